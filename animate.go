@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/yashikota/go-streaming-image-mosaic/internal/gifstream"
+	"github.com/yashikota/go-streaming-image-mosaic/mosaic"
+)
+
+// アニメーション GIF のタイルの大きさの一覧を表すフラグの値 (例: 4,8,16,32,64)
+type sizeList []int
+
+func (l *sizeList) String() string {
+	parts := make([]string, len(*l))
+	for i, n := range *l {
+		parts[i] = strconv.Itoa(n)
+	}
+	return strings.Join(parts, ",")
+}
+
+func (l *sizeList) Set(s string) error {
+	var sizes sizeList
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		n, err := strconv.Atoi(part)
+		if err != nil || n <= 0 {
+			return fmt.Errorf("invalid size %q (want positive integers such as 4,8,16)", part)
+		}
+		sizes = append(sizes, n)
+	}
+	*l = sizes
+	return nil
+}
+
+func (l *sizeList) Get() any {
+	return l.String()
+}
+
+// タイルの大きさを順に変えたアニメーション GIF の設定
+type animation struct {
+	sizes    []int
+	pingPong bool          // 最後の大きさから最初の大きさへ戻るフレームも加える
+	delay    time.Duration // 1 フレームを表示する時間
+	loop     int           // 繰り返しの回数 (0 で無限、-1 で 1 回だけ再生)
+}
+
+// フレームのタイルの大きさの順序
+// pingPong の場合は 4,8,16 を 4,8,16,8 のように折り返し、繰り返しで最初の大きさへ戻るようにする
+func (a *animation) frames() []int {
+	sizes := append([]int(nil), a.sizes...)
+	if a.pingPong {
+		for i := len(a.sizes) - 2; i > 0; i-- {
+			sizes = append(sizes, a.sizes[i])
+		}
+	}
+	return sizes
+}
+
+// GIF で使う色の数
+const animationColors = 256
+
+// src をタイルの大きさごとにモザイク処理し、アニメーション GIF として w に書き込む
+// 作業用の画像とフレームの画像は使い回し、フレームは処理するたびに書き出すため、メモリの使用量はフレームの数によらない
+// パレットは元画像から作り、すべてのフレームで共有する
+func (p pipeline) writeAnimation(ctx context.Context, logger *slog.Logger, w *countingWriter, src, region *image.NRGBA, opts []mosaic.Option) error {
+	palette := gifstream.MedianCut(src, animationColors)
+	size := src.Rect.Size()
+	enc, err := gifstream.NewEncoder(w, size.X, size.Y, palette, p.animate.loop)
+	if err != nil {
+		return p.fail(logger, stageEncode, err)
+	}
+	// GIF の表示時間は 1/100 秒単位
+	delay := int(p.animate.delay / (10 * time.Millisecond))
+	work := image.NewNRGBA(src.Rect)
+	frame := image.NewPaletted(src.Rect, palette)
+	cache := map[color.NRGBA]uint8{}
+	for _, tile := range p.animate.frames() {
+		copy(work.Pix, src.Pix)
+		target := work.SubImage(region.Rect).(*image.NRGBA)
+		if _, err := mosaic.New(target, tile, tile, opts...).ProcessInPlace(ctx); err != nil {
+			return p.fail(logger, stageProcess, fmt.Errorf("tile %d: %w", tile, err))
+		}
+		err := p.stats.timed(stageEncode, func() error {
+			gifstream.Quantize(frame, work, palette, cache)
+			return enc.Encode(frame, delay)
+		})
+		if err != nil {
+			return p.fail(logger, stageEncode, err)
+		}
+		logger.Debug("animation frame written", "tile", tile, "frame", enc.Frames())
+	}
+	if err := p.stats.timed(stageEncode, enc.Close); err != nil {
+		return p.fail(logger, stageEncode, err)
+	}
+	return nil
+}
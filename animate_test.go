@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image/gif"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAnimationFrames(t *testing.T) {
+	tests := []struct {
+		sizes    []int
+		pingPong bool
+		want     string
+	}{
+		{[]int{4, 8, 16}, false, "[4 8 16]"},
+		{[]int{4, 8, 16}, true, "[4 8 16 8]"},
+		{[]int{4, 8, 16, 32}, true, "[4 8 16 32 16 8]"},
+		{[]int{4, 8}, true, "[4 8]"},
+		{[]int{4}, true, "[4]"},
+	}
+	for _, tt := range tests {
+		a := animation{sizes: tt.sizes, pingPong: tt.pingPong}
+		if got := fmt.Sprint(a.frames()); got != tt.want {
+			t.Errorf("%v (pingpong %v): frames %s, want %s", tt.sizes, tt.pingPong, got, tt.want)
+		}
+	}
+}
+
+// -animate-sizes はタイルの大きさごとに 1 フレームを書き出し、-animate-pingpong は折り返して最初の大きさへ戻る
+func TestApplyAnimateSizes(t *testing.T) {
+	dir := t.TempDir()
+	in := filepath.Join(dir, "in.png")
+	writeTestImage(t, in, testImage(64, 48))
+
+	tests := []struct {
+		name   string
+		args   []string
+		frames int
+		loop   int
+		delay  int      // 1/100 秒単位
+		same   [][2]int // 同じ大きさで、画素が同じになるフレームの組
+	}{
+		{"sizes", []string{"-animate-sizes", "4,8,16,32"}, 4, 0, 50, nil},
+		{"pingpong", []string{"-animate-sizes", "4,8,16,32", "-animate-pingpong"}, 6, 0, 50, [][2]int{{1, 5}, {2, 4}}},
+		{"play once", []string{"-animate-sizes", "4,8", "-animate-loop", "-1", "-animate-delay", "120ms"}, 2, -1, 12, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out := filepath.Join(dir, tt.name+".gif")
+			args := append([]string{"apply", "-in", in, "-out", out, "-quiet"}, tt.args...)
+			if res := runCLI(t, args...); res.code != exitOK {
+				t.Fatalf("exit code = %d (stderr: %s)", res.code, res.stderr)
+			}
+			data, err := os.ReadFile(out)
+			if err != nil {
+				t.Fatal(err)
+			}
+			g, err := gif.DecodeAll(bytes.NewReader(data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(g.Image) != tt.frames || g.LoopCount != tt.loop {
+				t.Fatalf("%d frames, loop %d, want %d frames, loop %d", len(g.Image), g.LoopCount, tt.frames, tt.loop)
+			}
+			for i, frame := range g.Image {
+				if frame.Rect.Dx() != 64 || frame.Rect.Dy() != 48 || g.Delay[i] != tt.delay {
+					t.Errorf("frame %d: %v, delay %d", i, frame.Rect, g.Delay[i])
+				}
+			}
+			// 大きさの異なるフレームは異なり、折り返したフレームは行きのフレームと同じ
+			for i := 1; i < len(g.Image); i++ {
+				if bytes.Equal(g.Image[i].Pix, g.Image[i-1].Pix) {
+					t.Errorf("frames %d and %d are the same", i-1, i)
+				}
+			}
+			for _, pair := range tt.same {
+				if !bytes.Equal(g.Image[pair[0]].Pix, g.Image[pair[1]].Pix) {
+					t.Errorf("frames %d and %d differ", pair[0], pair[1])
+				}
+			}
+		})
+	}
+
+	for _, args := range [][]string{
+		{"-animate-sizes", "4,0"},
+		{"-animate-sizes", "4,8", "-format", "svg"},
+		{"-animate-sizes", "4,8", "-animate-loop", "-2"},
+	} {
+		res := runCLI(t, append([]string{"apply", "-in", in, "-out", filepath.Join(dir, "x.gif"), "-quiet"}, args...)...)
+		if res.code != exitUsage {
+			t.Errorf("%v: exit code = %d, want %d (stderr: %s)", args, res.code, exitUsage, res.stderr)
+		}
+	}
+}
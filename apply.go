@@ -0,0 +1,360 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/yashikota/go-streaming-image-mosaic/mosaic"
+)
+
+// apply のフラグ
+type applyFlags struct {
+	*commonFlags
+	in           *string
+	out          *string
+	metricsPush  *string
+	debugOverlay *string
+	overlayFill  *bool
+	exportTiles  *string
+	exportFormat *string
+	format       *string
+	quality      *int
+	compression  *string
+	htmlOriginal *bool
+	stitchLegend *string
+	stitchCell   *int
+	maxCols      *int
+	preview      *bool
+	animSizes    sizeList
+	outputs      outputList
+	block        blockSize
+	animDelay    *time.Duration
+	animLoop     *int
+	animPingPong *bool
+	fetchTimeout *time.Duration
+	fetchMaxSize *int64
+	insecure     *bool
+	dataMaxSize  *int64
+	json         *bool
+	report       *string
+	digest       *bool
+	outFormat    string // -format と -out から決めた出力の形式 (空の場合は JPEG)
+}
+
+func newApplyFlags(stderr io.Writer) *applyFlags {
+	c := newCommonFlags("apply", "[flags] [in [out]]", stderr)
+	f := &applyFlags{
+		commonFlags:  c,
+		in:           c.fs.String("in", "test.jpg", "入力画像のパス、http(s):// の URL または data URI (data:- の場合は data URI を標準入力から読む)"),
+		out:          c.fs.String("out", "result.jpg", "出力画像のパス (- の場合は標準出力、data: の場合は -format の形式の data URI を標準出力に書き出す)"),
+		metricsPush:  c.fs.String("metrics-push", "", "処理終了時にメトリクスを送信する Pushgateway の URL"),
+		debugOverlay: c.fs.String("debug-overlay", "", "タイルの境界と計算結果の色を描いたデバッグ用 PNG の出力先"),
+		overlayFill:  c.fs.Bool("debug-overlay-fill", true, "デバッグ用 PNG のタイルを計算結果の色で塗る"),
+		exportTiles:  c.fs.String("export-tiles", "", "タイルの位置と色を書き出すファイル (JSON または CSV)"),
+		exportFormat: c.fs.String("export-format", "", "-export-tiles の形式 (json、ndjson または csv、省略時は拡張子で決める)"),
+		format:       c.fs.String("format", "", "出力の形式 (jpeg、png などの画像の形式、各タイルを rect で表した svg、色の付いた div の格子で表した html、クロスステッチの図案の PNG の stitch、タイルを絵文字にしたテキストの emoji-text またはその PNG の emoji-png。省略時は出力のパスの拡張子で決め、拡張子がなければ jpeg)"),
+		quality:      c.fs.Int("quality", 0, "JPEG などの品質 (1〜100、0 で形式の既定)"),
+		compression:  c.fs.String("compression", "default", "PNG などの圧縮の程度 (default、none、fast または best)"),
+		htmlOriginal: c.fs.Bool("html-original", false, "-format html の出力に元画像を埋め込み、切り替えて表示できるようにする"),
+		stitchLegend: c.fs.String("stitch-legend", "", "-format stitch の凡例 (CSV) の書き出し先 (省略時は出力のパスの拡張子を _legend.csv にしたもの)"),
+		stitchCell:   c.fs.Int("stitch-cell", 16, "-format stitch の図案の 1 マスの大きさ (px)"),
+		maxCols:      c.fs.Int("max-cols", defaultEmojiMaxCols, "-format emoji-text で出力できるタイルの列の数の上限 (0 で無制限)"),
+		preview:      c.fs.Bool("preview", false, "処理後のタイルの格子を端末に色で表示する (-out - の場合は標準エラー出力、それ以外は標準出力)"),
+		fetchTimeout: c.fs.Duration("fetch-timeout", 30*time.Second, "URL から入力画像を取得する際の制限時間 (0 で無制限)"),
+		fetchMaxSize: c.fs.Int64("fetch-max-size", 256<<20, "URL から取得する入力画像の最大バイト数 (0 で無制限)"),
+		insecure:     c.fs.Bool("insecure", false, "URL から取得する際に TLS の証明書を検証しない"),
+		dataMaxSize:  c.fs.Int64("data-max-size", 64<<20, "入力の data URI 全体の最大バイト数 (0 で無制限)"),
+		json:         c.fs.Bool("json", false, "処理の要約 (入出力、使った設定、段階ごとの時間、警告) を JSON で出力する"),
+		report:       c.fs.String("report", "", "-json の要約の書き出し先 (省略時は標準出力)"),
+		digest:       c.fs.Bool("digest", false, "処理結果の画素の SHA-256 (エンコーダーによらない) を標準出力 (-out - の場合は標準エラー出力) に、-json の場合は要約に出力する"),
+		animDelay:    c.fs.Duration("animate-delay", 500*time.Millisecond, "-animate-sizes の 1 フレームを表示する時間 (10ms 単位)"),
+		animLoop:     c.fs.Int("animate-loop", 0, "-animate-sizes のアニメーションを繰り返す回数 (0 で無限、-1 で 1 回だけ再生)"),
+		animPingPong: c.fs.Bool("animate-pingpong", false, "-animate-sizes の最後の大きさから最初の大きさへ戻るフレームも加える"),
+	}
+	c.fs.Var(&f.block, "block", "幅 × 高さのブロック (`WxH`、例: 4096x1024) を単位に処理し、作業用のバッファを画像の幅によらない大きさにする")
+	c.fs.Var(&f.outputs, "output", "主の出力とは別のタイルの大きさでも書き出す (`tile:path[:quality]`、繰り返し指定できる。例: 16:med.jpg:85)")
+	c.fs.Var(&f.animSizes, "animate-sizes", "タイルの大きさを順に変えたアニメーション GIF を出力する (`list`、例: 4,8,16,32,64)")
+	return f
+}
+
+// 引数を解析
+// 位置引数で入力と出力のパスを指定した場合は -in と -out より優先する
+func (f *applyFlags) parse(args []string) error {
+	if err := f.commonFlags.parse(args); err != nil {
+		return err
+	}
+	rest := f.fs.Args()
+	if len(rest) > 2 {
+		return &usageError{fmt.Errorf("too many arguments: %q", rest)}
+	}
+	if len(rest) > 0 {
+		*f.in = rest[0]
+	}
+	if len(rest) > 1 {
+		*f.out = rest[1]
+	}
+	switch *f.exportFormat {
+	case "", exportJSON, exportNDJSON, exportCSV:
+	default:
+		return &usageError{fmt.Errorf("unknown export format %q (want json, ndjson or csv)", *f.exportFormat)}
+	}
+	var err error
+	if f.outFormat, err = outputEncoder(*f.format, *f.out); err != nil {
+		return err
+	}
+	f.settings.Quality, f.settings.Compression = *f.quality, *f.compression
+	if err := f.settings.Validate(); err != nil {
+		return &usageError{err}
+	}
+	f.settings = f.settings.Canonical()
+	if *f.stripe != "" && (*f.exportTiles != "" || f.tileFormat()) {
+		// 縞で分けたタイルは格子に並ばないため、タイルの色を書き出せない
+		return &usageError{errors.New("-stripe cannot be combined with -export-tiles or -format")}
+	}
+	if f.block != (blockSize{}) && (*f.exportTiles != "" || f.tileFormat() || len(f.animSizes) > 0) {
+		// ブロックの順に処理したタイルは格子の行の順に並ばない
+		return &usageError{errors.New("-block cannot be combined with -export-tiles, -format svg, html, stitch, emoji-text, emoji-png or -animate-sizes")}
+	}
+	if f.settings.ProcessesRegions() && (*f.exportTiles != "" || f.tileFormat() || f.block != (blockSize{}) || len(f.animSizes) > 0 || len(f.outputs) > 0 || *f.preview) {
+		// 範囲ごとにタイルの格子が異なるため、1 つの格子のタイルとして扱えない
+		return &usageError{errors.New("-region cannot be combined with -export-tiles, -format svg, html, stitch, emoji-text, emoji-png, -block, -animate-sizes, -output or -preview")}
+	}
+	if len(f.animSizes) > 0 {
+		if *f.exportTiles != "" || *f.format != "" || *f.debugOverlay != "" || *f.preview {
+			return &usageError{errors.New("-animate-sizes cannot be combined with -export-tiles, -format, -debug-overlay or -preview")}
+		}
+		if len(f.outputs) > 0 {
+			return &usageError{errors.New("-animate-sizes cannot be combined with -output")}
+		}
+		if *f.animDelay < 0 || *f.animDelay > 0xffff*10*time.Millisecond {
+			return &usageError{errors.New("animate-delay must be between 0 and 655.35s")}
+		}
+		if *f.animLoop < -1 || *f.animLoop > 0xffff {
+			return &usageError{errors.New("animate-loop must be between -1 and 65535")}
+		}
+	}
+	if *f.stitchCell < 2 {
+		return &usageError{errors.New("stitch-cell must be at least 2")}
+	}
+	if *f.maxCols < 0 {
+		return &usageError{errors.New("max-cols must not be negative")}
+	}
+	if *f.json && *f.report == "" && f.toStdout() {
+		// 画像と要約を同じ標準出力に書き出すと、どちらも読めなくなる
+		return &usageError{errors.New("-json with -out - or -out data: requires -report")}
+	}
+	if *f.json && *f.report == "" && *f.preview && !f.toStdout() {
+		return &usageError{errors.New("-json with -preview requires -report")}
+	}
+	if *f.digest && len(f.animSizes) > 0 {
+		return &usageError{errors.New("-digest cannot be combined with -animate-sizes")}
+	}
+	if *f.fetchTimeout < 0 || *f.fetchMaxSize < 0 {
+		return &usageError{errors.New("fetch-timeout and fetch-max-size must not be negative")}
+	}
+	if *f.dataMaxSize < 0 {
+		return &usageError{errors.New("data-max-size must not be negative")}
+	}
+	return nil
+}
+
+// 画像を標準出力に書き出すかどうか (-out - または -out data:)
+func (f *applyFlags) toStdout() bool {
+	return *f.out == stdoutPath || *f.out == dataURIOut
+}
+
+// タイルを要素で表す形式 (svg、html、stitch、emoji-text、emoji-png) で書き出すかどうか
+func (f *applyFlags) tileFormat() bool {
+	return mosaic.IsTileFormat(f.outFormat)
+}
+
+// 画像をモザイク処理する
+func runApply(args []string, stdout, stderr io.Writer) error {
+	f := newApplyFlags(stderr)
+	if err := f.parse(args); err != nil {
+		return err
+	}
+
+	bar := newProgressBar(stderr, *f.quiet)
+	logger, err := f.logger(bar.logOutput(stderr))
+	if err != nil {
+		return err
+	}
+
+	p := f.pipeline(logger)
+	p.debugOverlay = *f.debugOverlay
+	p.debugOverlayFill = *f.overlayFill
+	p.exportTiles = *f.exportTiles
+	p.exportFormat = *f.exportFormat
+	if f.tileFormat() {
+		p.format = f.outFormat
+	} else {
+		p.encoder = f.outFormat
+	}
+	compression, _ := mosaic.ParseCompression(p.settings.Compression)
+	p.encodeOpts = mosaic.EncodeOptions{Quality: p.settings.Quality, Compression: compression}
+	p.htmlOriginal = *f.htmlOriginal
+	if p.format == formatStitch {
+		p.stitchLegend = *f.stitchLegend
+		if p.stitchLegend == "" {
+			p.stitchLegend = defaultStitchLegend(*f.out)
+		}
+		p.stitchCell = *f.stitchCell
+	}
+	p.maxCols = *f.maxCols
+	p.outputs = f.outputs
+	p.block = f.block
+	if len(f.animSizes) > 0 {
+		p.animate = &animation{sizes: f.animSizes, pingPong: *f.animPingPong, delay: *f.animDelay, loop: *f.animLoop}
+	}
+	if *f.metricsPush != "" {
+		p.metrics = newMetrics()
+	}
+	if *f.json || *f.digest || *f.verbose {
+		// -v ではメモリの見積もりとヒープの変化をデバッグログに出力する
+		p.summaries = newSummaryLog(p)
+	}
+	p.digest = *f.digest
+
+	p.stdout = stdout
+	if *f.preview {
+		// 標準出力に画像を書き出す場合は、画像を壊さないよう標準エラー出力に描く
+		w := stdout
+		if f.toStdout() {
+			w = stderr
+		}
+		p.preview = newTerminalPreview(w, os.Getenv)
+	}
+
+	ctx := context.Background()
+	in := *f.in
+	if isDataURI(in) {
+		// 要約やログに本文を含めない
+		in = dataURIName(in)
+	}
+	progress := bar.callback(logger, in, 1, 1)
+	var runErr error
+	switch {
+	case isURL(*f.in):
+		fetch := newFetcher(*f.fetchTimeout, *f.fetchMaxSize, *f.insecure)
+		runErr = processURL(ctx, p, fetch, *f.in, *f.out, progress)
+	case isDataURI(*f.in):
+		runErr = processDataURI(ctx, p, *f.in, os.Stdin, *f.dataMaxSize, *f.out, progress)
+	default:
+		runErr = processFile(ctx, p, *f.in, *f.out, progress)
+	}
+	bar.finish()
+	if runErr == nil && p.preview != nil {
+		if err := p.preview.flush(); err != nil {
+			logger.Warn("failed to write preview", "error", err)
+		}
+	}
+
+	if *f.metricsPush != "" {
+		if err := p.metrics.push(*f.metricsPush); err != nil {
+			logger.Error("failed to push metrics", "error", err)
+		}
+	}
+	if *f.json {
+		// 失敗した場合も、失敗した入力の要約を書き出す
+		summary := mosaic.RunSummary{Total: 1, Files: []mosaic.FileSummary{p.summaries.file(in, *f.out, runErr)}}
+		if runErr != nil {
+			summary.Failed = 1
+		}
+		if err := writeSummaryTo(*f.report, stdout, summary); err != nil && runErr == nil {
+			return err
+		}
+	} else if *f.digest && runErr == nil {
+		w := stdout
+		if f.toStdout() {
+			w = stderr
+		}
+		if err := writeDigests(w, logger, []mosaic.FileSummary{p.summaries.file(in, *f.out, nil)}); err != nil {
+			return err
+		}
+	}
+	return runErr
+}
+
+// ファイルを読み込み、モザイク処理した結果をファイルに書き込む
+// progress が nil でなければバンドの処理が終わるたびに呼び出す
+func processFile(ctx context.Context, p pipeline, in, out string, progress mosaic.ProgressFunc) error {
+	file, err := os.Open(in)
+	if err != nil {
+		return &inputError{path: in, err: err}
+	}
+	defer file.Close()
+	return processReader(ctx, p, in, file, out, progress)
+}
+
+// URL から取得した画像をモザイク処理した結果をファイルに書き込む
+func processURL(ctx context.Context, p pipeline, fetch *fetcher, rawURL, out string, progress mosaic.ProgressFunc) error {
+	body, err := fetch.open(ctx, rawURL)
+	if err != nil {
+		return &inputError{path: rawURL, err: err}
+	}
+	defer body.Close()
+	err = processReader(ctx, p, rawURL, body, out, progress)
+	if err != nil && body.err != nil {
+		// 本文の取得に失敗した場合は、デコードのエラーではなく入力のエラーとする
+		return &inputError{path: rawURL, err: body.err}
+	}
+	return err
+}
+
+// r から読み込んだ画像をモザイク処理した結果をファイルに書き込む
+// in はエラーとログに使う入力の名前
+// out が - で p.stdout を設定した場合は p.stdout に、data: の場合は data URI にして p.stdout に書き込む
+func processReader(ctx context.Context, p pipeline, in string, r io.Reader, out string, progress mosaic.ProgressFunc) error {
+	var outFile io.WriteCloser
+	toStdout := (out == stdoutPath || out == dataURIOut) && p.stdout != nil
+	regular := false // 書きかけを削除してよい通常のファイルかどうか (名前付きパイプなどは削除しない)
+	switch {
+	case toStdout && out == dataURIOut:
+		outFile = newDataURIWriter(p.stdout, p.outputMediaType)
+	case toStdout:
+		outFile = nopWriteCloser{p.stdout}
+	default:
+		file, err := os.Create(out)
+		if err != nil {
+			return &outputError{path: out, err: err}
+		}
+		if info, err := file.Stat(); err == nil {
+			regular = info.Mode().IsRegular()
+		}
+		outFile = file
+	}
+
+	runErr := p.run(ctx, in, r, outFile, progress)
+	closeErr := outFile.Close()
+	if (runErr != nil || closeErr != nil) && regular {
+		// 書きかけの出力を残さない
+		os.Remove(out)
+	}
+
+	var (
+		stage   *stageError
+		output  *outputError
+		stalled *outputStalledError
+	)
+	if errors.As(runErr, &output) {
+		return runErr
+	}
+	if errors.As(runErr, &stalled) {
+		return &outputError{path: out, err: stalled}
+	}
+	if errors.As(runErr, &stage) && stage.stage == stageEncode {
+		return &outputError{path: out, err: runErr}
+	}
+	if runErr != nil {
+		return fmt.Errorf("%s: %w", in, runErr)
+	}
+	if closeErr != nil {
+		return &outputError{path: out, err: closeErr}
+	}
+	return nil
+}
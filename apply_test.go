@@ -0,0 +1,584 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+	"image/jpeg"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/yashikota/go-streaming-image-mosaic/mosaic"
+)
+
+func TestApplyOutputFormat(t *testing.T) {
+	dir := t.TempDir()
+	in := filepath.Join(dir, "in.png")
+	writeTestImage(t, in, testImage(32, 24))
+
+	tests := []struct {
+		name   string
+		args   []string // -in と -tile に続けるフラグ
+		out    string
+		format string // 書き出した画像の形式 (空の場合は画像でない)
+		prefix string // 画像でない場合の先頭
+	}{
+		{"extension", nil, "out.png", "png", ""},
+		{"format wins", []string{"-format", "png"}, "out.jpg", "png", ""},
+		{"no extension", nil, "out", "jpeg", ""},
+		{"svg extension", nil, "out.svg", "", "<?xml"},
+		{"html format", []string{"-format", "html"}, "out.dat", "", "<!DOCTYPE html>"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out := filepath.Join(dir, tt.out)
+			args := append([]string{"apply", "-in", in, "-tile", "8", "-quiet", "-out", out}, tt.args...)
+			if res := runCLI(t, args...); res.code != exitOK {
+				t.Fatalf("exit code = %d (stderr: %s)", res.code, res.stderr)
+			}
+			data, err := os.ReadFile(out)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.format == "" {
+				if !bytes.HasPrefix(data, []byte(tt.prefix)) {
+					t.Errorf("output starts with %q, want %q", data[:min(len(data), 32)], tt.prefix)
+				}
+				return
+			}
+			if _, format, err := image.DecodeConfig(bytes.NewReader(data)); err != nil || format != tt.format {
+				t.Errorf("written as %s (%v), want %s", format, err, tt.format)
+			}
+		})
+	}
+}
+
+func TestApplyUnknownOutputFormat(t *testing.T) {
+	dir := t.TempDir()
+	in := filepath.Join(dir, "in.png")
+	writeTestImage(t, in, testImage(16, 16))
+	for _, args := range [][]string{
+		{"-out", filepath.Join(dir, "out.webp")},
+		{"-out", filepath.Join(dir, "out.png"), "-format", "webp"},
+	} {
+		res := runCLI(t, append([]string{"apply", "-in", in, "-quiet"}, args...)...)
+		if res.code != exitUsage {
+			t.Fatalf("%v: exit code = %d, want %d", args, res.code, exitUsage)
+		}
+		// 書き出せる形式を並べ、JPEG で書き出さない
+		if !strings.Contains(res.stderr, "jpeg, png") || !strings.Contains(res.stderr, "emoji-png") {
+			t.Errorf("%v: stderr %q does not list the formats", args, res.stderr)
+		}
+		if _, err := os.Stat(args[1]); !os.IsNotExist(err) {
+			t.Errorf("%v: output was written", args)
+		}
+	}
+}
+
+// 幅か高さが 0 の画像はデコードのエラーにし、出力を書き出さない
+func TestApplyEmptyImage(t *testing.T) {
+	dir := t.TempDir()
+	var buf bytes.Buffer
+	if err := gif.Encode(&buf, image.NewPaletted(image.Rect(0, 0, 0, 4), color.Palette{color.Black}), nil); err != nil {
+		t.Fatal(err)
+	}
+	in, out := filepath.Join(dir, "empty.gif"), filepath.Join(dir, "out.png")
+	writeTestFile(t, in, buf.Bytes())
+	res := runCLI(t, "apply", "-in", in, "-out", out, "-tile", "8", "-quiet")
+	if res.code != exitDecode || !strings.Contains(res.stderr, mosaic.ErrEmptyImage.Error()) {
+		t.Errorf("exit code = %d, want %d (stderr: %s)", res.code, exitDecode, res.stderr)
+	}
+	if _, err := os.Stat(out); !os.IsNotExist(err) {
+		t.Errorf("output was written: %v", err)
+	}
+
+	// 1×1 の画像は画像より大きいタイルでもそのまま残る
+	one := image.NewNRGBA(image.Rect(0, 0, 1, 1))
+	one.SetNRGBA(0, 0, color.NRGBA{12, 34, 56, 255})
+	writeTestImage(t, filepath.Join(dir, "one.png"), one)
+	if res := runCLI(t, "apply", "-in", filepath.Join(dir, "one.png"), "-out", out, "-tile", "100", "-quiet"); res.code != exitOK {
+		t.Fatalf("1x1: exit code = %d (stderr: %s)", res.code, res.stderr)
+	}
+	assertSameNRGBA(t, readTestImage(t, out), one)
+}
+
+// -adjust-scope all は -select で選ばなかった画素の色も変換する
+func TestApplyAdjustScope(t *testing.T) {
+	dir := t.TempDir()
+	src := testImage(48, 40)
+	in := filepath.Join(dir, "in.png")
+	writeTestImage(t, in, src)
+	sel := image.Rect(8, 8, 32, 24)
+	for _, tt := range []struct {
+		scope string
+		opts  []mosaic.Option
+	}{
+		{"region", nil},
+		{"all", []mosaic.Option{mosaic.WithAdjustScope(mosaic.AdjustAll)}},
+	} {
+		out := filepath.Join(dir, tt.scope+".png")
+		res := runCLI(t, "apply", "-in", in, "-out", out, "-tile", "8", "-quiet", "-brightness", "-40", "-select", "rect(8,8,24,16)", "-adjust-scope", tt.scope)
+		if res.code != exitOK {
+			t.Fatalf("%s: exit code = %d (stderr: %s)", tt.scope, res.code, res.stderr)
+		}
+		opts := append([]mosaic.Option{mosaic.WithSelection(mosaic.Rects(sel)), mosaic.WithColorAdjust(mosaic.Brightness(-40))}, tt.opts...)
+		want, err := mosaic.New(src, 8, 8, opts...).ProcessContext(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertSameNRGBA(t, readTestImage(t, out), want)
+	}
+
+	// 変換がない場合はどちらの範囲でも同じバイト列になる
+	var outputs [][]byte
+	for _, scope := range []string{"region", "all"} {
+		out := filepath.Join(dir, "identity-"+scope+".png")
+		if res := runCLI(t, "apply", "-in", in, "-out", out, "-tile", "8", "-quiet", "-select", "rect(8,8,24,16)", "-adjust-scope", scope); res.code != exitOK {
+			t.Fatalf("exit code = %d (stderr: %s)", res.code, res.stderr)
+		}
+		data, err := os.ReadFile(out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		outputs = append(outputs, data)
+	}
+	if !bytes.Equal(outputs[0], outputs[1]) {
+		t.Error("-adjust-scope all without adjustments changed the output")
+	}
+
+	if res := runCLI(t, "apply", "-in", in, "-out", filepath.Join(dir, "x.png"), "-adjust-scope", "selection"); res.code != exitUsage || !strings.Contains(res.stderr, "adjust scope") {
+		t.Errorf("unknown scope: exit code = %d (stderr: %s)", res.code, res.stderr)
+	}
+}
+
+func TestApplyCropOffset(t *testing.T) {
+	dir := t.TempDir()
+	full := testImage(200, 150)
+	writeTestImage(t, filepath.Join(dir, "full.png"), full)
+	if res := runCLI(t, "apply", "-in", filepath.Join(dir, "full.png"), "-out", filepath.Join(dir, "full-out.png"), "-tile", "16", "-grid-origin", "5,3", "-quiet"); res.code != exitOK {
+		t.Fatalf("full: exit code = %d (stderr: %s)", res.code, res.stderr)
+	}
+	want := readTestImage(t, filepath.Join(dir, "full-out.png"))
+
+	// 格子の境界 (5+16n, 3+16n) で切り出した 4 つの画像を、元画像の中の位置を指定して処理し、つなぎ合わせる
+	split := image.Pt(101, 67)
+	crops := []image.Rectangle{
+		image.Rect(0, 0, split.X, split.Y),
+		image.Rect(split.X, 0, 200, split.Y),
+		image.Rect(0, split.Y, split.X, 150),
+		image.Rect(split.X, split.Y, 200, 150),
+	}
+	stitched := image.NewNRGBA(full.Rect)
+	for i, r := range crops {
+		crop := image.NewNRGBA(image.Rect(0, 0, r.Dx(), r.Dy()))
+		draw.Draw(crop, crop.Rect, full, r.Min, draw.Src)
+		in, out := filepath.Join(dir, fmt.Sprintf("crop%d.png", i)), filepath.Join(dir, fmt.Sprintf("crop%d-out.png", i))
+		writeTestImage(t, in, crop)
+		offset := fmt.Sprintf("%d,%d", r.Min.X, r.Min.Y)
+		if res := runCLI(t, "apply", "-in", in, "-out", out, "-tile", "16", "-grid-origin", "5,3", "-crop-offset", offset, "-quiet"); res.code != exitOK {
+			t.Fatalf("crop %v: exit code = %d (stderr: %s)", r, res.code, res.stderr)
+		}
+		draw.Draw(stitched, r, readTestImage(t, out), image.Point{}, draw.Src)
+	}
+	assertSameNRGBA(t, stitched, want)
+}
+
+func TestApplyStreamingJPEGMatchesBuffered(t *testing.T) {
+	dir := t.TempDir()
+	in := filepath.Join(dir, "in.png")
+	// 高さが MCU の高さの倍数でない画像で、最後のバンドも確かめる
+	src := testImage(100, 75)
+	writeTestImage(t, in, src)
+
+	tests := []struct {
+		tile int
+		mode string
+	}{
+		{16, "mode=streaming"},
+		{12, "reason=\"tile 12 is not a multiple of 16\""},
+	}
+	for _, tt := range tests {
+		for _, quality := range []int{0, 90} {
+			out := filepath.Join(dir, fmt.Sprintf("out%d-%d.jpg", tt.tile, quality))
+			args := []string{"apply", "-in", in, "-out", out, "-tile", fmt.Sprint(tt.tile), "-v"}
+			var o *jpeg.Options
+			if quality > 0 {
+				args = append(args, "-quality", fmt.Sprint(quality))
+				o = &jpeg.Options{Quality: quality}
+			}
+			res := runCLI(t, args...)
+			if res.code != exitOK {
+				t.Fatalf("tile %d: exit code = %d (stderr: %s)", tt.tile, res.code, res.stderr)
+			}
+			if !strings.Contains(res.stderr, tt.mode) {
+				t.Errorf("tile %d: log does not contain %s:\n%s", tt.tile, tt.mode, res.stderr)
+			}
+			got, err := os.ReadFile(out)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// 同じモザイクを image/jpeg でまとめてエンコードした結果と一致する
+			processed, err := mosaic.New(src, tt.tile, tt.tile).ProcessContext(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			var want bytes.Buffer
+			if err := jpeg.Encode(&want, processed, o); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, want.Bytes()) {
+				t.Errorf("tile %d quality %d: output differs from image/jpeg (%d, %d bytes)", tt.tile, quality, len(got), want.Len())
+			}
+		}
+	}
+}
+
+func TestApplyExcludeColors(t *testing.T) {
+	dir := t.TempDir()
+	in := filepath.Join(dir, "in.png")
+	src := testImage(32, 32)
+	keys := []color.NRGBA{{255, 0, 255, 255}, {0, 255, 0, 255}, {0, 0, 250, 255}}
+	for y := 0; y < 32; y++ {
+		for x := 0; x < 32; x++ {
+			if (x+y)%5 == 0 {
+				src.SetNRGBA(x, y, keys[(x/5)%len(keys)])
+			}
+		}
+	}
+	writeTestImage(t, in, src)
+
+	// -exclude-color は繰り返しても、カンマで区切ってもよい
+	for _, args := range [][]string{
+		{"-exclude-color", "#ff00ff", "-exclude-color", "#00ff00,#0000ff", "-exclude-tolerance", "5"},
+		{"-exclude-color", "#ff00ff,#00ff00", "-exclude-color", "#0000fa"},
+	} {
+		out := filepath.Join(dir, "out.png")
+		res := runCLI(t, append([]string{"apply", "-in", in, "-out", out, "-tile", "8", "-quiet"}, args...)...)
+		if res.code != exitOK {
+			t.Fatalf("%v: exit code = %d (stderr: %s)", args, res.code, res.stderr)
+		}
+		got := readTestImage(t, out)
+		want := mosaic.New(src, 8, 8, mosaic.WithExclude(mosaic.ExcludeColors(5, keys...))).Process()
+		assertSameNRGBA(t, got, want)
+		for y := 0; y < 32; y++ {
+			for x := 0; x < 32; x++ {
+				if (x+y)%5 == 0 && got.NRGBAAt(x, y) != src.NRGBAAt(x, y) {
+					t.Fatalf("%v: key pixel (%d, %d) changed to %v", args, x, y, got.NRGBAAt(x, y))
+				}
+			}
+		}
+	}
+	if res := runCLI(t, "apply", "-in", in, "-out", filepath.Join(dir, "bad.png"), "-exclude-color", "#ff00ff,magenta"); res.code != exitUsage {
+		t.Errorf("bad color: exit code = %d, want %d", res.code, exitUsage)
+	}
+}
+
+// -style lego、-baseplate と -lego-palette はライブラリの LegoRenderer と PaletteAdjust と同じ画像になる
+// render でタイルの色から描き直しても同じ画像になる
+func TestApplyLegoStyle(t *testing.T) {
+	dir := t.TempDir()
+	src := testImage(97, 61)
+	in := filepath.Join(dir, "in.png")
+	writeTestImage(t, in, src)
+	plate := color.NRGBA{0x23, 0x78, 0x41, 255}
+	for _, tt := range []struct {
+		name string
+		args []string
+		opts []mosaic.Option
+	}{
+		{"studs", nil, []mosaic.Option{mosaic.WithTileRenderer(mosaic.LegoRenderer{})}},
+		{"baseplate", []string{"-baseplate", "#237841"}, []mosaic.Option{mosaic.WithTileRenderer(mosaic.LegoRenderer{Baseplate: plate})}},
+		{"palette", []string{"-lego-palette"}, []mosaic.Option{mosaic.WithTileRenderer(mosaic.LegoRenderer{}), mosaic.WithColorAdjust(mosaic.PaletteAdjust(mosaic.LegoPalette))}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			out := filepath.Join(dir, tt.name+".png")
+			tiles := filepath.Join(dir, tt.name+".json")
+			args := append([]string{"apply", "-in", in, "-out", out, "-tile", "16", "-quiet", "-style", "lego", "-export-tiles", tiles}, tt.args...)
+			if res := runCLI(t, args...); res.code != exitOK {
+				t.Fatalf("exit code = %d (stderr: %s)", res.code, res.stderr)
+			}
+			want, err := mosaic.New(src, 16, 16, tt.opts...).ProcessContext(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			assertSameNRGBA(t, readTestImage(t, out), want)
+
+			// パレットの色はタイルの色として書き出されるため、render には -lego-palette を渡さない
+			rendered := filepath.Join(dir, tt.name+"-render.png")
+			args = []string{"render", "-tiles", tiles, "-out", rendered, "-quiet", "-style", "lego"}
+			if tt.name == "baseplate" {
+				args = append(args, "-baseplate", "#237841")
+			}
+			if res := runCLI(t, args...); res.code != exitOK {
+				t.Fatalf("render: exit code = %d (stderr: %s)", res.code, res.stderr)
+			}
+			assertSameNRGBA(t, readTestImage(t, rendered), want)
+		})
+	}
+
+	if res := runCLI(t, "apply", "-in", in, "-out", filepath.Join(dir, "x.png"), "-style", "duplo"); res.code != exitUsage || !strings.Contains(res.stderr, "unknown style") {
+		t.Errorf("unknown style: exit code = %d (stderr: %s)", res.code, res.stderr)
+	}
+}
+
+// -label-colors はタイルの幅と高さが -label-min-size 以上の場合だけコードを描く
+// 97x61 の画像を 48px で分けると、48x48 のタイルは 2 つだけになる
+func TestApplyLabelColors(t *testing.T) {
+	dir := t.TempDir()
+	src := testImage(97, 61)
+	in := filepath.Join(dir, "in.png")
+	writeTestImage(t, in, src)
+	plain, err := mosaic.New(src, 48, 48).ProcessContext(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	labeled, err := mosaic.New(src, 48, 48, mosaic.WithTileRenderer(mosaic.LabelRenderer{MinSize: 48})).ProcessContext(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		args   []string
+		labels int // コードを描いたタイルの数
+	}{
+		{nil, 2},
+		{[]string{"-label-min-size", "48"}, 2},
+		{[]string{"-label-min-size", "49"}, 0},
+	} {
+		out := filepath.Join(dir, "out.png")
+		args := append([]string{"apply", "-in", in, "-out", out, "-tile", "48", "-quiet", "-label-colors"}, tt.args...)
+		if res := runCLI(t, args...); res.code != exitOK {
+			t.Fatalf("%v: exit code = %d (stderr: %s)", tt.args, res.code, res.stderr)
+		}
+		got := readTestImage(t, out)
+		if tt.labels == 0 {
+			assertSameNRGBA(t, got, plain)
+			continue
+		}
+		assertSameNRGBA(t, got, labeled)
+		// 無地のモザイクと異なる画素を含むタイルを数える
+		diff := map[image.Point]bool{}
+		for y := 0; y < 61; y++ {
+			for x := 0; x < 97; x++ {
+				if got.NRGBAAt(x, y) != plain.NRGBAAt(x, y) {
+					diff[image.Pt(x/48, y/48)] = true
+				}
+			}
+		}
+		if n := len(diff); n != tt.labels || n > 0 && !(diff[image.Pt(0, 0)] && diff[image.Pt(1, 0)]) {
+			t.Errorf("%v: tiles %v labeled, want the %d tiles of 48x48", tt.args, diff, tt.labels)
+		}
+	}
+}
+
+// -pattern と -pattern-invert は WithTilePattern と同じタイルだけを処理する
+func TestApplyPattern(t *testing.T) {
+	dir := t.TempDir()
+	src := testImage(50, 37)
+	in := filepath.Join(dir, "in.png")
+	writeTestImage(t, in, src)
+	for _, tt := range []struct {
+		args    []string
+		pattern mosaic.TilePattern
+	}{
+		{[]string{"-pattern", "checker"}, mosaic.CheckerPattern},
+		{[]string{"-pattern", "stripes-h"}, mosaic.StripesHPattern},
+		{[]string{"-pattern", "stripes-v", "-pattern-invert"}, mosaic.InvertPattern(mosaic.StripesVPattern)},
+	} {
+		out := filepath.Join(dir, "out.png")
+		args := append([]string{"apply", "-in", in, "-out", out, "-tile", "8", "-quiet"}, tt.args...)
+		if res := runCLI(t, args...); res.code != exitOK {
+			t.Fatalf("%v: exit code = %d (stderr: %s)", tt.args, res.code, res.stderr)
+		}
+		want, err := mosaic.New(src, 8, 8, mosaic.WithTilePattern(tt.pattern)).ProcessContext(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertSameNRGBA(t, readTestImage(t, out), want)
+	}
+	if res := runCLI(t, "apply", "-in", in, "-out", filepath.Join(dir, "x.png"), "-pattern", "zigzag"); res.code != exitUsage || !strings.Contains(res.stderr, "unknown pattern") {
+		t.Errorf("unknown pattern: exit code = %d (stderr: %s)", res.code, res.stderr)
+	}
+}
+
+// -stripe は WithStripes と同じ行だけを処理する
+func TestApplyStripe(t *testing.T) {
+	dir := t.TempDir()
+	src := testImage(48, 100)
+	in := filepath.Join(dir, "in.png")
+	writeTestImage(t, in, src)
+	out := filepath.Join(dir, "out.png")
+	if res := runCLI(t, "apply", "-in", in, "-out", out, "-tile", "16", "-quiet", "-stripe", "40:20"); res.code != exitOK {
+		t.Fatalf("exit code = %d (stderr: %s)", res.code, res.stderr)
+	}
+	want, err := mosaic.New(src, 16, 16, mosaic.WithStripes(40, 20)).ProcessContext(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := readTestImage(t, out)
+	assertSameNRGBA(t, got, want)
+	// 残す縞の行は入力のまま
+	for _, y := range []int{40, 50, 59} {
+		if c := got.NRGBAAt(5, y); c != src.NRGBAAt(5, y) {
+			t.Errorf("row %d in the skipped stripe: %v, want %v", y, c, src.NRGBAAt(5, y))
+		}
+	}
+
+	for _, args := range [][]string{
+		{"-stripe", "40"},
+		{"-stripe", "0:20"},
+		{"-stripe", "40:20", "-export-tiles", filepath.Join(dir, "tiles.json")},
+	} {
+		res := runCLI(t, append([]string{"apply", "-in", in, "-out", filepath.Join(dir, "x.png"), "-quiet"}, args...)...)
+		if res.code != exitUsage {
+			t.Errorf("%v: exit code = %d, want %d (stderr: %s)", args, res.code, exitUsage, res.stderr)
+		}
+	}
+}
+
+// すべて 255 の -strength-map は完全なモザイク、すべて 0 は元画像と同じ画像になる
+// 大きさが入力と異なるマップは入力のエラーにする
+func TestApplyStrengthMap(t *testing.T) {
+	dir := t.TempDir()
+	src := testImage(50, 37)
+	in := filepath.Join(dir, "in.png")
+	writeTestImage(t, in, src)
+	full := filepath.Join(dir, "full.png")
+	if res := runCLI(t, "apply", "-in", in, "-out", full, "-tile", "8", "-quiet"); res.code != exitOK {
+		t.Fatalf("exit code = %d (stderr: %s)", res.code, res.stderr)
+	}
+	for _, tt := range []struct {
+		name  string
+		value uint8
+		want  *image.NRGBA
+	}{
+		{"all 255", 255, readTestImage(t, full)},
+		{"all 0", 0, src},
+	} {
+		m := image.NewGray(src.Rect)
+		draw.Draw(m, m.Rect, image.NewUniform(color.Gray{tt.value}), image.Point{}, draw.Src)
+		mapPath := filepath.Join(dir, "map.png")
+		writeTestImage(t, mapPath, m)
+		out := filepath.Join(dir, "out.png")
+		if res := runCLI(t, "apply", "-in", in, "-out", out, "-tile", "8", "-quiet", "-strength-map", mapPath); res.code != exitOK {
+			t.Fatalf("%s: exit code = %d (stderr: %s)", tt.name, res.code, res.stderr)
+		}
+		assertSameNRGBA(t, readTestImage(t, out), tt.want)
+	}
+
+	mapPath := filepath.Join(dir, "small.png")
+	writeTestImage(t, mapPath, image.NewGray(image.Rect(0, 0, 49, 37)))
+	res := runCLI(t, "apply", "-in", in, "-out", filepath.Join(dir, "x.png"), "-tile", "8", "-quiet", "-strength-map", mapPath)
+	if res.code != exitInput || !strings.Contains(res.stderr, "strength map is 49x37 but the image is 50x37") {
+		t.Errorf("size mismatch: exit code = %d (stderr: %s)", res.code, res.stderr)
+	}
+}
+
+// -debug-overlay はオーバーレイの PNG を別に書き出し、出力画像は指定しない場合と同じバイト列になる
+// -region では範囲の輪郭、-select-luma では選んだ画素の輪郭を OutlineColor で描く
+func TestApplyDebugOverlay(t *testing.T) {
+	dir := t.TempDir()
+	src := testImage(48, 40)
+	in := filepath.Join(dir, "in.png")
+	writeTestImage(t, in, src)
+	dimmed := mosaic.Dim(src, 0.5)
+
+	for _, tt := range []struct {
+		name string
+		args []string
+		// オーバーレイの画素の期待値 (GridColor、OutlineColor または暗くした元画像)
+		pixels  map[image.Point]color.NRGBA
+		outline bool // OutlineColor の画素があるかどうか
+	}{
+		{"grid", []string{"-grid-origin", "3,2"}, map[image.Point]color.NRGBA{
+			{3, 10}: mosaic.GridColor, {20, 2}: mosaic.GridColor, {10, 9}: mosaic.GridColor,
+		}, false},
+		{"jpeg", []string{"-format", "jpeg"}, map[image.Point]color.NRGBA{{0, 0}: mosaic.GridColor, {7, 20}: mosaic.GridColor}, false},
+		{"region", []string{"-region", "4,4,20,20", "-region", "30,30,40,40:tile=4"}, map[image.Point]color.NRGBA{
+			{4, 4}: mosaic.OutlineColor, {23, 12}: mosaic.OutlineColor, {30, 39}: mosaic.OutlineColor, {47, 35}: mosaic.OutlineColor,
+			{8, 10}: mosaic.GridColor, {35, 33}: mosaic.GridColor,
+			{40, 2}: dimmed.NRGBAAt(40, 2), {2, 30}: dimmed.NRGBAAt(2, 30),
+		}, true},
+		{"select", []string{"-select-luma", ">=0.5"}, nil, true},
+	} {
+		plain := filepath.Join(dir, tt.name+"-plain.out")
+		withOverlay := filepath.Join(dir, tt.name+"-overlay.out")
+		debug := filepath.Join(dir, tt.name+"-debug.png")
+		args := append([]string{"-in", in, "-tile", "8", "-quiet"}, tt.args...)
+		if tt.name != "jpeg" {
+			args = append(args, "-format", "png")
+		}
+		if res := runCLI(t, append([]string{"apply", "-out", plain}, args...)...); res.code != exitOK {
+			t.Fatalf("%s: exit code = %d (stderr: %s)", tt.name, res.code, res.stderr)
+		}
+		if res := runCLI(t, append([]string{"apply", "-out", withOverlay, "-debug-overlay", debug}, args...)...); res.code != exitOK {
+			t.Fatalf("%s: exit code = %d (stderr: %s)", tt.name, res.code, res.stderr)
+		}
+		want, err := os.ReadFile(plain)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := os.ReadFile(withOverlay)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("%s: output differs with -debug-overlay", tt.name)
+		}
+
+		overlay := readTestImage(t, debug)
+		if overlay.Rect != src.Rect {
+			t.Fatalf("%s: overlay bounds %v, want %v", tt.name, overlay.Rect, src.Rect)
+		}
+		for p, want := range tt.pixels {
+			if got := overlay.NRGBAAt(p.X, p.Y); got != want {
+				t.Errorf("%s: pixel %v = %v, want %v", tt.name, p, got, want)
+			}
+		}
+		outline := false
+		for y := overlay.Rect.Min.Y; y < overlay.Rect.Max.Y; y++ {
+			for x := overlay.Rect.Min.X; x < overlay.Rect.Max.X; x++ {
+				outline = outline || overlay.NRGBAAt(x, y) == mosaic.OutlineColor
+			}
+		}
+		if outline != tt.outline {
+			t.Errorf("%s: outline drawn = %v, want %v", tt.name, outline, tt.outline)
+		}
+	}
+}
+
+// ppm と rgba の通常のファイルへの出力は、バンドをその位置に並列に書き込み、標準出力に順に書き出した場合と同じバイト列になる
+func TestApplyOffsetFormats(t *testing.T) {
+	dir := t.TempDir()
+	in := filepath.Join(dir, "in.png")
+	writeTestImage(t, in, testImage(123, 77))
+	for _, format := range []string{"ppm", "rgba"} {
+		serial := runCLI(t, "apply", "-in", in, "-out", "-", "-format", format, "-tile", "6", "-quiet")
+		if serial.code != exitOK {
+			t.Fatalf("%s: exit code = %d (stderr: %s)", format, serial.code, serial.stderr)
+		}
+		out := filepath.Join(dir, "out."+format)
+		res := runCLI(t, "apply", "-in", in, "-out", out, "-tile", "6", "-parallel", "8", "-v")
+		if res.code != exitOK {
+			t.Fatalf("%s: exit code = %d (stderr: %s)", format, res.code, res.stderr)
+		}
+		if !strings.Contains(res.stderr, "mode=offsets") {
+			t.Errorf("%s: bands not written at offsets (stderr: %s)", format, res.stderr)
+		}
+		got, err := os.ReadFile(out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, []byte(serial.stdout)) {
+			t.Errorf("%s: file output differs from the serial output", format)
+		}
+		if want := fmt.Sprintf("bytes_out=%d", len(got)); !strings.Contains(res.stderr, want) {
+			t.Errorf("%s: stderr does not contain %s (stderr: %s)", format, want, res.stderr)
+		}
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/png"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/yashikota/go-streaming-image-mosaic/internal/tiff"
+	"github.com/yashikota/go-streaming-image-mosaic/mosaic"
+)
+
+var (
+	errBandsTIFF    = errors.New("band streaming is not supported for TIFF")
+	errBandsRegions = errors.New("band streaming is not supported with -region")
+)
+
+// 処理済みのバンドを受け取る関数
+// bounds は画像全体の範囲で、band のうち rect の範囲が処理済み
+type bandSink func(bounds image.Rectangle, band *image.NRGBA, rect image.Rectangle) error
+
+// 画像を読み込み、処理済みのバンドを上から順に fn に渡す
+// tolerant で復元できなかった行は、塗りつぶした範囲を最後のバンドとして渡す
+// 処理したバンドの数を返却
+func (p pipeline) runBands(ctx context.Context, name string, r io.Reader, fn bandSink) (int, error) {
+	logger := p.logger
+	if logger == nil {
+		logger = discardLogger
+	}
+	logger = p.warningLogger(logger.With("input", name))
+	start := time.Now()
+	logger.Info("processing started", "tile", p.tile, "mode", "bands")
+
+	if p.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.timeout)
+		defer cancel()
+		r = &contextReader{ctx: ctx, r: r}
+	}
+	if p.settings.ProcessesRegions() {
+		return 0, p.fail(logger, stageProcess, errBandsRegions)
+	}
+	br := bufio.NewReader(r)
+	if magic, _ := br.Peek(4); tiff.IsTIFF(magic) {
+		return 0, p.fail(logger, stageDecode, errBandsTIFF)
+	}
+	p, br, err := p.withInputDensity(logger, br)
+	if err != nil {
+		return 0, p.fail(logger, stageDecode, err)
+	}
+	src, region, format, err := p.decodeSource(logger, br)
+	if err != nil {
+		return 0, p.fail(logger, stageDecode, err)
+	}
+	opts, err := p.options(logger, nil, src)
+	if err != nil {
+		return 0, p.fail(logger, stageProcess, err)
+	}
+
+	bands := 0
+	var sinkErr error
+	opts = append(opts, mosaic.WithPrefetch(bandPrefetch))
+	err = mosaic.New(region, p.tile, p.tile, opts...).ProcessBands(ctx, func(band *image.NRGBA, rect image.Rectangle) error {
+		bands++
+		sinkErr = fn(src.Rect, band, rect)
+		return sinkErr
+	})
+	if sinkErr != nil {
+		return bands, p.fail(logger, stageEncode, sinkErr)
+	}
+	if err != nil {
+		return bands, p.fail(logger, stageProcess, err)
+	}
+	if region.Rect.Max.Y < src.Rect.Max.Y {
+		bands++
+		rest := image.Rect(src.Rect.Min.X, region.Rect.Max.Y, src.Rect.Max.X, src.Rect.Max.Y)
+		if err := fn(src.Rect, src, rest); err != nil {
+			return bands, p.fail(logger, stageEncode, err)
+		}
+	}
+
+	if p.metrics != nil {
+		p.metrics.imageProcessed(format)
+	}
+	logger.Info("processing finished", "format", format, "bands", bands, "duration", time.Since(start))
+	return bands, nil
+}
+
+// Accept で multipart/mixed を求めているかどうか
+func wantsMultipart(r *http.Request) bool {
+	for _, v := range strings.Split(r.Header.Get("Accept"), ",") {
+		if mt, _, err := mime.ParseMediaType(strings.TrimSpace(v)); err == nil && mt == "multipart/mixed" {
+			return true
+		}
+	}
+	return false
+}
+
+// 処理の結果の最後のパート
+type bandSummary struct {
+	Width      int    `json:"width"`
+	Height     int    `json:"height"`
+	Bands      int    `json:"bands"`
+	DurationMS int64  `json:"duration_ms"`
+	Error      string `json:"error,omitempty"`
+	Status     int    `json:"status,omitempty"` // 失敗した場合に、一括で返す場合と同じ HTTP ステータス
+
+	Warnings []mosaic.Warning `json:"warnings,omitempty"` // 処理中に記録した警告
+}
+
+// バンドを処理するたびに、PNG にしたバンドを multipart/mixed の 1 つのパートとして返す
+// 各パートには画像全体の大きさとバンドの位置をヘッダーで付け、最後のパートに JSON の要約を返す
+// checksum (crc32、crc32c) を指定した場合は、バンドの画素のチェックサムを X-Band-Checksum に付ける
+// 最初のバンドを送った後はステータスを変えられないため、失敗は要約の error と status で伝える
+func (s *server) handleProcessBands(w http.ResponseWriter, r *http.Request, p pipeline) {
+	start := time.Now()
+	var checksum mosaic.ChecksumAlgorithm
+	if v := r.URL.Query().Get("checksum"); v != "" {
+		alg, ok := mosaic.ChecksumAlgorithmByName(v)
+		if !ok {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("unknown checksum %q (want %s)", v, strings.Join(mosaic.ChecksumAlgorithms(), ", ")))
+			return
+		}
+		checksum = alg
+	}
+	mw := multipart.NewWriter(w)
+	rc := http.NewResponseController(w)
+	var bounds image.Rectangle
+	started := false
+	warnings := &warningList{}
+	p.onWarning = warnings.add
+	bands, err := p.runBands(r.Context(), "request", r.Body, func(b image.Rectangle, band *image.NRGBA, rect image.Rectangle) error {
+		if !started {
+			w.Header().Set("Content-Type", "multipart/mixed; boundary="+mw.Boundary())
+			w.WriteHeader(http.StatusOK)
+			bounds, started = b, true
+		}
+		h := textproto.MIMEHeader{}
+		h.Set("Content-Type", "image/png")
+		h.Set("X-Image-Width", strconv.Itoa(b.Dx()))
+		h.Set("X-Image-Height", strconv.Itoa(b.Dy()))
+		h.Set("X-Band-Y", strconv.Itoa(rect.Min.Y-b.Min.Y))
+		h.Set("X-Band-Height", strconv.Itoa(rect.Dy()))
+		if checksum != "" {
+			h.Set("X-Band-Checksum", mosaic.BandChecksum(checksum, band, rect).String())
+		}
+		part, err := mw.CreatePart(h)
+		if err != nil {
+			return err
+		}
+		if err := png.Encode(part, band.SubImage(rect)); err != nil {
+			return err
+		}
+		return rc.Flush()
+	})
+	if !started {
+		// バンドを送る前に失敗した場合は、一括で返す場合と同じエラーにする
+		if err != nil {
+			writeError(w, processStatus(err), err)
+			return
+		}
+		w.Header().Set("Content-Type", "multipart/mixed; boundary="+mw.Boundary())
+	}
+	summary := bandSummary{Width: bounds.Dx(), Height: bounds.Dy(), Bands: bands, DurationMS: time.Since(start).Milliseconds(), Warnings: warnings.all()}
+	if err != nil {
+		summary.Error, summary.Status = err.Error(), processStatus(err)
+	}
+	h := textproto.MIMEHeader{}
+	h.Set("Content-Type", "application/json")
+	part, perr := mw.CreatePart(h)
+	if perr == nil {
+		perr = json.NewEncoder(part).Encode(summary)
+	}
+	if perr == nil {
+		perr = mw.Close()
+	}
+	if perr != nil && p.logger != nil {
+		p.logger.Warn("failed to write band stream", "error", perr)
+	}
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/yashikota/go-streaming-image-mosaic/client"
+	"github.com/yashikota/go-streaming-image-mosaic/mosaic"
+)
+
+// upstream へリクエストを中継し、バンドのストリームの index 番目のバンドの PNG を corrupt で書き換えるプロキシ
+func corruptingProxy(t *testing.T, upstream string, index int, corrupt func(t *testing.T, data []byte) []byte) *httptest.Server {
+	t.Helper()
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req, err := http.NewRequestWithContext(r.Context(), r.Method, upstream+r.URL.RequestURI(), r.Body)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		req.Header = r.Header.Clone()
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer resp.Body.Close()
+		for k, v := range resp.Header {
+			w.Header()[k] = v
+		}
+		w.WriteHeader(resp.StatusCode)
+		mt, params, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+		if mt != "multipart/mixed" {
+			io.Copy(w, resp.Body)
+			return
+		}
+		mr := multipart.NewReader(resp.Body, params["boundary"])
+		mw := multipart.NewWriter(w)
+		mw.SetBoundary(params["boundary"])
+		defer mw.Close()
+		for i := 0; ; i++ {
+			part, err := mr.NextPart()
+			if err != nil {
+				return
+			}
+			data, err := io.ReadAll(part)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if i == index && part.Header.Get("X-Band-Y") != "" {
+				data = corrupt(t, data)
+			}
+			pw, err := mw.CreatePart(textproto.MIMEHeader(part.Header))
+			if err != nil {
+				return
+			}
+			pw.Write(data)
+		}
+	}))
+	t.Cleanup(proxy.Close)
+	return proxy
+}
+
+// PNG のバイト列の途中の 1 バイトを反転する (PNG のチャンクの CRC が合わなくなり、デコードできない)
+func flipByte(t *testing.T, data []byte) []byte {
+	data = slices.Clone(data)
+	data[len(data)/2] ^= 0x01
+	return data
+}
+
+// 1 画素の色を変えて PNG にし直す (デコードはできるが、画素のチェックサムが合わない)
+func repaintPixel(t *testing.T, data []byte) []byte {
+	img, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Error(err)
+		return data
+	}
+	nrgba := mosaic.ConvertToNRGBA(img)
+	nrgba.Pix[len(nrgba.Pix)/2] ^= 0x10
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, nrgba); err != nil {
+		t.Error(err)
+	}
+	return buf.Bytes()
+}
+
+// バンドのストリームの各バンドの範囲とチェックサム
+func streamedBands(t *testing.T, c *client.Client, input []byte, params client.Params) ([]image.Rectangle, []string) {
+	t.Helper()
+	var rects []image.Rectangle
+	var sums []string
+	_, err := c.ProcessBands(context.Background(), bytes.NewReader(input), params, func(b client.Band) error {
+		rects = append(rects, image.Rect(0, b.Y, b.Width, b.Y+b.Height))
+		sums = append(sums, b.Checksum)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rects, sums
+}
+
+func TestBandStreamChecksums(t *testing.T) {
+	ts, _ := newTestServer(t, "-cache-size", "0")
+	c := client.New(ts.URL)
+	src := testImage(48, 40)
+	input := encodeTestImage(t, src, "png")
+	want, err := mosaic.New(src, 8, 8).ProcessContext(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// チェックサムは処理結果のバンドの画素のもので、指定しない場合は付けない
+	rects, sums := streamedBands(t, c, input, client.Params{Tile: 8})
+	if len(rects) < 3 {
+		t.Fatalf("%d bands", len(rects))
+	}
+	for i, sum := range sums {
+		if sum != "" {
+			t.Errorf("band %d without checksum: %q", i, sum)
+		}
+	}
+	for _, alg := range mosaic.ChecksumAlgorithms() {
+		got, sums := streamedBands(t, c, input, client.Params{Tile: 8, Checksum: alg})
+		if !slices.Equal(got, rects) {
+			t.Fatalf("%s: bands %v, want %v", alg, got, rects)
+		}
+		for i, sum := range sums {
+			if want := mosaic.BandChecksum(mosaic.ChecksumAlgorithm(alg), want, rects[i]).String(); sum != want {
+				t.Errorf("%s band %v: checksum %q, want %q", alg, rects[i], sum, want)
+			}
+		}
+	}
+
+	// 壊れていなければ画像全体を組み立てる
+	img, summary, err := c.ReassembleVerified(context.Background(), bytes.NewReader(input), client.Params{Tile: 8})
+	if err != nil || summary.Bands != len(rects) {
+		t.Fatalf("ReassembleVerified: %v (%+v)", err, summary)
+	}
+	if !bytes.Equal(img.Pix, want.Pix) {
+		t.Error("reassembled image differs from the library result")
+	}
+
+	// 知らないチェックサムの種類は 400
+	_, err = c.ProcessBands(context.Background(), bytes.NewReader(input), client.Params{Tile: 8, Checksum: "xxhash"}, func(client.Band) error { return nil })
+	var apiErr *client.Error
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusBadRequest {
+		t.Errorf("unknown checksum: %v", err)
+	}
+}
+
+// 最初のバンドは、最後のバンドを処理する前にクライアントへ届く
+// 最後のバンドのタイルの描画は、クライアントが最初のバンドを受け取るまで待たせる
+func TestBandStreamFirstPartBeforeLastBand(t *testing.T) {
+	ts, s := newTestServer(t, "-cache-size", "0")
+	src := testImage(48, 64)
+	input := encodeTestImage(t, src, "png")
+	want, err := mosaic.New(src, 8, 8).ProcessContext(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	received := make(chan struct{})
+	waited := make(chan bool, 48/8)
+	deadline := time.Now().Add(5 * time.Second)
+	s.pipeline.renderer = mosaic.TileRendererFunc(func(dst *image.NRGBA, tile image.Rectangle, c color.NRGBA) {
+		if tile.Min.Y >= 56 {
+			select {
+			case <-received:
+				waited <- true
+			case <-time.After(time.Until(deadline)):
+				waited <- false
+			}
+		}
+		mosaic.FlatRenderer{}.Render(dst, tile, c)
+	})
+
+	got := image.NewNRGBA(src.Rect)
+	summary, err := client.New(ts.URL).ProcessBands(context.Background(), bytes.NewReader(input), client.Params{Tile: 8}, func(b client.Band) error {
+		if b.Y == 0 {
+			close(received)
+		}
+		draw.Draw(got, image.Rect(0, b.Y, b.Width, b.Y+b.Height), b.Image, b.Image.Bounds().Min, draw.Src)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if summary.Bands < 2 {
+		t.Fatalf("%d bands", summary.Bands)
+	}
+	close(waited)
+	n := 0
+	for ok := range waited {
+		if !ok {
+			t.Fatal("the last band was processed before the first part arrived")
+		}
+		n++
+	}
+	if n != 48/8 {
+		t.Errorf("%d tiles rendered in the last band, want %d", n, 48/8)
+	}
+	assertSameNRGBA(t, got, want)
+}
+
+// 転送中に 1 つのバンドを壊すと、そのバンドだけを壊れたバンドとして報告する
+func TestReassembleVerifiedPinpointsCorruptBand(t *testing.T) {
+	ts, _ := newTestServer(t, "-cache-size", "0")
+	src := testImage(48, 40)
+	input := encodeTestImage(t, src, "png")
+	want, err := mosaic.New(src, 8, 8).ProcessContext(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	rects, _ := streamedBands(t, client.New(ts.URL), input, client.Params{Tile: 8})
+
+	for _, corrupt := range []struct {
+		name string
+		fn   func(*testing.T, []byte) []byte
+	}{
+		{"flipped byte", flipByte},
+		{"repainted pixel", repaintPixel},
+	} {
+		for _, index := range []int{0, len(rects) / 2, len(rects) - 1} {
+			proxy := corruptingProxy(t, ts.URL, index, corrupt.fn)
+			for _, alg := range []string{"", "crc32"} {
+				img, _, err := client.New(proxy.URL).ReassembleVerified(context.Background(), bytes.NewReader(input), client.Params{Tile: 8, Checksum: alg})
+				var ce *client.ChecksumError
+				if !errors.As(err, &ce) || !slices.Equal(ce.Rects, []image.Rectangle{rects[index]}) {
+					t.Fatalf("%s in band %d (%q): %v, want %v", corrupt.name, index, alg, err, rects[index])
+				}
+				// 壊れたバンドの範囲は空け、ほかのバンドは組み立てる
+				for i, rect := range rects {
+					got, wantBand := img.SubImage(rect).(*image.NRGBA), want.SubImage(rect).(*image.NRGBA)
+					same := bytes.Equal(packedRows(got), packedRows(wantBand))
+					if i == index && (same || slices.ContainsFunc(packedRows(got), func(v byte) bool { return v != 0 })) {
+						t.Errorf("%s in band %d: corrupted band was drawn", corrupt.name, index)
+					}
+					if i != index && !same {
+						t.Errorf("%s in band %d: band %d differs", corrupt.name, index, i)
+					}
+				}
+			}
+		}
+	}
+}
+
+// 画像の範囲の行を詰めて並べた画素
+func packedRows(img *image.NRGBA) []byte {
+	var pix []byte
+	for y := img.Rect.Min.Y; y < img.Rect.Max.Y; y++ {
+		i := img.PixOffset(img.Rect.Min.X, y)
+		pix = append(pix, img.Pix[i:i+4*img.Rect.Dx()]...)
+	}
+	return pix
+}
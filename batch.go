@@ -0,0 +1,294 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/yashikota/go-streaming-image-mosaic/mosaic"
+)
+
+// 処理対象とする画像の拡張子
+var imageExts = map[string]bool{
+	".jpg":  true,
+	".jpeg": true,
+	".png":  true,
+	".tif":  true,
+	".tiff": true,
+}
+
+// 処理対象の画像ファイルかどうか
+func isImageFile(name string) bool {
+	return imageExts[strings.ToLower(filepath.Ext(name))]
+}
+
+// TIFF の拡張子かどうか
+func isTIFFName(name string) bool {
+	ext := strings.ToLower(filepath.Ext(name))
+	return ext == ".tif" || ext == ".tiff"
+}
+
+// 入力ファイルに対応する出力ファイルのパスを返却
+// ディレクトリ構造を保ち、拡張子は出力形式に合わせる (TIFF は TIFF のまま、それ以外は JPEG)
+func outputPath(inDir, outDir, path string) (string, error) {
+	rel, err := filepath.Rel(inDir, path)
+	if err != nil {
+		return "", err
+	}
+	if !isTIFFName(rel) {
+		rel = strings.TrimSuffix(rel, filepath.Ext(rel)) + ".jpg"
+	}
+	return filepath.Join(outDir, rel), nil
+}
+
+// batch のフラグ
+type batchFlags struct {
+	*commonFlags
+	in          *string
+	out         *string
+	metricsPush *string
+	report      *string
+	json        *bool
+	digest      *bool
+	failFast    *bool
+}
+
+func newBatchFlags(stderr io.Writer) *batchFlags {
+	c := newCommonFlags("batch", "[flags] -in dir -out dir", stderr)
+	return &batchFlags{
+		commonFlags: c,
+		in:          c.fs.String("in", "", "入力画像のディレクトリまたは zip ファイル"),
+		out:         c.fs.String("out", "", "出力先のディレクトリ (-in が zip の場合は出力する zip ファイル)"),
+		metricsPush: c.fs.String("metrics-push", "", "処理終了時にメトリクスを送信する Pushgateway の URL"),
+		report:      c.fs.String("report", "", "ファイルごとの結果を書き出す JSON のパス"),
+		json:        c.fs.Bool("json", false, "ファイルごとの処理の要約 (使った設定、段階ごとの時間、警告を含む) を -report に、省略時は標準出力に書き出す"),
+		digest:      c.fs.Bool("digest", false, "ファイルごとの処理結果の画素の SHA-256 (エンコーダーによらない) を標準出力に、-json の場合は要約に、-report の場合は結果にも出力する"),
+		failFast:    c.fs.Bool("fail-fast", false, "失敗したファイルがあった時点で処理を中止する"),
+	}
+}
+
+// batch の結果
+type batchReport struct {
+	Version buildVersion `json:"version"` // 処理したバイナリのバージョン
+	Total   int          `json:"total"`
+	Failed  int          `json:"failed"`
+	Skipped int          `json:"skipped"`
+	Files   []fileResult `json:"files"`
+}
+
+// ファイルごとの処理結果
+type fileResult struct {
+	Input    string  `json:"input"`
+	Output   string  `json:"output"`
+	Status   string  `json:"status"`   // ok, failed, skipped (-fail-fast で処理しなかったファイル)
+	Duration float64 `json:"duration"` // 秒
+	Error    string  `json:"error,omitempty"`
+	Digest   string  `json:"digest,omitempty"` // -digest の処理結果の画素の SHA-256
+
+	Warnings []mosaic.Warning `json:"warnings,omitempty"` // 処理中に記録した警告
+}
+
+// 結果を JSON で書き出す
+func writeReport(path string, report batchReport) error {
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(path, append(data, '\n'), 0o644); err != nil {
+		return &outputError{path: path, err: err}
+	}
+	return nil
+}
+
+// ディレクトリ内の画像をまとめてモザイク処理する
+// 失敗したファイルがあっても、-fail-fast を指定しない限り残りの処理を続ける
+func runBatch(args []string, stdout, stderr io.Writer) error {
+	f := newBatchFlags(stderr)
+	if err := f.parse(args); err != nil {
+		return err
+	}
+	if *f.in == "" || *f.out == "" {
+		return &usageError{errors.New("both -in and -out are required")}
+	}
+	if isZipFile(*f.in) && !isZipFile(*f.out) {
+		return &usageError{errors.New("-out must be a .zip file when -in is a zip archive")}
+	}
+
+	bar := newProgressBar(stderr, *f.quiet)
+	logger, err := f.logger(bar.logOutput(stderr))
+	if err != nil {
+		return err
+	}
+	p := f.pipeline(logger)
+	if *f.metricsPush != "" {
+		p.metrics = newMetrics()
+	}
+	if *f.json || *f.digest || *f.verbose || *f.report != "" {
+		// -v ではメモリの見積もりとヒープの変化をデバッグログに出力し、-report ではファイルごとの警告を書き出す
+		p.summaries = newSummaryLog(p)
+	}
+	p.digest = *f.digest
+
+	var (
+		report   batchReport
+		firstErr error
+	)
+	if isZipFile(*f.in) {
+		z := zipBatch{in: *f.in, out: *f.out, failFast: *f.failFast}
+		report, firstErr, err = z.run(context.Background(), p, bar)
+	} else {
+		b := batch{fsys: os.DirFS(*f.in), inName: *f.in, outDir: *f.out, failFast: *f.failFast}
+		report, firstErr, err = b.run(context.Background(), p, bar)
+	}
+	if err != nil {
+		return err
+	}
+	bar.finish()
+
+	if *f.json {
+		if err := writeSummaryTo(*f.report, stdout, p.summaries.batch(report)); err != nil {
+			return err
+		}
+	} else {
+		if p.summaries != nil {
+			summary := p.summaries.batch(report)
+			for i, file := range summary.Files {
+				report.Files[i].Digest, report.Files[i].Warnings = file.Digest, file.Warnings
+			}
+			if *f.digest {
+				if err := writeDigests(stdout, logger, summary.Files); err != nil {
+					return err
+				}
+			}
+		}
+		if *f.report != "" {
+			if err := writeReport(*f.report, report); err != nil {
+				return err
+			}
+		}
+	}
+	if *f.metricsPush != "" {
+		if err := p.metrics.push(*f.metricsPush); err != nil {
+			logger.Error("failed to push metrics", "error", err)
+		}
+	}
+	logger.Info("batch finished", "total", report.Total, "failed", report.Failed, "skipped", report.Skipped)
+	if *f.failFast && firstErr != nil {
+		return firstErr
+	}
+	if report.Failed > 0 {
+		return &partialError{failed: report.Failed, total: report.Total}
+	}
+	return nil
+}
+
+// バッチ処理の入出力
+// 入力は fs.FS から読み込むため、os.DirFS 以外 (埋め込みファイルや fstest.MapFS など) も使える
+// fs.FS は読み込み専用のため、出力は outDir 以下のファイルに書き込む
+type batch struct {
+	fsys     fs.FS  // 入力画像を読み込むファイルシステム
+	inName   string // ログと結果に表示する入力ディレクトリの名前
+	outDir   string // 出力先のディレクトリ
+	failFast bool   // 最初の失敗で残りのファイルを処理しないかどうか
+}
+
+// 処理するファイル
+type batchFile struct {
+	name  string // fsys 内のパス、または zip 内のエントリの名前
+	in    string // ログと結果に表示する入力のパス
+	out   string // 出力先のパス
+	entry int    // zip 内のエントリの位置
+}
+
+// fsys 内の画像を列挙
+func (b batch) files() ([]batchFile, error) {
+	var files []batchFile
+	err := fs.WalkDir(b.fsys, ".", func(name string, d fs.DirEntry, err error) error {
+		in := filepath.Join(b.inName, filepath.FromSlash(name))
+		if err != nil {
+			// fsys 内のパスではなく、表示用のパスをエラーに含める
+			var pathErr *fs.PathError
+			if errors.As(err, &pathErr) {
+				err = pathErr.Err
+			}
+			return &inputError{path: in, err: err}
+		}
+		if d.IsDir() || !isImageFile(name) {
+			return nil
+		}
+		out, err := outputPath(".", b.outDir, filepath.FromSlash(name))
+		if err != nil {
+			return err
+		}
+		files = append(files, batchFile{name: name, in: in, out: out})
+		return nil
+	})
+	return files, err
+}
+
+// すべての画像を処理し、結果と最初に失敗したファイルのエラーを返却
+// ファイルの列挙に失敗した場合は err を返却
+func (b batch) run(ctx context.Context, p pipeline, bar *progressBar) (report batchReport, firstErr, err error) {
+	// 進捗の表示のため、処理する前にファイルを列挙する
+	files, err := b.files()
+	if err != nil {
+		return batchReport{}, nil, err
+	}
+	report, firstErr = processFiles(p.logger, bar, files, b.failFast, func(file batchFile, progress mosaic.ProgressFunc) error {
+		return b.process(ctx, p, file, progress)
+	})
+	return report, firstErr, nil
+}
+
+// files を順に process で処理し、結果と最初に失敗したファイルのエラーを返却
+// failFast の場合、失敗した後のファイルは処理せずに skipped とする
+func processFiles(logger *slog.Logger, bar *progressBar, files []batchFile, failFast bool, process func(batchFile, mosaic.ProgressFunc) error) (report batchReport, firstErr error) {
+	if logger == nil {
+		logger = discardLogger
+	}
+	report = batchReport{Version: currentVersion(), Total: len(files), Files: make([]fileResult, 0, len(files))}
+	for i, file := range files {
+		result := fileResult{Input: file.in, Output: file.out, Status: "skipped"}
+		if firstErr != nil && failFast {
+			report.Skipped++
+			report.Files = append(report.Files, result)
+			continue
+		}
+
+		start := time.Now()
+		fileErr := process(file, bar.callback(logger, file.in, i+1, len(files)))
+		result.Duration = time.Since(start).Seconds()
+		result.Status = "ok"
+		if fileErr != nil {
+			report.Failed++
+			result.Status = "failed"
+			result.Error = fileErr.Error()
+			logger.Error("file failed", "input", file.in, "error", fileErr)
+			if firstErr == nil {
+				firstErr = fileErr
+			}
+		}
+		report.Files = append(report.Files, result)
+	}
+	return report, firstErr
+}
+
+// 1 つのファイルを処理する
+func (b batch) process(ctx context.Context, p pipeline, file batchFile, progress mosaic.ProgressFunc) error {
+	if err := os.MkdirAll(filepath.Dir(file.out), 0o755); err != nil {
+		return &outputError{path: filepath.Dir(file.out), err: err}
+	}
+	in, err := b.fsys.Open(file.name)
+	if err != nil {
+		return &inputError{path: file.in, err: err}
+	}
+	defer in.Close()
+	return processReader(ctx, p, file.in, in, file.out, progress)
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+// path の -report の結果を読み込む
+func readBatchReport(t *testing.T, path string) batchReport {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var report batchReport
+	if err := json.Unmarshal(data, &report); err != nil {
+		t.Fatal(err)
+	}
+	return report
+}
+
+// 壊れたファイルと空のファイルを含む入力のディレクトリ
+func batchFixture(t *testing.T) string {
+	t.Helper()
+	in := t.TempDir()
+	writeTestImage(t, filepath.Join(in, "a.png"), testImage(40, 30))
+	jpeg := encodeTestImage(t, testImage(64, 48), "jpeg")
+	writeTestFile(t, filepath.Join(in, "b-truncated.jpg"), jpeg[:len(jpeg)/2])
+	writeTestFile(t, filepath.Join(in, "c-empty.png"), nil)
+	writeTestImage(t, filepath.Join(in, "d.jpg"), testImage(30, 40))
+	return in
+}
+
+func TestBatchReport(t *testing.T) {
+	in, out := batchFixture(t), t.TempDir()
+	reportPath := filepath.Join(t.TempDir(), "report.json")
+	res := runCLI(t, "batch", "-in", in, "-out", out, "-tile", "8", "-quiet", "-report", reportPath)
+	if res.code != exitPartial {
+		t.Fatalf("exit code = %d, want %d (stderr: %s)", res.code, exitPartial, res.stderr)
+	}
+
+	report := readBatchReport(t, reportPath)
+	if report.Total != 4 || report.Failed != 2 || report.Skipped != 0 || len(report.Files) != 4 {
+		t.Fatalf("report: total %d, failed %d, skipped %d, %d files", report.Total, report.Failed, report.Skipped, len(report.Files))
+	}
+	want := map[string]string{"a.png": "ok", "b-truncated.jpg": "failed", "c-empty.png": "failed", "d.jpg": "ok"}
+	for _, file := range report.Files {
+		name := filepath.Base(file.Input)
+		if file.Status != want[name] {
+			t.Errorf("%s: status %q, want %q", name, file.Status, want[name])
+		}
+		if file.Duration < 0 {
+			t.Errorf("%s: duration %g", name, file.Duration)
+		}
+		switch file.Status {
+		case "ok":
+			if file.Error != "" {
+				t.Errorf("%s: error %q on success", name, file.Error)
+			}
+			if _, err := os.Stat(file.Output); err != nil {
+				t.Errorf("%s: output %v", name, err)
+			}
+		case "failed":
+			if file.Error == "" {
+				t.Errorf("%s: failure without an error message", name)
+			}
+			if _, err := os.Stat(file.Output); err == nil {
+				t.Errorf("%s: output %s written for a failed file", name, file.Output)
+			}
+		}
+	}
+}
+
+func TestBatchFailFast(t *testing.T) {
+	in, out := batchFixture(t), t.TempDir()
+	reportPath := filepath.Join(t.TempDir(), "report.json")
+	res := runCLI(t, "batch", "-in", in, "-out", out, "-tile", "8", "-quiet", "-fail-fast", "-report", reportPath)
+	if res.code != exitDecode {
+		t.Fatalf("exit code = %d, want %d (stderr: %s)", res.code, exitDecode, res.stderr)
+	}
+
+	// 最初の失敗で止め、残りのファイルは skipped にする
+	report := readBatchReport(t, reportPath)
+	var statuses []string
+	for _, file := range report.Files {
+		statuses = append(statuses, file.Status)
+	}
+	if report.Failed != 1 || report.Skipped != 2 {
+		t.Errorf("failed %d, skipped %d (statuses %v)", report.Failed, report.Skipped, statuses)
+	}
+}
+
+// 入力は fs.FS から読むため、ディレクトリを用意しなくても fstest.MapFS で処理できる
+func TestBatchMapFS(t *testing.T) {
+	jpeg := encodeTestImage(t, testImage(64, 48), "jpeg")
+	fsys := fstest.MapFS{
+		"a.png":               {Data: encodeTestImage(t, testImage(40, 30), "png")},
+		"sub/b.jpg":           {Data: jpeg},
+		"sub/c.tif":           {Data: encodeTestImage(t, testImage(16, 16), "tiff")},
+		"sub/d-truncated.jpg": {Data: jpeg[:len(jpeg)/2]},
+		"notes.txt":           {Data: []byte("not an image")},
+	}
+	f := newBatchFlags(io.Discard)
+	if err := f.parse([]string{"-tile", "8", "-quiet"}); err != nil {
+		t.Fatal(err)
+	}
+	out := t.TempDir()
+	b := batch{fsys: fsys, inName: "mem", outDir: out}
+	report, firstErr, err := b.run(context.Background(), f.pipeline(discardLogger), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if firstErr == nil || report.Total != 4 || report.Failed != 1 {
+		t.Fatalf("total %d, failed %d, first error %v", report.Total, report.Failed, firstErr)
+	}
+
+	want := map[string]string{
+		filepath.Join("mem", "a.png"):                  filepath.Join(out, "a.jpg"),
+		filepath.Join("mem", "sub", "b.jpg"):           filepath.Join(out, "sub", "b.jpg"),
+		filepath.Join("mem", "sub", "c.tif"):           filepath.Join(out, "sub", "c.tif"),
+		filepath.Join("mem", "sub", "d-truncated.jpg"): filepath.Join(out, "sub", "d-truncated.jpg"),
+	}
+	for _, file := range report.Files {
+		if want[file.Input] != file.Output {
+			t.Errorf("%s: output %s, want %s", file.Input, file.Output, want[file.Input])
+		}
+		_, err := os.Stat(file.Output)
+		if ok := file.Status == "ok"; ok != (err == nil) || ok == strings.HasSuffix(file.Input, "truncated.jpg") {
+			t.Errorf("%s: status %q, output %v", file.Input, file.Status, err)
+		}
+	}
+	// ディスク上の同じ画像と同じ結果になる
+	in := filepath.Join(t.TempDir(), "c.tif")
+	writeTestFile(t, in, fsys["sub/c.tif"].Data)
+	apply := filepath.Join(t.TempDir(), "c.tif")
+	if res := runCLI(t, "apply", "-in", in, "-out", apply, "-tile", "8", "-quiet"); res.code != exitOK {
+		t.Fatalf("apply: exit code = %d (stderr: %s)", res.code, res.stderr)
+	}
+	assertSameImage(t, readTestImage(t, filepath.Join(out, "sub", "c.tif")), readTestImage(t, apply))
+}
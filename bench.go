@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"image/jpeg"
+	"io"
+	"math"
+	"runtime"
+	runtimemetrics "runtime/metrics"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ヒープの大きさを調べる間隔
+const benchSampleInterval = time.Millisecond
+
+// 画素数のカンマ区切りのリスト (例: 2MP,12MP)
+type pixelList []pixelCount
+
+func (l *pixelList) String() string {
+	parts := make([]string, len(*l))
+	for i := range *l {
+		parts[i] = (*l)[i].String()
+	}
+	return strings.Join(parts, ",")
+}
+
+func (l *pixelList) Set(s string) error {
+	var sizes pixelList
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		var p pixelCount
+		if err := p.Set(part); err != nil || p <= 0 {
+			return fmt.Errorf("invalid image size %q (want positive sizes such as 2MP,12MP)", part)
+		}
+		sizes = append(sizes, p)
+	}
+	*l = sizes
+	return nil
+}
+
+func (l *pixelList) Get() any {
+	return l.String()
+}
+
+// bench のフラグ
+type benchFlags struct {
+	*commonFlags
+	sizes   pixelList
+	tiles   sizeList
+	workers sizeList
+	runs    *int
+	json    *bool
+}
+
+func newBenchFlags(stderr io.Writer) *benchFlags {
+	c := newCommonFlags("bench", "[flags]", stderr)
+	f := &benchFlags{
+		commonFlags: c,
+		sizes:       pixelList{2000000, 12000000},
+		tiles:       sizeList{16, 64},
+		workers:     sizeList{1},
+		runs:        c.fs.Int("runs", 3, "組み合わせごとに処理する回数 (中央値の時間を採る)"),
+		json:        c.fs.Bool("json", false, "JSON 形式で出力する"),
+	}
+	if n := runtime.GOMAXPROCS(0); n > 1 {
+		f.workers = append(f.workers, n)
+	}
+	c.fs.Var(&f.sizes, "sizes", "合成する画像の画素数のカンマ区切りのリスト (例: 2MP,12MP,50MP)")
+	c.fs.Var(&f.workers, "workers", "ゴルーチンの数のカンマ区切りのリスト (例: 1,4,8)")
+	// 共通の -tile は 1 つの大きさのため、bench ではカンマ区切りのリストとして受け取る
+	tile := c.fs.Lookup("tile")
+	tile.Value, tile.DefValue = &f.tiles, f.tiles.String()
+	tile.Usage = "タイルの大きさのカンマ区切りのリスト (例: 16,64)"
+	return f
+}
+
+// bench の 1 つの組み合わせの結果
+type benchResult struct {
+	Pixels        int64   `json:"pixels"`
+	Width         int     `json:"width"`
+	Height        int     `json:"height"`
+	Tile          int     `json:"tile"`
+	Workers       int     `json:"workers"`
+	Seconds       float64 `json:"seconds"`         // 処理時間の中央値
+	MPPerSecond   float64 `json:"mp_per_second"`   // 1 秒あたりに処理した百万画素の数
+	PeakHeapBytes int64   `json:"peak_heap_bytes"` // 処理前より増えたヒープの最大値
+	Allocs        int64   `json:"allocs"`          // 1 回の処理のメモリ確保の回数
+	AllocBytes    int64   `json:"alloc_bytes"`     // 1 回の処理で確保したバイト数
+}
+
+// bench の結果と測った環境
+type benchReport struct {
+	Version    string        `json:"version"`
+	GoVersion  string        `json:"go_version"`
+	OS         string        `json:"os"`
+	Arch       string        `json:"arch"`
+	GOMAXPROCS int           `json:"gomaxprocs"`
+	Results    []benchResult `json:"results"`
+}
+
+// 合成した画像を実際のパイプライン (デコード、モザイク処理、エンコード) で処理し、大きさ、タイル、ゴルーチンの数の組み合わせごとの速さとメモリを表示する
+// 画像は JPEG にしてメモリに置き、出力は捨てる。大きさごとに最初の 1 回は準備を含むため捨てる
+func runBench(args []string, stdout, stderr io.Writer) error {
+	f := newBenchFlags(stderr)
+	if err := f.parse(args); err != nil {
+		return err
+	}
+	if f.fs.NArg() > 0 {
+		return &usageError{fmt.Errorf("unexpected arguments: %s", strings.Join(f.fs.Args(), " "))}
+	}
+	if len(f.sizes) == 0 || len(f.tiles) == 0 || len(f.workers) == 0 {
+		return &usageError{fmt.Errorf("-sizes, -tile and -workers must not be empty")}
+	}
+	if *f.runs < 1 {
+		return &usageError{fmt.Errorf("-runs must be at least 1")}
+	}
+	logger := discardLogger
+	if *f.verbose {
+		l, err := f.logger(stderr)
+		if err != nil {
+			return err
+		}
+		logger = l
+	}
+	base := f.pipeline(logger)
+
+	report := benchReport{
+		Version:    versionString(),
+		GoVersion:  runtime.Version(),
+		OS:         runtime.GOOS,
+		Arch:       runtime.GOARCH,
+		GOMAXPROCS: runtime.GOMAXPROCS(0),
+	}
+	ctx := context.Background()
+	for _, size := range f.sizes {
+		width := max(1, int(math.Round(math.Sqrt(float64(size)*4/3))))
+		height := max(1, int(math.Round(float64(size)/float64(width))))
+		var input bytes.Buffer
+		if err := jpeg.Encode(&input, syntheticImage(width, height), &jpeg.Options{Quality: 90}); err != nil {
+			return err
+		}
+		if _, err := benchRun(ctx, base, input.Bytes()); err != nil {
+			return err
+		}
+		for _, tile := range f.tiles {
+			for _, workers := range f.workers {
+				p := base.degraded(degradation{Tile: tile})
+				p.workers = workers
+				res := benchResult{Pixels: int64(width) * int64(height), Width: width, Height: height, Tile: tile, Workers: workers}
+				times := make([]time.Duration, *f.runs)
+				for i := range times {
+					m, err := benchRun(ctx, p, input.Bytes())
+					if err != nil {
+						return err
+					}
+					times[i] = m.elapsed
+					res.PeakHeapBytes = max(res.PeakHeapBytes, m.peakHeap)
+					res.Allocs, res.AllocBytes = m.allocs, m.allocBytes
+				}
+				slices.Sort(times)
+				res.Seconds = times[len(times)/2].Seconds()
+				res.MPPerSecond = float64(res.Pixels) / 1e6 / max(res.Seconds, 1e-9)
+				report.Results = append(report.Results, res)
+				if !*f.json {
+					if len(report.Results) == 1 {
+						fmt.Fprintf(stdout, "%-8s %-11s %5s %7s %9s %9s %11s %10s %11s\n",
+							"SIZE", "DIMENSIONS", "TILE", "WORKERS", "MP/S", "TIME", "PEAK HEAP", "ALLOCS", "ALLOC")
+					}
+					fmt.Fprintf(stdout, "%-8s %-11s %5d %7d %9.1f %9s %11s %10d %11s\n",
+						size.String(), strconv.Itoa(width)+"x"+strconv.Itoa(height), tile, workers, res.MPPerSecond,
+						time.Duration(res.Seconds*float64(time.Second)).Round(time.Millisecond), formatBytes(res.PeakHeapBytes), res.Allocs, formatBytes(res.AllocBytes))
+				}
+			}
+		}
+	}
+	if *f.json {
+		enc := json.NewEncoder(stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(report)
+	}
+	return nil
+}
+
+// bench の 1 回の処理の測定値
+type benchMeasure struct {
+	elapsed    time.Duration
+	peakHeap   int64 // 処理前より増えたヒープのオブジェクトのバイト数の最大値
+	allocs     int64
+	allocBytes int64
+}
+
+// input を p で 1 回処理して測る
+// ヒープは処理の間 benchSampleInterval ごとに調べるため、その間に確保して解放したメモリは含まない場合がある
+func benchRun(ctx context.Context, p pipeline, input []byte) (benchMeasure, error) {
+	samples := []runtimemetrics.Sample{
+		{Name: "/memory/classes/heap/objects:bytes"},
+		{Name: "/gc/heap/allocs:objects"},
+		{Name: "/gc/heap/allocs:bytes"},
+	}
+	runtime.GC()
+	runtimemetrics.Read(samples)
+	heap, allocs, allocBytes := int64(samples[0].Value.Uint64()), int64(samples[1].Value.Uint64()), int64(samples[2].Value.Uint64())
+
+	done := make(chan struct{})
+	peak := make(chan int64)
+	go func() {
+		high := heap
+		heapSample := samples[:1:1]
+		ticker := time.NewTicker(benchSampleInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				runtimemetrics.Read(heapSample)
+				peak <- max(high, int64(heapSample[0].Value.Uint64()))
+				return
+			case <-ticker.C:
+				runtimemetrics.Read(heapSample)
+				high = max(high, int64(heapSample[0].Value.Uint64()))
+			}
+		}
+	}()
+
+	start := time.Now()
+	err := p.run(ctx, "bench", bytes.NewReader(input), io.Discard, nil)
+	elapsed := time.Since(start)
+	close(done)
+	high := <-peak
+	if err != nil {
+		return benchMeasure{}, err
+	}
+	runtimemetrics.Read(samples[1:])
+	return benchMeasure{
+		elapsed:    elapsed,
+		peakHeap:   high - heap,
+		allocs:     int64(samples[1].Value.Uint64()) - allocs,
+		allocBytes: int64(samples[2].Value.Uint64()) - allocBytes,
+	}, nil
+}
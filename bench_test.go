@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"image/color"
+	"strings"
+	"testing"
+)
+
+func TestPixelList(t *testing.T) {
+	var l pixelList
+	if err := l.Set("2MP, 0.5mp,,30000"); err != nil {
+		t.Fatal(err)
+	}
+	if want := (pixelList{2000000, 500000, 30000}); len(l) != len(want) || l[0] != want[0] || l[1] != want[1] || l[2] != want[2] {
+		t.Errorf("Set = %v, want %v", l, want)
+	}
+	for _, in := range []string{"0", "-2MP", "2XP", "12MP,big"} {
+		if err := l.Set(in); err == nil {
+			t.Errorf("Set(%q) accepted", in)
+		}
+	}
+}
+
+func TestBenchJSON(t *testing.T) {
+	res := runCLI(t, "bench", "-sizes", "20000,0.05MP", "-tile", "8,16", "-workers", "1,2", "-runs", "1", "-json")
+	if res.code != exitOK {
+		t.Fatalf("exit code = %d (stderr: %s)", res.code, res.stderr)
+	}
+	var report benchReport
+	if err := json.Unmarshal([]byte(res.stdout), &report); err != nil {
+		t.Fatalf("%v\n%s", err, res.stdout)
+	}
+	if report.GoVersion == "" || report.GOMAXPROCS < 1 {
+		t.Errorf("environment %+v", report)
+	}
+	// 大きさ、タイル、ゴルーチンの数の順に、すべての組み合わせを測る
+	if len(report.Results) != 8 {
+		t.Fatalf("%d results, want 8", len(report.Results))
+	}
+	i := 0
+	for _, pixels := range []int64{20000, 50000} {
+		for _, tile := range []int{8, 16} {
+			for _, workers := range []int{1, 2} {
+				r := report.Results[i]
+				i++
+				if r.Tile != tile || r.Workers != workers {
+					t.Errorf("result %d: tile %d, workers %d, want %d, %d", i, r.Tile, r.Workers, tile, workers)
+				}
+				// 4:3 の画像で、画素数は指定に近い
+				if d := r.Pixels - pixels; d < -pixels/100 || d > pixels/100 || r.Pixels != int64(r.Width*r.Height) || r.Width < r.Height {
+					t.Errorf("result %d: %dx%d (%d pixels), want about %d", i, r.Width, r.Height, r.Pixels, pixels)
+				}
+				if r.Seconds <= 0 || r.MPPerSecond <= 0 || r.Allocs <= 0 || r.AllocBytes <= 0 || r.PeakHeapBytes < 0 {
+					t.Errorf("result %d: %+v", i, r)
+				}
+			}
+		}
+	}
+}
+
+func TestBenchTable(t *testing.T) {
+	res := runCLI(t, "bench", "-sizes", "20000", "-tile", "8,16", "-workers", "1", "-runs", "1")
+	if res.code != exitOK {
+		t.Fatalf("exit code = %d (stderr: %s)", res.code, res.stderr)
+	}
+	lines := strings.Split(strings.TrimSpace(res.stdout), "\n")
+	if len(lines) != 3 || !strings.HasPrefix(lines[0], "SIZE") || !strings.Contains(lines[0], "MP/S") {
+		t.Fatalf("table:\n%s", res.stdout)
+	}
+	for i, tile := range []string{"8", "16"} {
+		if fields := strings.Fields(lines[i+1]); len(fields) < 9 || fields[0] != "20000" || fields[1] != "163x123" || fields[2] != tile || fields[3] != "1" {
+			t.Errorf("row %q", lines[i+1])
+		}
+	}
+}
+
+func TestBenchUsage(t *testing.T) {
+	for _, args := range [][]string{
+		{"-runs", "0"},
+		{"-sizes", ""},
+		{"-sizes", "0"},
+		{"-tile", "8,x"},
+		{"-workers", ""},
+		{"extra"},
+	} {
+		if res := runCLI(t, append([]string{"bench"}, args...)...); res.code != exitUsage {
+			t.Errorf("%v: exit code = %d, want %d (stderr: %s)", args, res.code, exitUsage, res.stderr)
+		}
+	}
+}
+
+// 合成する画像は決まった内容で、平らな画像ではない
+func TestSyntheticImage(t *testing.T) {
+	a, b := syntheticImage(64, 48), syntheticImage(64, 48)
+	colors := map[color.NRGBA]bool{}
+	for y := 0; y < 48; y++ {
+		for x := 0; x < 64; x++ {
+			c := a.NRGBAAt(x, y)
+			if c != b.NRGBAAt(x, y) {
+				t.Fatalf("pixel (%d,%d) differs between calls", x, y)
+			}
+			if c.A != 255 {
+				t.Fatalf("pixel (%d,%d) is not opaque", x, y)
+			}
+			colors[c] = true
+		}
+	}
+	if len(colors) < 64*48/2 {
+		t.Errorf("%d distinct colors", len(colors))
+	}
+}
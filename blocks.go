@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"io"
+	"log/slog"
+	"strconv"
+	"strings"
+
+	"github.com/yashikota/go-streaming-image-mosaic/internal/jpegstream"
+	"github.com/yashikota/go-streaming-image-mosaic/internal/tiff"
+	"github.com/yashikota/go-streaming-image-mosaic/mosaic"
+)
+
+// 処理の単位のブロックの大きさを表すフラグの値 (例: 4096x1024)
+type blockSize image.Point
+
+func (b *blockSize) String() string {
+	if b.X == 0 && b.Y == 0 {
+		return ""
+	}
+	return strconv.Itoa(b.X) + "x" + strconv.Itoa(b.Y)
+}
+
+func (b *blockSize) Set(s string) error {
+	w, h, ok := strings.Cut(strings.ToLower(s), "x")
+	x, errX := strconv.Atoi(w)
+	y, errY := strconv.Atoi(h)
+	if !ok || errX != nil || errY != nil || x <= 0 || y <= 0 {
+		return fmt.Errorf("invalid block size %q (want WxH such as 4096x1024)", s)
+	}
+	*b = blockSize{X: x, Y: y}
+	return nil
+}
+
+func (b *blockSize) Get() any {
+	return b.String()
+}
+
+// タイルの TIFF に書き出せるよう、幅と高さをタイルの大きさと 16 の公倍数に切り上げたブロックの大きさ
+// TIFF 以外で書き出す場合は指定した大きさのまま (Processor がタイルの大きさの倍数に切り上げる)
+func (p pipeline) blockSize() image.Point {
+	if p.encoderName() != "tiff" {
+		return image.Point(p.block)
+	}
+	step := lcm(p.tile, jpegstream.MCUHeight)
+	return image.Pt((p.block.X+step-1)/step*step, (p.block.Y+step-1)/step*step)
+}
+
+// 最小公倍数
+func lcm(a, b int) int {
+	x, y := a, b
+	for y != 0 {
+		x, y = y, x%y
+	}
+	return a / x * b
+}
+
+// 処理済みのブロックを、ブロックと同じ大きさのタイルの TIFF として順に w に書き込む
+// 出力画像全体を保持しないため、出力に使うメモリはブロック 1 つ分で済む
+func (p pipeline) encodeTiledTIFF(ctx context.Context, logger *slog.Logger, processor *mosaic.Processor, w io.Writer, src *image.NRGBA) error {
+	size, block := src.Rect.Size(), processor.BlockSize()
+	var res tiff.Resolution
+	if p.encodeOpts.DPI > 0 {
+		res = tiff.ResolutionDPI(p.encodeOpts.DPI)
+	}
+	enc, err := tiff.NewTileEncoder(w, size.X, size.Y, block.X, block.Y, src.Opaque(), res)
+	if err != nil {
+		return p.fail(logger, stageEncode, err)
+	}
+	var encErr error
+	err = processor.ProcessBlocks(ctx, func(b *image.NRGBA, rect image.Rectangle) error {
+		encErr = p.stats.timed(stageEncode, func() error { return enc.WriteTile(b, rect) })
+		return encErr
+	})
+	if encErr != nil {
+		return p.fail(logger, stageEncode, encErr)
+	}
+	if err != nil {
+		return p.fail(logger, stageProcess, err)
+	}
+	if err := p.stats.timed(stageEncode, enc.Close); err != nil {
+		return p.fail(logger, stageEncode, err)
+	}
+	return nil
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/yashikota/go-streaming-image-mosaic/mosaic"
+)
+
+// キャッシュのキーの形式の版
+// 処理設定を文字列にする方法や、同じ設定での処理結果が変わる場合は上げ、古い版のキャッシュを使わないようにする
+// 版 3 で処理結果に警告を含めた
+// 版 4 で処理結果を画素の Digest から決まるキーで保持し、入力のキーからはそのキーを引くようにした
+const cacheSchemaVersion = 4
+
+// 処理結果のキャッシュ
+// 独自の実装に差し替えることで、ディスクや Redis などに保存できる
+type ResultCache interface {
+	Get(key string) (CachedResult, bool)
+	Put(key string, result CachedResult)
+}
+
+// キャッシュする処理結果
+// キャッシュから返す応答にも処理した時と同じ X-Mosaic-Warning ヘッダーを付けるため、警告も保持する
+type CachedResult struct {
+	Data     []byte
+	Warnings []mosaic.Warning
+	Ref      string // 空でない場合は、入力のキーから引いた処理結果のキー (Data と Warnings は空)
+}
+
+// 合計の大きさの上限に数えるバイト数
+func (r CachedResult) size() int {
+	return len(r.Data) + len(r.Ref)
+}
+
+// メモリ上に処理結果を保持する ResultCache
+// 合計の大きさが上限を超えた場合は、最も長く使われていない結果から捨てる
+type memoryResultCache struct {
+	mu      sync.Mutex
+	budget  int // 保持する結果の合計の大きさの上限 (バイト)
+	size    int
+	order   *list.List // 先頭ほど最近使った結果
+	entries map[string]*list.Element
+}
+
+type cacheEntry struct {
+	key    string
+	result CachedResult
+}
+
+func newMemoryResultCache(budget int) *memoryResultCache {
+	return &memoryResultCache{budget: budget, order: list.New(), entries: map[string]*list.Element{}}
+}
+
+func (c *memoryResultCache) Get(key string) (CachedResult, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if !ok {
+		return CachedResult{}, false
+	}
+	c.order.MoveToFront(e)
+	return e.Value.(*cacheEntry).result, true
+}
+
+// 大きさは処理結果の画像 (処理結果のキーを引く場合はキー) のバイト数で数える
+func (c *memoryResultCache) Put(key string, result CachedResult) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if result.size() > c.budget {
+		// 上限より大きい結果は、ほかの結果をすべて捨てても入らないので保持しない
+		return
+	}
+	if e, ok := c.entries[key]; ok {
+		c.size -= e.Value.(*cacheEntry).result.size()
+		c.order.Remove(e)
+	}
+	c.entries[key] = c.order.PushFront(&cacheEntry{key: key, result: result})
+	c.size += result.size()
+	for c.size > c.budget {
+		e := c.order.Back()
+		entry := e.Value.(*cacheEntry)
+		c.order.Remove(e)
+		delete(c.entries, entry.key)
+		c.size -= entry.result.size()
+	}
+}
+
+// 入力と処理設定から決まるキャッシュのキー
+// options はリクエストの処理設定を文字列にしたもの (server.requestOptions)
+func cacheKey(input []byte, options string) string {
+	sum := sha256.Sum256(input)
+	h := sha256.New()
+	fmt.Fprintf(h, "v%d\n%s\n%x", cacheSchemaVersion, options, sum)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// 処理結果の画素の Digest と出力の設定から決まるキャッシュのキー
+// 形式の違う入力でも、同じ画素になる処理結果は同じキー (と ETag) になる
+// output は出力の形式とエンコードの設定を文字列にしたもの (outputOptions)
+func resultKey(digest, output string) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "v%d\nresult\n%s\n%s", cacheSchemaVersion, output, digest)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// If-None-Match が etag と一致するかどうか
+// * は etag の処理結果がある (exists) 場合だけ一致する
+func etagMatches(r *http.Request, etag string, exists bool) bool {
+	for _, v := range strings.Split(r.Header.Get("If-None-Match"), ",") {
+		v = strings.TrimPrefix(strings.TrimSpace(v), "W/")
+		if v == etag || v == "*" && exists {
+			return true
+		}
+	}
+	return false
+}
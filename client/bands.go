@@ -0,0 +1,130 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/png"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"strconv"
+)
+
+// 処理済みのバンド
+type Band struct {
+	Y, Height    int         // 画像の上端からの位置と高さ
+	Width, Total int         // 画像全体の幅と高さ
+	Image        image.Image // バンドの画像 (範囲は (0,0) から始まる)
+	Checksum     string      // サーバーが付けた画素のチェックサム (Params.Checksum を指定した場合だけ、crc32c:0123abcd の形式)
+}
+
+// バンドのストリームの最後に返される処理の要約
+type BandSummary struct {
+	Width      int    `json:"width"`
+	Height     int    `json:"height"`
+	Bands      int    `json:"bands"`
+	DurationMS int64  `json:"duration_ms"`
+	Error      string `json:"error,omitempty"`
+	Status     int    `json:"status,omitempty"`
+}
+
+// r の画像をモザイク処理し、処理済みのバンドを届いた順に fn に渡す
+// サーバーは処理の途中から結果を返すため、大きな画像でも最初のバンドをすぐに受け取れる
+// 途中で処理に失敗した場合は、要約のステータスとメッセージの *Error を返却
+func (c *Client) ProcessBands(ctx context.Context, r io.Reader, params Params, fn func(Band) error) (BandSummary, error) {
+	return c.streamBands(ctx, r, params, func(b Band, err error) error {
+		if err != nil {
+			return err
+		}
+		return fn(b)
+	})
+}
+
+// バンドのストリームを読み、バンドごとに fn に渡す
+// バンドの画像を読めなかった場合は、ヘッダーから読んだ位置と読めなかった理由を渡す
+// (fn が nil を返せば次のバンドを読み続ける)
+func (c *Client) streamBands(ctx context.Context, r io.Reader, params Params, fn func(Band, error) error) (BandSummary, error) {
+	header := http.Header{"Accept": {"multipart/mixed"}}
+	resp, err := c.do(ctx, http.MethodPost, "/process", params.query(), header, r)
+	if err != nil {
+		return BandSummary{}, err
+	}
+	defer resp.Body.Close()
+	mt, mtParams, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil || mt != "multipart/mixed" {
+		return BandSummary{}, fmt.Errorf("client: unexpected response type %q", resp.Header.Get("Content-Type"))
+	}
+
+	mr := multipart.NewReader(resp.Body, mtParams["boundary"])
+	for {
+		part, err := mr.NextPart()
+		if errors.Is(err, io.EOF) {
+			return BandSummary{}, errors.New("client: band stream ended without a summary")
+		}
+		if err != nil {
+			return BandSummary{}, err
+		}
+		if part.Header.Get("Content-Type") == "application/json" {
+			var summary BandSummary
+			if err := json.NewDecoder(part).Decode(&summary); err != nil {
+				return BandSummary{}, err
+			}
+			if summary.Error != "" {
+				return summary, &Error{StatusCode: summary.Status, Message: summary.Error}
+			}
+			return summary, nil
+		}
+		band, err := readBandHeader(part)
+		if err != nil {
+			return BandSummary{}, err
+		}
+		band.Image, err = png.Decode(part)
+		if err := fn(band, err); err != nil {
+			return BandSummary{}, err
+		}
+	}
+}
+
+// バンドのパートのヘッダーを読み込む
+func readBandHeader(part *multipart.Part) (Band, error) {
+	b := Band{Checksum: part.Header.Get("X-Band-Checksum")}
+	for _, h := range []struct {
+		name string
+		v    *int
+	}{
+		{"X-Band-Y", &b.Y}, {"X-Band-Height", &b.Height}, {"X-Image-Width", &b.Width}, {"X-Image-Height", &b.Total},
+	} {
+		n, err := strconv.Atoi(part.Header.Get(h.name))
+		if err != nil {
+			return Band{}, fmt.Errorf("client: invalid %s header: %w", h.name, err)
+		}
+		*h.v = n
+	}
+	return b, nil
+}
+
+// r の画像をモザイク処理し、バンドのストリームから組み立てた画像を返却
+// 画像全体の大きさは最初のバンドから決める
+func (c *Client) ProcessImage(ctx context.Context, r io.Reader, params Params) (*image.NRGBA, BandSummary, error) {
+	var out *image.NRGBA
+	summary, err := c.ProcessBands(ctx, r, params, func(b Band) error {
+		if out == nil {
+			out = image.NewNRGBA(image.Rect(0, 0, b.Width, b.Total))
+		}
+		rect := image.Rect(0, b.Y, b.Width, b.Y+b.Height)
+		draw.Draw(out, rect, b.Image, b.Image.Bounds().Min, draw.Src)
+		return nil
+	})
+	if err != nil {
+		return nil, summary, err
+	}
+	if out == nil {
+		out = image.NewNRGBA(image.Rect(0, 0, summary.Width, summary.Height))
+	}
+	return out, summary, nil
+}
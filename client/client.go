@@ -0,0 +1,251 @@
+// Package client は、mosaic serve の HTTP API を呼び出すクライアント
+// リクエストとレスポンスのボディはメモリに読み込まず、そのまま送受信する
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// サーバーが返したエラー
+// サーバーのエラーの JSON ({"error": "..."}) とステータスを保持する
+type Error struct {
+	StatusCode int
+	Message    string
+	RetryAfter time.Duration // Retry-After の値 (指定がない場合は 0)
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("mosaic server: %d %s: %s", e.StatusCode, http.StatusText(e.StatusCode), e.Message)
+}
+
+// 再試行すれば成功する可能性があるかどうか (429 と 503)
+func (e *Error) Temporary() bool {
+	return e.StatusCode == http.StatusTooManyRequests || e.StatusCode == http.StatusServiceUnavailable
+}
+
+// 本文を読み直せないため再試行できなかったことを表すエラー
+var ErrNotRetryable = errors.New("client: request body cannot be resent")
+
+// 処理の設定
+// ゼロ値の項目は送らず、サーバーの設定を使う
+type Params struct {
+	Tile   int    // モザイクタイルの大きさ
+	Format string // 出力の形式 (jpeg、png など。空の場合はサーバーの既定)
+
+	// バンドのストリームで、各バンドに付けてもらう画素のチェックサムの種類 (crc32、crc32c)
+	Checksum string
+}
+
+func (p Params) query() url.Values {
+	q := url.Values{}
+	if p.Tile > 0 {
+		q.Set("tile", strconv.Itoa(p.Tile))
+	}
+	if p.Format != "" {
+		q.Set("format", p.Format)
+	}
+	if p.Checksum != "" {
+		q.Set("checksum", p.Checksum)
+	}
+	return q
+}
+
+// mosaic serve のクライアント
+type Client struct {
+	baseURL    string
+	httpClient *http.Client
+	retries    int           // 429 と 503 の場合に再試行する回数
+	backoff    time.Duration // 最初の再試行までの時間 (再試行のたびに倍にする)
+	maxBackoff time.Duration
+}
+
+type Option func(*Client)
+
+// リクエストに使う http.Client を設定
+func WithHTTPClient(hc *http.Client) Option {
+	return func(c *Client) {
+		c.httpClient = hc
+	}
+}
+
+// 429 と 503 の場合に再試行する回数を設定 (0 で再試行しない)
+func WithRetries(n int) Option {
+	return func(c *Client) {
+		c.retries = n
+	}
+}
+
+// 再試行までの時間を設定
+// Retry-After がない場合は base から始めて再試行のたびに倍にし、max で打ち止めにする
+func WithBackoff(base, max time.Duration) Option {
+	return func(c *Client) {
+		c.backoff, c.maxBackoff = base, max
+	}
+}
+
+// baseURL (例: http://localhost:8080) のサーバーのクライアントを生成
+func New(baseURL string, opts ...Option) *Client {
+	c := &Client{
+		baseURL:    strings.TrimSuffix(baseURL, "/"),
+		httpClient: http.DefaultClient,
+		retries:    3,
+		backoff:    500 * time.Millisecond,
+		maxBackoff: 30 * time.Second,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// r の画像をモザイク処理した結果を返却
+// 結果は読み終えたら Close すること
+// r が io.Seeker の場合だけ、429 と 503 の場合に先頭へ戻して送り直す
+func (c *Client) Process(ctx context.Context, r io.Reader, params Params) (io.ReadCloser, error) {
+	resp, err := c.do(ctx, http.MethodPost, "/process", params.query(), nil, r)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// リクエストを送り、2xx 以外のステータスは *Error にする
+// 429 と 503 の場合は Retry-After またはバックオフの時間だけ待って再試行する
+// header はリクエストに加えるヘッダー (nil でもよい)
+func (c *Client) do(ctx context.Context, method, path string, query url.Values, header http.Header, body io.Reader) (*http.Response, error) {
+	u := c.baseURL + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	// 送り直せるよう、先頭の位置と大きさを覚えておく
+	seeker, _ := body.(io.Seeker)
+	var start, size int64 = 0, -1
+	if seeker != nil {
+		var err error
+		if start, err = seeker.Seek(0, io.SeekCurrent); err != nil {
+			seeker = nil
+		} else if end, err := seeker.Seek(0, io.SeekEnd); err == nil {
+			size = end - start
+			if _, err := seeker.Seek(start, io.SeekStart); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	wait := c.backoff
+	for attempt := 0; ; attempt++ {
+		var (
+			reqBody io.Reader
+			sent    *requestBody
+		)
+		if body != nil {
+			sent = &requestBody{r: body}
+			reqBody = sent
+		}
+		req, err := http.NewRequestWithContext(ctx, method, u, reqBody)
+		if err != nil {
+			return nil, err
+		}
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		if body != nil {
+			req.Header.Set("Content-Type", "application/octet-stream")
+			if size >= 0 {
+				req.ContentLength = size
+			}
+		}
+		resp, err := c.httpClient.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode/100 == 2 {
+			return resp, nil
+		}
+		apiErr := readError(resp)
+		if !apiErr.Temporary() || attempt >= c.retries {
+			return nil, apiErr
+		}
+		if body != nil {
+			// サーバーがボディを読み終える前に応答した場合も、送信を止めてから先頭へ戻す
+			sent.Close()
+			if seeker == nil {
+				return nil, fmt.Errorf("%w: %w", ErrNotRetryable, apiErr)
+			}
+			if _, err := seeker.Seek(start, io.SeekStart); err != nil {
+				return nil, fmt.Errorf("%w: %w", ErrNotRetryable, apiErr)
+			}
+		}
+		delay := apiErr.RetryAfter
+		if delay <= 0 {
+			delay = wait
+			wait = min(2*wait, c.maxBackoff)
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(delay):
+		}
+	}
+}
+
+// リクエストのボディ
+// http.Client は送り終えたボディを閉じるため、呼び出し側の r は閉じない
+// 閉じた後は読み込まないため、閉じてから r を先頭へ戻せる (送信中の Read の終わりを待つ)
+type requestBody struct {
+	mu     sync.Mutex
+	r      io.Reader
+	closed bool
+}
+
+func (b *requestBody) Read(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return 0, errBodyClosed
+	}
+	return b.r.Read(p)
+}
+
+func (b *requestBody) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.closed = true
+	return nil
+}
+
+var errBodyClosed = errors.New("client: request body closed")
+
+// エラーのレスポンスを *Error にする
+// ボディを読み切って閉じる
+func readError(resp *http.Response) *Error {
+	defer resp.Body.Close()
+	e := &Error{StatusCode: resp.StatusCode}
+	var body struct {
+		Error string `json:"error"`
+	}
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if json.Unmarshal(data, &body) == nil && body.Error != "" {
+		e.Message = body.Error
+	} else {
+		e.Message = strings.TrimSpace(string(data))
+	}
+	if v := resp.Header.Get("Retry-After"); v != "" {
+		if sec, err := strconv.Atoi(v); err == nil {
+			e.RetryAfter = time.Duration(sec) * time.Second
+		} else if t, err := http.ParseTime(v); err == nil {
+			e.RetryAfter = time.Until(t)
+		}
+	}
+	return e
+}
@@ -0,0 +1,167 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// 受け取ったリクエストのボディを記録し、最初の failures 回は status で応答するサーバー
+type flakyServer struct {
+	mu         sync.Mutex
+	failures   int
+	status     int
+	retryAfter string
+	bodies     [][]byte
+	queries    []string
+}
+
+func (s *flakyServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	s.mu.Lock()
+	s.bodies = append(s.bodies, body)
+	s.queries = append(s.queries, r.URL.RawQuery)
+	fail := len(s.bodies) <= s.failures
+	s.mu.Unlock()
+	if fail {
+		if s.retryAfter != "" {
+			w.Header().Set("Retry-After", s.retryAfter)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(s.status)
+		io.WriteString(w, `{"error": "busy"}`)
+		return
+	}
+	w.Write(append([]byte("processed:"), body...))
+}
+
+func newFlakyServer(t *testing.T, s *flakyServer) *Client {
+	t.Helper()
+	ts := httptest.NewServer(s)
+	t.Cleanup(ts.Close)
+	return New(ts.URL, WithBackoff(time.Millisecond, 4*time.Millisecond))
+}
+
+func TestProcessRetriesAndResendsBody(t *testing.T) {
+	for _, status := range []int{http.StatusTooManyRequests, http.StatusServiceUnavailable} {
+		s := &flakyServer{failures: 2, status: status}
+		c := newFlakyServer(t, s)
+		payload := []byte("image bytes")
+		rc, err := c.Process(context.Background(), bytes.NewReader(payload), Params{Tile: 16, Format: "png"})
+		if err != nil {
+			t.Fatalf("status %d: %v", status, err)
+		}
+		got, _ := io.ReadAll(rc)
+		rc.Close()
+		if string(got) != "processed:image bytes" {
+			t.Errorf("status %d: response %q", status, got)
+		}
+		// 先頭へ戻して、毎回同じボディを送り直す
+		if len(s.bodies) != 3 {
+			t.Fatalf("status %d: %d requests, want 3", status, len(s.bodies))
+		}
+		for i, body := range s.bodies {
+			if !bytes.Equal(body, payload) {
+				t.Errorf("status %d: attempt %d sent %q", status, i, body)
+			}
+			if s.queries[i] != "format=png&tile=16" {
+				t.Errorf("status %d: attempt %d query %q", status, i, s.queries[i])
+			}
+		}
+	}
+}
+
+func TestProcessResendsFromSeekPosition(t *testing.T) {
+	s := &flakyServer{failures: 1, status: http.StatusServiceUnavailable}
+	c := newFlakyServer(t, s)
+	// 呼び出し時の位置から送り、再試行でもその位置へ戻す
+	r := strings.NewReader("headerIMAGE")
+	r.Seek(6, io.SeekStart)
+	rc, err := c.Process(context.Background(), r, Params{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rc.Close()
+	for i, body := range s.bodies {
+		if string(body) != "IMAGE" {
+			t.Errorf("attempt %d sent %q", i, body)
+		}
+	}
+}
+
+func TestProcessHonorsRetryAfter(t *testing.T) {
+	s := &flakyServer{failures: 1, status: http.StatusTooManyRequests, retryAfter: "1"}
+	c := newFlakyServer(t, s)
+	start := time.Now()
+	rc, err := c.Process(context.Background(), bytes.NewReader([]byte("x")), Params{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rc.Close()
+	// バックオフ (1ms) ではなく Retry-After の 1 秒待つ
+	if elapsed := time.Since(start); elapsed < time.Second {
+		t.Errorf("retried after %v, want at least 1s", elapsed)
+	}
+}
+
+func TestProcessGivesUp(t *testing.T) {
+	s := &flakyServer{failures: 10, status: http.StatusServiceUnavailable, retryAfter: "120"}
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+	c := New(ts.URL, WithRetries(0))
+	_, err := c.Process(context.Background(), bytes.NewReader([]byte("x")), Params{})
+	var apiErr *Error
+	if !errors.As(err, &apiErr) {
+		t.Fatalf("error %v is not *Error", err)
+	}
+	if apiErr.StatusCode != http.StatusServiceUnavailable || apiErr.Message != "busy" || apiErr.RetryAfter != 120*time.Second || !apiErr.Temporary() {
+		t.Errorf("error %+v", apiErr)
+	}
+	if len(s.bodies) != 1 {
+		t.Errorf("%d requests with retries disabled", len(s.bodies))
+	}
+}
+
+func TestProcessNotRetryable(t *testing.T) {
+	s := &flakyServer{failures: 1, status: http.StatusServiceUnavailable}
+	c := newFlakyServer(t, s)
+	// io.Seeker でないボディは送り直せない
+	_, err := c.Process(context.Background(), io.MultiReader(strings.NewReader("x")), Params{})
+	if !errors.Is(err, ErrNotRetryable) {
+		t.Fatalf("error = %v, want ErrNotRetryable", err)
+	}
+	var apiErr *Error
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("error %v does not wrap the server error", err)
+	}
+}
+
+func TestProcessDoesNotRetryClientErrors(t *testing.T) {
+	s := &flakyServer{failures: 1, status: http.StatusBadRequest}
+	c := newFlakyServer(t, s)
+	_, err := c.Process(context.Background(), bytes.NewReader([]byte("x")), Params{})
+	var apiErr *Error
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusBadRequest || apiErr.Temporary() {
+		t.Fatalf("error = %v", err)
+	}
+	if len(s.bodies) != 1 {
+		t.Errorf("%d requests for a 400", len(s.bodies))
+	}
+}
+
+func TestProcessCanceledWhileWaiting(t *testing.T) {
+	s := &flakyServer{failures: 1, status: http.StatusServiceUnavailable, retryAfter: "60"}
+	c := newFlakyServer(t, s)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := c.Process(ctx, bytes.NewReader([]byte("x")), Params{}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("error = %v, want deadline exceeded", err)
+	}
+}
@@ -0,0 +1,78 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// ジョブの状態
+type JobState string
+
+const (
+	JobQueued     JobState = "queued"
+	JobProcessing JobState = "processing"
+	JobDone       JobState = "done"
+	JobFailed     JobState = "failed"
+	JobCanceled   JobState = "canceled"
+)
+
+// 非同期ジョブの情報
+type Job struct {
+	ID         string    `json:"id"`
+	State      JobState  `json:"state"`
+	Progress   float64   `json:"progress"` // 進捗率 (%)
+	Error      string    `json:"error,omitempty"`
+	CreatedAt  time.Time `json:"created_at"`
+	FinishedAt time.Time `json:"finished_at"` // 終了していない場合はゼロ値
+	Format     string    `json:"format"`      // 出力の形式
+	QueueDepth int       `json:"queue_depth"` // 取得した時点でキューで待機しているジョブ数
+}
+
+// ジョブが終了状態かどうか
+func (j Job) Finished() bool {
+	return j.State == JobDone || j.State == JobFailed || j.State == JobCanceled
+}
+
+// r の画像を処理するジョブを登録
+// r が io.Seeker の場合だけ、429 と 503 の場合に先頭へ戻して送り直す
+func (c *Client) Submit(ctx context.Context, r io.Reader, params Params) (Job, error) {
+	return c.job(ctx, http.MethodPost, "/jobs", params.query(), r)
+}
+
+// ジョブの状態を取得
+func (c *Client) Status(ctx context.Context, id string) (Job, error) {
+	return c.job(ctx, http.MethodGet, "/jobs/"+url.PathEscape(id), nil, nil)
+}
+
+// 完了したジョブの処理結果を返却
+// 結果は読み終えたら Close すること。完了していない場合は 409 の *Error を返却
+func (c *Client) Result(ctx context.Context, id string) (io.ReadCloser, error) {
+	resp, err := c.do(ctx, http.MethodGet, "/jobs/"+url.PathEscape(id)+"/result", nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// ジョブをキャンセル
+func (c *Client) Cancel(ctx context.Context, id string) (Job, error) {
+	return c.job(ctx, http.MethodDelete, "/jobs/"+url.PathEscape(id), nil, nil)
+}
+
+// ジョブの情報を返す API を呼び出す
+func (c *Client) job(ctx context.Context, method, path string, query url.Values, body io.Reader) (Job, error) {
+	resp, err := c.do(ctx, method, path, query, nil, body)
+	if err != nil {
+		return Job{}, err
+	}
+	defer resp.Body.Close()
+	var job Job
+	if err := json.NewDecoder(resp.Body).Decode(&job); err != nil {
+		return Job{}, err
+	}
+	return job, nil
+}
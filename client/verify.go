@@ -0,0 +1,110 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"image"
+	"image/draw"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// ReassembleVerified が Params.Checksum を指定しない場合に使うチェックサムの種類
+const defaultChecksum = "crc32c"
+
+var checksumTables = map[string]*crc32.Table{
+	"crc32":  crc32.IEEETable,
+	"crc32c": crc32.MakeTable(crc32.Castagnoli),
+}
+
+// ReassembleVerified で、画像を読めなかったかチェックサムが合わなかったバンドの範囲を持つエラー
+type ChecksumError struct {
+	Rects []image.Rectangle // 壊れたバンドの範囲 (画像全体の座標、上から順)
+}
+
+func (e *ChecksumError) Error() string {
+	rects := make([]string, len(e.Rects))
+	for i, r := range e.Rects {
+		rects[i] = r.String()
+	}
+	return fmt.Sprintf("client: %d corrupted bands: %s", len(e.Rects), strings.Join(rects, ", "))
+}
+
+// バンドの画素のチェックサムがサーバーの付けたものと同じかを確かめる
+// 画素はサーバーと同じく、各行を左から順に乗算済みにしない R, G, B, A の 4 バイトで並べたものとする
+func (b Band) Verify() error {
+	if b.Checksum == "" {
+		return errors.New("client: band has no checksum")
+	}
+	name, want, ok := strings.Cut(b.Checksum, ":")
+	table := checksumTables[strings.ToLower(name)]
+	sum, err := strconv.ParseUint(want, 16, 32)
+	if !ok || table == nil || len(want) != 8 || err != nil {
+		return fmt.Errorf("client: invalid checksum %q", b.Checksum)
+	}
+	if b.Image.Bounds().Size() != image.Pt(b.Width, b.Height) {
+		return fmt.Errorf("client: band image is %v, want %dx%d", b.Image.Bounds().Size(), b.Width, b.Height)
+	}
+	if got := pixelChecksum(table, b.Image); got != uint32(sum) {
+		return fmt.Errorf("client: checksum mismatch (want %s, got %s:%08x)", b.Checksum, name, got)
+	}
+	return nil
+}
+
+// img の画素のチェックサム
+func pixelChecksum(table *crc32.Table, img image.Image) uint32 {
+	nrgba, ok := img.(*image.NRGBA)
+	if !ok {
+		nrgba = image.NewNRGBA(img.Bounds())
+		draw.Draw(nrgba, nrgba.Rect, img, img.Bounds().Min, draw.Src)
+	}
+	var sum uint32
+	width := 4 * nrgba.Rect.Dx()
+	for y := nrgba.Rect.Min.Y; y < nrgba.Rect.Max.Y; y++ {
+		i := nrgba.PixOffset(nrgba.Rect.Min.X, y)
+		sum = crc32.Update(sum, table, nrgba.Pix[i:i+width])
+	}
+	return sum
+}
+
+// r の画像をモザイク処理し、バンドごとにチェックサムを確かめながら組み立てた画像を返却
+// Params.Checksum が空の場合は crc32c を使う
+// 壊れたバンドがあっても最後まで読み、その範囲を空けた画像と、すべての壊れたバンドの範囲の *ChecksumError を返す
+func (c *Client) ReassembleVerified(ctx context.Context, r io.Reader, params Params) (*image.NRGBA, BandSummary, error) {
+	if params.Checksum == "" {
+		params.Checksum = defaultChecksum
+	}
+	var out *image.NRGBA
+	var corrupted []image.Rectangle
+	summary, err := c.streamBands(ctx, r, params, func(b Band, err error) error {
+		if out == nil {
+			out = image.NewNRGBA(image.Rect(0, 0, b.Width, b.Total))
+		}
+		rect := image.Rect(0, b.Y, b.Width, b.Y+b.Height)
+		if err == nil {
+			if b.Checksum == "" {
+				return fmt.Errorf("client: server did not send a checksum for band %v", rect)
+			}
+			err = b.Verify()
+		}
+		if err != nil {
+			corrupted = append(corrupted, rect)
+			return nil
+		}
+		draw.Draw(out, rect, b.Image, b.Image.Bounds().Min, draw.Src)
+		return nil
+	})
+	if err != nil {
+		return nil, summary, err
+	}
+	if out == nil {
+		out = image.NewNRGBA(image.Rect(0, 0, summary.Width, summary.Height))
+	}
+	if len(corrupted) > 0 {
+		return out, summary, &ChecksumError{Rects: corrupted}
+	}
+	return out, summary, nil
+}
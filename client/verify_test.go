@@ -0,0 +1,94 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"strings"
+	"testing"
+)
+
+// 座標からの色で塗ったバンド
+func testBand(w, h int) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			img.SetNRGBA(x, y, color.NRGBA{uint8(10 * x), uint8(20 * y), uint8(x + y), uint8(128 + x)})
+		}
+	}
+	return img
+}
+
+func TestBandVerify(t *testing.T) {
+	img := testBand(6, 4)
+	sum := crc32.Checksum(img.Pix, crc32.MakeTable(crc32.Castagnoli))
+	band := Band{Y: 8, Height: 4, Width: 6, Total: 20, Image: img, Checksum: fmt.Sprintf("crc32c:%08x", sum)}
+	if err := band.Verify(); err != nil {
+		t.Fatal(err)
+	}
+	ieee := band
+	ieee.Checksum = fmt.Sprintf("CRC32:%08X", crc32.ChecksumIEEE(img.Pix))
+	if err := ieee.Verify(); err != nil {
+		t.Errorf("crc32: %v", err)
+	}
+	// 乗算済みの画像は乗算済みにしない画素に戻して確かめる
+	rgba := image.NewRGBA(img.Rect)
+	opaque := testBand(6, 4)
+	for i := 3; i < len(opaque.Pix); i += 4 {
+		opaque.Pix[i] = 255
+	}
+	copy(rgba.Pix, opaque.Pix)
+	converted := Band{Width: 6, Height: 4, Image: rgba, Checksum: fmt.Sprintf("crc32c:%08x", crc32.Checksum(opaque.Pix, crc32.MakeTable(crc32.Castagnoli)))}
+	if err := converted.Verify(); err != nil {
+		t.Errorf("RGBA band: %v", err)
+	}
+	// 一部を切り出した画像は範囲の画素だけを使う
+	big := testBand(10, 10)
+	sub := big.SubImage(image.Rect(2, 3, 8, 7)).(*image.NRGBA)
+	var pix []byte
+	for y := 3; y < 7; y++ {
+		pix = append(pix, big.Pix[big.PixOffset(2, y):big.PixOffset(8, y)]...)
+	}
+	cropped := Band{Width: 6, Height: 4, Image: sub, Checksum: fmt.Sprintf("crc32c:%08x", crc32.Checksum(pix, crc32.MakeTable(crc32.Castagnoli)))}
+	if err := cropped.Verify(); err != nil {
+		t.Errorf("sub-image band: %v", err)
+	}
+
+	tests := []struct {
+		name string
+		edit func(b *Band)
+		want string
+	}{
+		{"no checksum", func(b *Band) { b.Checksum = "" }, "no checksum"},
+		{"unknown algorithm", func(b *Band) { b.Checksum = "md5:0123abcd" }, "invalid checksum"},
+		{"short sum", func(b *Band) { b.Checksum = "crc32c:abc" }, "invalid checksum"},
+		{"not hex", func(b *Band) { b.Checksum = "crc32c:0123abcz" }, "invalid checksum"},
+		{"no separator", func(b *Band) { b.Checksum = "crc32c" }, "invalid checksum"},
+		{"size", func(b *Band) { b.Height = 5 }, "band image is"},
+		{"pixel", func(b *Band) {
+			changed := testBand(6, 4)
+			changed.Pix[13] ^= 0x80
+			b.Image = changed
+		}, "checksum mismatch"},
+	}
+	for _, tt := range tests {
+		b := band
+		tt.edit(&b)
+		if err := b.Verify(); err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: %v, want %q", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestChecksumError(t *testing.T) {
+	err := error(&ChecksumError{Rects: []image.Rectangle{image.Rect(0, 8, 40, 16), image.Rect(0, 24, 40, 32)}})
+	if got, want := err.Error(), "client: 2 corrupted bands: (0,8)-(40,16), (0,24)-(40,32)"; got != want {
+		t.Errorf("Error = %q, want %q", got, want)
+	}
+	var ce *ChecksumError
+	if !errors.As(fmt.Errorf("wrapped: %w", err), &ce) || len(ce.Rects) != 2 {
+		t.Error("errors.As failed")
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"image"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/yashikota/go-streaming-image-mosaic/client"
+	"github.com/yashikota/go-streaming-image-mosaic/mosaic"
+)
+
+// client パッケージを実際のサーバーのハンドラーに対して使う (クライアントとサーバーの食い違いを見つけるため)
+func TestClientProcess(t *testing.T) {
+	ts, _ := newTestServer(t, "-cache-size", "0")
+	c := client.New(ts.URL)
+	src := testImage(48, 32)
+
+	rc, err := c.Process(context.Background(), bytes.NewReader(encodeTestImage(t, src, "png")), client.Params{Tile: 8, Format: "png"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	img, format, err := image.Decode(rc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if format != "png" || img.Bounds() != src.Rect {
+		t.Fatalf("got %s %v", format, img.Bounds())
+	}
+	want, err := mosaic.New(src, 8, 8).ProcessContext(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(mosaic.ConvertToNRGBA(img).Pix, want.Pix) {
+		t.Error("client result differs from the library result")
+	}
+
+	// サーバーのエラーの JSON を *client.Error にする
+	_, err = c.Process(context.Background(), bytes.NewReader([]byte("not an image")), client.Params{})
+	var apiErr *client.Error
+	if !errors.As(err, &apiErr) || apiErr.StatusCode/100 != 4 || apiErr.Message == "" || apiErr.Temporary() {
+		t.Errorf("error for a broken image: %v", err)
+	}
+}
+
+func TestClientRetriesRateLimit(t *testing.T) {
+	ts, _ := newTestServer(t, "-cache-size", "0", "-rate", "2/s", "-burst", "1")
+	c := client.New(ts.URL, client.WithBackoff(time.Millisecond, time.Millisecond))
+	input := encodeTestImage(t, testImage(16, 16), "png")
+
+	for i := 0; i < 2; i++ {
+		// 2 回目は 429 の Retry-After だけ待って送り直す
+		rc, err := c.Process(context.Background(), bytes.NewReader(input), client.Params{Tile: 4})
+		if err != nil {
+			t.Fatalf("request %d: %v", i, err)
+		}
+		io.Copy(io.Discard, rc)
+		rc.Close()
+	}
+
+	// 再試行しない設定では 429 をそのまま返す
+	_, err := client.New(ts.URL, client.WithRetries(0)).Process(context.Background(), bytes.NewReader(input), client.Params{})
+	var apiErr *client.Error
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusTooManyRequests || apiErr.RetryAfter <= 0 {
+		t.Errorf("error = %v, want 429 with Retry-After", err)
+	}
+}
+
+func TestClientJobs(t *testing.T) {
+	ts, _ := newTestServer(t, "-workers", "1")
+	c := client.New(ts.URL)
+	ctx := context.Background()
+
+	job, err := c.Submit(ctx, bytes.NewReader(encodeTestImage(t, testImage(40, 40), "png")), client.Params{Tile: 10, Format: "png"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job.ID == "" {
+		t.Fatalf("job without an id: %+v", job)
+	}
+	for deadline := time.Now().Add(10 * time.Second); !job.Finished(); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("job did not finish: %+v", job)
+		}
+		if job, err = c.Status(ctx, job.ID); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if job.State != client.JobDone || job.Format != "png" {
+		t.Fatalf("job %+v", job)
+	}
+	rc, err := c.Result(ctx, job.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	if _, format, err := image.Decode(rc); err != nil || format != "png" {
+		t.Errorf("result: %s, %v", format, err)
+	}
+
+	var apiErr *client.Error
+	if _, err := c.Status(ctx, "no-such-job"); !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusNotFound {
+		t.Errorf("status of an unknown job: %v", err)
+	}
+}
@@ -0,0 +1,181 @@
+// Package colorspace は、sRGB と線形 RGB、XYZ、CIELAB (L*a*b*)、OKLab の間で色を変換する
+// 白色点は sRGB と同じ D65 を使う
+package colorspace
+
+import (
+	"math"
+	"sort"
+)
+
+// CIELAB の色
+// L は 0〜100、A と B はおおよそ -128〜127 の範囲を取る
+type Lab struct {
+	L, A, B float64
+}
+
+// CIE XYZ の色 (Y は 0〜1)
+type XYZ struct {
+	X, Y, Z float64
+}
+
+// D65 の白色点
+var whiteD65 = XYZ{X: 0.95047, Y: 1, Z: 1.08883}
+
+// sRGB の 8 ビット値から線形の値への表
+var toLinear [256]float64
+
+// 線形の値を 8 ビット値に戻す際のしきい値
+// toLinear の隣り合う値の中点で、線形の値がしきい値 i 以上なら i+1 以上になる
+var thresholds [255]float64
+
+// 線形の sRGB から XYZ への行列と、その逆行列
+// 逆行列は丸めた係数を使わずに計算し、範囲内の色が往復で範囲外にならないようにする
+var (
+	linearToXYZ = [3][3]float64{
+		{0.4124564, 0.3575761, 0.1804375},
+		{0.2126729, 0.7151522, 0.0721750},
+		{0.0193339, 0.1191920, 0.9503041},
+	}
+	xyzToLinear = invert(linearToXYZ)
+)
+
+// 3x3 の行列の逆行列
+func invert(m [3][3]float64) [3][3]float64 {
+	var inv [3][3]float64
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 3; j++ {
+			// 余因子を転置して並べる
+			a, b := (j+1)%3, (j+2)%3
+			c, d := (i+1)%3, (i+2)%3
+			inv[i][j] = m[a][c]*m[b][d] - m[a][d]*m[b][c]
+		}
+	}
+	det := m[0][0]*inv[0][0] + m[0][1]*inv[1][0] + m[0][2]*inv[2][0]
+	for i := range inv {
+		for j := range inv[i] {
+			inv[i][j] /= det
+		}
+	}
+	return inv
+}
+
+func init() {
+	for i := range toLinear {
+		v := float64(i) / 255
+		if v <= 0.04045 {
+			toLinear[i] = v / 12.92
+		} else {
+			toLinear[i] = math.Pow((v+0.055)/1.055, 2.4)
+		}
+	}
+	for i := range thresholds {
+		thresholds[i] = (toLinear[i] + toLinear[i+1]) / 2
+	}
+}
+
+// sRGB の 8 ビット値を 0〜1 の線形の値に変換
+func SRGBToLinear(v uint8) float64 {
+	return toLinear[v]
+}
+
+// 0〜1 の線形の値を sRGB の 8 ビット値に変換 (範囲外の値は 0 または 255 にする)
+// 表を二分探索するため、SRGBToLinear の結果は元の値に戻る
+func LinearToSRGB(v float64) uint8 {
+	return uint8(sort.Search(len(thresholds), func(i int) bool { return thresholds[i] > v }))
+}
+
+// 線形の sRGB を XYZ に変換
+func LinearToXYZ(r, g, b float64) XYZ {
+	m := &linearToXYZ
+	return XYZ{
+		X: m[0][0]*r + m[0][1]*g + m[0][2]*b,
+		Y: m[1][0]*r + m[1][1]*g + m[1][2]*b,
+		Z: m[2][0]*r + m[2][1]*g + m[2][2]*b,
+	}
+}
+
+// XYZ を線形の sRGB に変換 (sRGB の範囲外の色は 0〜1 の範囲外の値になる)
+func XYZToLinear(c XYZ) (r, g, b float64) {
+	m := &xyzToLinear
+	r = m[0][0]*c.X + m[0][1]*c.Y + m[0][2]*c.Z
+	g = m[1][0]*c.X + m[1][1]*c.Y + m[1][2]*c.Z
+	b = m[2][0]*c.X + m[2][1]*c.Y + m[2][2]*c.Z
+	return r, g, b
+}
+
+// CIELAB の変換で使う定数
+const (
+	labEpsilon = 216.0 / 24389
+	labKappa   = 24389.0 / 27
+)
+
+// XYZ を CIELAB に変換
+func XYZToLab(c XYZ) Lab {
+	fx := labF(c.X / whiteD65.X)
+	fy := labF(c.Y / whiteD65.Y)
+	fz := labF(c.Z / whiteD65.Z)
+	return Lab{L: 116*fy - 16, A: 500 * (fx - fy), B: 200 * (fy - fz)}
+}
+
+func labF(t float64) float64 {
+	if t > labEpsilon {
+		return math.Cbrt(t)
+	}
+	return (labKappa*t + 16) / 116
+}
+
+// CIELAB を XYZ に変換
+func LabToXYZ(c Lab) XYZ {
+	fy := (c.L + 16) / 116
+	fx := fy + c.A/500
+	fz := fy - c.B/200
+	return XYZ{X: whiteD65.X * labFInv(fx), Y: whiteD65.Y * labFInv(fy), Z: whiteD65.Z * labFInv(fz)}
+}
+
+func labFInv(f float64) float64 {
+	if t := f * f * f; t > labEpsilon {
+		return t
+	}
+	return (116*f - 16) / labKappa
+}
+
+// sRGB の 8 ビット値を CIELAB に変換
+func SRGBToLab(r, g, b uint8) Lab {
+	return XYZToLab(LinearToXYZ(toLinear[r], toLinear[g], toLinear[b]))
+}
+
+// CIELAB を sRGB の 8 ビット値に変換
+// sRGB で表せない色は、明度と色相を保ったまま彩度を下げて sRGB の範囲に収める
+func LabToSRGB(c Lab) (r, g, b uint8) {
+	c.L = min(max(c.L, 0), 100)
+	return fitGamut(func(s float64) (r, g, b float64) {
+		return XYZToLinear(LabToXYZ(Lab{L: c.L, A: c.A * s, B: c.B * s}))
+	})
+}
+
+// 彩度を元の s 倍 (0〜1) にした色の線形の値を返す linear から、sRGB の範囲に収まる色を 8 ビット値で返却
+// 元の色が範囲外の場合は、範囲内に収まる最大の彩度の割合を二分探索する
+func fitGamut(linear func(s float64) (r, g, b float64)) (r, g, b uint8) {
+	lr, lg, lb := linear(1)
+	if !inGamut(lr, lg, lb) {
+		lo, hi := 0.0, 1.0
+		for i := 0; i < 16; i++ {
+			s := (lo + hi) / 2
+			if inGamut(linear(s)) {
+				lo = s
+			} else {
+				hi = s
+			}
+		}
+		lr, lg, lb = linear(lo)
+	}
+	return LinearToSRGB(lr), LinearToSRGB(lg), LinearToSRGB(lb)
+}
+
+// 線形の値が sRGB の範囲に収まっているかどうか (丸めの誤差は許容する)
+func inGamut(r, g, b float64) bool {
+	const tolerance = 1e-9
+	return r >= -tolerance && r <= 1+tolerance &&
+		g >= -tolerance && g <= 1+tolerance &&
+		b >= -tolerance && b <= 1+tolerance
+}
@@ -0,0 +1,222 @@
+package colorspace
+
+import (
+	"math"
+	"testing"
+)
+
+// 8 ビット値の差の絶対値
+func diff8(a, b uint8) int {
+	if a > b {
+		return int(a - b)
+	}
+	return int(b - a)
+}
+
+// 往復した色と元の色の、成分ごとの差の最大値
+func roundTripError(r, g, b uint8, back func(r, g, b uint8) (uint8, uint8, uint8)) int {
+	br, bg, bb := back(r, g, b)
+	return max(diff8(r, br), diff8(g, bg), diff8(b, bb))
+}
+
+// 3 成分の色を step おきに並べ、fn を呼ぶ (255 も必ず含める)
+func eachColor(step int, fn func(r, g, b uint8)) {
+	values := []uint8{}
+	for v := 0; v < 255; v += step {
+		values = append(values, uint8(v))
+	}
+	values = append(values, 255)
+	for _, r := range values {
+		for _, g := range values {
+			for _, b := range values {
+				fn(r, g, b)
+			}
+		}
+	}
+}
+
+func TestSRGBLinearRoundTrip(t *testing.T) {
+	prev := -1.0
+	for i := 0; i < 256; i++ {
+		v := uint8(i)
+		lin := SRGBToLinear(v)
+		if lin <= prev {
+			t.Fatalf("SRGBToLinear(%d) = %v is not increasing", v, lin)
+		}
+		prev = lin
+		if got := LinearToSRGB(lin); got != v {
+			t.Errorf("LinearToSRGB(SRGBToLinear(%d)) = %d", v, got)
+		}
+	}
+	// 参照値 (IEC 61966-2-1 の式)
+	for _, tt := range []struct {
+		v    uint8
+		want float64
+	}{{0, 0}, {10, 10.0 / 255 / 12.92}, {128, 0.2158605}, {255, 1}} {
+		if got := SRGBToLinear(tt.v); math.Abs(got-tt.want) > 1e-6 {
+			t.Errorf("SRGBToLinear(%d) = %v, want %v", tt.v, got, tt.want)
+		}
+	}
+	for _, tt := range []struct {
+		v    float64
+		want uint8
+	}{{-0.5, 0}, {0, 0}, {1, 255}, {1.5, 255}, {0.2158605, 128}} {
+		if got := LinearToSRGB(tt.v); got != tt.want {
+			t.Errorf("LinearToSRGB(%v) = %d, want %d", tt.v, got, tt.want)
+		}
+	}
+}
+
+func TestXYZRoundTrip(t *testing.T) {
+	eachColor(15, func(r, g, b uint8) {
+		lr, lg, lb := SRGBToLinear(r), SRGBToLinear(g), SRGBToLinear(b)
+		xr, xg, xb := XYZToLinear(LinearToXYZ(lr, lg, lb))
+		if e := max(math.Abs(xr-lr), math.Abs(xg-lg), math.Abs(xb-lb)); e > 1e-12 {
+			t.Fatalf("(%d,%d,%d): linear round trip error %g", r, g, b, e)
+		}
+	})
+	// D65 の白は白色点になる
+	if w := LinearToXYZ(1, 1, 1); math.Abs(w.X-whiteD65.X) > 1e-4 || math.Abs(w.Y-1) > 1e-6 || math.Abs(w.Z-whiteD65.Z) > 1e-4 {
+		t.Errorf("white = %+v, want %+v", w, whiteD65)
+	}
+}
+
+func TestLabRoundTrip(t *testing.T) {
+	worst := 0
+	eachColor(3, func(r, g, b uint8) {
+		worst = max(worst, roundTripError(r, g, b, func(r, g, b uint8) (uint8, uint8, uint8) {
+			return LabToSRGB(SRGBToLab(r, g, b))
+		}))
+	})
+	if worst > 1 {
+		t.Errorf("max Lab round trip error %d/255, want <= 1/255", worst)
+	}
+}
+
+func TestLabReference(t *testing.T) {
+	// 参照値 (D65、sRGB の原色と白黒)
+	tests := []struct {
+		r, g, b uint8
+		want    Lab
+	}{
+		{0, 0, 0, Lab{0, 0, 0}},
+		{255, 255, 255, Lab{100, 0, 0}},
+		{255, 0, 0, Lab{53.2408, 80.0925, 67.2032}},
+		{0, 255, 0, Lab{87.7347, -86.1827, 83.1793}},
+		{0, 0, 255, Lab{32.2970, 79.1875, -107.8602}},
+		{128, 128, 128, Lab{53.5850, 0, 0}},
+	}
+	for _, tt := range tests {
+		got := SRGBToLab(tt.r, tt.g, tt.b)
+		if math.Abs(got.L-tt.want.L) > 0.01 || math.Abs(got.A-tt.want.A) > 0.01 || math.Abs(got.B-tt.want.B) > 0.01 {
+			t.Errorf("SRGBToLab(%d,%d,%d) = %+v, want %+v", tt.r, tt.g, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestLabOutOfGamut(t *testing.T) {
+	tests := []struct {
+		in      Lab
+		r, g, b uint8
+	}{
+		// 明度の範囲外は切り詰める
+		{Lab{150, 0, 0}, 255, 255, 255},
+		{Lab{-20, 0, 0}, 0, 0, 0},
+	}
+	for _, tt := range tests {
+		if r, g, b := LabToSRGB(tt.in); r != tt.r || g != tt.g || b != tt.b {
+			t.Errorf("LabToSRGB(%+v) = %d,%d,%d, want %d,%d,%d", tt.in, r, g, b, tt.r, tt.g, tt.b)
+		}
+	}
+	// 彩度を下げて収めた色は、明度を保ち、色相の向きが変わらない
+	in := Lab{L: 60, A: 150, B: 20}
+	r, g, b := LabToSRGB(in)
+	got := SRGBToLab(r, g, b)
+	if math.Abs(got.L-in.L) > 1 || got.A <= 0 || math.Abs(math.Atan2(got.B, got.A)-math.Atan2(in.B, in.A)) > 0.05 {
+		t.Errorf("LabToSRGB(%+v) = %d,%d,%d (%+v)", in, r, g, b, got)
+	}
+}
+
+func TestOKLabRoundTrip(t *testing.T) {
+	worst := 0
+	eachColor(3, func(r, g, b uint8) {
+		worst = max(worst, roundTripError(r, g, b, func(r, g, b uint8) (uint8, uint8, uint8) {
+			return OKLabToSRGB(SRGBToOKLab(r, g, b))
+		}))
+	})
+	if worst > 1 {
+		t.Errorf("max OKLab round trip error %d/255, want <= 1/255", worst)
+	}
+}
+
+func TestOKLabReference(t *testing.T) {
+	// 参照値 (Björn Ottosson による sRGB の原色と白)
+	tests := []struct {
+		r, g, b uint8
+		want    OKLab
+	}{
+		{0, 0, 0, OKLab{0, 0, 0}},
+		{255, 255, 255, OKLab{1, 0, 0}},
+		{255, 0, 0, OKLab{0.62796, 0.22486, 0.12585}},
+		{0, 255, 0, OKLab{0.86644, -0.23389, 0.17950}},
+		{0, 0, 255, OKLab{0.45201, -0.03246, -0.31153}},
+	}
+	for _, tt := range tests {
+		got := SRGBToOKLab(tt.r, tt.g, tt.b)
+		if math.Abs(got.L-tt.want.L) > 1e-4 || math.Abs(got.A-tt.want.A) > 1e-4 || math.Abs(got.B-tt.want.B) > 1e-4 {
+			t.Errorf("SRGBToOKLab(%d,%d,%d) = %+v, want %+v", tt.r, tt.g, tt.b, got, tt.want)
+		}
+	}
+	// 範囲外の色は明度を保って収める
+	if r, g, b := OKLabToSRGB(OKLab{L: 2}); r != 255 || g != 255 || b != 255 {
+		t.Errorf("OKLabToSRGB(L=2) = %d,%d,%d", r, g, b)
+	}
+	in := OKLab{L: 0.7, A: 0.4, B: 0}
+	r, g, b := OKLabToSRGB(in)
+	if got := SRGBToOKLab(r, g, b); math.Abs(got.L-in.L) > 0.01 || got.A <= 0 {
+		t.Errorf("OKLabToSRGB(%+v) = %d,%d,%d (%+v)", in, r, g, b, got)
+	}
+}
+
+func TestHSVRoundTrip(t *testing.T) {
+	worst := 0
+	eachColor(5, func(r, g, b uint8) {
+		worst = max(worst, roundTripError(r, g, b, func(r, g, b uint8) (uint8, uint8, uint8) {
+			return HSVToRGB(RGBToHSV(r, g, b))
+		}))
+	})
+	if worst != 0 {
+		t.Errorf("max HSV round trip error %d/255, want 0", worst)
+	}
+}
+
+func TestRGBToHSV(t *testing.T) {
+	tests := []struct {
+		r, g, b uint8
+		want    HSV
+	}{
+		{255, 0, 0, HSV{0, 1, 1}},
+		{255, 255, 0, HSV{60, 1, 1}},
+		{0, 0, 255, HSV{240, 1, 1}},
+		{255, 0, 43, HSV{349.88, 1, 1}},
+		{128, 64, 64, HSV{0, 0.5, 0.502}},
+		{0, 0, 0, HSV{}},
+		{128, 128, 128, HSV{0, 0, 0.502}},
+	}
+	for _, tt := range tests {
+		got := RGBToHSV(tt.r, tt.g, tt.b)
+		if math.Abs(got.H-tt.want.H) > 0.01 || math.Abs(got.S-tt.want.S) > 0.001 || math.Abs(got.V-tt.want.V) > 0.001 {
+			t.Errorf("RGBToHSV(%d,%d,%d) = %+v, want %+v", tt.r, tt.g, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestNormalizeHue(t *testing.T) {
+	for _, tt := range []struct{ in, want float64 }{
+		{0, 0}, {359.5, 359.5}, {360, 0}, {720, 0}, {-10, 350}, {-360, 0}, {370, 10}, {-1e-15, 0},
+	} {
+		if got := NormalizeHue(tt.in); math.Abs(got-tt.want) > 1e-9 || got >= 360 {
+			t.Errorf("NormalizeHue(%g) = %g, want %g", tt.in, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package colorspace
+
+import "math"
+
+// HSV の色
+// H は 0〜360 未満の角度 (度)、S と V は 0〜1 の範囲を取る
+type HSV struct {
+	H, S, V float64
+}
+
+// sRGB の 8 ビット値を HSV に変換
+// 無彩色の色相は 0 とする
+func RGBToHSV(r, g, b uint8) HSV {
+	hi := max(r, g, b)
+	lo := min(r, g, b)
+	if hi == 0 {
+		return HSV{}
+	}
+	v := float64(hi) / 255
+	chroma := float64(hi - lo)
+	s := chroma / float64(hi)
+	if chroma == 0 {
+		return HSV{S: s, V: v}
+	}
+	var h float64
+	switch hi {
+	case r:
+		h = float64(int(g)-int(b)) / chroma
+	case g:
+		h = float64(int(b)-int(r))/chroma + 2
+	default:
+		h = float64(int(r)-int(g))/chroma + 4
+	}
+	return HSV{H: NormalizeHue(h * 60), S: s, V: v}
+}
+
+// HSV を sRGB の 8 ビット値に変換 (S と V は 0〜1 に切り詰める)
+func HSVToRGB(c HSV) (r, g, b uint8) {
+	s := min(max(c.S, 0), 1)
+	v := min(max(c.V, 0), 1)
+	h := NormalizeHue(c.H) / 60
+	chroma := v * s
+	x := chroma * (1 - math.Abs(math.Mod(h, 2)-1))
+	var fr, fg, fb float64
+	switch int(h) {
+	case 0:
+		fr, fg = chroma, x
+	case 1:
+		fr, fg = x, chroma
+	case 2:
+		fg, fb = chroma, x
+	case 3:
+		fg, fb = x, chroma
+	case 4:
+		fr, fb = x, chroma
+	default:
+		fr, fb = chroma, x
+	}
+	m := v - chroma
+	return to8(fr + m), to8(fg + m), to8(fb + m)
+}
+
+func to8(v float64) uint8 {
+	return uint8(math.Round(min(max(v, 0), 1) * 255))
+}
+
+// 角度を 0〜360 未満の範囲にする
+func NormalizeHue(h float64) float64 {
+	h = math.Mod(h, 360)
+	if h < 0 {
+		h += 360
+	}
+	if h >= 360 {
+		// -1e-15 などを足した結果が 360 に丸められる場合
+		h = 0
+	}
+	return h
+}
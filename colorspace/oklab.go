@@ -0,0 +1,59 @@
+package colorspace
+
+import "math"
+
+// OKLab の色
+// L は 0〜1、A と B はおおよそ -0.4〜0.4 の範囲を取る
+type OKLab struct {
+	L, A, B float64
+}
+
+// 線形の sRGB から LMS への行列と、LMS の立方根から OKLab への行列 (Björn Ottosson による定義)
+var (
+	linearToLMS = [3][3]float64{
+		{0.4122214708, 0.5363325363, 0.0514459929},
+		{0.2119034982, 0.6806995451, 0.1073969566},
+		{0.0883024619, 0.2817188376, 0.6299787005},
+	}
+	lmsToOKLab = [3][3]float64{
+		{0.2104542553, 0.7936177850, -0.0040720468},
+		{1.9779984951, -2.4285922050, 0.4505937099},
+		{0.0259040371, 0.7827717662, -0.8086757660},
+	}
+	lmsToLinear = invert(linearToLMS)
+	okLabToLMS  = invert(lmsToOKLab)
+)
+
+// 3x3 の行列と 3 つの値の積
+func mul(m *[3][3]float64, a, b, c float64) (x, y, z float64) {
+	return m[0][0]*a + m[0][1]*b + m[0][2]*c,
+		m[1][0]*a + m[1][1]*b + m[1][2]*c,
+		m[2][0]*a + m[2][1]*b + m[2][2]*c
+}
+
+// 線形の sRGB を OKLab に変換
+func LinearToOKLab(r, g, b float64) OKLab {
+	l, m, s := mul(&linearToLMS, r, g, b)
+	L, A, B := mul(&lmsToOKLab, math.Cbrt(l), math.Cbrt(m), math.Cbrt(s))
+	return OKLab{L: L, A: A, B: B}
+}
+
+// OKLab を線形の sRGB に変換 (sRGB の範囲外の色は 0〜1 の範囲外の値になる)
+func OKLabToLinear(c OKLab) (r, g, b float64) {
+	l, m, s := mul(&okLabToLMS, c.L, c.A, c.B)
+	return mul(&lmsToLinear, l*l*l, m*m*m, s*s*s)
+}
+
+// sRGB の 8 ビット値を OKLab に変換
+func SRGBToOKLab(r, g, b uint8) OKLab {
+	return LinearToOKLab(toLinear[r], toLinear[g], toLinear[b])
+}
+
+// OKLab を sRGB の 8 ビット値に変換
+// sRGB で表せない色は、明度と色相を保ったまま彩度を下げて sRGB の範囲に収める
+func OKLabToSRGB(c OKLab) (r, g, b uint8) {
+	c.L = min(max(c.L, 0), 1)
+	return fitGamut(func(s float64) (r, g, b float64) {
+		return OKLabToLinear(OKLab{L: c.L, A: c.A * s, B: c.B * s})
+	})
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	"io"
+	"os"
+
+	"github.com/yashikota/go-streaming-image-mosaic/mosaic"
+)
+
+// compare のフラグ
+type compareFlags struct {
+	*commonFlags
+	out       *string
+	threshold *float64
+	json      *bool
+}
+
+func newCompareFlags(stderr io.Writer) *compareFlags {
+	c := newCommonFlags("compare", "[flags] before after", stderr)
+	return &compareFlags{
+		commonFlags: c,
+		out:         c.fs.String("out", "", "変わったタイルを示す画像の出力先 (省略時は書き出さない)"),
+		threshold:   c.fs.Float64("threshold", 4, "タイルが変わったとみなす、画素ごとの差 (RGBA の差の最大値、0〜255) のタイル内の平均"),
+		json:        c.fs.Bool("json", false, "要約を JSON 形式で標準出力に出力する"),
+	}
+}
+
+// 2 つの画像の大きさが異なることを表すエラー
+type sizeMismatchError struct {
+	before, after image.Point
+}
+
+func (e *sizeMismatchError) Error() string {
+	return fmt.Sprintf("image sizes differ: before is %dx%d, after is %dx%d", e.before.X, e.before.Y, e.after.X, e.after.Y)
+}
+
+// 変わったタイル
+type changedTile struct {
+	Column     int     `json:"column"`
+	Row        int     `json:"row"`
+	X          int     `json:"x"`
+	Y          int     `json:"y"`
+	Width      int     `json:"width"`
+	Height     int     `json:"height"`
+	Difference float64 `json:"difference"` // 画素ごとの差のタイル内の平均
+}
+
+// 比較の要約
+type compareSummary struct {
+	Width     int           `json:"width"`
+	Height    int           `json:"height"`
+	Tile      int           `json:"tile"`
+	Threshold float64       `json:"threshold"`
+	Tiles     int           `json:"tiles"`
+	Changed   int           `json:"changed"`
+	Bounds    *rectJSON     `json:"bounds,omitempty"` // 変わったタイルをすべて囲む範囲
+	Regions   []changedTile `json:"changed_tiles"`
+}
+
+type rectJSON struct {
+	X      int `json:"x"`
+	Y      int `json:"y"`
+	Width  int `json:"width"`
+	Height int `json:"height"`
+}
+
+// 2 つの画像をタイルごとに比べ、変わったタイルを表示する
+// モザイク処理したタイルは画素がすべて変わるため、画素ではなくタイルの単位で差を求める
+func runCompare(args []string, stdout, stderr io.Writer) error {
+	f := newCompareFlags(stderr)
+	if err := f.parse(args); err != nil {
+		return err
+	}
+	if f.fs.NArg() != 2 {
+		return &usageError{errors.New("compare needs two images: before and after")}
+	}
+	if *f.threshold < 0 || *f.threshold > 255 {
+		return &usageError{errors.New("threshold must be between 0 and 255")}
+	}
+	beforePath, afterPath := f.fs.Arg(0), f.fs.Arg(1)
+	before, err := readCompareImage(beforePath)
+	if err != nil {
+		return err
+	}
+	after, err := readCompareImage(afterPath)
+	if err != nil {
+		return err
+	}
+	if before.Rect.Size() != after.Rect.Size() {
+		return &inputError{path: afterPath, err: &sizeMismatchError{before: before.Rect.Size(), after: after.Rect.Size()}}
+	}
+	// 原点が異なる画像も、左上をそろえて比べる
+	if after.Rect.Min != before.Rect.Min {
+		after = translated(after, before.Rect.Min)
+	}
+
+	summary, changed := compareTiles(before, after, *f.tile, image.Pt(f.settings.GridOrigin[0], f.settings.GridOrigin[1]), *f.threshold)
+	if *f.out != "" {
+		diff := diffMap(before, after, summary.Regions)
+		if err := writeImage(*f.out, diff, mosaic.EncodeOptions{}); err != nil {
+			return &outputError{path: *f.out, err: err}
+		}
+	}
+
+	if *f.json {
+		enc := json.NewEncoder(stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(summary)
+	}
+	fmt.Fprintf(stderr, "%d of %d tiles changed\n", summary.Changed, summary.Tiles)
+	if b := summary.Bounds; b != nil {
+		fmt.Fprintf(stderr, "bounds: %dx%d+%d+%d\n", b.Width, b.Height, b.X, b.Y)
+	}
+	for _, t := range changed {
+		fmt.Fprintf(stderr, "  tile (%d,%d) %dx%d+%d+%d difference %.1f\n", t.Column, t.Row, t.Width, t.Height, t.X, t.Y, t.Difference)
+	}
+	return nil
+}
+
+// 比べる画像を読み込む
+func readCompareImage(path string) (*image.NRGBA, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, &inputError{path: path, err: err}
+	}
+	defer file.Close()
+	img, _, err := mosaic.Decode(file)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, &stageError{stage: stageDecode, err: err})
+	}
+	return mosaic.ConvertToNRGBA(img), nil
+}
+
+// 左上が min になるよう範囲をずらした画像 (画素は共有する)
+func translated(img *image.NRGBA, min image.Point) *image.NRGBA {
+	out := *img
+	out.Rect = img.Rect.Sub(img.Rect.Min).Add(min)
+	return &out
+}
+
+// タイルごとに画素の差の平均を求め、しきい値を超えたタイルを返却
+// 画素ごとの差 (RGBA の各成分の差の最大値) を画素とする画像を作り、タイルの平均色と同じ格子で平均する
+// タイルは apply と同じく origin を通る格子に並べる
+func compareTiles(before, after *image.NRGBA, tile int, origin image.Point, threshold float64) (compareSummary, []changedTile) {
+	diff := image.NewNRGBA(before.Rect)
+	for i := 0; i < len(diff.Pix); i += 4 {
+		d := uint8(0)
+		for c := 0; c < 4; c++ {
+			d = max(d, absDiff(before.Pix[i+c], after.Pix[i+c]))
+		}
+		diff.Pix[i], diff.Pix[i+1], diff.Pix[i+2], diff.Pix[i+3] = d, d, d, 0xff
+	}
+	// PixOffset は Rect が同じ画像どうしで同じになる
+	grid := mosaic.NewColorGridAt(diff, tile, origin)
+
+	summary := compareSummary{
+		Width:     before.Rect.Dx(),
+		Height:    before.Rect.Dy(),
+		Tile:      tile,
+		Threshold: threshold,
+		Tiles:     grid.Columns * grid.Rows,
+		Regions:   []changedTile{},
+	}
+	var bounds image.Rectangle
+	for row := 0; row < grid.Rows; row++ {
+		for col := 0; col < grid.Columns; col++ {
+			d := float64(grid.At(col, row).R)
+			if d <= threshold {
+				continue
+			}
+			r := grid.Grid().Cell(col, row).Rect
+			summary.Regions = append(summary.Regions, changedTile{
+				Column: col, Row: row, X: r.Min.X - before.Rect.Min.X, Y: r.Min.Y - before.Rect.Min.Y,
+				Width: r.Dx(), Height: r.Dy(), Difference: d,
+			})
+			bounds = bounds.Union(r)
+		}
+	}
+	summary.Changed = len(summary.Regions)
+	if !bounds.Empty() {
+		b := bounds.Sub(before.Rect.Min)
+		summary.Bounds = &rectJSON{X: b.Min.X, Y: b.Min.Y, Width: b.Dx(), Height: b.Dy()}
+	}
+	return summary, summary.Regions
+}
+
+// 変わらなかったタイルは元画像を暗くし、変わったタイルは処理後の画像を赤く重ねて輪郭を描いた画像
+func diffMap(before, after *image.NRGBA, changed []changedTile) *image.NRGBA {
+	dst := mosaic.Dim(before, 0.5)
+	for _, t := range changed {
+		r := image.Rect(t.X, t.Y, t.X+t.Width, t.Y+t.Height).Add(before.Rect.Min)
+		draw.Draw(dst, r, after, r.Min, draw.Src)
+		mosaic.BlendRect(dst, r, mosaic.OutlineColor, 0.3)
+		mosaic.StrokeRect(dst, r, mosaic.OutlineColor)
+	}
+	return dst
+}
+
+func absDiff(a, b uint8) uint8 {
+	if a > b {
+		return a - b
+	}
+	return b - a
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"image"
+	"image/color"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// compare -json の要約
+func runCompareJSON(t *testing.T, args ...string) compareSummary {
+	t.Helper()
+	res := runCLI(t, append([]string{"compare", "-json"}, args...)...)
+	if res.code != exitOK {
+		t.Fatalf("exit code = %d (stderr: %s)", res.code, res.stderr)
+	}
+	var summary compareSummary
+	if err := json.Unmarshal([]byte(res.stdout), &summary); err != nil {
+		t.Fatalf("%v: %s", err, res.stdout)
+	}
+	return summary
+}
+
+func TestCompareIdentical(t *testing.T) {
+	dir := t.TempDir()
+	a, b := filepath.Join(dir, "a.png"), filepath.Join(dir, "b.png")
+	writeTestImage(t, a, testImage(50, 30))
+	writeTestImage(t, b, testImage(50, 30))
+
+	summary := runCompareJSON(t, "-tile", "10", a, b)
+	if summary.Tiles != 15 || summary.Changed != 0 || summary.Bounds != nil || len(summary.Regions) != 0 {
+		t.Errorf("summary = %+v, want 15 tiles and none changed", summary)
+	}
+	res := runCLI(t, "compare", "-tile", "10", a, b)
+	if res.code != exitOK || !strings.Contains(res.stderr, "0 of 15 tiles changed") {
+		t.Errorf("exit code = %d (stderr: %s)", res.code, res.stderr)
+	}
+}
+
+// apply で範囲だけを処理した画像と元画像を比べると、範囲のタイルだけが変わっている
+func TestCompareChangedTiles(t *testing.T) {
+	dir := t.TempDir()
+	orig, processed := filepath.Join(dir, "orig.png"), filepath.Join(dir, "processed.png")
+	writeTestImage(t, orig, testImage(50, 30))
+	if res := runCLI(t, "apply", "-in", orig, "-out", processed, "-tile", "10", "-region", "10,10,20,10", "-quiet"); res.code != exitOK {
+		t.Fatalf("exit code = %d (stderr: %s)", res.code, res.stderr)
+	}
+
+	diff := filepath.Join(dir, "diff.png")
+	summary := runCompareJSON(t, "-tile", "10", "-out", diff, orig, processed)
+	if summary.Changed != 2 || len(summary.Regions) != 2 {
+		t.Fatalf("summary = %+v, want 2 changed tiles", summary)
+	}
+	for i, want := range []changedTile{{Column: 1, Row: 1, X: 10, Y: 10}, {Column: 2, Row: 1, X: 20, Y: 10}} {
+		got := summary.Regions[i]
+		if got.Column != want.Column || got.Row != want.Row || got.X != want.X || got.Y != want.Y || got.Width != 10 || got.Height != 10 || got.Difference <= 4 {
+			t.Errorf("changed tile %d = %+v, want %+v 10x10", i, got, want)
+		}
+	}
+	if b := summary.Bounds; b == nil || *b != (rectJSON{X: 10, Y: 10, Width: 20, Height: 10}) {
+		t.Errorf("bounds = %+v, want 20x10+10+10", b)
+	}
+
+	// 変わらなかったタイルは元画像を暗くし、変わったタイルは輪郭を描く
+	img := readTestImage(t, diff)
+	src := testImage(50, 30)
+	if got, c := img.NRGBAAt(5, 5), src.NRGBAAt(5, 5); got.R > c.R/2+1 || got.G > c.G/2+1 {
+		t.Errorf("unchanged pixel %v is not dimmed from %v", got, c)
+	}
+	if got := img.NRGBAAt(10, 10); got.R < 200 || got.G > 100 {
+		t.Errorf("outline pixel of a changed tile = %v, want red", got)
+	}
+
+	// しきい値を超えない差は変わったとみなさない
+	if summary := runCompareJSON(t, "-tile", "10", "-threshold", "255", orig, processed); summary.Changed != 0 {
+		t.Errorf("threshold 255: %d tiles changed", summary.Changed)
+	}
+}
+
+func TestCompareTilesThreshold(t *testing.T) {
+	before := image.NewNRGBA(image.Rect(0, 0, 4, 2))
+	after := image.NewNRGBA(image.Rect(0, 0, 4, 2))
+	for i := range before.Pix {
+		before.Pix[i], after.Pix[i] = 100, 100
+	}
+	// 右のタイルの 1 画素だけを 40 変えると、タイル内の平均の差は 10
+	after.SetNRGBA(3, 1, color.NRGBA{140, 100, 100, 100})
+	summary, changed := compareTiles(before, after, 2, image.Point{}, 9.9)
+	if summary.Tiles != 2 || len(changed) != 1 || changed[0].Column != 1 || changed[0].Difference != 10 {
+		t.Errorf("summary = %+v", summary)
+	}
+	if _, changed := compareTiles(before, after, 2, image.Point{}, 10); len(changed) != 0 {
+		t.Errorf("difference equal to the threshold counted as changed: %+v", changed)
+	}
+}
+
+func TestCompareErrors(t *testing.T) {
+	dir := t.TempDir()
+	a, b := filepath.Join(dir, "a.png"), filepath.Join(dir, "b.png")
+	writeTestImage(t, a, testImage(50, 30))
+	writeTestImage(t, b, testImage(30, 50))
+	text := filepath.Join(dir, "text.png")
+	writeTestFile(t, text, []byte("not an image"))
+
+	tests := []struct {
+		args   []string
+		code   int
+		stderr string
+	}{
+		{[]string{a}, exitUsage, "two images"},
+		{[]string{"-threshold", "300", a, a}, exitUsage, "threshold"},
+		{[]string{a, b}, exitInput, "before is 50x30, after is 30x50"},
+		{[]string{a, filepath.Join(dir, "missing.png")}, exitInput, "missing.png"},
+		{[]string{a, text}, exitDecode, "text.png"},
+	}
+	for _, tt := range tests {
+		out := filepath.Join(dir, "diff.png")
+		res := runCLI(t, append([]string{"compare", "-out", out}, tt.args...)...)
+		if res.code != tt.code || !strings.Contains(res.stderr, tt.stderr) {
+			t.Errorf("%v: exit code = %d, want %d with %q (stderr: %s)", tt.args, res.code, tt.code, tt.stderr, res.stderr)
+		}
+		if _, err := os.Stat(out); err == nil {
+			t.Errorf("%v: diff map was written", tt.args)
+		}
+	}
+}
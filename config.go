@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// 解決済みの設定を出力する
+func runConfig(args []string, stdout, stderr io.Writer) error {
+	if len(args) == 0 || args[0] != "print" {
+		return &usageError{errors.New("usage: mosaic config print [command] [flags]")}
+	}
+	args = args[1:]
+
+	name := "apply"
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name, args = args[0], args[1:]
+	}
+	cmd, ok := lookupCommand(name)
+	if !ok || cmd.flags == nil {
+		return &usageError{fmt.Errorf("unknown command %q", name)}
+	}
+
+	c := cmd.flags(stderr)
+	if err := c.parse(args); err != nil {
+		return err
+	}
+	return printConfig(c.fs, stdout)
+}
+
+// 設定ファイルを読み込み、コマンドラインで指定されていないフラグに値を設定
+// 設定ファイルのキーはフラグ名と同じで、known に含まれないキーはエラーとする
+func loadConfig(fs *flag.FlagSet, path string, known map[string]bool) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var values map[string]json.RawMessage
+	if err := json.Unmarshal(data, &values); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+
+	// コマンドラインや環境変数で指定されたフラグを優先する
+	explicit := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		if !known[key] {
+			return fmt.Errorf("%s: unknown key %q", path, key)
+		}
+		if fs.Lookup(key) == nil || explicit[key] {
+			continue
+		}
+		value, err := configValue(values[key])
+		if err != nil {
+			return fmt.Errorf("%s: key %q: %w", path, key, err)
+		}
+		if err := fs.Set(key, value); err != nil {
+			return fmt.Errorf("%s: key %q: %w", path, key, err)
+		}
+	}
+	return nil
+}
+
+// JSON の値をフラグに渡す文字列に変換
+func configValue(raw json.RawMessage) (string, error) {
+	var v any
+	if err := json.Unmarshal(raw, &v); err != nil {
+		return "", err
+	}
+	switch v := v.(type) {
+	case string:
+		return v, nil
+	case float64, bool:
+		return string(raw), nil
+	default:
+		return "", fmt.Errorf("unsupported value %s", raw)
+	}
+}
+
+// 解決済みの設定を JSON で書き出す
+func printConfig(fs *flag.FlagSet, w io.Writer) error {
+	values := map[string]any{}
+	fs.VisitAll(func(f *flag.Flag) {
+		if f.Name == "config" {
+			return
+		}
+		v := f.Value.(flag.Getter).Get()
+		if d, ok := v.(time.Duration); ok {
+			v = d.String()
+		}
+		values[f.Name] = v
+	})
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(values)
+}
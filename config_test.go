@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// config print の結果
+func printedConfig(t *testing.T, args ...string) map[string]any {
+	t.Helper()
+	res := runCLI(t, append([]string{"config", "print"}, args...)...)
+	if res.code != exitOK {
+		t.Fatalf("config print %v: exit code %d (stderr: %s)", args, res.code, res.stderr)
+	}
+	var values map[string]any
+	if err := json.Unmarshal([]byte(res.stdout), &values); err != nil {
+		t.Fatal(err)
+	}
+	return values
+}
+
+func TestConfigPrecedence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "mosaic.json")
+	writeTestFile(t, path, []byte(`{"tile": 20, "quality": 70, "format": "png", "timeout": "3s"}`))
+
+	// 既定値 < 設定ファイル < 環境変数 < フラグ
+	t.Setenv("MOSAIC_QUALITY", "80")
+	t.Setenv("MOSAIC_FORMAT", "gif")
+	values := printedConfig(t, "apply", "-config", path, "-format", "tiff")
+	for key, want := range map[string]any{
+		"tile":     20.0,   // 設定ファイル
+		"quality":  80.0,   // 環境変数が設定ファイルより優先
+		"format":   "tiff", // フラグが環境変数より優先
+		"timeout":  "3s",   // 設定ファイルの期間
+		"parallel": 0.0,    // 既定値
+	} {
+		if values[key] != want {
+			t.Errorf("%s = %v, want %v", key, values[key], want)
+		}
+	}
+}
+
+func TestConfigFromEnv(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "mosaic.json")
+	writeTestFile(t, path, []byte(`{"tile": 12}`))
+	// -config も環境変数で指定できる
+	t.Setenv("MOSAIC_CONFIG", path)
+	t.Setenv("MOSAIC_QUIET", "true")
+	values := printedConfig(t, "apply")
+	if values["tile"] != 12.0 || values["quiet"] != true {
+		t.Errorf("tile = %v, quiet = %v", values["tile"], values["quiet"])
+	}
+}
+
+func TestConfigErrors(t *testing.T) {
+	dir := t.TempDir()
+	unknown := filepath.Join(dir, "unknown.json")
+	writeTestFile(t, unknown, []byte(`{"tlie": 20}`))
+	badValue := filepath.Join(dir, "bad.json")
+	writeTestFile(t, badValue, []byte(`{"tile": "large"}`))
+
+	tests := []struct {
+		name    string
+		env     map[string]string
+		args    []string
+		message string
+	}{
+		{"unknown key", nil, []string{"-config", unknown}, `unknown key "tlie"`},
+		{"bad config value", nil, []string{"-config", badValue}, `key "tile"`},
+		{"bad env value", map[string]string{"MOSAIC_TILE": "large"}, nil, "MOSAIC_TILE"},
+		{"bad env bool", map[string]string{"MOSAIC_QUIET": "maybe"}, nil, "MOSAIC_QUIET"},
+		{"bad env duration", map[string]string{"MOSAIC_TIMEOUT": "5"}, nil, "MOSAIC_TIMEOUT"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+			res := runCLI(t, append([]string{"config", "print", "apply"}, tt.args...)...)
+			if res.code != exitUsage {
+				t.Fatalf("exit code = %d, want %d", res.code, exitUsage)
+			}
+			if !strings.Contains(res.stderr, tt.message) {
+				t.Errorf("stderr %q does not contain %q", res.stderr, tt.message)
+			}
+		})
+	}
+}
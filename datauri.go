@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/yashikota/go-streaming-image-mosaic/mosaic"
+)
+
+const (
+	dataURIStdin = "data:-" // data URI を標準入力から読む場合の -in の値
+	dataURIOut   = "data:"  // 処理結果を data URI として標準出力に書き出す場合の -out の値
+)
+
+// data URI の , までの部分 (MIME タイプとパラメーター) の最大バイト数
+const maxDataURIHeader = 1024
+
+// 出力の MIME タイプを決めるために控える先頭のバイト数
+const dataURISniffLen = 4
+
+// 入力が data URI かどうか
+func isDataURI(s string) bool {
+	return strings.HasPrefix(s, dataURIOut)
+}
+
+// エラーとログに使う data URI の名前 (本文を除いた data:image/png;base64 など)
+func dataURIName(uri string) string {
+	if i := strings.IndexByte(uri, ','); i >= 0 && i <= maxDataURIHeader {
+		return uri[:i]
+	}
+	if uri == dataURIStdin {
+		return uri
+	}
+	return dataURIOut
+}
+
+// data URI の本文を base64 からデコードしながら読む io.Reader
+// 読み込みのエラーを記録し、本文の誤りと画像のデコードの失敗を区別できるようにする
+type dataURIReader struct {
+	r   io.Reader
+	err error // 最初に発生した読み込みのエラー (io.EOF を除く)
+}
+
+func (d *dataURIReader) Read(p []byte) (int, error) {
+	n, err := d.r.Read(p)
+	if err != nil && err != io.EOF && d.err == nil {
+		d.err = err
+	}
+	return n, err
+}
+
+// data URI を開き、本文をデコードしながら読む dataURIReader を返却
+// data:- の場合は URI を stdin から読む。本文は写しを作らずに読みながらデコードする
+// maxSize は URI 全体の最大バイト数 (0 の場合は無制限)
+// base64 でない URI (;base64 がないもの) と画像でない MIME タイプは読み込む前にエラーとする
+func openDataURI(uri string, stdin io.Reader, maxSize int64) (*dataURIReader, error) {
+	var src io.Reader
+	if uri == dataURIStdin {
+		src = &sizeLimitReader{r: stdin, limit: maxSize}
+	} else {
+		if maxSize > 0 && int64(len(uri)) > maxSize {
+			return nil, fmt.Errorf("data URI of %d bytes exceeds the limit of %d bytes", len(uri), maxSize)
+		}
+		src = strings.NewReader(uri)
+	}
+	br := bufio.NewReader(src)
+	header, err := readDataURIHeader(br)
+	if err != nil {
+		return nil, err
+	}
+	mediaType, ok := strings.CutSuffix(header, ";base64")
+	if !ok {
+		return nil, errors.New("data URI is not base64-encoded (want data:image/png;base64,...)")
+	}
+	// MIME タイプを省略した場合は、形式をデコーダーに判別させる
+	if mediaType != "" && !strings.HasPrefix(mediaType, ";") {
+		if err := checkImageMediaType(mediaType); err != nil {
+			return nil, err
+		}
+	}
+	return &dataURIReader{r: base64.NewDecoder(base64.StdEncoding, &base64Body{r: br})}, nil
+}
+
+// data: から , までを読み、間の部分 (MIME タイプとパラメーター) を返却
+func readDataURIHeader(r *bufio.Reader) (string, error) {
+	var b []byte
+	for len(b) < len(dataURIOut)+maxDataURIHeader {
+		c, err := r.ReadByte()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+		if c == ',' {
+			header, ok := strings.CutPrefix(strings.TrimSpace(string(b)), dataURIOut)
+			if !ok {
+				return "", errors.New("not a data URI (want data:image/png;base64,...)")
+			}
+			return header, nil
+		}
+		b = append(b, c)
+	}
+	if !strings.HasPrefix(strings.TrimSpace(string(b)), dataURIOut) {
+		return "", errors.New("not a data URI (want data:image/png;base64,...)")
+	}
+	return "", errors.New("malformed data URI: missing , after the media type")
+}
+
+// base64 の本文から空白と改行を除き、省略された末尾の = を補う io.Reader
+type base64Body struct {
+	r   io.Reader
+	n   int    // これまでに読んだ空白以外の文字の数
+	pad string // 本文の終わりの後に渡す = (本文を読み終えるまでは空)
+	eof bool
+}
+
+func (b *base64Body) Read(p []byte) (int, error) {
+	for !b.eof {
+		n, err := b.r.Read(p)
+		k := 0
+		for _, c := range p[:n] {
+			switch c {
+			case ' ', '\t', '\r', '\n':
+			default:
+				p[k] = c
+				k++
+			}
+		}
+		b.n += k
+		if err == io.EOF {
+			b.eof = true
+			if r := b.n % 4; r >= 2 {
+				b.pad = "=="[:4-r]
+			}
+			err = nil
+		}
+		if k > 0 || err != nil {
+			return k, err
+		}
+	}
+	if b.pad == "" {
+		return 0, io.EOF
+	}
+	n := copy(p, b.pad)
+	b.pad = b.pad[n:]
+	return n, nil
+}
+
+// 最大バイト数を超えて読み込もうとした場合はエラーを返す io.Reader (limit が 0 の場合は無制限)
+type sizeLimitReader struct {
+	r     io.Reader
+	limit int64
+	n     int64
+}
+
+func (l *sizeLimitReader) Read(p []byte) (int, error) {
+	if l.limit > 0 && l.n >= l.limit {
+		// 上限ちょうどで終わる入力と区別するため、1 バイト先を確認する
+		var one [1]byte
+		if n, err := l.r.Read(one[:]); n == 0 {
+			return 0, err
+		}
+		return 0, fmt.Errorf("data URI exceeds the limit of %d bytes", l.limit)
+	}
+	if l.limit > 0 && int64(len(p)) > l.limit-l.n {
+		p = p[:l.limit-l.n]
+	}
+	n, err := l.r.Read(p)
+	l.n += int64(n)
+	return n, err
+}
+
+// data URI の画像をモザイク処理した結果をファイルに書き込む
+func processDataURI(ctx context.Context, p pipeline, uri string, stdin io.Reader, maxSize int64, out string, progress mosaic.ProgressFunc) error {
+	name := dataURIName(uri)
+	body, err := openDataURI(uri, stdin, maxSize)
+	if err != nil {
+		return &inputError{path: name, err: err}
+	}
+	err = processReader(ctx, p, name, body, out, progress)
+	if err != nil && body.err != nil {
+		// 本文の誤りや上限を超えた場合は、デコードのエラーではなく入力のエラーとする
+		return &inputError{path: name, err: body.err}
+	}
+	return err
+}
+
+// 書き込まれた画像を base64 にして、data URI として w に書き出す io.WriteCloser
+// 出力全体を控えずに書き込みながらエンコードし、Close で末尾のパディングと改行を書き出す
+type dataURIWriter struct {
+	w         *bufio.Writer
+	mediaType func(head []byte) string // 先頭のバイトから出力の MIME タイプを決める
+	head      []byte                   // MIME タイプを決めるまで控えた先頭のバイト
+	enc       io.WriteCloser
+}
+
+func newDataURIWriter(w io.Writer, mediaType func(head []byte) string) *dataURIWriter {
+	return &dataURIWriter{w: bufio.NewWriter(w), mediaType: mediaType}
+}
+
+func (d *dataURIWriter) Write(b []byte) (int, error) {
+	if d.enc != nil {
+		return d.enc.Write(b)
+	}
+	d.head = append(d.head, b...)
+	if len(d.head) < dataURISniffLen {
+		return len(b), nil
+	}
+	if err := d.start(); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// MIME タイプを書き、控えた先頭のバイトからエンコードを始める
+func (d *dataURIWriter) start() error {
+	if _, err := d.w.WriteString(dataURIOut + d.mediaType(d.head) + ";base64,"); err != nil {
+		return err
+	}
+	d.enc = base64.NewEncoder(base64.StdEncoding, d.w)
+	_, err := d.enc.Write(d.head)
+	d.head = nil
+	return err
+}
+
+func (d *dataURIWriter) Close() error {
+	if d.enc == nil {
+		if err := d.start(); err != nil {
+			return err
+		}
+	}
+	if err := d.enc.Close(); err != nil {
+		return err
+	}
+	if err := d.w.WriteByte('\n'); err != nil {
+		return err
+	}
+	return d.w.Flush()
+}
+
+// 出力の MIME タイプ
+// タイルを要素で表す形式とアニメーションはその形式で、TIFF の入力は TIFF で、それ以外は encoder の形式で決める
+func (p pipeline) outputMediaType(head []byte) string {
+	switch {
+	case p.format == exportSVG:
+		return "image/svg+xml"
+	case p.format == exportHTML:
+		return "text/html;charset=utf-8"
+	case p.format == formatEmojiText:
+		return "text/plain;charset=utf-8"
+	case p.format == formatStitch || p.format == formatEmojiPNG:
+		return "image/png"
+	case p.animate != nil:
+		return "image/gif"
+	}
+	return outputContentType(head, p.encoderName())
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"image"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/yashikota/go-streaming-image-mosaic/mosaic"
+)
+
+// enc で payload を本文にした data URI
+func testDataURI(mediaType string, enc *base64.Encoding, payload []byte) string {
+	return "data:" + mediaType + ";base64," + enc.EncodeToString(payload)
+}
+
+// data URI の本文をデコードした画像
+func decodeDataURI(t *testing.T, uri string) *image.NRGBA {
+	t.Helper()
+	body, err := openDataURI(strings.TrimSpace(uri), nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, _, err := mosaic.Decode(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return mosaic.ConvertToNRGBA(img)
+}
+
+// data を標準入力にして f を呼び出す
+func withStdin(t *testing.T, data string, f func()) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "stdin")
+	writeTestFile(t, path, []byte(data))
+	in, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer in.Close()
+	old := os.Stdin
+	os.Stdin = in
+	defer func() { os.Stdin = old }()
+	f()
+}
+
+func TestDataURIRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	input := encodeTestImage(t, testImage(40, 30), "png")
+	src := filepath.Join(dir, "in.png")
+	writeTestFile(t, src, input)
+	want := filepath.Join(dir, "want.png")
+	if res := runCLI(t, "apply", "-in", src, "-out", want, "-tile", "8", "-quiet"); res.code != exitOK {
+		t.Fatalf("exit code = %d (stderr: %s)", res.code, res.stderr)
+	}
+
+	// data URI を読み、data URI で書き出す
+	res := runCLI(t, "apply", "-in", testDataURI("image/png", base64.StdEncoding, input), "-out", "data:", "-format", "png", "-tile", "8", "-quiet")
+	if res.code != exitOK {
+		t.Fatalf("exit code = %d (stderr: %s)", res.code, res.stderr)
+	}
+	if !strings.HasPrefix(res.stdout, "data:image/png;base64,") || strings.Count(res.stdout, "\n") != 1 || !strings.HasSuffix(res.stdout, "\n") {
+		t.Fatalf("output %.60q is not a single-line PNG data URI", res.stdout)
+	}
+	assertSameNRGBA(t, decodeDataURI(t, res.stdout), readTestImage(t, want))
+
+	// 標準入力の、改行を含み末尾の = を省いた data URI
+	body := base64.RawStdEncoding.EncodeToString(input)
+	var wrapped strings.Builder
+	for len(body) > 76 {
+		wrapped.WriteString(body[:76] + "\r\n")
+		body = body[76:]
+	}
+	wrapped.WriteString(body)
+	out := filepath.Join(dir, "stdin.png")
+	withStdin(t, "data:image/png;base64,"+wrapped.String()+"\n", func() {
+		res = runCLI(t, "apply", "-in", "data:-", "-out", out, "-tile", "8", "-quiet")
+	})
+	if res.code != exitOK {
+		t.Fatalf("stdin: exit code = %d (stderr: %s)", res.code, res.stderr)
+	}
+	assertSameNRGBA(t, readTestImage(t, out), readTestImage(t, want))
+}
+
+func assertSameNRGBA(t *testing.T, got, want *image.NRGBA) {
+	t.Helper()
+	if got.Rect != want.Rect || !bytes.Equal(got.Pix, want.Pix) {
+		t.Fatalf("images differ (%v, %v)", got.Rect, want.Rect)
+	}
+}
+
+func TestOpenDataURIPadding(t *testing.T) {
+	for _, payload := range [][]byte{[]byte("a"), []byte("ab"), []byte("abc"), []byte("abcd"), bytes.Repeat([]byte{0xfb, 0xff}, 100)} {
+		for _, enc := range []*base64.Encoding{base64.StdEncoding, base64.RawStdEncoding} {
+			uri := testDataURI("image/png", enc, payload)
+			body, err := openDataURI(uri, nil, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := io.ReadAll(body)
+			if err != nil || !bytes.Equal(got, payload) {
+				t.Errorf("%q: read %q, %v, want %q", uri, got, err, payload)
+			}
+		}
+	}
+}
+
+func TestOpenDataURIErrors(t *testing.T) {
+	payload := base64.StdEncoding.EncodeToString([]byte("image bytes"))
+	tests := []struct {
+		name, uri, want string
+	}{
+		{"no base64 marker", "data:image/png," + payload, "not base64-encoded"},
+		{"percent-encoded", "data:image/png;charset=utf-8,%89PNG", "not base64-encoded"},
+		{"not an image", "data:text/plain;base64," + payload, "is not an image"},
+		{"no comma", "data:image/png;base64" + payload, "missing , after the media type"},
+		{"invalid media type", "data:image/png;=;base64," + payload, "invalid content type"},
+		{"not a data URI", "date:image/png;base64," + payload, "not a data URI"},
+		{"header too long", "data:image/png;" + strings.Repeat("x", maxDataURIHeader+1) + ";base64," + payload, "missing ,"},
+	}
+	for _, tt := range tests {
+		_, err := openDataURI(tt.uri, nil, 0)
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: %v, want %q", tt.name, err, tt.want)
+		}
+	}
+	// MIME タイプを省略した URI は形式をデコーダーに判別させる
+	if _, err := openDataURI("data:;base64,"+payload, nil, 0); err != nil {
+		t.Errorf("without a media type: %v", err)
+	}
+
+	// 本文の誤りは読み込みのエラーとして記録する
+	body, err := openDataURI("data:image/png;base64,iVBO!!!!", nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadAll(body); err == nil || body.err == nil {
+		t.Errorf("corrupt body: %v (recorded %v)", err, body.err)
+	}
+}
+
+func TestDataURISizeLimit(t *testing.T) {
+	uri := testDataURI("image/png", base64.StdEncoding, bytes.Repeat([]byte{1}, 300))
+	if _, err := openDataURI(uri, nil, int64(len(uri)-1)); err == nil || !strings.Contains(err.Error(), "exceeds the limit") {
+		t.Errorf("argument over the limit: %v", err)
+	}
+	if body, err := openDataURI(uri, nil, int64(len(uri))); err != nil {
+		t.Errorf("argument at the limit: %v", err)
+	} else if _, err := io.ReadAll(body); err != nil {
+		t.Errorf("argument at the limit: %v", err)
+	}
+	// 標準入力は読みながら上限を確かめる
+	body, err := openDataURI(dataURIStdin, strings.NewReader(uri), int64(len(uri)-1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadAll(body); err == nil || !strings.Contains(body.err.Error(), "exceeds the limit") {
+		t.Errorf("stdin over the limit: %v", err)
+	}
+	body, err = openDataURI(dataURIStdin, strings.NewReader(uri), int64(len(uri)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadAll(body); err != nil {
+		t.Errorf("stdin at the limit: %v", err)
+	}
+}
+
+func TestApplyDataURIErrors(t *testing.T) {
+	input := encodeTestImage(t, testImage(16, 16), "png")
+	out := filepath.Join(t.TempDir(), "out.png")
+	tests := []struct {
+		name string
+		args []string
+		code int
+	}{
+		{"no base64 marker", []string{"-in", "data:image/png," + string(input[:8])}, exitInput},
+		{"corrupt base64", []string{"-in", "data:image/png;base64,iVBORw0K!!!!"}, exitInput},
+		{"over the limit", []string{"-in", testDataURI("image/png", base64.StdEncoding, input), "-data-max-size", "100"}, exitInput},
+		{"not an image", []string{"-in", testDataURI("image/png", base64.StdEncoding, []byte("plain text, not a PNG"))}, exitDecode},
+		{"negative limit", []string{"-in", testDataURI("image/png", base64.StdEncoding, input), "-data-max-size", "-1"}, exitUsage},
+	}
+	for _, tt := range tests {
+		res := runCLI(t, append([]string{"apply", "-out", out, "-tile", "8", "-quiet"}, tt.args...)...)
+		if res.code != tt.code {
+			t.Errorf("%s: exit code = %d, want %d (stderr: %s)", tt.name, res.code, tt.code, res.stderr)
+		}
+		// エラーには本文を含めない
+		if len(res.stderr) > 200 {
+			t.Errorf("%s: stderr has %d bytes", tt.name, len(res.stderr))
+		}
+	}
+}
+
+// 書き出す data URI の MIME タイプは、出力の先頭のバイトが短くても決める
+func TestDataURIWriter(t *testing.T) {
+	for _, data := range []string{"", "ab", "abcdef"} {
+		var buf bytes.Buffer
+		w := newDataURIWriter(&buf, func(head []byte) string { return "image/x-test" })
+		for i := 0; i < len(data); i++ {
+			if _, err := w.Write([]byte{data[i]}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if want := testDataURI("image/x-test", base64.StdEncoding, []byte(data)) + "\n"; buf.String() != want {
+			t.Errorf("%q: %q, want %q", data, buf.String(), want)
+		}
+	}
+}
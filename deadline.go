@@ -0,0 +1,260 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"io"
+	"math/rand"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/yashikota/go-streaming-image-mosaic/mosaic"
+)
+
+// 見積もりの誤差を見込み、残りの時間のこの割合に収まるように近道を選ぶ
+const deadlineMargin = 0.8
+
+// 縮小する倍率の上限
+const maxDownscale = 16
+
+// -deadline の処理時間の見積もりに使う、起動時に測った処理の速さ
+type workModel struct {
+	decode  float64 // デコードと NRGBA への変換の画素/秒
+	scale   float64 // 縮小の画素/秒 (縮小する前の画素の数)
+	process float64 // モザイク処理とエンコードの画素/秒 (タイルの数によらない部分)
+	perTile float64 // タイル 1 つあたりの処理の秒数
+}
+
+// 処理を間に合わせるための近道 (ゼロ値は近道をしない)
+type degradation struct {
+	Downscale int // 元画像を 1/Downscale に縮小してから処理する (1 以下は縮小しない)
+	Tile      int // 大きくしたタイルの大きさ (0 の場合は変えない)
+}
+
+// 適用した近道の X-Mosaic-Degraded の値 (例: "downscale=2; tile=32"、近道をしない場合は "none")
+func (d degradation) String() string {
+	var parts []string
+	if d.Downscale > 1 {
+		parts = append(parts, fmt.Sprintf("downscale=%d", d.Downscale))
+	}
+	if d.Tile > 0 {
+		parts = append(parts, fmt.Sprintf("tile=%d", d.Tile))
+	}
+	if len(parts) == 0 {
+		return "none"
+	}
+	return strings.Join(parts, "; ")
+}
+
+// width×height の画像を 1/downscale に縮小し、タイル tile で処理する時間の見積もり
+// デコードと縮小は縮小する前の画像の大きさで、処理とエンコードは縮小した画像の大きさで見積もる
+func (m workModel) estimate(width, height, tile, downscale int) time.Duration {
+	downscale = max(1, downscale)
+	w, h := ceilDiv(width, downscale), ceilDiv(height, downscale)
+	source, pixels := float64(width)*float64(height), float64(w)*float64(h)
+	tiles := float64(ceilDiv(w, tile)) * float64(ceilDiv(h, tile))
+	seconds := source/m.decode + pixels/m.process + tiles*m.perTile
+	if downscale > 1 {
+		seconds += source / m.scale
+	}
+	return time.Duration(seconds * float64(time.Second))
+}
+
+// width×height の画像をタイル tile で budget 以内に処理するための近道と、その見積もりを選ぶ
+// 縮小の倍率が小さいものから順に、タイルの大きさは元の 1、2、4 倍 (画像の大きさまで) を試し、最初に収まるものにする
+// 縮小する場合のタイルは、元画像の上で同じ大きさになるように 1/倍率 (切り上げ) にしてから大きくする
+// どの近道でも収まらない場合 (デコードだけで収まらないなど) は、最も粗い近道の見積もりの 1.1 倍に収まる最初の近道にする
+func planDegradation(m workModel, width, height, tile int, budget time.Duration) (degradation, time.Duration) {
+	if floor := m.estimate(width, height, 4*ceilDiv(tile, maxDownscale), maxDownscale); floor > budget {
+		budget = floor + floor/10
+	}
+	var (
+		d        degradation
+		estimate time.Duration
+	)
+	for downscale := 1; downscale <= maxDownscale; downscale++ {
+		limit := max(1, min(ceilDiv(width, downscale), ceilDiv(height, downscale)))
+		base := ceilDiv(tile, downscale)
+		for _, t := range []int{base, 2 * base, 4 * base} {
+			if t > limit && t != base {
+				break
+			}
+			d = degradation{Downscale: downscale, Tile: t}
+			estimate = m.estimate(width, height, t, downscale)
+			if estimate <= budget {
+				break
+			}
+		}
+		if estimate <= budget {
+			break
+		}
+	}
+	if d.Downscale == 1 {
+		d.Downscale = 0
+	}
+	if d.Tile == tile {
+		d.Tile = 0
+	}
+	return d, estimate
+}
+
+func ceilDiv(a, b int) int {
+	return (a + b - 1) / b
+}
+
+// p の設定で小さな画像を処理し、処理の速さを測る
+// デコードとエンコードには JPEG を使い、タイルの数による違いは小さいタイルと大きいタイルの差から求める
+// 測ったうちで最も遅い速さにして、見積もりを短くしすぎないようにする
+func calibrateWork(ctx context.Context, p pipeline) (workModel, error) {
+	const size, small, large, runs = 512, 4, 64, 3
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, syntheticImage(size, size), nil); err != nil {
+		return workModel{}, err
+	}
+	var decodeTime, scaleTime, smallTime, largeTime time.Duration
+	for i := 0; i <= runs; i++ {
+		start := time.Now()
+		img, _, err := mosaic.Decode(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			return workModel{}, err
+		}
+		src := mosaic.ConvertToNRGBA(img)
+		decoded := time.Since(start)
+		start = time.Now()
+		downscaleSource(src, src, 2)
+		scaled := time.Since(start)
+
+		times := [2]time.Duration{}
+		for j, tile := range []int{small, large} {
+			work := image.NewNRGBA(src.Rect)
+			copy(work.Pix, src.Pix)
+			opts, err := p.options(discardLogger, nil, work)
+			if err != nil {
+				// 入力の大きさに合わせる設定 (強さのマップなど) は測定では使わない
+				opts = []mosaic.Option{mosaic.WithWorkers(p.workers)}
+			}
+			start := time.Now()
+			if _, err := mosaic.New(work, tile, tile, opts...).ProcessInPlace(ctx); err != nil {
+				return workModel{}, err
+			}
+			if err := p.encode(io.Discard, work); err != nil {
+				return workModel{}, err
+			}
+			times[j] = time.Since(start)
+		}
+		if i == 0 {
+			// 最初の 1 回は準備 (テーブルの生成など) を含むため捨てる
+			continue
+		}
+		decodeTime, scaleTime = max(decodeTime, decoded), max(scaleTime, scaled)
+		smallTime, largeTime = max(smallTime, times[0]), max(largeTime, times[1])
+	}
+
+	pixels := float64(size * size)
+	smallTiles, largeTiles := float64(ceilDiv(size, small)*ceilDiv(size, small)), float64(ceilDiv(size, large)*ceilDiv(size, large))
+	m := workModel{decode: pixels / max(decodeTime.Seconds(), 1e-6), scale: pixels / max(scaleTime.Seconds(), 1e-6)}
+	m.perTile = max(0, (smallTime-largeTime).Seconds()/(smallTiles-largeTiles))
+	m.process = pixels / max(largeTime.Seconds()-largeTiles*m.perTile, 1e-6)
+	return m, nil
+}
+
+// 速さを測るための width×height の画像 (JPEG の圧縮が写真に近くなるよう、なめらかな色にノイズを加える)
+func syntheticImage(width, height int) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	r := rand.New(rand.NewSource(1))
+	for y := 0; y < height; y++ {
+		row := img.Pix[y*img.Stride : y*img.Stride+4*width]
+		for x := 0; x < width; x++ {
+			n := uint8(r.Intn(32))
+			px := row[4*x : 4*x+4 : 4*x+4]
+			px[0], px[1], px[2], px[3] = uint8(x*255/width)^n, uint8(y*255/height)+n, uint8((x*height+y*width)*127/(width*height)), 255
+		}
+	}
+	return img
+}
+
+// 残りの時間に収まるように、ヘッダーを読んだ画像の処理の近道を選んで p に適用する
+// 選んだ近道と見積もりをレスポンスのヘッダーに書く
+// 縮小は TIFF 以外の画像にだけ使い、TIFF と縮小できない設定ではタイルを大きくするだけにする
+func (s *server) fitDeadline(w http.ResponseWriter, r *http.Request, p pipeline, start time.Time, header imageHeader) pipeline {
+	remaining := s.deadline - time.Since(start)
+	if d, ok := r.Context().Deadline(); ok {
+		remaining = min(remaining, time.Until(d))
+	}
+	budget := time.Duration(float64(remaining) * deadlineMargin)
+	config := header.config
+	d, estimate := planDegradation(s.work, config.Width, config.Height, p.tile, budget)
+	if (header.format == "tiff" || !p.downscalable()) && d.Downscale > 1 {
+		d.Downscale = 0
+		d.Tile = 4 * p.tile
+		estimate = s.work.estimate(config.Width, config.Height, d.Tile, 1)
+	}
+	w.Header().Set("X-Mosaic-Degraded", d.String())
+	w.Header().Set("X-Mosaic-Estimated-Duration", estimate.Round(time.Millisecond).String())
+	if d != (degradation{}) && p.logger != nil {
+		p.logger.Info("degraded to fit the deadline",
+			"width", config.Width, "height", config.Height, "budget", budget, "estimate", estimate, "degradation", d.String())
+	}
+	return p.degraded(d)
+}
+
+// 画素の位置を指定する設定 (範囲、タイルの境界、強さのマップなど) がなく、元画像を縮小しても結果の意味が変わらないかどうか
+func (p pipeline) downscalable() bool {
+	return len(p.settings.Regions) == 0 && p.gridOrigin == (image.Point{}) && p.block == (blockSize{}) &&
+		p.strengthMap == nil && p.exclude == nil && p.selectExpr == nil && p.stripes.Process <= 0
+}
+
+// 近道 d を適用した設定
+func (p pipeline) degraded(d degradation) pipeline {
+	if d.Tile > 0 {
+		o := p.settings
+		o.Tile, o.TileMM = d.Tile, 0
+		p.settings = o.Canonical()
+		p.tile, p.tileMM = d.Tile, 0
+	}
+	p.downscale = d.Downscale
+	return p
+}
+
+// src を 1/factor に縮小した画像と、region に対応する範囲 (端は切り上げる)
+// factor×factor の画素を不透明度で重み付けして平均し 1 画素にする (右端と下端は残りの画素の平均)
+func downscaleSource(src, region *image.NRGBA, factor int) (*image.NRGBA, *image.NRGBA) {
+	size := src.Rect.Size()
+	out := image.NewNRGBA(image.Rect(0, 0, ceilDiv(size.X, factor), ceilDiv(size.Y, factor)))
+	sums := make([]uint64, 4*out.Rect.Dx())
+	for oy := 0; oy < out.Rect.Dy(); oy++ {
+		clear(sums)
+		rows := min(factor, size.Y-oy*factor)
+		for y := 0; y < rows; y++ {
+			i := src.PixOffset(src.Rect.Min.X, src.Rect.Min.Y+oy*factor+y)
+			row := src.Pix[i : i+4*size.X : i+4*size.X]
+			for x := 0; x < size.X; x++ {
+				px, sum := row[4*x:4*x+4:4*x+4], sums[4*(x/factor):4*(x/factor)+4:4*(x/factor)+4]
+				a := uint64(px[3])
+				sum[0] += uint64(px[0]) * a
+				sum[1] += uint64(px[1]) * a
+				sum[2] += uint64(px[2]) * a
+				sum[3] += a
+			}
+		}
+		dst := out.Pix[oy*out.Stride : oy*out.Stride+len(sums)]
+		for ox := 0; ox < out.Rect.Dx(); ox++ {
+			sum, d := sums[4*ox:4*ox+4:4*ox+4], dst[4*ox:4*ox+4:4*ox+4]
+			if sum[3] == 0 {
+				continue
+			}
+			n := uint64(rows * min(factor, size.X-ox*factor))
+			d[0] = uint8((sum[0] + sum[3]/2) / sum[3])
+			d[1] = uint8((sum[1] + sum[3]/2) / sum[3])
+			d[2] = uint8((sum[2] + sum[3]/2) / sum[3])
+			d[3] = uint8((sum[3] + n/2) / n)
+		}
+	}
+	r := region.Rect.Sub(src.Rect.Min)
+	rect := image.Rect(r.Min.X/factor, r.Min.Y/factor, ceilDiv(r.Max.X, factor), ceilDiv(r.Max.Y, factor))
+	return out, out.SubImage(rect).(*image.NRGBA)
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"math"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestEstimate(t *testing.T) {
+	m := workModel{decode: 1e6, scale: 2e6, process: 4e5, perTile: 1e-3}
+	tests := []struct {
+		tile, downscale int
+		want            float64
+	}{
+		// 0.6 (デコード) + 1.5 (処理) + 6000 タイル
+		{10, 1, 0.6 + 1.5 + 6},
+		{10, 0, 0.6 + 1.5 + 6},
+		{20, 1, 0.6 + 1.5 + 1.5},
+		// 500×300 に縮小: 0.6 (デコード) + 0.3 (縮小) + 0.375 (処理) + 1500 タイル
+		{10, 2, 0.6 + 0.3 + 0.375 + 1.5},
+		// 端のタイルも 1 つに数える: 334×200 → 34×20 タイル
+		{10, 3, 0.6 + 0.3 + 334*200/4e5 + 0.68},
+	}
+	for _, tt := range tests {
+		got := m.estimate(1000, 600, tt.tile, tt.downscale)
+		want := time.Duration(tt.want * float64(time.Second))
+		if d := got - want; d < -time.Microsecond || d > time.Microsecond {
+			t.Errorf("estimate(tile %d, downscale %d) = %v, want %v", tt.tile, tt.downscale, got, want)
+		}
+	}
+}
+
+func TestPlanDegradation(t *testing.T) {
+	fast := 1e12
+	tests := []struct {
+		name   string
+		m      workModel
+		budget time.Duration
+		want   degradation
+	}{
+		{"fits", workModel{decode: 1e9, scale: 1e9, process: 1e9}, time.Second, degradation{}},
+		// タイルの数で決まる場合は、タイルを大きくするだけで間に合う
+		{"per tile", workModel{decode: fast, scale: fast, process: fast, perTile: 1e-4}, 300 * time.Millisecond, degradation{Tile: 20}},
+		{"per tile, 4x", workModel{decode: fast, scale: fast, process: fast, perTile: 1e-4}, 70 * time.Millisecond, degradation{Tile: 40}},
+		// 画素の数で決まる場合は、タイルを大きくしても間に合わないため縮小する (タイルは縮小した画像の上の大きさ)
+		{"per pixel", workModel{decode: fast, scale: fast, process: 1e6}, 300 * time.Millisecond, degradation{Downscale: 2, Tile: 5}},
+		{"per pixel, 4x", workModel{decode: fast, scale: fast, process: 1e6}, 50 * time.Millisecond, degradation{Downscale: 5, Tile: 2}},
+	}
+	for _, tt := range tests {
+		d, estimate := planDegradation(tt.m, 1000, 1000, 10, tt.budget)
+		if d != tt.want {
+			t.Errorf("%s: %v, want %v", tt.name, d, tt.want)
+		}
+		if estimate > tt.budget {
+			t.Errorf("%s: estimate %v exceeds the budget %v", tt.name, estimate, tt.budget)
+		}
+		downscale, tile := max(1, d.Downscale), 10
+		if d.Tile > 0 {
+			tile = d.Tile
+		}
+		if want := tt.m.estimate(1000, 1000, tile, downscale); estimate != want {
+			t.Errorf("%s: estimate %v, want %v", tt.name, estimate, want)
+		}
+	}
+
+	// デコードだけで間に合わない場合は、最も粗い近道の 1.1 倍に収まる最初の近道にする
+	m := workModel{decode: 1e6, scale: fast, process: fast}
+	d, estimate := planDegradation(m, 1000, 1000, 10, 100*time.Millisecond)
+	if d != (degradation{}) || estimate < time.Second {
+		t.Errorf("decode bound: %v (%v), want no degradation", d, estimate)
+	}
+	// 縮小の上限でも間に合わない場合は、最も粗い近道にする
+	m = workModel{decode: fast, scale: fast, process: 1e3}
+	d, _ = planDegradation(m, 1000, 1000, 10, time.Millisecond)
+	if d.Downscale != maxDownscale {
+		t.Errorf("slowest model: %v, want downscale %d", d, maxDownscale)
+	}
+}
+
+func TestDegradationString(t *testing.T) {
+	for _, tt := range []struct {
+		d    degradation
+		want string
+	}{
+		{degradation{}, "none"},
+		{degradation{Downscale: 1}, "none"},
+		{degradation{Downscale: 2}, "downscale=2"},
+		{degradation{Tile: 32}, "tile=32"},
+		{degradation{Downscale: 2, Tile: 32}, "downscale=2; tile=32"},
+	} {
+		if got := tt.d.String(); got != tt.want {
+			t.Errorf("%+v = %q, want %q", tt.d, got, tt.want)
+		}
+	}
+}
+
+func TestDownscaleSource(t *testing.T) {
+	src := testImage(45, 29)
+	for i := 3; i < len(src.Pix); i += 4 {
+		src.Pix[i] = uint8(i * 13)
+	}
+	// すべての画素が透明な範囲
+	for y := 0; y < 3; y++ {
+		for x := 0; x < 3; x++ {
+			src.SetNRGBA(x, y, color.NRGBA{200, 100, 50, 0})
+		}
+	}
+	const factor = 3
+	out, _ := downscaleSource(src, src, factor)
+	if out.Rect != image.Rect(0, 0, 15, 10) {
+		t.Fatalf("bounds %v", out.Rect)
+	}
+	for oy := 0; oy < out.Rect.Dy(); oy++ {
+		for ox := 0; ox < out.Rect.Dx(); ox++ {
+			// 不透明度で重み付けした平均 (右端と下端は残りの画素の平均)
+			var sum [4]float64
+			n := 0.0
+			for y := oy * factor; y < min((oy+1)*factor, 29); y++ {
+				for x := ox * factor; x < min((ox+1)*factor, 45); x++ {
+					c := src.NRGBAAt(x, y)
+					a := float64(c.A)
+					sum[0], sum[1], sum[2], sum[3] = sum[0]+float64(c.R)*a, sum[1]+float64(c.G)*a, sum[2]+float64(c.B)*a, sum[3]+a
+					n++
+				}
+			}
+			var want color.NRGBA
+			if sum[3] > 0 {
+				want = color.NRGBA{
+					uint8(math.Floor(sum[0]/sum[3] + 0.5)),
+					uint8(math.Floor(sum[1]/sum[3] + 0.5)),
+					uint8(math.Floor(sum[2]/sum[3] + 0.5)),
+					uint8(math.Floor(sum[3]/n + 0.5)),
+				}
+			}
+			if got := out.NRGBAAt(ox, oy); got != want {
+				t.Fatalf("pixel (%d,%d) = %v, want %v", ox, oy, got, want)
+			}
+		}
+	}
+
+	// 透明な画素は色を暗くしない
+	pair := image.NewNRGBA(image.Rect(0, 0, 2, 1))
+	pair.SetNRGBA(0, 0, color.NRGBA{255, 0, 0, 255})
+	out, _ = downscaleSource(pair, pair, 2)
+	if got := out.NRGBAAt(0, 0); got != (color.NRGBA{255, 0, 0, 128}) {
+		t.Errorf("with a transparent pixel: %v", got)
+	}
+
+	// 範囲は縮小した画像の上で端を切り上げる
+	offset := testImage(20, 20).SubImage(image.Rect(2, 2, 14, 12)).(*image.NRGBA)
+	region := offset.SubImage(image.Rect(3, 5, 9, 8)).(*image.NRGBA)
+	out, sub := downscaleSource(offset, region, 4)
+	if out.Rect != image.Rect(0, 0, 3, 3) || sub.Rect != image.Rect(0, 0, 2, 2) {
+		t.Errorf("bounds %v, region %v", out.Rect, sub.Rect)
+	}
+}
+
+func TestDeadlineDegradesSlowRequests(t *testing.T) {
+	const deadline = 2 * time.Second
+	ts, s := newTestServer(t, "-deadline", deadline.String())
+	// タイル 1 つに 1ms かかる遅い設定として見積もらせる
+	s.work = workModel{decode: 1e9, scale: 1e9, process: 1e9, perTile: 1e-3}
+	input := encodeTestImage(t, testImage(400, 400), "png")
+
+	start := time.Now()
+	resp, err := http.Post(ts.URL+"/process?tile=2&format=png", "image/png", bytes.NewReader(input))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if elapsed := time.Since(start); elapsed > deadline {
+		t.Errorf("took %v, deadline %v", elapsed, deadline)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status %d", resp.StatusCode)
+	}
+	// 元の大きさとタイル 2 の倍以上では 2.5 秒以上かかり、1/3 に縮小したタイル 4 (元画像の上で 12) で 1.2 秒ほど
+	if got := resp.Header.Get("X-Mosaic-Degraded"); got != "downscale=3; tile=4" {
+		t.Errorf("X-Mosaic-Degraded = %q", got)
+	}
+	estimate, err := time.ParseDuration(resp.Header.Get("X-Mosaic-Estimated-Duration"))
+	if err != nil || estimate > deadline {
+		t.Errorf("X-Mosaic-Estimated-Duration = %q", resp.Header.Get("X-Mosaic-Estimated-Duration"))
+	}
+
+	// 速い設定では近道をしない
+	s.work = workModel{decode: 1e9, scale: 1e9, process: 1e9}
+	resp, err = http.Post(ts.URL+"/process?tile=2&format=png", "image/png", bytes.NewReader(input))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if got := resp.Header.Get("X-Mosaic-Degraded"); resp.StatusCode != http.StatusOK || got != "none" {
+		t.Errorf("status %d, X-Mosaic-Degraded = %q", resp.StatusCode, got)
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"log/slog"
+	"math"
+
+	"github.com/yashikota/go-streaming-image-mosaic/internal/imagemeta"
+)
+
+// 1 インチあたりのミリメートル
+const mmPerInch = 25.4
+
+var errNoDensity = errors.New("input has no resolution metadata (specify -dpi)")
+
+// mm の長さを解像度 dpi の画素数に換算 (1 以上に丸める)
+func mmToPixels(mm, dpi float64) int {
+	return max(1, int(math.Round(mm/mmPerInch*dpi)))
+}
+
+// 入力の先頭部分から解像度を読み取り、-tile-mm と -dpi に従って処理設定を決める
+// 読んだ先頭部分を含めて画像全体を読み込める *bufio.Reader を返却
+func (p pipeline) withInputDensity(logger *slog.Logger, br *bufio.Reader) (pipeline, *bufio.Reader, error) {
+	if p.tileMM <= 0 && p.dpi <= 0 {
+		return p, br, nil
+	}
+	br = bufio.NewReaderSize(br, infoHeaderLimit)
+	header, _ := br.Peek(infoHeaderLimit)
+	dpi, ok := imagemeta.Density(header)
+	q, err := p.withDensity(logger, dpi, ok)
+	if err != nil {
+		return p, br, err
+	}
+	return q, br, nil
+}
+
+// 入力の解像度 (ok が false の場合は記録されていない) から処理設定を決める
+// -dpi は記録された解像度より優先し、-tile-mm はその解像度で画素数に換算する
+// どちらかを指定した場合は、使った解像度を出力にも記録する
+func (p pipeline) withDensity(logger *slog.Logger, dpi float64, ok bool) (pipeline, error) {
+	if p.tileMM <= 0 && p.dpi <= 0 {
+		return p, nil
+	}
+	source := "metadata"
+	switch {
+	case p.dpi > 0:
+		dpi, source = p.dpi, "flag"
+	case !ok:
+		return p, errNoDensity
+	}
+	p.encodeOpts.DPI = dpi
+	if p.tileMM > 0 {
+		p.tile = mmToPixels(p.tileMM, dpi)
+		logger.Debug("tile size converted from millimeters", "tile_mm", p.tileMM, "dpi", dpi, "dpi_source", source, "tile", p.tile)
+	}
+	return p, nil
+}
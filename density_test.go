@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/yashikota/go-streaming-image-mosaic/internal/imagemeta"
+	"github.com/yashikota/go-streaming-image-mosaic/internal/tiff"
+	"github.com/yashikota/go-streaming-image-mosaic/mosaic"
+)
+
+// img を解像度 dpi を記録して format の形式でエンコードしたバイト列
+func encodeWithDPI(t *testing.T, format string, dpi float64) []byte {
+	t.Helper()
+	enc, err := mosaic.LookupEncoder(format)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := enc.Encode(&buf, testImage(64, 48), mosaic.EncodeOptions{DPI: dpi}); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// -tile-mm は PNG の pHYs、TIFF のタグ、JFIF のどれに記録された解像度でも同じ画素数に換算する
+// 1 mm は 254 dpi で 10 px
+func TestTileMM(t *testing.T) {
+	dir := t.TempDir()
+	// 単位をセンチメートルにした JFIF (100 dots/cm = 254 dpi)
+	jfifCM := encodeWithDPI(t, "jpeg", 1)
+	jfifCM[13] = 2
+	binary.BigEndian.PutUint16(jfifCM[14:], 100)
+	binary.BigEndian.PutUint16(jfifCM[16:], 100)
+	// 単位をセンチメートルにした TIFF
+	var tiffCM bytes.Buffer
+	enc := tiff.NewEncoder(&tiffCM, 1)
+	if err := enc.Encode(testImage(64, 48), tiff.Resolution{X: tiff.Rational{Num: 100, Den: 1}, Y: tiff.Rational{Num: 100, Den: 1}, Unit: 3}); err != nil {
+		t.Fatal(err)
+	}
+	if err := enc.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		in   string
+		data []byte
+		args []string
+	}{
+		{"png pHYs", "in.png", encodeWithDPI(t, "png", 254), nil},
+		{"jfif dpi", "in.jpg", encodeWithDPI(t, "jpeg", 254), nil},
+		{"jfif dots per cm", "in.jpg", jfifCM, nil},
+		{"tiff inch", "in.tif", encodeWithDPI(t, "tiff", 254), nil},
+		{"tiff cm", "in.tif", tiffCM.Bytes(), nil},
+		// -dpi は記録された解像度より優先する
+		{"dpi flag", "in.png", encodeWithDPI(t, "png", 72), []string{"-dpi", "254"}},
+		{"dpi without metadata", "in.png", encodeTestImage(t, testImage(64, 48), "png"), []string{"-dpi", "254"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			in := filepath.Join(dir, tt.in)
+			writeTestFile(t, in, tt.data)
+			want := filepath.Join(dir, "want"+filepath.Ext(tt.in))
+			if res := runCLI(t, "apply", "-in", in, "-out", want, "-tile", "10", "-quiet"); res.code != exitOK {
+				t.Fatalf("apply -tile: exit code = %d (stderr: %s)", res.code, res.stderr)
+			}
+			got := filepath.Join(dir, "got"+filepath.Ext(tt.in))
+			args := append([]string{"apply", "-in", in, "-out", got, "-tile-mm", "1", "-quiet"}, tt.args...)
+			if res := runCLI(t, args...); res.code != exitOK {
+				t.Fatalf("apply -tile-mm: exit code = %d (stderr: %s)", res.code, res.stderr)
+			}
+			assertSameImage(t, readTestImage(t, got), readTestImage(t, want))
+
+			// 出力にも使った解像度を記録する
+			data, err := os.ReadFile(got)
+			if err != nil {
+				t.Fatal(err)
+			}
+			dpi, ok := imagemeta.Density(data)
+			if tt.in == "in.tif" {
+				file, err := tiff.Parse(data)
+				if err != nil {
+					t.Fatal(err)
+				}
+				page, err := file.Page(0)
+				if err != nil {
+					t.Fatal(err)
+				}
+				dpi, ok = page.Resolution.DPI()
+			}
+			if !ok || dpi < 253.9 || dpi > 254.1 {
+				t.Errorf("output density %g, %v, want 254", dpi, ok)
+			}
+		})
+	}
+}
+
+func TestTileMMWithoutDensity(t *testing.T) {
+	dir := t.TempDir()
+	in := filepath.Join(dir, "in.png")
+	writeTestImage(t, in, testImage(64, 48))
+	res := runCLI(t, "apply", "-in", in, "-out", filepath.Join(dir, "out.png"), "-tile-mm", "1", "-quiet")
+	if res.code != exitDecode || !strings.Contains(res.stderr, "specify -dpi") {
+		t.Errorf("exit code = %d (stderr: %s), want %d asking for -dpi", res.code, res.stderr, exitDecode)
+	}
+}
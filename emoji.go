@@ -0,0 +1,10 @@
+package main
+
+// -format emoji-text と emoji-png の出力
+const (
+	formatEmojiText = "emoji-text" // 絵文字を並べたテキスト
+	formatEmojiPNG  = "emoji-png"  // 絵文字のスプライトを並べた PNG
+)
+
+// -max-cols の既定 (チャットに貼れる程度の幅)
+const defaultEmojiMaxCols = 200
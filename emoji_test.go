@@ -0,0 +1,55 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// 表の色のタイルを並べた画像から、同じ並びの絵文字のテキストと PNG を書き出す
+func TestApplyEmojiText(t *testing.T) {
+	colors := [][]color.NRGBA{
+		{{0xe5, 0x61, 0x71, 255}, {0xf7, 0xab, 0x47, 255}, {0x99, 0xc4, 0x81, 255}, {0x7e, 0xc0, 0xf2, 255}},
+		{{0x63, 0x67, 0x6c, 255}, {0xec, 0xed, 0xee, 255}, {0xea, 0x80, 0x8d, 255}, {0xd2, 0xc3, 0xe9, 255}},
+	}
+	want := "🟥🟧🟩🟦\n⬛⬜🔴💜\n"
+	img := image.NewNRGBA(image.Rect(0, 0, 40, 20))
+	for y, row := range colors {
+		for x, c := range row {
+			draw.Draw(img, image.Rect(x*10, y*10, x*10+10, y*10+10), image.NewUniform(c), image.Point{}, draw.Src)
+		}
+	}
+	dir := t.TempDir()
+	in := filepath.Join(dir, "in.png")
+	writeTestImage(t, in, img)
+
+	out := filepath.Join(dir, "out.txt")
+	if res := runCLI(t, "apply", "-in", in, "-out", out, "-format", "emoji-text", "-tile", "10", "-quiet"); res.code != exitOK {
+		t.Fatalf("exit code = %d (stderr: %s)", res.code, res.stderr)
+	}
+	data, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != want {
+		t.Errorf("text %q, want %q", data, want)
+	}
+
+	png := filepath.Join(dir, "out.png")
+	if res := runCLI(t, "apply", "-in", in, "-out", png, "-format", "emoji-png", "-tile", "10", "-quiet"); res.code != exitOK {
+		t.Fatalf("emoji-png: exit code = %d (stderr: %s)", res.code, res.stderr)
+	}
+	if got := readTestImage(t, png); got.Rect.Dx() != 4*32 || got.Rect.Dy() != 2*32 {
+		t.Errorf("emoji-png %v, want 128x64", got.Rect)
+	}
+
+	// 列の数が -max-cols を超える場合は書き出さない
+	res := runCLI(t, "apply", "-in", in, "-out", filepath.Join(dir, "wide.txt"), "-format", "emoji-text", "-tile", "10", "-quiet", "-max-cols", "3")
+	if res.code != exitUsage || !strings.Contains(res.stderr, "4 columns wide") {
+		t.Errorf("max-cols: exit code = %d (stderr: %s)", res.code, res.stderr)
+	}
+}
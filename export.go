@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"image"
+	"io"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/yashikota/go-streaming-image-mosaic/mosaic"
+)
+
+// タイルの色の書き出しの形式
+const (
+	exportJSON   = "json"
+	exportNDJSON = "ndjson"
+	exportCSV    = "csv"
+	exportSVG    = "svg"  // -format svg の出力 (-export-tiles では使わない)
+	exportHTML   = "html" // -format html の出力 (-export-tiles では使わない)
+)
+
+// SVG と HTML の先頭に書き出す画像の情報
+type exportHeader struct {
+	size     image.Point // 画像の大きさ
+	name     string      // 入力の名前
+	tile     int         // タイルの大きさ
+	original string      // 元画像の data URI (空の場合は埋め込まない、HTML のみ)
+}
+
+// -export-format が空の場合に、出力先の拡張子から形式を決める
+func exportFormat(format, path string) string {
+	if format != "" {
+		return format
+	}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".csv":
+		return exportCSV
+	case ".ndjson", ".jsonl":
+		return exportNDJSON
+	}
+	return exportJSON
+}
+
+// 書き出すタイルの情報 (JSON の 1 要素)
+type exportedTile struct {
+	GridX  int    `json:"grid_x"`
+	GridY  int    `json:"grid_y"`
+	X      int    `json:"x"`
+	Y      int    `json:"y"`
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+	Hex    string `json:"hex"`
+	R      uint8  `json:"r"`
+	G      uint8  `json:"g"`
+	B      uint8  `json:"b"`
+	A      uint8  `json:"a"`
+	Pixels int    `json:"pixels"`
+}
+
+// CSV の見出し (exportedTile のフィールドと同じ順)
+var exportCSVHeader = []string{"grid_x", "grid_y", "x", "y", "width", "height", "hex", "r", "g", "b", "a", "pixels"}
+
+// タイルの色を行ごとに順に書き出す
+// タイルは並列に、順序によらずに処理されるため、行のタイルがそろうまで保持し、そろった行から左から順に書き出す
+// 保持するのは処理中の行だけなので、タイルの数によらずメモリの使用量はほぼ一定になる
+// 書き換えなかったタイルは書き出さない
+// SVG と HTML では、行の中で隣り合う同じ色のタイルを 1 つの要素にまとめる
+type tileExporter struct {
+	mu      sync.Mutex
+	w       *bufio.Writer
+	csv     *csv.Writer
+	format  string
+	columns int                       // 1 行のタイルの数
+	pending map[int][]mosaic.TileInfo // 行ごとの書き出していないタイル
+	next    int                       // 次に書き出す行
+	written int                       // 書き出したタイルの数
+	err     error
+}
+
+// grid は処理するタイルの格子、header は SVG と HTML の先頭に書き出す情報で、それ以外の形式では使わない
+func newTileExporter(w io.Writer, format string, grid mosaic.Grid, header exportHeader) (*tileExporter, error) {
+	e := &tileExporter{
+		w:       bufio.NewWriter(w),
+		format:  format,
+		columns: grid.Columns,
+		pending: map[int][]mosaic.TileInfo{},
+	}
+	switch format {
+	case exportJSON:
+		_, e.err = e.w.WriteString("[")
+	case exportCSV:
+		e.csv = csv.NewWriter(e.w)
+		e.err = e.csv.Write(exportCSVHeader)
+	case exportSVG:
+		_, e.err = fmt.Fprintf(e.w, "<?xml version=\"1.0\" encoding=\"UTF-8\"?>\n"+
+			"<svg xmlns=\"http://www.w3.org/2000/svg\" width=\"%d\" height=\"%d\" viewBox=\"0 0 %d %d\" shape-rendering=\"crispEdges\">\n",
+			header.size.X, header.size.Y, header.size.X, header.size.Y)
+	case exportHTML:
+		e.err = writeHTMLHeader(e.w, header, grid)
+	}
+	return e, e.err
+}
+
+// WithTileObserver に渡す関数
+func (e *tileExporter) observe(t mosaic.TileInfo) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.pending[t.Y] = append(e.pending[t.Y], t)
+	for len(e.pending[e.next]) == e.columns {
+		row := e.pending[e.next]
+		delete(e.pending, e.next)
+		e.next++
+		if e.err != nil {
+			continue
+		}
+		slices.SortFunc(row, func(a, b mosaic.TileInfo) int { return a.X - b.X })
+		switch e.format {
+		case exportSVG:
+			e.err = e.writeSVGRow(row)
+			continue
+		case exportHTML:
+			e.err = e.writeHTMLRow(row)
+			continue
+		}
+		for _, t := range row {
+			if t.Skipped {
+				continue
+			}
+			if e.err = e.write(t); e.err != nil {
+				break
+			}
+		}
+	}
+}
+
+// 左から順に並べた 1 行のタイルを rect として書き出す
+// 隣り合う同じ色のタイルは幅を足し合わせて 1 つの rect にし、完全に透明なタイルは書き出さない
+// 属性の値は数値と 16 進数の色だけなので、エスケープは不要
+func (e *tileExporter) writeSVGRow(row []mosaic.TileInfo) error {
+	for i := 0; i < len(row); {
+		t := row[i]
+		rect := t.Rect
+		j := i + 1
+		for ; j < len(row) && !t.Skipped && !row[j].Skipped && row[j].Color == t.Color && row[j].Rect.Min.X == rect.Max.X; j++ {
+			rect.Max.X = row[j].Rect.Max.X
+		}
+		i = j
+		if t.Skipped || t.Color.A == 0 {
+			continue
+		}
+		fmt.Fprintf(e.w, "<rect x=\"%d\" y=\"%d\" width=\"%d\" height=\"%d\" fill=\"#%02X%02X%02X\"",
+			rect.Min.X, rect.Min.Y, rect.Dx(), rect.Dy(), t.Color.R, t.Color.G, t.Color.B)
+		if t.Color.A != 0xff {
+			fmt.Fprintf(e.w, " fill-opacity=\"%.3f\"", float64(t.Color.A)/0xff)
+		}
+		e.w.WriteString("/>\n")
+		e.written++
+	}
+	return nil
+}
+
+func (e *tileExporter) write(t mosaic.TileInfo) error {
+	tile := exportedTile{
+		GridX:  t.X,
+		GridY:  t.Y,
+		X:      t.Rect.Min.X,
+		Y:      t.Rect.Min.Y,
+		Width:  t.Rect.Dx(),
+		Height: t.Rect.Dy(),
+		Hex:    fmt.Sprintf("#%02X%02X%02X", t.Color.R, t.Color.G, t.Color.B),
+		R:      t.Color.R,
+		G:      t.Color.G,
+		B:      t.Color.B,
+		A:      t.Color.A,
+		Pixels: t.Pixels,
+	}
+	e.written++
+	if e.format == exportCSV {
+		return e.csv.Write([]string{
+			strconv.Itoa(tile.GridX), strconv.Itoa(tile.GridY),
+			strconv.Itoa(tile.X), strconv.Itoa(tile.Y), strconv.Itoa(tile.Width), strconv.Itoa(tile.Height),
+			tile.Hex,
+			strconv.Itoa(int(tile.R)), strconv.Itoa(int(tile.G)), strconv.Itoa(int(tile.B)), strconv.Itoa(int(tile.A)),
+			strconv.Itoa(tile.Pixels),
+		})
+	}
+	data, err := json.Marshal(tile)
+	if err != nil {
+		return err
+	}
+	switch {
+	case e.format == exportNDJSON:
+		data = append(data, '\n')
+	case e.written > 1:
+		e.w.WriteString(",\n")
+	default:
+		e.w.WriteString("\n")
+	}
+	// 書き込みの失敗は bufio.Writer が保持し、Flush で返す
+	e.w.Write(data)
+	return nil
+}
+
+// 書き出しを終える
+// すべての行がそろっていない場合 (処理の途中で失敗した場合など) は、そろった行までを書き出した状態になる
+func (e *tileExporter) close() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.err != nil {
+		return e.err
+	}
+	switch e.format {
+	case exportJSON:
+		e.w.WriteString("\n]\n")
+	case exportSVG:
+		e.w.WriteString("</svg>\n")
+	case exportHTML:
+		if err := htmlFooter.Execute(e.w, nil); err != nil {
+			return err
+		}
+	case exportCSV:
+		e.csv.Flush()
+		if err := e.csv.Error(); err != nil {
+			return err
+		}
+	}
+	return e.w.Flush()
+}
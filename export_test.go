@@ -0,0 +1,295 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/yashikota/go-streaming-image-mosaic/mosaic"
+)
+
+// -export-tiles の JSON、NDJSON、CSV を exportedTile として読む
+func readExportedTiles(t *testing.T, path, format string) []exportedTile {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tiles []exportedTile
+	switch format {
+	case exportJSON:
+		if err := json.Unmarshal(data, &tiles); err != nil {
+			t.Fatal(err)
+		}
+	case exportNDJSON:
+		for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+			var tile exportedTile
+			if err := json.Unmarshal([]byte(line), &tile); err != nil {
+				t.Fatalf("%q: %v", line, err)
+			}
+			tiles = append(tiles, tile)
+		}
+	case exportCSV:
+		rows, err := csv.NewReader(bytes.NewReader(data)).ReadAll()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Join(rows[0], ",") != strings.Join(exportCSVHeader, ",") {
+			t.Fatalf("header %v, want %v", rows[0], exportCSVHeader)
+		}
+		for _, row := range rows[1:] {
+			v := make([]int, len(row))
+			for i, s := range row {
+				if i != 6 {
+					v[i], _ = strconv.Atoi(s)
+				}
+			}
+			tiles = append(tiles, exportedTile{
+				GridX: v[0], GridY: v[1], X: v[2], Y: v[3], Width: v[4], Height: v[5], Hex: row[6],
+				R: uint8(v[7]), G: uint8(v[8]), B: uint8(v[9]), A: uint8(v[10]), Pixels: v[11],
+			})
+		}
+	}
+	return tiles
+}
+
+// 書き出したタイルは行の順に並び、範囲、色、画素数が出力の画像と一致する
+// JSON、NDJSON、CSV のどれでも同じタイルを書き出す
+func TestExportTiles(t *testing.T) {
+	dir := t.TempDir()
+	in := filepath.Join(dir, "in.png")
+	writeTestImage(t, in, testImage(97, 61))
+	out := filepath.Join(dir, "out.png")
+
+	var first []exportedTile
+	for _, tt := range []struct {
+		path string
+		args []string
+		want string
+	}{
+		{"tiles.json", nil, exportJSON},
+		{"tiles.ndjson", nil, exportNDJSON},
+		{"tiles.txt", []string{"-export-format", "ndjson"}, exportNDJSON},
+		{"tiles.csv", nil, exportCSV},
+	} {
+		path := filepath.Join(dir, tt.path)
+		args := append([]string{"apply", "-in", in, "-out", out, "-tile", "10", "-quiet", "-export-tiles", path}, tt.args...)
+		if res := runCLI(t, args...); res.code != exitOK {
+			t.Fatalf("%s: exit code = %d (stderr: %s)", tt.path, res.code, res.stderr)
+		}
+		tiles := readExportedTiles(t, path, tt.want)
+		if first == nil {
+			first = tiles
+		} else if fmt.Sprint(tiles) != fmt.Sprint(first) {
+			t.Errorf("%s: tiles differ from tiles.json", tt.path)
+		}
+	}
+
+	img := readTestImage(t, out)
+	if len(first) != 10*7 {
+		t.Fatalf("%d tiles, want 70", len(first))
+	}
+	var covered int
+	for i, tile := range first {
+		if tile.GridX != i%10 || tile.GridY != i/10 {
+			t.Fatalf("tile %d at (%d, %d), want row order", i, tile.GridX, tile.GridY)
+		}
+		want := image.Rect(tile.GridX*10, tile.GridY*10, tile.GridX*10+10, tile.GridY*10+10).Intersect(img.Rect)
+		if got := image.Rect(tile.X, tile.Y, tile.X+tile.Width, tile.Y+tile.Height); got != want {
+			t.Errorf("tile (%d, %d): rect %v, want %v", tile.GridX, tile.GridY, got, want)
+		}
+		if tile.Pixels != want.Dx()*want.Dy() {
+			t.Errorf("tile (%d, %d): %d pixels, want %d", tile.GridX, tile.GridY, tile.Pixels, want.Dx()*want.Dy())
+		}
+		c := color.NRGBA{tile.R, tile.G, tile.B, tile.A}
+		if tile.Hex != fmt.Sprintf("#%02X%02X%02X", c.R, c.G, c.B) {
+			t.Errorf("tile (%d, %d): hex %s does not match %v", tile.GridX, tile.GridY, tile.Hex, c)
+		}
+		if got := img.NRGBAAt(want.Max.X-1, want.Max.Y-1); got != c {
+			t.Errorf("tile (%d, %d): output pixel %v, want %v", tile.GridX, tile.GridY, got, c)
+		}
+		covered += tile.Pixels
+	}
+	if covered != 97*61 {
+		t.Errorf("tiles cover %d pixels, want %d", covered, 97*61)
+	}
+}
+
+// 書き出したタイルを render と同じく読み込んで描き直すと、モザイクの出力と同じ画像になる
+func TestExportRenderRoundTrip(t *testing.T) {
+	src := testImage(45, 38)
+	for _, format := range []string{exportJSON, exportNDJSON, exportCSV} {
+		t.Run(format, func(t *testing.T) {
+			var buf bytes.Buffer
+			p := mosaic.New(src, 8, 8)
+			e, err := newTileExporter(&buf, format, p.Grid(), exportHeader{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			p = mosaic.New(src, 8, 8, mosaic.WithTileObserver(e.observe))
+			want, err := p.ProcessContext(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := e.close(); err != nil {
+				t.Fatal(err)
+			}
+			path := filepath.Join(t.TempDir(), "tiles."+format)
+			writeTestFile(t, path, buf.Bytes())
+			tiles, err := readTileFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, size := range []int{0, 8} {
+				bounds, infos, err := layoutTiles(tiles, size, false)
+				if err != nil {
+					t.Fatalf("size %d: %v", size, err)
+				}
+				assertSameImage(t, mosaic.RenderTiles(bounds, infos, color.NRGBA{}, nil), want)
+			}
+		})
+	}
+}
+
+// タイルが処理された順によらず、行がそろった順に左から書き出す
+func TestTileExporterOrder(t *testing.T) {
+	grid := mosaic.New(image.NewNRGBA(image.Rect(0, 0, 3, 2)), 1, 1).Grid()
+	var buf bytes.Buffer
+	e, err := newTileExporter(&buf, exportNDJSON, grid, exportHeader{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := func() int {
+		e.mu.Lock()
+		defer e.mu.Unlock()
+		e.w.Flush()
+		return strings.Count(buf.String(), "\n")
+	}
+	for _, p := range []image.Point{{2, 1}, {1, 0}, {0, 1}, {2, 0}} {
+		e.observe(mosaic.TileInfo{X: p.X, Y: p.Y, Rect: image.Rect(p.X, p.Y, p.X+1, p.Y+1), Pixels: 1})
+	}
+	// 1 行目は (0, 0) がそろうまで書き出さない
+	if n := lines(); n != 0 {
+		t.Fatalf("%d tiles written before the first row is complete", n)
+	}
+	e.observe(mosaic.TileInfo{X: 0, Y: 0, Rect: image.Rect(0, 0, 1, 1), Pixels: 1})
+	if n := lines(); n != 3 {
+		t.Fatalf("%d tiles written after the first row, want 3", n)
+	}
+	// 書き換えなかったタイルは書き出さない
+	e.observe(mosaic.TileInfo{X: 1, Y: 1, Rect: image.Rect(1, 1, 2, 2), Skipped: true})
+	if err := e.close(); err != nil {
+		t.Fatal(err)
+	}
+	var order []string
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var tile exportedTile
+		if err := json.Unmarshal([]byte(line), &tile); err != nil {
+			t.Fatal(err)
+		}
+		order = append(order, fmt.Sprintf("%d,%d", tile.GridX, tile.GridY))
+	}
+	if got := strings.Join(order, " "); got != "0,0 1,0 2,0 0,1 2,1" {
+		t.Errorf("written in order %s", got)
+	}
+}
+
+// -format svg の出力の rect
+type svgRect struct {
+	X           int    `xml:"x,attr"`
+	Y           int    `xml:"y,attr"`
+	Width       int    `xml:"width,attr"`
+	Height      int    `xml:"height,attr"`
+	Fill        string `xml:"fill,attr"`
+	FillOpacity string `xml:"fill-opacity,attr"`
+}
+
+// SVG の rect は重ならずに画像全体を覆い、どの画素も書き出したタイルと同じ色で塗る
+// 隣り合う同じ色のタイルは 1 つの rect にまとめる
+func TestApplySVG(t *testing.T) {
+	dir := t.TempDir()
+	uniform := image.NewNRGBA(image.Rect(0, 0, 97, 61))
+	draw.Draw(uniform, uniform.Rect, image.NewUniform(color.NRGBA{10, 200, 30, 255}), image.Point{}, draw.Src)
+
+	for _, tt := range []struct {
+		name  string
+		img   *image.NRGBA
+		rects int
+	}{
+		{"gradient", testImage(97, 61), 10 * 7},
+		{"uniform", uniform, 7}, // 1 行に 1 つ
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			in := filepath.Join(dir, tt.name+".png")
+			writeTestImage(t, in, tt.img)
+			out := filepath.Join(dir, tt.name+".svg")
+			tiles := filepath.Join(dir, tt.name+".json")
+			if res := runCLI(t, "apply", "-in", in, "-out", out, "-tile", "10", "-quiet"); res.code != exitOK {
+				t.Fatalf("exit code = %d (stderr: %s)", res.code, res.stderr)
+			}
+			if res := runCLI(t, "apply", "-in", in, "-out", filepath.Join(dir, "out.png"), "-tile", "10", "-quiet", "-export-tiles", tiles); res.code != exitOK {
+				t.Fatalf("export: exit code = %d (stderr: %s)", res.code, res.stderr)
+			}
+			data, err := os.ReadFile(out)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var svg struct {
+				Width   int       `xml:"width,attr"`
+				Height  int       `xml:"height,attr"`
+				ViewBox string    `xml:"viewBox,attr"`
+				Rects   []svgRect `xml:"rect"`
+			}
+			if err := xml.Unmarshal(data, &svg); err != nil {
+				t.Fatal(err)
+			}
+			if svg.Width != 97 || svg.Height != 61 || svg.ViewBox != "0 0 97 61" {
+				t.Errorf("svg %dx%d, viewBox %q", svg.Width, svg.Height, svg.ViewBox)
+			}
+			if len(svg.Rects) != tt.rects {
+				t.Errorf("%d rects, want %d", len(svg.Rects), tt.rects)
+			}
+
+			// 画素ごとに、書き出したタイルの色と rect の色を比べる
+			want := map[image.Point]string{}
+			for _, tile := range readExportedTiles(t, tiles, exportJSON) {
+				for y := tile.Y; y < tile.Y+tile.Height; y++ {
+					for x := tile.X; x < tile.X+tile.Width; x++ {
+						want[image.Pt(x, y)] = tile.Hex
+					}
+				}
+			}
+			var area int
+			covered := map[image.Point]bool{}
+			for _, r := range svg.Rects {
+				area += r.Width * r.Height
+				if r.FillOpacity != "" {
+					t.Errorf("rect %+v of an opaque image has fill-opacity", r)
+				}
+				for y := r.Y; y < r.Y+r.Height; y++ {
+					for x := r.X; x < r.X+r.Width; x++ {
+						p := image.Pt(x, y)
+						if covered[p] || want[p] != r.Fill {
+							t.Fatalf("pixel %v: covered twice or fill %s, want %s", p, r.Fill, want[p])
+						}
+						covered[p] = true
+					}
+				}
+			}
+			if area != 97*61 || len(covered) != 97*61 {
+				t.Errorf("rects cover %d pixels (total area %d), want %d", len(covered), area, 97*61)
+			}
+		})
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+)
+
+// リダイレクトをたどる最大回数
+const maxRedirects = 5
+
+// URL から入力画像を取得する設定
+type fetcher struct {
+	client  *http.Client
+	maxSize int64 // レスポンスの本文の最大バイト数 (0 の場合は無制限)
+}
+
+// 入力画像を取得する fetcher を生成
+// insecure の場合は TLS の証明書を検証しない
+func newFetcher(timeout time.Duration, maxSize int64, insecure bool) *fetcher {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if insecure {
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+	return &fetcher{
+		client: &http.Client{
+			Timeout:   timeout,
+			Transport: transport,
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				if len(via) >= maxRedirects {
+					return fmt.Errorf("stopped after %d redirects", maxRedirects)
+				}
+				return nil
+			},
+		},
+		maxSize: maxSize,
+	}
+}
+
+// 入力のパスが HTTP(S) の URL かどうか
+func isURL(s string) bool {
+	return strings.HasPrefix(s, "http://") || strings.HasPrefix(s, "https://")
+}
+
+// URL の画像を取得し、本文を読み込む responseBody を返却
+// 本文は読み込みながらデコードするため、全体をメモリに保持しない
+func (f *fetcher) open(ctx context.Context, rawURL string) (*responseBody, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	if err := checkContentType(resp.Request.URL, resp.Header.Get("Content-Type")); err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+	if f.maxSize > 0 && resp.ContentLength > f.maxSize {
+		resp.Body.Close()
+		return nil, fmt.Errorf("response of %d bytes exceeds the limit of %d bytes", resp.ContentLength, f.maxSize)
+	}
+	return &responseBody{r: resp.Body, limit: f.maxSize}, nil
+}
+
+// 拡張子のない URL では、Content-Type を形式の手がかりにする
+// 画像以外 (エラーページの HTML など) が返された場合はデコードする前にエラーとする
+func checkContentType(u *url.URL, contentType string) error {
+	if path.Ext(u.Path) != "" || contentType == "" {
+		return nil
+	}
+	return checkImageMediaType(contentType)
+}
+
+// 画像 (または application/octet-stream) の MIME タイプでなければエラーを返却
+func checkImageMediaType(contentType string) error {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return fmt.Errorf("invalid content type %q: %w", contentType, err)
+	}
+	if strings.HasPrefix(mediaType, "image/") || mediaType == "application/octet-stream" {
+		return nil
+	}
+	return fmt.Errorf("content type %s is not an image", mediaType)
+}
+
+// レスポンスの本文を読み込む io.ReadCloser
+// 最大バイト数を超えて読み込もうとした場合はエラーを返す
+// 読み込みのエラーを記録し、デコードの失敗と取得の失敗を区別できるようにする
+type responseBody struct {
+	r     io.ReadCloser
+	limit int64 // 最大バイト数 (0 の場合は無制限)
+	n     int64 // 読み込んだバイト数
+	err   error // 最初に発生した読み込みのエラー (io.EOF を除く)
+}
+
+func (b *responseBody) Read(p []byte) (int, error) {
+	if b.limit > 0 && b.n >= b.limit {
+		// 上限ちょうどで終わる本文と区別するため、1 バイト先を確認する
+		var one [1]byte
+		if n, err := b.r.Read(one[:]); n == 0 {
+			return 0, b.record(err)
+		}
+		return 0, b.record(fmt.Errorf("response exceeds the limit of %d bytes", b.limit))
+	}
+	if b.limit > 0 && int64(len(p)) > b.limit-b.n {
+		p = p[:b.limit-b.n]
+	}
+	n, err := b.r.Read(p)
+	b.n += int64(n)
+	return n, b.record(err)
+}
+
+func (b *responseBody) record(err error) error {
+	if err != nil && err != io.EOF && b.err == nil {
+		b.err = err
+	}
+	return err
+}
+
+func (b *responseBody) Close() error {
+	return b.r.Close()
+}
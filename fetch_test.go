@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// 画像とエラーのレスポンスを返すテスト用のサーバー
+func newFetchServer(t *testing.T, png []byte) *httptest.Server {
+	t.Helper()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/img.png", func(w http.ResponseWriter, r *http.Request) {
+		w.Write(png)
+	})
+	mux.HandleFunc("/image", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(png)
+	})
+	mux.HandleFunc("/page", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		io.WriteString(w, "<html></html>")
+	})
+	mux.HandleFunc("/chunked.png", func(w http.ResponseWriter, r *http.Request) {
+		// Content-Length を付けずに返す
+		for i := 0; i < len(png); i += 64 {
+			w.Write(png[i:min(i+64, len(png))])
+			w.(http.Flusher).Flush()
+		}
+	})
+	mux.HandleFunc("/missing.png", func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "not found", http.StatusNotFound)
+	})
+	mux.HandleFunc("/broken.png", func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "boom", http.StatusInternalServerError)
+	})
+	mux.HandleFunc("/redirect", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/img.png", http.StatusFound)
+	})
+	mux.HandleFunc("/loop", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/loop", http.StatusFound)
+	})
+	mux.HandleFunc("/slow.png", func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	})
+	ts := httptest.NewServer(mux)
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+func TestFetcherOpen(t *testing.T) {
+	png := encodeTestImage(t, testImage(32, 24), "png")
+	ts := newFetchServer(t, png)
+
+	tests := []struct {
+		path    string
+		maxSize int64
+		err     string // 空の場合は成功して png を読み込める
+	}{
+		{"/img.png", 0, ""},
+		{"/image", 0, ""},
+		{"/redirect", 0, ""},
+		{"/img.png", int64(len(png)), ""},
+		{"/chunked.png", int64(len(png)), ""},
+		{"/page", 0, "content type text/html is not an image"},
+		{"/missing.png", 0, "unexpected status 404 Not Found"},
+		{"/broken.png", 0, "unexpected status 500 Internal Server Error"},
+		{"/loop", 0, "stopped after 5 redirects"},
+		{"/img.png", int64(len(png)) - 1, "exceeds the limit"},
+		{"/chunked.png", int64(len(png)) - 1, "exceeds the limit"},
+	}
+	for _, tt := range tests {
+		f := newFetcher(time.Second, tt.maxSize, false)
+		body, err := f.open(context.Background(), ts.URL+tt.path)
+		var data []byte
+		if err == nil {
+			data, err = io.ReadAll(body)
+			body.Close()
+		}
+		switch {
+		case tt.err == "" && err != nil:
+			t.Errorf("%s (max %d): %v", tt.path, tt.maxSize, err)
+		case tt.err == "" && string(data) != string(png):
+			t.Errorf("%s (max %d): read %d bytes, want the %d bytes of the image", tt.path, tt.maxSize, len(data), len(png))
+		case tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)):
+			t.Errorf("%s (max %d): error %v, want %q", tt.path, tt.maxSize, err, tt.err)
+		}
+	}
+}
+
+func TestFetcherTimeout(t *testing.T) {
+	ts := newFetchServer(t, nil)
+	_, err := newFetcher(50*time.Millisecond, 0, false).open(context.Background(), ts.URL+"/slow.png")
+	var timeout interface{ Timeout() bool }
+	if !errors.As(err, &timeout) || !timeout.Timeout() {
+		t.Errorf("error %v, want a timeout", err)
+	}
+}
+
+func TestFetcherInsecure(t *testing.T) {
+	png := encodeTestImage(t, testImage(8, 8), "png")
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(png)
+	}))
+	ts.Config.ErrorLog = log.New(io.Discard, "", 0) // 検証に失敗したハンドシェイクを出力しない
+	ts.StartTLS()
+	defer ts.Close()
+	// 自己署名の証明書は -insecure を指定した場合だけ受け入れる
+	if _, err := newFetcher(time.Second, 0, false).open(context.Background(), ts.URL+"/img.png"); err == nil {
+		t.Error("self-signed certificate accepted without -insecure")
+	}
+	body, err := newFetcher(time.Second, 0, true).open(context.Background(), ts.URL+"/img.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body.Close()
+}
+
+func TestApplyURL(t *testing.T) {
+	src := testImage(32, 24)
+	png := encodeTestImage(t, src, "png")
+	ts := newFetchServer(t, png)
+	dir := t.TempDir()
+	want := filepath.Join(dir, "want.png")
+	writeTestImage(t, filepath.Join(dir, "in.png"), src)
+	if res := runCLI(t, "apply", "-in", filepath.Join(dir, "in.png"), "-out", want, "-tile", "8", "-quiet"); res.code != exitOK {
+		t.Fatalf("exit code = %d (stderr: %s)", res.code, res.stderr)
+	}
+
+	tests := []struct {
+		path   string
+		args   []string
+		code   int
+		stderr string
+	}{
+		{"/img.png", nil, exitOK, ""},
+		{"/image", nil, exitOK, ""},
+		{"/redirect", nil, exitOK, ""},
+		{"/missing.png", nil, exitInput, "404 Not Found"},
+		{"/broken.png", nil, exitInput, "500 Internal Server Error"},
+		{"/page", nil, exitInput, "not an image"},
+		{"/chunked.png", []string{"-fetch-max-size", "100"}, exitInput, "exceeds the limit of 100 bytes"},
+		{"/slow.png", []string{"-fetch-timeout", "50ms"}, exitInput, ""},
+	}
+	for _, tt := range tests {
+		out := filepath.Join(dir, "out.png")
+		args := append([]string{"apply", "-in", ts.URL + tt.path, "-out", out, "-tile", "8", "-quiet"}, tt.args...)
+		res := runCLI(t, args...)
+		if res.code != tt.code || !strings.Contains(res.stderr, tt.stderr) {
+			t.Errorf("%s %v: exit code = %d, want %d with %q (stderr: %s)", tt.path, tt.args, res.code, tt.code, tt.stderr, res.stderr)
+			continue
+		}
+		if tt.code == exitOK {
+			assertSameImage(t, readTestImage(t, out), readTestImage(t, want))
+		}
+	}
+}
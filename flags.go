@@ -0,0 +1,523 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"log/slog"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/yashikota/go-streaming-image-mosaic/mosaic"
+)
+
+// すべてのサブコマンドで共通のフラグ
+type commonFlags struct {
+	fs         *flag.FlagSet
+	tile       *int
+	tileMM     *float64
+	dpi        *float64
+	verbose    *bool
+	quiet      *bool
+	logFormat  *string
+	config     *string
+	grain      *int
+	grainDist  *string
+	seed       *int64
+	tint       *string
+	tintStr    *float64
+	hueShift   *float64
+	bright     *float64
+	contrast   *float64
+	satur      *float64
+	adjScope   *string
+	parallel   *int
+	tolerant   *bool
+	tolFill    *string
+	timeout    *time.Duration
+	maxWidth   *int
+	maxHeight  *int
+	maxPixels  pixelCount
+	maxHeap    byteSize
+	pages      pageRanges
+	toSRGB     *bool
+	colorSp    *string
+	tileFilter *string
+	legacyRnd  *bool
+	exclude    colorList
+	excludeTol *int
+	selLuma    *string
+	selGrow    *int
+	selExpr    *string
+	selMasks   map[string]*image.Gray // 読み込んだ -select の mask(path) の画像
+	skipEdges  *float64
+	pattern    *string
+	patternInv *bool
+	stripe     *string
+	strength   *string
+	strengthIm *image.Gray    // 読み込んだ -strength-map
+	settings   mosaic.Options // parse で確かめ、Canonical にした処理結果に影響する設定
+	labels     *bool
+	labelMin   *int
+	style      *string
+	baseplate  *string
+	legoColors *bool
+	palette    *string
+	origin     gridOrigin
+	cropOffset gridOrigin
+	regions    regionList
+	regionFile *string
+	regionMinT *int
+	minTile    *int
+	fileRegion []mosaic.RegionOptions // 読み込んだ -regions の範囲
+}
+
+// サブコマンドのフラグセットを生成し、共通のフラグを登録
+// usage は -h で表示する引数の書式
+func newCommonFlags(name, usage string, stderr io.Writer) *commonFlags {
+	fs := flag.NewFlagSet(progName+" "+name, flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: %s %s %s\n\nflags:\n", progName, name, usage)
+		fs.PrintDefaults()
+	}
+	c := &commonFlags{
+		fs:         fs,
+		tile:       fs.Int("tile", 100, "モザイクタイルの大きさ (px)"),
+		tileMM:     fs.Float64("tile-mm", 0, "モザイクタイルの大きさを mm で指定し、入力の解像度で px に換算する (-tile より優先、0 で無効)"),
+		dpi:        fs.Float64("dpi", 0, "入力の解像度 (dpi)。記録された解像度より優先し、出力にも記録する (0 の場合は入力の解像度を使う)"),
+		verbose:    fs.Bool("v", false, "デバッグログを出力する"),
+		quiet:      fs.Bool("quiet", false, "エラー以外のログを出力しない"),
+		logFormat:  fs.String("log-format", "text", "ログの形式 (text または json)"),
+		config:     fs.String("config", "", "設定ファイル (JSON) のパス"),
+		grain:      fs.Int("grain", 0, "塗りつぶし後のタイルに加えるノイズの最大幅 (±値、0 で無効)"),
+		grainDist:  fs.String("grain-dist", "uniform", "ノイズの分布 (uniform または triangular)"),
+		seed:       fs.Int64("seed", 0, "ノイズの乱数のシード"),
+		tint:       fs.String("tint", "", "タイルの色を近づける色 (例: #0044cc)"),
+		tintStr:    fs.Float64("tint-strength", 0.5, "-tint の色へ近づける割合 (0〜1)"),
+		hueShift:   fs.Float64("hue-shift", 0, "タイルの色相を回転させる角度 (度)"),
+		bright:     fs.Float64("brightness", 0, "タイルの色の明るさ (-100〜100、0 で変更なし)"),
+		contrast:   fs.Float64("contrast", 0, "タイルの色のコントラスト (-100〜100、0 で変更なし)"),
+		satur:      fs.Float64("saturation", 0, "タイルの色の彩度 (-100〜100、0 で変更なし)"),
+		adjScope:   fs.String("adjust-scope", "region", "色の変換 (-brightness など) を適用する範囲 (モザイクのタイルだけの region、または -region や -select で選ばなかった画素にも適用する all)"),
+		parallel:   fs.Int("parallel", 0, "1 枚の画像の処理に使うゴルーチンの数 (0 で CPU の数)"),
+		tolerant:   fs.Bool("tolerant", false, "途中で切れた JPEG を読み込めた行まで処理する"),
+		tolFill:    fs.String("tolerant-fill", "#808080", "-tolerant で復元できなかった行を塗りつぶす色"),
+		timeout:    fs.Duration("timeout", 0, "1 枚の画像のデコードからエンコードまでの制限時間 (0 で無制限)"),
+		maxWidth:   fs.Int("max-width", 0, "デコードする画像の幅の上限 (px、0 で無制限)"),
+		maxHeight:  fs.Int("max-height", 0, "デコードする画像の高さの上限 (px、0 で無制限)"),
+		colorSp:    fs.String("color-space", "rgb", "タイルの色を平均する色空間 (rgb、lab または hsv)"),
+		tileFilter: fs.String("tile-filter", "box", "タイルの平均色の画素の重み (一様な box、中心ほど重い tent または gauss。-color-space rgb の場合だけ)"),
+		legacyRnd:  fs.Bool("legacy-rounding", false, "タイルの平均色を以前の計算で切り捨てる (省略時は四捨五入する。以前の出力とバイト単位で同じ結果が必要な場合に使う)"),
+		excludeTol: fs.Int("exclude-tolerance", 0, "-exclude-color の色とみなす RGB の各成分の差 (0〜255)"),
+		selLuma:    fs.String("select-luma", "", "輝度 (0〜1) がしきい値を満たす画素だけを処理する (例: '>=0.9' または '<=0.1')"),
+		selGrow:    fs.Int("select-grow", 0, "-select-luma で選んだ範囲を広げる画素数"),
+		selExpr:    fs.String("select", "", "処理する画素の選び方の式 (例: 'regions + luma(>=0.9) - rect(0,0,200,80)'。項は all、regions、rect(x,y,w,h)、luma(>=0.9[,grow])、mask(path)、演算子は + - & ! と括弧。-select-luma と組み合わせた場合は両方で選んだ画素)"),
+		skipEdges:  fs.Float64("skip-edges", 0, "エッジの量 (隣り合う画素の RGB の差の平均、0〜510) がこの値より大きいタイルを処理しない (0 で無効)"),
+		pattern:    fs.String("pattern", "none", "処理するタイルの並び (none、市松模様の checker、横縞の stripes-h または縦縞の stripes-v)"),
+		patternInv: fs.Bool("pattern-invert", false, "-pattern で処理しないタイルの方を処理する"),
+		stripe:     fs.String("stripe", "", "処理する横縞の高さと残す横縞の高さ (`process:skip`、px、例: 40:20)"),
+		strength:   fs.String("strength-map", "", "タイルごとの処理の強さ (0 で元のまま、255 で完全にモザイク) を表す画像と同じ大きさのグレースケール画像"),
+		labels:     fs.Bool("label-colors", false, "タイルの中央に色の 16 進数のコード (例: #8A6F4B) を描く"),
+		labelMin:   fs.Int("label-min-size", 48, "-label-colors でコードを描くタイルの最小の大きさ (px)"),
+		style:      fs.String("style", "flat", "タイルの描き方 (flat、レゴのブロック風の lego、円の dot、角丸の rounded または目地を入れた grout)"),
+		baseplate:  fs.String("baseplate", "", "-style lego でブロックの間に見せる基礎板の色 (例: #237841、省略時は隙間なし)、dot、rounded と grout では背景と目地の色 (省略時は白)"),
+		legoColors: fs.Bool("lego-palette", false, "タイルの色をレゴのブロックの色 (44 色) のうち最も近い色にする (-palette lego と同じ)"),
+		palette:    fs.String("palette", "", "タイルの色を組み込みのパレットのうち最も近い色にする (grayscale、viridis、okabe-ito、tol-bright または lego。一覧は palette list で表示する)"),
+		regionFile: fs.String("regions", "", "処理する範囲と範囲ごとの設定を並べた JSON ファイル (-region より前の範囲として扱う)"),
+		regionMinT: fs.Int("region-min-tiles", 0, "範囲の幅と高さがどちらもタイルこの数以上になるよう、範囲ごとにタイルを小さくする (0 で無効)"),
+		minTile:    fs.Int("min-tile", 4, "-region-min-tiles で小さくするタイルの大きさの下限 (px)"),
+		toSRGB:     fs.Bool("convert-srgb", false, "埋め込まれた ICC プロファイル (Display P3 や AdobeRGB など) に従って sRGB に変換してから処理する"),
+	}
+	fs.Var(&c.maxPixels, "max-pixels", "デコードする画像の画素数の上限 (`n` または 100MP のようなメガピクセル単位、0 で無制限)")
+	fs.Var(&c.maxHeap, "max-heap", "画像の大きさと設定から見積もった主なメモリの確保がこの大きさを超える場合は処理しない (`size`、例: 2GiB、0 で無制限)")
+	fs.Var(&c.exclude, "exclude-color", "タイルの平均に含めず、そのまま残す画素の色 (`color`、例: #ff00ff、複数指定可)")
+	fs.Var(&c.origin, "grid-origin", "タイルの境界が通る点 (`x,y`、px、省略時は 0,0)")
+	fs.Var(&c.cropOffset, "crop-offset", "入力が大きな元画像から切り出したものである場合の、元画像の中での入力の左上の位置 (`x,y`、px)。-grid-origin を元画像の座標とみなし、元画像全体を処理した場合と格子をそろえる")
+	fs.Var(&c.regions, "region", "この範囲だけを処理する (`x,y,w,h[:tile=n][:color-space=name][:style=name]`、繰り返し指定でき、重なる場合は後の範囲を優先する)")
+	fs.Var(&c.pages, "pages", "複数ページの TIFF で処理するページ (`list`、例: 1,3-5、省略時はすべて)")
+	return c
+}
+
+// 引数を解析し、環境変数と設定ファイルの値を反映
+// 優先順位はコマンドラインのフラグ > 環境変数 > 設定ファイル > デフォルト値
+func (c *commonFlags) parse(args []string) error {
+	annotateEnv(c.fs)
+	if err := c.fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return err
+		}
+		return &usageError{err}
+	}
+	if err := applyEnv(c.fs, os.LookupEnv); err != nil {
+		return &usageError{err}
+	}
+	if *c.config != "" {
+		if err := loadConfig(c.fs, *c.config, knownConfigKeys()); err != nil {
+			return &usageError{err}
+		}
+	}
+	if *c.regionFile != "" {
+		regions, err := loadRegions(*c.regionFile)
+		if err != nil {
+			return &inputError{path: *c.regionFile, err: err}
+		}
+		c.fileRegion = regions
+	}
+	c.settings = c.options()
+	if err := c.settings.Validate(); err != nil {
+		return &usageError{err}
+	}
+	c.settings = c.settings.Canonical()
+	if *c.strength != "" {
+		m, err := loadStrengthMap(*c.strength)
+		if err != nil {
+			return &inputError{path: *c.strength, err: err}
+		}
+		c.strengthIm = m
+	}
+	if c.settings.Select != "" {
+		masks, err := loadSelectMasks(c.settings.Select)
+		if err != nil {
+			return err
+		}
+		c.selMasks = masks
+	}
+	if *c.parallel < 0 {
+		return &usageError{errors.New("parallel must not be negative")}
+	}
+	if *c.timeout < 0 {
+		return &usageError{errors.New("timeout must not be negative")}
+	}
+	if *c.maxWidth < 0 || *c.maxHeight < 0 {
+		return &usageError{errors.New("max-width and max-height must not be negative")}
+	}
+	return nil
+}
+
+// フラグの値のうち処理結果に影響する設定
+// -crop-offset は入力の座標での格子の原点に含める
+func (c *commonFlags) options() mosaic.Options {
+	exclude := make([]string, len(c.exclude))
+	for i, color := range c.exclude {
+		exclude[i] = mosaic.FormatHexColor(color)
+	}
+	return mosaic.Options{
+		Tile:             *c.tile,
+		TileMM:           *c.tileMM,
+		DPI:              *c.dpi,
+		GridOrigin:       [2]int{c.origin.X - c.cropOffset.X, c.origin.Y - c.cropOffset.Y},
+		ColorSpace:       *c.colorSp,
+		TileFilter:       *c.tileFilter,
+		LegacyRounding:   *c.legacyRnd,
+		Brightness:       *c.bright,
+		Contrast:         *c.contrast,
+		Saturation:       *c.satur,
+		HueShift:         *c.hueShift,
+		Tint:             *c.tint,
+		TintStrength:     *c.tintStr,
+		LegoPalette:      *c.legoColors,
+		Palette:          *c.palette,
+		AdjustScope:      *c.adjScope,
+		Grain:            *c.grain,
+		GrainDist:        *c.grainDist,
+		Seed:             *c.seed,
+		ExcludeColors:    exclude,
+		ExcludeTolerance: *c.excludeTol,
+		SelectLuma:       *c.selLuma,
+		SelectGrow:       *c.selGrow,
+		Select:           *c.selExpr,
+		SkipEdges:        *c.skipEdges,
+		Pattern:          *c.pattern,
+		PatternInvert:    *c.patternInv,
+		Stripe:           *c.stripe,
+		StrengthMap:      *c.strength,
+		Style:            *c.style,
+		Baseplate:        *c.baseplate,
+		LabelColors:      *c.labels,
+		LabelMinSize:     *c.labelMin,
+		Tolerant:         *c.tolerant,
+		TolerantFill:     *c.tolFill,
+		ConvertSRGB:      *c.toSRGB,
+		Regions:          append(append([]mosaic.RegionOptions{}, c.fileRegion...), c.regions...),
+		RegionMinTiles:   *c.regionMinT,
+		MinTile:          *c.minTile,
+	}
+}
+
+// -max-width、-max-height、-max-pixels の上限
+func (c *commonFlags) limits() imageLimits {
+	return imageLimits{
+		maxWidth:  *c.maxWidth,
+		maxHeight: *c.maxHeight,
+		maxPixels: int64(c.maxPixels),
+	}
+}
+
+// フラグの指定に応じた処理設定を組み立てる
+// 処理結果に影響する設定は parse で確かめた settings から組み立てる
+func (c *commonFlags) pipeline(logger *slog.Logger) pipeline {
+	workers := *c.parallel
+	if workers == 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	o := c.settings
+	fill, _ := mosaic.ParseHexColor(o.TolerantFill)
+	p := pipeline{
+		tile:         o.Tile,
+		gridOrigin:   image.Pt(o.GridOrigin[0], o.GridOrigin[1]),
+		tileMM:       o.TileMM,
+		dpi:          o.DPI,
+		workers:      workers,
+		timeout:      *c.timeout,
+		logger:       logger,
+		tolerant:     o.Tolerant,
+		tolerantFill: fill,
+		pages:        c.pages,
+		convertSRGB:  o.ConvertSRGB,
+		skipEdges:    o.SkipEdges,
+		renderer:     renderer(o),
+		settings:     o,
+		grain: mosaic.Grain{
+			Amount:     o.Grain,
+			Seed:       o.Seed,
+			Triangular: o.GrainDist == "triangular",
+		},
+		limits:  c.limits(),
+		maxHeap: c.maxHeap,
+	}
+
+	if len(o.ExcludeColors) > 0 {
+		colors := make([]color.NRGBA, len(o.ExcludeColors))
+		for i, hex := range o.ExcludeColors {
+			colors[i], _ = mosaic.ParseHexColor(hex)
+		}
+		p.exclude = mosaic.ExcludeColors(o.ExcludeTolerance, colors...)
+	}
+
+	if o.SelectLuma != "" {
+		threshold, above, _ := mosaic.ParseLumaSelection(o.SelectLuma)
+		p.selectLuma = &lumaSelection{threshold: threshold, above: above, grow: o.SelectGrow}
+	}
+
+	if o.Select != "" {
+		e, _ := mosaic.ParseSelectExpr(o.Select)
+		p.selectExpr, p.selectMask = &e, c.selMasks
+	}
+
+	if pattern, _ := mosaic.PatternByName(o.Pattern); pattern != nil {
+		if o.PatternInvert {
+			pattern = mosaic.InvertPattern(pattern)
+		}
+		p.pattern = pattern
+	}
+
+	if c.strengthIm != nil {
+		p.strengthMap, p.strengthPath = c.strengthIm, o.StrengthMap
+	}
+	if o.Stripe != "" {
+		p.stripes, _ = mosaic.ParseStripes(o.Stripe)
+	}
+
+	p.colorSpace = o.ColorSpace
+	p.tileFilter, _ = mosaic.ParseTileFilter(o.TileFilter)
+	if o.LegacyRounding {
+		p.rounding = mosaic.RoundTruncate
+	}
+	if o.ColorSpace != "rgb" {
+		p.color = meanColor(o.ColorSpace)
+	}
+
+	// 明るさ → コントラスト → 彩度 → 色相 → 色味付けの順に適用する
+	if o.Brightness != 0 {
+		p.adjusts = append(p.adjusts, mosaic.Brightness(o.Brightness))
+	}
+	if o.Contrast != 0 {
+		p.adjusts = append(p.adjusts, mosaic.Contrast(o.Contrast))
+	}
+	if o.Saturation != 0 {
+		p.adjusts = append(p.adjusts, mosaic.Saturation(o.Saturation))
+	}
+	if o.HueShift != 0 {
+		p.adjusts = append(p.adjusts, mosaic.HueShift(o.HueShift))
+	}
+	if o.Tint != "" {
+		tint, _ := mosaic.ParseHexColor(o.Tint)
+		p.adjusts = append(p.adjusts, mosaic.TintAdjust(tint, o.TintStrength))
+	}
+	p.adjustScope, _ = mosaic.ParseAdjustScope(o.AdjustScope)
+	// パレットへの置き換えは、ほかの調整を済ませた色に対して最後に行う
+	if o.LegoPalette {
+		p.palette = mosaic.NewPaletteMatcher(mosaic.LegoPalette)
+	} else if palette, ok := mosaic.PaletteByName(o.Palette); ok {
+		p.palette = mosaic.NewPaletteMatcher(palette.Colors)
+	}
+	return p
+}
+
+// -color-space の色空間でタイルの色を平均する関数
+func meanColor(space string) mosaic.TileColorFunc {
+	switch space {
+	case "lab":
+		return mosaic.LabMeanColor
+	case "hsv":
+		return mosaic.HSVMeanColor
+	}
+	return mosaic.MeanColor
+}
+
+// -style、-baseplate と -label-colors に応じたタイルの描画処理 (nil の場合は単色で塗りつぶす)
+func renderer(o mosaic.Options) mosaic.TileRenderer {
+	var renderer mosaic.TileRenderer
+	var baseplate color.NRGBA
+	if o.Baseplate != "" {
+		baseplate, _ = mosaic.ParseHexColor(o.Baseplate)
+	} else if o.Style != "lego" {
+		// lego 以外は省略時に白の背景や目地にする
+		baseplate = color.NRGBA{0xff, 0xff, 0xff, 0xff}
+	}
+	switch o.Style {
+	case "lego":
+		renderer = mosaic.LegoRenderer{Baseplate: baseplate}
+	case "dot":
+		renderer = mosaic.DotRenderer{Background: baseplate}
+	case "rounded":
+		renderer = mosaic.RoundedRenderer{Background: baseplate}
+	case "grout":
+		renderer = mosaic.GroutRenderer{Grout: baseplate}
+	}
+	if o.LabelColors {
+		renderer = mosaic.LabelRenderer{Base: renderer, MinSize: o.LabelMinSize}
+	}
+	return renderer
+}
+
+// 複数指定できる色のフラグの値
+// 指定するたびに追加し、カンマ区切りで一度に複数の色も指定できる
+type colorList []color.NRGBA
+
+func (l *colorList) String() string {
+	parts := make([]string, len(*l))
+	for i, c := range *l {
+		parts[i] = mosaic.FormatHexColor(c)
+	}
+	return strings.Join(parts, ",")
+}
+
+func (l *colorList) Set(s string) error {
+	for _, part := range strings.Split(s, ",") {
+		c, err := mosaic.ParseHexColor(strings.TrimSpace(part))
+		if err != nil {
+			return err
+		}
+		*l = append(*l, c)
+	}
+	return nil
+}
+
+func (l *colorList) Get() any {
+	return l.String()
+}
+
+// 繰り返し指定できる -region の値
+type regionList []mosaic.RegionOptions
+
+func (l *regionList) String() string {
+	parts := make([]string, len(*l))
+	for i, r := range *l {
+		parts[i] = fmt.Sprintf("%d,%d,%d,%d", r.Rect[0], r.Rect[1], r.Rect[2], r.Rect[3])
+		if r.Tile != 0 {
+			parts[i] += ":tile=" + strconv.Itoa(r.Tile)
+		}
+		if r.ColorSpace != "" {
+			parts[i] += ":color-space=" + r.ColorSpace
+		}
+		if r.Style != "" {
+			parts[i] += ":style=" + r.Style
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+func (l *regionList) Set(s string) error {
+	r, err := mosaic.ParseRegion(s)
+	if err != nil {
+		return err
+	}
+	*l = append(*l, r)
+	return nil
+}
+
+func (l *regionList) Get() any {
+	return l.String()
+}
+
+// -regions の JSON ファイル (mosaic.RegionOptions の配列) を読み込む
+func loadRegions(path string) ([]mosaic.RegionOptions, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var regions []mosaic.RegionOptions
+	if err := json.Unmarshal(data, &regions); err != nil {
+		return nil, fmt.Errorf("invalid regions file: %w", err)
+	}
+	return regions, nil
+}
+
+// フラグの指定に応じたロガーを生成
+func (c *commonFlags) logger(stderr io.Writer) (*slog.Logger, error) {
+	logger, err := newLogger(stderr, *c.verbose, *c.quiet, *c.logFormat)
+	if err != nil {
+		return nil, &usageError{err}
+	}
+	return logger, nil
+}
+
+// いずれかのサブコマンドで定義されているフラグ名の集合
+// 設定ファイルは複数のサブコマンドで共有できるため、どのサブコマンドにもないキーのみを未知とする
+func knownConfigKeys() map[string]bool {
+	keys := map[string]bool{}
+	for _, cmd := range commands() {
+		if cmd.flags == nil {
+			continue
+		}
+		cmd.flags(io.Discard).fs.VisitAll(func(f *flag.Flag) {
+			keys[f.Name] = true
+		})
+	}
+	delete(keys, "config")
+	return keys
+}
+
+// タイルの格子の原点を表すフラグの値 (例: 50,0)
+type gridOrigin image.Point
+
+func (o *gridOrigin) String() string {
+	if *o == (gridOrigin{}) {
+		return ""
+	}
+	return strconv.Itoa(o.X) + "," + strconv.Itoa(o.Y)
+}
+
+func (o *gridOrigin) Set(s string) error {
+	xs, ys, ok := strings.Cut(s, ",")
+	x, errX := strconv.Atoi(strings.TrimSpace(xs))
+	y, errY := strconv.Atoi(strings.TrimSpace(ys))
+	if !ok || errX != nil || errY != nil {
+		return fmt.Errorf("invalid grid origin %q (want x,y such as 50,0)", s)
+	}
+	*o = gridOrigin{X: x, Y: y}
+	return nil
+}
+
+func (o *gridOrigin) Get() any {
+	return o.String()
+}
@@ -0,0 +1,17 @@
+//go:build avif
+
+package main
+
+import (
+	"github.com/gen2brain/avif"
+
+	"github.com/yashikota/go-streaming-image-mosaic/mosaic"
+)
+
+// AVIF を読み込めるようにする
+// go get github.com/gen2brain/avif でモジュールを追加してから -tags avif でビルドする
+func init() {
+	for _, brand := range []string{"avif", "avis"} {
+		mosaic.RegisterDecoderConfig("avif", "????ftyp"+brand, avif.Decode, avif.DecodeConfig)
+	}
+}
@@ -0,0 +1,17 @@
+//go:build heic
+
+package main
+
+import (
+	"github.com/jdeng/goheif"
+
+	"github.com/yashikota/go-streaming-image-mosaic/mosaic"
+)
+
+// HEIC (iPhone の写真など) を読み込めるようにする
+// cgo を使うデコーダーのため、go get github.com/jdeng/goheif でモジュールを追加してから -tags heic でビルドする
+func init() {
+	for _, brand := range []string{"heic", "heix", "mif1", "msf1"} {
+		mosaic.RegisterDecoderConfig("heic", "????ftyp"+brand, goheif.Decode, goheif.DecodeConfig)
+	}
+}
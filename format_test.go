@@ -0,0 +1,74 @@
+package main
+
+import (
+	"image"
+	"io"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/yashikota/go-streaming-image-mosaic/mosaic"
+)
+
+// 外部のデコーダーの代わりに登録するテスト用の形式
+// "MFAK"、幅、高さ (各 1 バイト)、続けて画素ごとの RGB
+func init() {
+	mosaic.RegisterDecoder("fake", "MFAK", func(r io.Reader) (image.Image, error) {
+		var header [6]byte
+		if _, err := io.ReadFull(r, header[:]); err != nil {
+			return nil, err
+		}
+		img := image.NewNRGBA(image.Rect(0, 0, int(header[4]), int(header[5])))
+		for i := 0; i < len(img.Pix); i += 4 {
+			if _, err := io.ReadFull(r, img.Pix[i:i+3]); err != nil {
+				return nil, err
+			}
+			img.Pix[i+3] = 255
+		}
+		return img, nil
+	})
+}
+
+func encodeFake(img *image.NRGBA) []byte {
+	data := []byte{'M', 'F', 'A', 'K', byte(img.Rect.Dx()), byte(img.Rect.Dy())}
+	for i := 0; i < len(img.Pix); i += 4 {
+		data = append(data, img.Pix[i:i+3]...)
+	}
+	return data
+}
+
+// RegisterDecoder で登録した形式は、標準の形式と同じくコマンドラインで読み込める
+func TestRegisteredDecoderCLI(t *testing.T) {
+	dir := t.TempDir()
+	src := testImage(40, 30)
+	fake, png := filepath.Join(dir, "in.fake"), filepath.Join(dir, "in.png")
+	writeTestFile(t, fake, encodeFake(src))
+	writeTestImage(t, png, src)
+
+	got, want := filepath.Join(dir, "got.png"), filepath.Join(dir, "want.png")
+	for _, args := range [][]string{
+		{"apply", "-in", fake, "-out", got, "-tile", "8", "-quiet"},
+		{"apply", "-in", png, "-out", want, "-tile", "8", "-quiet"},
+	} {
+		if res := runCLI(t, args...); res.code != exitOK {
+			t.Fatalf("%v: exit code = %d (stderr: %s)", args, res.code, res.stderr)
+		}
+	}
+	assertSameImage(t, readTestImage(t, got), readTestImage(t, want))
+
+	if res := runCLI(t, "-version"); !strings.Contains(res.stdout, "fake") {
+		t.Errorf("-version does not list the registered format: %s", res.stdout)
+	}
+	// 読み込めない入力のエラーには、登録した形式も並べる
+	unknown := filepath.Join(dir, "in.bin")
+	writeTestFile(t, unknown, []byte("not an image"))
+	res := runCLI(t, "apply", "-in", unknown, "-out", got, "-quiet")
+	if res.code != exitDecode || !strings.Contains(res.stderr, "fake") {
+		t.Errorf("unknown format: exit code = %d (stderr: %s)", res.code, res.stderr)
+	}
+	// 大きさの上限はデコードして求めた大きさで確かめる
+	res = runCLI(t, "apply", "-in", fake, "-out", got, "-max-width", "20", "-quiet")
+	if res.code != exitDecode || !strings.Contains(res.stderr, "exceeds max-width 20") {
+		t.Errorf("max-width: exit code = %d (stderr: %s)", res.code, res.stderr)
+	}
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/yashikota/go-streaming-image-mosaic/mosaic"
+)
+
+// frames のフラグ
+type framesFlags struct {
+	*commonFlags
+	in          *string
+	out         *string
+	start       *int
+	end         *int
+	allowGaps   *bool
+	temporal    *float64
+	temporalThr *float64
+}
+
+func newFramesFlags(stderr io.Writer) *framesFlags {
+	c := newCommonFlags("frames", "[flags] -in 'frames/frame_%06d.png' -end n -out 'out/frame_%06d.png'", stderr)
+	f := &framesFlags{
+		commonFlags: c,
+		in:          c.fs.String("in", "", "入力のフレームのパスの書式 (番号を表す %d を 1 つ含む printf の書式、例: frames/frame_%06d.png)"),
+		out:         c.fs.String("out", "", "出力のフレームのパスの書式 (-in と同じ形式、拡張子で出力の形式を決める)"),
+		start:       c.fs.Int("start", 1, "最初のフレームの番号"),
+		end:         c.fs.Int("end", -1, "最後のフレームの番号 (この番号も含む)"),
+		allowGaps:   c.fs.Bool("allow-gaps", false, "範囲の中で欠けているフレームを警告して飛ばす (省略時はエラーで中止する)"),
+		temporal:    c.fs.Float64("temporal", 0, "前のフレームのタイルの色を残す割合 (0〜1 未満、0 で平滑化しない)。タイルの色のちらつきを抑える"),
+		temporalThr: c.fs.Float64("temporal-threshold", 48, "-temporal で場面の切り替わりとみなし、平滑化しないタイルの色の変化 (RGBA の距離、0〜510)"),
+	}
+	return f
+}
+
+// 書式の中のフレームの番号を表す動詞
+var frameVerb = regexp.MustCompile(`%0?[0-9]*d`)
+
+// 番号を表す %d をちょうど 1 つ含む書式かどうかを確かめる
+func checkFramePattern(name, pattern string) error {
+	rest := strings.ReplaceAll(pattern, "%%", "")
+	if len(frameVerb.FindAllString(rest, -1)) != 1 || strings.Count(rest, "%") != 1 {
+		return &usageError{fmt.Errorf("-%s must contain exactly one %%d verb for the frame number (e.g. frame_%%06d.png)", name)}
+	}
+	return nil
+}
+
+// 番号で並んだフレームの画像を順にモザイク処理する
+// フレームの大きさはすべて同じとみなし、デコード、処理、エンコードのバッファを使い回す
+func runFrames(args []string, stdout, stderr io.Writer) error {
+	f := newFramesFlags(stderr)
+	if err := f.parse(args); err != nil {
+		return err
+	}
+	if *f.in == "" || *f.out == "" || *f.end < 0 {
+		return &usageError{errors.New("-in, -out and -end are required")}
+	}
+	if err := checkFramePattern("in", *f.in); err != nil {
+		return err
+	}
+	if err := checkFramePattern("out", *f.out); err != nil {
+		return err
+	}
+	if *f.start < 0 || *f.end < *f.start {
+		return &usageError{errors.New("-start must not be negative and -end must not be less than -start")}
+	}
+	if *f.temporal < 0 || *f.temporal >= 1 {
+		return &usageError{errors.New("temporal must be at least 0 and less than 1")}
+	}
+	if *f.temporalThr < 0 || *f.temporalThr > 510 {
+		return &usageError{errors.New("temporal-threshold must be between 0 and 510")}
+	}
+
+	bar := newProgressBar(stderr, *f.quiet)
+	logger, err := f.logger(bar.logOutput(stderr))
+	if err != nil {
+		return err
+	}
+	p := f.pipeline(logger)
+	if p.encoder, err = imageEncoder("", *f.out); err != nil {
+		return err
+	}
+	s := &frameSequence{p: p, logger: logger, bar: bar, in: *f.in, out: *f.out, allowGaps: *f.allowGaps,
+		temporal: *f.temporal, temporalThr: *f.temporalThr}
+
+	start := time.Now()
+	processed, skipped, err := s.run(context.Background(), *f.start, *f.end)
+	bar.finish()
+	if err != nil {
+		return err
+	}
+	elapsed := time.Since(start)
+	logger.Info("frames finished", "frames", processed, "skipped", skipped,
+		"fps", fmt.Sprintf("%.1f", float64(processed)/elapsed.Seconds()), "elapsed", elapsed.Round(time.Millisecond))
+	return nil
+}
+
+// 番号で並んだフレームの入出力と、フレームの間で使い回すバッファ
+type frameSequence struct {
+	p         pipeline
+	logger    *slog.Logger
+	bar       *progressBar
+	in, out   string // パスの書式
+	allowGaps bool
+
+	temporal    float64                    // 前のフレームのタイルの色を残す割合 (0 の場合は平滑化しない)
+	temporalThr float64                    // 場面の切り替わりとみなす色の変化
+	smoothers   []*mosaic.TemporalSmoother // 処理する範囲ごと (範囲がない場合は画像全体) の平滑化
+
+	br    *bufio.Reader
+	bw    *bufio.Writer
+	frame *image.NRGBA // デコードしたフレーム (その場で処理する)
+}
+
+// start から end までのフレームを順に処理し、処理した数と飛ばした数を返却
+// 欠けているフレームは allowGaps の場合だけ飛ばし、それ以外の失敗は最初の失敗で中止する
+func (s *frameSequence) run(ctx context.Context, start, end int) (processed, skipped int, err error) {
+	s.br = bufio.NewReader(nil)
+	s.bw = bufio.NewWriterSize(nil, 1<<20)
+	total := end - start + 1
+	for n := start; n <= end; n++ {
+		in := fmt.Sprintf(s.in, n)
+		err := s.process(ctx, in, fmt.Sprintf(s.out, n))
+		var missing *missingFrameError
+		switch {
+		case errors.As(err, &missing) && s.allowGaps:
+			s.logger.Warn("frame is missing; skipped", "frame", n, "input", in)
+			skipped++
+		case err != nil:
+			return processed, skipped, err
+		default:
+			processed++
+		}
+		s.bar.frames(s.logger, n-start+1, total)
+	}
+	return processed, skipped, nil
+}
+
+// 範囲の中で欠けているフレームを表すエラー
+type missingFrameError struct {
+	err error
+}
+
+func (e *missingFrameError) Error() string { return "frame is missing (use -allow-gaps to skip it)" }
+func (e *missingFrameError) Unwrap() error { return e.err }
+
+// i 番目の範囲 (範囲がない場合は画像全体) のタイルの色を平滑化する TemporalSmoother
+// color は範囲のタイルの色の決め方 (nil の場合は -tile-filter で重み付けした平均色)
+func (s *frameSequence) smoother(i int, color mosaic.TileColorFunc) *mosaic.TemporalSmoother {
+	for len(s.smoothers) <= i {
+		smoother := mosaic.NewTemporalSmoother(s.temporal, s.temporalThr)
+		smoother.Filter = s.p.tileFilter
+		s.smoothers = append(s.smoothers, smoother)
+	}
+	s.smoothers[i].Color = color
+	return s.smoothers[i]
+}
+
+// 1 つのフレームを処理して書き出す
+func (s *frameSequence) process(ctx context.Context, in, out string) error {
+	file, err := os.Open(in)
+	if errors.Is(err, fs.ErrNotExist) {
+		return &inputError{path: in, err: &missingFrameError{err: err}}
+	}
+	if err != nil {
+		return &inputError{path: in, err: err}
+	}
+	defer file.Close()
+
+	s.br.Reset(file)
+	p, br, err := s.p.withInputDensity(s.logger, s.br)
+	if err != nil {
+		return fmt.Errorf("%s: %w", in, &stageError{stage: stageDecode, err: err})
+	}
+	src, region, _, err := p.decodeSourceInto(s.logger, br, s.frame)
+	if err != nil {
+		return fmt.Errorf("%s: %w", in, &stageError{stage: stageDecode, err: err})
+	}
+	if s.frame == nil {
+		s.frame = src
+	} else if src != s.frame {
+		return &inputError{path: in, err: fmt.Errorf("frame size %dx%d differs from the first frame (%dx%d)",
+			src.Rect.Dx(), src.Rect.Dy(), s.frame.Rect.Dx(), s.frame.Rect.Dy())}
+	}
+
+	opts, err := p.options(s.logger, nil, src)
+	if err != nil {
+		return fmt.Errorf("%s: %w", in, &stageError{stage: stageProcess, err: err})
+	}
+	if p.settings.ProcessesRegions() {
+		regions := p.regions(s.logger, region.Rect)
+		if s.temporal > 0 {
+			// 範囲ごとにタイルの大きさと色の決め方が異なるため、範囲ごとに平滑化する
+			for i := range regions {
+				color := p.color
+				if cs := p.settings.Regions[i].ColorSpace; cs != "" {
+					color = meanColor(cs)
+				}
+				r := &regions[i]
+				sub := region.SubImage(r.Rect.Intersect(region.Rect)).(*image.NRGBA)
+				smoother := s.smoother(i, color)
+				smoother.Frame(mosaic.New(sub, r.TileWidth, r.TileHeight, mosaic.WithGridOrigin(p.gridOrigin)).Grid())
+				r.Options = append(r.Options, mosaic.WithTileColor(smoother.TileColor))
+			}
+		}
+		err = mosaic.ProcessRegions(ctx, region, p.tile, p.tile, regions, opts...)
+	} else {
+		var smoother *mosaic.TemporalSmoother
+		if s.temporal > 0 {
+			smoother = s.smoother(0, p.color)
+			opts = append(opts, mosaic.WithTileColor(smoother.TileColor))
+		}
+		mp := mosaic.New(region, p.tile, p.tile, opts...)
+		if smoother != nil {
+			smoother.Frame(mp.Grid())
+		}
+		_, err = mp.ProcessInPlace(ctx)
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %w", in, &stageError{stage: stageProcess, err: err})
+	}
+
+	if err := os.MkdirAll(filepath.Dir(out), 0o755); err != nil {
+		return &outputError{path: filepath.Dir(out), err: err}
+	}
+	outFile, err := os.Create(out)
+	if err != nil {
+		return &outputError{path: out, err: err}
+	}
+	s.bw.Reset(outFile)
+	err = p.encode(s.bw, src)
+	if err == nil {
+		err = s.bw.Flush()
+	}
+	if cerr := outFile.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		// 書きかけの出力を残さない
+		os.Remove(out)
+		return &outputError{path: out, err: err}
+	}
+	return nil
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// base の R、G、B に -1、0、+1 のどれかを加えたフレーム (seed ごとに異なる)
+func noisyTestFrame(base *image.NRGBA, seed uint32) *image.NRGBA {
+	img := image.NewNRGBA(base.Rect)
+	copy(img.Pix, base.Pix)
+	state := seed*2654435761 + 1
+	for i := range img.Pix {
+		if i%4 == 3 {
+			continue
+		}
+		state = state*1664525 + 1013904223
+		img.Pix[i] = uint8(int(img.Pix[i]) + int(state>>24)%3 - 1)
+	}
+	return img
+}
+
+// -temporal は格子の原点、範囲、タイルの重み付けを指定してもタイルごとに色を保持し、
+// 1 LSB のノイズだけが異なるフレームでは最初のフレームと同じ出力になる
+func TestFramesTemporal(t *testing.T) {
+	in := t.TempDir()
+	// ノイズで画素の値があふれないよう、成分を 20〜219 にする
+	base := testImage(80, 56)
+	for i := range base.Pix {
+		if i%4 != 3 {
+			base.Pix[i] = 20 + base.Pix[i]%200
+		}
+	}
+	for i := 1; i <= 6; i++ {
+		writeTestImage(t, filepath.Join(in, fmt.Sprintf("frame_%02d.png", i)), noisyTestFrame(base, uint32(i)))
+	}
+	pattern := filepath.Join(in, "frame_%02d.png")
+
+	for _, args := range [][]string{
+		nil,
+		{"-grid-origin", "5,3"},
+		{"-tile-filter", "gauss"},
+		{"-tile-filter", "tent", "-grid-origin", "-8,12"},
+		// 範囲の外の画素はノイズのまま残るため、範囲で画像全体を覆う
+		{"-region", "0,0,48,56", "-region", "40,0,40,56:tile=12"},
+	} {
+		out := filepath.Join(t.TempDir(), "out_%02d.png")
+		common := append([]string{"-tile", "16", "-quiet"}, args...)
+		res := runCLI(t, append([]string{"frames", "-in", pattern, "-end", "6", "-out", out, "-start", "1", "-temporal", "0.7"}, common...)...)
+		if res.code != exitOK {
+			t.Fatalf("%v: exit code %d (stderr: %s)", args, res.code, res.stderr)
+		}
+		// 最初のフレームは平滑化せずに apply した結果と同じ
+		want := filepath.Join(t.TempDir(), "want.png")
+		if res := runCLI(t, append([]string{"apply", "-in", fmt.Sprintf(pattern, 1), "-out", want}, common...)...); res.code != exitOK {
+			t.Fatalf("%v: apply: exit code %d (stderr: %s)", args, res.code, res.stderr)
+		}
+		first := readTestImage(t, want)
+		changed := false
+		for i := 1; i <= 6; i++ {
+			assertSameImage(t, readTestImage(t, fmt.Sprintf(out, i)), first)
+			if i > 1 && !changed {
+				if res := runCLI(t, append([]string{"apply", "-in", fmt.Sprintf(pattern, i), "-out", want}, common...)...); res.code != exitOK {
+					t.Fatalf("%v: apply: exit code %d (stderr: %s)", args, res.code, res.stderr)
+				}
+				changed = !bytes.Equal(readTestImage(t, want).Pix, first.Pix)
+			}
+		}
+		// 平滑化しない場合はノイズで色が変わるタイルがある (テストがノイズを見逃していない)
+		if !changed {
+			t.Errorf("%v: noise never changed an unsmoothed frame", args)
+		}
+	}
+
+	// 以前の名前のフラグは受け付けない
+	for _, args := range [][]string{{"-temporal", "1"}, {"-smooth", "0.7"}, {"-smooth-threshold", "30"}} {
+		res := runCLI(t, append([]string{"frames", "-in", pattern, "-end", "3", "-out", filepath.Join(t.TempDir(), "out_%02d.png")}, args...)...)
+		if res.code != exitUsage {
+			t.Errorf("%v: exit code %d, want %d", args, res.code, exitUsage)
+		}
+	}
+}
+
+// 10 枚のフレームのうち 6 枚目が欠けている場合
+// 既定では 6 枚目で中止し、-allow-gaps では警告して残りのフレームを処理する
+func TestFramesMissingFrame(t *testing.T) {
+	in := t.TempDir()
+	for i := 1; i <= 10; i++ {
+		if i == 6 {
+			continue
+		}
+		img := testImage(24, 16)
+		for j := 0; j < len(img.Pix); j += 4 {
+			img.Pix[j] += uint8(20 * i)
+		}
+		writeTestImage(t, filepath.Join(in, fmt.Sprintf("frame_%02d.png", i)), img)
+	}
+	pattern := filepath.Join(in, "frame_%02d.png")
+	exists := func(path string) bool {
+		_, err := os.Stat(path)
+		return err == nil
+	}
+
+	out := filepath.Join(t.TempDir(), "out_%02d.png")
+	res := runCLI(t, "frames", "-in", pattern, "-start", "1", "-end", "10", "-out", out, "-tile", "8", "-quiet")
+	if res.code != exitInput || !strings.Contains(res.stderr, "frame_06.png") || !strings.Contains(res.stderr, "-allow-gaps") {
+		t.Fatalf("strict: exit code %d, want %d (stderr: %s)", res.code, exitInput, res.stderr)
+	}
+	for i := 1; i <= 10; i++ {
+		if want := i < 6; exists(fmt.Sprintf(out, i)) != want {
+			t.Errorf("strict: output of frame %d exists = %v, want %v", i, !want, want)
+		}
+	}
+
+	out = filepath.Join(t.TempDir(), "out_%02d.png")
+	res = runCLI(t, "frames", "-in", pattern, "-start", "1", "-end", "10", "-out", out, "-tile", "8", "-allow-gaps")
+	if res.code != exitOK {
+		t.Fatalf("-allow-gaps: exit code %d (stderr: %s)", res.code, res.stderr)
+	}
+	if !strings.Contains(res.stderr, "frame is missing; skipped") || !strings.Contains(res.stderr, "frame=6") || !strings.Contains(res.stderr, "skipped=1") {
+		t.Errorf("-allow-gaps: stderr does not report the missing frame: %s", res.stderr)
+	}
+	want := filepath.Join(t.TempDir(), "want.png")
+	for i := 1; i <= 10; i++ {
+		if i == 6 {
+			if exists(fmt.Sprintf(out, i)) {
+				t.Error("-allow-gaps: output of the missing frame was written")
+			}
+			continue
+		}
+		// フレームの間でバッファを使い回しても、1 枚ずつ apply した結果と同じ
+		if res := runCLI(t, "apply", "-in", fmt.Sprintf(pattern, i), "-out", want, "-tile", "8", "-quiet"); res.code != exitOK {
+			t.Fatalf("apply: exit code %d (stderr: %s)", res.code, res.stderr)
+		}
+		assertSameImage(t, readTestImage(t, fmt.Sprintf(out, i)), readTestImage(t, want))
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/color"
+	"io"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/yashikota/go-streaming-image-mosaic/mosaic"
+)
+
+// 横と縦のグラデーションの画像 (タイルごとに平均の色が変わる)
+func testImage(w, h int) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			img.SetNRGBA(x, y, color.NRGBA{uint8(x * 255 / max(w-1, 1)), uint8(y * 255 / max(h-1, 1)), uint8((x + y) % 256), 255})
+		}
+	}
+	return img
+}
+
+// img を format の形式でエンコードしたバイト列
+func encodeTestImage(t *testing.T, img image.Image, format string) []byte {
+	t.Helper()
+	enc, err := mosaic.LookupEncoder(format)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := enc.Encode(&buf, img, mosaic.EncodeOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// img を path の拡張子の形式で書き出す
+func writeTestImage(t *testing.T, path string, img image.Image) {
+	t.Helper()
+	name, _, err := mosaic.ResolveEncoder("", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeTestFile(t, path, encodeTestImage(t, img, name))
+}
+
+// data を path に書き出す (ディレクトリも作る)
+func writeTestFile(t *testing.T, path string, data []byte) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// path の画像をデコードする
+func readTestImage(t *testing.T, path string) *image.NRGBA {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	img, _, err := image.Decode(f)
+	if err != nil {
+		t.Fatalf("%s: %v", path, err)
+	}
+	return mosaic.ConvertToNRGBA(img)
+}
+
+// got と want の範囲と画素が同じかどうかを確かめる
+func assertSameImage(t *testing.T, got, want *image.NRGBA) {
+	t.Helper()
+	if got.Rect != want.Rect {
+		t.Fatalf("bounds %v, want %v", got.Rect, want.Rect)
+	}
+	if !bytes.Equal(got.Pix, want.Pix) {
+		for y := got.Rect.Min.Y; y < got.Rect.Max.Y; y++ {
+			for x := got.Rect.Min.X; x < got.Rect.Max.X; x++ {
+				if g, w := got.NRGBAAt(x, y), want.NRGBAAt(x, y); g != w {
+					t.Fatalf("pixel (%d, %d) = %v, want %v", x, y, g, w)
+				}
+			}
+		}
+	}
+}
+
+// CLI の結果
+type cliResult struct {
+	code           int
+	stdout, stderr string
+}
+
+// run を標準入力なしで呼び出す
+func runCLI(t *testing.T, args ...string) cliResult {
+	t.Helper()
+	var stdout, stderr bytes.Buffer
+	code := run(args, &stdout, &stderr)
+	return cliResult{code: code, stdout: stdout.String(), stderr: stderr.String()}
+}
+
+// serve のフラグ args で生成したサーバーを httptest で起動する
+func newTestServer(t *testing.T, args ...string) (*httptest.Server, *server) {
+	t.Helper()
+	f := newServeFlags(io.Discard)
+	if err := f.parse(args); err != nil {
+		t.Fatal(err)
+	}
+	s, err := f.newServer(discardLogger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(s.routes())
+	t.Cleanup(func() {
+		ts.Close()
+		s.jobs.Close(context.Background())
+	})
+	return ts, s
+}
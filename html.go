@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"html/template"
+	"image"
+	"image/jpeg"
+	"io"
+	"strings"
+
+	"github.com/yashikota/go-streaming-image-mosaic/mosaic"
+)
+
+// HTML の出力の先頭
+// 元画像はチェックボックスで重ねて表示し、JavaScript を使わずに切り替える
+var htmlHeader = template.Must(template.New("header").Parse(`<!DOCTYPE html>
+<html lang="ja">
+<head>
+<meta charset="utf-8">
+<title>{{.Name}} - mosaic</title>
+<style>
+body { margin: 16px; font-family: sans-serif; background: #fff; }
+header { margin-bottom: 8px; font-size: 14px; color: #333; }
+.mosaic { position: relative; width: {{.Width}}px; }
+.grid { display: grid; grid-template-columns: {{.Columns}}; grid-template-rows: {{.Rows}}; }
+.grid div { min-width: 0; }
+.original { display: none; position: absolute; top: 0; left: 0; }
+#show-original:checked ~ .mosaic .original { display: block; }
+</style>
+</head>
+<body>
+<header>{{.Name}}: タイル {{.Tile}}px、{{.GridColumns}}×{{.GridRows}} タイル ({{.Width}}×{{.Height}}px)</header>
+{{- if .Original}}
+<input type="checkbox" id="show-original"> <label for="show-original">元画像を表示</label>
+{{- end}}
+<div class="mosaic">
+{{- if .Original}}
+<img class="original" src="{{.Original}}" width="{{.Width}}" height="{{.Height}}" alt="{{.Name}}">
+{{- end}}
+<div class="grid">
+`))
+
+// 1 行のタイル
+// span は横に並べてまとめたタイルの数で、色が空の要素は書き換えなかったタイル
+var htmlRow = template.Must(template.New("row").Parse(
+	`{{range .}}<div style="{{if .Color}}background:{{.Color}};{{end}}grid-column:span {{.Span}}"></div>{{end}}
+`))
+
+var htmlFooter = template.Must(template.New("footer").Parse(`</div>
+</div>
+</body>
+</html>
+`))
+
+// HTML の 1 つのセル
+type htmlCell struct {
+	Color string // #RRGGBB または半透明の場合は #RRGGBBAA
+	Span  int
+}
+
+// 画像の端の列と行はタイルが小さくなるため、列と行の大きさを個別に指定する
+func writeHTMLHeader(w io.Writer, h exportHeader, grid mosaic.Grid) error {
+	columns := make([]int, grid.Columns)
+	for x := range columns {
+		columns[x] = grid.Cell(x, 0).Rect.Dx()
+	}
+	rows := make([]int, grid.Rows)
+	for y := range rows {
+		rows[y] = grid.Cell(0, y).Rect.Dy()
+	}
+	return htmlHeader.Execute(w, map[string]any{
+		"Name":        h.name,
+		"Tile":        h.tile,
+		"Width":       h.size.X,
+		"Height":      h.size.Y,
+		"GridColumns": grid.Columns,
+		"GridRows":    grid.Rows,
+		"Columns":     template.CSS(gridTracks(columns, h.tile)),
+		"Rows":        template.CSS(gridTracks(rows, h.tile)),
+		// data URI は html/template では既定で安全でないとみなされるため、自分で生成した値として渡す
+		"Original": template.URL(h.original),
+	})
+}
+
+// 列か行の大きさ sizes を並べた grid-template-columns や grid-template-rows の値
+// 続く tile の大きさの列や行は repeat でまとめる
+func gridTracks(sizes []int, tile int) string {
+	var tracks []string
+	for i := 0; i < len(sizes); {
+		if sizes[i] != tile {
+			tracks = append(tracks, fmt.Sprintf("%dpx", sizes[i]))
+			i++
+			continue
+		}
+		j := i + 1
+		for ; j < len(sizes) && sizes[j] == tile; j++ {
+		}
+		tracks = append(tracks, fmt.Sprintf("repeat(%d, %dpx)", j-i, tile))
+		i = j
+	}
+	return strings.Join(tracks, " ")
+}
+
+// 左から順に並べた 1 行のタイルを div として書き出す
+// 隣り合う同じ色のタイルは grid-column の span で 1 つにまとめる
+func (e *tileExporter) writeHTMLRow(row []mosaic.TileInfo) error {
+	var cells []htmlCell
+	for i := 0; i < len(row); {
+		t := row[i]
+		j := i + 1
+		for ; j < len(row) && row[j].Skipped == t.Skipped && row[j].Color == t.Color; j++ {
+		}
+		cell := htmlCell{Span: j - i}
+		if !t.Skipped {
+			cell.Color = fmt.Sprintf("#%02X%02X%02X", t.Color.R, t.Color.G, t.Color.B)
+			if t.Color.A != 0xff {
+				cell.Color += fmt.Sprintf("%02X", t.Color.A)
+			}
+		}
+		cells = append(cells, cell)
+		e.written += j - i
+		i = j
+	}
+	return htmlRow.Execute(e.w, cells)
+}
+
+// 画像を JPEG にエンコードした data URI
+func dataURI(img image.Image) (string, error) {
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, nil); err != nil {
+		return "", err
+	}
+	return "data:image/jpeg;base64," + base64.StdEncoding.EncodeToString(buf.Bytes()), nil
+}
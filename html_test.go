@@ -0,0 +1,116 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// HTML の出力の格子の 1 行 (div の並び) と、1 つのセルの色と span
+var (
+	htmlRowPattern  = regexp.MustCompile(`(?m)^(?:<div style="[^"]*"></div>)+$`)
+	htmlCellPattern = regexp.MustCompile(`<div style="(?:background:(#[0-9A-F]+);)?grid-column:span (\d+)"></div>`)
+)
+
+// -format html の格子の行ごとに、セルの色をタイルの数だけ並べたもの (span を展開する)
+func readHTMLGrid(t *testing.T, path string) (html string, rows [][]string) {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range htmlRowPattern.FindAllString(string(data), -1) {
+		var row []string
+		for _, m := range htmlCellPattern.FindAllStringSubmatch(line, -1) {
+			span, _ := strconv.Atoi(m[2])
+			for i := 0; i < span; i++ {
+				row = append(row, m[1])
+			}
+		}
+		rows = append(rows, row)
+	}
+	return string(data), rows
+}
+
+// 格子のセルは書き出したタイルと同じ順、同じ色で並び、隣り合う同じ色のタイルは span でまとめる
+func TestApplyHTML(t *testing.T) {
+	dir := t.TempDir()
+	uniform := image.NewNRGBA(image.Rect(0, 0, 97, 61))
+	draw.Draw(uniform, uniform.Rect, image.NewUniform(color.NRGBA{10, 200, 30, 255}), image.Point{}, draw.Src)
+
+	for _, tt := range []struct {
+		name  string
+		img   *image.NRGBA
+		cells int // div の数
+	}{
+		{"gradient", testImage(97, 61), 10 * 7},
+		{"uniform", uniform, 7}, // 1 行に 1 つ
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			in := filepath.Join(dir, tt.name+".png")
+			writeTestImage(t, in, tt.img)
+			out := filepath.Join(dir, tt.name+".html")
+			tiles := filepath.Join(dir, tt.name+".json")
+			if res := runCLI(t, "apply", "-in", in, "-out", out, "-tile", "10", "-quiet"); res.code != exitOK {
+				t.Fatalf("exit code = %d (stderr: %s)", res.code, res.stderr)
+			}
+			if res := runCLI(t, "apply", "-in", in, "-out", filepath.Join(dir, "out.png"), "-tile", "10", "-quiet", "-export-tiles", tiles); res.code != exitOK {
+				t.Fatalf("export: exit code = %d (stderr: %s)", res.code, res.stderr)
+			}
+			html, rows := readHTMLGrid(t, out)
+			// 端の列と行は小さい
+			for _, want := range []string{"grid-template-columns: repeat(9, 10px) 7px;", "grid-template-rows: repeat(6, 10px) 1px;", "10×7 タイル (97×61px)"} {
+				if !strings.Contains(html, want) {
+					t.Errorf("output does not contain %q", want)
+				}
+			}
+			if n := strings.Count(html, `grid-column:span`); n != tt.cells {
+				t.Errorf("%d cells, want %d", n, tt.cells)
+			}
+			if len(rows) != 7 {
+				t.Fatalf("%d rows, want 7", len(rows))
+			}
+			for _, tile := range readExportedTiles(t, tiles, exportJSON) {
+				row := rows[tile.GridY]
+				if len(row) != 10 {
+					t.Fatalf("row %d has %d tiles, want 10", tile.GridY, len(row))
+				}
+				if got := row[tile.GridX]; got != strings.ToUpper(tile.Hex) {
+					t.Errorf("cell (%d, %d) = %s, want %s", tile.GridX, tile.GridY, got, tile.Hex)
+				}
+			}
+			if strings.Contains(html, `class="original"`) {
+				t.Error("original image embedded without -html-original")
+			}
+		})
+	}
+}
+
+// -html-original は元画像を data URI で埋め込み、名前は HTML としてエスケープする
+func TestApplyHTMLOriginal(t *testing.T) {
+	dir := t.TempDir()
+	in := filepath.Join(dir, "a&b.png")
+	writeTestImage(t, in, testImage(32, 24))
+	out := filepath.Join(dir, "out.html")
+	if res := runCLI(t, "apply", "-in", in, "-out", out, "-tile", "8", "-quiet", "-html-original"); res.code != exitOK {
+		t.Fatalf("exit code = %d (stderr: %s)", res.code, res.stderr)
+	}
+	html, rows := readHTMLGrid(t, out)
+	for _, want := range []string{`<img class="original" src="data:image/jpeg;base64,`, `<input type="checkbox" id="show-original">`, "a&amp;b.png"} {
+		if !strings.Contains(html, want) {
+			t.Errorf("output does not contain %q", want)
+		}
+	}
+	if strings.Contains(html, "a&b.png") {
+		t.Error("name is not escaped")
+	}
+	if len(rows) != 3 || len(rows[0]) != 4 {
+		t.Errorf("grid %d rows, want 3 rows of 4", len(rows))
+	}
+}
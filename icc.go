@@ -0,0 +1,278 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"math"
+)
+
+// XYZ (D50) から線形の sRGB への変換行列
+// ICC プロファイルの接続色空間は D50 のため、Bradford 変換で D50 に合わせた sRGB の行列の逆行列を使う
+var xyzD50ToLinearSRGB = [3][3]float64{
+	{3.1338561, -1.6168667, -0.4906146},
+	{-0.9787684, 1.9161415, 0.0334540},
+	{0.0719453, -0.2289914, 1.4052427},
+}
+
+// 線形の値を sRGB の値に戻す表の分割数
+const srgbEncodeSteps = 4096
+
+// 埋め込まれた ICC プロファイルを取り出す (JPEG の APP2 と PNG の iCCP)
+// header は画像の先頭部分で、プロファイルがないか途中で切れている場合は nil を返却
+func embeddedICCProfile(header []byte) []byte {
+	switch {
+	case bytes.HasPrefix(header, []byte{0xff, 0xd8}):
+		return jpegICCProfile(header)
+	case bytes.HasPrefix(header, []byte("\x89PNG\r\n\x1a\n")):
+		return pngICCProfile(header)
+	}
+	return nil
+}
+
+// JPEG の APP2 セグメントに分割して埋め込まれたプロファイルをつなげる
+func jpegICCProfile(data []byte) []byte {
+	const signature = "ICC_PROFILE\x00"
+	var chunks [][]byte
+	walkJPEGSegments(data, func(marker byte, segment []byte) bool {
+		if marker != 0xe2 || len(segment) < len(signature)+2 || string(segment[:len(signature)]) != signature {
+			return true
+		}
+		// 続く 2 バイトは 1 から数えたチャンクの番号とチャンクの数
+		seq, count := int(segment[len(signature)]), int(segment[len(signature)+1])
+		if chunks == nil {
+			chunks = make([][]byte, count)
+		}
+		if seq < 1 || seq > len(chunks) || count != len(chunks) {
+			chunks = nil
+			return false
+		}
+		chunks[seq-1] = segment[len(signature)+2:]
+		return true
+	})
+	var profile []byte
+	for _, chunk := range chunks {
+		if chunk == nil {
+			return nil
+		}
+		profile = append(profile, chunk...)
+	}
+	return profile
+}
+
+// PNG の iCCP チャンクのプロファイルを展開
+func pngICCProfile(data []byte) []byte {
+	for i := 8; i+8 <= len(data); {
+		length := int(binary.BigEndian.Uint32(data[i:]))
+		typ := string(data[i+4 : i+8])
+		end := i + 8 + length + 4
+		if length < 0 || end > len(data) || typ == "IDAT" {
+			return nil
+		}
+		if typ == "iCCP" {
+			// プロファイル名、NUL、圧縮方式 (0 のみ) に続いて zlib で圧縮したプロファイル
+			chunk := data[i+8 : i+8+length]
+			name := bytes.IndexByte(chunk, 0)
+			if name < 0 || name+2 > len(chunk) || chunk[name+1] != 0 {
+				return nil
+			}
+			zr, err := zlib.NewReader(bytes.NewReader(chunk[name+2:]))
+			if err != nil {
+				return nil
+			}
+			defer zr.Close()
+			profile, err := io.ReadAll(zr)
+			if err != nil {
+				return nil
+			}
+			return profile
+		}
+		i = end
+	}
+	return nil
+}
+
+// 対応していないプロファイルを表すエラー
+type unsupportedProfileError struct {
+	reason string
+}
+
+func (e *unsupportedProfileError) Error() string {
+	return "unsupported ICC profile: " + e.reason
+}
+
+// マトリックスとトーンカーブによる RGB から sRGB への変換
+type iccTransform struct {
+	linear [3][256]float64 // 入力の値を線形の値にする表
+	matrix [3][3]float64   // 線形の入力の RGB から線形の sRGB への行列
+	encode [srgbEncodeSteps + 1]uint8
+}
+
+// マトリックスと TRC (トーンカーブ) を持つ RGB のプロファイルを解析し、sRGB への変換を生成
+// LUT (A2B0 など) だけで変換を表すプロファイルやグレースケール、CMYK のプロファイルには対応しない
+func parseICCProfile(profile []byte) (*iccTransform, error) {
+	if len(profile) < 132 {
+		return nil, errors.New("ICC profile is too short")
+	}
+	if space := string(profile[16:20]); space != "RGB " {
+		return nil, &unsupportedProfileError{fmt.Sprintf("color space %q", space)}
+	}
+	tags := map[string][]byte{}
+	count := int(binary.BigEndian.Uint32(profile[128:]))
+	for i := 0; i < count; i++ {
+		entry := 132 + 12*i
+		if entry+12 > len(profile) {
+			return nil, errors.New("ICC profile tag table is truncated")
+		}
+		offset := int64(binary.BigEndian.Uint32(profile[entry+4:]))
+		size := int64(binary.BigEndian.Uint32(profile[entry+8:]))
+		if offset+size > int64(len(profile)) {
+			return nil, errors.New("ICC profile tag is out of range")
+		}
+		tags[string(profile[entry:entry+4])] = profile[offset : offset+size]
+	}
+
+	t := &iccTransform{}
+	var colorants [3][3]float64
+	for c, name := range [3]string{"r", "g", "b"} {
+		xyz, ok := tags[name+"XYZ"]
+		trc, ok2 := tags[name+"TRC"]
+		if !ok || !ok2 {
+			if _, lut := tags["A2B0"]; lut {
+				return nil, &unsupportedProfileError{"LUT-based profile without a matrix and tone curves"}
+			}
+			return nil, &unsupportedProfileError{"missing colorant or tone curve tags"}
+		}
+		if len(xyz) < 20 || string(xyz[:4]) != "XYZ " {
+			return nil, fmt.Errorf("invalid %sXYZ tag", name)
+		}
+		for i := 0; i < 3; i++ {
+			colorants[i][c] = s15Fixed16(xyz[8+4*i:])
+		}
+		curve, err := parseToneCurve(trc)
+		if err != nil {
+			return nil, fmt.Errorf("%sTRC: %w", name, err)
+		}
+		for v := range t.linear[c] {
+			t.linear[c][v] = curve(float64(v) / 255)
+		}
+	}
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 3; j++ {
+			for k := 0; k < 3; k++ {
+				t.matrix[i][j] += xyzD50ToLinearSRGB[i][k] * colorants[k][j]
+			}
+		}
+	}
+	for i := range t.encode {
+		t.encode[i] = uint8(math.Round(encodeSRGB(float64(i)/srgbEncodeSteps) * 255))
+	}
+	return t, nil
+}
+
+// s15Fixed16Number の値
+func s15Fixed16(b []byte) float64 {
+	return float64(int32(binary.BigEndian.Uint32(b))) / 65536
+}
+
+// curv または para のタグのトーンカーブ (0〜1 の値を線形の値にする関数)
+func parseToneCurve(tag []byte) (func(float64) float64, error) {
+	if len(tag) < 12 {
+		return nil, errors.New("tone curve is too short")
+	}
+	switch string(tag[:4]) {
+	case "curv":
+		n := int(binary.BigEndian.Uint32(tag[8:]))
+		if len(tag) < 12+2*n {
+			return nil, errors.New("tone curve is truncated")
+		}
+		switch n {
+		case 0:
+			return func(x float64) float64 { return x }, nil
+		case 1:
+			gamma := float64(binary.BigEndian.Uint16(tag[12:])) / 256
+			return func(x float64) float64 { return math.Pow(x, gamma) }, nil
+		}
+		table := make([]float64, n)
+		for i := range table {
+			table[i] = float64(binary.BigEndian.Uint16(tag[12+2*i:])) / 65535
+		}
+		return func(x float64) float64 {
+			pos := x * float64(n-1)
+			i := min(int(pos), n-2)
+			return table[i] + (table[i+1]-table[i])*(pos-float64(i))
+		}, nil
+	case "para":
+		// 関数の種類ごとのパラメーターの数
+		counts := [5]int{1, 3, 4, 5, 7}
+		fn := int(binary.BigEndian.Uint16(tag[8:]))
+		if fn >= len(counts) || len(tag) < 12+4*counts[fn] {
+			return nil, fmt.Errorf("unknown parametric curve type %d", fn)
+		}
+		var p [7]float64
+		for i := 0; i < counts[fn]; i++ {
+			p[i] = s15Fixed16(tag[12+4*i:])
+		}
+		g, a, b, c, d, e, f := p[0], p[1], p[2], p[3], p[4], p[5], p[6]
+		switch fn {
+		case 0:
+			return func(x float64) float64 { return math.Pow(x, g) }, nil
+		case 1:
+			return func(x float64) float64 {
+				if x >= -b/a {
+					return math.Pow(a*x+b, g)
+				}
+				return 0
+			}, nil
+		case 2:
+			return func(x float64) float64 {
+				if x >= -b/a {
+					return math.Pow(a*x+b, g) + c
+				}
+				return c
+			}, nil
+		case 3:
+			return func(x float64) float64 {
+				if x >= d {
+					return math.Pow(a*x+b, g)
+				}
+				return c * x
+			}, nil
+		}
+		return func(x float64) float64 {
+			if x >= d {
+				return math.Pow(a*x+b, g) + e
+			}
+			return c*x + f
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown tone curve type %q", tag[:4])
+}
+
+// 線形の値を sRGB のトーンカーブで 0〜1 の値にする
+func encodeSRGB(v float64) float64 {
+	if v <= 0.0031308 {
+		return 12.92 * v
+	}
+	return 1.055*math.Pow(v, 1/2.4) - 0.055
+}
+
+// img の色をその場で sRGB に変換する (アルファはそのまま)
+// sRGB の範囲外の色は範囲内に切り詰める
+func (t *iccTransform) apply(img *image.NRGBA) {
+	size := img.Rect.Size()
+	for y := 0; y < size.Y; y++ {
+		row := img.Pix[y*img.Stride : y*img.Stride+4*size.X]
+		for i := 0; i < len(row); i += 4 {
+			r, g, b := t.linear[0][row[i]], t.linear[1][row[i+1]], t.linear[2][row[i+2]]
+			for c := 0; c < 3; c++ {
+				v := t.matrix[c][0]*r + t.matrix[c][1]*g + t.matrix[c][2]*b
+				row[i+c] = t.encode[int(math.Round(min(max(v, 0), 1)*srgbEncodeSteps))]
+			}
+		}
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"math"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Display P3 の D50 に合わせた原色 (Apple の Display P3 プロファイルの rXYZ、gXYZ、bXYZ)
+var displayP3Colorants = [3][3]float64{
+	{0.515102, 0.241182, -0.001050},
+	{0.291965, 0.692236, 0.041882},
+	{0.157153, 0.066574, 0.784073},
+}
+
+// 原色 colorants と sRGB と同じトーンカーブ (para の種類 3) を持つ RGB のプロファイル
+// lut の場合は原色とトーンカーブの代わりに A2B0 だけを持つ
+func testICCProfile(colorants [3][3]float64, lut bool) []byte {
+	fixed := func(v float64) []byte {
+		return binary.BigEndian.AppendUint32(nil, uint32(int32(math.Round(v*65536))))
+	}
+	type tag struct {
+		sig  string
+		data []byte
+	}
+	var tags []tag
+	if lut {
+		tags = append(tags, tag{"A2B0", append([]byte("mft2"), make([]byte, 48)...)})
+	} else {
+		trc := append([]byte("para\x00\x00\x00\x00\x00\x03\x00\x00"), fixed(2.4)...)
+		for _, v := range []float64{1 / 1.055, 0.055 / 1.055, 1 / 12.92, 0.04045} {
+			trc = append(trc, fixed(v)...)
+		}
+		for i, name := range []string{"r", "g", "b"} {
+			xyz := []byte("XYZ \x00\x00\x00\x00")
+			for _, v := range colorants[i] {
+				xyz = append(xyz, fixed(v)...)
+			}
+			tags = append(tags, tag{name + "XYZ", xyz}, tag{name + "TRC", trc})
+		}
+	}
+
+	header := make([]byte, 128)
+	copy(header[12:], "mntr")
+	copy(header[16:], "RGB ")
+	copy(header[20:], "XYZ ")
+	copy(header[36:], "acsp")
+	table := binary.BigEndian.AppendUint32(nil, uint32(len(tags)))
+	offset := 128 + 4 + 12*len(tags)
+	var data []byte
+	for _, t := range tags {
+		table = append(table, t.sig...)
+		table = binary.BigEndian.AppendUint32(table, uint32(offset+len(data)))
+		table = binary.BigEndian.AppendUint32(table, uint32(len(t.data)))
+		data = append(data, t.data...)
+		for len(data)%4 != 0 {
+			data = append(data, 0)
+		}
+	}
+	profile := append(append(header, table...), data...)
+	binary.BigEndian.PutUint32(profile, uint32(len(profile)))
+	return profile
+}
+
+// PNG の IHDR の直後に iCCP チャンクを入れる
+func withPNGProfile(png, profile []byte) []byte {
+	var z bytes.Buffer
+	zw := zlib.NewWriter(&z)
+	zw.Write(profile)
+	zw.Close()
+	body := append([]byte("iCCP"), "Display P3\x00\x00"...)
+	body = append(body, z.Bytes()...)
+	chunk := binary.BigEndian.AppendUint32(nil, uint32(len(body)-4))
+	chunk = append(chunk, body...)
+	chunk = binary.BigEndian.AppendUint32(chunk, crc32.ChecksumIEEE(body))
+	const ihdrEnd = 8 + 8 + 13 + 4
+	return append(append(append([]byte(nil), png[:ihdrEnd]...), chunk...), png[ihdrEnd:]...)
+}
+
+// JPEG の SOI の直後に APP2 セグメントを入れる
+func withJPEGProfile(jpeg, profile []byte) []byte {
+	segment := append([]byte("ICC_PROFILE\x00\x01\x01"), profile...)
+	app2 := binary.BigEndian.AppendUint16([]byte{0xff, 0xe2}, uint16(len(segment)+2))
+	return append(append(append([]byte(nil), jpeg[:2]...), append(app2, segment...)...), jpeg[2:]...)
+}
+
+// 単色の画像
+func flatImage(w, h int, c color.NRGBA) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for i := 0; i < len(img.Pix); i += 4 {
+		copy(img.Pix[i:], []uint8{c.R, c.G, c.B, c.A})
+	}
+	return img
+}
+
+// Display P3 の赤のパッチは、sRGB の既知の色に変換してから処理する
+func TestConvertSRGBDisplayP3(t *testing.T) {
+	profile := testICCProfile(displayP3Colorants, false)
+	dir := t.TempDir()
+	tests := []struct {
+		name  string
+		patch color.NRGBA
+		want  color.NRGBA // Display P3 から sRGB への線形の行列で求めた値
+	}{
+		// sRGB の範囲内の赤
+		{"red", color.NRGBA{204, 51, 51, 255}, color.NRGBA{222, 24, 41, 255}},
+		// P3 の最も彩度の高い赤は sRGB の範囲外のため、sRGB の赤に切り詰める
+		{"primary", color.NRGBA{255, 0, 0, 255}, color.NRGBA{255, 0, 0, 255}},
+		{"white", color.NRGBA{255, 255, 255, 255}, color.NRGBA{255, 255, 255, 255}},
+	}
+	for _, tt := range tests {
+		for _, format := range []string{"png", "jpeg"} {
+			src := flatImage(16, 16, tt.patch)
+			data := encodeTestImage(t, src, format)
+			if format == "png" {
+				data = withPNGProfile(data, profile)
+			} else {
+				data = withJPEGProfile(data, profile)
+			}
+			in := filepath.Join(dir, tt.name+"."+format)
+			writeTestFile(t, in, data)
+			if got := embeddedICCProfile(data); !bytes.Equal(got, profile) {
+				t.Fatalf("%s %s: embedded profile not found", tt.name, format)
+			}
+
+			out := filepath.Join(dir, "out.png")
+			if res := runCLI(t, "apply", "-in", in, "-out", out, "-tile", "16", "-convert-srgb", "-quiet"); res.code != exitOK {
+				t.Fatalf("exit code = %d (stderr: %s)", res.code, res.stderr)
+			}
+			// JPEG は色の誤差があるため許容範囲を広げる
+			tolerance := uint8(2)
+			if format == "jpeg" {
+				tolerance = 4
+			}
+			got := readTestImage(t, out).NRGBAAt(8, 8)
+			if absDiff(got.R, tt.want.R) > tolerance || absDiff(got.G, tt.want.G) > tolerance || absDiff(got.B, tt.want.B) > tolerance {
+				t.Errorf("%s %s: %v, want %v within %d", tt.name, format, got, tt.want, tolerance)
+			}
+		}
+	}
+
+	// -convert-srgb を指定しない場合はバイトの値のまま平均する
+	in := filepath.Join(dir, "red.png")
+	out := filepath.Join(dir, "out.png")
+	if res := runCLI(t, "apply", "-in", in, "-out", out, "-tile", "16", "-quiet"); res.code != exitOK {
+		t.Fatalf("exit code = %d (stderr: %s)", res.code, res.stderr)
+	}
+	if got := readTestImage(t, out).NRGBAAt(8, 8); got != (color.NRGBA{204, 51, 51, 255}) {
+		t.Errorf("without -convert-srgb: %v", got)
+	}
+}
+
+// LUT だけのプロファイルは警告して変換せずに処理する
+func TestConvertSRGBUnsupportedProfile(t *testing.T) {
+	dir := t.TempDir()
+	patch := color.NRGBA{204, 51, 51, 255}
+	in := filepath.Join(dir, "lut.png")
+	writeTestFile(t, in, withPNGProfile(encodeTestImage(t, flatImage(8, 8, patch), "png"), testICCProfile(displayP3Colorants, true)))
+	out := filepath.Join(dir, "out.png")
+	res := runCLI(t, "apply", "-in", in, "-out", out, "-tile", "8", "-convert-srgb")
+	if res.code != exitOK {
+		t.Fatalf("exit code = %d (stderr: %s)", res.code, res.stderr)
+	}
+	if !strings.Contains(res.stderr, "colors are not converted to sRGB") || !strings.Contains(res.stderr, "LUT-based profile") {
+		t.Errorf("stderr does not warn about the LUT profile: %s", res.stderr)
+	}
+	if got := readTestImage(t, out).NRGBAAt(0, 0); got != patch {
+		t.Errorf("pixel %v, want unconverted %v", got, patch)
+	}
+}
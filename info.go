@@ -0,0 +1,414 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"os"
+
+	"github.com/yashikota/go-streaming-image-mosaic/mosaic"
+)
+
+// 画像の情報を得るために読み込む先頭部分の最大サイズ
+const infoHeaderLimit = 1 << 20
+
+// 画像ファイルの情報
+type imageInfo struct {
+	Path         string `json:"path"`
+	Format       string `json:"format,omitempty"`
+	Width        int    `json:"width,omitempty"`
+	Height       int    `json:"height,omitempty"`
+	ColorModel   string `json:"color_model,omitempty"`
+	Alpha        bool   `json:"alpha"`
+	Orientation  int    `json:"orientation,omitempty"`   // EXIF の Orientation (なければ 0)
+	DecodedBytes int64  `json:"decoded_bytes,omitempty"` // デコード直後の画像のおおよそのサイズ
+	NRGBABytes   int64  `json:"nrgba_bytes,omitempty"`   // 処理のために NRGBA に変換した画像のサイズ
+	Tile         int    `json:"tile,omitempty"`
+	TileColumns  int    `json:"tile_columns,omitempty"`
+	TileRows     int    `json:"tile_rows,omitempty"`
+	Bands        int    `json:"bands,omitempty"`
+	Error        string `json:"error,omitempty"`
+}
+
+// info のフラグ
+type infoFlags struct {
+	*commonFlags
+	json *bool
+}
+
+func newInfoFlags(stderr io.Writer) *infoFlags {
+	c := newCommonFlags("info", "[flags] path...", stderr)
+	return &infoFlags{
+		commonFlags: c,
+		json:        c.fs.Bool("json", false, "JSON 形式で出力する"),
+	}
+}
+
+// 画像をデコードせずに、形式や大きさ、タイルの分割数を表示する
+// 読み込めないファイルがあっても残りのファイルの表示を続ける
+func runInfo(args []string, stdout, stderr io.Writer) error {
+	f := newInfoFlags(stderr)
+	if err := f.parse(args); err != nil {
+		return err
+	}
+	paths := f.fs.Args()
+	if len(paths) == 0 {
+		return &usageError{errors.New("no input files")}
+	}
+
+	infos := make([]imageInfo, 0, len(paths))
+	failed := 0
+	for _, path := range paths {
+		info, err := readImageInfo(path, *f.tile, image.Pt(f.settings.GridOrigin[0], f.settings.GridOrigin[1]))
+		if err != nil {
+			failed++
+			info.Error = err.Error()
+			fmt.Fprintf(stderr, "%s: %v\n", progName, err)
+		}
+		infos = append(infos, info)
+	}
+
+	if *f.json {
+		enc := json.NewEncoder(stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(infos); err != nil {
+			return err
+		}
+	} else {
+		for _, info := range infos {
+			if info.Error == "" {
+				printImageInfo(stdout, info)
+			}
+		}
+	}
+
+	if failed > 0 {
+		return &partialError{failed: failed, total: len(paths)}
+	}
+	return nil
+}
+
+// 画像ファイルの先頭部分だけを読み込み、情報を取得
+// タイルの格子は origin を通る (apply の -grid-origin と同じ)
+func readImageInfo(path string, tile int, origin image.Point) (imageInfo, error) {
+	info := imageInfo{Path: path}
+	file, err := os.Open(path)
+	if err != nil {
+		return info, &inputError{path: path, err: err}
+	}
+	defer file.Close()
+
+	header, err := io.ReadAll(io.LimitReader(file, infoHeaderLimit))
+	if err != nil {
+		return info, &inputError{path: path, err: err}
+	}
+	config, format, err := mosaic.DecodeConfig(bytes.NewReader(header))
+	if err != nil {
+		return info, fmt.Errorf("%s: %w", path, &stageError{stage: stageDecode, err: err})
+	}
+
+	info.Format = format
+	info.Width, info.Height = config.Width, config.Height
+	info.ColorModel = colorModelName(config.ColorModel)
+	if format == "png" {
+		info.Alpha = pngHasAlpha(header)
+	} else {
+		info.Alpha = hasAlpha(config.ColorModel)
+	}
+	pixels := int64(config.Width) * int64(config.Height)
+	info.NRGBABytes = pixels * 4
+
+	if format == "jpeg" {
+		subsampling, orientation := scanJPEG(header)
+		if subsampling != "" {
+			info.ColorModel += " " + subsampling
+		}
+		info.Orientation = orientation
+	}
+	info.DecodedBytes = decodedBytes(config, format, header)
+
+	info.Tile = tile
+	grid := mosaic.NewGrid(image.Rect(0, 0, config.Width, config.Height), tile, tile, origin)
+	info.TileColumns, info.TileRows = grid.Columns, grid.Rows
+	info.Bands = info.TileRows
+	return info, nil
+}
+
+// 画像の情報を人が読む形式で出力
+func printImageInfo(w io.Writer, info imageInfo) {
+	fmt.Fprintf(w, "%s\n", info.Path)
+	fmt.Fprintf(w, "  format:      %s\n", info.Format)
+	fmt.Fprintf(w, "  dimensions:  %dx%d\n", info.Width, info.Height)
+	fmt.Fprintf(w, "  color model: %s\n", info.ColorModel)
+	fmt.Fprintf(w, "  alpha:       %t\n", info.Alpha)
+	if info.Orientation != 0 {
+		fmt.Fprintf(w, "  orientation: %d\n", info.Orientation)
+	}
+	fmt.Fprintf(w, "  memory:      %s decoded, %s as NRGBA\n", formatBytes(info.DecodedBytes), formatBytes(info.NRGBABytes))
+	fmt.Fprintf(w, "  tile grid:   %dx%d (tile %dpx), %d bands\n", info.TileColumns, info.TileRows, info.Tile, info.Bands)
+}
+
+// バイト数を読みやすい単位で表す
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// カラーモデルの名前
+func colorModelName(m color.Model) string {
+	switch m {
+	case color.YCbCrModel:
+		return "YCbCr"
+	case color.NYCbCrAModel:
+		return "NYCbCrA"
+	case color.CMYKModel:
+		return "CMYK"
+	case color.GrayModel:
+		return "Gray"
+	case color.Gray16Model:
+		return "Gray16"
+	case color.RGBAModel:
+		return "RGBA"
+	case color.RGBA64Model:
+		return "RGBA64"
+	case color.NRGBAModel:
+		return "NRGBA"
+	case color.NRGBA64Model:
+		return "NRGBA64"
+	case color.AlphaModel:
+		return "Alpha"
+	case color.Alpha16Model:
+		return "Alpha16"
+	}
+	if p, ok := m.(color.Palette); ok {
+		return fmt.Sprintf("Paletted (%d colors)", len(p))
+	}
+	return fmt.Sprintf("%T", m)
+}
+
+// カラーモデルが透明度を持つかどうか
+// RGBA と RGBA64 は不透明な RGB の画像にもデコーダーが返すため、透明度を持つとはみなさない
+func hasAlpha(m color.Model) bool {
+	switch m {
+	case color.NRGBAModel, color.NRGBA64Model, color.AlphaModel, color.Alpha16Model, color.NYCbCrAModel:
+		return true
+	}
+	if p, ok := m.(color.Palette); ok {
+		for _, c := range p {
+			if _, _, _, a := c.RGBA(); a != 0xffff {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// PNG の先頭部分 header から透明度を持つかどうかを判定
+// IHDR の色の種類が透明度付きのグレースケール (4) か RGBA (6) の場合と、IDAT より前に tRNS がある場合に透明度を持つ
+func pngHasAlpha(header []byte) bool {
+	const signatureLen = 8
+	if len(header) < signatureLen+8+13 || string(header[signatureLen+4:signatureLen+8]) != "IHDR" {
+		return false
+	}
+	if colorType := header[signatureLen+8+9]; colorType == 4 || colorType == 6 {
+		return true
+	}
+	for data := header[signatureLen:]; len(data) >= 8; {
+		length := int64(binary.BigEndian.Uint32(data))
+		switch string(data[4:8]) {
+		case "tRNS":
+			return true
+		case "IDAT":
+			return false
+		}
+		if 12+length > int64(len(data)) {
+			break
+		}
+		data = data[12+length:]
+	}
+	return false
+}
+
+// デコーダーが返す画像のバイト数
+// JPEG は先頭部分 header のサブサンプリングから求める
+func decodedBytes(config image.Config, format string, header []byte) int64 {
+	pixels := int64(config.Width) * int64(config.Height)
+	if format == "jpeg" {
+		subsampling, _ := scanJPEG(header)
+		return pixels * jpegBytesPerPixel[subsampling] / 2
+	}
+	return pixels * bytesPerPixel(config.ColorModel)
+}
+
+// カラーモデルごとの 1 画素あたりのバイト数
+func bytesPerPixel(m color.Model) int64 {
+	switch m {
+	case color.GrayModel, color.AlphaModel:
+		return 1
+	case color.Gray16Model, color.Alpha16Model:
+		return 2
+	case color.RGBA64Model, color.NRGBA64Model:
+		return 8
+	}
+	if _, ok := m.(color.Palette); ok {
+		return 1
+	}
+	return 4
+}
+
+// JPEG のサブサンプリングごとの 1 画素あたりのバイト数 (2 倍した値)
+var jpegBytesPerPixel = map[string]int64{
+	"":      8, // 不明な場合は CMYK と同じとみなす
+	"4:4:4": 6,
+	"4:4:0": 4,
+	"4:2:2": 4,
+	"4:2:0": 3,
+	"4:1:1": 3,
+	"gray":  2,
+}
+
+// JPEG のマーカーを走査し、サブサンプリングと EXIF の Orientation を取得
+func scanJPEG(data []byte) (subsampling string, orientation int) {
+	walkJPEGSegments(data, func(marker byte, segment []byte) bool {
+		switch {
+		case marker == 0xe1:
+			if o := exifOrientation(segment); o != 0 {
+				orientation = o
+			}
+		case isSOF(marker):
+			subsampling = sofSubsampling(segment)
+		}
+		return true
+	})
+	return subsampling, orientation
+}
+
+// JPEG の先頭部分 header の SOF がプログレッシブ (または算術符号のプログレッシブ) かどうか
+func progressiveJPEG(header []byte) bool {
+	progressive := false
+	walkJPEGSegments(header, func(marker byte, segment []byte) bool {
+		if !isSOF(marker) {
+			return true
+		}
+		progressive = marker == 0xc2 || marker == 0xc6 || marker == 0xca || marker == 0xce
+		return false
+	})
+	return progressive
+}
+
+// JPEG のヘッダーのセグメントを順に fn に渡す
+// 画像データの開始 (SOS) に達するか、data が途中で切れているか、fn が false を返した時点で止める
+func walkJPEGSegments(data []byte, fn func(marker byte, segment []byte) bool) {
+	if len(data) < 2 || data[0] != 0xff || data[1] != 0xd8 {
+		return
+	}
+	for i := 2; i+4 <= len(data); {
+		if data[i] != 0xff {
+			return
+		}
+		marker := data[i+1]
+		if marker == 0xff {
+			i++
+			continue
+		}
+		if marker == 0xd8 || marker == 0x01 || (marker >= 0xd0 && marker <= 0xd7) {
+			i += 2
+			continue
+		}
+		if marker == 0xda {
+			// 画像データの開始以降にはヘッダーがない
+			return
+		}
+		length := int(binary.BigEndian.Uint16(data[i+2:]))
+		end := i + 2 + length
+		if length < 2 || end > len(data) {
+			return
+		}
+		if !fn(marker, data[i+4:end]) {
+			return
+		}
+		i = end
+	}
+}
+
+// フレームの開始を表すマーカーかどうか
+func isSOF(marker byte) bool {
+	return marker >= 0xc0 && marker <= 0xcf && marker != 0xc4 && marker != 0xc8 && marker != 0xcc
+}
+
+// SOF セグメントのサンプリング係数からサブサンプリングを判定
+func sofSubsampling(seg []byte) string {
+	if len(seg) < 6 {
+		return ""
+	}
+	n := int(seg[5])
+	if n == 1 {
+		return "gray"
+	}
+	if n != 3 || len(seg) < 6+3*n {
+		return ""
+	}
+	yh, yv := int(seg[7]>>4), int(seg[7]&0x0f)
+	ch, cv := int(seg[10]>>4), int(seg[10]&0x0f)
+	if ch == 0 || cv == 0 {
+		return ""
+	}
+	switch [2]int{yh / ch, yv / cv} {
+	case [2]int{1, 1}:
+		return "4:4:4"
+	case [2]int{1, 2}:
+		return "4:4:0"
+	case [2]int{2, 1}:
+		return "4:2:2"
+	case [2]int{2, 2}:
+		return "4:2:0"
+	case [2]int{4, 1}:
+		return "4:1:1"
+	}
+	return ""
+}
+
+// APP1 セグメントの EXIF から Orientation を取得 (なければ 0)
+func exifOrientation(seg []byte) int {
+	if len(seg) < 14 || string(seg[:6]) != "Exif\x00\x00" {
+		return 0
+	}
+	tiff := seg[6:]
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 0
+	}
+	offset := int(order.Uint32(tiff[4:]))
+	if offset+2 > len(tiff) {
+		return 0
+	}
+	count := int(order.Uint16(tiff[offset:]))
+	for i := 0; i < count; i++ {
+		entry := offset + 2 + i*12
+		if entry+12 > len(tiff) {
+			return 0
+		}
+		if order.Uint16(tiff[entry:]) == 0x0112 {
+			return int(order.Uint16(tiff[entry+8:]))
+		}
+	}
+	return 0
+}
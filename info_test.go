@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"path/filepath"
+	"testing"
+)
+
+// PNG の IHDR の直後に chunk を挿入する
+func insertPNGChunk(data []byte, typ string, body []byte) []byte {
+	const afterIHDR = 8 + 8 + 13 + 4
+	chunk := binary.BigEndian.AppendUint32(nil, uint32(len(body)))
+	chunk = append(chunk, typ...)
+	chunk = append(chunk, body...)
+	chunk = binary.BigEndian.AppendUint32(chunk, crc32.ChecksumIEEE(chunk[4:]))
+	return append(append(append([]byte{}, data[:afterIHDR]...), chunk...), data[afterIHDR:]...)
+}
+
+func TestInfoAlpha(t *testing.T) {
+	dir := t.TempDir()
+	opaque := testImage(16, 8)
+	translucent := testImage(16, 8)
+	translucent.SetNRGBA(3, 3, color.NRGBA{10, 20, 30, 128})
+	gray := image.NewGray(image.Rect(0, 0, 8, 8))
+	paletted := image.NewPaletted(image.Rect(0, 0, 8, 8), color.Palette{color.NRGBA{0, 0, 0, 255}, color.NRGBA{0, 0, 0, 0}})
+	rgb := encodeTestImage(t, opaque, "png")
+
+	files := []struct {
+		name  string
+		data  []byte
+		alpha bool
+	}{
+		{"rgb.png", rgb, false},
+		{"rgba.png", encodeTestImage(t, translucent, "png"), true},
+		{"gray.png", encodeTestImage(t, gray, "png"), false},
+		{"paletted.png", encodeTestImage(t, paletted, "png"), true},
+		{"rgb-trns.png", insertPNGChunk(rgb, "tRNS", []byte{0, 1, 0, 2, 0, 3}), true},
+		{"photo.jpg", encodeTestImage(t, opaque, "jpeg"), false},
+	}
+	for _, f := range files {
+		path := filepath.Join(dir, f.name)
+		writeTestFile(t, path, f.data)
+		info, err := readImageInfo(path, 4, image.Point{})
+		if err != nil {
+			t.Fatalf("%s: %v", f.name, err)
+		}
+		if info.Alpha != f.alpha {
+			t.Errorf("%s: alpha = %v, want %v (color model %s)", f.name, info.Alpha, f.alpha, info.ColorModel)
+		}
+	}
+}
+
+func TestInfoMultiplePaths(t *testing.T) {
+	dir := t.TempDir()
+	good := filepath.Join(dir, "good.png")
+	writeTestImage(t, good, testImage(30, 20))
+	broken := filepath.Join(dir, "broken.png")
+	writeTestFile(t, broken, []byte("not an image"))
+	missing := filepath.Join(dir, "missing.png")
+
+	res := runCLI(t, "info", "-json", "-tile", "8", good, broken, missing)
+	if res.code != exitPartial {
+		t.Fatalf("exit code = %d, want %d", res.code, exitPartial)
+	}
+	var infos []imageInfo
+	if err := json.Unmarshal([]byte(res.stdout), &infos); err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != 3 {
+		t.Fatalf("%d records, want 3", len(infos))
+	}
+	if got := infos[0]; got.Error != "" || got.Format != "png" || got.Width != 30 || got.TileColumns != 4 || got.TileRows != 3 || got.Bands != 3 {
+		t.Errorf("good.png: %+v", got)
+	}
+	for _, info := range infos[1:] {
+		if info.Error == "" || !bytes.Contains([]byte(res.stderr), []byte(info.Path)) {
+			t.Errorf("%s: error %q not reported (stderr: %s)", info.Path, info.Error, res.stderr)
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package gifstream
+
+import (
+	"image"
+	"image/color"
+	"slices"
+)
+
+// パレットを作る際に使う画素の数の上限
+// 大きな画像は間引いて使う
+const maxSamples = 1 << 16
+
+// Quantize で番号を覚えておく色の数の上限
+const maxCache = 1 << 16
+
+// img の色から n 色 (1〜256) のパレットをメディアンカットで作る
+// 色の範囲が最も広い箱を、その範囲が最も広い成分の中央値で分けることを繰り返し、箱ごとの平均色をパレットにする
+// 透明度は無視する。結果は img だけから決まる
+func MedianCut(img *image.NRGBA, n int) color.Palette {
+	n = min(max(n, 1), 256)
+	pixels := img.Rect.Dx() * img.Rect.Dy()
+	step := max(1, pixels/maxSamples)
+	samples := make([][3]uint8, 0, min(pixels, maxSamples+1))
+	for i := 0; i < pixels; i += step {
+		x, y := img.Rect.Min.X+i%img.Rect.Dx(), img.Rect.Min.Y+i/img.Rect.Dx()
+		c := img.NRGBAAt(x, y)
+		samples = append(samples, [3]uint8{c.R, c.G, c.B})
+	}
+	if len(samples) == 0 {
+		return color.Palette{color.NRGBA{0, 0, 0, 255}}
+	}
+
+	boxes := [][][3]uint8{samples}
+	for len(boxes) < n {
+		// 範囲が最も広い箱を選ぶ (1 色だけの箱は分けられない)
+		best, bestChannel, bestRange := -1, 0, 0
+		for i, box := range boxes {
+			if ch, r := widestChannel(box); r > bestRange {
+				best, bestChannel, bestRange = i, ch, r
+			}
+		}
+		if best < 0 {
+			break
+		}
+		box := boxes[best]
+		slices.SortFunc(box, func(a, b [3]uint8) int { return int(a[bestChannel]) - int(b[bestChannel]) })
+		mid := len(box) / 2
+		// 中央値と同じ値の画素が同じ箱に入るよう、境界を値の変わる位置にずらす
+		for mid > 0 && box[mid-1][bestChannel] == box[mid][bestChannel] {
+			mid--
+		}
+		if mid == 0 {
+			for mid < len(box) && box[mid][bestChannel] == box[0][bestChannel] {
+				mid++
+			}
+		}
+		boxes[best] = box[:mid:mid]
+		boxes = append(boxes, box[mid:])
+	}
+
+	palette := make(color.Palette, len(boxes))
+	for i, box := range boxes {
+		var r, g, b int
+		for _, c := range box {
+			r += int(c[0])
+			g += int(c[1])
+			b += int(c[2])
+		}
+		n := len(box)
+		palette[i] = color.NRGBA{uint8((r + n/2) / n), uint8((g + n/2) / n), uint8((b + n/2) / n), 255}
+	}
+	return palette
+}
+
+// 値の範囲が最も広い成分と、その範囲
+func widestChannel(box [][3]uint8) (channel, width int) {
+	lo := [3]uint8{255, 255, 255}
+	var hi [3]uint8
+	for _, c := range box {
+		for i := range c {
+			lo[i] = min(lo[i], c[i])
+			hi[i] = max(hi[i], c[i])
+		}
+	}
+	for i := range lo {
+		if r := int(hi[i]) - int(lo[i]); r > width {
+			channel, width = i, r
+		}
+	}
+	return channel, width
+}
+
+// img の各画素をパレットの最も近い色の番号にして dst に書き込む
+// dst は img と同じ範囲とする
+// モザイクの画像は同じ色が続くため、色ごとに番号を cache に覚えておき、パレットの探索を省く
+// cache は同じパレットのフレームの間で使い回せる (nil の場合は毎回作る)
+func Quantize(dst *image.Paletted, img *image.NRGBA, palette color.Palette, cache map[color.NRGBA]uint8) {
+	if cache == nil {
+		cache = map[color.NRGBA]uint8{}
+	}
+	var (
+		last      color.NRGBA
+		lastIndex uint8
+		haveLast  bool
+	)
+	for y := img.Rect.Min.Y; y < img.Rect.Max.Y; y++ {
+		src := img.Pix[img.PixOffset(img.Rect.Min.X, y):]
+		out := dst.Pix[dst.PixOffset(dst.Rect.Min.X, dst.Rect.Min.Y+y-img.Rect.Min.Y):]
+		for x := 0; x < img.Rect.Dx(); x++ {
+			c := color.NRGBA{src[4*x], src[4*x+1], src[4*x+2], 255}
+			if !haveLast || c != last {
+				idx, ok := cache[c]
+				if !ok {
+					if len(cache) >= maxCache {
+						// ノイズを加えた画像などで色が多い場合に、覚える色が増え続けないようにする
+						clear(cache)
+					}
+					idx = uint8(palette.Index(c))
+					cache[c] = idx
+				}
+				last, lastIndex, haveLast = c, idx, true
+			}
+			out[x] = lastIndex
+		}
+	}
+}
@@ -0,0 +1,175 @@
+// Package gifstream は、フレームを 1 枚ずつ受け取ってアニメーション GIF を書き出す
+// image/gif の EncodeAll と異なり、すべてのフレームをメモリに保持しない
+// すべてのフレームで 1 つのグローバルカラーテーブルを共有する
+package gifstream
+
+import (
+	"bufio"
+	"compress/lzw"
+	"errors"
+	"image"
+	"image/color"
+	"io"
+)
+
+// アニメーション GIF の書き出し
+type Encoder struct {
+	w      *bufio.Writer
+	bounds image.Rectangle
+	bits   int // カラーテーブルの大きさ (2 の bits 乗)
+	frames int
+	err    error
+}
+
+// ヘッダーとグローバルカラーテーブルを書き出し、Encoder を生成
+// palette は 1〜256 色で、すべてのフレームで共有する
+// loopCount が 0 の場合は無限に繰り返し、負の場合は 1 回だけ再生し、正の場合は loopCount 回繰り返す (image/gif と同じ)
+func NewEncoder(w io.Writer, width, height int, palette color.Palette, loopCount int) (*Encoder, error) {
+	if len(palette) == 0 || len(palette) > 256 {
+		return nil, errors.New("gifstream: palette must have 1 to 256 colors")
+	}
+	if width <= 0 || height <= 0 || width > 0xffff || height > 0xffff {
+		return nil, errors.New("gifstream: invalid image size")
+	}
+	bits := 1
+	for 1<<bits < len(palette) {
+		bits++
+	}
+	e := &Encoder{
+		w:      bufio.NewWriter(w),
+		bounds: image.Rect(0, 0, width, height),
+		bits:   bits,
+	}
+
+	e.w.WriteString("GIF89a")
+	e.writeUint16(width)
+	e.writeUint16(height)
+	// グローバルカラーテーブルあり、色の解像度 8 ビット、テーブルの大きさ
+	e.w.WriteByte(0x80 | 0x70 | byte(bits-1))
+	e.w.WriteByte(0) // 背景色の番号
+	e.w.WriteByte(0) // 画素のアスペクト比
+	for i := 0; i < 1<<bits; i++ {
+		var r, g, b uint8
+		if i < len(palette) {
+			cr, cg, cb, _ := palette[i].RGBA()
+			r, g, b = uint8(cr>>8), uint8(cg>>8), uint8(cb>>8)
+		}
+		e.w.Write([]byte{r, g, b})
+	}
+	if loopCount >= 0 {
+		// NETSCAPE2.0 のアプリケーション拡張で繰り返しの回数を指定する
+		e.w.Write([]byte{0x21, 0xff, 0x0b})
+		e.w.WriteString("NETSCAPE2.0")
+		e.w.Write([]byte{0x03, 0x01})
+		e.writeUint16(loopCount)
+		e.w.WriteByte(0)
+	}
+	return e, e.flushErr()
+}
+
+func (e *Encoder) writeUint16(v int) {
+	e.w.Write([]byte{byte(v), byte(v >> 8)})
+}
+
+// 書き込みの失敗は bufio.Writer が保持するため、書き込んだ後にまとめて確認する
+func (e *Encoder) flushErr() error {
+	if e.err == nil {
+		e.err = e.w.Flush()
+	}
+	return e.err
+}
+
+// フレームを書き出す
+// img は NewEncoder に渡した大きさで、色の番号は共有するパレットの番号とする (img.Palette は参照しない)
+// delay はこのフレームを表示する時間 (1/100 秒単位)
+func (e *Encoder) Encode(img *image.Paletted, delay int) error {
+	if e.err != nil {
+		return e.err
+	}
+	if img.Rect.Size() != e.bounds.Size() {
+		return errors.New("gifstream: frame size does not match the image size")
+	}
+	// グラフィック制御拡張 (表示時間。フレームは画像全体を覆うため、破棄の方法は「そのまま残す」にする)
+	e.w.Write([]byte{0x21, 0xf9, 0x04, 0x04})
+	e.writeUint16(delay)
+	e.w.Write([]byte{0x00, 0x00})
+
+	// イメージ記述子 (ローカルカラーテーブルなし、インターレースなし)
+	e.w.WriteByte(0x2c)
+	e.writeUint16(0)
+	e.writeUint16(0)
+	e.writeUint16(e.bounds.Dx())
+	e.writeUint16(e.bounds.Dy())
+	e.w.WriteByte(0)
+
+	// LZW の最小の符号の幅は 2 以上にする
+	litWidth := max(e.bits, 2)
+	e.w.WriteByte(byte(litWidth))
+	bw := &blockWriter{w: e.w}
+	lw := lzw.NewWriter(bw, lzw.LSB, litWidth)
+	width := img.Rect.Dx()
+	for y := img.Rect.Min.Y; y < img.Rect.Max.Y; y++ {
+		i := img.PixOffset(img.Rect.Min.X, y)
+		if _, err := lw.Write(img.Pix[i : i+width]); err != nil {
+			e.err = err
+			return err
+		}
+	}
+	if err := lw.Close(); err != nil {
+		e.err = err
+		return err
+	}
+	bw.close()
+	e.frames++
+	return e.flushErr()
+}
+
+// 書き出したフレームの数
+func (e *Encoder) Frames() int {
+	return e.frames
+}
+
+// 終端を書き出す
+// w は閉じない。Close の後に Encode を呼び出してはならない
+func (e *Encoder) Close() error {
+	if e.err != nil {
+		return e.err
+	}
+	e.w.WriteByte(0x3b)
+	return e.flushErr()
+}
+
+// LZW の出力を 255 バイトずつのサブブロックに分けて書き出す
+type blockWriter struct {
+	w   *bufio.Writer
+	buf [255]byte
+	n   int
+}
+
+func (b *blockWriter) Write(p []byte) (int, error) {
+	written := len(p)
+	for len(p) > 0 {
+		c := copy(b.buf[b.n:], p)
+		b.n += c
+		p = p[c:]
+		if b.n == len(b.buf) {
+			b.flush()
+		}
+	}
+	return written, nil
+}
+
+func (b *blockWriter) flush() {
+	if b.n == 0 {
+		return
+	}
+	b.w.WriteByte(byte(b.n))
+	b.w.Write(b.buf[:b.n])
+	b.n = 0
+}
+
+// 残りのサブブロックと、終端の空のサブブロックを書き出す
+func (b *blockWriter) close() {
+	b.flush()
+	b.w.WriteByte(0)
+}
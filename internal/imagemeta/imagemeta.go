@@ -0,0 +1,127 @@
+// Package imagemeta は、JPEG (JFIF) と PNG (pHYs) に記録する解像度を読み書きする
+package imagemeta
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"math"
+)
+
+// 1 インチあたりのセンチメートルとメートル
+const (
+	cmPerInch    = 2.54
+	meterPerInch = 0.0254
+)
+
+const pngSignature = "\x89PNG\r\n\x1a\n"
+
+// 画像の先頭部分 header に記録された横の解像度 (dpi)
+// JPEG は JFIF の APP0、PNG は pHYs チャンクから読み取る
+// 記録されていない場合や、単位がなく縦横の比だけの場合は false を返却
+func Density(header []byte) (float64, bool) {
+	switch {
+	case bytes.HasPrefix(header, []byte{0xff, 0xd8}):
+		return jfifDensity(header)
+	case bytes.HasPrefix(header, []byte(pngSignature)):
+		return pngDensity(header)
+	}
+	return 0, false
+}
+
+// JFIF の APP0 の解像度
+// APP0 は SOI の直後に置かれる
+func jfifDensity(data []byte) (float64, bool) {
+	// SOI、マーカー、長さ、"JFIF\0"、版 (2 バイト)、単位、横と縦の解像度
+	if len(data) < 18 || data[2] != 0xff || data[3] != 0xe0 || string(data[6:11]) != "JFIF\x00" {
+		return 0, false
+	}
+	x := float64(binary.BigEndian.Uint16(data[14:]))
+	if x == 0 {
+		return 0, false
+	}
+	switch data[13] {
+	case 1: // dots per inch
+		return x, true
+	case 2: // dots per cm
+		return x * cmPerInch, true
+	}
+	return 0, false
+}
+
+// PNG の pHYs チャンクの解像度
+// pHYs は IDAT より前に置かれる
+func pngDensity(data []byte) (float64, bool) {
+	for i := len(pngSignature); i+8 <= len(data); {
+		length := int(binary.BigEndian.Uint32(data[i:]))
+		typ := string(data[i+4 : i+8])
+		end := i + 8 + length + 4
+		if length < 0 || end > len(data) || typ == "IDAT" {
+			return 0, false
+		}
+		if typ == "pHYs" && length == 9 {
+			// 横と縦の 1 単位あたりの画素数と単位 (1 はメートル)
+			chunk := data[i+8 : i+8+length]
+			x := float64(binary.BigEndian.Uint32(chunk))
+			if chunk[8] != 1 || x == 0 {
+				return 0, false
+			}
+			return x * meterPerInch, true
+		}
+		i = end
+	}
+	return 0, false
+}
+
+// w に書き込む JPEG の SOI の直後に、解像度 dpi の JFIF の APP0 を挿入する io.Writer
+// JPEG のエンコーダーは APP0 を書き込まないものとする
+func JPEGWriter(w io.Writer, dpi float64) io.Writer {
+	d := uint16(math.Round(math.Min(math.Max(dpi, 1), math.MaxUint16)))
+	app0 := []byte{0xff, 0xe0, 0, 16, 'J', 'F', 'I', 'F', 0, 1, 2, 1, 0, 0, 0, 0, 0, 0}
+	binary.BigEndian.PutUint16(app0[12:], d)
+	binary.BigEndian.PutUint16(app0[14:], d)
+	return &insertWriter{w: w, offset: 2, insert: app0}
+}
+
+// w に書き込む PNG の IHDR の直後に、解像度 dpi の pHYs を挿入する io.Writer
+func PNGWriter(w io.Writer, dpi float64) io.Writer {
+	ppm := uint32(math.Round(math.Min(math.Max(dpi, 1)/meterPerInch, math.MaxUint32)))
+	chunk := make([]byte, 4+4+9+4)
+	binary.BigEndian.PutUint32(chunk, 9)
+	copy(chunk[4:], "pHYs")
+	binary.BigEndian.PutUint32(chunk[8:], ppm)
+	binary.BigEndian.PutUint32(chunk[12:], ppm)
+	chunk[16] = 1
+	binary.BigEndian.PutUint32(chunk[17:], crc32.ChecksumIEEE(chunk[4:17]))
+	// シグネチャと IHDR (長さ、種類、13 バイトのデータ、CRC)
+	return &insertWriter{w: w, offset: len(pngSignature) + 4 + 4 + 13 + 4, insert: chunk}
+}
+
+// 先頭から offset バイトの位置に insert を挟んで w に書き込む
+type insertWriter struct {
+	w      io.Writer
+	offset int
+	insert []byte
+	n      int // 書き込んだバイト数 (insert を除く)
+}
+
+func (iw *insertWriter) Write(p []byte) (int, error) {
+	if iw.n >= iw.offset {
+		n, err := iw.w.Write(p)
+		iw.n += n
+		return n, err
+	}
+	head := min(len(p), iw.offset-iw.n)
+	n, err := iw.w.Write(p[:head])
+	iw.n += n
+	if err != nil || head == len(p) && iw.n < iw.offset {
+		return n, err
+	}
+	if _, err := iw.w.Write(iw.insert); err != nil {
+		return n, err
+	}
+	m, err := iw.w.Write(p[head:])
+	iw.n += m
+	return n + m, err
+}
@@ -0,0 +1,110 @@
+package imagemeta
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"math"
+	"testing"
+)
+
+// 解像度を記録していない JPEG と PNG
+func encodeImages(t *testing.T) (jpg, pngData []byte) {
+	t.Helper()
+	img := image.NewGray(image.Rect(0, 0, 8, 8))
+	var j, p bytes.Buffer
+	if err := jpeg.Encode(&j, img, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := png.Encode(&p, img); err != nil {
+		t.Fatal(err)
+	}
+	return j.Bytes(), p.Bytes()
+}
+
+// SOI の直後に単位 unit、解像度 x の JFIF の APP0 を挟んだ JPEG
+func withJFIF(jpg []byte, unit byte, x uint16) []byte {
+	app0 := []byte{0xff, 0xe0, 0, 16, 'J', 'F', 'I', 'F', 0, 1, 2, unit, 0, 0, 0, 0, 0, 0}
+	binary.BigEndian.PutUint16(app0[12:], x)
+	binary.BigEndian.PutUint16(app0[14:], x)
+	return append(append(append([]byte{}, jpg[:2]...), app0...), jpg[2:]...)
+}
+
+// 先頭から offset バイトの位置に、単位 unit、1 単位あたり ppu 画素の pHYs チャンクを挟んだ PNG
+func withPHYs(pngData []byte, offset int, unit byte, ppu uint32) []byte {
+	chunk := make([]byte, 4+4+9+4)
+	binary.BigEndian.PutUint32(chunk, 9)
+	copy(chunk[4:], "pHYs")
+	binary.BigEndian.PutUint32(chunk[8:], ppu)
+	binary.BigEndian.PutUint32(chunk[12:], ppu)
+	chunk[16] = unit
+	binary.BigEndian.PutUint32(chunk[17:], crc32.ChecksumIEEE(chunk[4:17]))
+	return append(append(append([]byte{}, pngData[:offset]...), chunk...), pngData[offset:]...)
+}
+
+func TestDensity(t *testing.T) {
+	jpg, pngData := encodeImages(t)
+	// シグネチャと IHDR の直後、IDAT の直後
+	afterIHDR := len(pngSignature) + 4 + 4 + 13 + 4
+	afterIDAT := afterIHDR + 4 + 4 + int(binary.BigEndian.Uint32(pngData[afterIHDR:])) + 4
+
+	tests := []struct {
+		name string
+		data []byte
+		dpi  float64 // 0 の場合は解像度がない
+	}{
+		{"jfif dpi", withJFIF(jpg, 1, 300), 300},
+		{"jfif dots per cm", withJFIF(jpg, 2, 118), 118 * 2.54},
+		{"jfif aspect only", withJFIF(jpg, 0, 1), 0},
+		{"jfif zero", withJFIF(jpg, 1, 0), 0},
+		{"jpeg without jfif", jpg, 0},
+		{"png pHYs", withPHYs(pngData, afterIHDR, 1, 11811), 11811 * 0.0254},
+		{"png aspect only", withPHYs(pngData, afterIHDR, 0, 1), 0},
+		{"png pHYs after IDAT", withPHYs(pngData, afterIDAT, 1, 11811), 0},
+		{"png without pHYs", pngData, 0},
+		{"truncated png", withPHYs(pngData, afterIHDR, 1, 11811)[:afterIHDR+10], 0},
+		{"not an image", []byte("GIF89a"), 0},
+	}
+	for _, tt := range tests {
+		dpi, ok := Density(tt.data)
+		if ok != (tt.dpi > 0) || math.Abs(dpi-tt.dpi) > 1e-9 {
+			t.Errorf("%s: Density = %g, %v, want %g", tt.name, dpi, ok, tt.dpi)
+		}
+	}
+}
+
+// JPEGWriter と PNGWriter で書き込んだ解像度を Density で読み戻せ、画像としてもデコードできる
+func TestWriterRoundTrip(t *testing.T) {
+	jpg, pngData := encodeImages(t)
+	for _, dpi := range []float64{72, 254, 300} {
+		for _, tt := range []struct {
+			name   string
+			data   []byte
+			writer func(io.Writer, float64) io.Writer
+			decode func(io.Reader) (image.Image, error)
+		}{
+			{"jpeg", jpg, JPEGWriter, jpeg.Decode},
+			{"png", pngData, PNGWriter, png.Decode},
+		} {
+			var buf bytes.Buffer
+			w := tt.writer(&buf, dpi)
+			// 挿入する位置をまたいで少しずつ書き込む
+			for i := 0; i < len(tt.data); i += 7 {
+				if _, err := w.Write(tt.data[i:min(i+7, len(tt.data))]); err != nil {
+					t.Fatal(err)
+				}
+			}
+			got, ok := Density(buf.Bytes())
+			if !ok || math.Abs(got-dpi) > 0.01 {
+				t.Errorf("%s %g dpi: Density = %g, %v", tt.name, dpi, got, ok)
+			}
+			if _, err := tt.decode(bytes.NewReader(buf.Bytes())); err != nil {
+				t.Errorf("%s %g dpi: %v", tt.name, dpi, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,151 @@
+// Package jpegstream は、画像をバンド単位で受け取りながら JPEG (4:2:0 ベースライン) を書き出す
+// 標準ライブラリの image/jpeg のエンコーダを元にしており、同じ画像からは同じ出力が得られる
+package jpegstream
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"io"
+)
+
+// MCU の高さ (4:2:0 のため 16 行)
+// 最後のバンドを除き、バンドの高さはこの倍数でなければならない
+const MCUHeight = 16
+
+// JPEG をバンド単位で書き出すエンコーダ
+// 使用するメモリは MCU 1 行分の作業領域とエントロピー符号化の状態だけで、画像の大きさによらない
+type Encoder struct {
+	encoder
+	width, height int
+	y             int // 次に書き込む行
+
+	// DC 成分は直前のブロックとの差分で符号化する
+	prevDCY, prevDCCb, prevDCCr int32
+}
+
+// w にヘッダーを書き込み、Encoder を生成
+// o が nil の場合は image/jpeg と同じ既定の品質を使う
+func NewEncoder(w io.Writer, width, height int, o *jpeg.Options) (*Encoder, error) {
+	if width <= 0 || height <= 0 {
+		return nil, errors.New("jpegstream: empty image")
+	}
+	if width >= 1<<16 || height >= 1<<16 {
+		return nil, errors.New("jpegstream: image is too large to encode")
+	}
+	e := &Encoder{width: width, height: height}
+	if ww, ok := w.(writer); ok {
+		e.w = ww
+	} else {
+		e.w = bufio.NewWriter(w)
+	}
+	e.initQuant(o)
+
+	// Start Of Image
+	e.write([]byte{0xff, 0xd8})
+	e.writeDQT()
+	e.writeSOF0(image.Pt(width, height), 3)
+	e.writeDHT(3)
+	e.write(sosHeaderYCbCr)
+	return e, e.err
+}
+
+// 品質から量子化テーブルを初期化 (image/jpeg の Encode と同じ計算)
+func (e *Encoder) initQuant(o *jpeg.Options) {
+	quality := jpeg.DefaultQuality
+	if o != nil {
+		quality = max(1, min(100, o.Quality))
+	}
+	var scale int
+	if quality < 50 {
+		scale = 5000 / quality
+	} else {
+		scale = 200 - quality*2
+	}
+	for i := range e.quant {
+		for j := range e.quant[i] {
+			x := (int(unscaledQuant[i][j])*scale + 50) / 100
+			e.quant[i][j] = uint8(max(1, min(255, x)))
+		}
+	}
+}
+
+// band の rect の範囲を符号化する
+// rect は画像の幅全体で、前回のバンドの直後から始まっていなければならない
+// 高さは MCUHeight の倍数か、画像の最後までであること
+func (e *Encoder) WriteBand(band *image.NRGBA, rect image.Rectangle) error {
+	if e.err != nil {
+		return e.err
+	}
+	if rect.Min.X != 0 || rect.Max.X != e.width || rect.Min.Y != e.y || rect.Max.Y > e.height {
+		return fmt.Errorf("jpegstream: band %v does not continue from row %d of a %dx%d image", rect, e.y, e.width, e.height)
+	}
+	if rect.Max.Y != e.height && rect.Dy()%MCUHeight != 0 {
+		return fmt.Errorf("jpegstream: band height %d is not a multiple of %d", rect.Dy(), MCUHeight)
+	}
+
+	var (
+		b      block
+		cb, cr [4]block
+	)
+	for y := rect.Min.Y; y < rect.Max.Y; y += MCUHeight {
+		for x := 0; x < e.width; x += 16 {
+			for i := 0; i < 4; i++ {
+				xOff := (i & 1) * 8
+				yOff := (i & 2) * 4
+				nrgbaToYCbCr(band, rect, image.Pt(x+xOff, y+yOff), &b, &cb[i], &cr[i])
+				e.prevDCY = e.writeBlock(&b, 0, e.prevDCY)
+			}
+			scale(&b, &cb)
+			e.prevDCCb = e.writeBlock(&b, 1, e.prevDCCb)
+			scale(&b, &cr)
+			e.prevDCCr = e.writeBlock(&b, 1, e.prevDCCr)
+		}
+	}
+	e.y = rect.Max.Y
+	return e.err
+}
+
+// 残りのビットと End Of Image を書き込む
+// すべての行を書き込む前に呼び出した場合はエラーを返却
+func (e *Encoder) Close() error {
+	if e.err != nil {
+		return e.err
+	}
+	if e.y != e.height {
+		return fmt.Errorf("jpegstream: closed after %d of %d rows", e.y, e.height)
+	}
+	// Pad the last byte with 1's.
+	e.emit(0x7f, 7)
+	// End Of Image
+	e.write([]byte{0xff, 0xd9})
+	e.flush()
+	return e.err
+}
+
+// band の p を左上とする 8x8 の範囲を YCbCr に変換
+// 範囲外の画素は rect の端の画素で補う
+// 透明度のある画素は image/jpeg と同じく乗算済みの値を使う
+func nrgbaToYCbCr(m *image.NRGBA, rect image.Rectangle, p image.Point, yBlock, cbBlock, crBlock *block) {
+	xmax := rect.Max.X - 1
+	ymax := rect.Max.Y - 1
+	for j := 0; j < 8; j++ {
+		sy := min(p.Y+j, ymax)
+		for i := 0; i < 8; i++ {
+			sx := min(p.X+i, xmax)
+			pix := m.Pix[m.PixOffset(sx, sy):]
+			r, g, b := pix[0], pix[1], pix[2]
+			if pix[3] != 0xff {
+				r16, g16, b16, _ := color.NRGBA{pix[0], pix[1], pix[2], pix[3]}.RGBA()
+				r, g, b = uint8(r16>>8), uint8(g16>>8), uint8(b16>>8)
+			}
+			yy, cb, cr := color.RGBToYCbCr(r, g, b)
+			yBlock[8*j+i] = int32(yy)
+			cbBlock[8*j+i] = int32(cb)
+			crBlock[8*j+i] = int32(cr)
+		}
+	}
+}
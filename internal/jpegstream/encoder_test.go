@@ -0,0 +1,159 @@
+package jpegstream
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"testing"
+)
+
+// グラデーションに決まったノイズと半透明の画素を加えた画像
+func testImage(w, h int) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	state := uint32(7)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			state = state*1664525 + 1013904223
+			a := uint8(255)
+			if (x+y)%13 == 0 {
+				a = uint8(state >> 24)
+			}
+			img.SetNRGBA(x, y, color.NRGBA{uint8(x * 3), uint8(y * 5), uint8(state >> 24), a})
+		}
+	}
+	return img
+}
+
+// img を高さ bandHeight のバンドに分けて Encoder で書き出す
+func encodeBands(t *testing.T, img *image.NRGBA, bandHeight int, o *jpeg.Options) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	e, err := NewEncoder(&buf, img.Rect.Dx(), img.Rect.Dy(), o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for y := 0; y < img.Rect.Dy(); y += bandHeight {
+		rect := image.Rect(0, y, img.Rect.Dx(), min(y+bandHeight, img.Rect.Dy()))
+		// バンドごとに別の画像として渡す
+		band := image.NewNRGBA(rect)
+		copy(band.Pix, img.Pix[img.PixOffset(0, y):])
+		if err := e.WriteBand(band, rect); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := e.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestEncoderMatchesImageJPEG(t *testing.T) {
+	for _, size := range []image.Point{{1, 1}, {16, 16}, {17, 33}, {64, 48}, {100, 75}} {
+		for _, bandHeight := range []int{MCUHeight, 3 * MCUHeight, 1 << 16} {
+			for _, o := range []*jpeg.Options{nil, {Quality: 1}, {Quality: 50}, {Quality: 100}} {
+				img := testImage(size.X, size.Y)
+				got := encodeBands(t, img, bandHeight, o)
+				var want bytes.Buffer
+				if err := jpeg.Encode(&want, img, o); err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(got, want.Bytes()) {
+					t.Errorf("%v bands %d %+v: output differs from image/jpeg (%d, %d bytes)", size, bandHeight, o, len(got), want.Len())
+				}
+				// 復号した画素も同じ
+				a, err := jpeg.Decode(bytes.NewReader(got))
+				if err != nil {
+					t.Fatalf("%v: %v", size, err)
+				}
+				b, _ := jpeg.Decode(bytes.NewReader(want.Bytes()))
+				if !bytes.Equal(a.(*image.YCbCr).Y, b.(*image.YCbCr).Y) || !bytes.Equal(a.(*image.YCbCr).Cb, b.(*image.YCbCr).Cb) {
+					t.Errorf("%v bands %d: decoded pixels differ", size, bandHeight)
+				}
+			}
+		}
+	}
+}
+
+// JPEG のマーカーを順に並べる (エントロピー符号化したデータの中の RST も含める)
+func markers(data []byte) []byte {
+	var ms []byte
+	for i := 2; i+1 < len(data); i++ {
+		if data[i] != 0xff {
+			continue
+		}
+		m := data[i+1]
+		if m == 0 || m == 0xff {
+			// 0xff のバイトの詰め物と、マーカーの前の詰め物
+			continue
+		}
+		ms = append(ms, m)
+		if m >= 0xc0 && m <= 0xfe && !(m >= 0xd0 && m <= 0xd9) {
+			// 長さのあるセグメントは読み飛ばす
+			i += 1 + (int(data[i+2])<<8 | int(data[i+3]))
+		}
+	}
+	return ms
+}
+
+func TestEncoderBaseline(t *testing.T) {
+	data := encodeBands(t, testImage(100, 75), MCUHeight, nil)
+	if !bytes.HasPrefix(data, []byte{0xff, 0xd8}) || !bytes.HasSuffix(data, []byte{0xff, 0xd9}) {
+		t.Fatal("missing SOI or EOI")
+	}
+	ms := markers(data)
+	// ベースライン (SOF0) で、プログレッシブ (SOF2) や拡張 (SOF1) にはしない
+	// バンドの境界でも DC の予測を続けるため、リスタートマーカー (DRI と RST0〜7) を使わない
+	want := []byte{0xdb, 0xc0, 0xc4, 0xda, 0xd9}
+	if !bytes.Equal(ms, want) {
+		t.Errorf("markers % x, want % x", ms, want)
+	}
+	config, err := jpeg.DecodeConfig(bytes.NewReader(data))
+	if err != nil || config.Width != 100 || config.Height != 75 || config.ColorModel != color.YCbCrModel {
+		t.Errorf("DecodeConfig %+v, %v", config, err)
+	}
+}
+
+func TestEncoderRejectsBands(t *testing.T) {
+	img := testImage(40, 40)
+	tests := []struct {
+		name  string
+		rects []image.Rectangle
+	}{
+		{"not from the top", []image.Rectangle{image.Rect(0, 16, 40, 32)}},
+		{"partial width", []image.Rectangle{image.Rect(0, 0, 32, 16)}},
+		{"not a multiple of the MCU height", []image.Rectangle{image.Rect(0, 0, 40, 8)}},
+		{"gap", []image.Rectangle{image.Rect(0, 0, 40, 16), image.Rect(0, 32, 40, 40)}},
+		{"past the bottom", []image.Rectangle{image.Rect(0, 0, 40, 48)}},
+	}
+	for _, tt := range tests {
+		var buf bytes.Buffer
+		e, err := NewEncoder(&buf, 40, 40, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, r := range tt.rects {
+			err = e.WriteBand(img, r)
+			if i < len(tt.rects)-1 && err != nil {
+				t.Fatalf("%s: band %v: %v", tt.name, r, err)
+			}
+		}
+		if err == nil {
+			t.Errorf("%s: accepted", tt.name)
+		}
+	}
+
+	var buf bytes.Buffer
+	e, _ := NewEncoder(&buf, 40, 40, nil)
+	if err := e.WriteBand(img, image.Rect(0, 0, 40, 16)); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Close(); err == nil {
+		t.Error("Close before the last row succeeded")
+	}
+	for _, size := range []image.Point{{0, 10}, {10, 0}, {1 << 16, 1}} {
+		if _, err := NewEncoder(&buf, size.X, size.Y, nil); err == nil {
+			t.Errorf("NewEncoder(%v) succeeded", size)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package tiff
+
+import "io"
+
+// TIFF の LZW の符号
+const (
+	lzwClear    = 256
+	lzwEOI      = 257
+	lzwFirst    = 258 // 最初に辞書に追加する符号
+	lzwMaxWidth = 12
+)
+
+// TIFF の LZW を n バイトまで展開
+// compress/lzw と異なり、符号の幅は辞書が幅の上限に達する 1 つ手前で増やす (early change)
+func decodeLZW(src []byte, n int) ([]byte, error) {
+	var (
+		prefix [1 << lzwMaxWidth]uint16
+		suffix [1 << lzwMaxWidth]byte
+		first  [1 << lzwMaxWidth]byte // 符号が表すバイト列の先頭
+		length [1 << lzwMaxWidth]int
+	)
+	for i := 0; i < lzwClear; i++ {
+		suffix[i], first[i], length[i] = byte(i), byte(i), 1
+	}
+
+	buf := make([]byte, 0, n)
+	// code が表すバイト列を buf に追加
+	emit := func(code int) {
+		start := len(buf)
+		for i := 0; i < length[code]; i++ {
+			buf = append(buf, 0)
+		}
+		for i := len(buf) - 1; i >= start; i-- {
+			buf[i] = suffix[code]
+			code = int(prefix[code])
+		}
+	}
+
+	var (
+		bits  uint32
+		nbits uint
+		pos   int
+		width uint = 9
+		next       = lzwFirst
+		prev       = -1
+	)
+	for len(buf) < n {
+		for nbits < width {
+			if pos >= len(src) {
+				return buf, io.ErrUnexpectedEOF
+			}
+			bits = bits<<8 | uint32(src[pos])
+			nbits += 8
+			pos++
+		}
+		code := int(bits>>(nbits-width)) & (1<<width - 1)
+		nbits -= width
+
+		switch {
+		case code == lzwClear:
+			width, next, prev = 9, lzwFirst, -1
+			continue
+		case code == lzwEOI:
+			return buf, nil
+		case prev == -1:
+			if code >= lzwClear {
+				return nil, FormatError("bad LZW code")
+			}
+			emit(code)
+			prev = code
+			continue
+		case code < next:
+			emit(code)
+			if next < 1<<lzwMaxWidth {
+				prefix[next], suffix[next], first[next], length[next] = uint16(prev), first[code], first[prev], length[prev]+1
+				next++
+			}
+		case code == next && next < 1<<lzwMaxWidth:
+			// 辞書にまだない符号は、直前のバイト列にその先頭を加えたもの
+			prefix[next], suffix[next], first[next], length[next] = uint16(prev), first[prev], first[prev], length[prev]+1
+			next++
+			emit(code)
+		default:
+			return nil, FormatError("bad LZW code")
+		}
+		prev = code
+		if next >= 1<<width-1 && width < lzwMaxWidth {
+			width++
+		}
+	}
+	return buf, nil
+}
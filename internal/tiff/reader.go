@@ -0,0 +1,659 @@
+// Package tiff は、複数ページの TIFF を読み書きする
+// 読み込みは非圧縮、PackBits、LZW、Deflate のストリップとタイルで、8 ビット以下のグレースケールとパレット、8 ビットの RGB (アルファ付きを含む) に対応する
+// 書き込みは Deflate で圧縮したストリップで、グレースケールと RGB (アルファ付きを含む) に対応する
+package tiff
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"math"
+)
+
+// タグ
+const (
+	tagImageWidth      = 256
+	tagImageLength     = 257
+	tagBitsPerSample   = 258
+	tagCompression     = 259
+	tagPhotometric     = 262
+	tagStripOffsets    = 273
+	tagSamplesPerPixel = 277
+	tagRowsPerStrip    = 278
+	tagStripByteCounts = 279
+	tagXResolution     = 282
+	tagYResolution     = 283
+	tagPlanarConfig    = 284
+	tagResolutionUnit  = 296
+	tagPredictor       = 317
+	tagColorMap        = 320
+	tagTileWidth       = 322
+	tagTileLength      = 323
+	tagTileOffsets     = 324
+	tagTileByteCounts  = 325
+	tagExtraSamples    = 338
+)
+
+// タグの値の型
+const (
+	typeByte     = 1
+	typeShort    = 3
+	typeLong     = 4
+	typeRational = 5
+)
+
+// 型ごとの値の大きさ (バイト)
+var typeSizes = map[uint16]int{
+	1: 1, 2: 1, 3: 2, 4: 4, 5: 8, 6: 1, 7: 1, 8: 2, 9: 4, 10: 8, 11: 4, 12: 8,
+}
+
+// 圧縮方式
+const (
+	compressionNone     = 1
+	compressionLZW      = 5
+	compressionDeflate  = 8
+	compressionPackBits = 32773
+	compressionDeflateX = 32946 // 古い Deflate の値
+)
+
+// 色の表現
+const (
+	photometricWhiteIsZero = 0
+	photometricBlackIsZero = 1
+	photometricRGB         = 2
+	photometricPalette     = 3
+)
+
+// 読み込むページ数の上限 (IFD の循環や壊れたファイルへの対策)
+const maxPages = 10000
+
+// 形式のエラー
+type FormatError string
+
+func (e FormatError) Error() string { return "tiff: invalid format: " + string(e) }
+
+// 対応していない機能のエラー
+type UnsupportedError string
+
+func (e UnsupportedError) Error() string { return "tiff: unsupported feature: " + string(e) }
+
+// 有理数 (解像度のタグの値)
+type Rational struct {
+	Num, Den uint32
+}
+
+// ページの解像度のタグ
+// Unit が 0 の場合は ResolutionUnit のタグがなく、Den が 0 の値はタグがない
+type Resolution struct {
+	X, Y Rational
+	Unit uint16 // 1: 単位なし、2: インチ、3: センチメートル
+}
+
+// 横の解像度 (dpi)
+// タグがない場合や単位がない場合は false を返却 (ResolutionUnit のタグがなければインチとする)
+func (r Resolution) DPI() (float64, bool) {
+	if r.X.Den == 0 || r.X.Num == 0 {
+		return 0, false
+	}
+	x := float64(r.X.Num) / float64(r.X.Den)
+	switch r.Unit {
+	case 0, 2:
+		return x, true
+	case 3:
+		return x * 2.54, true
+	}
+	return 0, false
+}
+
+// 縦横の解像度が dpi の Resolution
+// 小数点以下 2 桁まで保つ
+func ResolutionDPI(dpi float64) Resolution {
+	v := Rational{Num: uint32(math.Round(dpi * 100)), Den: 100}
+	return Resolution{X: v, Y: v, Unit: 2}
+}
+
+// デコードしたページ
+type Page struct {
+	Image      image.Image
+	Resolution Resolution
+}
+
+func init() {
+	image.RegisterFormat("tiff", "II*\x00", Decode, DecodeConfig)
+	image.RegisterFormat("tiff", "MM\x00*", Decode, DecodeConfig)
+}
+
+// 先頭のバイト列が TIFF のヘッダーかどうか
+func IsTIFF(b []byte) bool {
+	return bytes.HasPrefix(b, []byte("II*\x00")) || bytes.HasPrefix(b, []byte("MM\x00*"))
+}
+
+// 先頭のページをデコード
+func Decode(r io.Reader) (image.Image, error) {
+	f, err := readFile(r)
+	if err != nil {
+		return nil, err
+	}
+	page, err := f.Page(0)
+	if err != nil {
+		return nil, err
+	}
+	return page.Image, nil
+}
+
+// 先頭のページの大きさと色のモデルを返却
+// IFD はファイルの末尾にあることも多いため、r はすべて読み込む
+func DecodeConfig(r io.Reader) (image.Config, error) {
+	f, err := readFile(r)
+	if err != nil {
+		return image.Config{}, err
+	}
+	return f.Config(0)
+}
+
+func readFile(r io.Reader) (*File, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	return Parse(data)
+}
+
+// 解析した TIFF ファイル
+// ページの画素は Page を呼び出すまでデコードしない
+type File struct {
+	data  []byte
+	order binary.ByteOrder
+	ifds  []ifd
+}
+
+// IFD のタグの値
+type ifd map[uint16]entry
+
+type entry struct {
+	typ   uint16
+	count uint32
+	data  []byte // 値のバイト列
+}
+
+// data の TIFF のヘッダーとすべての IFD を解析
+func Parse(data []byte) (*File, error) {
+	if len(data) < 8 {
+		return nil, FormatError("short header")
+	}
+	f := &File{data: data}
+	switch string(data[:4]) {
+	case "II*\x00":
+		f.order = binary.LittleEndian
+	case "MM\x00*":
+		f.order = binary.BigEndian
+	default:
+		if string(data[:4]) == "II+\x00" || string(data[:4]) == "MM\x00+" {
+			return nil, UnsupportedError("BigTIFF")
+		}
+		return nil, FormatError("bad magic")
+	}
+
+	offset := f.order.Uint32(data[4:])
+	visited := map[uint32]bool{}
+	for offset != 0 {
+		if visited[offset] {
+			return nil, FormatError("IFD loop")
+		}
+		if len(f.ifds) >= maxPages {
+			return nil, FormatError("too many pages")
+		}
+		visited[offset] = true
+		d, next, err := f.parseIFD(offset)
+		if err != nil {
+			return nil, err
+		}
+		f.ifds = append(f.ifds, d)
+		offset = next
+	}
+	if len(f.ifds) == 0 {
+		return nil, FormatError("no pages")
+	}
+	return f, nil
+}
+
+// offset の IFD を解析し、次の IFD の位置を返却
+func (f *File) parseIFD(offset uint32) (ifd, uint32, error) {
+	pos := int64(offset)
+	if pos+2 > int64(len(f.data)) {
+		return nil, 0, FormatError("IFD offset out of range")
+	}
+	n := int64(f.order.Uint16(f.data[pos:]))
+	end := pos + 2 + n*12
+	if end+4 > int64(len(f.data)) {
+		return nil, 0, FormatError("IFD out of range")
+	}
+	d := ifd{}
+	for p := pos + 2; p < end; p += 12 {
+		raw := f.data[p : p+12]
+		e := entry{typ: f.order.Uint16(raw[2:]), count: f.order.Uint32(raw[4:])}
+		size, ok := typeSizes[e.typ]
+		if !ok {
+			// 知らない型のタグは読み飛ばす
+			continue
+		}
+		length := int64(size) * int64(e.count)
+		if length <= 4 {
+			e.data = raw[8 : 8+length]
+		} else {
+			valueOffset := int64(f.order.Uint32(raw[8:]))
+			if valueOffset+length > int64(len(f.data)) {
+				return nil, 0, FormatError("tag value out of range")
+			}
+			e.data = f.data[valueOffset : valueOffset+length]
+		}
+		d[f.order.Uint16(raw)] = e
+	}
+	return d, f.order.Uint32(f.data[end:]), nil
+}
+
+// ページ数
+func (f *File) NumPages() int {
+	return len(f.ifds)
+}
+
+// タグの整数の値の一覧 (BYTE、SHORT、LONG のみ)
+func (f *File) uints(d ifd, tag uint16) ([]uint32, error) {
+	e, ok := d[tag]
+	if !ok {
+		return nil, nil
+	}
+	values := make([]uint32, e.count)
+	for i := range values {
+		switch e.typ {
+		case typeByte:
+			values[i] = uint32(e.data[i])
+		case typeShort:
+			values[i] = uint32(f.order.Uint16(e.data[2*i:]))
+		case typeLong:
+			values[i] = f.order.Uint32(e.data[4*i:])
+		default:
+			return nil, FormatError(fmt.Sprintf("tag %d has type %d, want an integer", tag, e.typ))
+		}
+	}
+	return values, nil
+}
+
+// タグの整数の値 (ない場合は def)
+func (f *File) uint(d ifd, tag uint16, def uint32) (uint32, error) {
+	values, err := f.uints(d, tag)
+	if err != nil {
+		return 0, err
+	}
+	if len(values) == 0 {
+		return def, nil
+	}
+	return values[0], nil
+}
+
+// タグの有理数の値 (ない場合はゼロ値)
+func (f *File) rational(d ifd, tag uint16) Rational {
+	e, ok := d[tag]
+	if !ok || e.typ != typeRational || e.count == 0 {
+		return Rational{}
+	}
+	return Rational{Num: f.order.Uint32(e.data), Den: f.order.Uint32(e.data[4:])}
+}
+
+// ページの画素の形式
+type layout struct {
+	width, height int
+	bps           int // 1 サンプルのビット数
+	spp           int // 1 画素のサンプル数
+	photometric   uint32
+	compression   uint32
+	predictor     uint32
+	extra         uint32 // アルファのサンプルの種類 (ExtraSamples の値、なければ 0)
+}
+
+// ページの画素の形式を読み込み、対応している形式か確認する
+func (f *File) layout(d ifd) (layout, error) {
+	var (
+		l   layout
+		err error
+		v   uint32
+	)
+	get := func(tag uint16, def uint32) uint32 {
+		if err != nil {
+			return 0
+		}
+		v, err = f.uint(d, tag, def)
+		return v
+	}
+	l.width = int(get(tagImageWidth, 0))
+	l.height = int(get(tagImageLength, 0))
+	l.spp = int(get(tagSamplesPerPixel, 1))
+	l.photometric = get(tagPhotometric, 1<<16)
+	l.compression = get(tagCompression, compressionNone)
+	l.predictor = get(tagPredictor, 1)
+	planar := get(tagPlanarConfig, 1)
+	if err != nil {
+		return layout{}, err
+	}
+	if l.width <= 0 || l.height <= 0 || l.width > 1<<24 || l.height > 1<<24 {
+		return layout{}, FormatError(fmt.Sprintf("bad image size %dx%d", l.width, l.height))
+	}
+	if l.photometric == 1<<16 {
+		return layout{}, FormatError("missing PhotometricInterpretation")
+	}
+
+	bps, err := f.uints(d, tagBitsPerSample)
+	if err != nil {
+		return layout{}, err
+	}
+	l.bps = 1
+	for i, b := range bps {
+		if i == 0 {
+			l.bps = int(b)
+		} else if int(b) != l.bps {
+			return layout{}, UnsupportedError("different bits per sample")
+		}
+	}
+	extra, err := f.uints(d, tagExtraSamples)
+	if err != nil {
+		return layout{}, err
+	}
+	if len(extra) > 0 {
+		l.extra = extra[0]
+	}
+
+	switch {
+	case planar != 1 && l.spp > 1:
+		return layout{}, UnsupportedError("planar configuration")
+	case l.photometric == photometricWhiteIsZero || l.photometric == photometricBlackIsZero:
+		if l.spp != 1 || (l.bps != 1 && l.bps != 2 && l.bps != 4 && l.bps != 8) {
+			return layout{}, UnsupportedError(fmt.Sprintf("grayscale with %d samples of %d bits", l.spp, l.bps))
+		}
+	case l.photometric == photometricPalette:
+		if l.spp != 1 || (l.bps != 1 && l.bps != 2 && l.bps != 4 && l.bps != 8) {
+			return layout{}, UnsupportedError(fmt.Sprintf("palette with %d samples of %d bits", l.spp, l.bps))
+		}
+	case l.photometric == photometricRGB:
+		if (l.spp != 3 && l.spp != 4) || l.bps != 8 {
+			return layout{}, UnsupportedError(fmt.Sprintf("RGB with %d samples of %d bits", l.spp, l.bps))
+		}
+	default:
+		return layout{}, UnsupportedError(fmt.Sprintf("photometric interpretation %d", l.photometric))
+	}
+	switch l.compression {
+	case compressionNone, compressionLZW, compressionDeflate, compressionDeflateX, compressionPackBits:
+	default:
+		return layout{}, UnsupportedError(fmt.Sprintf("compression %d", l.compression))
+	}
+	if l.predictor != 1 && (l.predictor != 2 || l.bps != 8) {
+		return layout{}, UnsupportedError(fmt.Sprintf("predictor %d with %d bits", l.predictor, l.bps))
+	}
+	return l, nil
+}
+
+// 色のモデル
+func (l layout) colorModel() color.Model {
+	switch {
+	case l.photometric == photometricRGB && l.spp == 4 && l.extra == 1:
+		return color.RGBAModel
+	case l.photometric == photometricRGB && l.spp == 4:
+		return color.NRGBAModel
+	case l.photometric == photometricRGB:
+		return color.RGBAModel
+	case l.photometric == photometricPalette:
+		return color.RGBAModel
+	}
+	return color.GrayModel
+}
+
+// 幅 width の 1 行のバイト数
+func (l layout) rowBytes(width int) int {
+	return (width*l.spp*l.bps + 7) / 8
+}
+
+// i ページ目の大きさと色のモデルを返却
+func (f *File) Config(i int) (image.Config, error) {
+	l, err := f.layout(f.ifds[i])
+	if err != nil {
+		return image.Config{}, err
+	}
+	return image.Config{ColorModel: l.colorModel(), Width: l.width, Height: l.height}, nil
+}
+
+// i ページ目をデコード
+func (f *File) Page(i int) (*Page, error) {
+	d := f.ifds[i]
+	l, err := f.layout(d)
+	if err != nil {
+		return nil, err
+	}
+	img, err := f.newImage(d, l)
+	if err != nil {
+		return nil, err
+	}
+
+	// ストリップは幅が画像と同じで高さが RowsPerStrip のタイルとして扱う
+	blockWidth, blockHeight := l.width, l.height
+	offsets, counts := tagStripOffsets, tagStripByteCounts
+	if _, tiled := d[tagTileWidth]; tiled {
+		w, err := f.uint(d, tagTileWidth, 0)
+		if err != nil {
+			return nil, err
+		}
+		h, err := f.uint(d, tagTileLength, 0)
+		if err != nil {
+			return nil, err
+		}
+		if w == 0 || h == 0 || w > 1<<16 || h > 1<<16 {
+			return nil, FormatError("bad tile size")
+		}
+		blockWidth, blockHeight = int(w), int(h)
+		offsets, counts = tagTileOffsets, tagTileByteCounts
+	} else {
+		rows, err := f.uint(d, tagRowsPerStrip, uint32(l.height))
+		if err != nil {
+			return nil, err
+		}
+		if rows > 0 && int(rows) < l.height {
+			blockHeight = int(rows)
+		}
+	}
+	blockOffsets, err := f.uints(d, uint16(offsets))
+	if err != nil {
+		return nil, err
+	}
+	blockCounts, err := f.uints(d, uint16(counts))
+	if err != nil {
+		return nil, err
+	}
+	across := (l.width + blockWidth - 1) / blockWidth
+	down := (l.height + blockHeight - 1) / blockHeight
+	if len(blockOffsets) < across*down || len(blockCounts) < across*down {
+		return nil, FormatError("missing strip or tile offsets")
+	}
+
+	for by := 0; by < down; by++ {
+		for bx := 0; bx < across; bx++ {
+			n := by*across + bx
+			start, size := int64(blockOffsets[n]), int64(blockCounts[n])
+			if start+size > int64(len(f.data)) {
+				return nil, FormatError("strip or tile out of range")
+			}
+			// ストリップの最後は画像の下端で切れるが、タイルは常に同じ大きさで符号化される
+			height := blockHeight
+			if offsets == tagStripOffsets {
+				height = min(blockHeight, l.height-by*blockHeight)
+			}
+			buf, err := decompress(l.compression, f.data[start:start+size], l.rowBytes(blockWidth)*height)
+			if err != nil {
+				return nil, err
+			}
+			if l.predictor == 2 {
+				undoPredictor(buf, l.rowBytes(blockWidth), l.spp)
+			}
+			rect := image.Rect(bx*blockWidth, by*blockHeight, (bx+1)*blockWidth, by*blockHeight+height).Intersect(img.Bounds())
+			l.copyBlock(img, rect, buf, l.rowBytes(blockWidth))
+		}
+	}
+
+	unit, err := f.uint(d, tagResolutionUnit, 0)
+	if err != nil {
+		return nil, err
+	}
+	return &Page{
+		Image: img,
+		Resolution: Resolution{
+			X:    f.rational(d, tagXResolution),
+			Y:    f.rational(d, tagYResolution),
+			Unit: uint16(unit),
+		},
+	}, nil
+}
+
+// ページの形式に合わせた画像を確保
+func (f *File) newImage(d ifd, l layout) (image.Image, error) {
+	rect := image.Rect(0, 0, l.width, l.height)
+	switch l.colorModel() {
+	case color.GrayModel:
+		return image.NewGray(rect), nil
+	case color.NRGBAModel:
+		return image.NewNRGBA(rect), nil
+	}
+	if l.photometric != photometricPalette {
+		return image.NewRGBA(rect), nil
+	}
+
+	cmap, err := f.uints(d, tagColorMap)
+	if err != nil {
+		return nil, err
+	}
+	n := 1 << l.bps
+	if len(cmap) < 3*n {
+		return nil, FormatError("short color map")
+	}
+	palette := make(color.Palette, n)
+	for i := range palette {
+		palette[i] = color.RGBA{uint8(cmap[i] >> 8), uint8(cmap[n+i] >> 8), uint8(cmap[2*n+i] >> 8), 0xff}
+	}
+	return image.NewPaletted(rect, palette), nil
+}
+
+// 展開したストリップまたはタイルの画素を img の rect に書き込む
+// buf の 1 行は stride バイトで、rect より右と下の部分 (タイルの余白) は捨てる
+func (l layout) copyBlock(img image.Image, rect image.Rectangle, buf []byte, stride int) {
+	for y := rect.Min.Y; y < rect.Max.Y; y++ {
+		row := buf[(y-rect.Min.Y)*stride:]
+		switch img := img.(type) {
+		case *image.RGBA:
+			dst := img.Pix[img.PixOffset(rect.Min.X, y):]
+			for x := 0; x < rect.Dx(); x++ {
+				s := row[x*l.spp:]
+				a := uint8(0xff)
+				if l.spp == 4 {
+					a = s[3]
+				}
+				dst[4*x], dst[4*x+1], dst[4*x+2], dst[4*x+3] = s[0], s[1], s[2], a
+			}
+		case *image.NRGBA:
+			copy(img.Pix[img.PixOffset(rect.Min.X, y):], row[:4*rect.Dx()])
+		case *image.Gray:
+			dst := img.Pix[img.PixOffset(rect.Min.X, y):]
+			maxValue := 1<<l.bps - 1
+			for x := 0; x < rect.Dx(); x++ {
+				v := l.sample(row, x)
+				if l.photometric == photometricWhiteIsZero {
+					v = maxValue - v
+				}
+				dst[x] = uint8(v * 0xff / maxValue)
+			}
+		case *image.Paletted:
+			dst := img.Pix[img.PixOffset(rect.Min.X, y):]
+			for x := 0; x < rect.Dx(); x++ {
+				dst[x] = uint8(l.sample(row, x))
+			}
+		}
+	}
+}
+
+// 1 サンプルの画素の x 番目の値
+func (l layout) sample(row []byte, x int) int {
+	if l.bps == 8 {
+		return int(row[x])
+	}
+	bit := x * l.bps
+	return int(row[bit/8]>>(8-l.bps-bit%8)) & (1<<l.bps - 1)
+}
+
+// 水平差分の予測を元に戻す
+func undoPredictor(buf []byte, stride, spp int) {
+	for row := 0; row+stride <= len(buf); row += stride {
+		for i := row + spp; i < row+stride; i++ {
+			buf[i] += buf[i-spp]
+		}
+	}
+}
+
+// 圧縮されたストリップまたはタイルを n バイトに展開
+func decompress(compression uint32, src []byte, n int) ([]byte, error) {
+	var (
+		buf []byte
+		err error
+	)
+	switch compression {
+	case compressionNone:
+		buf = src
+	case compressionPackBits:
+		buf, err = decodePackBits(src, n)
+	case compressionLZW:
+		buf, err = decodeLZW(src, n)
+	case compressionDeflate, compressionDeflateX:
+		var zr io.ReadCloser
+		zr, err = zlib.NewReader(bytes.NewReader(src))
+		if err == nil {
+			buf = make([]byte, n)
+			_, err = io.ReadFull(zr, buf)
+			zr.Close()
+		}
+	}
+	if err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil, FormatError("short strip or tile data")
+		}
+		return nil, err
+	}
+	if len(buf) < n {
+		return nil, FormatError("short strip or tile data")
+	}
+	return buf[:n], nil
+}
+
+// PackBits を n バイトまで展開
+func decodePackBits(src []byte, n int) ([]byte, error) {
+	buf := make([]byte, 0, n)
+	for i := 0; i < len(src) && len(buf) < n; {
+		c := int(int8(src[i]))
+		i++
+		switch {
+		case c >= 0:
+			if i+c+1 > len(src) {
+				return nil, io.ErrUnexpectedEOF
+			}
+			buf = append(buf, src[i:i+c+1]...)
+			i += c + 1
+		case c > -128:
+			if i >= len(src) {
+				return nil, io.ErrUnexpectedEOF
+			}
+			for j := 0; j < 1-c; j++ {
+				buf = append(buf, src[i])
+			}
+			i++
+		}
+	}
+	return buf, nil
+}
@@ -0,0 +1,212 @@
+package tiff
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"math"
+	"testing"
+)
+
+// 座標から決まる画素を持つ画像 (translucent の場合は一部を半透明にする)
+func testImage(w, h int, translucent bool) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			a := uint8(255)
+			if translucent && (x+y)%3 == 0 {
+				a = uint8(x * 7)
+			}
+			img.SetNRGBA(x, y, color.NRGBA{uint8(x * 5), uint8(y * 3), uint8(x ^ y), a})
+		}
+	}
+	return img
+}
+
+func testGray(w, h int) *image.Gray {
+	img := image.NewGray(image.Rect(0, 0, w, h))
+	for i := range img.Pix {
+		img.Pix[i] = uint8(i * 11)
+	}
+	return img
+}
+
+// a と b の画素が NRGBA として一致するか確かめる
+func assertSamePixels(t *testing.T, name string, got, want image.Image) {
+	t.Helper()
+	if got.Bounds() != want.Bounds() {
+		t.Fatalf("%s: bounds %v, want %v", name, got.Bounds(), want.Bounds())
+	}
+	b := want.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			g := color.NRGBAModel.Convert(got.At(x, y))
+			w := color.NRGBAModel.Convert(want.At(x, y))
+			if g != w {
+				t.Fatalf("%s: pixel (%d, %d) = %v, want %v", name, x, y, g, w)
+			}
+		}
+	}
+}
+
+func TestEncoderMultiPageRoundTrip(t *testing.T) {
+	pages := []struct {
+		img   image.Image
+		res   Resolution
+		model color.Model
+	}{
+		{testImage(40, 30, false), ResolutionDPI(300), color.RGBAModel},
+		{testGray(17, 50), Resolution{X: Rational{72, 1}, Y: Rational{144, 1}, Unit: 2}, color.GrayModel},
+		// 64 KiB を超えるため複数のストリップになる
+		{testImage(200, 150, true), Resolution{}, color.NRGBAModel},
+	}
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf, len(pages))
+	for _, p := range pages {
+		if err := enc.Encode(p.img, p.res); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := enc.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	file, err := Parse(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if file.NumPages() != len(pages) {
+		t.Fatalf("NumPages = %d, want %d", file.NumPages(), len(pages))
+	}
+	for i, want := range pages {
+		config, err := file.Config(i)
+		if err != nil {
+			t.Fatal(err)
+		}
+		size := want.img.Bounds().Size()
+		if config.Width != size.X || config.Height != size.Y || config.ColorModel != want.model {
+			t.Errorf("page %d: config %dx%d, want %v", i+1, config.Width, config.Height, size)
+		}
+		page, err := file.Page(i)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if page.Resolution != want.res {
+			t.Errorf("page %d: resolution %+v, want %+v", i+1, page.Resolution, want.res)
+		}
+		assertSamePixels(t, "page", page.Image, want.img)
+	}
+	if dpi, ok := pages[0].res.DPI(); !ok || dpi != 300 {
+		t.Errorf("DPI = %v, %v, want 300", dpi, ok)
+	}
+
+	// 最初のページは image.Decode からも読める
+	img, format, err := image.Decode(bytes.NewReader(buf.Bytes()))
+	if err != nil || format != "tiff" {
+		t.Fatalf("image.Decode: %s, %v", format, err)
+	}
+	assertSamePixels(t, "image.Decode", img, pages[0].img)
+}
+
+func TestEncoderPageCount(t *testing.T) {
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf, 2)
+	if err := enc.Encode(testGray(4, 4), Resolution{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := enc.Close(); err == nil {
+		t.Error("Close after 1 of 2 pages succeeded")
+	}
+	if err := enc.Encode(testGray(4, 4), Resolution{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := enc.Encode(testGray(4, 4), Resolution{}); err == nil {
+		t.Error("third page accepted")
+	}
+	if err := NewEncoder(&buf, 1).Encode(image.NewGray(image.Rect(0, 0, 0, 4)), Resolution{}); err == nil {
+		t.Error("empty page accepted")
+	}
+}
+
+func TestTileEncoderRoundTrip(t *testing.T) {
+	for _, translucent := range []bool{false, true} {
+		// 右端と下端のタイルは画像からはみ出す
+		src := testImage(50, 40, translucent)
+		var buf bytes.Buffer
+		enc, err := NewTileEncoder(&buf, 50, 40, 16, 32, !translucent, ResolutionDPI(96))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for y := 0; y < 40; y += 32 {
+			for x := 0; x < 50; x += 16 {
+				if err := enc.WriteTile(src, image.Rect(x, y, x+16, y+32).Intersect(src.Rect)); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+		if err := enc.Close(); err != nil {
+			t.Fatal(err)
+		}
+		file, err := Parse(buf.Bytes())
+		if err != nil {
+			t.Fatal(err)
+		}
+		page, err := file.Page(0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertSamePixels(t, "tiled", page.Image, src)
+		if dpi, _ := page.Resolution.DPI(); dpi != 96 {
+			t.Errorf("DPI = %v, want 96", dpi)
+		}
+	}
+	if _, err := NewTileEncoder(&bytes.Buffer{}, 50, 40, 24, 16, true, Resolution{}); err == nil {
+		t.Error("tile width 24 accepted")
+	}
+}
+
+func TestDecodePackBits(t *testing.T) {
+	// TIFF 6.0 の仕様にある例
+	src := []byte{0xfe, 0xaa, 0x02, 0x80, 0x00, 0x2a, 0xfd, 0xaa, 0x03, 0x80, 0x00, 0x2a, 0x22, 0xf7, 0xaa}
+	want := []byte{0xaa, 0xaa, 0xaa, 0x80, 0x00, 0x2a, 0xaa, 0xaa, 0xaa, 0xaa, 0x80, 0x00, 0x2a, 0x22, 0xaa, 0xaa, 0xaa, 0xaa, 0xaa, 0xaa, 0xaa, 0xaa, 0xaa, 0xaa}
+	got, err := decodePackBits(src, len(want))
+	if err != nil || !bytes.Equal(got, want) {
+		t.Errorf("decodePackBits = % x, %v, want % x", got, err, want)
+	}
+}
+
+func TestParseRejectsMalformed(t *testing.T) {
+	for _, data := range [][]byte{
+		nil,
+		[]byte("II*\x00"),
+		[]byte("II*\x00\xff\xff\x00\x00"),
+		[]byte("XX*\x00\x08\x00\x00\x00"),
+	} {
+		if _, err := Parse(data); err == nil {
+			t.Errorf("Parse(%q) succeeded", data)
+		}
+	}
+}
+
+func TestResolutionDPI(t *testing.T) {
+	tests := []struct {
+		res Resolution
+		dpi float64 // 0 の場合は解像度がない
+	}{
+		{Resolution{X: Rational{300, 1}, Unit: 2}, 300},
+		{Resolution{X: Rational{720, 2}, Unit: 2}, 360},
+		{Resolution{X: Rational{300, 1}}, 300}, // ResolutionUnit のタグがない場合はインチ
+		{Resolution{X: Rational{100, 1}, Unit: 3}, 254},
+		{Resolution{X: Rational{300, 1}, Unit: 1}, 0},
+		{Resolution{X: Rational{300, 0}, Unit: 2}, 0},
+		{Resolution{X: Rational{0, 1}, Unit: 2}, 0},
+		{Resolution{}, 0},
+		{ResolutionDPI(96.5), 96.5},
+	}
+	for _, tt := range tests {
+		dpi, ok := tt.res.DPI()
+		if ok != (tt.dpi > 0) || math.Abs(dpi-tt.dpi) > 1e-9 {
+			t.Errorf("%+v: DPI = %g, %v, want %g", tt.res, dpi, ok, tt.dpi)
+		}
+	}
+}
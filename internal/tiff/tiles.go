@@ -0,0 +1,136 @@
+package tiff
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"math"
+	"sort"
+)
+
+// 1 ページの TIFF をタイル単位で書き出すエンコーダ
+// タイルは圧縮せずに書き込むため、各タイルの位置は先に決まり、IFD を先頭に書き込んだ後はタイルを届いた順に書き出せる
+// 保持するのはタイル 1 つ分の行だけで、画像の大きさによらない
+type TileEncoder struct {
+	w             io.Writer
+	width, height int
+	tileW, tileH  int
+	spp           int // 1 画素のサンプル数 (3 または 4)
+	next          int // 次に書き込むタイルの番号 (行優先)
+	tiles         int
+	row           []byte
+}
+
+// 幅 width × 高さ height の画像を tileW × tileH のタイルで書き出す TileEncoder を生成し、ヘッダーと IFD を書き込む
+// タイルの幅と高さは 16 の倍数でなければならない。opaque の場合は RGB、それ以外はアルファ付きの RGB で書き込む
+func NewTileEncoder(w io.Writer, width, height, tileW, tileH int, opaque bool, res Resolution) (*TileEncoder, error) {
+	if width <= 0 || height <= 0 {
+		return nil, errors.New("tiff: empty image")
+	}
+	if tileW <= 0 || tileH <= 0 || tileW%16 != 0 || tileH%16 != 0 {
+		return nil, fmt.Errorf("tiff: tile size %dx%d is not a multiple of 16", tileW, tileH)
+	}
+	e := &TileEncoder{w: w, width: width, height: height, tileW: tileW, tileH: tileH, spp: 4}
+	if opaque {
+		e.spp = 3
+	}
+	across, down := (width+tileW-1)/tileW, (height+tileH-1)/tileH
+	e.tiles = across * down
+	tileBytes := int64(tileW) * int64(tileH) * int64(e.spp)
+
+	bps := make([]uint32, e.spp)
+	for i := range bps {
+		bps[i] = 8
+	}
+	offsets := make([]uint32, e.tiles)
+	counts := make([]uint32, e.tiles)
+	fields := []field{
+		{tagImageWidth, typeLong, []uint32{uint32(width)}},
+		{tagImageLength, typeLong, []uint32{uint32(height)}},
+		{tagBitsPerSample, typeShort, bps},
+		{tagCompression, typeShort, []uint32{compressionNone}},
+		{tagPhotometric, typeShort, []uint32{photometricRGB}},
+		{tagSamplesPerPixel, typeShort, []uint32{uint32(e.spp)}},
+		{tagPlanarConfig, typeShort, []uint32{1}},
+		{tagTileWidth, typeLong, []uint32{uint32(tileW)}},
+		{tagTileLength, typeLong, []uint32{uint32(tileH)}},
+		{tagTileOffsets, typeLong, offsets},
+		{tagTileByteCounts, typeLong, counts},
+	}
+	if res.X.Den != 0 {
+		fields = append(fields, field{tagXResolution, typeRational, []uint32{res.X.Num, res.X.Den}})
+	}
+	if res.Y.Den != 0 {
+		fields = append(fields, field{tagYResolution, typeRational, []uint32{res.Y.Num, res.Y.Den}})
+	}
+	if res.Unit != 0 {
+		fields = append(fields, field{tagResolutionUnit, typeShort, []uint32{uint32(res.Unit)}})
+	}
+	if e.spp == 4 {
+		fields = append(fields, field{tagExtraSamples, typeShort, []uint32{2}})
+	}
+	sort.Slice(fields, func(i, j int) bool { return fields[i].tag < fields[j].tag })
+
+	// ヘッダー、IFD、4 バイトに収まらない値、タイルの順に並べる
+	const headerSize = 8
+	ifdSize := int64(2 + 12*len(fields) + 4)
+	extSize := int64(0)
+	for _, f := range fields {
+		if size := f.size(); size > 4 {
+			extSize += size
+		}
+	}
+	start := headerSize + ifdSize + extSize
+	if start+int64(e.tiles)*tileBytes > math.MaxUint32 {
+		return nil, errors.New("tiff: file is too large")
+	}
+	for i := range offsets {
+		offsets[i] = uint32(start + int64(i)*tileBytes)
+		counts[i] = uint32(tileBytes)
+	}
+	buf := []byte{'I', 'I', 42, 0, headerSize, 0, 0, 0}
+	buf = append(buf, (&Encoder{}).ifd(fields, headerSize+ifdSize, 0)...)
+	if _, err := w.Write(buf); err != nil {
+		return nil, err
+	}
+	e.row = make([]byte, tileW*e.spp)
+	return e, nil
+}
+
+// 次のタイルとして img の rect の範囲を書き込む
+// タイルは行優先の順に書き込み、rect の大きさは画像の端で切り詰めたタイルの大きさと同じでなければならない
+// 画像の外側にはみ出す部分は 0 で埋める
+func (e *TileEncoder) WriteTile(img *image.NRGBA, rect image.Rectangle) error {
+	if e.next >= e.tiles {
+		return fmt.Errorf("tiff: more than %d tiles written", e.tiles)
+	}
+	across := (e.width + e.tileW - 1) / e.tileW
+	tx, ty := e.next%across*e.tileW, e.next/across*e.tileH
+	want := image.Pt(min(e.tileW, e.width-tx), min(e.tileH, e.height-ty))
+	if rect.Size() != want || !rect.In(img.Rect) {
+		return fmt.Errorf("tiff: tile %d has size %v, want %v", e.next, rect.Size(), want)
+	}
+	for y := 0; y < e.tileH; y++ {
+		clear(e.row)
+		if y < want.Y {
+			pix := img.Pix[img.PixOffset(rect.Min.X, rect.Min.Y+y):]
+			for x := 0; x < want.X; x++ {
+				copy(e.row[x*e.spp:(x+1)*e.spp], pix[4*x:4*x+4])
+			}
+		}
+		if _, err := e.w.Write(e.row); err != nil {
+			return err
+		}
+	}
+	e.next++
+	return nil
+}
+
+// すべてのタイルを書き込んだか確認する
+func (e *TileEncoder) Close() error {
+	if e.next != e.tiles {
+		return fmt.Errorf("tiff: %d of %d tiles written", e.next, e.tiles)
+	}
+	return nil
+}
@@ -0,0 +1,240 @@
+package tiff
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"math"
+	"sort"
+)
+
+// 1 つのストリップに含める展開後のおおよそのバイト数
+const stripBytes = 64 << 10
+
+// ページを順に書き込み、複数ページの TIFF を書き出すエンコーダ
+// 各ページは書き込んだ時点で w に書き出すため、保持するのは書き込み中の 1 ページ分の圧縮結果だけで済む
+type Encoder struct {
+	w       io.Writer
+	pages   int   // 書き込むページ数
+	written int   // 書き込んだページ数
+	offset  int64 // 次に書き込む位置
+}
+
+// pages ページの TIFF を w に書き出す Encoder を生成
+// 各ページの IFD に次のページの位置を書き込むため、ページ数は先に決めておく
+func NewEncoder(w io.Writer, pages int) *Encoder {
+	return &Encoder{w: w, pages: pages}
+}
+
+// 書き込む値を持つタグ
+type field struct {
+	tag    uint16
+	typ    uint16
+	values []uint32 // RATIONAL の場合は分子と分母の組
+}
+
+// img を次のページとして書き込む
+// *image.Gray はグレースケール、不透明な画像は RGB、それ以外はアルファ付きの RGB で書き込む
+func (e *Encoder) Encode(img image.Image, res Resolution) error {
+	if e.written >= e.pages {
+		return fmt.Errorf("tiff: more than %d pages written", e.pages)
+	}
+	if e.written == 0 {
+		header := []byte{'I', 'I', 42, 0, 8, 0, 0, 0}
+		if _, err := e.w.Write(header); err != nil {
+			return err
+		}
+		e.offset = int64(len(header))
+	}
+
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if width <= 0 || height <= 0 {
+		return errors.New("tiff: empty image")
+	}
+	spp, photometric := 4, uint32(photometricRGB)
+	if _, ok := img.(*image.Gray); ok {
+		spp, photometric = 1, photometricBlackIsZero
+	} else if o, ok := img.(interface{ Opaque() bool }); ok && o.Opaque() {
+		spp = 3
+	}
+
+	// ストリップごとに圧縮する
+	rowBytes := width * spp
+	rowsPerStrip := max(1, stripBytes/rowBytes)
+	var (
+		strips bytes.Buffer
+		counts []uint32
+		row    = make([]byte, rowBytes)
+	)
+	zw := zlib.NewWriter(nil)
+	for y := 0; y < height; y += rowsPerStrip {
+		start := strips.Len()
+		zw.Reset(&strips)
+		for sy := y; sy < min(y+rowsPerStrip, height); sy++ {
+			readRow(row, img, bounds.Min.Y+sy, spp)
+			if _, err := zw.Write(row); err != nil {
+				return err
+			}
+		}
+		if err := zw.Close(); err != nil {
+			return err
+		}
+		counts = append(counts, uint32(strips.Len()-start))
+	}
+
+	offsets := make([]uint32, len(counts))
+	bps := make([]uint32, spp)
+	for i := range bps {
+		bps[i] = 8
+	}
+	fields := []field{
+		{tagImageWidth, typeLong, []uint32{uint32(width)}},
+		{tagImageLength, typeLong, []uint32{uint32(height)}},
+		{tagBitsPerSample, typeShort, bps},
+		{tagCompression, typeShort, []uint32{compressionDeflate}},
+		{tagPhotometric, typeShort, []uint32{photometric}},
+		{tagStripOffsets, typeLong, offsets},
+		{tagSamplesPerPixel, typeShort, []uint32{uint32(spp)}},
+		{tagRowsPerStrip, typeLong, []uint32{uint32(rowsPerStrip)}},
+		{tagStripByteCounts, typeLong, counts},
+		{tagPlanarConfig, typeShort, []uint32{1}},
+	}
+	if res.X.Den != 0 {
+		fields = append(fields, field{tagXResolution, typeRational, []uint32{res.X.Num, res.X.Den}})
+	}
+	if res.Y.Den != 0 {
+		fields = append(fields, field{tagYResolution, typeRational, []uint32{res.Y.Num, res.Y.Den}})
+	}
+	if res.Unit != 0 {
+		fields = append(fields, field{tagResolutionUnit, typeShort, []uint32{uint32(res.Unit)}})
+	}
+	if spp == 4 {
+		// アルファは乗算済みでない値 (unassociated alpha) で書き込む
+		fields = append(fields, field{tagExtraSamples, typeShort, []uint32{2}})
+	}
+	sort.Slice(fields, func(i, j int) bool { return fields[i].tag < fields[j].tag })
+
+	// IFD、4 バイトに収まらない値、ストリップの順に並べる
+	ifdSize := int64(2 + 12*len(fields) + 4)
+	extSize := int64(0)
+	for _, f := range fields {
+		if size := f.size(); size > 4 {
+			extSize += size
+		}
+	}
+	stripStart := e.offset + ifdSize + extSize
+	end := stripStart + int64(strips.Len())
+	if end%2 == 1 {
+		// IFD は偶数の位置から始める
+		end++
+	}
+	if end > math.MaxUint32 {
+		return errors.New("tiff: file is too large")
+	}
+	pos := uint32(stripStart)
+	for i, n := range counts {
+		offsets[i] = pos
+		pos += n
+	}
+
+	next := uint32(0)
+	if e.written+1 < e.pages {
+		next = uint32(end)
+	}
+	buf := e.ifd(fields, e.offset+ifdSize, next)
+	buf = append(buf, strips.Bytes()...)
+	if int64(len(buf))+e.offset < end {
+		buf = append(buf, 0)
+	}
+	if _, err := e.w.Write(buf); err != nil {
+		return err
+	}
+	e.offset = end
+	e.written++
+	return nil
+}
+
+// すべてのページを書き込んだか確認する
+func (e *Encoder) Close() error {
+	if e.written != e.pages {
+		return fmt.Errorf("tiff: %d of %d pages written", e.written, e.pages)
+	}
+	return nil
+}
+
+// 値のバイト数
+func (f field) size() int64 {
+	return int64(typeSizes[f.typ]) * int64(f.count())
+}
+
+// 値の個数
+func (f field) count() int {
+	if f.typ == typeRational {
+		return len(f.values) / 2
+	}
+	return len(f.values)
+}
+
+// IFD と 4 バイトに収まらない値のバイト列を組み立てる
+// ext は 4 バイトに収まらない値を書き込む位置
+func (e *Encoder) ifd(fields []field, ext int64, next uint32) []byte {
+	order := binary.LittleEndian
+	buf := order.AppendUint16(nil, uint16(len(fields)))
+	var values []byte
+	for _, f := range fields {
+		buf = order.AppendUint16(buf, f.tag)
+		buf = order.AppendUint16(buf, f.typ)
+		buf = order.AppendUint32(buf, uint32(f.count()))
+		var v []byte
+		for _, x := range f.values {
+			if f.typ == typeShort {
+				v = order.AppendUint16(v, uint16(x))
+			} else {
+				v = order.AppendUint32(v, x)
+			}
+		}
+		if len(v) <= 4 {
+			buf = append(buf, v...)
+			buf = append(buf, make([]byte, 4-len(v))...)
+			continue
+		}
+		buf = order.AppendUint32(buf, uint32(ext)+uint32(len(values)))
+		values = append(values, v...)
+	}
+	buf = order.AppendUint32(buf, next)
+	return append(buf, values...)
+}
+
+// img の y 行目を spp サンプルの画素として row に書き込む
+func readRow(row []byte, img image.Image, y, spp int) {
+	bounds := img.Bounds()
+	switch img := img.(type) {
+	case *image.Gray:
+		copy(row, img.Pix[img.PixOffset(bounds.Min.X, y):])
+		return
+	case *image.NRGBA:
+		pix := img.Pix[img.PixOffset(bounds.Min.X, y):]
+		if spp == 4 {
+			copy(row, pix[:len(row)])
+			return
+		}
+		for x := 0; x < bounds.Dx(); x++ {
+			row[3*x], row[3*x+1], row[3*x+2] = pix[4*x], pix[4*x+1], pix[4*x+2]
+		}
+		return
+	}
+	for x := 0; x < bounds.Dx(); x++ {
+		c := color.NRGBAModel.Convert(img.At(bounds.Min.X+x, y)).(color.NRGBA)
+		s := row[x*spp:]
+		s[0], s[1], s[2] = c.R, c.G, c.B
+		if spp == 4 {
+			s[3] = c.A
+		}
+	}
+}
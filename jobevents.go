@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/yashikota/go-streaming-image-mosaic/mosaic"
+)
+
+// 購読者ごとに送らずにためておける進捗のイベントの数
+// 受け取りが遅い購読者の分は捨て、処理を止めない
+const jobEventBuffer = 16
+
+// /jobs/{id}/events で送るイベント
+type jobEvent struct {
+	Type       string  `json:"type"` // progress、done または error
+	Percent    float64 `json:"percent"`
+	BandsDone  int     `json:"bands_done,omitempty"`
+	BandsTotal int     `json:"bands_total,omitempty"`
+	Elapsed    float64 `json:"elapsed_seconds"` // ジョブを登録してからの時間
+	Error      string  `json:"error,omitempty"`
+}
+
+// ジョブのイベントの購読
+// 進捗は events が一杯なら捨てるが、最後のイベントは容量 1 の final に必ず送る
+type jobSubscription struct {
+	events chan jobEvent
+	final  chan jobEvent
+}
+
+// ジョブのイベントを購読
+// 終了済みのジョブは、最後のイベントだけを送った購読を返却
+func (m *jobManager) subscribe(id string) (*jobSubscription, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	job, ok := m.store.Get(id)
+	if !ok {
+		return nil, errJobNotFound
+	}
+	sub := &jobSubscription{events: make(chan jobEvent, jobEventBuffer), final: make(chan jobEvent, 1)}
+	if job.finished() {
+		sub.final <- finalEvent(job)
+		return sub, nil
+	}
+	m.subscribers[id] = append(m.subscribers[id], sub)
+	return sub, nil
+}
+
+// 購読をやめる
+func (m *jobManager) unsubscribe(id string, sub *jobSubscription) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	subs := m.subscribers[id]
+	for i, s := range subs {
+		if s == sub {
+			m.subscribers[id] = append(subs[:i:i], subs[i+1:]...)
+			break
+		}
+	}
+	if len(m.subscribers[id]) == 0 {
+		delete(m.subscribers, id)
+	}
+}
+
+// 進捗のイベントを購読者に送る
+// 購読者の受け取りを待たない
+func (m *jobManager) publishProgress(id string, created time.Time, p mosaic.Progress) {
+	event := jobEvent{
+		Type:       "progress",
+		Percent:    p.Percent(),
+		BandsDone:  p.BandsDone,
+		BandsTotal: p.BandsTotal,
+		Elapsed:    time.Since(created).Seconds(),
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.progress[id] = p
+	for _, sub := range m.subscribers[id] {
+		select {
+		case sub.events <- event:
+		default:
+		}
+	}
+}
+
+// 終了したジョブの最後のイベントを購読者に送り、購読を終える
+// 最後のイベントのバンドの数は、最後に送った進捗のもの
+func (m *jobManager) publishFinished(id string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	job, ok := m.store.Get(id)
+	if !ok || !job.finished() {
+		return
+	}
+	event := finalEvent(job)
+	if p, ok := m.progress[id]; ok {
+		event.BandsDone, event.BandsTotal = p.BandsDone, p.BandsTotal
+	}
+	for _, sub := range m.subscribers[id] {
+		sub.final <- event
+	}
+	delete(m.subscribers, id)
+	delete(m.progress, id)
+}
+
+// 終了したジョブの最後のイベント
+// キャンセルしたジョブは error にする
+func finalEvent(job Job) jobEvent {
+	event := jobEvent{Type: "done", Percent: job.Progress, Elapsed: job.FinishedAt.Sub(job.CreatedAt).Seconds()}
+	switch job.State {
+	case JobFailed:
+		event.Type, event.Error = "error", job.Error
+	case JobCanceled:
+		event.Type, event.Error = "error", "job canceled"
+	}
+	return event
+}
+
+// ジョブの進捗を Server-Sent Events で送る
+// 最後に done か error のイベントを送って接続を閉じる
+func (s *server) handleJobEvents(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	sub, err := s.jobs.subscribe(id)
+	if err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	defer s.jobs.unsubscribe(id, sub)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	rc := http.NewResponseController(w)
+	send := func(event jobEvent) error {
+		data, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, data); err != nil {
+			return err
+		}
+		return rc.Flush()
+	}
+	rc.Flush()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case event := <-sub.final:
+			send(event)
+			return
+		case event := <-sub.events:
+			if send(event) != nil {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,478 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/yashikota/go-streaming-image-mosaic/mosaic"
+)
+
+var (
+	errJobNotFound = errors.New("job not found")
+	errJobNotDone  = errors.New("job is not done")
+	errQueueFull   = errors.New("job queue is full")
+	errJobsClosed  = errors.New("server is shutting down")
+)
+
+// ジョブの状態
+type JobState string
+
+const (
+	JobQueued     JobState = "queued"
+	JobProcessing JobState = "processing"
+	JobDone       JobState = "done"
+	JobFailed     JobState = "failed"
+	JobCanceled   JobState = "canceled"
+)
+
+// 非同期ジョブの情報
+type Job struct {
+	ID         string    `json:"id"`
+	State      JobState  `json:"state"`
+	Progress   float64   `json:"progress"` // 進捗率 (%)
+	Error      string    `json:"error,omitempty"`
+	CreatedAt  time.Time `json:"created_at"`
+	FinishedAt time.Time `json:"finished_at"` // 終了していない場合はゼロ値
+	Format     string    `json:"format"`      // 出力の形式 (TIFF の入力は常に TIFF で出力する)
+}
+
+// ジョブが終了状態かどうか
+func (j Job) finished() bool {
+	return j.State == JobDone || j.State == JobFailed || j.State == JobCanceled
+}
+
+// ジョブと処理結果の保存先
+// 独自の実装に差し替えることで、外部ストレージに保存できる
+type JobStore interface {
+	Save(job Job) error
+	Get(id string) (Job, bool)
+	SaveResult(id string, data []byte) error
+	Result(id string) ([]byte, bool)
+	Delete(id string) error
+	// before より前に終了したジョブを削除し、削除した件数を返却
+	DeleteExpired(before time.Time) int
+}
+
+// メモリ上にジョブを保持する JobStore
+type memoryJobStore struct {
+	mu      sync.RWMutex
+	jobs    map[string]Job
+	results map[string][]byte
+}
+
+func newMemoryJobStore() *memoryJobStore {
+	return &memoryJobStore{
+		jobs:    map[string]Job{},
+		results: map[string][]byte{},
+	}
+}
+
+func (s *memoryJobStore) Save(job Job) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.jobs[job.ID] = job
+	return nil
+}
+
+func (s *memoryJobStore) Get(id string) (Job, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	job, ok := s.jobs[id]
+	return job, ok
+}
+
+func (s *memoryJobStore) SaveResult(id string, data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.results[id] = data
+	return nil
+}
+
+func (s *memoryJobStore) Result(id string) ([]byte, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	data, ok := s.results[id]
+	return data, ok
+}
+
+func (s *memoryJobStore) Delete(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.jobs, id)
+	delete(s.results, id)
+	return nil
+}
+
+func (s *memoryJobStore) DeleteExpired(before time.Time) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := 0
+	for id, job := range s.jobs {
+		if job.finished() && job.FinishedAt.Before(before) {
+			delete(s.jobs, id)
+			delete(s.results, id)
+			n++
+		}
+	}
+	return n
+}
+
+// キューに積まれたジョブ
+type queuedJob struct {
+	id       string
+	input    []byte
+	pipeline pipeline
+	ctx      context.Context
+	created  time.Time
+}
+
+// ワーカープールでジョブを処理する構造体
+type jobManager struct {
+	store   JobStore
+	queue   chan queuedJob
+	ttl     time.Duration
+	mu      sync.Mutex // ジョブの状態更新を直列化する
+	cancels map[string]context.CancelFunc
+	closed  bool // 新しいジョブを受け付けない (queue は閉じている)
+
+	subscribers map[string][]*jobSubscription // ジョブごとのイベントの購読者
+	progress    map[string]mosaic.Progress    // 処理中のジョブの最後の進捗
+
+	done      chan struct{} // 閉じると期限切れジョブの掃除を止める
+	closeOnce sync.Once
+	wg        sync.WaitGroup // ワーカーと掃除の終了を待つ
+}
+
+// ワーカーと期限切れジョブの掃除を開始
+func newJobManager(store JobStore, workers, queueSize int, ttl time.Duration) *jobManager {
+	m := &jobManager{
+		store:   store,
+		queue:   make(chan queuedJob, queueSize),
+		ttl:     ttl,
+		cancels: map[string]context.CancelFunc{},
+
+		subscribers: map[string][]*jobSubscription{},
+		progress:    map[string]mosaic.Progress{},
+		done:        make(chan struct{}),
+	}
+	m.wg.Add(workers + 1)
+	for i := 0; i < workers; i++ {
+		go m.worker()
+	}
+	go m.cleanup()
+	return m
+}
+
+// 新しいジョブの受け付けを止め、キューに積まれたジョブと処理中のジョブの終了を待つ
+// 期限切れジョブの掃除も止める
+// ctx が終わるまでに終わらなかったジョブはキャンセルし、ctx のエラーを返却
+func (m *jobManager) Close(ctx context.Context) error {
+	m.stopIntake()
+	m.closeOnce.Do(func() { close(m.done) })
+	stopped := make(chan struct{})
+	go func() {
+		m.wg.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+		return nil
+	case <-ctx.Done():
+	}
+	m.mu.Lock()
+	ids := make([]string, 0, len(m.cancels))
+	for id := range m.cancels {
+		ids = append(ids, id)
+	}
+	m.mu.Unlock()
+	for _, id := range ids {
+		m.cancel(id)
+	}
+	return ctx.Err()
+}
+
+// 新しいジョブの受け付けを止める
+// キューに積まれたジョブは、ワーカーが処理し終えてから終了する
+func (m *jobManager) stopIntake() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.closed {
+		m.closed = true
+		close(m.queue)
+	}
+}
+
+// ジョブを登録してキューに積む
+func (m *jobManager) submit(input []byte, p pipeline) (Job, error) {
+	id, err := newJobID()
+	if err != nil {
+		return Job{}, err
+	}
+	job := Job{ID: id, State: JobQueued, CreatedAt: time.Now(), Format: p.encoderName()}
+	if err := m.store.Save(job); err != nil {
+		return Job{}, err
+	}
+
+	// ワーカーは状態の更新で m.mu を待つので、キャンセル関数の登録より先に処理を始めない
+	ctx, cancel := context.WithCancel(context.Background())
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	err = errJobsClosed
+	if !m.closed {
+		select {
+		case m.queue <- queuedJob{id: id, input: input, pipeline: p, ctx: ctx, created: job.CreatedAt}:
+			m.cancels[id] = cancel
+			return job, nil
+		default:
+			err = errQueueFull
+		}
+	}
+	cancel()
+	m.store.Delete(id)
+	return Job{}, err
+}
+
+// ジョブの状態を更新
+// 終了済みのジョブは更新しない
+func (m *jobManager) update(id string, fn func(*Job)) (Job, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	job, ok := m.store.Get(id)
+	if !ok {
+		return Job{}, errJobNotFound
+	}
+	if job.finished() {
+		return job, nil
+	}
+	fn(&job)
+	return job, m.store.Save(job)
+}
+
+// ジョブを終了状態にする
+func (m *jobManager) finish(id string, result []byte, err error) {
+	m.mu.Lock()
+	if cancel, ok := m.cancels[id]; ok {
+		cancel()
+		delete(m.cancels, id)
+	}
+	m.mu.Unlock()
+
+	if err == nil {
+		if serr := m.store.SaveResult(id, result); serr != nil {
+			err = serr
+		}
+	}
+	m.update(id, func(job *Job) {
+		job.FinishedAt = time.Now()
+		switch {
+		case errors.Is(err, context.Canceled):
+			job.State = JobCanceled
+		case err != nil:
+			job.State = JobFailed
+			job.Error = err.Error()
+		default:
+			job.State = JobDone
+			job.Progress = 100
+		}
+	})
+	m.publishFinished(id)
+}
+
+// ジョブをキャンセル
+func (m *jobManager) cancel(id string) (Job, error) {
+	job, err := m.update(id, func(job *Job) {
+		job.State = JobCanceled
+		job.FinishedAt = time.Now()
+	})
+	if err != nil {
+		return Job{}, err
+	}
+
+	m.mu.Lock()
+	if cancel, ok := m.cancels[id]; ok {
+		cancel()
+		delete(m.cancels, id)
+	}
+	m.mu.Unlock()
+	m.publishFinished(id)
+	return job, nil
+}
+
+// キューからジョブを取り出して処理
+func (m *jobManager) worker() {
+	defer m.wg.Done()
+	for qj := range m.queue {
+		if qj.ctx.Err() != nil {
+			continue
+		}
+		m.update(qj.id, func(job *Job) {
+			job.State = JobProcessing
+		})
+		progress := func(p mosaic.Progress) {
+			m.update(qj.id, func(job *Job) {
+				job.Progress = p.Percent()
+			})
+			m.publishProgress(qj.id, qj.created, p)
+		}
+		var buf bytes.Buffer
+		err := qj.pipeline.run(qj.ctx, "job "+qj.id, bytes.NewReader(qj.input), &buf, progress)
+		m.finish(qj.id, buf.Bytes(), err)
+	}
+}
+
+// 保持期間を過ぎたジョブを done が閉じられるまで定期的に削除
+func (m *jobManager) cleanup() {
+	defer m.wg.Done()
+	interval := max(m.ttl/2, time.Second)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-m.done:
+			return
+		case now := <-ticker.C:
+			m.deleteExpired(now.Add(-m.ttl))
+		}
+	}
+}
+
+// before より前に終了したジョブを削除し、削除した件数を返却
+// ストアから消えたジョブの購読者、進捗、キャンセル関数も合わせて捨てる
+func (m *jobManager) deleteExpired(before time.Time) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n := m.store.DeleteExpired(before)
+	gone := func(id string) bool {
+		_, ok := m.store.Get(id)
+		return !ok
+	}
+	for id, subs := range m.subscribers {
+		if gone(id) {
+			for _, sub := range subs {
+				sub.final <- jobEvent{Type: "error", Error: errJobNotFound.Error()}
+			}
+			delete(m.subscribers, id)
+		}
+	}
+	for id := range m.progress {
+		if gone(id) {
+			delete(m.progress, id)
+		}
+	}
+	for id, cancel := range m.cancels {
+		if gone(id) {
+			cancel()
+			delete(m.cancels, id)
+		}
+	}
+	return n
+}
+
+// キューで待機しているジョブ数
+func (m *jobManager) queueDepth() int {
+	return len(m.queue)
+}
+
+// ランダムなジョブ ID を生成
+func newJobID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// ステータス API のレスポンス
+type jobStatus struct {
+	Job
+	QueueDepth int `json:"queue_depth"`
+}
+
+// ジョブを登録し、ジョブ ID を即座に返却
+func (s *server) handleSubmitJob(w http.ResponseWriter, r *http.Request) {
+	p, err := s.pipelineFromQuery(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	// リクエスト終了後も処理を続けるため、ボディを読み切っておく
+	input, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, bodyStatus(err), err)
+		return
+	}
+
+	// 上限を超える画像は、キューに積む前に拒否する
+	var tooLarge *ErrImageTooLarge
+	if _, err := p.limits.check(bytes.NewReader(input)); errors.As(err, &tooLarge) {
+		writeError(w, http.StatusRequestEntityTooLarge, err)
+		return
+	}
+
+	job, err := s.jobs.submit(input, p)
+	if errors.Is(err, errQueueFull) || errors.Is(err, errJobsClosed) {
+		writeError(w, http.StatusServiceUnavailable, err)
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	w.Header().Set("Location", "/jobs/"+job.ID)
+	writeJSON(w, http.StatusAccepted, jobStatus{Job: job, QueueDepth: s.jobs.queueDepth()})
+}
+
+// ジョブの状態を返却
+func (s *server) handleJobStatus(w http.ResponseWriter, r *http.Request) {
+	job, ok := s.jobs.store.Get(r.PathValue("id"))
+	if !ok {
+		writeError(w, http.StatusNotFound, errJobNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, jobStatus{Job: job, QueueDepth: s.jobs.queueDepth()})
+}
+
+// 完了したジョブの処理結果を返却
+func (s *server) handleJobResult(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	job, ok := s.jobs.store.Get(id)
+	if !ok {
+		writeError(w, http.StatusNotFound, errJobNotFound)
+		return
+	}
+	if job.State != JobDone {
+		writeError(w, http.StatusConflict, errJobNotDone)
+		return
+	}
+	result, ok := s.jobs.store.Result(id)
+	if !ok {
+		writeError(w, http.StatusNotFound, errJobNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", outputContentType(result, job.Format))
+	io.Copy(w, bytes.NewReader(result))
+}
+
+// ジョブをキャンセル
+func (s *server) handleCancelJob(w http.ResponseWriter, r *http.Request) {
+	job, err := s.jobs.cancel(r.PathValue("id"))
+	if errors.Is(err, errJobNotFound) {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, jobStatus{Job: job, QueueDepth: s.jobs.queueDepth()})
+}
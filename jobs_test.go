@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"image"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/yashikota/go-streaming-image-mosaic/mosaic"
+)
+
+// method で url にリクエストし、ステータスとボディを返却
+func doRequest(t *testing.T, method, url string, body io.Reader) (int, []byte) {
+	t.Helper()
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, data
+}
+
+// ジョブが終了するまで状態を取得し続ける
+func waitJob(t *testing.T, url, id string) jobStatus {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		code, body := doRequest(t, http.MethodGet, url+"/jobs/"+id, nil)
+		if code != http.StatusOK {
+			t.Fatalf("GET /jobs/%s: status %d: %s", id, code, body)
+		}
+		var st jobStatus
+		if err := json.Unmarshal(body, &st); err != nil {
+			t.Fatal(err)
+		}
+		if st.finished() {
+			return st
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("job %s did not finish", id)
+	return jobStatus{}
+}
+
+func TestJobAPI(t *testing.T) {
+	ts, s := newTestServer(t)
+	input := encodeTestImage(t, testImage(64, 48), "png")
+
+	code, body := doRequest(t, http.MethodPost, ts.URL+"/jobs?tile=8&format=png", bytes.NewReader(input))
+	if code != http.StatusAccepted {
+		t.Fatalf("POST /jobs: status %d: %s", code, body)
+	}
+	var submitted jobStatus
+	if err := json.Unmarshal(body, &submitted); err != nil {
+		t.Fatal(err)
+	}
+	if submitted.ID == "" || submitted.State != JobQueued || submitted.Format != "png" {
+		t.Fatalf("submitted %+v", submitted)
+	}
+
+	st := waitJob(t, ts.URL, submitted.ID)
+	if st.State != JobDone || st.Progress != 100 || st.FinishedAt.IsZero() {
+		t.Fatalf("finished %+v", st)
+	}
+
+	// 結果は同期 API と同じ画像
+	code, result := doRequest(t, http.MethodGet, ts.URL+"/jobs/"+st.ID+"/result", nil)
+	if code != http.StatusOK {
+		t.Fatalf("GET result: status %d: %s", code, result)
+	}
+	code, want := doRequest(t, http.MethodPost, ts.URL+"/process?tile=8&format=png", bytes.NewReader(input))
+	if code != http.StatusOK {
+		t.Fatalf("POST /process: status %d", code)
+	}
+	if !bytes.Equal(result, want) {
+		t.Error("job result differs from /process")
+	}
+	img, _, err := image.Decode(bytes.NewReader(result))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if img.Bounds() != image.Rect(0, 0, 64, 48) {
+		t.Errorf("result bounds %v", img.Bounds())
+	}
+
+	// 期限切れで削除したジョブは状態も結果も 404
+	if n := s.jobs.deleteExpired(time.Now().Add(time.Second)); n != 1 {
+		t.Errorf("deleteExpired removed %d jobs, want 1", n)
+	}
+	for _, path := range []string{"/jobs/" + st.ID, "/jobs/" + st.ID + "/result", "/jobs/" + st.ID + "/events"} {
+		if code, _ := doRequest(t, http.MethodGet, ts.URL+path, nil); code != http.StatusNotFound {
+			t.Errorf("GET %s after expiry: status %d, want 404", path, code)
+		}
+	}
+	if code, _ := doRequest(t, http.MethodDelete, ts.URL+"/jobs/"+st.ID, nil); code != http.StatusNotFound {
+		t.Errorf("DELETE after expiry: status %d, want 404", code)
+	}
+}
+
+func TestJobAPIErrors(t *testing.T) {
+	ts, _ := newTestServer(t)
+	if code, _ := doRequest(t, http.MethodGet, ts.URL+"/jobs/unknown", nil); code != http.StatusNotFound {
+		t.Errorf("unknown job: status %d, want 404", code)
+	}
+	if code, _ := doRequest(t, http.MethodPost, ts.URL+"/jobs?tile=x", bytes.NewReader(nil)); code != http.StatusBadRequest {
+		t.Errorf("bad tile: status %d, want 400", code)
+	}
+}
+
+func TestJobExpiryKeepsUnfinished(t *testing.T) {
+	m := newJobManager(newMemoryJobStore(), 0, 1, time.Minute)
+	defer m.Close(context.Background())
+	now := time.Now()
+	m.store.Save(Job{ID: "queued", State: JobQueued, CreatedAt: now.Add(-time.Hour)})
+	m.store.Save(Job{ID: "old", State: JobDone, CreatedAt: now.Add(-time.Hour), FinishedAt: now.Add(-time.Hour)})
+	m.store.Save(Job{ID: "new", State: JobFailed, CreatedAt: now, FinishedAt: now})
+
+	if n := m.deleteExpired(now.Add(-time.Minute)); n != 1 {
+		t.Errorf("deleteExpired removed %d jobs, want 1", n)
+	}
+	for id, want := range map[string]bool{"queued": true, "old": false, "new": true} {
+		if _, ok := m.store.Get(id); ok != want {
+			t.Errorf("%s kept = %v, want %v", id, ok, want)
+		}
+	}
+}
+
+func TestJobExpiryPrunesManagerState(t *testing.T) {
+	m := newJobManager(newMemoryJobStore(), 0, 1, time.Minute)
+	defer m.Close(context.Background())
+	now := time.Now()
+	m.store.Save(Job{ID: "live", State: JobProcessing, CreatedAt: now})
+	liveSub, err := m.subscribe("live")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.publishProgress("live", now, mosaic.Progress{BandsDone: 1, BandsTotal: 4})
+
+	// ストアから消えたジョブの状態が残っている場合
+	goneSub := &jobSubscription{events: make(chan jobEvent, jobEventBuffer), final: make(chan jobEvent, 1)}
+	canceled := false
+	m.mu.Lock()
+	m.subscribers["gone"] = []*jobSubscription{goneSub}
+	m.progress["gone"] = mosaic.Progress{BandsDone: 2, BandsTotal: 4}
+	m.cancels["gone"] = func() { canceled = true }
+	m.mu.Unlock()
+
+	m.deleteExpired(now)
+
+	m.mu.Lock()
+	_, sub := m.subscribers["gone"]
+	_, prog := m.progress["gone"]
+	_, canc := m.cancels["gone"]
+	liveSubs, liveProg := len(m.subscribers["live"]), m.progress["live"]
+	m.mu.Unlock()
+	if sub || prog || canc {
+		t.Errorf("state of deleted job kept: subscribers %v, progress %v, cancels %v", sub, prog, canc)
+	}
+	if !canceled {
+		t.Error("cancel of deleted job not called")
+	}
+	select {
+	case event := <-goneSub.final:
+		if event.Type != "error" || event.Error != errJobNotFound.Error() {
+			t.Errorf("final event %+v", event)
+		}
+	default:
+		t.Error("subscriber of deleted job got no final event")
+	}
+	if liveSubs != 1 || liveProg.BandsDone != 1 {
+		t.Errorf("state of live job pruned: %d subscribers, progress %+v", liveSubs, liveProg)
+	}
+	select {
+	case event := <-liveSub.final:
+		t.Errorf("live subscriber got final event %+v", event)
+	default:
+	}
+}
+
+func TestJobManagerCloseStopsCleanup(t *testing.T) {
+	m := newJobManager(newMemoryJobStore(), 1, 1, time.Hour)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := m.Close(ctx); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	// 2 回目の Close も待たずに返る
+	if err := m.Close(ctx); err != nil {
+		t.Fatalf("second Close: %v", err)
+	}
+}
+
+func TestJobManagerCloseWaitsForQueuedJobs(t *testing.T) {
+	_, s := newTestServer(t)
+	m := newJobManager(newMemoryJobStore(), 1, 8, time.Hour)
+	input := encodeTestImage(t, testImage(256, 192), "png")
+	var ids []string
+	for i := 0; i < 4; i++ {
+		job, err := m.submit(input, s.pipeline)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, job.ID)
+	}
+	if err := m.Close(context.Background()); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	for _, id := range ids {
+		if job, _ := m.store.Get(id); job.State != JobDone {
+			t.Errorf("job %s: state %s after Close, want done", id, job.State)
+		}
+	}
+	if _, err := m.submit(input, s.pipeline); !errors.Is(err, errJobsClosed) {
+		t.Errorf("submit after Close: %v, want %v", err, errJobsClosed)
+	}
+}
+
+func TestJobManagerCloseCancelsOnTimeout(t *testing.T) {
+	_, s := newTestServer(t)
+	m := newJobManager(newMemoryJobStore(), 1, 8, time.Hour)
+	// 大きな画像を積んでおき、待たずに終わる ctx で閉じる
+	input := encodeTestImage(t, testImage(1024, 768), "png")
+	var ids []string
+	for i := 0; i < 4; i++ {
+		job, err := m.submit(input, s.pipeline)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, job.ID)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := m.Close(ctx); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Close: %v, want %v", err, context.Canceled)
+	}
+	m.Close(context.Background())
+	canceled := 0
+	for _, id := range ids {
+		job, _ := m.store.Get(id)
+		if !job.finished() {
+			t.Errorf("job %s: state %s after Close", id, job.State)
+		}
+		if job.State == JobCanceled {
+			canceled++
+		}
+	}
+	if canceled == 0 {
+		t.Error("no job was canceled")
+	}
+}
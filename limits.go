@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"image"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/yashikota/go-streaming-image-mosaic/mosaic"
+)
+
+// 画像の大きさが上限を超えていることを表すエラー
+type ErrImageTooLarge struct {
+	Width, Height int
+	Limit         string // 超えた上限 (例: "max-pixels 100000000")
+	Hint          string // 上限に収めるための案内 (空の場合は出力しない)
+}
+
+func (e *ErrImageTooLarge) Error() string {
+	msg := fmt.Sprintf("image is too large: %dx%d exceeds %s", e.Width, e.Height, e.Limit)
+	if e.Hint != "" {
+		msg += "; " + e.Hint
+	}
+	return msg
+}
+
+// デコードする画像の大きさの上限 (0 は無制限)
+type imageLimits struct {
+	maxWidth  int
+	maxHeight int
+	maxPixels int64
+}
+
+// いずれかの上限が設定されているかどうか
+func (l imageLimits) enabled() bool {
+	return l.maxWidth > 0 || l.maxHeight > 0 || l.maxPixels > 0
+}
+
+// 画像全体をデコードする前に、ヘッダーの大きさが上限を超えていないか確認する
+// 確認のために読んだ先頭部分を含めて画像全体を読み込める io.Reader を返却
+func (l imageLimits) check(r io.Reader) (io.Reader, error) {
+	if !l.enabled() {
+		return r, nil
+	}
+	br, header, err := peekHeader(r)
+	if err != nil {
+		// 大きさを確認できない画像はデコードしない
+		return nil, err
+	}
+	if err := l.checkConfig(header.config); err != nil {
+		return nil, err
+	}
+	return br, nil
+}
+
+// 画像の先頭部分から読んだヘッダー
+type imageHeader struct {
+	config image.Config
+	format string
+	data   []byte // 読んだ先頭部分 (次に読むまで有効)
+}
+
+// デコーダーが返す画像のバイト数
+func (h imageHeader) decodedBytes() int64 {
+	return decodedBytes(h.config, h.format, h.data)
+}
+
+// 画像の先頭部分のヘッダーを読む
+// 読んだ先頭部分を含めて画像全体を読み込める io.Reader を返却 (ヘッダーを読めなかった場合も返す)
+func peekHeader(r io.Reader) (io.Reader, imageHeader, error) {
+	br := bufio.NewReaderSize(r, infoHeaderLimit)
+	data, err := br.Peek(infoHeaderLimit)
+	if len(data) == 0 && err != nil {
+		return br, imageHeader{}, err
+	}
+	config, format, err := mosaic.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return br, imageHeader{}, fmt.Errorf("reading image header: %w", err)
+	}
+	return br, imageHeader{config: config, format: format, data: data}, nil
+}
+
+// 画像の大きさを上限と比較
+func (l imageLimits) checkConfig(c image.Config) error {
+	switch {
+	case l.maxWidth > 0 && c.Width > l.maxWidth:
+		return &ErrImageTooLarge{Width: c.Width, Height: c.Height, Limit: fmt.Sprintf("max-width %d", l.maxWidth)}
+	case l.maxHeight > 0 && c.Height > l.maxHeight:
+		return &ErrImageTooLarge{Width: c.Width, Height: c.Height, Limit: fmt.Sprintf("max-height %d", l.maxHeight)}
+	case l.maxPixels > 0 && int64(c.Width)*int64(c.Height) > l.maxPixels:
+		return &ErrImageTooLarge{Width: c.Width, Height: c.Height, Limit: fmt.Sprintf("max-pixels %d", l.maxPixels)}
+	}
+	return nil
+}
+
+// 画素数を表すフラグの値
+// 数値のほか、100MP のようにメガピクセル単位でも指定できる (0 は無制限)
+type pixelCount int64
+
+func (p *pixelCount) String() string {
+	if *p != 0 && *p%1000000 == 0 {
+		return strconv.FormatInt(int64(*p)/1000000, 10) + "MP"
+	}
+	return strconv.FormatInt(int64(*p), 10)
+}
+
+func (p *pixelCount) Set(s string) error {
+	num, scale := s, 1.0
+	if n, ok := strings.CutSuffix(strings.ToUpper(s), "MP"); ok {
+		num, scale = n, 1e6
+	}
+	v, err := strconv.ParseFloat(strings.TrimSpace(num), 64)
+	if err != nil || v < 0 {
+		return fmt.Errorf("invalid pixel count %q (want e.g. 100MP or 100000000)", s)
+	}
+	*p = pixelCount(v * scale)
+	return nil
+}
+
+func (p *pixelCount) Get() any {
+	return p.String()
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// 幅と高さだけを書いた PNG のヘッダー (画素のデータはない)
+func pngHeader(w, h uint32) []byte {
+	ihdr := binary.BigEndian.AppendUint32([]byte("IHDR"), w)
+	ihdr = binary.BigEndian.AppendUint32(ihdr, h)
+	ihdr = append(ihdr, 8, 6, 0, 0, 0) // 8 ビットの RGBA
+	b := []byte("\x89PNG\r\n\x1a\n")
+	b = binary.BigEndian.AppendUint32(b, 13)
+	b = append(b, ihdr...)
+	return binary.BigEndian.AppendUint32(b, crc32.ChecksumIEEE(ihdr))
+}
+
+// 幅と高さだけを書いた GIF のヘッダー
+func gifHeader(w, h uint16) []byte {
+	b := []byte("GIF89a")
+	b = binary.LittleEndian.AppendUint16(b, w)
+	b = binary.LittleEndian.AppendUint16(b, h)
+	return append(b, 0, 0, 0)
+}
+
+// 幅と高さだけを書いた JPEG のヘッダー (SOI、JFIF の APP0 と 3 成分の SOF0)
+func jpegHeader(w, h uint16) []byte {
+	b := []byte{0xff, 0xd8, 0xff, 0xe0, 0, 16, 'J', 'F', 'I', 'F', 0, 1, 1, 0, 0, 1, 0, 1, 0, 0}
+	b = append(b, 0xff, 0xc0, 0, 17, 8)
+	b = binary.BigEndian.AppendUint16(b, h)
+	b = binary.BigEndian.AppendUint16(b, w)
+	return append(b, 3, 1, 0x22, 0, 2, 0x11, 1, 3, 0x11, 1)
+}
+
+func TestImageLimitsCraftedHeaders(t *testing.T) {
+	tests := []struct {
+		name   string
+		data   []byte
+		limits imageLimits
+		w, h   int
+		limit  string // 空の場合は上限を超えない
+	}{
+		{"png width", pngHeader(5000, 10), imageLimits{maxWidth: 4096}, 5000, 10, "max-width 4096"},
+		{"png height", pngHeader(10, 5000), imageLimits{maxWidth: 4096, maxHeight: 4096}, 10, 5000, "max-height 4096"},
+		{"png pixels", pngHeader(100000, 100000), imageLimits{maxPixels: serveMaxPixels}, 100000, 100000, "max-pixels 100000000"},
+		{"png at limits", pngHeader(4096, 4096), imageLimits{maxWidth: 4096, maxHeight: 4096, maxPixels: 4096 * 4096}, 4096, 4096, ""},
+		{"gif width", gifHeader(60000, 1), imageLimits{maxWidth: 50000}, 60000, 1, "max-width 50000"},
+		{"gif pixels", gifHeader(20000, 20000), imageLimits{maxPixels: serveMaxPixels}, 20000, 20000, "max-pixels 100000000"},
+		{"jpeg height", jpegHeader(16, 65000), imageLimits{maxHeight: 65000 - 1}, 16, 65000, "max-height 64999"},
+		{"jpeg pixels", jpegHeader(65000, 65000), imageLimits{maxPixels: 1_000_000_000}, 65000, 65000, "max-pixels 1000000000"},
+		{"jpeg unlimited", jpegHeader(65000, 65000), imageLimits{}, 65000, 65000, ""},
+	}
+	for _, tt := range tests {
+		if len(tt.data) > 1024 {
+			t.Fatalf("%s: fixture is %d bytes", tt.name, len(tt.data))
+		}
+		r, err := tt.limits.check(bytes.NewReader(tt.data))
+		if tt.limit == "" {
+			if err != nil {
+				t.Errorf("%s: %v", tt.name, err)
+				continue
+			}
+			// 確認のために読んだ先頭部分も含めて読める
+			if got, _ := io.ReadAll(r); !bytes.Equal(got, tt.data) {
+				t.Errorf("%s: reader returned %d bytes, want %d", tt.name, len(got), len(tt.data))
+			}
+			continue
+		}
+		var tooLarge *ErrImageTooLarge
+		if !errors.As(err, &tooLarge) {
+			t.Errorf("%s: %v, want *ErrImageTooLarge", tt.name, err)
+			continue
+		}
+		if tooLarge.Width != tt.w || tooLarge.Height != tt.h || tooLarge.Limit != tt.limit {
+			t.Errorf("%s: %dx%d %q, want %dx%d %q", tt.name, tooLarge.Width, tooLarge.Height, tooLarge.Limit, tt.w, tt.h, tt.limit)
+		}
+	}
+}
+
+func TestImageLimitsUnreadableHeader(t *testing.T) {
+	l := imageLimits{maxPixels: 1}
+	if _, err := l.check(strings.NewReader("not an image")); err == nil {
+		t.Error("unreadable header accepted")
+	}
+	if _, err := l.check(bytes.NewReader(pngHeader(10, 10)[:20])); err == nil {
+		t.Error("truncated header accepted")
+	}
+}
+
+func TestApplyImageLimits(t *testing.T) {
+	dir := t.TempDir()
+	bomb := filepath.Join(dir, "bomb.png")
+	writeTestFile(t, bomb, pngHeader(100000, 100000))
+	wide := filepath.Join(dir, "wide.png")
+	writeTestFile(t, wide, pngHeader(8000, 100))
+	heap := filepath.Join(dir, "heap.png")
+	writeTestFile(t, heap, pngHeader(4000, 4000))
+
+	tests := []struct {
+		in    string
+		args  []string
+		limit string
+	}{
+		{bomb, []string{"-max-pixels", "1000MP"}, "max-pixels 1000000000"},
+		{bomb, []string{"-max-pixels", "100MP"}, "max-pixels 100000000"},
+		{wide, []string{"-max-width", "4000"}, "max-width 4000"},
+		{wide, []string{"-max-height", "50"}, "max-height 50"},
+		{heap, []string{"-max-heap", "1MiB"}, "max-heap 1MiB"},
+	}
+	for _, tt := range tests {
+		args := append([]string{"apply", "-in", tt.in, "-out", filepath.Join(dir, "out.png"), "-tile", "8", "-quiet"}, tt.args...)
+		res := runCLI(t, args...)
+		if res.code != exitDecode || !strings.Contains(res.stderr, "exceeds "+tt.limit) {
+			t.Errorf("%v: exit %d, want %d with %q (stderr: %s)", tt.args, res.code, exitDecode, tt.limit, res.stderr)
+		}
+	}
+}
+
+func TestServerImageLimits(t *testing.T) {
+	ts, _ := newTestServer(t)
+	for _, path := range []string{"/process", "/jobs"} {
+		resp, body := postImage(t, ts.URL+path, bytes.NewReader(pngHeader(100000, 100000)))
+		assertJSONError(t, resp, body, http.StatusRequestEntityTooLarge)
+		if !strings.Contains(string(body), "max-pixels 100000000") {
+			t.Errorf("%s: %s", path, body)
+		}
+	}
+}
+
+// コマンドラインでは既定で上限を設けず、サーバーモードだけ -max-pixels の既定値を 100MP にする
+func TestMaxPixelsDefault(t *testing.T) {
+	if f := newApplyFlags(io.Discard); f.maxPixels != 0 || f.fs.Lookup("max-pixels").DefValue != "0" {
+		t.Errorf("apply: max-pixels = %v (default %q), want 0", f.maxPixels, f.fs.Lookup("max-pixels").DefValue)
+	}
+	if f := newServeFlags(io.Discard); f.maxPixels != serveMaxPixels || f.fs.Lookup("max-pixels").DefValue != "100MP" {
+		t.Errorf("serve: max-pixels = %v (default %q), want 100MP", f.maxPixels, f.fs.Lookup("max-pixels").DefValue)
+	}
+	res := runCLI(t, "apply", "-help")
+	if strings.Contains(res.stderr, "1000MP") || strings.Contains(res.stderr, "(default 100MP)") {
+		t.Errorf("apply -help shows a max-pixels default: %s", res.stderr)
+	}
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/yashikota/go-streaming-image-mosaic/mosaic"
+)
+
+// 記録したログの 1 件 (With で付けた属性も attrs に含める)
+type logEntry struct {
+	level slog.Level
+	msg   string
+	attrs map[string]any
+}
+
+// ログを記録する slog.Handler
+type recordingHandler struct {
+	mu      *sync.Mutex
+	entries *[]logEntry
+	attrs   []slog.Attr
+}
+
+func newRecordingLogger() (*slog.Logger, func() []logEntry) {
+	h := recordingHandler{mu: &sync.Mutex{}, entries: &[]logEntry{}}
+	return slog.New(h), func() []logEntry {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		return append([]logEntry(nil), *h.entries...)
+	}
+}
+
+func (recordingHandler) Enabled(context.Context, slog.Level) bool { return true }
+
+func (h recordingHandler) Handle(_ context.Context, r slog.Record) error {
+	e := logEntry{level: r.Level, msg: r.Message, attrs: map[string]any{}}
+	for _, a := range h.attrs {
+		e.attrs[a.Key] = a.Value.Any()
+	}
+	r.Attrs(func(a slog.Attr) bool {
+		e.attrs[a.Key] = a.Value.Any()
+		return true
+	})
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	*h.entries = append(*h.entries, e)
+	return nil
+}
+
+func (h recordingHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	h.attrs = append(append([]slog.Attr(nil), h.attrs...), attrs...)
+	return h
+}
+
+func (h recordingHandler) WithGroup(string) slog.Handler { return h }
+
+// msg のログ (記録した順)
+func entriesWithMessage(entries []logEntry, msg string) []logEntry {
+	var found []logEntry
+	for _, e := range entries {
+		if e.msg == msg {
+			found = append(found, e)
+		}
+	}
+	return found
+}
+
+// ファイルごとの開始と終了 (大きさと処理時間)、バンドごとの進捗 (デバッグ)、警告と失敗をログに出力する
+func TestPipelineLogEvents(t *testing.T) {
+	logger, entries := newRecordingLogger()
+	f := newBatchFlags(io.Discard)
+	// 画像からはみ出した範囲で警告する
+	if err := f.parse([]string{"-tile", "8", "-region", "16,0,64,16"}); err != nil {
+		t.Fatal(err)
+	}
+	fsys := fstest.MapFS{
+		"a.png":        {Data: encodeTestImage(t, testImage(40, 30), "png")},
+		"b-broken.png": {Data: []byte("\x89PNG\r\n\x1a\n broken")},
+		"notes.txt":    {Data: []byte("not an image")},
+		"sub/c.png":    {Data: encodeTestImage(t, testImage(24, 20), "png")},
+	}
+	report, _, err := batch{fsys: fsys, inName: "in", outDir: t.TempDir()}.run(context.Background(), f.pipeline(logger), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Failed != 1 {
+		t.Fatalf("%d files failed, want 1", report.Failed)
+	}
+	got := entries()
+
+	sizes := map[string][2]int64{filepath.Join("in", "a.png"): {40, 30}, filepath.Join("in", "sub", "c.png"): {24, 20}}
+	started := entriesWithMessage(got, "processing started")
+	if len(started) != len(report.Files) {
+		t.Errorf("%d files started, want %d", len(started), len(report.Files))
+	}
+	for _, e := range started {
+		if e.level != slog.LevelInfo || e.attrs["tile"] != int64(8) {
+			t.Errorf("processing started: %v %v", e.level, e.attrs)
+		}
+	}
+	finished := entriesWithMessage(got, "processing finished")
+	if len(finished) != len(sizes) {
+		t.Fatalf("%d files finished, want %d", len(finished), len(sizes))
+	}
+	for _, e := range finished {
+		size, ok := sizes[e.attrs["input"].(string)]
+		d, _ := e.attrs["duration"].(time.Duration)
+		if !ok || e.level != slog.LevelInfo || e.attrs["width"] != size[0] || e.attrs["height"] != size[1] || d <= 0 {
+			t.Errorf("processing finished: %v %v", e.level, e.attrs)
+		}
+	}
+
+	// バンドの進捗は、範囲と重なるタイルの行ごとにデバッグで出力する
+	bands := entriesWithMessage(got, "band processed")
+	if len(bands) == 0 {
+		t.Error("no band progress")
+	}
+	for _, e := range bands {
+		if e.level != slog.LevelDebug || e.attrs["bands_total"] == nil || e.attrs["input"] == nil {
+			t.Errorf("band processed: %v %v", e.level, e.attrs)
+		}
+	}
+
+	clipped := entriesWithMessage(got, "region extends outside the image; clipped to the image")
+	if len(clipped) != len(sizes) {
+		t.Errorf("region clipped %d times, want once per processed file", len(clipped))
+	}
+	for _, e := range clipped {
+		if e.level != slog.LevelWarn || e.attrs["code"] != string(mosaic.WarningRegionClipped) || e.attrs["input"] == nil {
+			t.Errorf("region clipped: %v %v", e.level, e.attrs)
+		}
+	}
+	if failed := entriesWithMessage(got, "file failed"); len(failed) != 1 || failed[0].level != slog.LevelError || failed[0].attrs["input"] != filepath.Join("in", "b-broken.png") {
+		t.Errorf("file failed: %+v", failed)
+	}
+}
+
+// 解像度を記録できない形式に -dpi を指定すると、解像度を書き出さないことを警告する
+func TestPipelineLogMetadataDropped(t *testing.T) {
+	src := encodeTestImage(t, testImage(40, 30), "png")
+	for _, tt := range []struct {
+		encoder string
+		warn    bool
+	}{
+		{"gif", true},
+		{"ppm", true},
+		{"png", false},
+		{"jpeg", false},
+	} {
+		logger, entries := newRecordingLogger()
+		f := newBatchFlags(io.Discard)
+		if err := f.parse([]string{"-tile", "8"}); err != nil {
+			t.Fatal(err)
+		}
+		p := f.pipeline(logger)
+		p.encoder = tt.encoder
+		p.encodeOpts.DPI = 300
+		if err := p.run(context.Background(), "in.png", bytes.NewReader(src), io.Discard, nil); err != nil {
+			t.Fatalf("%s: %v", tt.encoder, err)
+		}
+		dropped := entriesWithMessage(entries(), "resolution is not recorded in this output format")
+		if !tt.warn {
+			if len(dropped) != 0 {
+				t.Errorf("%s: resolution reported as dropped", tt.encoder)
+			}
+			continue
+		}
+		if len(dropped) != 1 {
+			t.Fatalf("%s: resolution dropped %d times, want 1", tt.encoder, len(dropped))
+		}
+		if e := dropped[0]; e.level != slog.LevelWarn || e.attrs["code"] != warnMetadataDropped || e.attrs["dpi"] != float64(300) || e.attrs["format"] != tt.encoder || e.attrs["input"] != "in.png" {
+			t.Errorf("%s: %v %v", tt.encoder, e.level, e.attrs)
+		}
+	}
+}
+
+// -log-format json は 1 行に 1 つの JSON のログを標準エラー出力に書く
+// -v ではバンドの進捗まで、-quiet では失敗だけを出力する
+func TestLogFormatJSON(t *testing.T) {
+	dir := t.TempDir()
+	in := filepath.Join(dir, "in.png")
+	writeTestImage(t, in, testImage(40, 30))
+	out := filepath.Join(dir, "out.gif")
+
+	for _, tt := range []struct {
+		args []string
+		msgs []string // 出力するログ
+		none []string // 出力しないログ
+	}{
+		{[]string{"-v"}, []string{"processing started", "band processed", "processing finished", "resolution is not recorded in this output format"}, nil},
+		{nil, []string{"processing started", "processing finished", "resolution is not recorded in this output format"}, []string{"band processed"}},
+		{[]string{"-quiet"}, nil, []string{"processing started", "band processed", "processing finished"}},
+	} {
+		args := append([]string{"apply", "-in", in, "-out", out, "-tile", "8", "-dpi", "300", "-log-format", "json"}, tt.args...)
+		res := runCLI(t, args...)
+		if res.code != exitOK {
+			t.Fatalf("%v: exit code = %d (stderr: %s)", tt.args, res.code, res.stderr)
+		}
+		levels := map[string]string{}
+		for _, line := range strings.Split(strings.TrimSpace(res.stderr), "\n") {
+			if line == "" {
+				continue
+			}
+			var record map[string]any
+			if err := json.Unmarshal([]byte(line), &record); err != nil {
+				t.Fatalf("%v: %q is not JSON: %v", tt.args, line, err)
+			}
+			msg, _ := record["msg"].(string)
+			levels[msg], _ = record["level"].(string)
+			if _, ok := record["time"]; !ok {
+				t.Errorf("%v: %q has no time", tt.args, line)
+			}
+		}
+		for _, msg := range tt.msgs {
+			if _, ok := levels[msg]; !ok {
+				t.Errorf("%v: %q not logged (stderr: %s)", tt.args, msg, res.stderr)
+			}
+		}
+		for _, msg := range tt.none {
+			if _, ok := levels[msg]; ok {
+				t.Errorf("%v: %q logged", tt.args, msg)
+			}
+		}
+		if level, ok := levels["band processed"]; ok && level != "DEBUG" {
+			t.Errorf("%v: band progress at level %s", tt.args, level)
+		}
+	}
+
+	if res := runCLI(t, "apply", "-in", in, "-out", out, "-log-format", "xml"); res.code != exitUsage || !strings.Contains(res.stderr, `unknown log format "xml"`) {
+		t.Errorf("-log-format xml: exit code = %d (stderr: %s)", res.code, res.stderr)
+	}
+}
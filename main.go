@@ -1,164 +1,167 @@
 package main
 
 import (
+	"errors"
+	"flag"
 	"fmt"
-	"image"
-	"image/color"
-	"image/draw"
-	"image/jpeg"
+	"io"
 	"os"
 )
 
-// モザイク処理に必要な情報を保持する構造体
-type MosaicProcessor struct {
-	img          *image.NRGBA // 元画像
-	mosaicWidth  int          // モザイクタイルの幅
-	mosaicHeight int          // モザイクタイルの高さ
-	buffer       *image.NRGBA // 一部画像を一時的に保持するバッファ
-	mosaicOffset int          // 処理中の画像のオフセット
-}
+// 診断メッセージの先頭に付けるプログラム名
+const progName = "mosaic"
+
+// 終了コード
+const (
+	exitOK      = 0 // 正常終了
+	exitGeneric = 1 // その他のエラー
+	exitUsage   = 2 // 引数の誤り
+	exitInput   = 3 // 入力を読み込めない
+	exitDecode  = 4 // 画像をデコードできない
+	exitOutput  = 5 // エンコードまたは出力の書き込みに失敗
+	exitPartial = 6 // 一部のファイルの処理に失敗 (バッチ処理)
+)
 
-// インスタンスを生成
-func NewMosaicProcessor(img *image.NRGBA, mosaicWidth, mosaicHeight int) *MosaicProcessor {
-	// バッファを生成 (画像の幅 × モザイクの高さ)
-	buffer := image.NewNRGBA(image.Rect(0, 0, img.Bounds().Max.X, mosaicHeight))
-	return &MosaicProcessor{
-		img:          img,
-		mosaicWidth:  mosaicWidth,
-		mosaicHeight: mosaicHeight,
-		buffer:       buffer,
-		mosaicOffset: 0,
-	}
+// 引数の誤りを表すエラー
+type usageError struct {
+	err error
 }
 
-// モザイク処理を実行し、処理後の画像を返却
-func (mp *MosaicProcessor) Process() *image.NRGBA {
-	bounds := mp.img.Bounds() // 元画像の範囲を取得
+func (e *usageError) Error() string { return e.err.Error() }
+func (e *usageError) Unwrap() error { return e.err }
 
-	// 出力画像を生成 (元画像と同じサイズ)
-	output := image.NewNRGBA(bounds)
-
-	// 画像をモザイクタイルの高さ単位で処理
-	for mp.mosaicOffset < bounds.Max.Y {
-		// バッファに画像の一部を読み込む
-		mp.readToBuffer()
-
-		// バッファ内のデータをモザイク処理
-		mp.applyMosaicToBuffer()
+// 入力の読み込みに失敗したことを表すエラー
+type inputError struct {
+	path string
+	err  error
+}
 
-		// 処理済みのデータを出力画像にコピー
-		mp.copyBufferToOutput(output)
+func (e *inputError) Error() string { return e.path + ": " + e.err.Error() }
+func (e *inputError) Unwrap() error { return e.err }
 
-		// 次の処理部分へオフセットを更新
-		mp.mosaicOffset += mp.mosaicHeight
+// 出力の書き込みに失敗したことを表すエラー
+type outputError struct {
+	path string
+	err  error
+}
 
-		fmt.Println(mp.mosaicOffset)
-	}
+func (e *outputError) Error() string { return e.path + ": " + e.err.Error() }
+func (e *outputError) Unwrap() error { return e.err }
 
-	return output
+// バッチ処理で一部のファイルが失敗したことを表すエラー
+type partialError struct {
+	failed int
+	total  int
 }
 
-// バッファに画像の一部を読み込む
-func (mp *MosaicProcessor) readToBuffer() {
-	// バッファに、元の画像から指定範囲をコピー
-	draw.Draw(mp.buffer, mp.buffer.Bounds(), mp.img, image.Point{0, mp.mosaicOffset}, draw.Src)
+func (e *partialError) Error() string {
+	return fmt.Sprintf("%d of %d files failed", e.failed, e.total)
 }
 
-// バッファ内のデータをモザイク処理
-func (mp *MosaicProcessor) applyMosaicToBuffer() {
-	bounds := mp.buffer.Bounds() // バッファの範囲を取得
-
-	// バッファをモザイクタイル単位で処理
-	for y := bounds.Min.Y; y < bounds.Max.Y; y += mp.mosaicHeight {
-		for x := bounds.Min.X; x < bounds.Max.X; x += mp.mosaicWidth {
-			// モザイクタイルの平均色を計算
-			avgColor := mp.averageColor(x, y, mp.mosaicWidth, mp.mosaicHeight)
-
-			// モザイクタイルを平均色で塗りつぶす
-			for dy := 0; dy < mp.mosaicHeight && y+dy < bounds.Max.Y; dy++ {
-				for dx := 0; dx < mp.mosaicWidth && x+dx < bounds.Max.X; dx++ {
-					mp.buffer.Set(x+dx, y+dy, avgColor)
-				}
-			}
-		}
-	}
+// サブコマンド
+type command struct {
+	name    string
+	summary string
+	flags   func(stderr io.Writer) *commonFlags // config print と設定ファイルのキーの検証に使う
+	run     func(args []string, stdout, stderr io.Writer) error
 }
 
-// 処理済みのデータを出力画像にコピー
-func (mp *MosaicProcessor) copyBufferToOutput(output *image.NRGBA) {
-	// コピーする高さを計算
-	copyHeight := min(mp.mosaicHeight, output.Bounds().Max.Y-mp.mosaicOffset)
-
-	// 出力画像に、バッファから指定範囲をコピー
-	draw.Draw(output, image.Rect(0, mp.mosaicOffset, output.Bounds().Max.X, mp.mosaicOffset+copyHeight),
-		mp.buffer, image.Point{0, 0}, draw.Src)
+// サブコマンドの一覧
+func commands() []command {
+	return []command{
+		{"apply", "画像をモザイク処理する", func(w io.Writer) *commonFlags { return newApplyFlags(w).commonFlags }, runApply},
+		{"batch", "ディレクトリ内の画像をまとめてモザイク処理する", func(w io.Writer) *commonFlags { return newBatchFlags(w).commonFlags }, runBatch},
+		{"tar", "標準入力の tar 内の画像をモザイク処理し、tar を標準出力に書き出す", func(w io.Writer) *commonFlags { return newTarFlags(w).commonFlags }, runTar},
+		{"serve", "HTTP サーバーとして起動する", func(w io.Writer) *commonFlags { return newServeFlags(w).commonFlags }, runServe},
+		{"watch", "ディレクトリを監視し、追加された画像をモザイク処理する", func(w io.Writer) *commonFlags { return newWatchFlags(w).commonFlags }, runWatch},
+		{"frames", "番号で並んだフレームの画像を順にモザイク処理する", func(w io.Writer) *commonFlags { return newFramesFlags(w).commonFlags }, runFrames},
+		{"render", "タイルの色のファイルからモザイク画像を描画する", func(w io.Writer) *commonFlags { return newRenderFlags(w).commonFlags }, runRender},
+		{"info", "画像の形式や大きさ、タイルの分割数を表示する", func(w io.Writer) *commonFlags { return newInfoFlags(w).commonFlags }, runInfo},
+		{"patch", "処理済みの画像の一部の範囲だけを元画像から処理し直す", func(w io.Writer) *commonFlags { return newPatchFlags(w).commonFlags }, runPatch},
+		{"compare", "2 つの画像をタイルごとに比べ、変わったタイルを表示する", func(w io.Writer) *commonFlags { return newCompareFlags(w).commonFlags }, runCompare},
+		{"photo", "素材の写真をタイルに使ったフォトモザイクを作る (photo index で索引だけを作る)", func(w io.Writer) *commonFlags { return newPhotoFlags(w).commonFlags }, runPhoto},
+		{"bench", "合成した画像で処理の速さとメモリを測る", func(w io.Writer) *commonFlags { return newBenchFlags(w).commonFlags }, runBench},
+		{"palette", "組み込みのパレットの一覧と見本を表示する (palette list、palette preview)", nil, runPalette},
+		{"config", "解決済みの設定を表示する (config print [command] [flags])", nil, runConfig},
+	}
 }
 
-func (mp *MosaicProcessor) averageColor(x, y, width, height int) color.Color {
-	var r, g, b, a uint32
-	var count uint32
-	bounds := mp.buffer.Bounds()
-	// 指定範囲の画素の平均色を計算
-	for dy := 0; dy < height && y+dy < bounds.Max.Y; dy++ {
-		for dx := 0; dx < width && x+dx < bounds.Max.X; dx++ {
-			pr, pg, pb, pa := mp.buffer.At(x+dx, y+dy).RGBA()
-			r += pr
-			g += pg
-			b += pb
-			a += pa
-			count++
+// 名前からサブコマンドを探す
+func lookupCommand(name string) (command, bool) {
+	for _, cmd := range commands() {
+		if cmd.name == name {
+			return cmd, true
 		}
 	}
-	if count == 0 {
-		return color.NRGBA{0, 0, 0, 255}
-	}
-	return color.NRGBA{
-		R: uint8(r / count >> 8),
-		G: uint8(g / count >> 8),
-		B: uint8(b / count >> 8),
-		A: uint8(a / count >> 8),
-	}
+	return command{}, false
 }
 
-func convertToNRGBA(img image.Image) *image.NRGBA {
-	bounds := img.Bounds()
-	nrgba := image.NewNRGBA(bounds)
-	draw.Draw(nrgba, bounds, img, image.Point{}, draw.Src)
-	return nrgba
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdout, os.Stderr))
 }
 
-func min(a, b int) int {
-	if a < b {
-		return a
+// コマンドを実行し、終了コードを返却
+// サブコマンドが省略された場合は apply として扱う
+func run(args []string, stdout, stderr io.Writer) int {
+	if len(args) > 0 {
+		switch args[0] {
+		case "-version", "--version":
+			return report(stderr, runVersion(args[1:], stdout, stderr))
+		case "-h", "-help", "--help", "help":
+			printUsage(stdout)
+			return exitOK
+		}
+		if cmd, ok := lookupCommand(args[0]); ok {
+			return report(stderr, cmd.run(args[1:], stdout, stderr))
+		}
 	}
-	return b
+	return report(stderr, runApply(args, stdout, stderr))
 }
 
-func main() {
-	file, err := os.Open("test.jpg")
-	if err != nil {
-		panic(err)
+// サブコマンドの一覧を出力
+func printUsage(w io.Writer) {
+	fmt.Fprintf(w, "usage: %s <command> [flags]\n\ncommands:\n", progName)
+	for _, cmd := range commands() {
+		fmt.Fprintf(w, "  %-8s %s\n", cmd.name, cmd.summary)
 	}
-	defer file.Close()
+	fmt.Fprintf(w, "\nコマンドを省略した場合は apply として扱います。\n")
+	fmt.Fprintf(w, "各コマンドのフラグは %s <command> -h で表示します。\n", progName)
+}
 
-	img, _, err := image.Decode(file)
-	if err != nil {
-		panic(err)
+// エラーを stderr に出力し、対応する終了コードを返却
+func report(stderr io.Writer, err error) int {
+	if err == nil || errors.Is(err, flag.ErrHelp) {
+		return exitOK
 	}
+	fmt.Fprintf(stderr, "%s: %v\n", progName, err)
+	return exitCode(err)
+}
 
-	nrgbaImg := convertToNRGBA(img)
-
-	mosaicWidth := 100
-	mosaicHeight := 100
-
-	processor := NewMosaicProcessor(nrgbaImg, mosaicWidth, mosaicHeight)
-	output := processor.Process()
-
-	outFile, err := os.Create("result.jpg")
-	if err != nil {
-		panic(err)
+// エラーの種類を終了コードに対応付ける
+func exitCode(err error) int {
+	var (
+		usage   *usageError
+		input   *inputError
+		output  *outputError
+		stage   *stageError
+		partial *partialError
+	)
+	switch {
+	case err == nil:
+		return exitOK
+	case errors.As(err, &usage):
+		return exitUsage
+	case errors.As(err, &partial):
+		return exitPartial
+	case errors.As(err, &input):
+		return exitInput
+	case errors.As(err, &output):
+		return exitOutput
+	case errors.As(err, &stage) && stage.stage == stageDecode:
+		return exitDecode
+	case errors.As(err, &stage) && stage.stage == stageEncode:
+		return exitOutput
+	default:
+		return exitGeneric
 	}
-	defer outFile.Close()
-
-	jpeg.Encode(outFile, output, nil)
 }
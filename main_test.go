@@ -0,0 +1,90 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestExitCodes(t *testing.T) {
+	dir := t.TempDir()
+	good := filepath.Join(dir, "good.png")
+	writeTestImage(t, good, testImage(32, 24))
+	garbage := filepath.Join(dir, "garbage.png")
+	writeTestFile(t, garbage, []byte("this is not an image"))
+	missing := filepath.Join(dir, "missing.png")
+	noDir := filepath.Join(dir, "no", "such", "dir", "out.png")
+
+	batchIn := filepath.Join(dir, "batch")
+	writeTestImage(t, filepath.Join(batchIn, "a.png"), testImage(16, 16))
+	writeTestFile(t, filepath.Join(batchIn, "b.png"), []byte("broken"))
+
+	tests := []struct {
+		name string
+		args []string
+		code int
+		path string // stderr のメッセージに含まれるパス
+	}{
+		{"ok", []string{"apply", "-in", good, "-out", filepath.Join(dir, "out.png"), "-tile", "8", "-quiet"}, exitOK, ""},
+		{"unknown flag", []string{"apply", "-no-such-flag"}, exitUsage, ""},
+		{"bad tile", []string{"apply", "-in", good, "-out", filepath.Join(dir, "out.png"), "-tile", "-3"}, exitUsage, ""},
+		{"unknown subcommand flag", []string{"batch", "-in"}, exitUsage, ""},
+		{"missing input", []string{"apply", "-in", missing, "-out", filepath.Join(dir, "out.png"), "-quiet"}, exitInput, missing},
+		{"decode failure", []string{"apply", "-in", garbage, "-out", filepath.Join(dir, "out.png"), "-quiet"}, exitDecode, garbage},
+		{"write failure", []string{"apply", "-in", good, "-out", noDir, "-quiet"}, exitOutput, noDir},
+		{"partial batch", []string{"batch", "-in", batchIn, "-out", filepath.Join(dir, "batch-out"), "-quiet"}, exitPartial, "b.png"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res := runCLI(t, tt.args...)
+			if res.code != tt.code {
+				t.Fatalf("exit code = %d, want %d (stderr: %s)", res.code, tt.code, res.stderr)
+			}
+			if tt.code == exitOK {
+				if res.stderr != "" {
+					t.Errorf("stderr = %q, want empty", res.stderr)
+				}
+				return
+			}
+			// 使い方やログの後の最後の行が診断のメッセージ
+			lines := strings.Split(strings.TrimSpace(res.stderr), "\n")
+			last := lines[len(lines)-1]
+			if !strings.HasPrefix(last, progName+": ") {
+				t.Errorf("last line of stderr %q does not start with the program name", last)
+			}
+			// バッチ処理では失敗したファイルをログに、件数を最後の行に出力する
+			if tt.code != exitPartial && !strings.Contains(last, tt.path) || !strings.Contains(res.stderr, tt.path) {
+				t.Errorf("stderr %q does not name %s", res.stderr, tt.path)
+			}
+			if res.stdout != "" && tt.code != exitPartial {
+				t.Errorf("diagnostics written to stdout: %q", res.stdout)
+			}
+		})
+	}
+}
+
+func TestExitCodeMapping(t *testing.T) {
+	tests := []struct {
+		err  error
+		code int
+	}{
+		{nil, exitOK},
+		{errors.New("boom"), exitGeneric},
+		{&usageError{errors.New("bad")}, exitUsage},
+		{&inputError{path: "a", err: os.ErrNotExist}, exitInput},
+		{&stageError{stage: stageDecode, err: errors.New("bad")}, exitDecode},
+		{&stageError{stage: stageEncode, err: errors.New("bad")}, exitOutput},
+		{&stageError{stage: stageProcess, err: errors.New("bad")}, exitGeneric},
+		{&outputError{path: "b", err: os.ErrPermission}, exitOutput},
+		{&partialError{failed: 1, total: 2}, exitPartial},
+		// 包んだエラーも同じ終了コードにする
+		{&stageError{stage: stageDecode, err: &inputError{path: "a", err: os.ErrNotExist}}, exitInput},
+	}
+	for _, tt := range tests {
+		if got := exitCode(tt.err); got != tt.code {
+			t.Errorf("exitCode(%v) = %d, want %d", tt.err, got, tt.code)
+		}
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/yashikota/go-streaming-image-mosaic/internal/jpegstream"
+	"github.com/yashikota/go-streaming-image-mosaic/mosaic"
+)
+
+// 大きさ c の画像を p で処理する場合に確保する主なメモリの見積もり (バイト)
+// decoded はデコーダーが返す画像のバイト数 (decodedBytes)
+// デコードした画像と NRGBA の元画像は変換の間だけ同時に持つが、合計は同時に持つとみなした上限にする
+// エンコーダーのバッファは、大きさが画像の幅で決まる PNG の行のバッファと GIF のフレームだけを数える
+func (p pipeline) planMemory(c image.Config, decoded int64) mosaic.SummaryMemory {
+	w, h := int64(c.Width), int64(c.Height)
+	pixels := w * h
+	m := mosaic.SummaryMemory{
+		Decoded: decoded,
+		Source:  4 * pixels, // 元画像は常に NRGBA に変換した複製
+	}
+
+	tile := p.tile
+	if p.animate != nil {
+		tile = max(tile, slices.Max(p.animate.frames()))
+	}
+	workers := int64(max(1, p.workers))
+	if b := p.blockSize(); b != (image.Point{}) {
+		m.Bands = workers * 4 * int64(b.X) * int64(b.Y)
+	} else {
+		rows := (h + int64(tile) - 1) / int64(max(1, tile))
+		batches := int64(1)
+		if p.streaming() {
+			batches += bandPrefetch
+		}
+		m.Bands = min(workers, max(1, rows)) * batches * 4 * w * int64(tile)
+	}
+
+	switch {
+	case p.animate != nil:
+		// 作業用の画像とパレットのフレーム
+		m.Output = 4 * pixels
+		m.Encoder = pixels
+	case p.debugOverlay != "":
+		// 出力画像とオーバーレイ
+		m.Output = 2 * 4 * pixels
+	}
+	if len(p.outputs) > 0 {
+		m.Output += 4 * pixels
+	}
+	if p.format == "" && p.encoderName() == "png" {
+		// 現在と前の行、フィルターごとの候補の行
+		m.Encoder += 6 * (4*w + 1)
+	}
+	m.Planned = m.Decoded + m.Source + m.Bands + m.Output + m.Encoder
+	return m
+}
+
+// 処理済みのバンドを順に JPEG にエンコードするかどうか
+// バンドの高さが MCU の高さの倍数で、範囲やブロックを指定していない場合
+func (p pipeline) streaming() bool {
+	return !p.settings.ProcessesRegions() && p.block == (blockSize{}) && p.encoderName() == "jpeg" &&
+		p.tile%jpegstream.MCUHeight == 0 && p.gridOrigin.Y%jpegstream.MCUHeight == 0
+}
+
+// 大きさ c の画像の見積もり m が -max-heap を超える場合は、処理を始めずに *ErrImageTooLarge を返す
+func (p pipeline) checkHeap(c image.Config, m mosaic.SummaryMemory) error {
+	if p.maxHeap <= 0 {
+		return nil
+	}
+	if m.Planned <= int64(p.maxHeap) {
+		return nil
+	}
+	return &ErrImageTooLarge{
+		Width: c.Width, Height: c.Height,
+		Limit: fmt.Sprintf("max-heap %s (planned %s)", p.maxHeap, byteSize(m.Planned)),
+		Hint:  p.heapHint(m),
+	}
+}
+
+// 見積もりのうち減らせる確保の案内
+func (p pipeline) heapHint(m mosaic.SummaryMemory) string {
+	switch {
+	case m.Output > 0:
+		var flags []string
+		if p.debugOverlay != "" {
+			flags = append(flags, "-debug-overlay")
+		}
+		if len(p.outputs) > 0 {
+			flags = append(flags, "-output")
+		}
+		if p.animate != nil {
+			flags = append(flags, "-animate-sizes")
+		}
+		verb, it := "needs", "it"
+		if len(flags) > 1 {
+			verb, it = "need", "them"
+		}
+		return fmt.Sprintf("%s %s %s of images besides the source; drop %s to save memory", strings.Join(flags, " and "), verb, byteSize(m.Output), it)
+	case m.Bands > m.Source/4:
+		return fmt.Sprintf("band buffers need %s; lower -parallel or use -block WxH", byteSize(m.Bands))
+	}
+	return fmt.Sprintf("the decoded source alone needs %s; downscale the input, or reject such inputs with -max-pixels", byteSize(m.Decoded+m.Source))
+}
+
+// 現在の runtime.MemStats.HeapInuse (バイト)
+func heapInuse() int64 {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	return int64(ms.HeapInuse)
+}
+
+// バイト数を表すフラグの値
+// 数値のほか、512MiB や 2GiB のように KiB、MiB、GiB 単位でも指定できる (0 は無制限)
+type byteSize int64
+
+var byteUnits = []struct {
+	suffix string
+	scale  int64
+}{{"GiB", 1 << 30}, {"MiB", 1 << 20}, {"KiB", 1 << 10}}
+
+func (b byteSize) String() string {
+	abs := max(b, -b)
+	for _, u := range byteUnits {
+		switch {
+		case b != 0 && int64(b)%u.scale == 0:
+			return strconv.FormatInt(int64(b)/u.scale, 10) + u.suffix
+		case int64(abs) >= u.scale:
+			return strconv.FormatFloat(float64(b)/float64(u.scale), 'f', 1, 64) + u.suffix
+		}
+	}
+	return strconv.FormatInt(int64(b), 10)
+}
+
+func (b *byteSize) Set(s string) error {
+	num, scale := s, 1.0
+	for _, u := range byteUnits {
+		if n, ok := strings.CutSuffix(strings.ToUpper(strings.TrimSpace(s)), strings.ToUpper(u.suffix)); ok {
+			num, scale = n, float64(u.scale)
+			break
+		}
+	}
+	v, err := strconv.ParseFloat(strings.TrimSpace(num), 64)
+	if err != nil || v < 0 {
+		return fmt.Errorf("invalid byte size %q (want e.g. 512MiB, 2GiB or 1073741824)", s)
+	}
+	*b = byteSize(v * scale)
+	return nil
+}
+
+func (b *byteSize) Get() any {
+	return b.String()
+}
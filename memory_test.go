@@ -0,0 +1,145 @@
+package main
+
+import (
+	"errors"
+	"image"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/yashikota/go-streaming-image-mosaic/mosaic"
+)
+
+func TestPlanMemory(t *testing.T) {
+	const w, h = 1000, 600
+	config := image.Config{Width: w, Height: h}
+	pixels := int64(w * h)
+	png := int64(6 * (4*w + 1))
+	tests := []struct {
+		name string
+		p    pipeline
+		want mosaic.SummaryMemory
+	}{
+		{
+			// JPEG のバンドごとのエンコードは先に処理する組のバンドも持つ
+			"streaming jpeg",
+			pipeline{tile: 16, workers: 1},
+			mosaic.SummaryMemory{Decoded: 3 * pixels / 2, Source: 4 * pixels, Bands: (1 + bandPrefetch) * 4 * w * 16},
+		},
+		{
+			"png with 4 workers",
+			pipeline{tile: 20, workers: 4, encoder: "png"},
+			mosaic.SummaryMemory{Decoded: 4 * pixels, Source: 4 * pixels, Bands: 4 * 4 * w * 20, Encoder: png},
+		},
+		{
+			// ゴルーチンの数はバンドの数までしか使わない
+			"more workers than bands",
+			pipeline{tile: 400, workers: 8, encoder: "png"},
+			mosaic.SummaryMemory{Decoded: 4 * pixels, Source: 4 * pixels, Bands: 2 * 4 * w * 400, Encoder: png},
+		},
+		{
+			"blocks",
+			pipeline{tile: 16, workers: 2, encoder: "gif", block: blockSize{128, 64}},
+			mosaic.SummaryMemory{Decoded: pixels, Source: 4 * pixels, Bands: 2 * 4 * 128 * 64},
+		},
+		{
+			"debug overlay",
+			pipeline{tile: 10, workers: 1, encoder: "gif", debugOverlay: "overlay.png"},
+			mosaic.SummaryMemory{Decoded: pixels, Source: 4 * pixels, Bands: 4 * w * 10, Output: 8 * pixels},
+		},
+		{
+			// アニメーションは最も大きいタイルのバンドと、作業用の画像とパレットのフレームを持つ
+			"animation",
+			pipeline{tile: 4, workers: 1, encoder: "gif", animate: &animation{sizes: []int{4, 8, 32}}},
+			mosaic.SummaryMemory{Decoded: pixels, Source: 4 * pixels, Bands: 4 * w * 32, Output: 4 * pixels, Encoder: pixels},
+		},
+		{
+			// タイルから書き出す形式には PNG の行のバッファを数えない
+			"svg",
+			pipeline{tile: 10, workers: 1, encoder: "png", format: exportSVG},
+			mosaic.SummaryMemory{Decoded: 4 * pixels, Source: 4 * pixels, Bands: 4 * w * 10},
+		},
+	}
+	for _, tt := range tests {
+		got := tt.p.planMemory(config, tt.want.Decoded)
+		want := tt.want
+		want.Planned = want.Decoded + want.Source + want.Bands + want.Output + want.Encoder
+		if got.Decoded != want.Decoded || got.Source != want.Source || got.Bands != want.Bands || got.Output != want.Output || got.Encoder != want.Encoder || got.Planned != want.Planned {
+			t.Errorf("%s: %+v, want %+v", tt.name, got, want)
+		}
+	}
+}
+
+func TestCheckHeap(t *testing.T) {
+	config := image.Config{Width: 1000, Height: 600}
+	p := pipeline{tile: 16, workers: 1}
+	m := p.planMemory(config, 900000)
+	if err := p.checkHeap(config, m); err != nil {
+		t.Errorf("no limit: %v", err)
+	}
+	p.maxHeap = byteSize(m.Planned)
+	if err := p.checkHeap(config, m); err != nil {
+		t.Errorf("limit equal to the plan: %v", err)
+	}
+	p.maxHeap--
+	var tooLarge *ErrImageTooLarge
+	if err := p.checkHeap(config, m); !errors.As(err, &tooLarge) || !strings.Contains(tooLarge.Limit, "max-heap") || tooLarge.Hint == "" {
+		t.Errorf("limit below the plan: %v", err)
+	}
+}
+
+func TestHeapHint(t *testing.T) {
+	tests := []struct {
+		p    pipeline
+		m    mosaic.SummaryMemory
+		want string
+	}{
+		{pipeline{debugOverlay: "o.png"}, mosaic.SummaryMemory{Output: 8 << 20}, "-debug-overlay needs 8MiB"},
+		{pipeline{debugOverlay: "o.png", outputs: outputList{{}}}, mosaic.SummaryMemory{Output: 8 << 20}, "-debug-overlay and -output need"},
+		{pipeline{}, mosaic.SummaryMemory{Source: 4 << 20, Bands: 2 << 20}, "lower -parallel"},
+		{pipeline{}, mosaic.SummaryMemory{Decoded: 1 << 20, Source: 4 << 20, Bands: 1 << 10}, "-max-pixels"},
+	}
+	for _, tt := range tests {
+		if got := tt.p.heapHint(tt.m); !strings.Contains(got, tt.want) {
+			t.Errorf("hint %q does not contain %q", got, tt.want)
+		}
+	}
+}
+
+func TestByteSize(t *testing.T) {
+	for _, tt := range []struct {
+		in   string
+		want byteSize
+		str  string
+	}{
+		{"0", 0, "0"},
+		{"1536", 1536, "1.5KiB"},
+		{"512MiB", 512 << 20, "512MiB"},
+		{"2gib", 2 << 30, "2GiB"},
+		{" 1.5 GiB", 3 << 29, "1.5GiB"},
+	} {
+		var b byteSize
+		if err := b.Set(tt.in); err != nil || b != tt.want || b.String() != tt.str {
+			t.Errorf("Set(%q) = %d (%s), %v, want %d (%s)", tt.in, b, b, err, tt.want, tt.str)
+		}
+	}
+	for _, in := range []string{"", "-1", "10TB", "MiB"} {
+		var b byteSize
+		if err := b.Set(in); err == nil {
+			t.Errorf("Set(%q) accepted", in)
+		}
+	}
+}
+
+func TestMaxHeapRefusesLargeImages(t *testing.T) {
+	dir := t.TempDir()
+	in := filepath.Join(dir, "in.png")
+	writeTestImage(t, in, testImage(200, 200))
+	res := runCLI(t, "apply", "-in", in, "-out", filepath.Join(dir, "out.png"), "-max-heap", "64KiB", "-quiet")
+	if res.code != exitDecode || !strings.Contains(res.stderr, "max-heap 64KiB") {
+		t.Errorf("exit code = %d, stderr %q", res.code, res.stderr)
+	}
+	if res := runCLI(t, "apply", "-in", in, "-out", filepath.Join(dir, "out.png"), "-max-heap", "64MiB", "-quiet"); res.code != exitOK {
+		t.Errorf("exit code = %d with a large limit (stderr: %s)", res.code, res.stderr)
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/yashikota/go-streaming-image-mosaic/mosaic"
+)
+
+// Prometheus のテキスト形式で公開するメトリクス
+// ラベルのカーディナリティを抑えるため、ファイル名などはラベルに含めない
+type metrics struct {
+	mu         sync.Mutex
+	processed  map[string]float64 // 形式ごとの処理済み画像数
+	failures   map[string]float64 // 段階ごとの失敗数
+	cache      map[string]float64 // 結果ごとのキャッシュの参照数
+	duration   *histogram         // 処理時間 (秒)
+	megapixels *histogram         // 入力画像の画素数 (メガピクセル)
+	bytesIn    float64
+	bytesOut   float64
+	inFlight   float64
+	pool       *mosaic.BufferPool // nil の場合はバッファのプールの統計を公開しない
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		processed:  map[string]float64{},
+		failures:   map[string]float64{stageDecode: 0, stageProcess: 0, stageEncode: 0},
+		cache:      map[string]float64{cacheHit: 0, cacheMiss: 0, cachePreconditionFailed: 0},
+		duration:   newHistogram(0.01, 0.05, 0.1, 0.5, 1, 5, 10, 30, 60),
+		megapixels: newHistogram(0.1, 0.5, 1, 2, 5, 10, 25, 50, 100),
+	}
+}
+
+func (m *metrics) ProcessStarted() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.inFlight++
+}
+
+func (m *metrics) ProcessFinished(elapsed time.Duration, pixels int, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.inFlight--
+	m.duration.observe(elapsed.Seconds())
+	m.megapixels.observe(float64(pixels) / 1e6)
+}
+
+// 画像の処理が完了したことを記録
+func (m *metrics) imageProcessed(format string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.processed[format]++
+}
+
+// 処理の失敗を記録
+func (m *metrics) failure(stage string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.failures[stage]++
+}
+
+// キャッシュの参照の結果
+const (
+	cacheHit                = "hit"
+	cacheMiss               = "miss"
+	cachePreconditionFailed = "precondition_failed" // If-None-Match が一致し、412 を返した
+)
+
+// キャッシュの参照を記録
+func (m *metrics) cacheResult(result string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.cache[result]++
+}
+
+// 入出力のバイト数を記録
+func (m *metrics) addBytes(in, out int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.bytesIn += float64(in)
+	m.bytesOut += float64(out)
+}
+
+// Prometheus のテキスト形式で書き出す
+func (m *metrics) writeTo(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	writeVec(w, "mosaic_images_processed_total", "Number of images processed successfully.", "counter", "format", m.processed)
+	writeVec(w, "mosaic_failures_total", "Number of failures by stage.", "counter", "stage", m.failures)
+	writeVec(w, "mosaic_cache_requests_total", "Number of result cache lookups by result.", "counter", "result", m.cache)
+	m.duration.writeTo(w, "mosaic_process_duration_seconds", "Time spent processing an image.")
+	m.megapixels.writeTo(w, "mosaic_input_megapixels", "Size of input images in megapixels.")
+	writeValue(w, "mosaic_bytes_in_total", "Bytes read from inputs.", "counter", m.bytesIn)
+	writeValue(w, "mosaic_bytes_out_total", "Bytes written to outputs.", "counter", m.bytesOut)
+	writeValue(w, "mosaic_in_flight", "Number of images being processed.", "gauge", m.inFlight)
+	if m.pool != nil {
+		stats := m.pool.Stats()
+		writeValue(w, "mosaic_pool_retained_bytes", "Bytes of idle band buffers kept by the buffer pool.", "gauge", float64(stats.Retained))
+		writeValue(w, "mosaic_pool_in_use_bytes", "Bytes of band buffers lent out by the buffer pool.", "gauge", float64(stats.InUse))
+		writeValue(w, "mosaic_pool_high_water_bytes", "Largest observed sum of retained and in-use buffer pool bytes.", "gauge", float64(stats.HighWater))
+		writeValue(w, "mosaic_pool_released_bytes_total", "Bytes of idle band buffers dropped by the buffer pool janitor.", "counter", float64(stats.Released))
+	}
+}
+
+// /metrics エンドポイントのハンドラー
+func (m *metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	m.writeTo(w)
+}
+
+// Pushgateway にメトリクスを送信
+func (m *metrics) push(gateway string) error {
+	var buf bytes.Buffer
+	m.writeTo(&buf)
+
+	url := strings.TrimSuffix(gateway, "/") + "/metrics/job/mosaic"
+	req, err := http.NewRequest(http.MethodPut, url, &buf)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; version=0.0.4")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("push metrics: unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+// ラベルなしの値を書き出す
+func writeValue(w io.Writer, name, help, typ string, v float64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %g\n", name, help, name, typ, name, v)
+}
+
+// ラベルを 1 つ持つ値を書き出す
+func writeVec(w io.Writer, name, help, typ, label string, values map[string]float64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(w, "%s{%s=%q} %g\n", name, label, k, values[k])
+	}
+}
+
+// 累積バケットを持つヒストグラム
+type histogram struct {
+	bounds []float64
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func newHistogram(bounds ...float64) *histogram {
+	return &histogram{bounds: bounds, counts: make([]uint64, len(bounds))}
+}
+
+func (h *histogram) observe(v float64) {
+	for i, b := range h.bounds {
+		if v <= b {
+			h.counts[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+func (h *histogram) writeTo(w io.Writer, name, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", name, help, name)
+	for i, b := range h.bounds {
+		fmt.Fprintf(w, "%s_bucket{le=\"%g\"} %d\n", name, b, h.counts[i])
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", name, h.count)
+	fmt.Fprintf(w, "%s_sum %g\n%s_count %d\n", name, h.sum, name, h.count)
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"testing"
+)
+
+// text の Prometheus 形式の中の name (ラベルを含む) の値
+func metricValue(t *testing.T, text, name string) float64 {
+	t.Helper()
+	m := regexp.MustCompile(`(?m)^` + regexp.QuoteMeta(name) + ` (\S+)$`).FindStringSubmatch(text)
+	if m == nil {
+		t.Fatalf("metric %s not found in:\n%s", name, text)
+	}
+	v, err := strconv.ParseFloat(m[1], 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
+
+func scrape(t *testing.T, url string) string {
+	t.Helper()
+	resp, err := http.Get(url + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	return string(body)
+}
+
+func TestServerMetrics(t *testing.T) {
+	ts, _ := newTestServer(t, "-metrics", "-cache-size", "0", "-tile", "8")
+	before := scrape(t, ts.URL)
+	if v := metricValue(t, before, `mosaic_failures_total{stage="decode"}`); v != 0 {
+		t.Fatalf("decode failures before processing = %g", v)
+	}
+
+	input := encodeTestImage(t, testImage(64, 48), "png")
+	resp, err := http.Post(ts.URL+"/process?format=png", "image/png", bytes.NewReader(input))
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d", resp.StatusCode)
+	}
+	resp, err = http.Post(ts.URL+"/process", "image/png", bytes.NewReader([]byte("not an image")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	after := scrape(t, ts.URL)
+	for _, c := range []struct {
+		name string
+		want float64
+	}{
+		{`mosaic_images_processed_total{format="png"}`, 1},
+		{`mosaic_failures_total{stage="decode"}`, 1},
+		{`mosaic_failures_total{stage="encode"}`, 0},
+		{`mosaic_process_duration_seconds_count`, 1},
+		{`mosaic_input_megapixels_count`, 1},
+		{`mosaic_in_flight`, 0},
+		{`mosaic_pool_in_use_bytes`, 0},
+		{`mosaic_pool_released_bytes_total`, 0},
+	} {
+		if got := metricValue(t, after, c.name); got != c.want {
+			t.Errorf("%s = %g, want %g", c.name, got, c.want)
+		}
+	}
+	if got := metricValue(t, after, "mosaic_bytes_in_total"); got < float64(len(input)) {
+		t.Errorf("mosaic_bytes_in_total = %g, want at least %d", got, len(input))
+	}
+	if got := metricValue(t, after, "mosaic_bytes_out_total"); got == 0 {
+		t.Error("mosaic_bytes_out_total did not move")
+	}
+	// 処理を終えたバンドのバッファはプールに残る
+	if retained, high := metricValue(t, after, "mosaic_pool_retained_bytes"), metricValue(t, after, "mosaic_pool_high_water_bytes"); retained < 4*64*8 || high < retained {
+		t.Errorf("mosaic_pool_retained_bytes = %g, mosaic_pool_high_water_bytes = %g", retained, high)
+	}
+	// ファイル名などをラベルにしない
+	if regexp.MustCompile(`(?m)^mosaic_\w+\{(path|file|input)=`).MatchString(after) {
+		t.Errorf("metrics have a per-file label:\n%s", after)
+	}
+}
+
+func TestBatchMetricsPush(t *testing.T) {
+	var pushed []byte
+	var method, path string
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		method, path = r.Method, r.URL.Path
+		pushed, _ = io.ReadAll(r.Body)
+	}))
+	defer gateway.Close()
+
+	in, out := t.TempDir(), t.TempDir()
+	writeTestImage(t, filepath.Join(in, "a.png"), testImage(40, 30))
+	writeTestImage(t, filepath.Join(in, "b.jpg"), testImage(30, 40))
+	writeTestFile(t, filepath.Join(in, "broken.png"), []byte("\x89PNG broken"))
+	res := runCLI(t, "batch", "-in", in, "-out", out, "-tile", "8", "-quiet", "-metrics-push", gateway.URL)
+	if res.code != exitPartial {
+		t.Fatalf("exit code = %d, want %d (stderr: %s)", res.code, exitPartial, res.stderr)
+	}
+	if method != http.MethodPut || path != "/metrics/job/mosaic" {
+		t.Fatalf("pushed with %s %s", method, path)
+	}
+	text := string(pushed)
+	if got := metricValue(t, text, `mosaic_images_processed_total{format="png"}`) + metricValue(t, text, `mosaic_images_processed_total{format="jpeg"}`); got != 2 {
+		t.Errorf("images processed = %g, want 2", got)
+	}
+	if got := metricValue(t, text, `mosaic_failures_total{stage="decode"}`); got != 1 {
+		t.Errorf("decode failures = %g, want 1", got)
+	}
+}
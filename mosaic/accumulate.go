@@ -0,0 +1,172 @@
+package mosaic
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+)
+
+// セルごとに画素の色を合計し、平均色を求める
+// 画素を 1 つずつセルの番号を指定して加え、すべての画素を加えた後に Color で平均色を得る
+// セルの形は呼び出し側が決めるため、矩形のタイル、マスクで選んだ画素、格子のマスなどに同じ計算を使える
+// 色は color.Color の RGBA と同じく乗算済みの 16 ビット値を uint64 で合計するため、セルの画素数によらずあふれない
+// 異なるセルに対しても、複数のゴルーチンから同時に加えてはならない
+type CellAccumulator struct {
+	sums    []colorSum
+	squares []colorSquares // 分散を求めない場合は nil
+}
+
+// 1 つのセルの画素の色の合計
+type colorSum struct {
+	r, g, b, a uint64
+	n          uint64 // 画素数
+}
+
+// 1 つのセルの画素の 8 ビットの成分 (乗算済みにしない値) の合計と 2 乗の合計
+type colorSquares struct {
+	sum, square [4]uint64
+	n           uint64 // 2 乗を合計した画素数 (Merge で分散を持たない合計を加えた場合は colorSum の画素数より少ない)
+}
+
+// cells 個のセルの CellAccumulator を生成
+// variance の場合は成分ごとの 2 乗の合計も保持し、Variance で分散を求められるようにする
+func NewCellAccumulator(cells int, variance bool) *CellAccumulator {
+	acc := &CellAccumulator{sums: make([]colorSum, cells)}
+	if variance {
+		acc.squares = make([]colorSquares, cells)
+	}
+	return acc
+}
+
+// セルの数
+func (acc *CellAccumulator) Len() int {
+	return len(acc.sums)
+}
+
+// cell 番目のセルに色 c の画素を加える
+func (acc *CellAccumulator) Add(cell int, c color.NRGBA) {
+	acc.sums[cell].add(c.R, c.G, c.B, c.A)
+	if acc.squares != nil {
+		acc.squares[cell].add(c.R, c.G, c.B, c.A)
+	}
+}
+
+// cell 番目のセルに NRGBA の画素の列 pix (4 バイトずつ) をすべて加える
+func (acc *CellAccumulator) AddPixels(cell int, pix []uint8) {
+	acc.sums[cell].addPixels(pix)
+	if acc.squares != nil {
+		for x := 0; x+4 <= len(pix); x += 4 {
+			acc.squares[cell].add(pix[x], pix[x+1], pix[x+2], pix[x+3])
+		}
+	}
+}
+
+// src の srcCell 番目のセルの合計を、cell 番目のセルに加える
+// 2 乗の合計は、両方が分散を保持している場合だけ加える (分散は 2 乗を合計した画素だけから求める)
+func (acc *CellAccumulator) Merge(cell int, src *CellAccumulator, srcCell int) {
+	acc.sums[cell].merge(src.sums[srcCell])
+	if acc.squares != nil && src.squares != nil {
+		dst, s := &acc.squares[cell], &src.squares[srcCell]
+		for i := range dst.sum {
+			dst.sum[i] += s.sum[i]
+			dst.square[i] += s.square[i]
+		}
+		dst.n += s.n
+	}
+}
+
+// cell 番目のセルに加えた画素の数
+func (acc *CellAccumulator) Count(cell int) int {
+	return int(acc.sums[cell].n)
+}
+
+// cell 番目のセルの平均色
+// 画素を 1 つも加えていないセルは MeanColor の空の範囲と同じく不透明な黒にする
+// 成分は RoundHalfUp で丸める
+func (acc *CellAccumulator) Color(cell int) color.NRGBA {
+	return acc.sums[cell].color(RoundHalfUp)
+}
+
+// cell 番目のセルの画素の 8 ビットの成分ごとの分散 (乗算済みにしない値)
+// 画素を 1 つも加えていないセルは 0 にする
+// NewCellAccumulator で variance を指定していない場合は panic する
+func (acc *CellAccumulator) Variance(cell int) (r, g, b, a float64) {
+	if acc.squares == nil {
+		panic(fmt.Sprintf("mosaic: variance of cell %d is not accumulated", cell))
+	}
+	sq := &acc.squares[cell]
+	n := float64(sq.n)
+	if n == 0 {
+		return 0, 0, 0, 0
+	}
+	var v [4]float64
+	for i := range v {
+		mean := float64(sq.sum[i]) / n
+		v[i] = math.Max(0, float64(sq.square[i])/n-mean*mean)
+	}
+	return v[0], v[1], v[2], v[3]
+}
+
+func (s *colorSquares) add(r, g, b, a uint8) {
+	for i, v := range [4]uint8{r, g, b, a} {
+		s.sum[i] += uint64(v)
+		s.square[i] += uint64(v) * uint64(v)
+	}
+	s.n++
+}
+
+// 色 (r, g, b, a) の画素を加える
+// color.NRGBA の RGBA と同じ計算で乗算済みの値にする (不透明な画素は割り算を省く)
+func (s *colorSum) add(r, g, b, a uint8) {
+	if a == 0xff {
+		s.r += uint64(r) * 0x101
+		s.g += uint64(g) * 0x101
+		s.b += uint64(b) * 0x101
+	} else {
+		s.r += uint64(uint32(r) * 0x101 * uint32(a) / 0xff)
+		s.g += uint64(uint32(g) * 0x101 * uint32(a) / 0xff)
+		s.b += uint64(uint32(b) * 0x101 * uint32(a) / 0xff)
+	}
+	s.a += uint64(a) * 0x101
+	s.n++
+}
+
+// NRGBA の画素の列 pix (4 バイトずつ) をすべて加える
+func (s *colorSum) addPixels(pix []uint8) {
+	for x := 0; x+4 <= len(pix); x += 4 {
+		p := pix[x : x+4 : x+4]
+		s.add(p[0], p[1], p[2], p[3])
+	}
+}
+
+// img の rect の画素をすべて加える
+func (s *colorSum) addRect(img *image.NRGBA, rect image.Rectangle) {
+	width := 4 * rect.Dx()
+	for y := rect.Min.Y; y < rect.Max.Y; y++ {
+		i := img.PixOffset(rect.Min.X, y)
+		s.addPixels(img.Pix[i : i+width : i+width])
+	}
+}
+
+func (s *colorSum) merge(src colorSum) {
+	s.r += src.r
+	s.g += src.g
+	s.b += src.b
+	s.a += src.a
+	s.n += src.n
+}
+
+// 平均色 (画素がない場合は不透明な黒)
+// 乗算済みの 16 ビット値の平均を r で 8 ビットの値に丸める
+func (s colorSum) color(r Rounding) color.NRGBA {
+	if s.n == 0 {
+		return color.NRGBA{0, 0, 0, 255}
+	}
+	return color.NRGBA{
+		R: r.mean(s.r, s.n),
+		G: r.mean(s.g, s.n),
+		B: r.mean(s.b, s.n),
+		A: r.mean(s.a, s.n),
+	}
+}
@@ -0,0 +1,105 @@
+package mosaic
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestCellAccumulatorEmptyCells(t *testing.T) {
+	acc := NewCellAccumulator(3, true)
+	acc.Add(1, color.NRGBA{10, 20, 30, 255})
+	for _, cell := range []int{0, 2} {
+		// 画素を加えていないセルは不透明な黒で、分散は 0
+		if c := acc.Color(cell); c != (color.NRGBA{0, 0, 0, 255}) || acc.Count(cell) != 0 {
+			t.Errorf("cell %d: color %v, count %d", cell, c, acc.Count(cell))
+		}
+		if r, g, b, a := acc.Variance(cell); r != 0 || g != 0 || b != 0 || a != 0 {
+			t.Errorf("cell %d: variance %g %g %g %g", cell, r, g, b, a)
+		}
+	}
+	if c := acc.Color(1); c != (color.NRGBA{10, 20, 30, 255}) || acc.Count(1) != 1 || acc.Len() != 3 {
+		t.Errorf("cell 1: color %v, count %d, len %d", c, acc.Count(1), acc.Len())
+	}
+}
+
+// バンドごとの CellAccumulator をまとめた平均は、バンドの境界をまたぐタイルでも矩形の平均と同じ
+func TestCellAccumulatorAcrossBands(t *testing.T) {
+	img := testImage(37, 29)
+	// 半透明の画素も含める
+	for i := 3; i < len(img.Pix); i += 4 * 5 {
+		img.Pix[i] = uint8(i)
+	}
+	const tile, bandHeight = 8, 5
+	grid := New(img, tile, tile).Grid()
+	total := NewCellAccumulator(grid.Columns*grid.Rows, true)
+	for top := 0; top < img.Rect.Dy(); top += bandHeight {
+		band := NewCellAccumulator(total.Len(), true)
+		for y := top; y < min(top+bandHeight, img.Rect.Dy()); y++ {
+			for x := 0; x < img.Rect.Dx(); x++ {
+				band.Add((y/tile)*grid.Columns+x/tile, img.NRGBAAt(x, y))
+			}
+		}
+		for cell := 0; cell < total.Len(); cell++ {
+			total.Merge(cell, band, cell)
+		}
+	}
+
+	out := process(t, img, tile)
+	for y := 0; y < grid.Rows; y++ {
+		for x := 0; x < grid.Columns; x++ {
+			rect := image.Rect(x*tile, y*tile, (x+1)*tile, (y+1)*tile).Intersect(img.Rect)
+			cell := y*grid.Columns + x
+			want := MeanColor(PixelRegion{img: img, Rect: rect})
+			if got := total.Color(cell); got != want {
+				t.Errorf("cell %v: %v, want the rectangular mean %v", rect, got, want)
+			}
+			if got := out.NRGBAAt(rect.Min.X, rect.Min.Y); got != want {
+				t.Errorf("cell %v: processed %v, want %v", rect, got, want)
+			}
+			if total.Count(cell) != rect.Dx()*rect.Dy() {
+				t.Errorf("cell %v: count %d", rect, total.Count(cell))
+			}
+		}
+	}
+}
+
+func TestCellAccumulatorVariance(t *testing.T) {
+	acc := NewCellAccumulator(1, true)
+	acc.AddPixels(0, []uint8{0, 10, 100, 255, 255, 10, 200, 255})
+	r, g, b, a := acc.Variance(0)
+	if r != 127.5*127.5 || g != 0 || b != 50*50 || a != 0 {
+		t.Errorf("variance %g %g %g %g", r, g, b, a)
+	}
+	// 分散を保持しない CellAccumulator から Merge しても 2 乗の合計は変わらない
+	plain := NewCellAccumulator(1, false)
+	plain.Add(0, color.NRGBA{255, 255, 255, 255})
+	acc.Merge(0, plain, 0)
+	if acc.Count(0) != 3 {
+		t.Errorf("count %d, want 3", acc.Count(0))
+	}
+	if r2, _, _, _ := acc.Variance(0); r2 != r {
+		t.Errorf("variance after merging without squares = %g, want %g", r2, r)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("Variance without variance accumulation did not panic")
+		}
+	}()
+	plain.Variance(0)
+}
+
+func TestCellAccumulatorLargeCell(t *testing.T) {
+	// 16 ビット値の合計は 4096x4096 の画素で 32 ビットを超える
+	const n = 4096 * 4096
+	acc := NewCellAccumulator(1, false)
+	row := bytes.Repeat([]uint8{255, 128, 1, 255}, 4096)
+	for i := 0; i < n/4096; i++ {
+		acc.AddPixels(0, row)
+	}
+	if c := acc.Color(0); c != (color.NRGBA{255, 128, 1, 255}) || acc.Count(0) != n {
+		t.Errorf("color %v, count %d", c, acc.Count(0))
+	}
+}
@@ -0,0 +1,141 @@
+package mosaic
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+)
+
+// 塗りつぶしの前にタイルの色を変換する処理
+// 複数の ColorAdjust は登録した順に適用される
+type ColorAdjust interface {
+	Adjust(c color.NRGBA) color.NRGBA
+}
+
+// 関数を ColorAdjust として扱う
+type ColorAdjustFunc func(c color.NRGBA) color.NRGBA
+
+func (f ColorAdjustFunc) Adjust(c color.NRGBA) color.NRGBA {
+	return f(c)
+}
+
+// タイルの色を変換する処理を追加
+func WithColorAdjust(adjusts ...ColorAdjust) Option {
+	return func(mp *Processor) {
+		mp.adjusts = append(mp.adjusts, adjusts...)
+	}
+}
+
+// WithColorAdjust の変換を適用する範囲
+type AdjustScope int
+
+const (
+	AdjustRegion AdjustScope = iota // モザイク処理するタイルの色だけを変換する (既定)
+	AdjustAll                       // WithSelection や ProcessRegions の範囲で選ばなかった画素も、画素ごとに変換する
+)
+
+var adjustScopeNames = []string{AdjustRegion: "region", AdjustAll: "all"}
+
+// region または all
+func (s AdjustScope) String() string {
+	if s < 0 || int(s) >= len(adjustScopeNames) {
+		return fmt.Sprintf("AdjustScope(%d)", int(s))
+	}
+	return adjustScopeNames[s]
+}
+
+// region または all の名前の AdjustScope (空文字列は region)
+func ParseAdjustScope(name string) (AdjustScope, error) {
+	if name == "" {
+		return AdjustRegion, nil
+	}
+	for s, n := range adjustScopeNames {
+		if n == name {
+			return AdjustScope(s), nil
+		}
+	}
+	return AdjustRegion, fmt.Errorf("unknown adjust scope %q (want region or all)", name)
+}
+
+// WithColorAdjust の変換を適用する範囲を設定
+// AdjustAll では、選んだ範囲のタイルの色に加えて、範囲の外で元のまま残す画素の色も画素ごとに変換する
+// 範囲の中で -pattern や -skip-edges などにより書き換えなかったタイルの画素は変換しない
+func WithAdjustScope(scope AdjustScope) Option {
+	return func(mp *Processor) {
+		mp.adjustScope = scope
+	}
+}
+
+// rect の範囲のうち、b で選んだかどうかが selected と同じ画素の色を adjusts で順に変換する
+func adjustPixels(img *image.NRGBA, rect image.Rectangle, b *Bitmap, selected bool, adjusts []ColorAdjust) {
+	rect = rect.Intersect(img.Rect)
+	for y := rect.Min.Y; y < rect.Max.Y; y++ {
+		for x := rect.Min.X; x < rect.Max.X; x++ {
+			if b.Contains(x, y) != selected {
+				continue
+			}
+			c := img.NRGBAAt(x, y)
+			for _, a := range adjusts {
+				c = a.Adjust(c)
+			}
+			img.SetNRGBA(x, y, c)
+		}
+	}
+}
+
+// 明るさを調整する ColorAdjust
+// v は -100〜100 で、各チャンネルに 255·v/100 を加える
+func Brightness(v float64) ColorAdjust {
+	offset := 255 * v / 100
+	return ColorAdjustFunc(func(c color.NRGBA) color.NRGBA {
+		return mapRGB(c, func(x float64) float64 {
+			return x + offset
+		})
+	})
+}
+
+// コントラストを調整する ColorAdjust
+// v は -100〜100 で、各チャンネルを 128 を中心に f 倍する
+// f は v ≤ 0 のとき (100+v)/100、v > 0 のとき 100/(100-v) (v = 100 では 255)
+func Contrast(v float64) ColorAdjust {
+	f := contrastFactor(v)
+	return ColorAdjustFunc(func(c color.NRGBA) color.NRGBA {
+		return mapRGB(c, func(x float64) float64 {
+			return (x-128)*f + 128
+		})
+	})
+}
+
+func contrastFactor(v float64) float64 {
+	switch {
+	case v <= 0:
+		return (100 + v) / 100
+	case v >= 100:
+		return 255
+	default:
+		return 100 / (100 - v)
+	}
+}
+
+// 彩度を調整する ColorAdjust
+// v は -100〜100 で、輝度 L = 0.299R + 0.587G + 0.114B からの差を (1+v/100) 倍する
+// v = -100 でグレースケールになる
+func Saturation(v float64) ColorAdjust {
+	f := 1 + v/100
+	return ColorAdjustFunc(func(c color.NRGBA) color.NRGBA {
+		l := 0.299*float64(c.R) + 0.587*float64(c.G) + 0.114*float64(c.B)
+		return mapRGB(c, func(x float64) float64 {
+			return l + (x-l)*f
+		})
+	})
+}
+
+// RGB の各チャンネルに fn を適用し、四捨五入して [0, 255] に収める (透明度は変えない)
+func mapRGB(c color.NRGBA, fn func(float64) float64) color.NRGBA {
+	return color.NRGBA{
+		R: clampUint8(fn(float64(c.R))),
+		G: clampUint8(fn(float64(c.G))),
+		B: clampUint8(fn(float64(c.B))),
+		A: c.A,
+	}
+}
@@ -0,0 +1,159 @@
+package mosaic
+
+import (
+	"context"
+	"image"
+	"image/color"
+	"testing"
+)
+
+// 計算式から求めた変換後の色
+func TestColorAdjustReferenceValues(t *testing.T) {
+	tests := []struct {
+		name   string
+		adjust ColorAdjust
+		in     color.NRGBA
+		want   color.NRGBA
+	}{
+		// x + 255·v/100 (.5 は大きい方に丸める)
+		{"brightness 50", Brightness(50), color.NRGBA{100, 0, 250, 77}, color.NRGBA{228, 128, 255, 77}},
+		{"brightness -20", Brightness(-20), color.NRGBA{100, 40, 60, 255}, color.NRGBA{49, 0, 9, 255}},
+		{"brightness -100", Brightness(-100), color.NRGBA{255, 200, 10, 255}, color.NRGBA{0, 0, 0, 255}},
+		// (x − 128)·f + 128
+		{"contrast 50", Contrast(50), color.NRGBA{100, 0, 250, 255}, color.NRGBA{72, 0, 255, 255}},
+		{"contrast -50", Contrast(-50), color.NRGBA{100, 0, 250, 255}, color.NRGBA{114, 64, 189, 255}},
+		{"contrast -50 half", Contrast(-50), color.NRGBA{127, 129, 255, 255}, color.NRGBA{128, 129, 192, 255}},
+		{"contrast 100", Contrast(100), color.NRGBA{127, 128, 129, 255}, color.NRGBA{0, 128, 255, 255}},
+		{"contrast -100", Contrast(-100), color.NRGBA{0, 77, 255, 10}, color.NRGBA{128, 128, 128, 10}},
+		// L + (x − L)·(1 + v/100)、L = 0.299R + 0.587G + 0.114B
+		{"saturation -100", Saturation(-100), color.NRGBA{255, 0, 0, 255}, color.NRGBA{76, 76, 76, 255}},
+		{"saturation 50", Saturation(50), color.NRGBA{200, 100, 50, 255}, color.NRGBA{238, 88, 13, 255}},
+		{"saturation 100", Saturation(100), color.NRGBA{200, 100, 50, 128}, color.NRGBA{255, 76, 0, 128}},
+		{"saturation gray", Saturation(100), color.NRGBA{90, 90, 90, 255}, color.NRGBA{90, 90, 90, 255}},
+	}
+	for _, tt := range tests {
+		if got := tt.adjust.Adjust(tt.in); got != tt.want {
+			t.Errorf("%s: %v → %v, want %v", tt.name, tt.in, got, tt.want)
+		}
+	}
+}
+
+// 0 の変換はどの色も変えない
+func TestColorAdjustIdentity(t *testing.T) {
+	for _, adjust := range []ColorAdjust{Brightness(0), Contrast(0), Saturation(0)} {
+		for r := 0; r < 256; r += 3 {
+			for g := 0; g < 256; g += 5 {
+				for _, b := range []uint8{0, 1, 127, 128, 254, 255} {
+					c := color.NRGBA{uint8(r), uint8(g), b, uint8(r ^ g)}
+					if got := adjust.Adjust(c); got != c {
+						t.Fatalf("%v → %v", c, got)
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestParseAdjustScope(t *testing.T) {
+	for name, want := range map[string]AdjustScope{"": AdjustRegion, "region": AdjustRegion, "all": AdjustAll} {
+		if got, err := ParseAdjustScope(name); err != nil || got != want {
+			t.Errorf("ParseAdjustScope(%q) = %v, %v", name, got, err)
+		}
+	}
+	if _, err := ParseAdjustScope("selection"); err == nil {
+		t.Error("unknown scope accepted")
+	}
+	if AdjustAll.String() != "all" || AdjustScope(5).String() != "AdjustScope(5)" {
+		t.Errorf("String: %s, %s", AdjustAll, AdjustScope(5))
+	}
+}
+
+// 画素ごとに adjust を適用した img
+func adjusted(img *image.NRGBA, rect image.Rectangle, adjust ColorAdjust) *image.NRGBA {
+	out := image.NewNRGBA(img.Rect)
+	copy(out.Pix, img.Pix)
+	for y := rect.Min.Y; y < rect.Max.Y; y++ {
+		for x := rect.Min.X; x < rect.Max.X; x++ {
+			out.SetNRGBA(x, y, adjust.Adjust(img.NRGBAAt(x, y)))
+		}
+	}
+	return out
+}
+
+// AdjustAll では選ばなかった画素も画素ごとに変換し、選んだ範囲のタイルは AdjustRegion と同じ
+func TestAdjustScopeSelection(t *testing.T) {
+	img := testImageAt(image.Rect(2, 1, 70, 59))
+	sel := image.Rect(10, 10, 40, 30)
+	dark := Brightness(-30)
+	region := process(t, img, 8, WithSelection(Rects(sel)), WithColorAdjust(dark))
+	for i, opts := range [][]Option{{WithWorkers(1)}, {WithWorkers(3), WithPrefetch(1)}, {WithBlockSize(16, 16)}} {
+		all := process(t, img, 8, append(opts, WithSelection(Rects(sel)), WithColorAdjust(dark), WithAdjustScope(AdjustAll))...)
+		for y := img.Rect.Min.Y; y < img.Rect.Max.Y; y++ {
+			for x := img.Rect.Min.X; x < img.Rect.Max.X; x++ {
+				want := dark.Adjust(img.NRGBAAt(x, y))
+				if (image.Point{x, y}).In(sel) {
+					want = region.NRGBAAt(x, y)
+				}
+				if got := all.NRGBAAt(x, y); got != want {
+					t.Fatalf("options %d: (%d,%d) = %v, want %v", i, x, y, got, want)
+				}
+			}
+		}
+	}
+	// 選ばなかった画素は AdjustRegion では元のまま
+	if got := region.NRGBAAt(2, 1); got != img.NRGBAAt(2, 1) {
+		t.Errorf("outside pixel %v, want %v", got, img.NRGBAAt(2, 1))
+	}
+	// 選び方を指定しない場合はどちらも同じ
+	assertSameImage(t, process(t, img, 8, WithColorAdjust(dark), WithAdjustScope(AdjustAll)), process(t, img, 8, WithColorAdjust(dark)))
+	// 変換がなければ何も変えない
+	assertSameImage(t, process(t, img, 8, WithSelection(Rects(sel)), WithAdjustScope(AdjustAll)), process(t, img, 8, WithSelection(Rects(sel))))
+}
+
+// ProcessRegions では、範囲の外の画素を 1 度だけ変換し、重なった範囲を 2 度変換しない
+func TestAdjustScopeRegions(t *testing.T) {
+	img := testImage(64, 48)
+	dark := Brightness(-25)
+	regions := []Region{{Rect: image.Rect(0, 0, 32, 32)}, {Rect: image.Rect(16, 16, 56, 40), TileWidth: 4, TileHeight: 4}}
+	run := func(scope AdjustScope) *image.NRGBA {
+		out := image.NewNRGBA(img.Rect)
+		copy(out.Pix, img.Pix)
+		if err := ProcessRegions(context.Background(), out, 8, 8, regions, WithColorAdjust(dark), WithAdjustScope(scope)); err != nil {
+			t.Fatal(err)
+		}
+		return out
+	}
+	region, all := run(AdjustRegion), run(AdjustAll)
+	for y := 0; y < 48; y++ {
+		for x := 0; x < 64; x++ {
+			want := region.NRGBAAt(x, y)
+			if !(image.Point{x, y}.In(regions[0].Rect) || image.Point{x, y}.In(regions[1].Rect)) {
+				want = dark.Adjust(img.NRGBAAt(x, y))
+			}
+			if got := all.NRGBAAt(x, y); got != want {
+				t.Fatalf("(%d,%d) = %v, want %v", x, y, got, want)
+			}
+		}
+	}
+
+	// PatchRegions は範囲の外の画素を変換し直さない
+	base := image.NewNRGBA(img.Rect)
+	copy(base.Pix, all.Pix)
+	if err := PatchRegions(context.Background(), base, img, 8, 8, regions, WithColorAdjust(dark), WithAdjustScope(AdjustAll)); err != nil {
+		t.Fatal(err)
+	}
+	assertSameImage(t, base, all)
+
+	// 範囲の中で選ばなかった画素も変換する
+	sel := image.Rect(0, 0, 20, 48)
+	out := image.NewNRGBA(img.Rect)
+	copy(out.Pix, img.Pix)
+	if err := ProcessRegions(context.Background(), out, 8, 8, regions[:1], WithSelection(Rects(sel)), WithColorAdjust(dark), WithAdjustScope(AdjustAll)); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []image.Point{{25, 5}, {40, 40}, {19, 40}} {
+		if got, want := out.NRGBAAt(p.X, p.Y), dark.Adjust(img.NRGBAAt(p.X, p.Y)); got != want {
+			t.Errorf("%v = %v, want %v", p, got, want)
+		}
+	}
+}
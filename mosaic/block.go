@@ -0,0 +1,134 @@
+package mosaic
+
+import (
+	"context"
+	"image"
+	"sync"
+	"time"
+)
+
+// 処理の単位を幅 w × 高さ h のブロックにする
+// 幅と高さはタイルの大きさの倍数に切り上げ、ブロックの格子はタイルの格子にそろえるため、結果はバンドで処理した場合と同じになる
+// 横に非常に長い画像でも、作業用のバッファはブロックの大きさで済む
+// ProcessContext、ProcessInto と ProcessInPlace はブロックで処理し、ProcessBands は常にバンドで処理する
+// Stage にはバンドではなくブロックが渡され、TileObserver はブロックの順 (行優先) に呼び出される
+func WithBlockSize(w, h int) Option {
+	return func(mp *Processor) {
+		mp.blockWidth, mp.blockHeight = w, h
+	}
+}
+
+// 処理済みのブロックを受け取るコールバック
+// block の rect の範囲が処理結果で、block はコールバックから戻った後に再利用される
+type BlockFunc func(block *image.NRGBA, rect image.Rectangle) error
+
+// タイルの大きさの倍数に切り上げたブロックの大きさ
+// WithBlockSize を指定していない場合と、余白を持つ Stage (MarginStage) がある場合はゼロ値
+func (mp *Processor) BlockSize() image.Point {
+	if mp.blockWidth <= 0 || mp.blockHeight <= 0 || mp.err != nil || mp.margin > 0 {
+		return image.Point{}
+	}
+	return image.Pt(roundUp(mp.blockWidth, mp.mosaicWidth), roundUp(mp.blockHeight, mp.mosaicHeight))
+}
+
+// ブロックごとにモザイク処理し、処理済みのブロックを行優先の順に fn に渡す
+// ブロックは Grid の左上のタイルから並べ、ブロックの境界はタイルの境界にそろえる
+// WithBlockSize を指定していない場合と余白を持つ Stage がある場合は、画像の幅 × タイルの高さのブロック (バンド) で処理する
+// 進捗の BandsDone と BandsTotal はブロックの数になる
+func (mp *Processor) ProcessBlocks(ctx context.Context, fn BlockFunc) (err error) {
+	if mp.err != nil {
+		return mp.err
+	}
+	if mp.metrics != nil {
+		start := time.Now()
+		mp.metrics.ProcessStarted()
+		defer func() {
+			size := mp.src.Bounds().Size()
+			mp.metrics.ProcessFinished(time.Since(start), size.X*size.Y, err)
+		}()
+	}
+
+	bounds := mp.src.Bounds()
+	size := mp.BlockSize()
+	if size == (image.Point{}) {
+		size = image.Pt(roundUp(max(1, bounds.Dx()), mp.mosaicWidth), mp.mosaicHeight)
+	}
+	var blocks []image.Rectangle
+	start := mp.Grid().start()
+	for y := start.Y; y < bounds.Max.Y; y += size.Y {
+		for x := start.X; x < bounds.Max.X; x += size.X {
+			if r := image.Rect(x, y, x+size.X, y+size.Y).Intersect(bounds); !r.Empty() {
+				blocks = append(blocks, r)
+			}
+		}
+	}
+	total := len(blocks)
+
+	workers := min(max(1, mp.workers), max(1, total))
+	buffers := make([]*image.NRGBA, workers)
+	for i := range buffers {
+		buffers[i] = mp.newBuffer(image.Rect(0, 0, size.X, size.Y+2*mp.margin))
+	}
+	defer mp.releaseBuffers(buffers...)
+	errs := make([]error, workers)
+	rows := &sourceRows{}
+
+	for done := 0; done < total; {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		// 同時に処理するブロックをバッファに読み込んで処理
+		n := min(workers, total-done)
+		rows.prune(blocks[done].Min.Y - mp.margin)
+		if n == 1 {
+			errs[0] = mp.processBlock(buffers[0], blocks[done], rows)
+		} else {
+			var wg sync.WaitGroup
+			for i := 0; i < n; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					errs[i] = mp.processBlock(buffers[i], blocks[done+i], rows)
+				}(i)
+			}
+			wg.Wait()
+		}
+
+		// 処理済みのブロックを順に渡す
+		for i := 0; i < n; i++ {
+			if errs[i] != nil {
+				return errs[i]
+			}
+			rect := blocks[done]
+			if err := fn(buffers[i], rect); err != nil {
+				return err
+			}
+			done++
+			if mp.logger != nil {
+				mp.logger.Debug("block processed", "rect", rect, "blocks_done", done, "blocks_total", total)
+			}
+			if mp.progress != nil {
+				mp.progress(Progress{BandsDone: done, BandsTotal: total})
+			}
+		}
+	}
+	return nil
+}
+
+// ブロックを 1 つ読み込んで処理する
+// バッファの座標は元画像の座標に合わせる
+func (mp *Processor) processBlock(buffer *image.NRGBA, rect image.Rectangle, rows *sourceRows) error {
+	buffer.Rect = image.Rectangle{Min: rect.Min, Max: rect.Min.Add(buffer.Rect.Size())}
+	if mp.margin > 0 {
+		rows.read(mp, buffer, rect)
+	} else {
+		mp.src.readNRGBA(buffer, rect)
+	}
+	return mp.pipeline.Apply(buffer, rect)
+}
+
+// n を m の倍数に切り上げる
+func roundUp(n, m int) int {
+	return (n + m - 1) / m * m
+}
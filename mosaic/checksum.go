@@ -0,0 +1,96 @@
+package mosaic
+
+import (
+	"fmt"
+	"hash/crc32"
+	"image"
+	"strconv"
+	"strings"
+)
+
+// バンドのチェックサムの種類
+type ChecksumAlgorithm string
+
+const (
+	ChecksumCRC32  ChecksumAlgorithm = "crc32"  // CRC-32 (IEEE、PNG や zip と同じ)
+	ChecksumCRC32C ChecksumAlgorithm = "crc32c" // CRC-32C (Castagnoli、CPU の命令を使えるため速い)
+)
+
+var checksumTables = map[ChecksumAlgorithm]*crc32.Table{
+	ChecksumCRC32:  crc32.IEEETable,
+	ChecksumCRC32C: crc32.MakeTable(crc32.Castagnoli),
+}
+
+// チェックサムの種類の名前の一覧
+func ChecksumAlgorithms() []string {
+	return []string{string(ChecksumCRC32), string(ChecksumCRC32C)}
+}
+
+// 名前 (大文字と小文字は区別しない) のチェックサムの種類
+func ChecksumAlgorithmByName(name string) (ChecksumAlgorithm, bool) {
+	alg := ChecksumAlgorithm(strings.ToLower(name))
+	_, ok := checksumTables[alg]
+	return alg, ok
+}
+
+// バンドの処理結果の画素のチェックサム
+// 画素は PixelHash と同じく、各行を左から順に乗算済みにしない R, G, B, A の 4 バイトで並べたもの (範囲の位置と幅と高さは含めない)
+type Checksum struct {
+	Algorithm ChecksumAlgorithm
+	Sum       uint32
+}
+
+// crc32c:0123abcd の形式の文字列 (ゼロ値の場合は空)
+func (c Checksum) String() string {
+	if c.Algorithm == "" {
+		return ""
+	}
+	return fmt.Sprintf("%s:%08x", c.Algorithm, c.Sum)
+}
+
+// String の形式の文字列を解析する
+func ParseChecksum(s string) (Checksum, error) {
+	name, sum, ok := strings.Cut(s, ":")
+	alg, known := ChecksumAlgorithmByName(name)
+	if !ok || !known || len(sum) != 8 {
+		return Checksum{}, fmt.Errorf("mosaic: invalid checksum %q", s)
+	}
+	n, err := strconv.ParseUint(sum, 16, 32)
+	if err != nil {
+		return Checksum{}, fmt.Errorf("mosaic: invalid checksum %q", s)
+	}
+	return Checksum{Algorithm: alg, Sum: uint32(n)}, nil
+}
+
+// img の rect の範囲の画素のチェックサム
+// 行が Pix で続いている場合 (rect が img の幅全体の場合) は Pix を 1 度だけ読む
+func BandChecksum(alg ChecksumAlgorithm, img *image.NRGBA, rect image.Rectangle) Checksum {
+	table := checksumTables[alg]
+	if table == nil {
+		return Checksum{}
+	}
+	rect = rect.Intersect(img.Rect)
+	var sum uint32
+	if !rect.Empty() {
+		width := 4 * rect.Dx()
+		i := img.PixOffset(rect.Min.X, rect.Min.Y)
+		if width == img.Stride {
+			sum = crc32.Update(0, table, img.Pix[i:i+width*rect.Dy()])
+		} else {
+			for y := 0; y < rect.Dy(); y++ {
+				sum = crc32.Update(sum, table, img.Pix[i:i+width])
+				i += img.Stride
+			}
+		}
+	}
+	return Checksum{Algorithm: alg, Sum: sum}
+}
+
+// Bands で取り出すバンドの Band.Checksum に、処理結果の画素のチェックサムを設定する
+// バンドを転送する側と受け取る側で同じチェックサムを求め、途中で壊れたバンドを見つけるために使う
+// ProcessBands の関数には渡せないため、同じ値を BandChecksum で求める
+func WithBandChecksum(alg ChecksumAlgorithm) Option {
+	return func(mp *Processor) {
+		mp.checksum = alg
+	}
+}
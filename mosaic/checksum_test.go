@@ -0,0 +1,141 @@
+package mosaic
+
+import (
+	"context"
+	"hash/crc32"
+	"image"
+	"io"
+	"testing"
+)
+
+// rect の範囲の行を詰めて並べた画素
+func packedPixels(img *image.NRGBA, rect image.Rectangle) []byte {
+	var pix []byte
+	for y := rect.Min.Y; y < rect.Max.Y; y++ {
+		i := img.PixOffset(rect.Min.X, y)
+		pix = append(pix, img.Pix[i:i+4*rect.Dx()]...)
+	}
+	return pix
+}
+
+func TestBandChecksum(t *testing.T) {
+	img := testImageAt(image.Rect(3, 2, 43, 32))
+	for _, tt := range []struct {
+		alg   ChecksumAlgorithm
+		table *crc32.Table
+	}{
+		{ChecksumCRC32, crc32.IEEETable},
+		{ChecksumCRC32C, crc32.MakeTable(crc32.Castagnoli)},
+	} {
+		// 幅全体の範囲と、行が Pix で続いていない範囲
+		for _, rect := range []image.Rectangle{img.Rect, image.Rect(3, 10, 43, 18), image.Rect(10, 5, 30, 20), image.Rect(40, 2, 60, 4)} {
+			want := crc32.Checksum(packedPixels(img, rect.Intersect(img.Rect)), tt.table)
+			if got := BandChecksum(tt.alg, img, rect); got.Algorithm != tt.alg || got.Sum != want {
+				t.Errorf("%s %v: %v, want %08x", tt.alg, rect, got, want)
+			}
+		}
+		if got := BandChecksum(tt.alg, img, image.Rect(100, 100, 110, 110)); got != (Checksum{Algorithm: tt.alg}) {
+			t.Errorf("%s empty rect: %v", tt.alg, got)
+		}
+	}
+	if got := BandChecksum("md5", img, img.Rect); got != (Checksum{}) {
+		t.Errorf("unknown algorithm: %v", got)
+	}
+
+	// 1 画素でも変われば変わる
+	before := BandChecksum(ChecksumCRC32C, img, img.Rect)
+	img.Pix[len(img.Pix)/2] ^= 1
+	if BandChecksum(ChecksumCRC32C, img, img.Rect) == before {
+		t.Error("checksum did not change")
+	}
+}
+
+func TestParseChecksum(t *testing.T) {
+	for _, c := range []Checksum{{ChecksumCRC32, 0}, {ChecksumCRC32C, 0x0123abcd}, {ChecksumCRC32, 0xffffffff}} {
+		s := c.String()
+		got, err := ParseChecksum(s)
+		if err != nil || got != c {
+			t.Errorf("ParseChecksum(%q) = %v, %v, want %v", s, got, err, c)
+		}
+	}
+	if s := (Checksum{ChecksumCRC32C, 0xab}).String(); s != "crc32c:000000ab" {
+		t.Errorf("String = %q", s)
+	}
+	if s := (Checksum{}).String(); s != "" {
+		t.Errorf("zero String = %q", s)
+	}
+	if got, err := ParseChecksum("CRC32C:0123ABCD"); err != nil || got != (Checksum{ChecksumCRC32C, 0x0123abcd}) {
+		t.Errorf("upper case: %v, %v", got, err)
+	}
+	for _, s := range []string{"", "crc32c", "crc32c:", "crc32c:123", "crc32c:0123abcdef", "crc32c:0123abcx", "md5:0123abcd", ":0123abcd"} {
+		if _, err := ParseChecksum(s); err == nil {
+			t.Errorf("ParseChecksum(%q) succeeded", s)
+		}
+	}
+}
+
+// WithBandChecksum を指定すると、Bands の各バンドに処理結果の画素のチェックサムを付ける
+func TestBandsWithChecksum(t *testing.T) {
+	img := testImageAt(image.Rect(1, 3, 70, 50))
+	want := process(t, img, 8)
+	blurred := process(t, img, 8, WithPipeline(NewPipeline(verticalBlur(2))))
+	for _, tt := range []struct {
+		opts []Option
+		want *image.NRGBA // 処理結果
+	}{
+		{[]Option{WithWorkers(1)}, want},
+		{[]Option{WithWorkers(3), WithPrefetch(2)}, want},
+		{[]Option{WithBlockSize(16, 16)}, want},
+		{[]Option{WithPipeline(NewPipeline(verticalBlur(2)))}, blurred},
+	} {
+		for _, alg := range []ChecksumAlgorithm{ChecksumCRC32, ChecksumCRC32C} {
+			it := New(img, 8, 8, append(tt.opts, WithBandChecksum(alg))...).Bands(context.Background())
+			covered := 0
+			for {
+				band, err := it.Next()
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				if band.Checksum != BandChecksum(alg, band.Image, band.Rect) || band.Checksum != BandChecksum(alg, tt.want, band.Rect) {
+					t.Fatalf("band %v: checksum %v", band.Rect, band.Checksum)
+				}
+				covered += band.Rect.Dy()
+			}
+			it.Close()
+			if covered != img.Rect.Dy() {
+				t.Errorf("bands cover %d rows, want %d", covered, img.Rect.Dy())
+			}
+		}
+	}
+
+	// 指定しない場合は付けない
+	it := New(img, 8, 8).Bands(context.Background())
+	defer it.Close()
+	if band, err := it.Next(); err != nil || band.Checksum != (Checksum{}) {
+		t.Errorf("without WithBandChecksum: %v, %v", band.Checksum, err)
+	}
+
+	// 知らない種類は処理のエラーにする
+	if _, err := New(img, 8, 8, WithBandChecksum("md5")).ProcessContext(context.Background()); err == nil {
+		t.Error("unknown algorithm accepted")
+	}
+	// ProcessBands の結果は変えない
+	assertSameImage(t, process(t, img, 8, WithBandChecksum(ChecksumCRC32C)), want)
+}
+
+func TestChecksumAlgorithmByName(t *testing.T) {
+	for _, name := range ChecksumAlgorithms() {
+		if alg, ok := ChecksumAlgorithmByName(name); !ok || string(alg) != name {
+			t.Errorf("%s: %q, %v", name, alg, ok)
+		}
+	}
+	if alg, ok := ChecksumAlgorithmByName("CRC32"); !ok || alg != ChecksumCRC32 {
+		t.Errorf("upper case: %q, %v", alg, ok)
+	}
+	if _, ok := ChecksumAlgorithmByName("xxhash"); ok {
+		t.Error("xxhash accepted")
+	}
+}
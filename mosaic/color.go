@@ -0,0 +1,143 @@
+package mosaic
+
+import (
+	"fmt"
+	"image/color"
+	"math"
+	"strings"
+)
+
+// #rgb または #rrggbb 形式の色を解析 (# は省略できる)
+func ParseHexColor(s string) (color.NRGBA, error) {
+	hex := strings.TrimPrefix(s, "#")
+	if len(hex) == 3 {
+		hex = string([]byte{hex[0], hex[0], hex[1], hex[1], hex[2], hex[2]})
+	}
+	var r, g, b uint8
+	if len(hex) != 6 {
+		return color.NRGBA{}, fmt.Errorf("invalid color %q (want #rrggbb)", s)
+	}
+	if _, err := fmt.Sscanf(hex, "%02x%02x%02x", &r, &g, &b); err != nil {
+		return color.NRGBA{}, fmt.Errorf("invalid color %q (want #rrggbb)", s)
+	}
+	return color.NRGBA{R: r, G: g, B: b, A: 255}, nil
+}
+
+// 色を小文字の #rrggbb 形式にする (透明度は含めない)
+func FormatHexColor(c color.NRGBA) string {
+	return fmt.Sprintf("#%02x%02x%02x", c.R, c.G, c.B)
+}
+
+// 塗りつぶしの前に、タイルの色を tint へ strength (0〜1) の割合で近づける
+// strength が 0 の場合は何もしない
+func WithTint(tint color.NRGBA, strength float64) Option {
+	if strength == 0 {
+		return WithColorAdjust()
+	}
+	return WithColorAdjust(TintAdjust(tint, strength))
+}
+
+// 塗りつぶしの前に、タイルの色の色相を degrees 度回転させる
+// HSL 色空間で回転させるため、明度と彩度は変わらない
+// degrees が 0 の場合は何もしない
+func WithHueShift(degrees float64) Option {
+	if degrees == 0 {
+		return WithColorAdjust()
+	}
+	return WithColorAdjust(HueShift(degrees))
+}
+
+// 色を tint へ strength の割合で近づける ColorAdjust
+func TintAdjust(tint color.NRGBA, strength float64) ColorAdjust {
+	return ColorAdjustFunc(func(c color.NRGBA) color.NRGBA {
+		return Tint(c, tint, strength)
+	})
+}
+
+// 色相を degrees 度回転させる ColorAdjust
+func HueShift(degrees float64) ColorAdjust {
+	return ColorAdjustFunc(func(c color.NRGBA) color.NRGBA {
+		return ShiftHue(c, degrees)
+	})
+}
+
+// c を tint へ strength の割合で線形に近づける (透明度は変えない)
+func Tint(c, tint color.NRGBA, strength float64) color.NRGBA {
+	mix := func(a, b uint8) uint8 {
+		return clampUint8(float64(a) + (float64(b)-float64(a))*strength)
+	}
+	return color.NRGBA{
+		R: mix(c.R, tint.R),
+		G: mix(c.G, tint.G),
+		B: mix(c.B, tint.B),
+		A: c.A,
+	}
+}
+
+// c の色相を degrees 度回転させる (透明度は変えない)
+func ShiftHue(c color.NRGBA, degrees float64) color.NRGBA {
+	h, s, l := RGBToHSL(c.R, c.G, c.B)
+	h = math.Mod(h+degrees, 360)
+	if h < 0 {
+		h += 360
+	}
+	r, g, b := HSLToRGB(h, s, l)
+	return color.NRGBA{R: r, G: g, B: b, A: c.A}
+}
+
+// RGB を HSL に変換
+// h は [0, 360)、s と l は [0, 1]
+func RGBToHSL(r, g, b uint8) (h, s, l float64) {
+	rf, gf, bf := float64(r)/255, float64(g)/255, float64(b)/255
+	maxC := math.Max(rf, math.Max(gf, bf))
+	minC := math.Min(rf, math.Min(gf, bf))
+	l = (maxC + minC) / 2
+	d := maxC - minC
+	if d == 0 {
+		return 0, 0, l
+	}
+
+	s = d / (1 - math.Abs(2*l-1))
+	switch maxC {
+	case rf:
+		h = math.Mod((gf-bf)/d, 6)
+	case gf:
+		h = (bf-rf)/d + 2
+	default:
+		h = (rf-gf)/d + 4
+	}
+	h *= 60
+	if h < 0 {
+		h += 360
+	}
+	return h, s, l
+}
+
+// HSL を RGB に変換
+func HSLToRGB(h, s, l float64) (r, g, b uint8) {
+	c := (1 - math.Abs(2*l-1)) * s
+	x := c * (1 - math.Abs(math.Mod(h/60, 2)-1))
+	m := l - c/2
+
+	var rf, gf, bf float64
+	switch {
+	case h < 60:
+		rf, gf, bf = c, x, 0
+	case h < 120:
+		rf, gf, bf = x, c, 0
+	case h < 180:
+		rf, gf, bf = 0, c, x
+	case h < 240:
+		rf, gf, bf = 0, x, c
+	case h < 300:
+		rf, gf, bf = x, 0, c
+	default:
+		rf, gf, bf = c, 0, x
+	}
+	return clampUint8((rf + m) * 255), clampUint8((gf + m) * 255), clampUint8((bf + m) * 255)
+}
+
+// 四捨五入して [0, 255] に収める
+func clampUint8(v float64) uint8 {
+	return uint8(math.Max(0, math.Min(255, math.Round(v))))
+}
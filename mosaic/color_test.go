@@ -0,0 +1,112 @@
+package mosaic
+
+import (
+	"image/color"
+	"math"
+	"testing"
+)
+
+// a と b の各成分の差が 1 以内かどうか
+func within1(a, b color.NRGBA) bool {
+	near := func(x, y uint8) bool { return math.Abs(float64(x)-float64(y)) <= 1 }
+	return near(a.R, b.R) && near(a.G, b.G) && near(a.B, b.B) && a.A == b.A
+}
+
+func TestShiftHue(t *testing.T) {
+	red := color.NRGBA{255, 0, 0, 255}
+	tests := []struct {
+		in      color.NRGBA
+		degrees float64
+		want    color.NRGBA
+	}{
+		{red, 0, red},
+		{red, 120, color.NRGBA{0, 255, 0, 255}},
+		{red, 240, color.NRGBA{0, 0, 255, 255}},
+		{red, 60, color.NRGBA{255, 255, 0, 255}},
+		// 0 度と 360 度の境界で折り返す
+		{red, 360, red},
+		{red, 720, red},
+		{red, -360, red},
+		{red, -120, color.NRGBA{0, 0, 255, 255}},
+		{color.NRGBA{255, 0, 64, 255}, 30, color.NRGBA{255, 64, 0, 255}},
+		{color.NRGBA{255, 64, 0, 255}, -30, color.NRGBA{255, 0, 64, 255}},
+		{color.NRGBA{255, 0, 1, 255}, 1, color.NRGBA{255, 3, 0, 255}},
+		{color.NRGBA{255, 1, 0, 255}, -1, color.NRGBA{255, 0, 3, 255}},
+		// 明度と彩度は変わらず、透明度も変えない
+		{color.NRGBA{200, 100, 50, 128}, 180, color.NRGBA{50, 150, 200, 128}},
+		// 無彩色は色相がないため変わらない
+		{color.NRGBA{0, 0, 0, 255}, 90, color.NRGBA{0, 0, 0, 255}},
+		{color.NRGBA{128, 128, 128, 255}, 90, color.NRGBA{128, 128, 128, 255}},
+		{color.NRGBA{255, 255, 255, 255}, 270, color.NRGBA{255, 255, 255, 255}},
+	}
+	for _, tt := range tests {
+		if got := ShiftHue(tt.in, tt.degrees); !within1(got, tt.want) {
+			t.Errorf("ShiftHue(%v, %g) = %v, want %v", tt.in, tt.degrees, got, tt.want)
+		}
+	}
+}
+
+func TestShiftHueRoundTrip(t *testing.T) {
+	// 回転して戻すと、すべての色相で元の色に ±1 で戻る
+	for h := 0; h < 360; h += 7 {
+		r, g, b := HSLToRGB(float64(h), 0.8, 0.4)
+		c := color.NRGBA{r, g, b, 255}
+		for _, degrees := range []float64{1, 45, 179, 359.5, -1} {
+			if got := ShiftHue(ShiftHue(c, degrees), -degrees); !within1(got, c) {
+				t.Errorf("ShiftHue(ShiftHue(%v, %g), %g) = %v", c, degrees, -degrees, got)
+			}
+		}
+	}
+}
+
+func TestRGBToHSLRange(t *testing.T) {
+	for _, c := range []color.NRGBA{{255, 0, 0, 255}, {255, 0, 1, 255}, {255, 1, 0, 255}, {0, 1, 255, 255}, {1, 0, 255, 255}, {7, 7, 7, 255}} {
+		h, s, l := RGBToHSL(c.R, c.G, c.B)
+		if h < 0 || h >= 360 || s < 0 || s > 1 || l < 0 || l > 1 {
+			t.Errorf("RGBToHSL(%v) = %g, %g, %g", c, h, s, l)
+		}
+		if r, g, b := HSLToRGB(h, s, l); !within1(color.NRGBA{r, g, b, 255}, c) {
+			t.Errorf("HSLToRGB(RGBToHSL(%v)) = %v, %v, %v", c, r, g, b)
+		}
+	}
+}
+
+func TestTint(t *testing.T) {
+	brand := color.NRGBA{0x00, 0x44, 0xcc, 255}
+	tests := []struct {
+		in       color.NRGBA
+		strength float64
+		want     color.NRGBA
+	}{
+		{color.NRGBA{200, 100, 50, 255}, 0, color.NRGBA{200, 100, 50, 255}},
+		{color.NRGBA{200, 100, 50, 255}, 1, brand},
+		{color.NRGBA{200, 100, 50, 255}, 0.5, color.NRGBA{100, 84, 127, 255}},
+		{color.NRGBA{255, 255, 255, 255}, 0.25, color.NRGBA{191, 208, 242, 255}},
+		// 透明度は変えない
+		{color.NRGBA{0, 0, 0, 64}, 1, color.NRGBA{0x00, 0x44, 0xcc, 64}},
+		// 0〜1 の外では範囲に収める (Validate では拒否する)
+		{color.NRGBA{200, 100, 50, 255}, 2, color.NRGBA{0, 36, 255, 255}},
+		{color.NRGBA{200, 100, 50, 255}, -1, color.NRGBA{255, 132, 0, 255}},
+	}
+	for _, tt := range tests {
+		if got := Tint(tt.in, brand, tt.strength); !within1(got, tt.want) {
+			t.Errorf("Tint(%v, %g) = %v, want %v", tt.in, tt.strength, got, tt.want)
+		}
+	}
+}
+
+func TestTintThenPalette(t *testing.T) {
+	img := testImage(32, 32)
+	palette := []color.NRGBA{{0, 0, 0, 255}, {0, 0, 255, 255}, {255, 255, 255, 255}}
+	// 青へ強く近づけてから減色すると、すべてのタイルが青になる
+	out := process(t, img, 8, WithTint(color.NRGBA{0, 0, 255, 255}, 0.9), WithColorAdjust(PaletteAdjust(palette)))
+	for y := 0; y < 32; y++ {
+		for x := 0; x < 32; x++ {
+			if c := out.NRGBAAt(x, y); c != palette[1] {
+				t.Fatalf("pixel (%d, %d) = %v, want %v", x, y, c, palette[1])
+			}
+		}
+	}
+	// WithTint と WithHueShift の 0 は何もしない
+	assertSameImage(t, process(t, img, 8, WithTint(color.NRGBA{255, 0, 0, 255}, 0), WithHueShift(0)), process(t, img, 8))
+}
@@ -0,0 +1,112 @@
+package mosaic
+
+import (
+	"errors"
+	"image"
+	"io"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// 登録されていない形式の画像を読み込もうとしたことを表すエラー
+// image.ErrFormat を包む
+type UnknownFormatError struct {
+	Formats []string // このビルドで読み込める形式
+}
+
+func (e *UnknownFormatError) Error() string {
+	if len(e.Formats) == 0 {
+		return "mosaic: unknown image format (no formats are registered)"
+	}
+	return "mosaic: unknown image format (registered formats: " + strings.Join(e.Formats, ", ") + ")"
+}
+
+func (e *UnknownFormatError) Unwrap() error {
+	return image.ErrFormat
+}
+
+var (
+	decodersMu sync.Mutex
+	decoders   []string // RegisterDecoder で登録した形式 (登録順)
+)
+
+// 標準ライブラリなどが image.RegisterFormat で登録する形式の先頭のバイト列 (jpeg、png、gif、bmp、tiff、webp)
+// 登録されているかどうかは、先頭のバイト列だけの入力で DecodeConfig を試して確かめる
+var knownMagics = []string{
+	"\xff\xd8",
+	"\x89PNG\r\n\x1a\n",
+	"GIF89a",
+	"BM",
+	"II*\x00",
+	"RIFF\x00\x00\x00\x00WEBPVP8 ",
+}
+
+// 外部のデコーダーを name の形式として登録する
+// magic は image.RegisterFormat と同じく先頭のバイト列で、"?" は任意の 1 バイトに一致する
+// 形式は登録した順に判定し、先に登録した形式の magic にも一致する場合は先の形式になる
+// (標準ライブラリの形式はパッケージの初期化で登録されるため、常にこれより先に判定する)
+// 大きさはデコードしてから求めるため、画像全体をデコードせずに大きさを確かめる処理 (サーバーの上限など) では使えない
+// 大きさを求められるデコーダーは RegisterDecoderConfig で登録すること
+func RegisterDecoder(name, magic string, decode func(io.Reader) (image.Image, error)) {
+	RegisterDecoderConfig(name, magic, decode, func(r io.Reader) (image.Config, error) {
+		img, err := decode(r)
+		if err != nil {
+			return image.Config{}, err
+		}
+		b := img.Bounds()
+		return image.Config{ColorModel: img.ColorModel(), Width: b.Dx(), Height: b.Dy()}, nil
+	})
+}
+
+// 画像の大きさを求める関数とあわせて、外部のデコーダーを name の形式として登録する
+// 同じ名前で magic を変えて複数回登録できる
+func RegisterDecoderConfig(name, magic string, decode func(io.Reader) (image.Image, error), decodeConfig func(io.Reader) (image.Config, error)) {
+	image.RegisterFormat(name, magic, decode, decodeConfig)
+	decodersMu.Lock()
+	defer decodersMu.Unlock()
+	if !slices.Contains(decoders, name) {
+		decoders = append(decoders, name)
+	}
+}
+
+// このビルドで読み込める形式の名前
+// 標準的な形式のうち登録されているもの、RegisterDecoder で登録した形式の順に並べる
+func Formats() []string {
+	var names []string
+	for _, magic := range knownMagics {
+		// 形式を判別できれば、デコードに失敗しても形式の名前を返す
+		if _, name, err := image.DecodeConfig(strings.NewReader(magic)); !errors.Is(err, image.ErrFormat) && !slices.Contains(names, name) {
+			names = append(names, name)
+		}
+	}
+	decodersMu.Lock()
+	defer decodersMu.Unlock()
+	for _, name := range decoders {
+		if !slices.Contains(names, name) {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// image.Decode と同じく画像をデコードし、形式の名前を返却
+// 形式を判別できない場合は、読み込める形式を並べた *UnknownFormatError を返却
+func Decode(r io.Reader) (image.Image, string, error) {
+	img, format, err := image.Decode(r)
+	return img, format, formatError(err)
+}
+
+// image.DecodeConfig と同じく画像の大きさを求め、形式の名前を返却
+// 形式を判別できない場合は、読み込める形式を並べた *UnknownFormatError を返却
+func DecodeConfig(r io.Reader) (image.Config, string, error) {
+	config, format, err := image.DecodeConfig(r)
+	return config, format, formatError(err)
+}
+
+func formatError(err error) error {
+	if errors.Is(err, image.ErrFormat) {
+		return &UnknownFormatError{Formats: Formats()}
+	}
+	return err
+}
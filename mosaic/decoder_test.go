@@ -0,0 +1,74 @@
+package mosaic
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"io"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// テスト用の形式: "MFAK"、幅、高さ (各 1 バイト)、続けて画素ごとの RGB
+const fakeMagic = "MFAK"
+
+func decodeFake(r io.Reader) (image.Image, error) {
+	var header [6]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+	img := image.NewNRGBA(image.Rect(0, 0, int(header[4]), int(header[5])))
+	rgb := make([]byte, 3*len(img.Pix)/4)
+	if _, err := io.ReadFull(r, rgb); err != nil {
+		return nil, err
+	}
+	for i := 0; i < len(rgb)/3; i++ {
+		copy(img.Pix[4*i:], rgb[3*i:3*i+3])
+		img.Pix[4*i+3] = 255
+	}
+	return img, nil
+}
+
+func encodeFake(img *image.NRGBA) []byte {
+	data := []byte(fakeMagic)
+	data = append(data, byte(img.Rect.Dx()), byte(img.Rect.Dy()))
+	for i := 0; i < len(img.Pix); i += 4 {
+		data = append(data, img.Pix[i:i+3]...)
+	}
+	return data
+}
+
+func init() {
+	RegisterDecoder("fake", fakeMagic, decodeFake)
+}
+
+func TestRegisterDecoder(t *testing.T) {
+	src := testImage(20, 12)
+	data := encodeFake(src)
+
+	img, format, err := Decode(bytes.NewReader(data))
+	if err != nil || format != "fake" {
+		t.Fatalf("Decode: format %q, %v", format, err)
+	}
+	assertSameImage(t, ConvertToNRGBA(img), src)
+	// 大きさを求める関数を登録しない場合はデコードして求める
+	config, format, err := DecodeConfig(bytes.NewReader(data))
+	if err != nil || format != "fake" || config.Width != 20 || config.Height != 12 {
+		t.Errorf("DecodeConfig = %dx%d %q, %v", config.Width, config.Height, format, err)
+	}
+
+	// 登録した形式は標準の形式のあとに並ぶ
+	formats := Formats()
+	if i := slices.Index(formats, "fake"); i < 0 || i < slices.Index(formats, "png") {
+		t.Errorf("Formats() = %v", formats)
+	}
+	_, _, err = Decode(strings.NewReader("not an image"))
+	var unknown *UnknownFormatError
+	if !errors.As(err, &unknown) || !errors.Is(err, image.ErrFormat) || !strings.Contains(err.Error(), "fake") {
+		t.Errorf("unknown format: %v", err)
+	}
+
+	// デコードした画像は登録した形式でも同じくモザイク処理できる
+	assertSameImage(t, process(t, ConvertToNRGBA(img), 8), process(t, src, 8))
+}
@@ -0,0 +1,90 @@
+package mosaic
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"image"
+)
+
+// 処理結果の画素の SHA-256
+// エンコーダーによらない処理結果の識別に使う
+type Digest [sha256.Size]byte
+
+// sha256: に続けた 16 進数の文字列
+func (d Digest) String() string {
+	return "sha256:" + hex.EncodeToString(d[:])
+}
+
+// 画像の画素を上の行から順に受け取り、Digest を求める
+// 幅と高さを "NRGBA 幅 高さ\n" の形で書いた後、各行の画素を左から順に乗算済みにしない R, G, B, A の 4 バイトで書いたものの SHA-256 とする
+// 画像の座標の原点は含めないため、同じ画素の画像は範囲の位置によらず同じ Digest になる
+type PixelHash struct {
+	bounds image.Rectangle
+	next   int // 次に受け取る行
+	h      hash.Hash
+}
+
+// bounds の画像の Digest を求める PixelHash
+func NewPixelHash(bounds image.Rectangle) *PixelHash {
+	h := sha256.New()
+	fmt.Fprintf(h, "NRGBA %d %d\n", bounds.Dx(), bounds.Dy())
+	return &PixelHash{bounds: bounds, next: bounds.Min.Y, h: h}
+}
+
+// img の rect の行を加える
+// rect は画像の幅全体で、前に加えた行の直後から始まること (そうでない場合はエラー)
+func (p *PixelHash) Write(img *image.NRGBA, rect image.Rectangle) error {
+	if rect.Empty() {
+		return nil
+	}
+	if rect.Min.X != p.bounds.Min.X || rect.Max.X != p.bounds.Max.X || rect.Min.Y != p.next || rect.Max.Y > p.bounds.Max.Y {
+		return fmt.Errorf("mosaic: digest rows %v do not continue from row %d of %v", rect, p.next, p.bounds)
+	}
+	for y := rect.Min.Y; y < rect.Max.Y; y++ {
+		i := img.PixOffset(rect.Min.X, y)
+		p.h.Write(img.Pix[i : i+4*rect.Dx()])
+	}
+	p.next = rect.Max.Y
+	return nil
+}
+
+// すべての行を加えたかどうか
+func (p *PixelHash) Complete() bool {
+	return p.next == p.bounds.Max.Y
+}
+
+// 加えた行の Digest
+// すべての行を加えていない場合は false を返却
+func (p *PixelHash) Sum() (Digest, bool) {
+	var d Digest
+	if !p.Complete() {
+		return d, false
+	}
+	p.h.Sum(d[:0])
+	return d, true
+}
+
+// img 全体の Digest
+func ImageDigest(img *image.NRGBA) Digest {
+	p := NewPixelHash(img.Rect)
+	p.Write(img, img.Rect)
+	d, _ := p.Sum()
+	return d
+}
+
+// モザイク処理を実行し、処理結果の画像の Digest を返却
+// 出力画像を確保せず、処理済みのバンドを順に加えるため、ProcessContext の結果の ImageDigest と同じになる
+func (mp *Processor) ProcessDigest(ctx context.Context) (Digest, error) {
+	p := NewPixelHash(mp.src.Bounds())
+	err := mp.ProcessBands(ctx, func(band *image.NRGBA, rect image.Rectangle) error {
+		return p.Write(band, rect)
+	})
+	if err != nil {
+		return Digest{}, err
+	}
+	d, _ := p.Sum()
+	return d, nil
+}
@@ -0,0 +1,101 @@
+package mosaic
+
+import (
+	"context"
+	"crypto/sha256"
+	"image"
+	"image/color"
+	"testing"
+)
+
+// ProcessDigest の結果 (失敗した場合はテストを止める)
+func processDigest(t *testing.T, img *image.NRGBA, tile int, opts ...Option) Digest {
+	t.Helper()
+	d, err := New(img, tile, tile, opts...).ProcessDigest(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+func TestProcessDigestPinned(t *testing.T) {
+	// 処理結果の画素が変わった場合にだけ変わる値 (エンコーダーの変更では変わらない)
+	tests := []struct {
+		name string
+		img  *image.NRGBA
+		tile int
+		opts []Option
+		want string
+	}{
+		{"gradient", testImage(64, 48), 8, nil, "sha256:857a4587011d13997b37a2fec63b239f8e20fe8e02adf6dced05cf4f839dbfa6"},
+		{"edge tiles", testImage(50, 30), 7, nil, "sha256:0850244a028b293797d9ac41f729f12f47191ae546b2d6d155a193aff7206607"},
+		{"hue shift", testImage(40, 40), 10, []Option{WithHueShift(90)}, "sha256:34f3d6859da30645f26538248b494010b2bb12327ecd67e16f4ddcb35b9df0dd"},
+	}
+	for _, tt := range tests {
+		got := processDigest(t, tt.img, tt.tile, tt.opts...)
+		if got.String() != tt.want {
+			t.Errorf("%s: %s, want %s", tt.name, got, tt.want)
+		}
+		if want := ImageDigest(process(t, tt.img, tt.tile, tt.opts...)); got != want {
+			t.Errorf("%s: ProcessDigest %s != ImageDigest %s", tt.name, got, want)
+		}
+	}
+}
+
+func TestImageDigestFormat(t *testing.T) {
+	// "NRGBA 幅 高さ\n" に続けて、上の行から順に画素の R, G, B, A を並べたものの SHA-256
+	img := image.NewNRGBA(image.Rect(5, 7, 7, 8))
+	img.SetNRGBA(5, 7, color.NRGBA{1, 2, 3, 255})
+	img.SetNRGBA(6, 7, color.NRGBA{4, 5, 6, 128})
+	want := sha256.Sum256(append([]byte("NRGBA 2 1\n"), 1, 2, 3, 255, 4, 5, 6, 128))
+	if got := ImageDigest(img); got != Digest(want) {
+		t.Errorf("ImageDigest %s, want %x", got, want)
+	}
+}
+
+func TestProcessDigestOptions(t *testing.T) {
+	img := testImage(64, 48)
+	base := processDigest(t, img, 8)
+	if again := processDigest(t, img, 8, WithWorkers(3)); again != base {
+		t.Errorf("digest changed with the number of workers: %s != %s", again, base)
+	}
+	tests := []struct {
+		name string
+		tile int
+		opts []Option
+	}{
+		{"tile", 16, nil},
+		{"grid origin", 8, []Option{WithGridOrigin(image.Pt(3, 0))}},
+		{"hue shift", 8, []Option{WithHueShift(1)}},
+		{"tint", 8, []Option{WithTint(color.NRGBA{0, 0, 255, 255}, 0.1)}},
+		{"rounding", 8, []Option{WithRounding(RoundTruncate)}},
+	}
+	for _, tt := range tests {
+		if d := processDigest(t, img, tt.tile, tt.opts...); d == base {
+			t.Errorf("%s: digest did not change", tt.name)
+		}
+	}
+}
+
+func TestPixelHashRowOrder(t *testing.T) {
+	img := testImage(10, 10)
+	p := NewPixelHash(img.Rect)
+	if err := p.Write(img, image.Rect(0, 5, 10, 10)); err == nil {
+		t.Error("rows out of order accepted")
+	}
+	if err := p.Write(img, image.Rect(0, 0, 4, 5)); err == nil {
+		t.Error("partial rows accepted")
+	}
+	if _, ok := p.Sum(); ok {
+		t.Error("Sum of an incomplete image succeeded")
+	}
+	if err := p.Write(img, image.Rect(0, 0, 10, 5)); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Write(img, image.Rect(0, 5, 10, 10)); err != nil {
+		t.Fatal(err)
+	}
+	if d, ok := p.Sum(); !ok || d != ImageDigest(img) {
+		t.Errorf("Sum %s, %v, want %s", d, ok, ImageDigest(img))
+	}
+}
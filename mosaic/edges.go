@@ -0,0 +1,84 @@
+package mosaic
+
+import (
+	"image"
+	"image/color"
+)
+
+// エッジの強いタイルを処理せずに残す設定
+// タイルのエッジの量 (EdgeEnergy) が threshold より大きいタイルは書き換えない
+// 0 以下の場合はすべてのタイルを処理する
+func WithSkipEdges(threshold float64) Option {
+	return func(mp *Processor) {
+		mp.skipEdges = threshold
+	}
+}
+
+// タイルのエッジの量
+// タイル内で左右および上下に隣り合う画素の組ごとに R, G, B の差の絶対値を合計し、3 × タイルの画素数で割った値
+// 透明度は考慮しない。平坦なタイルは 0 で、1 画素ごとに黒と白を交互に並べたタイルでは 510 に近づく
+// 値はタイルの大きさに対して正規化しているため、タイルの大きさを変えても同じしきい値を使える
+func EdgeEnergy(pixels PixelRegion) float64 {
+	return edgeEnergy(pixels.img, pixels.Rect)
+}
+
+func edgeEnergy(img *image.NRGBA, rect image.Rectangle) float64 {
+	if rect.Empty() {
+		return 0
+	}
+	var sum uint64
+	var prev []uint8
+	width := 4 * rect.Dx()
+	for y := rect.Min.Y; y < rect.Max.Y; y++ {
+		i := img.PixOffset(rect.Min.X, y)
+		row := img.Pix[i : i+width : i+width]
+		sum += rowEdges(row, prev)
+		prev = row
+	}
+	return float64(sum) / float64(3*rect.Dx()*rect.Dy())
+}
+
+// row の中で左右に隣り合う画素と、上の行 prev (nil の場合は省く) と上下に隣り合う画素の差の合計
+func rowEdges(row, prev []uint8) uint64 {
+	var sum uint64
+	for x := 0; x < len(row); x += 4 {
+		if x+4 < len(row) {
+			sum += diffRGB(row[x:x+3], row[x+4:x+7])
+		}
+		if prev != nil {
+			sum += diffRGB(row[x:x+3], prev[x:x+3])
+		}
+	}
+	return sum
+}
+
+func diffRGB(a, b []uint8) uint64 {
+	return uint64(absDiff(a[0], b[0]) + absDiff(a[1], b[1]) + absDiff(a[2], b[2]))
+}
+
+// 平均色とエッジの量を、タイルの画素を 1 度だけ読んで計算
+// 平均色は averageColor と同じ値になる
+func averageColorEdges(img *image.NRGBA, rect image.Rectangle, rounding Rounding) (color.NRGBA, float64) {
+	if rect.Empty() {
+		return color.NRGBA{0, 0, 0, 255}, 0
+	}
+	var s colorSum
+	var edges uint64
+	var prev []uint8
+	width := 4 * rect.Dx()
+	for y := rect.Min.Y; y < rect.Max.Y; y++ {
+		i := img.PixOffset(rect.Min.X, y)
+		row := img.Pix[i : i+width : i+width]
+		for x := 0; x < len(row); x += 4 {
+			s.add(row[x], row[x+1], row[x+2], row[x+3])
+			if x+4 < len(row) {
+				edges += diffRGB(row[x:x+3], row[x+4:x+7])
+			}
+			if prev != nil {
+				edges += diffRGB(row[x:x+3], prev[x:x+3])
+			}
+		}
+		prev = row
+	}
+	return s.color(rounding), float64(edges) / float64(3*s.n)
+}
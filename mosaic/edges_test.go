@@ -0,0 +1,145 @@
+package mosaic
+
+import (
+	"image"
+	"image/color"
+	"math"
+	"math/rand/v2"
+	"testing"
+)
+
+// 1 画素ごとに黒と白を交互に並べた n×n の画像
+func checkerboard(n int) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, n, n))
+	for y := 0; y < n; y++ {
+		for x := 0; x < n; x++ {
+			v := uint8(255 * ((x + y) % 2))
+			img.SetNRGBA(x, y, color.NRGBA{v, v, v, 255})
+		}
+	}
+	return img
+}
+
+func TestEdgeEnergy(t *testing.T) {
+	flat := image.NewNRGBA(image.Rect(0, 0, 8, 8))
+	for i := range flat.Pix {
+		flat.Pix[i] = 100
+	}
+	if e := EdgeEnergy(PixelRegion{img: flat, Rect: flat.Rect}); e != 0 {
+		t.Errorf("flat tile: EdgeEnergy = %g, want 0", e)
+	}
+	if e := EdgeEnergy(PixelRegion{img: flat, Rect: image.Rectangle{}}); e != 0 {
+		t.Errorf("empty tile: EdgeEnergy = %g, want 0", e)
+	}
+
+	// n×n の市松模様は 2n(n-1) 組の差がそれぞれ 3 × 255 なので、510(n-1)/n
+	for _, n := range []int{1, 2, 8, 16, 64} {
+		img := checkerboard(n)
+		want := 510 * float64(n-1) / float64(n)
+		if e := EdgeEnergy(PixelRegion{img: img, Rect: img.Rect}); math.Abs(e-want) > 1e-9 {
+			t.Errorf("%dx%d checkerboard: EdgeEnergy = %g, want %g", n, n, e, want)
+		}
+	}
+
+	// 透明度は考慮せず、範囲の外の画素は含めない
+	img := image.NewNRGBA(image.Rect(0, 0, 3, 1))
+	img.SetNRGBA(0, 0, color.NRGBA{0, 0, 0, 0})
+	img.SetNRGBA(1, 0, color.NRGBA{30, 60, 90, 255})
+	img.SetNRGBA(2, 0, color.NRGBA{255, 255, 255, 255})
+	if e, want := EdgeEnergy(PixelRegion{img: img, Rect: image.Rect(0, 0, 2, 1)}), 180.0/6; e != want {
+		t.Errorf("EdgeEnergy = %g, want %g", e, want)
+	}
+}
+
+// 平均色とエッジの量を同時に求めても、別々に求めた値と同じ
+func TestAverageColorEdges(t *testing.T) {
+	rng := rand.New(rand.NewPCG(1, 2))
+	img := image.NewNRGBA(image.Rect(-3, 5, 40, 30))
+	for i := range img.Pix {
+		img.Pix[i] = uint8(rng.Uint32())
+	}
+	for i := 0; i < 50; i++ {
+		x, y := -3+rng.IntN(43), 5+rng.IntN(25)
+		rect := image.Rect(x, y, x+1+rng.IntN(20), y+1+rng.IntN(20)).Intersect(img.Rect)
+		for _, rounding := range []Rounding{RoundHalfUp, RoundTruncate} {
+			c, e := averageColorEdges(img, rect, rounding)
+			if want := averageColor(img, rect, false, rounding); c != want {
+				t.Fatalf("%v: color %v, want %v", rect, c, want)
+			}
+			if want := edgeEnergy(img, rect); e != want {
+				t.Fatalf("%v: edges %g, want %g", rect, e, want)
+			}
+		}
+	}
+}
+
+// なめらかなグラデーションのうち、右上の 4 分の 1 だけにノイズを加えた画像
+func texturedQuadrantImage() (*image.NRGBA, image.Rectangle) {
+	img := image.NewNRGBA(image.Rect(0, 0, 64, 64))
+	textured := image.Rect(32, 0, 64, 32)
+	rng := rand.New(rand.NewPCG(3, 4))
+	for y := 0; y < 64; y++ {
+		for x := 0; x < 64; x++ {
+			c := color.NRGBA{uint8(2 * x), uint8(2 * y), 128, 255}
+			if image.Pt(x, y).In(textured) {
+				c = color.NRGBA{uint8(rng.Uint32()), uint8(rng.Uint32()), uint8(rng.Uint32()), 255}
+			}
+			img.SetNRGBA(x, y, c)
+		}
+	}
+	return img, textured
+}
+
+func TestSkipEdgesLeavesTexturedQuadrant(t *testing.T) {
+	img, textured := texturedQuadrantImage()
+	// グラデーションのエッジの量は 4/3 程度、ノイズは 85 程度
+	for _, tt := range []struct {
+		name string
+		opts []Option
+	}{
+		{"mean", nil},
+		{"tile color", []Option{WithTileColor(MeanColor)}},
+		{"truncate", []Option{WithRounding(RoundTruncate)}},
+		{"hsv", []Option{WithTileColor(HSVMeanColor)}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var skipped, processed int
+			observe := WithTileObserver(func(tile TileInfo) {
+				if tile.Skipped {
+					skipped++
+				} else {
+					processed++
+				}
+			})
+			out := process(t, img, 8, append([]Option{WithSkipEdges(20), WithWorkers(1), observe}, tt.opts...)...)
+			want := process(t, img, 8, tt.opts...)
+			for y := 0; y < 64; y++ {
+				for x := 0; x < 64; x++ {
+					expected := want.NRGBAAt(x, y)
+					if image.Pt(x, y).In(textured) {
+						expected = img.NRGBAAt(x, y)
+					}
+					if got := out.NRGBAAt(x, y); got != expected {
+						t.Fatalf("pixel (%d, %d) = %v, want %v", x, y, got, expected)
+					}
+				}
+			}
+			if skipped != 16 || processed != 48 {
+				t.Errorf("skipped %d and processed %d tiles, want 16 and 48", skipped, processed)
+			}
+		})
+	}
+
+	// 0 以下のしきい値ではすべてのタイルを処理する
+	for _, threshold := range []float64{0, -1} {
+		assertSameImage(t, process(t, img, 8, WithSkipEdges(threshold)), process(t, img, 8))
+	}
+	// しきい値はタイルの大きさによらない
+	assertSameImage(t, process(t, img, 16, WithSkipEdges(20)), func() *image.NRGBA {
+		want := process(t, img, 16)
+		for y := textured.Min.Y; y < textured.Max.Y; y++ {
+			copy(want.Pix[want.PixOffset(textured.Min.X, y):want.PixOffset(textured.Max.X, y)], img.Pix[img.PixOffset(textured.Min.X, y):])
+		}
+		return want
+	}())
+}
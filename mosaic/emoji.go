@@ -0,0 +1,153 @@
+package mosaic
+
+import (
+	"bufio"
+	"bytes"
+	_ "embed"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"io"
+	"strings"
+	"sync"
+)
+
+// 絵文字
+type Emoji struct {
+	Char  string // 絵文字の文字 (異体字セレクタを含む)
+	Name  string
+	Color color.NRGBA // 白い背景に描いたときの平均色
+}
+
+//go:embed emoji.txt
+var emojiData string
+
+//go:embed emoji.png
+var emojiSpriteData []byte
+
+// 色で選べる絵文字 (色の付いた四角、丸、ハートの 27 個)
+var Emojis = parseEmojis(emojiData)
+
+// 絵文字のスプライトの幅と高さ (px)
+const EmojiSpriteSize = 32
+
+// 絵文字、#RRGGBB、名前を並べた表のファイルを解析
+// 埋め込んだファイルの誤りはプログラムの誤りのため、panic する
+func parseEmojis(data string) []Emoji {
+	var emojis []Emoji
+	for _, line := range strings.Split(data, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "# ") {
+			continue
+		}
+		fields := strings.Fields(line)
+		var r, g, b uint8
+		if len(fields) < 3 {
+			panic(fmt.Sprintf("mosaic: invalid emoji line %q", line))
+		}
+		if _, err := fmt.Sscanf(fields[1], "#%02x%02x%02x", &r, &g, &b); err != nil {
+			panic(fmt.Sprintf("mosaic: invalid emoji line %q", line))
+		}
+		emojis = append(emojis, Emoji{
+			Char:  fields[0],
+			Name:  strings.Join(fields[2:], " "),
+			Color: color.NRGBA{R: r, G: g, B: b, A: 255},
+		})
+	}
+	return emojis
+}
+
+// 絵文字のスプライトを横に並べた画像 (Emojis と同じ順)
+var emojiSprites = sync.OnceValue(func() *image.NRGBA {
+	img, err := png.Decode(bytes.NewReader(emojiSpriteData))
+	if err != nil {
+		panic(fmt.Sprintf("mosaic: invalid emoji sprites: %v", err))
+	}
+	if img.Bounds().Dx() != EmojiSpriteSize*len(Emojis) {
+		panic("mosaic: emoji sprites do not match the emoji table")
+	}
+	return ConvertToNRGBA(img)
+})
+
+// 絵文字のモザイク
+// タイルを 1 マスとし、タイルの色を Emojis の最も近い色 (PaletteMatcher と同じ基準) の絵文字に置き換える
+// 書き換えなかったタイルと完全に透明なタイルは空白のマスとする
+type EmojiGrid struct {
+	Columns, Rows int
+	matcher       *PaletteMatcher
+	cells         []int // 行ごとに左から並べたマスの絵文字 (Emojis の添字、-1 は空白)
+}
+
+func NewEmojiGrid(columns, rows int) *EmojiGrid {
+	colors := make([]color.NRGBA, len(Emojis))
+	for i, e := range Emojis {
+		colors[i] = e.Color
+	}
+	cells := make([]int, columns*rows)
+	for i := range cells {
+		cells[i] = -1
+	}
+	return &EmojiGrid{Columns: columns, Rows: rows, matcher: NewPaletteMatcher(colors), cells: cells}
+}
+
+// WithTileObserver に渡す関数
+// 異なるタイルに対しては、複数のゴルーチンから同時に呼び出せる
+func (g *EmojiGrid) Observe(t TileInfo) {
+	if t.X < 0 || t.X >= g.Columns || t.Y < 0 || t.Y >= g.Rows {
+		return
+	}
+	i := -1
+	if !t.Skipped && t.Color.A != 0 {
+		i = g.matcher.Nearest(t.Color)
+	}
+	g.cells[t.Y*g.Columns+t.X] = i
+}
+
+// 左から x 番目、上から y 番目のマスの絵文字 (空白のマスは false)
+func (g *EmojiGrid) At(x, y int) (Emoji, bool) {
+	if x < 0 || x >= g.Columns || y < 0 || y >= g.Rows || g.cells[y*g.Columns+x] < 0 {
+		return Emoji{}, false
+	}
+	return Emojis[g.cells[y*g.Columns+x]], true
+}
+
+// 絵文字の幅に合わせた空白のマス (全角スペース)
+const emojiBlank = "　"
+
+// 1 行に 1 段のマスを並べたテキストで w に書き出す
+func (g *EmojiGrid) WriteText(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	for y := 0; y < g.Rows; y++ {
+		for x := 0; x < g.Columns; x++ {
+			if e, ok := g.At(x, y); ok {
+				bw.WriteString(e.Char)
+			} else {
+				bw.WriteString(emojiBlank)
+			}
+		}
+		bw.WriteByte('\n')
+	}
+	return bw.Flush()
+}
+
+// 1 マスを EmojiSpriteSize×EmojiSpriteSize の画素で描いた画像
+// 絵文字のマスは白い背景にスプライトを重ね、空白のマスは透明にする
+func (g *EmojiGrid) Image() *image.NRGBA {
+	sprites := emojiSprites()
+	img := image.NewNRGBA(image.Rect(0, 0, g.Columns*EmojiSpriteSize, g.Rows*EmojiSpriteSize))
+	white := color.NRGBA{0xff, 0xff, 0xff, 0xff}
+	for y := 0; y < g.Rows; y++ {
+		for x := 0; x < g.Columns; x++ {
+			i := g.cells[y*g.Columns+x]
+			if i < 0 {
+				continue
+			}
+			rect := image.Rect(x*EmojiSpriteSize, y*EmojiSpriteSize, (x+1)*EmojiSpriteSize, (y+1)*EmojiSpriteSize)
+			fillRect(img, rect, white)
+			draw.Draw(img, rect, sprites, image.Pt(i*EmojiSpriteSize, 0), draw.Over)
+		}
+	}
+	return img
+}
@@ -0,0 +1,56 @@
+package mosaic
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestEmojiGrid(t *testing.T) {
+	if len(Emojis) != 27 {
+		t.Fatalf("%d emojis, want 27", len(Emojis))
+	}
+	// 表の色はそれぞれの絵文字になる
+	g := NewEmojiGrid(len(Emojis), 1)
+	for i, e := range Emojis {
+		g.Observe(TileInfo{X: i, Color: e.Color})
+	}
+	for i, e := range Emojis {
+		if got, ok := g.At(i, 0); !ok || got.Char != e.Char {
+			t.Errorf("%s (%v): got %q", e.Name, e.Color, got.Char)
+		}
+	}
+
+	// 表にない色は最も近い色の絵文字 (純白は最も白い 🤍) に、書き換えなかったタイルと透明なタイルは空白にする
+	g = NewEmojiGrid(3, 2)
+	for _, tile := range []TileInfo{
+		{X: 0, Y: 0, Color: color.NRGBA{230, 20, 30, 255}},
+		{X: 1, Y: 0, Color: color.NRGBA{10, 10, 10, 255}},
+		{X: 2, Y: 0, Color: color.NRGBA{255, 255, 255, 255}},
+		{X: 0, Y: 1, Color: color.NRGBA{120, 190, 240, 255}},
+		{X: 1, Y: 1, Color: color.NRGBA{1, 2, 3, 255}, Skipped: true},
+		{X: 2, Y: 1, Color: color.NRGBA{255, 0, 0, 0}},
+	} {
+		g.Observe(tile)
+	}
+	var buf bytes.Buffer
+	if err := g.WriteText(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if want := "🟥⬛🤍\n🟦　　\n"; buf.String() != want {
+		t.Errorf("text %q, want %q", buf.String(), want)
+	}
+
+	// 画像は空白のマスを透明にする
+	img := g.Image()
+	if img.Rect != image.Rect(0, 0, 3*EmojiSpriteSize, 2*EmojiSpriteSize) {
+		t.Fatalf("image %v", img.Rect)
+	}
+	if c := img.NRGBAAt(EmojiSpriteSize+1, EmojiSpriteSize+1); c.A != 0 {
+		t.Errorf("blank cell pixel %v, want transparent", c)
+	}
+	if c := img.NRGBAAt(EmojiSpriteSize/2, EmojiSpriteSize/2); c.A != 255 {
+		t.Errorf("emoji cell pixel %v, want opaque", c)
+	}
+}
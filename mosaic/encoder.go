@@ -0,0 +1,275 @@
+package mosaic
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"mime"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/yashikota/go-streaming-image-mosaic/internal/imagemeta"
+	"github.com/yashikota/go-streaming-image-mosaic/internal/tiff"
+)
+
+// PNG などの圧縮の程度
+type Compression int
+
+const (
+	CompressionDefault Compression = iota // 形式の既定
+	CompressionNone                       // 圧縮しない
+	CompressionFast                       // 速度を優先する
+	CompressionBest                       // 大きさを優先する
+)
+
+// default、none、fast または best の名前の Compression
+func ParseCompression(s string) (Compression, error) {
+	switch s {
+	case "default":
+		return CompressionDefault, nil
+	case "none":
+		return CompressionNone, nil
+	case "fast":
+		return CompressionFast, nil
+	case "best":
+		return CompressionBest, nil
+	}
+	return 0, fmt.Errorf("unknown compression %q (want default, none, fast or best)", s)
+}
+
+// エンコードの設定
+// 形式ごとに使う設定だけを参照し、対応していない設定は無視する
+type EncodeOptions struct {
+	Quality     int         // 非可逆圧縮の品質 (1〜100、0 の場合は形式の既定)
+	Compression Compression // 可逆圧縮の程度
+	Lossless    bool        // 可逆と非可逆を選べる形式で可逆にするかどうか
+	DPI         float64     // ファイルに記録する解像度 (0 の場合は記録しない)
+}
+
+// 画像を 1 つの形式で書き出すエンコーダー
+type Encoder interface {
+	Encode(w io.Writer, img image.Image, opts EncodeOptions) error
+}
+
+// 関数を Encoder として使うための型
+type EncoderFunc func(w io.Writer, img image.Image, opts EncodeOptions) error
+
+func (f EncoderFunc) Encode(w io.Writer, img image.Image, opts EncodeOptions) error {
+	return f(w, img, opts)
+}
+
+// 登録されていない形式で書き出そうとしたことを表すエラー
+type UnknownEncoderError struct {
+	Name     string   // 指定した形式の名前か拡張子
+	Encoders []string // このビルドで書き出せる形式
+}
+
+func (e *UnknownEncoderError) Error() string {
+	return fmt.Sprintf("mosaic: unknown output format %q (registered formats: %s)", e.Name, strings.Join(e.Encoders, ", "))
+}
+
+// 登録されたエンコーダー
+type encoderEntry struct {
+	name       string
+	mediaType  string
+	extensions []string // 小文字で "." から始まる拡張子
+	enc        Encoder
+}
+
+var (
+	encodersMu sync.RWMutex
+	encoders   []encoderEntry // 登録順
+)
+
+func init() {
+	RegisterEncoder("jpeg", EncoderFunc(encodeJPEG), "image/jpeg", ".jpg", ".jpeg")
+	RegisterEncoder("png", EncoderFunc(encodePNG), "image/png", ".png")
+	RegisterEncoder("gif", EncoderFunc(encodeGIF), "image/gif", ".gif")
+	RegisterEncoder("tiff", EncoderFunc(encodeTIFF), "image/tiff", ".tif", ".tiff")
+	RegisterEncoder("ppm", offsetEncoder(ppmFormat{}), "image/x-portable-pixmap", ".ppm")
+	RegisterEncoder("rgba", offsetEncoder(rgbaFormat{}), "", ".rgba")
+	RegisterEncoder("svg", TileFormat("svg"), "image/svg+xml", ".svg")
+	RegisterEncoder("html", TileFormat("html"), "text/html", ".html", ".htm")
+	RegisterEncoder("stitch", TileFormat("stitch"), "")
+	RegisterEncoder("emoji-text", TileFormat("emoji-text"), "text/plain", ".txt")
+	RegisterEncoder("emoji-png", TileFormat("emoji-png"), "")
+}
+
+// 処理後の画像ではなく、タイルの位置と色から書き出す形式 (svg、html など)
+// 形式の名前と拡張子を登録するためのもので、書き出しは WithTileObserver で受け取ったタイルの色から行う
+// Encode は常に *TileFormatError を返却
+type TileFormat string
+
+func (f TileFormat) Encode(io.Writer, image.Image, EncodeOptions) error {
+	return &TileFormatError{Name: string(f)}
+}
+
+// タイルから書き出す形式を画像のエンコーダーとして使おうとしたことを表すエラー
+type TileFormatError struct {
+	Name string
+}
+
+func (e *TileFormatError) Error() string {
+	return fmt.Sprintf("mosaic: %s is written from the tiles, not from an image", e.Name)
+}
+
+// name がタイルから書き出す形式かどうか
+func IsTileFormat(name string) bool {
+	e, ok := findEncoder(func(e encoderEntry) bool { return e.name == strings.ToLower(name) })
+	_, tiles := e.enc.(TileFormat)
+	return ok && tiles
+}
+
+// enc を name の形式として登録する
+// mediaType はサーバーの Content-Type と Accept の照合に使い、extensions は出力のパスから形式を決めるのに使う
+// 同じ名前で登録し直すと置き換え、拡張子と MIME タイプは後から登録した形式を優先する
+func RegisterEncoder(name string, enc Encoder, mediaType string, extensions ...string) {
+	e := encoderEntry{name: strings.ToLower(name), mediaType: mediaType, enc: enc}
+	for _, ext := range extensions {
+		if !strings.HasPrefix(ext, ".") {
+			ext = "." + ext
+		}
+		e.extensions = append(e.extensions, strings.ToLower(ext))
+	}
+	encodersMu.Lock()
+	defer encodersMu.Unlock()
+	if i := slices.IndexFunc(encoders, func(x encoderEntry) bool { return x.name == e.name }); i >= 0 {
+		encoders[i] = e
+		return
+	}
+	encoders = append(encoders, e)
+}
+
+// このビルドで書き出せる形式の名前 (登録順)
+func Encoders() []string {
+	encodersMu.RLock()
+	defer encodersMu.RUnlock()
+	names := make([]string, len(encoders))
+	for i, e := range encoders {
+		names[i] = e.name
+	}
+	return names
+}
+
+// name の形式のエンコーダーを返却
+// 登録されていない場合は、書き出せる形式を並べた *UnknownEncoderError を返却
+func LookupEncoder(name string) (Encoder, error) {
+	e, ok := findEncoder(func(e encoderEntry) bool { return e.name == strings.ToLower(name) })
+	if !ok {
+		return nil, &UnknownEncoderError{Name: name, Encoders: Encoders()}
+	}
+	return e.enc, nil
+}
+
+// 出力の形式の名前を決める
+// format を指定した場合はそれを使い、空の場合は path の拡張子から決める
+// どちらからも決められない場合は *UnknownEncoderError を返却
+func ResolveEncoder(format, path string) (string, Encoder, error) {
+	if format != "" {
+		enc, err := LookupEncoder(format)
+		return strings.ToLower(format), enc, err
+	}
+	ext := strings.ToLower(filepath.Ext(path))
+	e, ok := findEncoder(func(e encoderEntry) bool { return ext != "" && slices.Contains(e.extensions, ext) })
+	if !ok {
+		return "", nil, &UnknownEncoderError{Name: ext, Encoders: Encoders()}
+	}
+	return e.name, e.enc, nil
+}
+
+// name の形式の MIME タイプ (登録されていない場合は空)
+func EncoderMediaType(name string) string {
+	e, _ := findEncoder(func(e encoderEntry) bool { return e.name == strings.ToLower(name) })
+	return e.mediaType
+}
+
+// MIME タイプ mediaType で書き出す形式の名前
+// パラメーターは無視し、見つからない場合は false を返却
+func EncoderForMediaType(mediaType string) (string, bool) {
+	mt, _, err := mime.ParseMediaType(mediaType)
+	if err != nil {
+		return "", false
+	}
+	e, ok := findEncoder(func(e encoderEntry) bool { return e.mediaType == mt })
+	return e.name, ok
+}
+
+// 後から登録したものを優先して、条件に合うエンコーダーを探す
+func findEncoder(match func(encoderEntry) bool) (encoderEntry, bool) {
+	encodersMu.RLock()
+	defer encodersMu.RUnlock()
+	for i := len(encoders) - 1; i >= 0; i-- {
+		if match(encoders[i]) {
+			return encoders[i], true
+		}
+	}
+	return encoderEntry{}, false
+}
+
+// モザイク処理を実行し、処理後の画像を format の形式で w に書き出す
+// 形式が登録されていない場合は処理せずに *UnknownEncoderError、タイルから書き出す形式の場合は *TileFormatError を返却
+func (mp *Processor) ProcessTo(ctx context.Context, w io.Writer, format string, opts EncodeOptions) error {
+	enc, err := LookupEncoder(format)
+	if err != nil {
+		return err
+	}
+	if f, ok := enc.(TileFormat); ok {
+		return &TileFormatError{Name: string(f)}
+	}
+	output, err := mp.ProcessContext(ctx)
+	if err != nil {
+		return err
+	}
+	return enc.Encode(w, output, opts)
+}
+
+func encodeJPEG(w io.Writer, img image.Image, opts EncodeOptions) error {
+	var o *jpeg.Options
+	if opts.Quality > 0 {
+		o = &jpeg.Options{Quality: opts.Quality}
+	}
+	if opts.DPI > 0 {
+		w = imagemeta.JPEGWriter(w, opts.DPI)
+	}
+	return jpeg.Encode(w, img, o)
+}
+
+func encodePNG(w io.Writer, img image.Image, opts EncodeOptions) error {
+	enc := png.Encoder{}
+	switch opts.Compression {
+	case CompressionNone:
+		enc.CompressionLevel = png.NoCompression
+	case CompressionFast:
+		enc.CompressionLevel = png.BestSpeed
+	case CompressionBest:
+		enc.CompressionLevel = png.BestCompression
+	}
+	if opts.DPI > 0 {
+		w = imagemeta.PNGWriter(w, opts.DPI)
+	}
+	return enc.Encode(w, img)
+}
+
+func encodeGIF(w io.Writer, img image.Image, _ EncodeOptions) error {
+	return gif.Encode(w, img, nil)
+}
+
+// 1 ページの TIFF で書き出す
+// 圧縮はエンコーダーの既定のまま変えない
+func encodeTIFF(w io.Writer, img image.Image, opts EncodeOptions) error {
+	var res tiff.Resolution
+	if opts.DPI > 0 {
+		res = tiff.ResolutionDPI(opts.DPI)
+	}
+	enc := tiff.NewEncoder(w, 1)
+	if err := enc.Encode(img, res); err != nil {
+		return err
+	}
+	return enc.Close()
+}
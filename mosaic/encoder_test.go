@@ -0,0 +1,106 @@
+package mosaic
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"image"
+	"io"
+	"slices"
+	"testing"
+)
+
+func TestResolveEncoder(t *testing.T) {
+	tests := []struct {
+		format, path, want string
+	}{
+		{"", "out.jpg", "jpeg"},
+		{"", "OUT.JPEG", "jpeg"},
+		{"", "dir.v2/out.png", "png"},
+		{"", "out.tif", "tiff"},
+		{"", "out.svg", "svg"},
+		{"", "out.htm", "html"},
+		{"", "out.txt", "emoji-text"},
+		// -format は拡張子より優先する
+		{"png", "out.jpg", "png"},
+		{"PNG", "out", "png"},
+		{"stitch", "pattern.png", "stitch"},
+	}
+	for _, tt := range tests {
+		name, enc, err := ResolveEncoder(tt.format, tt.path)
+		if err != nil || name != tt.want || enc == nil {
+			t.Errorf("ResolveEncoder(%q, %q) = %q, %v, %v, want %q", tt.format, tt.path, name, enc, err, tt.want)
+		}
+	}
+}
+
+func TestResolveEncoderUnknown(t *testing.T) {
+	for _, tt := range []struct{ format, path, name string }{
+		{"webp", "out.jpg", "webp"},
+		{"", "out.webp", ".webp"},
+		{"", "out", ""},
+		{"", "-", ""},
+	} {
+		_, _, err := ResolveEncoder(tt.format, tt.path)
+		var unknown *UnknownEncoderError
+		if !errors.As(err, &unknown) {
+			t.Fatalf("ResolveEncoder(%q, %q): error %v is not *UnknownEncoderError", tt.format, tt.path, err)
+		}
+		// 書き出せる形式をすべて並べる
+		if unknown.Name != tt.name || !slices.Equal(unknown.Encoders, Encoders()) {
+			t.Errorf("ResolveEncoder(%q, %q): %+v", tt.format, tt.path, unknown)
+		}
+	}
+}
+
+func TestTileFormats(t *testing.T) {
+	for _, name := range []string{"svg", "html", "stitch", "emoji-text", "emoji-png"} {
+		if !slices.Contains(Encoders(), name) || !IsTileFormat(name) {
+			t.Errorf("%s is not registered as a tile format", name)
+		}
+		// 画像からは書き出せない
+		err := New(testImage(8, 8), 4, 4).ProcessTo(context.Background(), io.Discard, name, EncodeOptions{})
+		var tf *TileFormatError
+		if !errors.As(err, &tf) || tf.Name != name {
+			t.Errorf("ProcessTo(%s) = %v, want *TileFormatError", name, err)
+		}
+	}
+	for _, name := range []string{"jpeg", "png", "ppm", "webp"} {
+		if IsTileFormat(name) {
+			t.Errorf("IsTileFormat(%s) = true", name)
+		}
+	}
+	if mt := EncoderMediaType("svg"); mt != "image/svg+xml" {
+		t.Errorf("media type of svg = %q", mt)
+	}
+}
+
+func TestRegisterEncoder(t *testing.T) {
+	raw := EncoderFunc(func(w io.Writer, img image.Image, _ EncodeOptions) error {
+		_, err := w.Write(ConvertToNRGBA(img).Pix)
+		return err
+	})
+	RegisterEncoder("test-raw", raw, "application/x-test-raw", "testraw")
+	name, _, err := ResolveEncoder("", "out.TESTRAW")
+	if err != nil || name != "test-raw" {
+		t.Fatalf("ResolveEncoder = %q, %v", name, err)
+	}
+	if got, ok := EncoderForMediaType("application/x-test-raw; q=1"); !ok || got != "test-raw" {
+		t.Errorf("EncoderForMediaType = %q, %v", got, ok)
+	}
+
+	img := testImage(16, 8)
+	var buf bytes.Buffer
+	if err := New(img, 4, 4).ProcessTo(context.Background(), &buf, "test-raw", EncodeOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf.Bytes(), process(t, img, 4).Pix) {
+		t.Error("ProcessTo did not write the processed image")
+	}
+
+	// 同じ拡張子は後から登録した形式を優先する
+	RegisterEncoder("test-raw2", raw, "", ".testraw")
+	if name, _, _ := ResolveEncoder("", "out.testraw"); name != "test-raw2" {
+		t.Errorf("extension resolves to %q, want the later registration", name)
+	}
+}
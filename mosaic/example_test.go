@@ -0,0 +1,34 @@
+package mosaic_test
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+
+	"github.com/yashikota/go-streaming-image-mosaic/mosaic"
+)
+
+// 1 つのタイルの色を求めて塗る
+func ExampleTileColor() {
+	img := image.NewNRGBA(image.Rect(0, 0, 4, 4))
+	for x := 0; x < 4; x++ {
+		for y := 0; y < 4; y++ {
+			img.SetNRGBA(x, y, color.NRGBA{uint8(x * 60), 0, 100, 255})
+		}
+	}
+	c, err := mosaic.TileColor(img, image.Rect(0, 0, 4, 4), mosaic.ColorMode{})
+	if err != nil {
+		panic(err)
+	}
+	mosaic.FillTile(img, image.Rect(0, 0, 2, 2), c)
+	fmt.Println(c, img.NRGBAAt(1, 1), img.NRGBAAt(3, 3))
+	// Output: {90 0 100 255} {90 0 100 255} {180 0 100 255}
+}
+
+// 画像からはみ出したタイルは重なる範囲だけで求め、Strict では重ならない範囲をエラーにする
+func ExampleTileColor_strict() {
+	img := image.NewNRGBA(image.Rect(0, 0, 8, 8))
+	_, err := mosaic.TileColor(img, image.Rect(8, 8, 16, 16), mosaic.ColorMode{Strict: true})
+	fmt.Println(err)
+	// Output: mosaic: tile (8,8)-(16,16) does not overlap image bounds (0,0)-(8,8)
+}
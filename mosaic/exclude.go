@@ -0,0 +1,104 @@
+package mosaic
+
+import (
+	"image"
+	"image/color"
+)
+
+// 画素をモザイク処理から除外するかどうかを決める関数
+// 除外した画素はタイルの色の計算に含めず、出力でも元の値のまま残す
+type ExcludeFunc func(c color.NRGBA) bool
+
+// 除外する画素を決める関数を設定
+// すべての画素を除外したタイルは書き換えない
+func WithExclude(fn ExcludeFunc) Option {
+	return func(mp *Processor) {
+		mp.exclude = fn
+	}
+}
+
+// いずれかの色との RGB の各成分の差が tolerance 以下の画素を除外する ExcludeFunc
+// クロマキーのように、特定の色で描いた部分を処理しない場合に使う
+func ExcludeColors(tolerance int, colors ...color.NRGBA) ExcludeFunc {
+	colors = append([]color.NRGBA(nil), colors...)
+	return func(c color.NRGBA) bool {
+		for _, key := range colors {
+			if absDiff(c.R, key.R) <= tolerance && absDiff(c.G, key.G) <= tolerance && absDiff(c.B, key.B) <= tolerance {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+func absDiff(a, b uint8) int {
+	if a > b {
+		return int(a - b)
+	}
+	return int(b - a)
+}
+
+// 処理から除外する画素の条件 (WithExclude の関数と、WithSelection で選んだバンドの画素)
+type pixelFilter struct {
+	exclude  ExcludeFunc
+	selected *Bitmap
+}
+
+// 除外する条件があるかどうか
+func (f pixelFilter) active() bool {
+	return f.exclude != nil || f.selected != nil
+}
+
+// (x, y) にある色 c の画素を除外するかどうか
+func (f pixelFilter) excluded(x, y int, c color.NRGBA) bool {
+	if f.selected != nil && !f.selected.Contains(x, y) {
+		return true
+	}
+	return f.exclude != nil && f.exclude(c)
+}
+
+// 除外した画素の位置と元の値
+type excludedPixel struct {
+	offset int
+	c      [4]uint8
+}
+
+// タイル内の除外する画素を buf に追加して返却
+func appendExcluded(buf []excludedPixel, img *image.NRGBA, rect image.Rectangle, filter pixelFilter) []excludedPixel {
+	for y := rect.Min.Y; y < rect.Max.Y; y++ {
+		i := img.PixOffset(rect.Min.X, y)
+		row := img.Pix[i : i+4*rect.Dx() : i+4*rect.Dx()]
+		for x := 0; x < len(row); x += 4 {
+			c := color.NRGBA{row[x], row[x+1], row[x+2], row[x+3]}
+			if filter.excluded(rect.Min.X+x/4, y, c) {
+				buf = append(buf, excludedPixel{offset: i + x, c: [4]uint8{c.R, c.G, c.B, c.A}})
+			}
+		}
+	}
+	return buf
+}
+
+// 除外した画素を元の値に戻す
+func restoreExcluded(img *image.NRGBA, pixels []excludedPixel) {
+	for _, p := range pixels {
+		copy(img.Pix[p.offset:p.offset+4], p.c[:])
+	}
+}
+
+// 除外する画素を除いて、指定範囲の画素の平均色を計算
+// 計算の方法は averageColorAlpha と同じで、除外していない画素の数で割る
+func averageColorExcluding(img *image.NRGBA, rect image.Rectangle, filter pixelFilter, rounding Rounding) color.NRGBA {
+	var s colorSum
+	width := 4 * rect.Dx()
+	for y := rect.Min.Y; y < rect.Max.Y; y++ {
+		i := img.PixOffset(rect.Min.X, y)
+		row := img.Pix[i : i+width : i+width]
+		for x := 0; x < len(row); x += 4 {
+			if filter.excluded(rect.Min.X+x/4, y, color.NRGBA{row[x], row[x+1], row[x+2], row[x+3]}) {
+				continue
+			}
+			s.add(row[x], row[x+1], row[x+2], row[x+3])
+		}
+	}
+	return s.color(rounding)
+}
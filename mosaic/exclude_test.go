@@ -0,0 +1,85 @@
+package mosaic
+
+import (
+	"image/color"
+	"testing"
+)
+
+func TestExcludeColors(t *testing.T) {
+	magenta, green := color.NRGBA{255, 0, 255, 255}, color.NRGBA{0, 255, 0, 255}
+	exclude := ExcludeColors(12, magenta, green)
+	tests := []struct {
+		c    color.NRGBA
+		want bool
+	}{
+		{magenta, true},
+		{green, true},
+		// 各成分の差が許容値以下
+		{color.NRGBA{243, 12, 243, 255}, true},
+		{color.NRGBA{242, 0, 255, 255}, false},
+		{color.NRGBA{255, 13, 255, 255}, false},
+		{color.NRGBA{10, 250, 5, 255}, true},
+		// 透明度は比べない
+		{color.NRGBA{255, 0, 255, 0}, true},
+		{color.NRGBA{128, 128, 128, 255}, false},
+	}
+	for _, tt := range tests {
+		if got := exclude(tt.c); got != tt.want {
+			t.Errorf("exclude(%v) = %v, want %v", tt.c, got, tt.want)
+		}
+	}
+	if !ExcludeColors(0, magenta)(magenta) || ExcludeColors(0, magenta)(color.NRGBA{254, 0, 255, 255}) {
+		t.Error("tolerance 0 does not match exactly")
+	}
+	if ExcludeColors(255)(magenta) {
+		t.Error("no colors excluded a pixel")
+	}
+}
+
+// 除外した画素は平均に含めず、出力でも元の値のまま残す
+func TestExcludeAveragesIncludedPixels(t *testing.T) {
+	const tile = 8
+	key := color.NRGBA{255, 0, 255, 255}
+	img := testImage(40, 24)
+	isKey := func(x, y int) bool { return (x*3+y*5)%7 == 0 || (x < 8 && y < 8) }
+	for y := 0; y < 24; y++ {
+		for x := 0; x < 40; x++ {
+			if isKey(x, y) {
+				// 許容値の範囲でずらした色も除外する
+				img.SetNRGBA(x, y, color.NRGBA{key.R - uint8(x%4), key.G + uint8(y%4), key.B, 255})
+			}
+		}
+	}
+	for _, opts := range [][]Option{{WithWorkers(1)}, {WithWorkers(3)}, {WithPrefetch(2)}, {WithBlockSize(16, 16)}} {
+		out := process(t, img, tile, append(opts, WithExclude(ExcludeColors(3, key)))...)
+		for ty := 0; ty < 24; ty += tile {
+			for tx := 0; tx < 40; tx += tile {
+				var s colorSum
+				for y := ty; y < ty+tile; y++ {
+					for x := tx; x < tx+tile; x++ {
+						if c := img.NRGBAAt(x, y); !isKey(x, y) {
+							s.add(c.R, c.G, c.B, c.A)
+						}
+					}
+				}
+				mean := s.color(RoundHalfUp)
+				for y := ty; y < ty+tile; y++ {
+					for x := tx; x < tx+tile; x++ {
+						want := mean
+						if isKey(x, y) {
+							// すべての画素を除外した左上のタイルも書き換えない
+							want = img.NRGBAAt(x, y)
+						}
+						if got := out.NRGBAAt(x, y); got != want {
+							t.Fatalf("%d options: pixel (%d, %d) = %v, want %v", len(opts), x, y, got, want)
+						}
+					}
+				}
+			}
+		}
+	}
+
+	// 除外する画素がない場合は通常の処理と同じ
+	plain := testImage(40, 24)
+	assertSameImage(t, process(t, plain, tile, WithExclude(ExcludeColors(0, key))), process(t, plain, tile))
+}
@@ -0,0 +1,28 @@
+package mosaic
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"io/fs"
+)
+
+// fsys の name の画像を読み込み、モザイク処理した結果を返却
+// 埋め込みファイルや zip など、os.Open で開けない入力にも使える
+// fs.FS は読み込み専用のため出力は扱わず、返却した画像の書き出しは呼び出し側で行う
+// タイルの大きさとオプションは New と同じ形で受け取る
+// デコードには Decode を使うため、対応する形式のパッケージを読み込むか、RegisterDecoder で登録しておくこと (例: import _ "image/jpeg")
+func ProcessFS(fsys fs.FS, name string, tileWidth, tileHeight int, opts ...Option) (*image.NRGBA, error) {
+	file, err := fsys.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	img, _, err := Decode(file)
+	if err != nil {
+		return nil, fmt.Errorf("mosaic: %s: %w", name, err)
+	}
+	// 変換した画像はここでしか使わないため、結果を書き戻して出力画像を確保しない
+	return New(ConvertToNRGBA(img), tileWidth, tileHeight, opts...).ProcessInPlace(context.Background())
+}
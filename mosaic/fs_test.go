@@ -0,0 +1,42 @@
+package mosaic
+
+import (
+	"errors"
+	"io/fs"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func TestProcessFS(t *testing.T) {
+	src := testImage(20, 12)
+	fsys := fstest.MapFS{
+		"img/a.fake":   {Data: encodeFake(src)},
+		"img/b.fake":   {Data: encodeFake(src)[:10]},
+		"img/c.txt":    {Data: []byte("not an image")},
+		"img/d/e.fake": {Data: encodeFake(src)},
+	}
+
+	for _, name := range []string{"img/a.fake", "img/d/e.fake"} {
+		got, err := ProcessFS(fsys, name, 4, 4)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		assertSameImage(t, got, process(t, src, 4))
+	}
+	// オプションは New と同じく適用する
+	got, err := ProcessFS(fsys, "img/a.fake", 4, 4, WithHueShift(90))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertSameImage(t, got, process(t, src, 4, WithHueShift(90)))
+
+	if _, err := ProcessFS(fsys, "img/missing.fake", 4, 4); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("missing file: %v, want fs.ErrNotExist", err)
+	}
+	for _, name := range []string{"img/b.fake", "img/c.txt"} {
+		if _, err := ProcessFS(fsys, name, 4, 4); err == nil || !strings.Contains(err.Error(), name) {
+			t.Errorf("%s: error %v, want one naming the file", name, err)
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package mosaic
+
+import (
+	"image"
+)
+
+// 塗りつぶし後のタイルに加えるノイズの設定
+// 同じ Seed とタイルの位置からは常に同じノイズが生成されるため、処理の順序によらず結果は変わらない
+type Grain struct {
+	Amount     int   // ノイズの最大幅 (±Amount)。0 の場合はノイズを加えない
+	Seed       int64 // 乱数のシード
+	Triangular bool  // true の場合は三角分布、false の場合は一様分布
+}
+
+// 塗りつぶし後のタイルにノイズを加える
+func WithGrain(g Grain) Option {
+	return func(mp *Processor) {
+		mp.grain = g
+	}
+}
+
+// タイル内の各画素の RGB に同じ値のノイズを加え、[0, 255] に収める
+// tileX, tileY は画像全体でのタイルの位置
+func (g Grain) apply(img *image.NRGBA, rect image.Rectangle, tileX, tileY int) {
+	if g.Amount <= 0 {
+		return
+	}
+	rng := newTileRand(g.Seed, tileX, tileY)
+	rect = rect.Intersect(img.Bounds())
+	for y := rect.Min.Y; y < rect.Max.Y; y++ {
+		i := img.PixOffset(rect.Min.X, y)
+		for x := rect.Min.X; x < rect.Max.X; x++ {
+			n := g.sample(&rng)
+			img.Pix[i+0] = clampAdd(img.Pix[i+0], n)
+			img.Pix[i+1] = clampAdd(img.Pix[i+1], n)
+			img.Pix[i+2] = clampAdd(img.Pix[i+2], n)
+			i += 4
+		}
+	}
+}
+
+// [-Amount, Amount] のノイズを 1 つ生成
+func (g Grain) sample(rng *tileRand) int {
+	span := uint64(2*g.Amount + 1)
+	if !g.Triangular {
+		return int(rng.next()%span) - g.Amount
+	}
+	// 一様分布を 2 つ足して三角分布にする
+	a := int(rng.next() % span)
+	b := int(rng.next() % span)
+	return (a+b+1)/2 - g.Amount
+}
+
+func clampAdd(v uint8, n int) uint8 {
+	return uint8(max(0, min(255, int(v)+n)))
+}
+
+// タイルごとの乱数生成器 (splitmix64)
+type tileRand struct {
+	state uint64
+}
+
+// シードとタイルの位置から乱数生成器を初期化
+func newTileRand(seed int64, tileX, tileY int) tileRand {
+	r := tileRand{state: uint64(seed)}
+	r.state ^= r.next() ^ uint64(tileX)*0x9e3779b97f4a7c15
+	r.state ^= r.next() ^ uint64(tileY)*0xc2b2ae3d27d4eb4f
+	return r
+}
+
+func (r *tileRand) next() uint64 {
+	r.state += 0x9e3779b97f4a7c15
+	z := r.state
+	z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+	z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+	return z ^ (z >> 31)
+}
@@ -0,0 +1,59 @@
+package mosaic
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestGrainZeroIsIdentity(t *testing.T) {
+	img := testImage(70, 45)
+	assertSameImage(t, process(t, img, 8, WithGrain(Grain{Amount: 0, Seed: 42})), process(t, img, 8))
+}
+
+func TestGrainReproducible(t *testing.T) {
+	img := testImage(130, 90)
+	for _, triangular := range []bool{false, true} {
+		g := Grain{Amount: 6, Seed: 7, Triangular: triangular}
+		want := process(t, img, 16, WithGrain(g), WithWorkers(1))
+		// 何度実行しても、ゴルーチンの数や先に処理するバンドの数を変えても同じになる
+		for _, opts := range [][]Option{
+			{WithWorkers(1)},
+			{WithWorkers(4)},
+			{WithWorkers(7), WithPrefetch(2)},
+		} {
+			got := process(t, img, 16, append(opts, WithGrain(g))...)
+			assertSameImage(t, got, want)
+		}
+		other := process(t, img, 16, WithGrain(Grain{Amount: 6, Seed: 8, Triangular: triangular}))
+		if bytes.Equal(other.Pix, want.Pix) {
+			t.Errorf("triangular=%v: a different seed produced the same noise", triangular)
+		}
+	}
+}
+
+func TestGrainAmount(t *testing.T) {
+	img := testImage(64, 64)
+	flat := process(t, img, 8)
+	for _, g := range []Grain{{Amount: 3, Seed: 1}, {Amount: 10, Seed: 2, Triangular: true}} {
+		noisy := process(t, img, 8, WithGrain(g))
+		changed := 0
+		for i := range flat.Pix {
+			d := int(noisy.Pix[i]) - int(flat.Pix[i])
+			if i%4 == 3 {
+				if d != 0 {
+					t.Fatalf("%+v: alpha changed at byte %d", g, i)
+				}
+				continue
+			}
+			if d < -g.Amount || d > g.Amount {
+				t.Fatalf("%+v: byte %d moved by %d", g, i, d)
+			}
+			if d != 0 {
+				changed++
+			}
+		}
+		if changed < len(flat.Pix)/4 {
+			t.Errorf("%+v: only %d of %d bytes changed", g, changed, len(flat.Pix))
+		}
+	}
+}
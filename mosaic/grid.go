@@ -0,0 +1,106 @@
+package mosaic
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+)
+
+// タイルごとの画素の色の合計を並べた格子
+// 平均色は MeanColor (既定の RoundHalfUp) と同じく CellAccumulator で求める
+// 合計を保持しているため、大きさが倍数のタイルの格子は、画素を読み直さずに格子のマスをまとめて作れる
+// タイルは Processor と同じ Grid に並べる
+type ColorGrid struct {
+	Tile          int // タイルの幅と高さ
+	Columns, Rows int
+	grid          Grid
+	cells         *CellAccumulator
+}
+
+// img の平均色を tile×tile のタイルごとに計算した格子 (格子は画像の座標の原点を通る)
+func NewColorGrid(img *image.NRGBA, tile int) *ColorGrid {
+	return NewColorGridAt(img, tile, image.Point{})
+}
+
+// img の平均色を、origin を通る tile×tile のタイルの格子 (WithGridOrigin と同じ) ごとに計算した格子
+func NewColorGridAt(img *image.NRGBA, tile int, origin image.Point) *ColorGrid {
+	g := newColorGrid(NewGrid(img.Rect, tile, tile, origin))
+	left := g.grid.start().X
+	for y := img.Rect.Min.Y; y < img.Rect.Max.Y; y++ {
+		i := img.PixOffset(img.Rect.Min.X, y)
+		row := img.Pix[i : i+4*img.Rect.Dx()]
+		cell, _ := g.grid.CellAt(img.Rect.Min.X, y)
+		n := cell.Row * g.Columns
+		// 最初の列のタイルは画像の左端で切り詰められていることがある
+		for x := 0; x < len(row); n++ {
+			end := min(len(row), 4*(left+(n%g.Columns+1)*tile-img.Rect.Min.X))
+			g.cells.AddPixels(n, row[x:end])
+			x = end
+		}
+	}
+	return g
+}
+
+// grid のマスの空の格子
+func newColorGrid(grid Grid) *ColorGrid {
+	return &ColorGrid{
+		Tile:    grid.TileWidth,
+		Columns: grid.Columns,
+		Rows:    grid.Rows,
+		grid:    grid,
+		cells:   NewCellAccumulator(grid.Columns*grid.Rows, false),
+	}
+}
+
+// タイルの格子
+func (g *ColorGrid) Grid() Grid {
+	return g.grid
+}
+
+// tile×tile のタイルの格子を、この格子のマスをまとめて作る
+// tile はこの格子のタイルの大きさの倍数とし、平均色は画素から直接計算した場合と同じになる
+func (g *ColorGrid) Coarsen(tile int) (*ColorGrid, error) {
+	if tile <= 0 || tile%g.Tile != 0 {
+		return nil, fmt.Errorf("mosaic: tile size %d is not a multiple of %d", tile, g.Tile)
+	}
+	// 大きな格子は同じ原点を通るため、境界はこの格子の境界に重なる
+	coarse := newColorGrid(NewGrid(g.grid.Bounds, tile, tile, g.grid.Origin))
+	for y := 0; y < g.Rows; y++ {
+		for x := 0; x < g.Columns; x++ {
+			r := g.grid.Cell(x, y).Rect
+			c, _ := coarse.grid.CellAt(r.Min.X, r.Min.Y)
+			coarse.cells.Merge(c.Row*coarse.Columns+c.Column, g.cells, y*g.Columns+x)
+		}
+	}
+	return coarse, nil
+}
+
+// 格子の左から x 番目、上から y 番目のタイルの平均色
+// 格子の範囲外のタイルは MeanColor の空の範囲と同じく不透明な黒にする
+func (g *ColorGrid) At(x, y int) color.NRGBA {
+	if x < 0 || x >= g.Columns || y < 0 || y >= g.Rows {
+		return color.NRGBA{0, 0, 0, 255}
+	}
+	return g.cells.Color(y*g.Columns + x)
+}
+
+// 格子の左から x 番目、上から y 番目のタイルの範囲 (画像の端で切り詰めない)
+func (g *ColorGrid) TileRect(x, y int) image.Rectangle {
+	return g.grid.Cell(x, y).Tile
+}
+
+// 格子の平均色を返す TileColorFunc
+// 画素を読まずにタイルの左上の位置から格子のマスを引くため、Processor のタイルの大きさを格子と同じにし、
+// WithExclude や WithMask、WithStripes などでタイルの範囲や画素を変えない場合にだけ使うこと
+func (g *ColorGrid) TileColor(pixels PixelRegion) color.NRGBA {
+	c, ok := g.grid.CellAt(pixels.Rect.Min.X, pixels.Rect.Min.Y)
+	if !ok {
+		return g.At(-1, -1)
+	}
+	return g.At(c.Column, c.Row)
+}
+
+// 負の数も切り捨てる整数の割り算
+func floorDiv(a, m int) int {
+	return (a - floorMod(a, m)) / m
+}
@@ -0,0 +1,57 @@
+package mosaic
+
+import (
+	"context"
+	"image"
+	"image/color"
+	"testing"
+)
+
+// グラデーションに決まったノイズを加えた画像 (平坦な画像では分からない違いを見つけるため)
+func testImage(w, h int) *image.NRGBA {
+	return testImageAt(image.Rect(0, 0, w, h))
+}
+
+// r の範囲の testImage
+func testImageAt(r image.Rectangle) *image.NRGBA {
+	img := image.NewNRGBA(r)
+	state := uint32(1)
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			state = state*1664525 + 1013904223
+			noise := int(state>>24) % 32
+			img.SetNRGBA(x, y, color.NRGBA{
+				uint8((x*7 + noise) % 256),
+				uint8((y*5 + noise) % 256),
+				uint8((x + y + noise) % 256),
+				255,
+			})
+		}
+	}
+	return img
+}
+
+// ProcessContext の結果 (失敗した場合はテストを止める)
+func process(t testing.TB, img *image.NRGBA, tile int, opts ...Option) *image.NRGBA {
+	t.Helper()
+	out, err := New(img, tile, tile, opts...).ProcessContext(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+// a と b の範囲と画素が同じかどうかを確かめる
+func assertSameImage(t testing.TB, a, b *image.NRGBA) {
+	t.Helper()
+	if a.Rect != b.Rect {
+		t.Fatalf("bounds %v != %v", a.Rect, b.Rect)
+	}
+	for y := a.Rect.Min.Y; y < a.Rect.Max.Y; y++ {
+		for x := a.Rect.Min.X; x < a.Rect.Max.X; x++ {
+			if ca, cb := a.NRGBAAt(x, y), b.NRGBAAt(x, y); ca != cb {
+				t.Fatalf("pixel (%d,%d): %v != %v", x, y, ca, cb)
+			}
+		}
+	}
+}
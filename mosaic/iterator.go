@@ -0,0 +1,217 @@
+package mosaic
+
+import (
+	"context"
+	"image"
+	"io"
+	"sync"
+	"time"
+)
+
+// BandIterator の Next が返す処理済みのバンド
+// Image の Rect の範囲が処理結果で、次に Next を呼び出すか Close を呼び出すまで有効 (その後はバッファを再利用する)
+// WithMask や WithSelection で選んだ画素を含まないバンドは処理せず、Image は元画像になるため、Image に書き込んではならない
+// 余白を持つ Stage (MarginStage) がある場合、Image は上下の余白の行も含むが、処理結果は Rect の範囲だけ
+type Band struct {
+	Image *image.NRGBA
+	Rect  image.Rectangle
+
+	// WithBandChecksum を指定した場合の Rect の範囲の画素のチェックサム (指定しない場合はゼロ値)
+	Checksum Checksum
+}
+
+// 処理済みのバンドを上から順に取り出すイテレーター
+// Next を呼び出した時に次のバンドを処理するため (WithPrefetch の場合は先に処理しておく)、取り出す速さを呼び出し側で決められる
+// ProcessBands や ProcessContext もこのイテレーターでバンドを取り出し、結果は同じになる
+// 最後まで取り出さない場合は Close を呼び出し、バッファと先に処理するゴルーチンを解放すること
+// 複数のゴルーチンから同時に呼び出してはならない
+type BandIterator struct {
+	mp                         *Processor
+	ctx                        context.Context
+	cancel                     context.CancelFunc
+	bandWorkers, columnWorkers int
+	total                      int // バンドの数
+	queued                     int // 処理したバンドの数
+	done                       int // 呼び出し側が受け取り終えたバンドの数
+	offset                     int // 次に処理する組の最初のバンドの位置
+	batch                      *bandBatch
+	batches                    []*bandBatch // 生成したすべての組 (終了時にバッファをプールに返す)
+	next                       int          // batch の中で次に渡すバンド
+	handed                     bool         // batch の next-1 番目のバンドを渡し、まだ受け取り終えていない
+	err                        error
+	finished                   bool
+	start                      time.Time
+
+	// 余白を持つ Stage がある場合に、後のバンドの上の余白にする元画像の行
+	rows *sourceRows
+
+	// WithPrefetch の場合に、別のゴルーチンが処理した組を受け渡すチャネル
+	ready       chan *bandBatch
+	free        chan *bandBatch
+	wg          sync.WaitGroup
+	producerErr error // 処理するゴルーチンが中断した理由 (wg.Wait の後に読む)
+}
+
+// 処理済みのバンドを上から順に取り出すイテレーターを生成
+// 各バンドはバッファに読み込んでから処理するため、受け取ったバンドより上の行は元画像を書き換えてもよい
+// (WithPrefetch を指定した場合は先のバンドを同時に読み込むため、受け取ったバンドより下の行は書き換えてはならない)
+//
+//	it := mp.Bands(ctx)
+//	defer it.Close()
+//	for {
+//		band, err := it.Next()
+//		if err == io.EOF {
+//			break
+//		}
+//		...
+//	}
+func (mp *Processor) Bands(ctx context.Context) *BandIterator {
+	it := &BandIterator{mp: mp}
+	if mp.err != nil {
+		it.err, it.finished = mp.err, true
+		return it
+	}
+	it.ctx, it.cancel = context.WithCancel(ctx)
+	if mp.metrics != nil {
+		it.start = time.Now()
+		mp.metrics.ProcessStarted()
+	}
+	it.total = mp.Grid().Rows
+	it.offset = mp.Grid().start().Y
+	it.bandWorkers, it.columnWorkers = mp.split(it.total)
+	it.rows = &sourceRows{}
+	if mp.prefetch > 0 {
+		it.startPrefetch()
+	} else {
+		it.batch = mp.newBandBatch(it.bandWorkers)
+		it.batches = []*bandBatch{it.batch}
+	}
+	return it
+}
+
+// 次の処理済みのバンドを返却
+// すべてのバンドを返した後は io.EOF を返す
+// ctx がキャンセルされた場合や Stage が失敗した場合はそのエラーを返し、以降も同じエラーを返す
+func (it *BandIterator) Next() (Band, error) {
+	band, err := it.nextBand()
+	if err == nil && it.mp.checksum != "" {
+		band.Checksum = BandChecksum(it.mp.checksum, band.Image, band.Rect)
+	}
+	return band, err
+}
+
+// チェックサムを求めずに次のバンドを返却 (ProcessBands はチェックサムを渡さないため、これを使う)
+func (it *BandIterator) nextBand() (Band, error) {
+	if it.err != nil {
+		return Band{}, it.err
+	}
+	if it.handed {
+		// 前に渡したバンドを受け取り終えたとみなす
+		it.handed = false
+		it.done++
+		it.mp.bandDone(it.batch.rects[it.next-1], it.done, it.total)
+	}
+	if it.batch == nil || it.next == it.batch.n {
+		if err := it.nextBatch(); err != nil {
+			it.fail(err)
+			return Band{}, err
+		}
+	}
+	b, i := it.batch, it.next
+	if err := b.errs[i]; err != nil {
+		it.fail(err)
+		return Band{}, err
+	}
+	it.next++
+	it.handed = true
+	return Band{Image: b.images[i], Rect: b.rects[i]}, nil
+}
+
+// 次の組を処理するか、先に処理された組を受け取る
+// 残りの組がない場合は io.EOF を返す
+func (it *BandIterator) nextBatch() error {
+	mp := it.mp
+	if it.ready != nil {
+		if it.batch != nil {
+			it.free <- it.batch
+			it.batch = nil
+		}
+		b, ok := <-it.ready
+		if !ok {
+			it.wg.Wait()
+			if it.producerErr != nil {
+				return it.producerErr
+			}
+			return io.EOF
+		}
+		if err := it.ctx.Err(); err != nil {
+			return err
+		}
+		it.batch, it.next = b, 0
+		return nil
+	}
+
+	if it.queued == it.total {
+		return io.EOF
+	}
+	if err := it.ctx.Err(); err != nil {
+		return err
+	}
+	it.batch.n = min(it.bandWorkers, it.total-it.queued)
+	mp.processBatch(it.batch, it.offset, it.columnWorkers, it.rows)
+	it.queued += it.batch.n
+	it.offset += it.bandWorkers * mp.mosaicHeight
+	it.next = 0
+	return nil
+}
+
+// 処理を終え、バッファと先に処理するゴルーチンを解放する
+// すべてのバンドを取り出す前に呼び出した場合は、残りのバンドを処理しない
+// 何度呼び出してもよく、Close の後の Next はエラーを返す
+func (it *BandIterator) Close() error {
+	if !it.finished {
+		it.err = errIteratorClosed
+		it.finish(nil)
+	}
+	return nil
+}
+
+// err で処理を中断する (io.EOF の場合は最後まで処理した)
+func (it *BandIterator) fail(err error) {
+	it.err = err
+	if err == io.EOF {
+		err = nil
+	}
+	it.finish(err)
+}
+
+// 先に処理するゴルーチンを止めて終了を待ち、計測を終える
+func (it *BandIterator) finish(err error) {
+	if it.finished {
+		return
+	}
+	it.finished = true
+	it.cancel()
+	if it.ready != nil {
+		// 送りかけの組を捨てる
+		for range it.ready {
+		}
+		it.wg.Wait()
+	}
+	it.batch = nil
+	for _, b := range it.batches {
+		it.mp.releaseBuffers(b.buffers...)
+	}
+	it.batches = nil
+	if it.mp.metrics != nil {
+		size := it.mp.src.Bounds().Size()
+		it.mp.metrics.ProcessFinished(time.Since(it.start), size.X*size.Y, err)
+	}
+}
+
+// Close の後に Next を呼び出した場合のエラー
+var errIteratorClosed = iteratorClosedError{}
+
+type iteratorClosedError struct{}
+
+func (iteratorClosedError) Error() string { return "mosaic: band iterator is closed" }
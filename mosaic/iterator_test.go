@@ -0,0 +1,220 @@
+package mosaic
+
+import (
+	"context"
+	"errors"
+	"image"
+	"io"
+	"runtime"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// ゴルーチンの数が before まで戻るのを待つ (戻らなければ漏れたとみなす)
+func assertNoGoroutineLeak(t *testing.T, before int) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for runtime.NumGoroutine() > before {
+		if time.Now().After(deadline) {
+			buf := make([]byte, 1<<16)
+			t.Fatalf("%d goroutines, want at most %d\n%s", runtime.NumGoroutine(), before, buf[:runtime.Stack(buf, true)])
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// Next を n 回呼び出す (失敗した場合はテストを止める)
+func takeBands(t *testing.T, it *BandIterator, n int) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		if _, err := it.Next(); err != nil {
+			t.Fatalf("band %d: %v", i, err)
+		}
+	}
+}
+
+func TestBandIteratorPrefetchMatchesSerial(t *testing.T) {
+	img := testImage(64, 200)
+	want := process(t, img, 8, WithWorkers(1))
+	for _, depth := range []int{1, 3} {
+		for _, workers := range []int{1, 4} {
+			assertSameImage(t, process(t, img, 8, WithPrefetch(depth), WithWorkers(workers)), want)
+		}
+	}
+}
+
+func TestBandIteratorCloseBeforeEOF(t *testing.T) {
+	before := runtime.NumGoroutine()
+	it := New(testImage(64, 400), 8, 8, WithPrefetch(2), WithWorkers(2)).Bands(context.Background())
+	takeBands(t, it, 3)
+	it.Close()
+	if _, err := it.Next(); !errors.Is(err, errIteratorClosed) {
+		t.Errorf("Next after Close = %v", err)
+	}
+	it.Close()
+	assertNoGoroutineLeak(t, before)
+}
+
+func TestBandIteratorCanceled(t *testing.T) {
+	before := runtime.NumGoroutine()
+	ctx, cancel := context.WithCancel(context.Background())
+	it := New(testImage(64, 400), 8, 8, WithPrefetch(2), WithWorkers(2)).Bands(ctx)
+	takeBands(t, it, 2)
+	cancel()
+	var err error
+	for err == nil {
+		_, err = it.Next()
+	}
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("err = %v, want context.Canceled", err)
+	}
+	// Close を呼び出さなくても、エラーを返した時点で先に処理するゴルーチンは終わっている
+	assertNoGoroutineLeak(t, before)
+	it.Close()
+}
+
+func TestBandIteratorStageFails(t *testing.T) {
+	errStage := errors.New("stage failed")
+	failing := StageFunc(func(band *image.NRGBA, rect image.Rectangle) error {
+		if rect.Min.Y >= 80 {
+			return errStage
+		}
+		return nil
+	})
+	for _, depth := range []int{1, 4} {
+		before := runtime.NumGoroutine()
+		it := New(testImage(64, 400), 8, 8, WithPipeline(NewPipeline(failing)), WithPrefetch(depth), WithWorkers(2)).Bands(context.Background())
+		var err error
+		bands := 0
+		for err == nil {
+			if _, err = it.Next(); err == nil {
+				bands++
+			}
+		}
+		// 失敗したバンドより前のバンドは渡し、失敗の後は同じエラーを返し続ける
+		if !errors.Is(err, errStage) || bands != 10 {
+			t.Fatalf("depth %d: %d bands, err = %v", depth, bands, err)
+		}
+		if _, err := it.Next(); !errors.Is(err, errStage) {
+			t.Errorf("depth %d: Next after the failure = %v", depth, err)
+		}
+		assertNoGoroutineLeak(t, before)
+		it.Close()
+	}
+}
+
+func TestBandIteratorEOF(t *testing.T) {
+	before := runtime.NumGoroutine()
+	it := New(testImage(64, 100), 8, 8, WithPrefetch(2)).Bands(context.Background())
+	takeBands(t, it, 13)
+	if _, err := it.Next(); err != io.EOF {
+		t.Fatalf("err = %v, want io.EOF", err)
+	}
+	assertNoGoroutineLeak(t, before)
+}
+
+// 開始と終了の回数を数える Metrics
+type countingMetrics struct {
+	started, finished int
+	err               error
+}
+
+func (m *countingMetrics) ProcessStarted() { m.started++ }
+
+func (m *countingMetrics) ProcessFinished(_ time.Duration, _ int, err error) {
+	m.finished++
+	m.err = err
+}
+
+// すべてのバンドを取り出して組み立てた画像は ProcessContext の結果と同じ
+func TestBandIteratorFullIteration(t *testing.T) {
+	img := testImageAt(image.Rect(3, -5, 70, 98))
+	configs := []struct {
+		name string
+		opts []Option
+	}{
+		{"default", nil},
+		{"workers", []Option{WithWorkers(3)}},
+		{"prefetch", []Option{WithPrefetch(2), WithWorkers(2)}},
+		{"grid origin", []Option{WithGridOrigin(image.Pt(4, 7))}},
+		{"margin", []Option{WithPipeline(NewPipeline(&MosaicStage{TileWidth: 8, TileHeight: 8}, verticalBlur(2)))}},
+		{"selection", []Option{WithSelection(Rects(image.Rect(10, 30, 40, 50)))}},
+		{"checksum", []Option{WithBandChecksum(ChecksumCRC32)}},
+	}
+	for _, c := range configs {
+		want := process(t, img, 8, c.opts...)
+		metrics := &countingMetrics{}
+		it := New(img, 8, 8, append(c.opts, WithMetrics(metrics))...).Bands(context.Background())
+		got := image.NewNRGBA(img.Rect)
+		next := img.Rect.Min.Y
+		for {
+			band, err := it.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatalf("%s: %v", c.name, err)
+			}
+			// バンドは画像の幅で、上から隙間なく続く
+			if band.Rect.Min.Y != next || band.Rect.Min.X != img.Rect.Min.X || band.Rect.Max.X != img.Rect.Max.X || !band.Rect.In(band.Image.Rect) {
+				t.Fatalf("%s: band %v (image %v) after row %d", c.name, band.Rect, band.Image.Rect, next)
+			}
+			next = band.Rect.Max.Y
+			for y := band.Rect.Min.Y; y < band.Rect.Max.Y; y++ {
+				copy(got.Pix[got.PixOffset(band.Rect.Min.X, y):got.PixOffset(band.Rect.Max.X, y)], band.Image.Pix[band.Image.PixOffset(band.Rect.Min.X, y):])
+			}
+		}
+		if next != img.Rect.Max.Y {
+			t.Errorf("%s: bands end at row %d, want %d", c.name, next, img.Rect.Max.Y)
+		}
+		assertSameImage(t, got, want)
+		// 最後まで取り出した後も io.EOF を返し、計測は 1 回だけ終える
+		if _, err := it.Next(); err != io.EOF {
+			t.Errorf("%s: Next after EOF = %v", c.name, err)
+		}
+		it.Close()
+		if metrics.started != 1 || metrics.finished != 1 || metrics.err != nil {
+			t.Errorf("%s: metrics %+v", c.name, metrics)
+		}
+	}
+}
+
+// 途中でやめた場合は残りのバンドを処理せず、バッファを返し、ゴルーチンを残さない
+func TestBandIteratorEarlyBreak(t *testing.T) {
+	img := testImage(64, 400)
+	for _, opts := range [][]Option{{WithWorkers(1)}, {WithWorkers(3)}, {WithPrefetch(1)}, {WithPrefetch(3), WithWorkers(2)}} {
+		before := runtime.NumGoroutine()
+		pool := NewBufferPool()
+		metrics := &countingMetrics{}
+		var processed atomic.Int32
+		counter := StageFunc(func(*image.NRGBA, image.Rectangle) error {
+			processed.Add(1)
+			return nil
+		})
+		it := New(img, 8, 8, append(opts, WithBufferPool(pool), WithMetrics(metrics), WithPipeline(NewPipeline(counter)))...).Bands(context.Background())
+		for i := 0; ; i++ {
+			if _, err := it.Next(); err != nil {
+				t.Fatal(err)
+			}
+			if i == 1 {
+				break
+			}
+		}
+		it.Close()
+		assertNoGoroutineLeak(t, before)
+		if s := pool.Stats(); s.InUse != 0 {
+			t.Errorf("%d bytes of buffers in use after Close", s.InUse)
+		}
+		// 50 バンドのうち、先に処理した分を超えては処理しない
+		if n := processed.Load(); n > 2+8 {
+			t.Errorf("%d bands processed after taking 2", n)
+		}
+		if _, err := it.Next(); !errors.Is(err, errIteratorClosed) {
+			t.Errorf("Next after Close = %v", err)
+		}
+		if metrics.started != 1 || metrics.finished != 1 {
+			t.Errorf("metrics %+v", metrics)
+		}
+	}
+}
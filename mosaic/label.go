@@ -0,0 +1,125 @@
+package mosaic
+
+import (
+	_ "embed"
+	"fmt"
+	"image"
+	"image/color"
+	"strings"
+
+	"github.com/yashikota/go-streaming-image-mosaic/colorspace"
+)
+
+//go:embed labelfont.txt
+var labelFontData string
+
+// ラベルのフォントのグリフの大きさ
+const (
+	glyphWidth  = 5
+	glyphHeight = 7
+)
+
+// 文字ごとのグリフ (行ごとに、左の点から順に下位のビットに並べる)
+var labelFont = parseLabelFont(labelFontData)
+
+// フォントのファイルを解析
+// 埋め込んだファイルの誤りはプログラムの誤りのため、panic する
+func parseLabelFont(data string) map[rune][glyphHeight]uint8 {
+	font := map[rune][glyphHeight]uint8{}
+	var lines []string
+	for _, line := range strings.Split(data, "\n") {
+		if line = strings.TrimSpace(line); line != "" && !strings.HasPrefix(line, "# ") {
+			lines = append(lines, line)
+		}
+	}
+	for len(lines) > 0 {
+		header := []rune(lines[0])
+		if len(header) != 2 || header[0] != '=' || len(lines) < 1+glyphHeight {
+			panic(fmt.Sprintf("mosaic: invalid label font near %q", lines[0]))
+		}
+		var glyph [glyphHeight]uint8
+		for y, row := range lines[1 : 1+glyphHeight] {
+			if len(row) != glyphWidth {
+				panic(fmt.Sprintf("mosaic: invalid glyph row %q for %q", row, header[1]))
+			}
+			for x := 0; x < glyphWidth; x++ {
+				if row[x] == '#' {
+					glyph[y] |= 1 << x
+				}
+			}
+		}
+		font[header[1]] = glyph
+		lines = lines[1+glyphHeight:]
+	}
+	return font
+}
+
+// タイルを描画した上に、タイルの色の 16 進数のコード (例: #8A6F4B) を中央に描く TileRenderer
+// 文字の色はタイルの色に対してコントラストの高い黒か白を選ぶ
+// タイルの幅か高さが MinSize 未満、またはコードが収まらないタイルにはラベルを描かない
+type LabelRenderer struct {
+	Base    TileRenderer // タイルを描画する処理。nil の場合は FlatRenderer
+	MinSize int          // ラベルを描くタイルの幅と高さの最小値 (px)
+}
+
+func (r LabelRenderer) Render(dst *image.NRGBA, tile image.Rectangle, c color.NRGBA) {
+	base := r.Base
+	if base == nil {
+		base = FlatRenderer{}
+	}
+	base.Render(dst, tile, c)
+
+	text := fmt.Sprintf("#%02X%02X%02X", c.R, c.G, c.B)
+	width := textWidth(text)
+	// 大きなタイルでは読みやすいよう、タイルの幅の半分ほどまで文字を拡大する
+	scale := max(1, tile.Dx()/(2*width))
+	if tile.Dx() < r.MinSize || tile.Dy() < r.MinSize || width*scale+2 > tile.Dx() || glyphHeight*scale+2 > tile.Dy() {
+		return
+	}
+	drawText(dst, tile, text, scale, labelInk(c))
+}
+
+// 拡大する前の文字列の幅 (px、文字の間は 1px 空ける)
+func textWidth(text string) int {
+	return len([]rune(text))*(glyphWidth+1) - 1
+}
+
+// text を scale 倍に拡大し、ink の色で rect の中央に描く
+func drawText(dst *image.NRGBA, rect image.Rectangle, text string, scale int, ink color.NRGBA) {
+	x0 := rect.Min.X + (rect.Dx()-textWidth(text)*scale)/2
+	y0 := rect.Min.Y + (rect.Dy()-glyphHeight*scale)/2
+	for i, ch := range []rune(text) {
+		glyph := labelFont[ch]
+		for gy := 0; gy < glyphHeight; gy++ {
+			for gx := 0; gx < glyphWidth; gx++ {
+				if glyph[gy]&(1<<gx) == 0 {
+					continue
+				}
+				x := x0 + (i*(glyphWidth+1)+gx)*scale
+				y := y0 + gy*scale
+				fillRect(dst, image.Rect(x, y, x+scale, y+scale), ink)
+			}
+		}
+	}
+}
+
+// 背景色 c の上で読みやすい文字の色 (黒または白)
+// WCAG の相対輝度で、黒と白のうち背景とのコントラスト比が高い方を選ぶ
+func labelInk(c color.NRGBA) color.NRGBA {
+	l := 0.2126*colorspace.SRGBToLinear(c.R) + 0.7152*colorspace.SRGBToLinear(c.G) + 0.0722*colorspace.SRGBToLinear(c.B)
+	// (l+0.05)/0.05 と 1.05/(l+0.05) が等しくなる相対輝度が境目
+	if l > 0.179 {
+		return color.NRGBA{0, 0, 0, 255}
+	}
+	return color.NRGBA{255, 255, 255, 255}
+}
+
+// rect の範囲を c で塗りつぶす (dst の範囲外は無視する)
+func fillRect(dst *image.NRGBA, rect image.Rectangle, c color.NRGBA) {
+	rect = rect.Intersect(dst.Rect)
+	for y := rect.Min.Y; y < rect.Max.Y; y++ {
+		for x := rect.Min.X; x < rect.Max.X; x++ {
+			dst.SetNRGBA(x, y, c)
+		}
+	}
+}
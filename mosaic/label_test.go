@@ -0,0 +1,79 @@
+package mosaic
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"math/bits"
+	"testing"
+)
+
+// tile に描いたラベルの文字の画素の数 (タイルの色と異なる画素)
+func labelInkPixels(dst *image.NRGBA, tile image.Rectangle, c color.NRGBA) int {
+	n := 0
+	for y := tile.Min.Y; y < tile.Max.Y; y++ {
+		for x := tile.Min.X; x < tile.Max.X; x++ {
+			if dst.NRGBAAt(x, y) != c {
+				n++
+			}
+		}
+	}
+	return n
+}
+
+func TestLabelRendererMinSize(t *testing.T) {
+	c := color.NRGBA{0x8a, 0x6f, 0x4b, 255}
+	// "#8A6F4B" のグリフの点の数
+	glyphDots := 0
+	for _, ch := range fmt.Sprintf("#%02X%02X%02X", c.R, c.G, c.B) {
+		for _, row := range labelFont[ch] {
+			glyphDots += bits.OnesCount8(row)
+		}
+	}
+	tests := []struct {
+		w, h, min int
+		scale     int // 0 の場合はラベルを描かない
+	}{
+		{48, 48, 48, 1},
+		{47, 48, 48, 0},
+		{48, 47, 48, 0},
+		{47, 47, 48, 0},
+		// コードの幅は 41px で、左右に 1px ずつの余白が要る
+		{43, 43, 8, 1},
+		{42, 42, 8, 0},
+		{100, 60, 48, 1},
+		{164, 64, 48, 2},
+	}
+	for _, tt := range tests {
+		tile := image.Rect(3, 5, 3+tt.w, 5+tt.h)
+		dst := image.NewNRGBA(tile)
+		LabelRenderer{MinSize: tt.min}.Render(dst, tile, c)
+		if got, want := labelInkPixels(dst, tile, c), glyphDots*tt.scale*tt.scale; got != want {
+			t.Errorf("%dx%d tile, min size %d: %d label pixels, want %d", tt.w, tt.h, tt.min, got, want)
+		}
+	}
+}
+
+func TestLabelInk(t *testing.T) {
+	tile := image.Rect(0, 0, 64, 64)
+	for _, tt := range []struct {
+		c, ink color.NRGBA
+	}{
+		{color.NRGBA{20, 30, 40, 255}, color.NRGBA{255, 255, 255, 255}},
+		{color.NRGBA{240, 230, 200, 255}, color.NRGBA{0, 0, 0, 255}},
+		{color.NRGBA{255, 0, 0, 255}, color.NRGBA{0, 0, 0, 255}},
+		{color.NRGBA{0, 0, 255, 255}, color.NRGBA{255, 255, 255, 255}},
+	} {
+		dst := image.NewNRGBA(tile)
+		LabelRenderer{MinSize: 48}.Render(dst, tile, tt.c)
+		for i := 0; i < len(dst.Pix); i += 4 {
+			p := color.NRGBA{dst.Pix[i], dst.Pix[i+1], dst.Pix[i+2], dst.Pix[i+3]}
+			if p != tt.c && p != tt.ink {
+				t.Fatalf("%v: pixel %v, want the tile color or %v", tt.c, p, tt.ink)
+			}
+		}
+		if labelInkPixels(dst, tile, tt.c) == 0 {
+			t.Errorf("%v: no label drawn", tt.c)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package mosaic
+
+import (
+	"image"
+	"image/color"
+	"math"
+)
+
+// タイルをレゴのブロックを真上から見たように描く TileRenderer
+// タイルの色で塗った上に、左上から光が当たったようにスタッド (突起) の影と明るい縁を描く
+// スタッドの大きさはタイルの小さい方の辺に合わせ、縁はアンチエイリアスする
+// 描画は乱数を使わないため、同じ入力からは常に同じ画像になる
+type LegoRenderer struct {
+	// ブロックの間の隙間に見せる基礎板の色
+	// 透明度が 0 の場合は隙間を作らず、タイル全体をブロックとして描く
+	Baseplate color.NRGBA
+}
+
+// スタッドを描くタイルの最小の大きさ (px)
+// これより小さいタイルはブロックの色で塗りつぶすだけにする
+const legoMinStud = 6
+
+// 円の縁のアンチエイリアスで、1 画素を縦横に分割する数
+const legoSubsamples = 4
+
+func (r LegoRenderer) Render(dst *image.NRGBA, tile image.Rectangle, c color.NRGBA) {
+	tile = tile.Intersect(dst.Bounds())
+	if tile.Empty() {
+		return
+	}
+	brick := tile
+	if r.Baseplate.A != 0 {
+		FlatRenderer{}.Render(dst, tile, r.Baseplate)
+		// 右と下にだけ隙間を空けて隣のブロックとの間を 1 本にする
+		brick = insetGap(tile)
+	}
+	FlatRenderer{}.Render(dst, brick, c)
+
+	size := min(brick.Dx(), brick.Dy())
+	if size < legoMinStud {
+		return
+	}
+	cx := float64(brick.Min.X) + float64(brick.Dx())/2
+	cy := float64(brick.Min.Y) + float64(brick.Dy())/2
+	radius := float64(size) * 0.3
+	offset := math.Max(1, radius*0.15)
+
+	// 右下にずらした影、スタッドの上面、左上の明るい縁の順に重ねる
+	fillCircle(dst, brick, cx+offset, cy+offset, radius, shade(c, 0.65))
+	fillCircle(dst, brick, cx, cy, radius, shade(c, 1.08))
+	fillCircle(dst, brick, cx-radius*0.25, cy-radius*0.25, radius*0.55, withAlpha(shade(c, 1.3), 0.5))
+	fillCircle(dst, brick, cx, cy, radius*0.8, shade(c, 1.08))
+}
+
+// 明るさを factor 倍した色 (1 を超える場合は白に近づける)
+func shade(c color.NRGBA, factor float64) color.NRGBA {
+	f := func(v uint8) uint8 {
+		x := float64(v)
+		if factor <= 1 {
+			x *= factor
+		} else {
+			x += (255 - x) * (factor - 1)
+		}
+		return uint8(math.Round(math.Min(math.Max(x, 0), 255)))
+	}
+	return color.NRGBA{R: f(c.R), G: f(c.G), B: f(c.B), A: c.A}
+}
+
+// 透明度を alpha 倍した色
+func withAlpha(c color.NRGBA, alpha float64) color.NRGBA {
+	c.A = uint8(math.Round(float64(c.A) * alpha))
+	return c
+}
+
+// 中心 (cx, cy)、半径 radius の円を clip の範囲に描く
+// 縁の画素は円に含まれる割合に応じて下の色と混ぜる
+func fillCircle(dst *image.NRGBA, clip image.Rectangle, cx, cy, radius float64, c color.NRGBA) {
+	area := image.Rect(int(math.Floor(cx-radius)), int(math.Floor(cy-radius)), int(math.Ceil(cx+radius))+1, int(math.Ceil(cy+radius))+1).Intersect(clip)
+	r2 := radius * radius
+	for y := area.Min.Y; y < area.Max.Y; y++ {
+		for x := area.Min.X; x < area.Max.X; x++ {
+			inside := 0
+			for sy := 0; sy < legoSubsamples; sy++ {
+				for sx := 0; sx < legoSubsamples; sx++ {
+					dx := float64(x) + (float64(sx)+0.5)/legoSubsamples - cx
+					dy := float64(y) + (float64(sy)+0.5)/legoSubsamples - cy
+					if dx*dx+dy*dy <= r2 {
+						inside++
+					}
+				}
+			}
+			if inside == 0 {
+				continue
+			}
+			alpha := float64(inside) / (legoSubsamples * legoSubsamples) * float64(c.A) / 0xff
+			under := dst.NRGBAAt(x, y)
+			dst.SetNRGBA(x, y, color.NRGBA{
+				R: blend(under.R, c.R, alpha),
+				G: blend(under.G, c.G, alpha),
+				B: blend(under.B, c.B, alpha),
+				A: under.A,
+			})
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package mosaic
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+// 描画を変えた場合にだけ変わる値
+// 意図して描画を変えた場合は、画像を目で確かめてから値を更新する
+func TestLegoRendererGolden(t *testing.T) {
+	plate := color.NRGBA{0x23, 0x78, 0x41, 255}
+	tests := []struct {
+		name string
+		img  *image.NRGBA
+		tile int
+		opts []Option
+		want string
+	}{
+		{"studs", testImage(96, 64), 16, []Option{WithTileRenderer(LegoRenderer{})}, "sha256:a6881f528bc1a512af687435464a72176265b477489d73f5ce756d5edda9a1d5"},
+		{"baseplate", testImage(96, 64), 16, []Option{WithTileRenderer(LegoRenderer{Baseplate: plate})}, "sha256:1cd95ce59d05a362436d7ff5985cda57daeca136dc7523d6070f259378482664"},
+		{"edge tiles", testImage(50, 37), 12, []Option{WithTileRenderer(LegoRenderer{Baseplate: plate})}, "sha256:d9e7d71caa3b13a4f3b99d1b24fcd18bcf708a6d5752acad3e76934de484e841"},
+		{"palette", testImage(96, 64), 16, []Option{WithTileRenderer(LegoRenderer{}), WithColorAdjust(PaletteAdjust(LegoPalette))}, "sha256:a737d91ffffa66c6dcd3495dbc079ad0ade1f91c652c6b4abc7a2e66a4ee7f1d"},
+	}
+	for _, tt := range tests {
+		if got := ImageDigest(process(t, tt.img, tt.tile, tt.opts...)); got.String() != tt.want {
+			t.Errorf("%s: %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+// スタッドは中央を明るく、右下に影を落とし、基礎板は右と下の隙間に見える
+func TestLegoRendererShape(t *testing.T) {
+	c := color.NRGBA{200, 40, 40, 255}
+	plate := color.NRGBA{0x23, 0x78, 0x41, 255}
+	tile := image.Rect(0, 0, 32, 32)
+	dst := image.NewNRGBA(tile)
+	LegoRenderer{Baseplate: plate}.Render(dst, tile, c)
+	// 隙間は 32/16 = 2px で、ブロックは 30×30、スタッドの半径は 9px
+	points := map[image.Point]color.NRGBA{
+		{0, 0}:   c,
+		{29, 0}:  c,
+		{30, 0}:  plate,
+		{0, 31}:  plate,
+		{31, 31}: plate,
+		{15, 15}: shade(c, 1.08),
+	}
+	for p, want := range points {
+		if got := dst.NRGBAAt(p.X, p.Y); got != want {
+			t.Errorf("pixel %v = %v, want %v", p, got, want)
+		}
+	}
+	// スタッドの右の縁の外側は影で暗く、左の縁の外側はブロックの色のまま
+	if shadow := dst.NRGBAAt(24, 16); shadow.R >= c.R {
+		t.Errorf("pixel (24,16) = %v, want the darker shadow", shadow)
+	}
+	if got := dst.NRGBAAt(5, 15); got != c {
+		t.Errorf("pixel (5,15) = %v, want %v", got, c)
+	}
+
+	// 6px 未満のタイルはブロックの色で塗りつぶすだけにする
+	small := image.Rect(0, 0, 5, 5)
+	dst = image.NewNRGBA(small)
+	LegoRenderer{}.Render(dst, small, c)
+	for y := 0; y < 5; y++ {
+		for x := 0; x < 5; x++ {
+			if got := dst.NRGBAAt(x, y); got != c {
+				t.Fatalf("5px tile: pixel (%d,%d) = %v, want %v", x, y, got, c)
+			}
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package mosaic
+
+import (
+	"image"
+	"sync"
+)
+
+// 余白を持つ Stage のために控える、元画像の行
+// 呼び出し側は受け取ったバンドを元画像に書き戻してよいため、後のバンドの上の余白は書き戻す前に控えた行から読む
+// nil の場合は控えずに、余白もすべて元画像から読む (元画像を書き換えない場合)
+type sourceRows struct {
+	mu   sync.Mutex
+	rows map[image.Point][]uint8 // 行の左端の位置から、その位置から読み込んだ範囲の幅の画素
+}
+
+// rect とその上下 mp.margin 行 (画像の範囲まで) を buffer に読み込み、buffer の範囲の上下を読み込んだ行に合わせる
+// 上の余白は控えた行があればその行を使い、rect の下側の mp.margin 行は後のバンドのために控える
+func (r *sourceRows) read(mp *Processor, buffer *image.NRGBA, rect image.Rectangle) {
+	bounds := mp.src.Bounds()
+	buffer.Rect.Min.Y, buffer.Rect.Max.Y = max(rect.Min.Y-mp.margin, bounds.Min.Y), min(rect.Max.Y+mp.margin, bounds.Max.Y)
+	if r == nil {
+		mp.src.readNRGBA(buffer, image.Rect(rect.Min.X, buffer.Rect.Min.Y, rect.Max.X, buffer.Rect.Max.Y))
+		return
+	}
+	n := 4 * rect.Dx()
+
+	var missing []int
+	r.mu.Lock()
+	for y := buffer.Rect.Min.Y; y < rect.Min.Y; y++ {
+		if row, ok := r.rows[image.Pt(rect.Min.X, y)]; ok {
+			copy(buffer.Pix[buffer.PixOffset(rect.Min.X, y):][:n], row)
+		} else {
+			missing = append(missing, y)
+		}
+	}
+	r.mu.Unlock()
+	// 控えていない行はその行のバンドをまだ読み込んでいないか、処理しなかった行のため、元画像のまま
+	for _, y := range missing {
+		mp.src.readNRGBA(buffer, image.Rect(rect.Min.X, y, rect.Max.X, y+1))
+	}
+	mp.src.readNRGBA(buffer, image.Rect(rect.Min.X, rect.Min.Y, rect.Max.X, buffer.Rect.Max.Y))
+
+	if rect.Max.Y >= bounds.Max.Y {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.rows == nil {
+		r.rows = map[image.Point][]uint8{}
+	}
+	for y := max(rect.Min.Y, rect.Max.Y-mp.margin); y < rect.Max.Y; y++ {
+		i := buffer.PixOffset(rect.Min.X, y)
+		r.rows[image.Pt(rect.Min.X, y)] = append([]uint8(nil), buffer.Pix[i:i+n]...)
+	}
+}
+
+// top より上の、これから読み込むバンドの余白にならない行を捨てる
+func (r *sourceRows) prune(top int) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for p := range r.rows {
+		if p.Y < top {
+			delete(r.rows, p)
+		}
+	}
+}
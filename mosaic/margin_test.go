@@ -0,0 +1,177 @@
+package mosaic
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"sync"
+	"testing"
+)
+
+// 余白を持つ Stage
+type marginStage struct {
+	margin int
+	apply  func(band *image.NRGBA, rect image.Rectangle) error
+}
+
+func (s marginStage) Margin() int { return s.margin }
+
+func (s marginStage) Apply(band *image.NRGBA, rect image.Rectangle) error {
+	return s.apply(band, rect)
+}
+
+// 上下 radius 行の平均にする縦方向のぼかし (band の範囲の行だけを使い、rect の中だけを書き換える)
+func verticalBlur(radius int) marginStage {
+	return marginStage{margin: radius, apply: func(band *image.NRGBA, rect image.Rectangle) error {
+		orig := append([]uint8(nil), band.Pix...)
+		for y := rect.Min.Y; y < rect.Max.Y; y++ {
+			from, to := max(y-radius, band.Rect.Min.Y), min(y+radius+1, band.Rect.Max.Y)
+			for x := rect.Min.X; x < rect.Max.X; x++ {
+				for c := 0; c < 4; c++ {
+					sum := 0
+					for yy := from; yy < to; yy++ {
+						sum += int(orig[band.PixOffset(x, yy)+c])
+					}
+					band.Pix[band.PixOffset(x, y)+c] = uint8(sum / (to - from))
+				}
+			}
+		}
+		return nil
+	}}
+}
+
+// 1 つのバンドで画像全体に st を適用した結果
+func applyWhole(t *testing.T, img *image.NRGBA, st Stage) *image.NRGBA {
+	t.Helper()
+	out := image.NewNRGBA(img.Rect)
+	copy(out.Pix, img.Pix)
+	if err := st.Apply(out, out.Rect); err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+func TestMarginIdentity(t *testing.T) {
+	const margin = 3
+	img := testImageAt(image.Rect(4, 2, 69, 49))
+	var mu sync.Mutex
+	checked := 0
+	identity := marginStage{margin: margin, apply: func(band *image.NRGBA, rect image.Rectangle) error {
+		// バンドは上下に余白の行を含み (画像の端では画像の範囲まで)、余白の行も元画像と同じ
+		top, bottom := max(rect.Min.Y-margin, img.Rect.Min.Y), min(rect.Max.Y+margin, img.Rect.Max.Y)
+		if band.Rect.Min.Y != top || band.Rect.Max.Y != bottom {
+			t.Errorf("band %v for rect %v, want rows %d-%d", band.Rect, rect, top, bottom)
+		}
+		for y := top; y < bottom; y++ {
+			i, j := band.PixOffset(rect.Min.X, y), img.PixOffset(rect.Min.X, y)
+			if !bytes.Equal(band.Pix[i:i+4*rect.Dx()], img.Pix[j:j+4*rect.Dx()]) {
+				t.Errorf("row %d of band %v differs from the source", y, rect)
+			}
+		}
+		mu.Lock()
+		checked++
+		mu.Unlock()
+		return nil
+	}}
+	for _, opts := range [][]Option{
+		{WithWorkers(1)},
+		{WithWorkers(4)},
+		{WithPrefetch(2)},
+		{WithBlockSize(16, 16)},
+	} {
+		opts = append(opts, WithPipeline(NewPipeline(identity)))
+		assertSameImage(t, process(t, img, 8, opts...), img)
+	}
+	if checked == 0 {
+		t.Fatal("stage was not applied")
+	}
+}
+
+// 前のバンドを元画像に書き戻しても、後のバンドの余白は書き換える前の行になる
+func TestMarginReadsOriginalRowsInPlace(t *testing.T) {
+	const margin = 3
+	img := testImage(40, 50)
+	orig := append([]uint8(nil), img.Pix...)
+	stage := marginStage{margin: margin, apply: func(band *image.NRGBA, rect image.Rectangle) error {
+		for y := band.Rect.Min.Y; y < band.Rect.Max.Y; y++ {
+			i := band.PixOffset(rect.Min.X, y)
+			if !bytes.Equal(band.Pix[i:i+4*rect.Dx()], orig[img.PixOffset(rect.Min.X, y):][:4*rect.Dx()]) {
+				t.Errorf("row %d of band %v was overwritten", y, rect)
+			}
+		}
+		for y := rect.Min.Y; y < rect.Max.Y; y++ {
+			i := band.PixOffset(rect.Min.X, y)
+			clear(band.Pix[i : i+4*rect.Dx()])
+		}
+		return nil
+	}}
+	for _, workers := range []int{1, 3} {
+		copy(img.Pix, orig)
+		out, err := New(img, 8, 8, WithPipeline(NewPipeline(stage)), WithWorkers(workers)).ProcessInPlace(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, v := range out.Pix {
+			if v != 0 {
+				t.Fatalf("workers %d: byte %d = %d, want 0", workers, i, v)
+			}
+		}
+	}
+}
+
+// 余白を読み込むぼかしはバンドの境目に継ぎ目を作らず、画像全体をぼかした場合と同じになる
+func TestMarginBlurHasNoSeam(t *testing.T) {
+	img := testImage(53, 71)
+	blur := verticalBlur(3)
+	want := applyWhole(t, img, blur)
+	for _, tile := range []int{4, 8, 13} {
+		for _, opts := range [][]Option{{WithWorkers(1)}, {WithWorkers(4)}, {WithPrefetch(1)}} {
+			opts = append(opts, WithPipeline(NewPipeline(blur)))
+			assertSameImage(t, process(t, img, tile, opts...), want)
+		}
+		// バンドを元画像に書き戻しながら処理しても同じ
+		work := image.NewNRGBA(img.Rect)
+		copy(work.Pix, img.Pix)
+		if _, err := New(work, tile, tile, WithPipeline(NewPipeline(blur)), WithWorkers(2)).ProcessInPlace(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		assertSameImage(t, work, want)
+		// 出力の位置にバンドを直接書き込む場合も同じ
+		var to bytes.Buffer
+		w := &memWriterAt{}
+		if err := New(img, tile, tile, WithPipeline(NewPipeline(blur)), WithWorkers(3)).ProcessToWriterAt(context.Background(), w, "ppm"); err != nil {
+			t.Fatal(err)
+		}
+		if err := New(want, tile, tile, WithPipeline(NewPipeline())).ProcessTo(context.Background(), &to, "ppm", EncodeOptions{}); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(w.buf, to.Bytes()) {
+			t.Errorf("tile %d: ProcessToWriterAt output differs from the whole-image blur", tile)
+		}
+	}
+}
+
+// モザイクの後のぼかしは、余白をタイルの高さの倍数にすると、画像全体をモザイク処理してからぼかした場合と同じ
+func TestMarginAfterMosaic(t *testing.T) {
+	const tile = 8
+	img := testImage(45, 67)
+	want := applyWhole(t, process(t, img, tile), verticalBlur(tile))
+	got := process(t, img, tile, WithPipeline(NewPipeline(&MosaicStage{TileWidth: tile, TileHeight: tile}, verticalBlur(tile))), WithWorkers(2))
+	assertSameImage(t, got, want)
+}
+
+// 重ならない範囲に同時に書き込めるメモリ上の io.WriterAt
+type memWriterAt struct {
+	mu  sync.Mutex
+	buf []byte
+}
+
+func (w *memWriterAt) WriteAt(p []byte, off int64) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if end := int(off) + len(p); end > len(w.buf) {
+		w.buf = append(w.buf, make([]byte, end-len(w.buf))...)
+	}
+	copy(w.buf[off:], p)
+	return len(p), nil
+}
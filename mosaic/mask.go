@@ -0,0 +1,126 @@
+package mosaic
+
+import (
+	"fmt"
+	"image"
+	"strconv"
+	"strings"
+)
+
+// 処理する画素を選ぶマスクを設定 (WithSelection に MaskSelection を渡すのと同じ)
+// マスクの値が 0 の画素 (マスクの範囲外を含む) は WithExclude と同じく、タイルの色の計算に含めず元の値のまま残す
+// マスクの座標は元画像と同じにすること
+func WithMask(mask *image.Alpha) Option {
+	return WithSelection(MaskSelection(mask))
+}
+
+// >=0.9 または <=0.1 形式の輝度の条件を解析し、LumaMask の threshold と above を返却
+func ParseLumaSelection(s string) (threshold float64, above bool, err error) {
+	switch {
+	case strings.HasPrefix(s, ">="):
+		above = true
+	case strings.HasPrefix(s, "<="):
+	default:
+		return 0, false, fmt.Errorf("invalid luma selection %q (want >=0.9 or <=0.1)", s)
+	}
+	v, err := strconv.ParseFloat(strings.TrimSpace(s[2:]), 64)
+	if err != nil || v < 0 || v > 1 {
+		return 0, false, fmt.Errorf("invalid luma selection %q (threshold must be between 0 and 1)", s)
+	}
+	return v, above, nil
+}
+
+// 輝度がしきい値以上 (above が false の場合は以下) の画素を選ぶマスクを生成
+// 輝度は 0.299R + 0.587G + 0.114B を 0〜1 にした値で、透明度は考慮しない
+func LumaMask(img *image.NRGBA, threshold float64, above bool) *image.Alpha {
+	mask := image.NewAlpha(img.Rect)
+	size := img.Rect.Size()
+	for y := 0; y < size.Y; y++ {
+		row := img.Pix[y*img.Stride : y*img.Stride+4*size.X]
+		out := mask.Pix[y*mask.Stride : y*mask.Stride+size.X]
+		for x := range out {
+			p := row[4*x : 4*x+3 : 4*x+3]
+			l := (0.299*float64(p[0]) + 0.587*float64(p[1]) + 0.114*float64(p[2])) / 255
+			if above && l >= threshold || !above && l <= threshold {
+				out[x] = 0xff
+			}
+		}
+	}
+	return mask
+}
+
+// マスクを n 画素だけ膨張させた新しいマスクを返却
+// 各画素の値を、その画素を中心とする (2n+1)×(2n+1) の正方形の範囲の最大値にする
+// 横と縦の 1 次元の最大値フィルタに分け、van Herk / Gil-Werman の方法で n によらず画素あたり一定の計算量で求める
+func DilateMask(mask *image.Alpha, n int) *image.Alpha {
+	out := image.NewAlpha(mask.Rect)
+	size := mask.Rect.Size()
+	for y := 0; y < size.Y; y++ {
+		copy(out.Pix[y*out.Stride:y*out.Stride+size.X], mask.Pix[y*mask.Stride:y*mask.Stride+size.X])
+	}
+	if n <= 0 {
+		return out
+	}
+
+	f := newMaxFilter(n, max(size.X, size.Y))
+	for y := 0; y < size.Y; y++ {
+		row := out.Pix[y*out.Stride : y*out.Stride+size.X]
+		f.apply(row, row)
+	}
+	column := make([]uint8, size.Y)
+	for x := 0; x < size.X; x++ {
+		for y := range column {
+			column[y] = out.Pix[y*out.Stride+x]
+		}
+		f.apply(column, column)
+		for y, v := range column {
+			out.Pix[y*out.Stride+x] = v
+		}
+	}
+	return out
+}
+
+// 幅 2n+1 の 1 次元の最大値フィルタ
+// 入力の両端を n 個の 0 で埋めた列を幅 2n+1 のブロックに分け、
+// ブロックの先頭からの最大値と末尾からの最大値の 2 つから各範囲の最大値を求める
+type maxFilter struct {
+	n                int
+	padded, pre, suf []uint8
+}
+
+func newMaxFilter(n, length int) *maxFilter {
+	total := length + 2*n
+	return &maxFilter{
+		n:      n,
+		padded: make([]uint8, total),
+		pre:    make([]uint8, total),
+		suf:    make([]uint8, total),
+	}
+}
+
+// src の最大値フィルタの結果を dst に書き込む (dst と src は同じでもよい)
+func (f *maxFilter) apply(dst, src []uint8) {
+	w := 2*f.n + 1
+	total := len(src) + 2*f.n
+	padded, pre, suf := f.padded[:total], f.pre[:total], f.suf[:total]
+	clear(padded)
+	copy(padded[f.n:], src)
+	for i, v := range padded {
+		if i%w == 0 || v > pre[i-1] {
+			pre[i] = v
+		} else {
+			pre[i] = pre[i-1]
+		}
+	}
+	for i := total - 1; i >= 0; i-- {
+		if i == total-1 || (i+1)%w == 0 || padded[i] > suf[i+1] {
+			suf[i] = padded[i]
+		} else {
+			suf[i] = suf[i+1]
+		}
+	}
+	// 出力の i 番目は padded の i〜i+2n の最大値
+	for i := range dst {
+		dst[i] = max(suf[i], pre[i+2*f.n])
+	}
+}
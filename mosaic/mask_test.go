@@ -0,0 +1,136 @@
+package mosaic
+
+import (
+	"image"
+	"image/color"
+	"math/rand/v2"
+	"testing"
+)
+
+func TestParseLumaSelection(t *testing.T) {
+	tests := []struct {
+		in        string
+		threshold float64
+		above     bool
+	}{
+		{">=0.9", 0.9, true},
+		{"<=0.1", 0.1, false},
+		{">= 1", 1, true},
+		{"<=0", 0, false},
+	}
+	for _, tt := range tests {
+		threshold, above, err := ParseLumaSelection(tt.in)
+		if err != nil || threshold != tt.threshold || above != tt.above {
+			t.Errorf("ParseLumaSelection(%q) = %g, %v, %v", tt.in, threshold, above, err)
+		}
+	}
+	for _, in := range []string{"", "0.9", ">0.9", "=>0.9", ">=1.1", "<=-0.1", ">=x"} {
+		if _, _, err := ParseLumaSelection(in); err == nil {
+			t.Errorf("ParseLumaSelection(%q) succeeded", in)
+		}
+	}
+}
+
+func TestLumaMask(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(2, 3, 6, 4))
+	for x, c := range []color.NRGBA{{255, 255, 255, 255}, {0, 0, 0, 255}, {128, 128, 128, 0}, {255, 255, 0, 255}} {
+		img.SetNRGBA(2+x, 3, c)
+	}
+	// 輝度は 1、0、約 0.502、0.886 (透明度は考慮しない)
+	for _, tt := range []struct {
+		threshold float64
+		above     bool
+		want      []uint8
+	}{
+		{0.9, true, []uint8{255, 0, 0, 0}},
+		{0.5, true, []uint8{255, 0, 255, 255}},
+		{0.1, false, []uint8{0, 255, 0, 0}},
+		{1, true, []uint8{255, 0, 0, 0}},
+		{0, false, []uint8{0, 255, 0, 0}},
+	} {
+		mask := LumaMask(img, tt.threshold, tt.above)
+		if mask.Rect != img.Rect {
+			t.Fatalf("mask bounds %v, want %v", mask.Rect, img.Rect)
+		}
+		for x, want := range tt.want {
+			if got := mask.AlphaAt(2+x, 3).A; got != want {
+				t.Errorf("threshold %g above %v: pixel %d = %d, want %d", tt.threshold, tt.above, x, got, want)
+			}
+		}
+	}
+}
+
+// 素朴に求めた、(2n+1)×(2n+1) の正方形の範囲の最大値
+func naiveDilate(mask *image.Alpha, n int) *image.Alpha {
+	out := image.NewAlpha(mask.Rect)
+	for y := mask.Rect.Min.Y; y < mask.Rect.Max.Y; y++ {
+		for x := mask.Rect.Min.X; x < mask.Rect.Max.X; x++ {
+			var v uint8
+			for yy := y - n; yy <= y+n; yy++ {
+				for xx := x - n; xx <= x+n; xx++ {
+					if image.Pt(xx, yy).In(mask.Rect) {
+						v = max(v, mask.AlphaAt(xx, yy).A)
+					}
+				}
+			}
+			out.SetAlpha(x, y, color.Alpha{v})
+		}
+	}
+	return out
+}
+
+func TestDilateMaskMatchesNaive(t *testing.T) {
+	rng := rand.New(rand.NewPCG(7, 8))
+	for i := 0; i < 30; i++ {
+		r := image.Rect(0, 0, 1+rng.IntN(40), 1+rng.IntN(40)).Add(image.Pt(rng.IntN(10)-5, rng.IntN(10)-5))
+		mask := image.NewAlpha(r)
+		for j := range mask.Pix {
+			if rng.IntN(20) == 0 {
+				mask.Pix[j] = uint8(rng.Uint32())
+			}
+		}
+		for _, n := range []int{0, 1, 2, 5, 50} {
+			got, want := DilateMask(mask, n), naiveDilate(mask, n)
+			if got.Rect != want.Rect || string(got.Pix) != string(want.Pix) {
+				t.Fatalf("%v n=%d: dilation differs from the naive maximum", r, n)
+			}
+		}
+	}
+	// 元のマスクは書き換えない
+	mask := image.NewAlpha(image.Rect(0, 0, 5, 5))
+	mask.SetAlpha(2, 2, color.Alpha{255})
+	DilateMask(mask, 1)
+	if mask.AlphaAt(1, 1).A != 0 {
+		t.Error("DilateMask modified its input")
+	}
+}
+
+// 明るい矩形だけをモザイク処理し、暗い部分は元のまま残す
+func TestLumaMaskSelectsBrightRectangle(t *testing.T) {
+	const tile = 8
+	img := image.NewNRGBA(image.Rect(0, 0, 64, 48))
+	bright := image.Rect(16, 8, 40, 32)
+	for y := 0; y < 48; y++ {
+		for x := 0; x < 64; x++ {
+			c := color.NRGBA{uint8(x), uint8(y), 40, 255}
+			if image.Pt(x, y).In(bright) {
+				c = color.NRGBA{uint8(235 + x%20), 250, uint8(230 + y%25), 255}
+			}
+			img.SetNRGBA(x, y, c)
+		}
+	}
+	out := process(t, img, tile, WithMask(LumaMask(img, 0.9, true)))
+	want := process(t, img, tile)
+	for y := 0; y < 48; y++ {
+		for x := 0; x < 64; x++ {
+			expected := img.NRGBAAt(x, y)
+			if image.Pt(x, y).In(bright) {
+				// 矩形はタイルの境界に揃えてあり、タイルの画素はすべて選ばれている
+				expected = want.NRGBAAt(x, y)
+			}
+			if got := out.NRGBAAt(x, y); got != expected {
+				t.Fatalf("pixel (%d, %d) = %v, want %v", x, y, got, expected)
+			}
+		}
+	}
+}
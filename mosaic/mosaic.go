@@ -0,0 +1,403 @@
+package mosaic
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	"io"
+	"log/slog"
+	"strings"
+	"time"
+)
+
+// モザイク処理に必要な情報を保持する構造体
+// 処理中の状態 (バンドのバッファとオフセット) は呼び出しごとに持つため、
+// 1 つの Processor で Process や ProcessContext を複数のゴルーチンから同時に呼び出せる
+// ただし、元画像を書き換える ProcessInPlace は同時に呼び出せない
+// また、コールバックなどオプションで渡したものも同時に呼び出される
+type Processor struct {
+	img          *image.NRGBA   // 元画像 (NewImage に NRGBA 以外の画像を渡した場合は nil)
+	src          pixelAccess    // 元画像の画素の読み方
+	mosaicWidth  int            // モザイクタイルの幅
+	mosaicHeight int            // モザイクタイルの高さ
+	progress     ProgressFunc   // 進捗通知用のコールバック
+	metrics      Metrics        // 計測用のインターフェース
+	logger       *slog.Logger   // nil の場合はログを出力しない
+	grain        Grain          // 塗りつぶし後に加えるノイズ
+	adjusts      []ColorAdjust  // 塗りつぶしの前にタイルの色を変換する処理
+	adjustScope  AdjustScope    // adjusts を適用する範囲
+	tileColor    TileColorFunc  // タイルの色を決める関数
+	tileFilter   TileFilter     // 平均色の画素の重み付け
+	rounding     Rounding       // 平均色の成分の丸め方
+	exclude      ExcludeFunc    // 処理から除外する画素を決める関数
+	selection    Selection      // 処理する画素の選び方 (nil の場合はすべての画素を処理する)
+	skipEdges    float64        // エッジの量がこれより大きいタイルを書き換えない (0 以下の場合は無効)
+	pattern      TilePattern    // 処理するタイルを決める関数 (nil の場合はすべてのタイル)
+	stripes      Stripes        // 処理する横縞
+	strength     *image.Gray    // タイルごとの処理の強さ
+	observer     func(TileInfo) // タイルを処理するたびに呼び出される関数
+	renderer     TileRenderer   // タイルを描画する処理
+	pipeline     *Pipeline      // バンドごとに実行する処理
+	workers      int            // 処理に使うゴルーチンの数
+	blockWidth   int            // ブロックの幅 (0 の場合はバンドで処理する)
+	blockHeight  int            // ブロックの高さ
+	gridOrigin   image.Point    // タイルの境界が通る点
+	prefetch     int            // fn に渡す前に先に処理しておくバンドの組の数 (0 の場合は重ねない)
+	pool         *BufferPool    // バンドとブロックのバッファを借りるプール (nil の場合は処理のたびに確保する)
+	stage        *MosaicStage   // New が組み立てた既定の Stage (処理しないバンドのタイルの通知に使う)
+	selected     []bool         // バンドごとに、selection で選んだ画素を含むかどうか (nil の場合はすべてのバンドを処理する)
+	margin       int            // バンドの上下に加えて読み込む行数 (pipeline の Margin)
+	err          error          // New で検出した設定の誤り (処理のたびに返す)
+
+	// ProcessTiles でタイルごとに呼び出される関数と、タイルの分散も求めるかどうか
+	visitor  func(Tile) error
+	variance bool
+
+	// 記録した警告と、エラーにする警告の種類、警告ごとに呼び出される関数
+	warnings  []Warning
+	strict    []WarningCode
+	onWarning func(Warning)
+
+	// Bands で取り出すバンドに付けるチェックサムの種類 (空の場合は付けない)
+	checksum ChecksumAlgorithm
+}
+
+// タイルの幅か高さが 0 以下の場合に処理のメソッドが返すエラー
+type TileSizeError struct {
+	Width, Height int
+}
+
+func (e *TileSizeError) Error() string {
+	return fmt.Sprintf("mosaic: invalid tile size %dx%d (width and height must be positive)", e.Width, e.Height)
+}
+
+// 元画像の幅か高さが 0 の場合に処理のメソッドが返すエラー
+// バッファや出力画像を確保する前に返す
+var ErrEmptyImage = errors.New("mosaic: image is empty (width and height must be positive)")
+
+// 処理の進捗状況
+type Progress struct {
+	BandsDone  int // 処理済みのバンド数
+	BandsTotal int // バンドの総数
+}
+
+// 進捗率をパーセントで返却
+func (p Progress) Percent() float64 {
+	if p.BandsTotal == 0 {
+		return 100
+	}
+	return float64(p.BandsDone) * 100 / float64(p.BandsTotal)
+}
+
+// バンドの処理が終わるたびに呼び出されるコールバック
+type ProgressFunc func(Progress)
+
+// Processor の設定を変更するオプション
+type Option func(*Processor)
+
+// 進捗通知用のコールバックを設定
+func WithProgress(fn ProgressFunc) Option {
+	return func(mp *Processor) {
+		mp.progress = fn
+	}
+}
+
+// 処理の計測に使うインターフェース
+// Prometheus などの具体的な実装は呼び出し側で用意する
+type Metrics interface {
+	// 処理の開始時に呼び出される
+	ProcessStarted()
+	// 処理の終了時に、所要時間と処理した画素数とともに呼び出される
+	ProcessFinished(elapsed time.Duration, pixels int, err error)
+}
+
+// 計測用のインターフェースを設定
+func WithMetrics(m Metrics) Option {
+	return func(mp *Processor) {
+		mp.metrics = m
+	}
+}
+
+// ログの出力先を設定
+// デバッグレベルでバンドごとの進捗を出力する
+func WithLogger(logger *slog.Logger) Option {
+	return func(mp *Processor) {
+		mp.logger = logger
+	}
+}
+
+// インスタンスを生成
+// タイルの幅か高さが 0 以下の場合、処理のメソッドは何もせずに *TileSizeError を返す
+// 元画像の幅か高さが 0 の場合は ErrEmptyImage を返す
+// 画像より大きいタイルは画像の大きさに切り詰め、WarningTileClamped の警告を記録する
+// 切り詰めても画像と重なるタイルの範囲は変わらない (格子の原点を動かす) ため、画像全体を覆うタイルは画像全体の平均色の 1 色になる
+func New(img *image.NRGBA, mosaicWidth, mosaicHeight int, opts ...Option) *Processor {
+	return newProcessor(img, nrgbaPixels{img}, mosaicWidth, mosaicHeight, opts)
+}
+
+// 任意の型の画像のインスタンスを生成
+// *image.RGBA、*image.Gray と *image.YCbCr は画像全体を NRGBA に変換せず、バンドやブロックを読み込む時に変換する
+// これらの画像の平均色 (WithTileColor、WithTileFilter、WithExclude、WithMask、WithSelection、WithSkipEdges を指定しない場合) は元画像から直接求めるため、
+// *image.RGBA の透明度の低い画素でも、NRGBA に変換してから求めるより精度が高い
+// それ以外の型の画像は ConvertToNRGBA で変換した画像を New に渡した場合と同じ
+// NRGBA 以外の元画像には ProcessInPlace を使えないため、ProcessInto に元画像を渡して書き戻す
+func NewImage(img image.Image, mosaicWidth, mosaicHeight int, opts ...Option) *Processor {
+	switch img := img.(type) {
+	case *image.NRGBA:
+		return New(img, mosaicWidth, mosaicHeight, opts...)
+	case *image.RGBA, *image.Gray, *image.YCbCr:
+		return newProcessor(nil, newPixelAccess(img), mosaicWidth, mosaicHeight, opts)
+	}
+	return New(ConvertToNRGBA(img), mosaicWidth, mosaicHeight, opts...)
+}
+
+// 元画像 src (NRGBA の場合は img も) のインスタンスを生成
+func newProcessor(img *image.NRGBA, src pixelAccess, mosaicWidth, mosaicHeight int, opts []Option) *Processor {
+	mp := &Processor{
+		img:          img,
+		src:          src,
+		mosaicWidth:  mosaicWidth,
+		mosaicHeight: mosaicHeight,
+	}
+	for _, opt := range opts {
+		opt(mp)
+	}
+	if mosaicWidth <= 0 || mosaicHeight <= 0 {
+		mp.err = &TileSizeError{Width: mosaicWidth, Height: mosaicHeight}
+		return mp
+	}
+	if src.Bounds().Empty() {
+		mp.err = ErrEmptyImage
+		return mp
+	}
+	if _, ok := checksumTables[mp.checksum]; mp.checksum != "" && !ok {
+		mp.err = fmt.Errorf("mosaic: unknown checksum algorithm %q (want %s)", mp.checksum, strings.Join(ChecksumAlgorithms(), ", "))
+		return mp
+	}
+	if bounds := src.Bounds(); mosaicWidth > bounds.Dx() || mosaicHeight > bounds.Dy() {
+		mp.mosaicWidth, mp.mosaicHeight = min(mosaicWidth, bounds.Dx()), min(mosaicHeight, bounds.Dy())
+		mp.gridOrigin = clampedOrigin(bounds, mosaicWidth, mosaicHeight, mp.gridOrigin)
+		err := mp.warn(Warning{
+			Code:    WarningTileClamped,
+			Message: "tile size is larger than the image; clamped to the image size",
+			Fields:  map[string]any{"tile_width": mosaicWidth, "tile_height": mosaicHeight, "width": bounds.Dx(), "height": bounds.Dy()},
+		})
+		if err != nil {
+			mp.err = err
+			return mp
+		}
+	}
+	if mp.pipeline == nil {
+		mp.stage = &MosaicStage{
+			TileWidth:  mp.mosaicWidth,
+			TileHeight: mp.mosaicHeight,
+			TileColor:  mp.tileColor,
+			Filter:     mp.tileFilter,
+			Rounding:   mp.rounding,
+			Exclude:    mp.exclude,
+			Selection:  mp.selection,
+			SkipEdges:  mp.skipEdges,
+			Pattern:    mp.pattern,
+			Stripes:    mp.stripes,
+			Strength:   mp.strength,
+			Observe:    mp.observer,
+			Renderer:   mp.renderer,
+			Adjusts:    mp.adjusts,
+			// 選ばなかった画素も変換する場合は、選んだ画素のないバンドも処理する
+			AdjustOutside: mp.adjustScope == AdjustAll,
+			Grain:         mp.grain,
+			Opaque:        src.Opaque(),
+			Origin:        mp.Grid().start(),
+			weights:       newTileWeights(mp.tileFilter, mp.mosaicWidth, mp.mosaicHeight),
+		}
+		if img == nil {
+			mp.stage.source = src
+		}
+		mp.pipeline = NewPipeline(mp.stage)
+		if mp.selection != nil && img != nil && !mp.stage.adjustsOutside() {
+			mp.selected = mp.selectedBands()
+		}
+	}
+	mp.margin = mp.pipeline.Margin()
+	return mp
+}
+
+// モザイク処理を実行し、処理後の画像を返却
+func (mp *Processor) Process() *image.NRGBA {
+	output, _ := mp.ProcessContext(context.Background())
+	return output
+}
+
+// モザイク処理を実行し、処理後の画像を返却
+// バンドごとに ctx を確認し、キャンセルされた場合や Stage が失敗した場合はその時点でエラーを返却
+func (mp *Processor) ProcessContext(ctx context.Context) (*image.NRGBA, error) {
+	if mp.err != nil {
+		return nil, mp.err
+	}
+	// 出力画像を生成 (元画像と同じサイズ)
+	output := image.NewNRGBA(mp.src.Bounds())
+	if err := mp.ProcessInto(ctx, output); err != nil {
+		return nil, err
+	}
+	return output, nil
+}
+
+// モザイク処理の結果を dst に書き込む
+// dst の範囲は元画像と同じでなければならない
+// 同じ dst を使い回すことで、フレームごとに出力画像を確保せずに済む
+// *image.RGBA の dst には、NRGBA の結果を乗算済みの値に変換して書き込む (ProcessContext の結果を変換した場合と同じ)
+// dst に元画像を渡すと、ProcessInPlace と同じく結果を元画像に書き戻す
+func (mp *Processor) ProcessInto(ctx context.Context, dst draw.Image) error {
+	if mp.err != nil {
+		return mp.err
+	}
+	if dst.Bounds() != mp.src.Bounds() {
+		return fmt.Errorf("mosaic: destination bounds %v do not match source bounds %v", dst.Bounds(), mp.src.Bounds())
+	}
+	if mp.BlockSize() != (image.Point{}) {
+		return mp.ProcessBlocks(ctx, func(block *image.NRGBA, rect image.Rectangle) error {
+			draw.Draw(dst, rect, block, rect.Min, draw.Src)
+			return nil
+		})
+	}
+	return mp.ProcessBands(ctx, func(band *image.NRGBA, rect image.Rectangle) error {
+		if draw.Image(band) == dst {
+			// 処理しなかったバンドを元画像に書き戻す場合
+			return nil
+		}
+		draw.Draw(dst, rect, band, rect.Min, draw.Src)
+		return nil
+	})
+}
+
+// モザイク処理の結果を元画像に書き戻し、元画像を返却
+// 出力画像を確保しないため、使用メモリは元画像とバンド 1 つ分で済む
+//
+// 注意: 元画像は上書きされ、処理前の内容は失われる。
+// エラーの場合は処理済みのバンドだけが書き換えられた状態になる。
+// 処理後に元画像を参照する用途 (デバッグ用オーバーレイなど) には ProcessContext を使うこと
+func (mp *Processor) ProcessInPlace(ctx context.Context) (*image.NRGBA, error) {
+	if mp.img == nil {
+		return nil, errors.New("mosaic: ProcessInPlace requires an *image.NRGBA source; use ProcessInto with the source image")
+	}
+	if err := mp.ProcessInto(ctx, mp.img); err != nil {
+		return nil, err
+	}
+	return mp.img, nil
+}
+
+// 処理済みのバンドを受け取るコールバック
+// band の rect の範囲が処理結果で、band はコールバックから戻った後に再利用される
+// WithMask や WithSelection で選んだ画素を含まないバンドは処理せずに元画像をそのまま渡すため、band に書き込んではならない
+type BandFunc func(band *image.NRGBA, rect image.Rectangle) error
+
+// バンドごとにモザイク処理し、処理済みのバンドを上から順に fn に渡す
+// 出力画像を確保せずに結果を逐次書き出す場合に使う (バンドを取り出す速さを呼び出し側で決める場合は Bands を使う)
+// fn がエラーを返した場合はその時点で処理を中断し、そのエラーを返却
+// 各バンドはバッファに読み込んでから処理するため、fn で元画像を書き換えてもよい
+// (WithPrefetch を指定した場合は先のバンドを同時に読み込むため、渡されたバンドより下の行は書き換えてはならない)
+func (mp *Processor) ProcessBands(ctx context.Context, fn BandFunc) error {
+	it := mp.Bands(ctx)
+	defer it.Close()
+	for {
+		band, err := it.nextBand()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := fn(band.Image, band.Rect); err != nil {
+			it.fail(err)
+			return err
+		}
+	}
+}
+
+// 処理済みのバンドを渡し終えたことをログと進捗に出力
+func (mp *Processor) bandDone(rect image.Rectangle, done, total int) {
+	if mp.logger != nil {
+		mp.logger.Debug("band processed",
+			"offset", rect.Max.Y, "bands_done", done, "bands_total", total)
+	}
+	if mp.progress != nil {
+		mp.progress(Progress{BandsDone: done, BandsTotal: total})
+	}
+}
+
+// バンドを 1 つ読み込んで処理し、処理結果を持つ画像と処理した範囲を返却
+// 選んだ画素を含まないバンドは読み込まずに、元画像をそのまま返す
+// rows は余白を持つ Stage がある場合に、後のバンドの上の余白にする元画像の行を控える
+func (mp *Processor) processBand(buffer *image.NRGBA, offset, columnWorkers int, rows *sourceRows) (*image.NRGBA, image.Rectangle, error) {
+	if mp.skipsBand(offset) {
+		rect := image.Rect(buffer.Rect.Min.X, offset, buffer.Rect.Max.X, offset+mp.mosaicHeight).Intersect(mp.src.Bounds())
+		mp.stage.skipTiles(rect)
+		return mp.img, rect, nil
+	}
+
+	// バッファに画像の一部を読み込む
+	rect := mp.readToBuffer(buffer, offset, rows)
+
+	// バッファ内のデータを処理
+	if columnWorkers <= 1 {
+		return buffer, rect, mp.pipeline.Apply(buffer, rect)
+	}
+	return buffer, rect, mp.applyColumns(buffer, rect, columnWorkers)
+}
+
+// バッファに画像の一部を読み込み、処理すべき範囲を返却
+// バッファの座標は元画像の座標に合わせる
+func (mp *Processor) readToBuffer(buffer *image.NRGBA, offset int, rows *sourceRows) image.Rectangle {
+	buffer.Rect = image.Rect(buffer.Rect.Min.X, offset, buffer.Rect.Max.X, offset+mp.mosaicHeight)
+
+	// バッファに、元の画像から指定範囲をコピー
+	rect := buffer.Rect.Intersect(mp.src.Bounds())
+	if mp.margin > 0 {
+		rows.read(mp, buffer, rect)
+		return rect
+	}
+	mp.src.readNRGBA(buffer, rect)
+	return rect
+}
+
+// バンド 1 つを読み込むバッファを生成 (元画像の幅 × モザイクの高さと上下の余白)
+// 余白は画像の範囲までしか読み込まないため、高さは元画像の高さを超えない (モザイクの高さは元画像の高さに切り詰めてある)
+func (mp *Processor) newBandBuffer() *image.NRGBA {
+	bounds := mp.src.Bounds()
+	return mp.newBuffer(image.Rect(bounds.Min.X, 0, bounds.Max.X, min(mp.mosaicHeight+2*mp.margin, bounds.Dy())))
+}
+
+// r の範囲のバッファを生成 (WithBufferPool の場合はプールから借りる)
+func (mp *Processor) newBuffer(r image.Rectangle) *image.NRGBA {
+	if mp.pool == nil {
+		return image.NewNRGBA(r)
+	}
+	return &image.NRGBA{Pix: mp.pool.get(4 * r.Dx() * r.Dy()), Stride: 4 * r.Dx(), Rect: r}
+}
+
+// newBuffer で生成したバッファを使い終える (WithBufferPool の場合はプールに返す)
+func (mp *Processor) releaseBuffers(buffers ...*image.NRGBA) {
+	if mp.pool == nil {
+		return
+	}
+	for _, b := range buffers {
+		mp.pool.put(b.Pix)
+	}
+}
+
+// 任意の画像を NRGBA に変換
+func ConvertToNRGBA(img image.Image) *image.NRGBA {
+	bounds := img.Bounds()
+	nrgba := image.NewNRGBA(bounds)
+	draw.Draw(nrgba, bounds, img, bounds.Min, draw.Src)
+	return nrgba
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,206 @@
+package mosaic
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// 不透明な img を tile の大きさのタイルで、画素を 1 つずつ足して素朴に処理した結果
+// 成分は RoundHalfUp で丸める
+func referenceMosaic(img *image.NRGBA, tile int) *image.NRGBA {
+	b := img.Rect
+	out := image.NewNRGBA(b)
+	for ty := b.Min.Y; ty < b.Max.Y; ty += tile {
+		for tx := b.Min.X; tx < b.Max.X; tx += tile {
+			rect := image.Rect(tx, ty, tx+tile, ty+tile).Intersect(b)
+			var sum [3]int
+			for y := rect.Min.Y; y < rect.Max.Y; y++ {
+				for x := rect.Min.X; x < rect.Max.X; x++ {
+					c := img.NRGBAAt(x, y)
+					sum[0] += int(c.R)
+					sum[1] += int(c.G)
+					sum[2] += int(c.B)
+				}
+			}
+			n := rect.Dx() * rect.Dy()
+			c := color.NRGBA{A: 255}
+			c.R = uint8((2*sum[0] + n) / (2 * n))
+			c.G = uint8((2*sum[1] + n) / (2 * n))
+			c.B = uint8((2*sum[2] + n) / (2 * n))
+			for y := rect.Min.Y; y < rect.Max.Y; y++ {
+				for x := rect.Min.X; x < rect.Max.X; x++ {
+					out.SetNRGBA(x, y, c)
+				}
+			}
+		}
+	}
+	return out
+}
+
+func TestProcessMatchesReference(t *testing.T) {
+	for _, tt := range []struct{ w, h, tile int }{
+		{64, 64, 8},
+		{50, 37, 16}, // 右と下のタイルが切れる
+		{7, 5, 32},   // 画像より大きなタイル
+		{33, 1, 4},   // 1 行の画像
+	} {
+		t.Run(fmt.Sprintf("%dx%d/%d", tt.w, tt.h, tt.tile), func(t *testing.T) {
+			img := testImage(tt.w, tt.h)
+			assertSameImage(t, process(t, img, tt.tile), referenceMosaic(img, tt.tile))
+		})
+	}
+}
+
+// 1 つの Processor の Process を同時に呼び出しても、それぞれの結果が正しい
+// (go test -race でバンドのバッファなどの共有を検出する)
+func TestProcessConcurrent(t *testing.T) {
+	img := testImage(200, 150)
+	want := referenceMosaic(img, 12)
+	mp := New(img, 12, 12, WithWorkers(2))
+
+	const calls = 8
+	outputs := make([]*image.NRGBA, calls)
+	var wg sync.WaitGroup
+	for i := range outputs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if i%2 == 0 {
+				outputs[i] = mp.Process()
+				return
+			}
+			out, err := mp.ProcessContext(context.Background())
+			if err != nil {
+				t.Error(err)
+			}
+			outputs[i] = out
+		}(i)
+	}
+	wg.Wait()
+	for i, out := range outputs {
+		if out == nil {
+			t.Fatalf("call %d returned no image", i)
+		}
+		assertSameImage(t, out, want)
+	}
+}
+
+func TestProcessInto(t *testing.T) {
+	img := testImage(60, 45)
+	mp := New(img, 10, 10)
+
+	// 同じ dst を使い回しても毎回同じ結果になる
+	dst := image.NewNRGBA(img.Rect)
+	for i := 0; i < 2; i++ {
+		if err := mp.ProcessInto(context.Background(), dst); err != nil {
+			t.Fatal(err)
+		}
+		assertSameImage(t, dst, mp.Process())
+	}
+
+	// 範囲が違う場合は両方の範囲をエラーに含める
+	wrong := image.NewNRGBA(image.Rect(0, 0, 60, 44))
+	err := mp.ProcessInto(context.Background(), wrong)
+	if err == nil {
+		t.Fatal("ProcessInto accepted mismatched bounds")
+	}
+	for _, r := range []image.Rectangle{wrong.Rect, img.Rect} {
+		if !strings.Contains(err.Error(), r.String()) {
+			t.Errorf("error %q does not mention %v", err, r)
+		}
+	}
+}
+
+// ProcessInto で dst を使い回す場合は、画像の大きさのメモリを確保しない
+func TestProcessIntoAllocations(t *testing.T) {
+	img := testImage(512, 512)
+	mp := New(img, 16, 16, WithWorkers(1))
+	dst := image.NewNRGBA(img.Rect)
+	if err := mp.ProcessInto(context.Background(), dst); err != nil {
+		t.Fatal(err)
+	}
+
+	const runs = 5
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	for i := 0; i < runs; i++ {
+		if err := mp.ProcessInto(context.Background(), dst); err != nil {
+			t.Fatal(err)
+		}
+	}
+	runtime.ReadMemStats(&after)
+	if perRun := (after.TotalAlloc - before.TotalAlloc) / runs; perRun >= uint64(len(img.Pix))/4 {
+		t.Errorf("ProcessInto allocated %d bytes per run for a %d byte image", perRun, len(img.Pix))
+	}
+}
+
+// ProcessInPlace は出力画像を確保せず、タイルごとにも確保しない
+// (確保の回数は画像の大きさによらず、確保するバイト数はバンドのバッファ程度)
+func TestProcessInPlaceAllocations(t *testing.T) {
+	var counts []float64
+	for _, size := range []int{64, 1024} {
+		img := testImage(size, size)
+		mp := New(img, 16, 16, WithWorkers(1))
+		counts = append(counts, testing.AllocsPerRun(5, func() {
+			if _, err := mp.ProcessInPlace(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+		}))
+
+		const runs = 5
+		var before, after runtime.MemStats
+		runtime.ReadMemStats(&before)
+		for i := 0; i < runs; i++ {
+			if _, err := mp.ProcessInPlace(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+		}
+		runtime.ReadMemStats(&after)
+		if perRun := (after.TotalAlloc - before.TotalAlloc) / runs; size == 1024 && perRun >= uint64(len(img.Pix))/8 {
+			t.Errorf("ProcessInPlace allocated %d bytes per run for a %d byte image", perRun, len(img.Pix))
+		}
+	}
+	// 1024x1024 は 64x64 の 256 倍のタイルを持つ
+	if counts[1] != counts[0] {
+		t.Errorf("%g allocations for 16 tiles but %g for 4096 tiles", counts[0], counts[1])
+	}
+}
+
+// タイルの大きさごとの Process の速さ
+func BenchmarkProcess(b *testing.B) {
+	img := testImage(1024, 768)
+	for _, tile := range []int{8, 32, 128} {
+		b.Run(fmt.Sprintf("tile=%d", tile), func(b *testing.B) {
+			mp := New(img, tile, tile)
+			b.SetBytes(int64(len(img.Pix)))
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				mp.Process()
+			}
+		})
+	}
+}
+
+// dst を使い回す ProcessInto の速さと確保するメモリ
+func BenchmarkProcessInto(b *testing.B) {
+	img := testImage(1024, 768)
+	for _, tile := range []int{8, 32, 128} {
+		b.Run(fmt.Sprintf("tile=%d", tile), func(b *testing.B) {
+			mp := New(img, tile, tile)
+			dst := image.NewNRGBA(img.Rect)
+			b.SetBytes(int64(len(img.Pix)))
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if err := mp.ProcessInto(context.Background(), dst); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,24 @@
+package mosaic
+
+import (
+	"image"
+	"image/color"
+)
+
+// 処理したタイルの情報
+type TileInfo struct {
+	X, Y    int             // タイルの列と行 (左上のタイルが 0, 0)
+	Rect    image.Rectangle // タイルの範囲 (画像全体の座標)
+	Color   color.NRGBA     // 塗りつぶした色 (ColorAdjust を適用した後の色)
+	Pixels  int             // 色の計算に使った画素数 (除外した画素を含まない)
+	Skipped bool            // WithExclude や WithSkipEdges などによりタイルを書き換えなかった場合は true (Color と Pixels はゼロ値)
+}
+
+// タイルを処理するたびに呼び出される関数を設定
+// 書き換えなかったタイルも Skipped を true にして呼び出すため、すべてのタイルが 1 度ずつ渡される
+// 並列処理では複数のゴルーチンから同時に、またタイルの順序によらずに呼び出される
+func WithTileObserver(fn func(TileInfo)) Option {
+	return func(mp *Processor) {
+		mp.observer = fn
+	}
+}
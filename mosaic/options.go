@@ -0,0 +1,485 @@
+package mosaic
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// 処理結果に影響する設定
+// コマンドのフラグ、設定ファイルや HTTP のクエリパラメーターなどの入口で共通に使い、Validate で確かめる
+// ゴルーチンの数や制限時間など、処理結果を変えない設定は含めない
+// 文字列の設定の空文字列は既定の値 (Canonical で補う値) とみなす
+type Options struct {
+	Tile       int     `json:"tile"`              // タイルの大きさ (px)
+	TileMM     float64 `json:"tile_mm,omitempty"` // タイルの大きさ (mm、0 より大きい場合は DPI で換算して Tile より優先する)
+	DPI        float64 `json:"dpi,omitempty"`     // 入力の解像度 (0 の場合は入力に記録された解像度)
+	GridOrigin [2]int  `json:"grid_origin"`       // タイルの境界が通る点
+	ColorSpace string  `json:"color_space"`       // rgb、lab または hsv
+	TileFilter string  `json:"tile_filter"`       // box、tent または gauss (ParseTileFilter の名前)
+	// 平均色を以前の計算 (RoundTruncate) で切り捨てる
+	LegacyRounding bool `json:"legacy_rounding,omitempty"`
+
+	Brightness   float64 `json:"brightness,omitempty"` // -100〜100
+	Contrast     float64 `json:"contrast,omitempty"`   // -100〜100
+	Saturation   float64 `json:"saturation,omitempty"` // -100〜100
+	HueShift     float64 `json:"hue_shift,omitempty"`  // 度
+	Tint         string  `json:"tint,omitempty"`       // #rrggbb
+	TintStrength float64 `json:"tint_strength,omitempty"`
+	LegoPalette  bool    `json:"lego_palette,omitempty"`
+	Palette      string  `json:"palette,omitempty"`      // PaletteByName の名前 (lego は LegoPalette と同じ)
+	AdjustScope  string  `json:"adjust_scope,omitempty"` // region または all (ParseAdjustScope の名前)
+
+	Grain     int    `json:"grain,omitempty"` // 0〜255
+	GrainDist string `json:"grain_dist"`      // uniform または triangular
+	Seed      int64  `json:"seed,omitempty"`
+
+	ExcludeColors    []string `json:"exclude_colors,omitempty"` // #rrggbb
+	ExcludeTolerance int      `json:"exclude_tolerance,omitempty"`
+
+	SelectLuma    string  `json:"select_luma,omitempty"` // >=0.9 または <=0.1
+	SelectGrow    int     `json:"select_grow,omitempty"`
+	Select        string  `json:"select,omitempty"` // ParseSelectExpr の式
+	SkipEdges     float64 `json:"skip_edges,omitempty"`
+	Pattern       string  `json:"pattern"` // PatternByName の名前
+	PatternInvert bool    `json:"pattern_invert,omitempty"`
+	Stripe        string  `json:"stripe,omitempty"`       // 40:20 形式
+	StrengthMap   string  `json:"strength_map,omitempty"` // 強さの画像のパス
+
+	Style        string `json:"style"`               // flat、lego、dot、rounded または grout
+	Baseplate    string `json:"baseplate,omitempty"` // #rrggbb
+	LabelColors  bool   `json:"label_colors,omitempty"`
+	LabelMinSize int    `json:"label_min_size,omitempty"`
+
+	Tolerant     bool   `json:"tolerant,omitempty"`
+	TolerantFill string `json:"tolerant_fill,omitempty"` // #rrggbb
+	ConvertSRGB  bool   `json:"convert_srgb,omitempty"`
+	Quality      int    `json:"quality,omitempty"` // 0〜100 (0 で形式の既定)
+	Compression  string `json:"compression"`       // ParseCompression の名前
+
+	Regions []RegionOptions `json:"regions,omitempty"` // 処理する範囲 (指定した場合は範囲の外を処理しない、後の範囲を優先する)
+	// 範囲ごとに幅と高さがどちらもタイルこの数以上になるようにタイルを小さくする (0 の場合は小さくしない)
+	RegionMinTiles int `json:"region_min_tiles,omitempty"`
+	MinTile        int `json:"min_tile,omitempty"` // RegionMinTiles で小さくするタイルの大きさの下限 (px、0 の場合は 1)
+}
+
+// 処理する範囲と、範囲ごとに変える設定
+// 空の設定は Options の設定を使う
+type RegionOptions struct {
+	Rect       [4]int `json:"rect"`                  // x, y, 幅, 高さ (px)
+	Tile       int    `json:"tile,omitempty"`        // タイルの大きさ (px、0 で Options の Tile)
+	ColorSpace string `json:"color_space,omitempty"` // rgb、lab または hsv
+	Style      string `json:"style,omitempty"`       // flat、lego、dot、rounded または grout
+}
+
+// 範囲の矩形
+func (r RegionOptions) Rectangle() image.Rectangle {
+	return image.Rect(r.Rect[0], r.Rect[1], r.Rect[0]+r.Rect[2], r.Rect[1]+r.Rect[3])
+}
+
+// x,y,w,h の後に :tile=8、:color-space=lab、:style=lego を続けた形式の範囲を解析
+func ParseRegion(s string) (RegionOptions, error) {
+	parts := strings.Split(s, ":")
+	var r RegionOptions
+	coords := strings.Split(parts[0], ",")
+	if len(coords) != 4 {
+		return RegionOptions{}, fmt.Errorf("invalid region %q (want x,y,w,h[:tile=n][:color-space=name][:style=name])", s)
+	}
+	for i, c := range coords {
+		v, err := strconv.Atoi(strings.TrimSpace(c))
+		if err != nil {
+			return RegionOptions{}, fmt.Errorf("invalid region %q (want x,y,w,h[:tile=n][:color-space=name][:style=name])", s)
+		}
+		r.Rect[i] = v
+	}
+	for _, part := range parts[1:] {
+		key, value, _ := strings.Cut(part, "=")
+		switch strings.TrimSpace(key) {
+		case "tile":
+			v, err := strconv.Atoi(strings.TrimSpace(value))
+			if err != nil {
+				return RegionOptions{}, fmt.Errorf("invalid region %q (tile must be an integer)", s)
+			}
+			r.Tile = v
+		case "color-space":
+			r.ColorSpace = strings.TrimSpace(value)
+		case "style":
+			r.Style = strings.TrimSpace(value)
+		default:
+			return RegionOptions{}, fmt.Errorf("invalid region %q (unknown setting %q, want tile, color-space or style)", s, key)
+		}
+	}
+	return r, nil
+}
+
+// 正しくない設定を表すエラー
+// メッセージは Err のメッセージだけで、どの設定かは Option で確かめる
+type OptionError struct {
+	Option string // 設定のフラグの名前 (tile など)
+	Err    error
+}
+
+func (e *OptionError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *OptionError) Unwrap() error {
+	return e.Err
+}
+
+func optionError(option string, err error) error {
+	return &OptionError{Option: option, Err: err}
+}
+
+// 設定の範囲と組み合わせを確かめ、最初に見つかった誤りを *OptionError で返却
+func (o Options) Validate() error {
+	if o.Tile <= 0 {
+		return optionError("tile", errors.New("tile must be positive"))
+	}
+	for _, v := range []struct {
+		name  string
+		value float64
+	}{
+		{"tile-mm", o.TileMM}, {"dpi", o.DPI}, {"brightness", o.Brightness}, {"contrast", o.Contrast}, {"saturation", o.Saturation},
+		{"hue-shift", o.HueShift}, {"tint-strength", o.TintStrength}, {"skip-edges", o.SkipEdges},
+	} {
+		if math.IsNaN(v.value) || math.IsInf(v.value, 0) {
+			return optionError(v.name, fmt.Errorf("%s must be a finite number", v.name))
+		}
+	}
+	if o.TileMM < 0 || o.DPI < 0 {
+		return optionError("tile-mm", errors.New("tile-mm and dpi must not be negative"))
+	}
+	if o.Grain < 0 || o.Grain > 255 {
+		return optionError("grain", errors.New("grain must be between 0 and 255"))
+	}
+	switch o.GrainDist {
+	case "", "uniform", "triangular":
+	default:
+		return optionError("grain-dist", fmt.Errorf("unknown grain distribution %q (want uniform or triangular)", o.GrainDist))
+	}
+	for _, v := range []struct {
+		name  string
+		value float64
+	}{{"brightness", o.Brightness}, {"contrast", o.Contrast}, {"saturation", o.Saturation}} {
+		if v.value < -100 || v.value > 100 {
+			return optionError(v.name, fmt.Errorf("%s must be between -100 and 100", v.name))
+		}
+	}
+	if _, err := ParseAdjustScope(o.AdjustScope); err != nil {
+		return optionError("adjust-scope", err)
+	}
+	if _, err := ParseColorSpace(o.ColorSpace); err != nil {
+		return optionError("color-space", err)
+	}
+	if f, err := ParseTileFilter(o.TileFilter); err != nil {
+		return optionError("tile-filter", err)
+	} else if f != BoxFilter && !o.rgbMean() {
+		return optionError("tile-filter", errors.New("-tile-filter requires -color-space rgb"))
+	}
+	if o.ExcludeTolerance < 0 || o.ExcludeTolerance > 255 {
+		return optionError("exclude-tolerance", errors.New("exclude-tolerance must be between 0 and 255"))
+	}
+	for _, c := range o.ExcludeColors {
+		if _, err := ParseHexColor(c); err != nil {
+			return optionError("exclude-color", err)
+		}
+	}
+	if o.SelectLuma != "" {
+		if _, _, err := ParseLumaSelection(o.SelectLuma); err != nil {
+			return optionError("select-luma", err)
+		}
+	}
+	if o.SkipEdges < 0 {
+		return optionError("skip-edges", errors.New("skip-edges must not be negative"))
+	}
+	if _, ok := PatternByName(o.Pattern); !ok && o.Pattern != "" {
+		return optionError("pattern", fmt.Errorf("unknown pattern %q (want none, checker, stripes-h or stripes-v)", o.Pattern))
+	}
+	if o.Stripe != "" {
+		if _, err := ParseStripes(o.Stripe); err != nil {
+			return optionError("stripe", err)
+		}
+	}
+	if o.SelectGrow < 0 {
+		return optionError("select-grow", errors.New("select-grow must not be negative"))
+	}
+	if o.SelectGrow > 0 && o.SelectLuma == "" {
+		return optionError("select-grow", errors.New("-select-grow requires -select-luma"))
+	}
+	if o.Select != "" {
+		e, err := ParseSelectExpr(o.Select)
+		if err != nil {
+			return optionError("select", err)
+		}
+		if len(e.Terms("regions")) > 0 {
+			if len(o.Regions) == 0 {
+				return optionError("select", errors.New("regions in -select requires -region or -regions"))
+			}
+			for _, r := range o.Regions {
+				if r.Tile != 0 || r.ColorSpace != "" || r.Style != "" {
+					return optionError("select", errors.New("regions in -select cannot be combined with per-region tile, color-space or style"))
+				}
+			}
+		}
+	}
+	if o.TolerantFill != "" {
+		if _, err := ParseHexColor(o.TolerantFill); err != nil {
+			return optionError("tolerant-fill", fmt.Errorf("-tolerant-fill: %w", err))
+		}
+	}
+	switch o.Style {
+	case "", "flat", "lego", "dot", "rounded", "grout":
+	default:
+		return optionError("style", fmt.Errorf("unknown style %q (want flat, lego, dot, rounded or grout)", o.Style))
+	}
+	if o.Baseplate != "" {
+		if _, err := ParseHexColor(o.Baseplate); err != nil {
+			return optionError("baseplate", fmt.Errorf("-baseplate: %w", err))
+		}
+		if !o.usesBaseplate() {
+			return optionError("baseplate", errors.New("-baseplate requires -style lego, dot, rounded or grout"))
+		}
+	}
+	if o.Tint != "" {
+		if _, err := ParseHexColor(o.Tint); err != nil {
+			return optionError("tint", fmt.Errorf("-tint: %w", err))
+		}
+		if o.TintStrength < 0 || o.TintStrength > 1 {
+			return optionError("tint-strength", errors.New("tint-strength must be between 0 and 1"))
+		}
+	}
+	if o.Palette != "" {
+		if _, ok := PaletteByName(o.Palette); !ok {
+			return optionError("palette", fmt.Errorf("unknown palette %q (want %s)", o.Palette, strings.Join(PaletteNames(), ", ")))
+		}
+		if o.LegoPalette && o.Palette != "lego" {
+			return optionError("palette", errors.New("-palette cannot be combined with -lego-palette"))
+		}
+	}
+	if o.Quality < 0 || o.Quality > 100 {
+		return optionError("quality", errors.New("quality must be between 0 and 100"))
+	}
+	if o.Compression != "" {
+		if _, err := ParseCompression(o.Compression); err != nil {
+			return optionError("compression", err)
+		}
+	}
+	if o.RegionMinTiles < 0 {
+		return optionError("region-min-tiles", errors.New("region-min-tiles must not be negative"))
+	}
+	if o.MinTile < 0 {
+		return optionError("min-tile", errors.New("min-tile must not be negative"))
+	}
+	for i, r := range o.Regions {
+		if err := r.validate(); err != nil {
+			return optionError("region", fmt.Errorf("region %d: %w", i+1, err))
+		}
+	}
+	return nil
+}
+
+// -region の範囲ごとに ProcessRegions で処理するかどうか
+// -select の式で regions を使う場合は、範囲を処理する画素の選び方にだけ使う
+func (o Options) ProcessesRegions() bool {
+	if len(o.Regions) == 0 {
+		return false
+	}
+	if o.Select == "" {
+		return true
+	}
+	e, err := ParseSelectExpr(o.Select)
+	return err != nil || len(e.Terms("regions")) == 0
+}
+
+// 範囲 r のタイルの大きさ (px)
+// tile は全体のタイルの大きさ (-tile-mm を換算した値) で、範囲の Tile を指定した場合はその大きさを使う
+// RegionMinTiles が 1 以上の場合は、bounds で切り詰めた範囲の幅と高さがどちらもタイル RegionMinTiles 個分以上になるまで小さくする
+// ただし MinTile より小さくはせず、元の大きさより大きくもしない
+func (o Options) RegionTile(r RegionOptions, tile int, bounds image.Rectangle) int {
+	if r.Tile > 0 {
+		tile = r.Tile
+	}
+	if o.RegionMinTiles <= 0 {
+		return tile
+	}
+	size := r.Rectangle().Intersect(bounds).Size()
+	fit := min(size.X, size.Y) / o.RegionMinTiles
+	return max(min(tile, fit), min(tile, max(o.MinTile, 1)))
+}
+
+// タイルの色を変換する設定があるかどうか
+func (o Options) adjustsColor() bool {
+	return o.Brightness != 0 || o.Contrast != 0 || o.Saturation != 0 || o.HueShift != 0 ||
+		(o.Tint != "" && o.TintStrength != 0) || o.LegoPalette || o.Palette != ""
+}
+
+// 全体とすべての範囲のタイルの色を RGB で平均するかどうか
+func (o Options) rgbMean() bool {
+	if o.ColorSpace != "" && o.ColorSpace != "rgb" {
+		return false
+	}
+	for _, r := range o.Regions {
+		if r.ColorSpace != "" && r.ColorSpace != "rgb" {
+			return false
+		}
+	}
+	return true
+}
+
+// 全体または範囲のどれかを -baseplate の色を使う描き方で描くかどうか
+func (o Options) usesBaseplate() bool {
+	if styleUsesBaseplate(o.Style) {
+		return true
+	}
+	for _, r := range o.Regions {
+		if styleUsesBaseplate(r.Style) {
+			return true
+		}
+	}
+	return false
+}
+
+// タイルの間や外側を -baseplate の色で描く描き方かどうか
+func styleUsesBaseplate(style string) bool {
+	switch style {
+	case "lego", "dot", "rounded", "grout":
+		return true
+	}
+	return false
+}
+
+func (r RegionOptions) validate() error {
+	if r.Rect[2] <= 0 || r.Rect[3] <= 0 {
+		return errors.New("width and height must be positive")
+	}
+	if r.Tile < 0 {
+		return errors.New("tile must not be negative")
+	}
+	if _, err := ParseColorSpace(r.ColorSpace); err != nil {
+		return err
+	}
+	switch r.Style {
+	case "", "flat", "lego", "dot", "rounded", "grout":
+	default:
+		return fmt.Errorf("unknown style %q (want flat, lego, dot, rounded or grout)", r.Style)
+	}
+	return nil
+}
+
+// 同じ処理結果になる設定を同じ値にそろえた Options
+// 既定の値を補い、色を小文字の #rrggbb に、-select-luma、-select と -stripe を決まった書式にし、
+// 効果のない設定 (-grain 0 の -seed など) をゼロ値にする
+// キャッシュのキーや実行の要約に使う (Validate を通った Options に使い、何度適用しても変わらない)
+func (o Options) Canonical() Options {
+	o.ColorSpace = defaultString(o.ColorSpace, "rgb")
+	o.TileFilter = defaultString(o.TileFilter, "box")
+	o.GrainDist = defaultString(o.GrainDist, "uniform")
+	o.Pattern = defaultString(o.Pattern, "none")
+	o.Style = defaultString(o.Style, "flat")
+	o.Compression = defaultString(o.Compression, "default")
+
+	o.Tint = canonicalColor(o.Tint)
+	if o.Tint == "" || o.TintStrength == 0 {
+		o.Tint, o.TintStrength = "", 0
+	}
+	if o.Grain == 0 {
+		o.GrainDist, o.Seed = "uniform", 0
+	}
+	if o.Palette == "lego" {
+		o.LegoPalette, o.Palette = true, ""
+	}
+	if o.AdjustScope == "region" || !o.adjustsColor() {
+		o.AdjustScope = ""
+	}
+	if o.ColorSpace == "lab" {
+		// CIELAB の平均色は丸め方によらない
+		o.LegacyRounding = false
+	}
+
+	colors := make([]string, 0, len(o.ExcludeColors))
+	for _, c := range o.ExcludeColors {
+		colors = append(colors, canonicalColor(c))
+	}
+	slices.Sort(colors)
+	o.ExcludeColors = slices.Compact(colors)
+	if len(o.ExcludeColors) == 0 {
+		o.ExcludeColors, o.ExcludeTolerance = nil, 0
+	}
+
+	if threshold, above, err := ParseLumaSelection(o.SelectLuma); err == nil {
+		op := "<="
+		if above {
+			op = ">="
+		}
+		o.SelectLuma = op + strconv.FormatFloat(threshold, 'g', -1, 64)
+	}
+	if o.SelectLuma == "" {
+		o.SelectGrow = 0
+	}
+	if e, err := ParseSelectExpr(o.Select); err == nil {
+		o.Select = e.String()
+	}
+	if o.Pattern == "none" {
+		o.PatternInvert = false
+	}
+	if s, err := ParseStripes(o.Stripe); err == nil {
+		o.Stripe = s.String()
+	}
+
+	o.Baseplate = canonicalColor(o.Baseplate)
+	if !o.usesBaseplate() {
+		o.Baseplate = ""
+	}
+	if !o.LabelColors {
+		o.LabelMinSize = 0
+	}
+	if o.Tolerant {
+		o.TolerantFill = canonicalColor(defaultString(o.TolerantFill, "#808080"))
+	} else {
+		o.TolerantFill = ""
+	}
+	if o.RegionMinTiles == 0 || !o.ProcessesRegions() {
+		o.RegionMinTiles, o.MinTile = 0, 0
+	} else {
+		o.MinTile = max(o.MinTile, 1)
+	}
+	if len(o.Regions) > 0 {
+		// 全体の設定と同じ値は省き、空の設定と同じにする
+		regions := make([]RegionOptions, len(o.Regions))
+		for i, r := range o.Regions {
+			if r.Tile == o.Tile && o.TileMM == 0 {
+				r.Tile = 0
+			}
+			if r.ColorSpace == o.ColorSpace {
+				r.ColorSpace = ""
+			}
+			if r.Style == o.Style {
+				r.Style = ""
+			}
+			regions[i] = r
+		}
+		o.Regions = regions
+	}
+	return o
+}
+
+func defaultString(s, def string) string {
+	if s == "" {
+		return def
+	}
+	return s
+}
+
+// 小文字の #rrggbb 形式の色 (解析できない場合はそのまま)
+func canonicalColor(s string) string {
+	c, err := ParseHexColor(strings.TrimSpace(s))
+	if err != nil {
+		return s
+	}
+	return FormatHexColor(c)
+}
@@ -0,0 +1,208 @@
+package mosaic
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// Validate を通る最小の設定
+func validOptions() Options {
+	return Options{Tile: 16}
+}
+
+func TestOptionsValidateInvalid(t *testing.T) {
+	region := RegionOptions{Rect: [4]int{0, 0, 10, 10}}
+	tests := []struct {
+		name   string
+		modify func(*Options)
+		option string // *OptionError の Option
+	}{
+		{"zero tile", func(o *Options) { o.Tile = 0 }, "tile"},
+		{"negative tile", func(o *Options) { o.Tile = -1 }, "tile"},
+		{"negative tile-mm", func(o *Options) { o.TileMM = -1 }, "tile-mm"},
+		{"negative dpi", func(o *Options) { o.DPI = -300 }, "tile-mm"},
+		{"negative grain", func(o *Options) { o.Grain = -1 }, "grain"},
+		{"grain above 255", func(o *Options) { o.Grain = 256 }, "grain"},
+		{"unknown grain-dist", func(o *Options) { o.GrainDist = "gaussian" }, "grain-dist"},
+		{"brightness below", func(o *Options) { o.Brightness = -100.5 }, "brightness"},
+		{"brightness above", func(o *Options) { o.Brightness = 101 }, "brightness"},
+		{"contrast above", func(o *Options) { o.Contrast = 200 }, "contrast"},
+		{"saturation below", func(o *Options) { o.Saturation = -101 }, "saturation"},
+		{"NaN brightness", func(o *Options) { o.Brightness = math.NaN() }, "brightness"},
+		{"infinite hue-shift", func(o *Options) { o.HueShift = math.Inf(1) }, "hue-shift"},
+		{"NaN tile-mm", func(o *Options) { o.TileMM = math.NaN() }, "tile-mm"},
+		{"unknown adjust-scope", func(o *Options) { o.AdjustScope = "outside" }, "adjust-scope"},
+		{"unknown color-space", func(o *Options) { o.ColorSpace = "cmyk" }, "color-space"},
+		{"unknown tile-filter", func(o *Options) { o.TileFilter = "lanczos" }, "tile-filter"},
+		{"tile-filter with lab", func(o *Options) { o.TileFilter, o.ColorSpace = "tent", "lab" }, "tile-filter"},
+		{"tile-filter with region lab", func(o *Options) {
+			o.TileFilter = "gauss"
+			o.Regions = []RegionOptions{{Rect: region.Rect, ColorSpace: "hsv"}}
+		}, "tile-filter"},
+		{"negative exclude-tolerance", func(o *Options) { o.ExcludeTolerance = -1 }, "exclude-tolerance"},
+		{"exclude-tolerance above 255", func(o *Options) { o.ExcludeTolerance = 256 }, "exclude-tolerance"},
+		{"bad exclude-color", func(o *Options) { o.ExcludeColors = []string{"#ff00ff", "magenta"} }, "exclude-color"},
+		{"bad select-luma", func(o *Options) { o.SelectLuma = "0.9" }, "select-luma"},
+		{"negative skip-edges", func(o *Options) { o.SkipEdges = -1 }, "skip-edges"},
+		{"unknown pattern", func(o *Options) { o.Pattern = "zigzag" }, "pattern"},
+		{"bad stripe", func(o *Options) { o.Stripe = "40" }, "stripe"},
+		{"negative select-grow", func(o *Options) { o.SelectGrow, o.SelectLuma = -1, ">=0.5" }, "select-grow"},
+		{"select-grow without select-luma", func(o *Options) { o.SelectGrow = 2 }, "select-grow"},
+		{"bad select", func(o *Options) { o.Select = "regions +" }, "select"},
+		{"select regions without regions", func(o *Options) { o.Select = "regions" }, "select"},
+		{"select regions with region tile", func(o *Options) {
+			o.Select = "regions"
+			o.Regions = []RegionOptions{{Rect: region.Rect, Tile: 8}}
+		}, "select"},
+		{"select regions with region style", func(o *Options) {
+			o.Select = "regions - rect(0,0,2,2)"
+			o.Regions = []RegionOptions{{Rect: region.Rect, Style: "dot"}}
+		}, "select"},
+		{"bad tolerant-fill", func(o *Options) { o.TolerantFill = "#80808" }, "tolerant-fill"},
+		{"unknown style", func(o *Options) { o.Style = "mosaic" }, "style"},
+		{"bad baseplate", func(o *Options) { o.Style, o.Baseplate = "lego", "green" }, "baseplate"},
+		{"baseplate with flat", func(o *Options) { o.Baseplate = "#237841" }, "baseplate"},
+		{"bad tint", func(o *Options) { o.Tint = "blue" }, "tint"},
+		{"tint-strength below", func(o *Options) { o.Tint, o.TintStrength = "#0044cc", -0.1 }, "tint-strength"},
+		{"tint-strength above", func(o *Options) { o.Tint, o.TintStrength = "#0044cc", 1.5 }, "tint-strength"},
+		{"unknown palette", func(o *Options) { o.Palette = "rainbow" }, "palette"},
+		{"palette with lego-palette", func(o *Options) { o.Palette, o.LegoPalette = "viridis", true }, "palette"},
+		{"negative quality", func(o *Options) { o.Quality = -1 }, "quality"},
+		{"quality above 100", func(o *Options) { o.Quality = 101 }, "quality"},
+		{"unknown compression", func(o *Options) { o.Compression = "ultra" }, "compression"},
+		{"negative region-min-tiles", func(o *Options) { o.RegionMinTiles = -1 }, "region-min-tiles"},
+		{"negative min-tile", func(o *Options) { o.MinTile = -1 }, "min-tile"},
+		{"empty region", func(o *Options) { o.Regions = []RegionOptions{{Rect: [4]int{0, 0, 0, 10}}} }, "region"},
+		{"negative region tile", func(o *Options) { o.Regions = []RegionOptions{{Rect: region.Rect, Tile: -1}} }, "region"},
+		{"unknown region color-space", func(o *Options) { o.Regions = []RegionOptions{region, {Rect: region.Rect, ColorSpace: "xyz"}} }, "region"},
+		{"unknown region style", func(o *Options) { o.Regions = []RegionOptions{{Rect: region.Rect, Style: "brick"}} }, "region"},
+	}
+	for _, tt := range tests {
+		o := validOptions()
+		tt.modify(&o)
+		err := o.Validate()
+		var oe *OptionError
+		if !errors.As(err, &oe) {
+			t.Errorf("%s: %v, want *OptionError", tt.name, err)
+			continue
+		}
+		if oe.Option != tt.option || oe.Error() == "" {
+			t.Errorf("%s: option %q (%v), want %q", tt.name, oe.Option, err, tt.option)
+		}
+	}
+}
+
+func TestOptionsValidateValid(t *testing.T) {
+	region := RegionOptions{Rect: [4]int{0, 0, 10, 10}}
+	tests := []struct {
+		name   string
+		modify func(*Options)
+	}{
+		{"minimal", func(o *Options) {}},
+		{"defaults spelled out", func(o *Options) {
+			o.ColorSpace, o.TileFilter, o.GrainDist, o.Pattern, o.Style, o.Compression, o.AdjustScope = "rgb", "box", "uniform", "none", "flat", "default", "region"
+		}},
+		{"limits", func(o *Options) {
+			o.Brightness, o.Contrast, o.Saturation, o.Grain, o.ExcludeTolerance, o.Quality = -100, 100, 100, 255, 255, 100
+		}},
+		{"box filter with lab", func(o *Options) { o.TileFilter, o.ColorSpace = "box", "lab" }},
+		{"lego palette by both names", func(o *Options) { o.Palette, o.LegoPalette = "lego", true }},
+		{"tint-strength ignored without tint", func(o *Options) { o.TintStrength = 5 }},
+		{"baseplate with region style", func(o *Options) {
+			o.Baseplate = "#237841"
+			o.Regions = []RegionOptions{{Rect: region.Rect, Style: "grout"}}
+		}},
+		{"select regions", func(o *Options) {
+			o.Select = "regions & luma(>=0.5)"
+			o.Regions = []RegionOptions{region}
+		}},
+		{"select-grow with select-luma", func(o *Options) { o.SelectLuma, o.SelectGrow = "<=0.1", 3 }},
+	}
+	for _, tt := range tests {
+		o := validOptions()
+		tt.modify(&o)
+		if err := o.Validate(); err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+	}
+}
+
+func TestOptionsCanonicalEquivalent(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b Options
+	}{
+		{"defaults", Options{Tile: 8}, Options{Tile: 8, ColorSpace: "rgb", TileFilter: "box", GrainDist: "uniform", Pattern: "none", Style: "flat", Compression: "default"}},
+		{"exclude colors order and case", Options{Tile: 8, ExcludeColors: []string{"#FF00FF", "#00ff00", "#ff00ff"}}, Options{Tile: 8, ExcludeColors: []string{"#00FF00", "#ff00ff"}}},
+		{"seed without grain", Options{Tile: 8, Seed: 42, GrainDist: "triangular"}, Options{Tile: 8}},
+		{"tint without strength", Options{Tile: 8, Tint: "#0044CC"}, Options{Tile: 8}},
+		{"lego palette", Options{Tile: 8, Palette: "lego"}, Options{Tile: 8, LegoPalette: true}},
+		{"luma format", Options{Tile: 8, SelectLuma: ">=0.90"}, Options{Tile: 8, SelectLuma: ">= .9"}},
+		{"adjust scope without adjustment", Options{Tile: 8, AdjustScope: "all"}, Options{Tile: 8}},
+		{"region same as global", Options{Tile: 8, Regions: []RegionOptions{{Rect: [4]int{0, 0, 4, 4}, Tile: 8, Style: "flat"}}}, Options{Tile: 8, Regions: []RegionOptions{{Rect: [4]int{0, 0, 4, 4}}}}},
+	}
+	for _, tt := range tests {
+		if err := tt.a.Validate(); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if a, b := tt.a.Canonical(), tt.b.Canonical(); !reflect.DeepEqual(a, b) {
+			t.Errorf("%s: %+v != %+v", tt.name, a, b)
+		}
+	}
+}
+
+func FuzzCanonical(f *testing.F) {
+	f.Add(16, "rgb", "box", "#FF00FF,#00ff00", ">=0.9", "40:20", "regions - rect(0,0,8,8)", "lego", "#237841", "#0044CC", 0.5, 10.0, 8, int64(1), "viridis", "all", "0,0,32,32")
+	f.Add(1, "", "", "", "", "", "", "", "", "", 0.0, 0.0, 0, int64(0), "", "", "")
+	f.Add(100, "lab", "tent", "#abc", "<=.25", "1:1", "all", "dot", "", "#fff", 1.0, -100.0, 255, int64(-7), "lego", "region", "10,10,5,5:tile=4:style=grout")
+	f.Fuzz(func(t *testing.T, tile int, colorSpace, filter, exclude, luma, stripe, sel, style, baseplate, tint string,
+		strength, brightness float64, grain int, seed int64, palette, scope, region string) {
+		o := Options{
+			Tile: tile, ColorSpace: colorSpace, TileFilter: filter, SelectLuma: luma, Stripe: stripe, Select: sel,
+			Style: style, Baseplate: baseplate, Tint: tint, TintStrength: strength, Brightness: brightness,
+			Grain: grain, Seed: seed, Palette: palette, AdjustScope: scope,
+		}
+		if exclude != "" {
+			o.ExcludeColors = strings.Split(exclude, ",")
+		}
+		if r, err := ParseRegion(region); err == nil {
+			o.Regions = []RegionOptions{r}
+		}
+		if o.Validate() != nil {
+			return
+		}
+		c := o.Canonical()
+		if err := c.Validate(); err != nil {
+			t.Fatalf("canonical options are invalid: %v\n%+v", err, c)
+		}
+		if cc := c.Canonical(); !reflect.DeepEqual(cc, c) {
+			t.Fatalf("Canonical is not idempotent:\n%+v\n%+v", c, cc)
+		}
+
+		// 除外する色の順番によらない
+		reversed := o
+		reversed.ExcludeColors = slices.Clone(o.ExcludeColors)
+		slices.Reverse(reversed.ExcludeColors)
+		if rc := reversed.Canonical(); !reflect.DeepEqual(rc, c) {
+			t.Fatalf("Canonical depends on the exclude color order:\n%+v\n%+v", c, rc)
+		}
+
+		// JSON で書き出して読み戻しても同じ設定
+		data, err := json.Marshal(c)
+		if err != nil {
+			t.Fatalf("marshal: %v", err)
+		}
+		var back Options
+		if err := json.Unmarshal(data, &back); err != nil {
+			t.Fatalf("unmarshal %s: %v", data, err)
+		}
+		if !reflect.DeepEqual(back.Canonical(), c) {
+			t.Fatalf("JSON round trip changed the options:\n%s\n%+v\n%+v", data, c, back.Canonical())
+		}
+	})
+}
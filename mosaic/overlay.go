@@ -0,0 +1,124 @@
+package mosaic
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+)
+
+// デバッグ用オーバーレイの描画色
+var (
+	GridColor    = color.NRGBA{255, 255, 255, 255} // タイルの境界線
+	OutlineColor = color.NRGBA{255, 0, 0, 255}     // 選択範囲の輪郭
+)
+
+// 処理結果を確認するためのオーバーレイ画像を生成
+// 暗くした元画像の上にタイルの境界線を描き、fill が true の場合は
+// 各タイルを計算結果の色で 40% の不透明度で塗る
+// タイルは画像の座標の原点を通る格子に並べる
+func DebugOverlay(src, output *image.NRGBA, tileWidth, tileHeight int, fill bool) *image.NRGBA {
+	return DebugOverlayGrid(src, output, NewGrid(src.Bounds(), tileWidth, tileHeight, image.Point{}), fill)
+}
+
+// grid のタイルの境界線を描く DebugOverlay
+func DebugOverlayGrid(src, output *image.NRGBA, grid Grid, fill bool) *image.NRGBA {
+	dst := Dim(src, 0.5)
+	drawGrid(dst, output, grid, fill)
+	return dst
+}
+
+// ProcessRegions の範囲ごとのタイルの境界線を描く DebugOverlay
+// 範囲ごとの格子は ProcessRegions と同じく origin を通り、画像の範囲で切り詰めた各範囲の輪郭を OutlineColor で描く
+// 範囲が重なる場合は後の範囲のタイルを上に描く
+func DebugOverlayRegions(src, output *image.NRGBA, tileWidth, tileHeight int, regions []Region, origin image.Point, fill bool) *image.NRGBA {
+	dimmed := Dim(src, 0.5)
+	dst := Dim(src, 0.5)
+	var outlines []image.Rectangle
+	for _, r := range regions {
+		rect := r.Rect.Intersect(src.Rect)
+		if rect.Empty() {
+			continue
+		}
+		w, h := tileWidth, tileHeight
+		if r.TileWidth > 0 && r.TileHeight > 0 {
+			w, h = r.TileWidth, r.TileHeight
+		}
+		// 前の範囲と重なった画素は、前の範囲のタイルを消してから描く
+		draw.Draw(dst, rect, dimmed, rect.Min, draw.Src)
+		drawGrid(dst, output, NewGrid(rect, w, h, origin), fill)
+		outlines = append(outlines, rect)
+	}
+	for _, rect := range outlines {
+		StrokeRect(dst, rect, OutlineColor)
+	}
+	return dst
+}
+
+// grid のタイルを左上の画素の output の色で塗り、境界線を描く
+func drawGrid(dst, output *image.NRGBA, grid Grid, fill bool) {
+	for _, cell := range grid.Cells() {
+		if fill {
+			BlendRect(dst, cell.Rect, output.NRGBAAt(cell.Rect.Min.X, cell.Rect.Min.Y), 0.4)
+		}
+		StrokeRect(dst, cell.Rect, GridColor)
+	}
+}
+
+// 明るさを factor 倍にした画像のコピーを返却
+func Dim(src *image.NRGBA, factor float64) *image.NRGBA {
+	dst := image.NewNRGBA(src.Bounds())
+	for i := 0; i < len(src.Pix); i += 4 {
+		dst.Pix[i+0] = uint8(float64(src.Pix[i+0]) * factor)
+		dst.Pix[i+1] = uint8(float64(src.Pix[i+1]) * factor)
+		dst.Pix[i+2] = uint8(float64(src.Pix[i+2]) * factor)
+		dst.Pix[i+3] = src.Pix[i+3]
+	}
+	return dst
+}
+
+// 指定範囲に色を不透明度 alpha で重ねる
+func BlendRect(dst *image.NRGBA, rect image.Rectangle, c color.NRGBA, alpha float64) {
+	rect = rect.Intersect(dst.Bounds())
+	for y := rect.Min.Y; y < rect.Max.Y; y++ {
+		for x := rect.Min.X; x < rect.Max.X; x++ {
+			i := dst.PixOffset(x, y)
+			dst.Pix[i+0] = blend(dst.Pix[i+0], c.R, alpha)
+			dst.Pix[i+1] = blend(dst.Pix[i+1], c.G, alpha)
+			dst.Pix[i+2] = blend(dst.Pix[i+2], c.B, alpha)
+		}
+	}
+}
+
+// 指定範囲の輪郭を 1px の線で描く
+func StrokeRect(dst *image.NRGBA, rect image.Rectangle, c color.NRGBA) {
+	rect = rect.Intersect(dst.Bounds())
+	if rect.Empty() {
+		return
+	}
+	for x := rect.Min.X; x < rect.Max.X; x++ {
+		dst.SetNRGBA(x, rect.Min.Y, c)
+		dst.SetNRGBA(x, rect.Max.Y-1, c)
+	}
+	for y := rect.Min.Y; y < rect.Max.Y; y++ {
+		dst.SetNRGBA(rect.Min.X, y, c)
+		dst.SetNRGBA(rect.Max.X-1, y, c)
+	}
+}
+
+// s で選んだ画素の輪郭を 1px の線で描く
+// 上下左右のいずれかに選ばなかった画素 (画像の外を含む) がある、選んだ画素を c で塗る
+func StrokeSelection(dst *image.NRGBA, s Selection, c color.NRGBA) {
+	b := NewBitmap(dst.Rect)
+	s.Fill(b)
+	for y := dst.Rect.Min.Y; y < dst.Rect.Max.Y; y++ {
+		for x := dst.Rect.Min.X; x < dst.Rect.Max.X; x++ {
+			if b.Contains(x, y) && !(b.Contains(x-1, y) && b.Contains(x+1, y) && b.Contains(x, y-1) && b.Contains(x, y+1)) {
+				dst.SetNRGBA(x, y, c)
+			}
+		}
+	}
+}
+
+func blend(dst, src uint8, alpha float64) uint8 {
+	return uint8(float64(dst)*(1-alpha) + float64(src)*alpha + 0.5)
+}
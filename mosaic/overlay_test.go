@@ -0,0 +1,127 @@
+package mosaic
+
+import (
+	"context"
+	"image"
+	"image/color"
+	"testing"
+)
+
+// src を暗くした画素に、c を 40% の不透明度で重ねた色
+func overlayPixel(src, c color.NRGBA, fill bool) color.NRGBA {
+	p := color.NRGBA{src.R / 2, src.G / 2, src.B / 2, src.A}
+	if !fill {
+		return p
+	}
+	mix := func(d, s uint8) uint8 { return uint8(float64(d)*0.6 + float64(s)*0.4 + 0.5) }
+	return color.NRGBA{mix(p.R, c.R), mix(p.G, c.G), mix(p.B, c.B), p.A}
+}
+
+// タイルの境界の画素かどうか
+func onCellEdge(r image.Rectangle, x, y int) bool {
+	return x == r.Min.X || x == r.Max.X-1 || y == r.Min.Y || y == r.Max.Y-1
+}
+
+// タイルの境界の画素は GridColor、それ以外は暗くした元画像にタイルの計算結果の色を 40% で重ねる
+// 端のタイルが切れる原点の格子でも、切り詰めたタイルの境界に線を引く
+func TestDebugOverlayGrid(t *testing.T) {
+	src := testImageAt(image.Rect(-5, 3, 37, 29))
+	for _, origin := range []image.Point{{}, {3, -2}} {
+		mp := New(src, 8, 6, WithGridOrigin(origin))
+		output := mp.Process()
+		grid := mp.Grid()
+		for _, fill := range []bool{true, false} {
+			overlay := DebugOverlayGrid(src, output, grid, fill)
+			if overlay.Rect != src.Rect {
+				t.Fatalf("overlay bounds %v, want %v", overlay.Rect, src.Rect)
+			}
+			for y := src.Rect.Min.Y; y < src.Rect.Max.Y; y++ {
+				for x := src.Rect.Min.X; x < src.Rect.Max.X; x++ {
+					cell, _ := grid.CellAt(x, y)
+					want := GridColor
+					if !onCellEdge(cell.Rect, x, y) {
+						want = overlayPixel(src.NRGBAAt(x, y), MeanColor(PixelRegion{img: src, Rect: cell.Rect}), fill)
+					}
+					if got := overlay.NRGBAAt(x, y); got != want {
+						t.Fatalf("origin %v, fill %v: pixel (%d,%d) = %v, want %v", origin, fill, x, y, got, want)
+					}
+				}
+			}
+		}
+	}
+}
+
+// 範囲ごとの格子を描き、画像の範囲で切り詰めた範囲の輪郭を OutlineColor で描く
+// 範囲の外は暗くした元画像のまま、重なった範囲は後の範囲のタイルを描く
+func TestDebugOverlayRegions(t *testing.T) {
+	src := testImage(40, 30)
+	regions := []Region{
+		{Rect: image.Rect(4, 4, 20, 40), TileWidth: 6, TileHeight: 6},
+		{Rect: image.Rect(16, 0, 36, 12)},
+	}
+	origin := image.Pt(1, 2)
+	output := image.NewNRGBA(src.Rect)
+	copy(output.Pix, src.Pix)
+	if err := ProcessRegions(context.Background(), output, 8, 8, regions, WithGridOrigin(origin)); err != nil {
+		t.Fatal(err)
+	}
+	overlay := DebugOverlayRegions(src, output, 8, 8, regions, origin, true)
+
+	clipped := []image.Rectangle{image.Rect(4, 4, 20, 30), image.Rect(16, 0, 36, 12)}
+	grids := []Grid{NewGrid(clipped[0], 6, 6, origin), NewGrid(clipped[1], 8, 8, origin)}
+	for y := src.Rect.Min.Y; y < src.Rect.Max.Y; y++ {
+		for x := src.Rect.Min.X; x < src.Rect.Max.X; x++ {
+			want := overlayPixel(src.NRGBAAt(x, y), color.NRGBA{}, false)
+			for i := range grids {
+				if cell, ok := grids[i].CellAt(x, y); ok {
+					want = GridColor
+					if !onCellEdge(cell.Rect, x, y) {
+						want = overlayPixel(src.NRGBAAt(x, y), output.NRGBAAt(cell.Rect.Min.X, cell.Rect.Min.Y), true)
+					}
+				}
+			}
+			for _, r := range clipped {
+				if (image.Point{x, y}).In(r) && onCellEdge(r, x, y) {
+					want = OutlineColor
+				}
+			}
+			if got := overlay.NRGBAAt(x, y); got != want {
+				t.Fatalf("pixel (%d,%d) = %v, want %v", x, y, got, want)
+			}
+		}
+	}
+}
+
+// 選んだ画素のうち、選ばなかった画素か画像の外と接する画素だけに輪郭を描く
+func TestStrokeSelection(t *testing.T) {
+	dst := image.NewNRGBA(image.Rect(0, 0, 10, 10))
+	// 右上の範囲は画像の外にはみ出し、L 字のマスクは範囲と離れている
+	mask := image.NewAlpha(dst.Rect)
+	for _, p := range []image.Point{{1, 6}, {1, 7}, {1, 8}, {2, 8}, {3, 8}} {
+		mask.SetAlpha(p.X, p.Y, color.Alpha{255})
+	}
+	StrokeSelection(dst, Union(Rects(image.Rect(2, 1, 6, 5), image.Rect(7, -2, 12, 3)), MaskSelection(mask)), OutlineColor)
+
+	outline := map[image.Point]bool{}
+	for _, r := range []image.Rectangle{image.Rect(2, 1, 6, 5), image.Rect(7, 0, 10, 3)} {
+		for y := r.Min.Y; y < r.Max.Y; y++ {
+			for x := r.Min.X; x < r.Max.X; x++ {
+				outline[image.Pt(x, y)] = onCellEdge(r, x, y)
+			}
+		}
+	}
+	for _, p := range []image.Point{{1, 6}, {1, 7}, {1, 8}, {2, 8}, {3, 8}} {
+		outline[p] = true
+	}
+	for y := 0; y < 10; y++ {
+		for x := 0; x < 10; x++ {
+			want := color.NRGBA{}
+			if outline[image.Pt(x, y)] {
+				want = OutlineColor
+			}
+			if got := dst.NRGBAAt(x, y); got != want {
+				t.Errorf("pixel (%d,%d) = %v, want %v", x, y, got, want)
+			}
+		}
+	}
+}
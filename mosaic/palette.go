@@ -0,0 +1,179 @@
+package mosaic
+
+import (
+	_ "embed"
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"slices"
+	"strings"
+
+	"github.com/yashikota/go-streaming-image-mosaic/colorspace"
+)
+
+// パレットの色のうち、指定した色に最も近い色を探す
+// 色の近さは CIELAB のユークリッド距離 (ΔE*ab) で比べ、距離が等しい場合はパレットの先の色を選ぶ
+// 生成後は読み取るだけなので、複数のゴルーチンから同時に使える
+type PaletteMatcher struct {
+	colors []color.NRGBA
+	labs   []colorspace.Lab
+}
+
+func NewPaletteMatcher(palette []color.NRGBA) *PaletteMatcher {
+	m := &PaletteMatcher{colors: append([]color.NRGBA(nil), palette...), labs: make([]colorspace.Lab, len(palette))}
+	for i, p := range palette {
+		m.labs[i] = colorspace.SRGBToLab(p.R, p.G, p.B)
+	}
+	return m
+}
+
+// c に最も近いパレットの色の添字 (パレットが空の場合は -1)
+// 透明度は比べない
+func (m *PaletteMatcher) Nearest(c color.NRGBA) int {
+	return m.NearestFunc(c, nil)
+}
+
+// c に最も近いパレットの色のうち、skip が true を返さない色の添字 (該当する色がない場合は -1)
+// skip が nil の場合は Nearest と同じ
+func (m *PaletteMatcher) NearestFunc(c color.NRGBA, skip func(i int) bool) int {
+	lab := colorspace.SRGBToLab(c.R, c.G, c.B)
+	best, bestDist := -1, 0.0
+	for i, p := range m.labs {
+		if skip != nil && skip(i) {
+			continue
+		}
+		dl, da, db := lab.L-p.L, lab.A-p.A, lab.B-p.B
+		if d := dl*dl + da*da + db*db; best < 0 || d < bestDist {
+			best, bestDist = i, d
+		}
+	}
+	return best
+}
+
+// 添字 i のパレットの色
+func (m *PaletteMatcher) Color(i int) color.NRGBA {
+	return m.colors[i]
+}
+
+// c と添字 i のパレットの色の CIELAB のユークリッド距離 (ΔE*ab)
+func (m *PaletteMatcher) Distance(c color.NRGBA, i int) float64 {
+	lab, p := colorspace.SRGBToLab(c.R, c.G, c.B), m.labs[i]
+	dl, da, db := lab.L-p.L, lab.A-p.A, lab.B-p.B
+	return math.Sqrt(dl*dl + da*da + db*db)
+}
+
+// タイルの色をパレットの最も近い色 (PaletteMatcher で探す) に置き換える ColorAdjust
+// 透明度はそのまま残す
+func PaletteAdjust(palette []color.NRGBA) ColorAdjust {
+	m := NewPaletteMatcher(palette)
+	return ColorAdjustFunc(func(c color.NRGBA) color.NRGBA {
+		i := m.Nearest(c)
+		if i < 0 {
+			return c
+		}
+		p := m.colors[i]
+		return color.NRGBA{R: p.R, G: p.G, B: p.B, A: c.A}
+	})
+}
+
+//go:embed palettes.txt
+var paletteData string
+
+//go:embed legopalette.txt
+var legoPaletteData string
+
+// 名前で選べる組み込みのパレット
+type Palette struct {
+	Name        string
+	Description string
+	Colors      []color.NRGBA
+}
+
+// 組み込みのパレット (palettes.txt、legopalette.txt の順)
+var builtinPalettes = append(parsePalettes(paletteData), parsePalettes(legoPaletteData)...)
+
+// レゴの現行の単色のパレット
+// PaletteAdjust に渡すと、タイルの色をレゴのブロックの色に合わせられる
+var LegoPalette = mustPalette("lego").Colors
+
+// 組み込みのパレットの一覧
+// Colors は組み込みのパレットと共有するため、書き換えてはならない
+func Palettes() []Palette {
+	return slices.Clone(builtinPalettes)
+}
+
+// 組み込みのパレットの名前の一覧
+func PaletteNames() []string {
+	names := make([]string, len(builtinPalettes))
+	for i, p := range builtinPalettes {
+		names[i] = p.Name
+	}
+	return names
+}
+
+// 名前の組み込みのパレット (知らない名前の場合は false を返却)
+// Colors は組み込みのパレットと共有するため、書き換えてはならない
+func PaletteByName(name string) (Palette, bool) {
+	for _, p := range builtinPalettes {
+		if p.Name == name {
+			return p, true
+		}
+	}
+	return Palette{}, false
+}
+
+// パレットの見本の画像
+// 上に名前を描き、その下に 1 辺 swatch px の色の四角を横に並べ、四角の中央に色の 16 進数のコードを描く (収まらない場合は描かない)
+func (p Palette) Preview(swatch int) *image.NRGBA {
+	swatch = max(1, swatch)
+	scale := max(1, swatch/32)
+	header := (glyphHeight + 4) * scale
+	width := max(1, len(p.Colors)) * swatch
+	img := image.NewNRGBA(image.Rect(0, 0, width, header+swatch))
+	FlatRenderer{}.Render(img, img.Rect, color.NRGBA{255, 255, 255, 255})
+	if name := strings.ToUpper(p.Name); textWidth(name)*scale+2 <= width {
+		drawText(img, image.Rect(0, 0, width, header), name, scale, color.NRGBA{0, 0, 0, 255})
+	}
+	for i, c := range p.Colors {
+		LabelRenderer{}.Render(img, image.Rect(i*swatch, header, (i+1)*swatch, header+swatch), c)
+	}
+	return img
+}
+
+func mustPalette(name string) Palette {
+	p, ok := PaletteByName(name)
+	if !ok {
+		panic("mosaic: missing builtin palette " + name)
+	}
+	return p
+}
+
+// "=名前 説明" の行で始まるパレットを並べたファイルを解析
+// 各行は色の名前 (省略できる) と #RRGGBB で、"# " で始まる行は注釈
+// 埋め込んだファイルの誤りはプログラムの誤りのため、panic する
+func parsePalettes(data string) []Palette {
+	var palettes []Palette
+	for _, line := range strings.Split(data, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "# ") {
+			continue
+		}
+		if header, ok := strings.CutPrefix(line, "="); ok {
+			name, description, _ := strings.Cut(header, " ")
+			palettes = append(palettes, Palette{Name: name, Description: strings.TrimSpace(description)})
+			continue
+		}
+		i := strings.LastIndexByte(line, '#')
+		var r, g, b uint8
+		if i < 0 || len(palettes) == 0 {
+			panic(fmt.Sprintf("mosaic: invalid palette line %q", line))
+		}
+		if _, err := fmt.Sscanf(line[i+1:], "%02x%02x%02x", &r, &g, &b); err != nil {
+			panic(fmt.Sprintf("mosaic: invalid palette line %q", line))
+		}
+		p := &palettes[len(palettes)-1]
+		p.Colors = append(p.Colors, color.NRGBA{R: r, G: g, B: b, A: 255})
+	}
+	return palettes
+}
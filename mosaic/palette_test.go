@@ -0,0 +1,139 @@
+package mosaic
+
+import (
+	"image"
+	"image/color"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestBuiltinPalettes(t *testing.T) {
+	want := map[string]int{"grayscale": 16, "viridis": 10, "okabe-ito": 8, "tol-bright": 7, "lego": 44}
+	if names := PaletteNames(); len(names) != len(want) {
+		t.Fatalf("names %v", names)
+	}
+	for name, n := range want {
+		p, ok := PaletteByName(name)
+		if !ok {
+			t.Fatalf("palette %q is missing", name)
+		}
+		if p.Name != name || p.Description == "" || len(p.Colors) != n {
+			t.Errorf("%s: name %q, %d colors, description %q, want %d colors", name, p.Name, len(p.Colors), p.Description, n)
+		}
+		for i, c := range p.Colors {
+			if c.A != 255 {
+				t.Errorf("%s: color %d is not opaque", name, i)
+			}
+		}
+	}
+	if _, ok := PaletteByName("Viridis"); ok {
+		t.Error("names are case-insensitive")
+	}
+	if !slices.Equal(LegoPalette, mustPalette("lego").Colors) {
+		t.Error("LegoPalette differs from the lego palette")
+	}
+}
+
+// 順序のあるパレットは、暗い灰色から明るい灰色へ順に、暗い色から明るい色へ順に置き換える
+func TestPaletteGrayRamp(t *testing.T) {
+	for _, name := range []string{"grayscale", "viridis"} {
+		p, _ := PaletteByName(name)
+		m := NewPaletteMatcher(p.Colors)
+		prev := 0
+		seen := map[int]bool{}
+		for v := 0; v < 256; v++ {
+			i := m.Nearest(color.NRGBA{uint8(v), uint8(v), uint8(v), 255})
+			if i < prev {
+				t.Fatalf("%s: gray %d maps to color %d after %d", name, v, i, prev)
+			}
+			prev = i
+			seen[i] = true
+		}
+		// 彩度の高い色は灰色から遠いため、灰色のパレットだけがすべての段階を使う
+		if name == "grayscale" && len(seen) != len(p.Colors) {
+			t.Errorf("%s: the gray ramp uses %d of %d colors", name, len(seen), len(p.Colors))
+		}
+	}
+	// 灰色のパレットは灰色をそのまま段階に丸める
+	adjust := PaletteAdjust(mustPalette("grayscale").Colors)
+	for _, v := range []uint8{0, 0x11, 0x16, 0x80, 0xff} {
+		c := adjust.Adjust(color.NRGBA{v, v, v, 100})
+		if w := uint8((int(v) + 8) / 17 * 17); c != (color.NRGBA{w, w, w, 100}) {
+			t.Errorf("gray %#x maps to %v, want %#x", v, c, w)
+		}
+	}
+}
+
+func TestParsePalettes(t *testing.T) {
+	got := parsePalettes("# 注釈\n=a 最初 の パレット\n赤 #ff0000\n#00FF00\n\n=b\n#0000ff\n")
+	if len(got) != 2 || got[0].Name != "a" || got[0].Description != "最初 の パレット" || got[1].Name != "b" || got[1].Description != "" {
+		t.Fatalf("parsed %+v", got)
+	}
+	if !slices.Equal(got[0].Colors, []color.NRGBA{{255, 0, 0, 255}, {0, 255, 0, 255}}) || !slices.Equal(got[1].Colors, []color.NRGBA{{0, 0, 255, 255}}) {
+		t.Errorf("colors %v, %v", got[0].Colors, got[1].Colors)
+	}
+	for _, data := range []string{"#ff0000\n", "=a\nred\n", "=a\n#ff00\n", "=a\n#gg0000\n"} {
+		func() {
+			defer func() {
+				if r := recover(); r == nil || !strings.Contains(r.(string), "invalid palette line") {
+					t.Errorf("%q: recovered %v", data, r)
+				}
+			}()
+			parsePalettes(data)
+		}()
+	}
+}
+
+func TestPalettePreview(t *testing.T) {
+	p := mustPalette("okabe-ito")
+	img := p.Preview(40)
+	header := glyphHeight + 4
+	if img.Rect != image.Rect(0, 0, 8*40, header+40) {
+		t.Fatalf("preview %v", img.Rect)
+	}
+	for i, c := range p.Colors {
+		// 四角の隅は色そのもの
+		for _, pt := range []image.Point{{i * 40, header}, {i*40 + 39, header + 39}} {
+			if got := img.NRGBAAt(pt.X, pt.Y); got != c {
+				t.Errorf("swatch %d at %v = %v, want %v", i, pt, got, c)
+			}
+		}
+	}
+	// 名前を上に描く
+	dark := 0
+	for y := 0; y < header; y++ {
+		for x := 0; x < img.Rect.Dx(); x++ {
+			if img.NRGBAAt(x, y).R == 0 {
+				dark++
+			}
+		}
+	}
+	if dark == 0 {
+		t.Error("the name is not drawn")
+	}
+	// 大きな四角では文字も大きくし (32 px ごとに 1 倍)、小さな四角でも画像を作る
+	if big := p.Preview(128); big.Rect.Dy() != 4*header+128 {
+		t.Errorf("preview(128) %v", big.Rect)
+	}
+	if small := p.Preview(0); small.Rect != image.Rect(0, 0, 8, header+1) {
+		t.Errorf("preview(0) %v", small.Rect)
+	}
+}
+
+func TestPaletteOptionValidate(t *testing.T) {
+	for _, tt := range []struct {
+		o    Options
+		want string
+	}{
+		{Options{Tile: 8, Palette: "viridis"}, ""},
+		{Options{Tile: 8, Palette: "lego", LegoPalette: true}, ""},
+		{Options{Tile: 8, Palette: "magma"}, "unknown palette"},
+		{Options{Tile: 8, Palette: "viridis", LegoPalette: true}, "cannot be combined"},
+	} {
+		err := tt.o.Validate()
+		if tt.want == "" && err != nil || tt.want != "" && (err == nil || !strings.Contains(err.Error(), tt.want)) {
+			t.Errorf("%+v: %v, want %q", tt.o, err, tt.want)
+		}
+	}
+}
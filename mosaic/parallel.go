@@ -0,0 +1,66 @@
+package mosaic
+
+import (
+	"image"
+	"sync"
+)
+
+// 処理に使うゴルーチンの数を設定
+// バンドの数が十分にある画像ではバンド単位で、横長でバンドが少ない画像ではバンド内のタイルの列単位で分担する
+// どちらの場合も結果は 1 つのゴルーチンで処理した場合と同じになる
+// 2 以上を指定すると、Stage や TileColorFunc などは複数のゴルーチンから同時に呼び出される
+func WithWorkers(n int) Option {
+	return func(mp *Processor) {
+		mp.workers = n
+	}
+}
+
+// 画像の形から、同時に処理するバンドの数とバンドを列方向に分割する数を決める
+func (mp *Processor) split(bands int) (bandWorkers, columnWorkers int) {
+	workers := max(1, mp.workers)
+	columns := mp.Grid().Columns
+	switch {
+	case workers == 1:
+		return 1, 1
+	case mp.margin > 0:
+		// 余白を持つ Stage は横の画素も参照するため、同じバンドの別の列を同時に書き換えない
+		return max(1, min(workers, bands)), 1
+	case bands >= workers:
+		return workers, 1
+	default:
+		// バンドが少ないため、バンド内のタイルの列を分担する
+		return 1, min(workers, columns)
+	}
+}
+
+// バンドをタイルの列の境界で workers 個に分割し、並列に処理する
+// 各ゴルーチンはバッファの重ならない範囲だけを書き換える
+func (mp *Processor) applyColumns(buffer *image.NRGBA, rect image.Rectangle, workers int) error {
+	grid := mp.Grid()
+	left := grid.start().X
+	per := (grid.Columns + workers - 1) / workers
+	errs := make([]error, workers)
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		chunk := rect
+		chunk.Min.X = max(rect.Min.X, left+i*per*mp.mosaicWidth)
+		chunk.Max.X = min(rect.Max.X, left+(i+1)*per*mp.mosaicWidth)
+		if chunk.Empty() {
+			break
+		}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = mp.pipeline.Apply(buffer, chunk)
+		}(i)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
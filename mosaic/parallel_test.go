@@ -0,0 +1,87 @@
+package mosaic
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"math/rand/v2"
+	"testing"
+)
+
+// 大きさとタイルを乱数で決めた横長の画像 (バンドが少なく、列方向に分担する)
+func randomPanorama(rng *rand.Rand) (*image.NRGBA, int) {
+	w, h := 300+rng.IntN(1700), 10+rng.IntN(70)
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for i := range img.Pix {
+		img.Pix[i] = uint8(rng.Uint32())
+	}
+	return img, 3 + rng.IntN(38)
+}
+
+func TestParallelMatchesSerial(t *testing.T) {
+	rng := rand.New(rand.NewPCG(1, 2))
+	for i := 0; i < 20; i++ {
+		img, tile := randomPanorama(rng)
+		var opts []Option
+		if i%2 == 1 {
+			opts = append(opts, WithHueShift(float64(rng.IntN(360))), WithGridOrigin(image.Pt(rng.IntN(tile), rng.IntN(tile))))
+		}
+		want := process(t, img, tile, append(opts, WithWorkers(1))...)
+		for _, workers := range []int{2, 3, 8, 64} {
+			got := process(t, img, tile, append(opts, WithWorkers(workers))...)
+			if got.Rect != want.Rect || !bytes.Equal(got.Pix, want.Pix) {
+				t.Fatalf("%v tile %d, %d workers: output differs from 1 worker", img.Rect.Size(), tile, workers)
+			}
+			// 元画像に書き戻す場合も同じ
+			work := image.NewNRGBA(img.Rect)
+			copy(work.Pix, img.Pix)
+			if _, err := New(work, tile, tile, append(opts, WithWorkers(workers))...).ProcessInPlace(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(work.Pix, want.Pix) {
+				t.Fatalf("%v tile %d, %d workers: ProcessInPlace differs from 1 worker", img.Rect.Size(), tile, workers)
+			}
+		}
+	}
+}
+
+func TestParallelTallImageMatchesSerial(t *testing.T) {
+	// バンドが多く、バンド単位で分担する
+	img := testImage(37, 503)
+	for _, tile := range []int{1, 5, 16} {
+		want := process(t, img, tile, WithWorkers(1))
+		for _, workers := range []int{2, 7} {
+			if got := process(t, img, tile, WithWorkers(workers)); !bytes.Equal(got.Pix, want.Pix) {
+				t.Errorf("tile %d, %d workers: output differs from 1 worker", tile, workers)
+			}
+		}
+	}
+}
+
+func TestSplit(t *testing.T) {
+	img := testImage(100, 40)
+	tests := []struct {
+		workers, bands int
+		margin         bool
+		band, column   int
+	}{
+		{0, 5, false, 1, 1},
+		{1, 5, false, 1, 1},
+		{4, 5, false, 4, 1},
+		{4, 2, false, 1, 4},
+		// 列は 10 個しかない
+		{16, 2, false, 1, 10},
+		{4, 2, true, 2, 1},
+		{4, 0, true, 1, 1},
+	}
+	for _, tt := range tests {
+		opts := []Option{WithWorkers(tt.workers)}
+		if tt.margin {
+			opts = append(opts, WithPipeline(NewPipeline(verticalBlur(1))))
+		}
+		band, column := New(img, 10, 10, opts...).split(tt.bands)
+		if band != tt.band || column != tt.column {
+			t.Errorf("%d workers, %d bands, margin %v: split = %d, %d, want %d, %d", tt.workers, tt.bands, tt.margin, band, column, tt.band, tt.column)
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package mosaic
+
+// タイルの格子上の位置 (左から x 番目、上から y 番目) から、タイルを処理するかどうかを決める関数
+// 並列処理では複数のゴルーチンから同時に呼び出される
+type TilePattern func(x, y int) bool
+
+// 処理するタイルを決める関数を設定
+// fn が false を返したタイルは書き換えず、元画像の画素のまま残す
+// 指定しない場合はすべてのタイルを処理する
+func WithTilePattern(fn TilePattern) Option {
+	return func(mp *Processor) {
+		mp.pattern = fn
+	}
+}
+
+// 市松模様に、x+y が偶数のタイルだけを処理する TilePattern
+func CheckerPattern(x, y int) bool {
+	return (x+y)&1 == 0
+}
+
+// 横縞に、偶数行のタイルだけを処理する TilePattern
+func StripesHPattern(x, y int) bool {
+	return y&1 == 0
+}
+
+// 縦縞に、偶数列のタイルだけを処理する TilePattern
+func StripesVPattern(x, y int) bool {
+	return x&1 == 0
+}
+
+// 名前で選べる TilePattern (none はすべてのタイルを処理する nil)
+var tilePatterns = map[string]TilePattern{
+	"none":      nil,
+	"checker":   CheckerPattern,
+	"stripes-h": StripesHPattern,
+	"stripes-v": StripesVPattern,
+}
+
+// none、checker、stripes-h または stripes-v の名前の TilePattern
+// none の場合は nil、知らない名前の場合は false を返却
+func PatternByName(name string) (TilePattern, bool) {
+	fn, ok := tilePatterns[name]
+	return fn, ok
+}
+
+// fn が処理しないタイルだけを処理する TilePattern
+func InvertPattern(fn TilePattern) TilePattern {
+	return func(x, y int) bool {
+		return !fn(x, y)
+	}
+}
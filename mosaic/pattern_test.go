@@ -0,0 +1,79 @@
+package mosaic
+
+import (
+	"image"
+	"testing"
+)
+
+// out のタイルを、モザイク処理した画像 mosaic と同じタイルと元画像 src と同じタイルに分けて数える
+// どちらとも一致しないタイルがあればテストを止める
+func countPatternTiles(t *testing.T, out, src, mosaic *image.NRGBA, tile int) (processed, kept map[image.Point]bool) {
+	t.Helper()
+	processed, kept = map[image.Point]bool{}, map[image.Point]bool{}
+	b := src.Rect
+	for ty := 0; ty*tile < b.Dy(); ty++ {
+		for tx := 0; tx*tile < b.Dx(); tx++ {
+			r := image.Rect(tx*tile, ty*tile, (tx+1)*tile, (ty+1)*tile).Intersect(b)
+			switch {
+			case sameRect(out, mosaic, r):
+				processed[image.Pt(tx, ty)] = true
+			case sameRect(out, src, r):
+				kept[image.Pt(tx, ty)] = true
+			default:
+				t.Fatalf("tile (%d, %d) is neither processed nor kept", tx, ty)
+			}
+		}
+	}
+	return processed, kept
+}
+
+// a と b の r の範囲の画素が同じかどうか
+func sameRect(a, b *image.NRGBA, r image.Rectangle) bool {
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			if a.NRGBAAt(x, y) != b.NRGBAAt(x, y) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func TestTilePatterns(t *testing.T) {
+	// 8px のタイルが 7×5 並び、右端と下端のタイルは小さい
+	src := testImage(50, 37)
+	full := process(t, src, 8)
+	tests := []struct {
+		name      string
+		pattern   TilePattern
+		processed int
+		want      func(x, y int) bool
+	}{
+		{"checker", CheckerPattern, 18, func(x, y int) bool { return (x+y)%2 == 0 }},
+		{"stripes-h", StripesHPattern, 21, func(x, y int) bool { return y%2 == 0 }},
+		{"stripes-v", StripesVPattern, 20, func(x, y int) bool { return x%2 == 0 }},
+		{"checker inverted", InvertPattern(CheckerPattern), 17, func(x, y int) bool { return (x+y)%2 == 1 }},
+		{"stripes-h inverted", InvertPattern(StripesHPattern), 14, func(x, y int) bool { return y%2 == 1 }},
+	}
+	for _, tt := range tests {
+		out := process(t, src, 8, WithTilePattern(tt.pattern))
+		processed, kept := countPatternTiles(t, out, src, full, 8)
+		if len(processed) != tt.processed || len(kept) != 35-tt.processed {
+			t.Errorf("%s: %d processed and %d kept tiles, want %d and %d", tt.name, len(processed), len(kept), tt.processed, 35-tt.processed)
+		}
+		for p := range processed {
+			if !tt.want(p.X, p.Y) {
+				t.Errorf("%s: tile %v was processed", tt.name, p)
+			}
+		}
+	}
+
+	for _, name := range []string{"none", "checker", "stripes-h", "stripes-v"} {
+		if fn, ok := PatternByName(name); !ok || (fn == nil) != (name == "none") {
+			t.Errorf("PatternByName(%q) = %v, %v", name, fn != nil, ok)
+		}
+	}
+	if _, ok := PatternByName("zigzag"); ok {
+		t.Error("unknown pattern accepted")
+	}
+}
@@ -0,0 +1,113 @@
+package mosaic
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+)
+
+// 写真の中央の正方形の範囲
+func centerSquare(r image.Rectangle) image.Rectangle {
+	side := min(r.Dx(), r.Dy())
+	x := r.Min.X + (r.Dx()-side)/2
+	y := r.Min.Y + (r.Dy()-side)/2
+	return image.Rect(x, y, x+side, y+side)
+}
+
+// フォトモザイクの素材の写真をタイルに使うときの平均色
+// Thumbnail と同じく、中央の正方形の範囲の平均を取る
+func PhotoColor(img image.Image) color.NRGBA {
+	src := ConvertToNRGBA(img)
+	return boxColor(src, centerSquare(src.Rect))
+}
+
+// 写真の中央の正方形を切り出し、size×size に縮小した画像
+// 縮小後の 1 画素は対応する範囲の画素の平均で、写真が size より小さい場合は拡大する
+func Thumbnail(img image.Image, size int) *image.NRGBA {
+	src := ConvertToNRGBA(img)
+	sq := centerSquare(src.Rect)
+	dst := image.NewNRGBA(image.Rect(0, 0, size, size))
+	if sq.Empty() {
+		return dst
+	}
+	side := sq.Dx()
+	for y := 0; y < size; y++ {
+		y0 := sq.Min.Y + y*side/size
+		y1 := max(sq.Min.Y+(y+1)*side/size, y0+1)
+		for x := 0; x < size; x++ {
+			x0 := sq.Min.X + x*side/size
+			x1 := max(sq.Min.X+(x+1)*side/size, x0+1)
+			dst.SetNRGBA(x, y, boxColor(src, image.Rect(x0, y0, x1, y1)))
+		}
+	}
+	return dst
+}
+
+// rect の画素の平均色 (averageColorAlpha と同じ計算で、範囲が空の場合は不透明な黒)
+func boxColor(img *image.NRGBA, rect image.Rectangle) color.NRGBA {
+	var s colorSum
+	s.addRect(img, rect)
+	return s.color(RoundHalfUp)
+}
+
+// 格子のタイルごとに、平均色が最も近い写真を選ぶ
+// colors は写真の平均色 (PhotoColor) で、戻り値はタイルごと (行優先) の colors の添字と、
+// 条件を満たす写真がなく、近くに同じ写真を置いたタイルの数
+// 色の近さは PaletteMatcher と同じく CIELAB の距離で比べる
+// radius が正の場合、同じ写真を縦横に radius タイル以内 (斜めを含む) に置かない
+// タイルは行優先の順に選ぶため、結果は colors の順と格子だけで決まる
+func MatchPhotos(grid *ColorGrid, colors []color.NRGBA, radius int) ([]int, int) {
+	m := NewPaletteMatcher(colors)
+	assign := make([]int, grid.Columns*grid.Rows)
+	// 近くのタイルで使った写真に、いま選んでいるタイルの番号の印を付ける
+	marks := make([]int, len(colors))
+	for i := range marks {
+		marks[i] = -1
+	}
+	repeats := 0
+	for y := 0; y < grid.Rows; y++ {
+		for x := 0; x < grid.Columns; x++ {
+			n := y*grid.Columns + x
+			c := grid.At(x, y)
+			if radius <= 0 {
+				assign[n] = m.Nearest(c)
+				continue
+			}
+			// 選び終えたタイル (上の行と、同じ行の左) だけを調べる
+			for ny := max(0, y-radius); ny <= y; ny++ {
+				for nx := max(0, x-radius); nx <= min(grid.Columns-1, x+radius); nx++ {
+					if ny == y && nx >= x {
+						break
+					}
+					if i := assign[ny*grid.Columns+nx]; i >= 0 {
+						marks[i] = n
+					}
+				}
+			}
+			i := m.NearestFunc(c, func(i int) bool { return marks[i] == n })
+			if i < 0 && len(colors) > 0 {
+				i = m.Nearest(c)
+				repeats++
+			}
+			assign[n] = i
+		}
+	}
+	return assign, repeats
+}
+
+// MatchPhotos で選んだ写真を格子のタイルに描く
+// thumb は写真の添字から grid.Tile×grid.Tile の縮小画像 (Thumbnail) を返す関数
+// 画像の端のタイルは dst の範囲で切り詰め、写真を選べなかったタイル (添字が負) はそのまま残す
+func DrawPhotos(dst *image.NRGBA, grid *ColorGrid, assign []int, thumb func(i int) *image.NRGBA) {
+	for y := 0; y < grid.Rows; y++ {
+		for x := 0; x < grid.Columns; x++ {
+			i := assign[y*grid.Columns+x]
+			if i < 0 {
+				continue
+			}
+			tile := grid.TileRect(x, y)
+			r := tile.Intersect(dst.Rect)
+			draw.Draw(dst, r, thumb(i), r.Min.Sub(tile.Min), draw.Src)
+		}
+	}
+}
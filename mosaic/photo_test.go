@@ -0,0 +1,123 @@
+package mosaic
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"testing"
+)
+
+// 左半分が赤、右上が青、右下が白で、tile px のタイルが 6×4 並ぶ画像
+func photoTestImage(tile int) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, 6*tile, 4*tile))
+	draw.Draw(img, image.Rect(0, 0, 3*tile, 4*tile), image.NewUniform(color.NRGBA{255, 0, 0, 255}), image.Point{}, draw.Src)
+	draw.Draw(img, image.Rect(3*tile, 0, 6*tile, 2*tile), image.NewUniform(color.NRGBA{0, 0, 255, 255}), image.Point{}, draw.Src)
+	draw.Draw(img, image.Rect(3*tile, 2*tile, 6*tile, 4*tile), image.NewUniform(color.NRGBA{255, 255, 255, 255}), image.Point{}, draw.Src)
+	return img
+}
+
+// 明るさの異なる赤、青、白の写真 (それぞれ n 枚)
+func photoLibrary(n int) []color.NRGBA {
+	var colors []color.NRGBA
+	for _, base := range []color.NRGBA{{255, 0, 0, 255}, {0, 0, 255, 255}, {255, 255, 255, 255}} {
+		for i := 0; i < n; i++ {
+			// 0 の成分はそのまま、255 の成分を 8 ずつ暗くする
+			d := uint8(i * 8)
+			dark := func(v uint8) uint8 { return v - v/255*d }
+			colors = append(colors, color.NRGBA{dark(base.R), dark(base.G), dark(base.B), 255})
+		}
+	}
+	return colors
+}
+
+// radius タイル以内に同じ写真を置いたタイルの組の数
+func nearbyRepeats(grid *ColorGrid, assign []int, radius int) int {
+	n := 0
+	for y := 0; y < grid.Rows; y++ {
+		for x := 0; x < grid.Columns; x++ {
+			for dy := 0; dy <= radius; dy++ {
+				for dx := -radius; dx <= radius; dx++ {
+					nx, ny := x+dx, y+dy
+					if dy == 0 && dx <= 0 || nx < 0 || nx >= grid.Columns || ny >= grid.Rows {
+						continue
+					}
+					if assign[y*grid.Columns+x] == assign[ny*grid.Columns+nx] {
+						n++
+					}
+				}
+			}
+		}
+	}
+	return n
+}
+
+func TestMatchPhotos(t *testing.T) {
+	grid := NewColorGrid(photoTestImage(4), 4)
+	colors := photoLibrary(9)
+
+	// 制限しない場合は、どのタイルも色が同じ写真を選ぶ
+	assign, repeats := MatchPhotos(grid, colors, 0)
+	counts := map[int]int{}
+	for _, i := range assign {
+		counts[i]++
+	}
+	if want := map[int]int{0: 12, 9: 6, 18: 6}; repeats != 0 || len(counts) != len(want) || counts[0] != want[0] || counts[9] != want[9] || counts[18] != want[18] {
+		t.Errorf("radius 0: counts %v (%d repeats), want %v", counts, repeats, want)
+	}
+
+	for _, radius := range []int{1, 2} {
+		assign, repeats := MatchPhotos(grid, colors, radius)
+		if repeats != 0 {
+			t.Errorf("radius %d: %d repeats with %d photos", radius, repeats, len(colors))
+		}
+		if n := nearbyRepeats(grid, assign, radius); n != 0 {
+			t.Errorf("radius %d: %d pairs of nearby tiles share a photo", radius, n)
+		}
+		// 同じ色の写真が足りるため、どのタイルも同じ色の写真から選ぶ
+		for n, i := range assign {
+			x, y := n%grid.Columns, n/grid.Columns
+			want := 0
+			switch {
+			case x >= 3 && y < 2:
+				want = 1
+			case x >= 3:
+				want = 2
+			}
+			if i < 0 || i/9 != want {
+				t.Errorf("radius %d: tile (%d, %d) got photo %d", radius, x, y, i)
+			}
+		}
+	}
+
+	// 写真が足りない場合も、すべてのタイルに写真を置き、近くに置いた数を返す
+	assign, repeats = MatchPhotos(grid, photoLibrary(1), 1)
+	for n, i := range assign {
+		if i < 0 {
+			t.Errorf("tile %d has no photo", n)
+		}
+	}
+	if repeats == 0 || repeats > len(assign) {
+		t.Errorf("%d repeats with 3 photos", repeats)
+	}
+}
+
+// 写真の平均色と縮小画像は、中央の正方形から求める
+func TestPhotoThumbnail(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(0, 0, 30, 10))
+	draw.Draw(img, img.Rect, image.NewUniform(color.NRGBA{0, 0, 255, 255}), image.Point{}, draw.Src)
+	draw.Draw(img, image.Rect(10, 0, 20, 10), image.NewUniform(color.NRGBA{255, 0, 0, 255}), image.Point{}, draw.Src)
+	if c := PhotoColor(img); c != (color.NRGBA{255, 0, 0, 255}) {
+		t.Errorf("PhotoColor = %v, want red", c)
+	}
+	for _, size := range []int{4, 10, 16} {
+		thumb := Thumbnail(img, size)
+		if thumb.Rect != image.Rect(0, 0, size, size) {
+			t.Fatalf("size %d: bounds %v", size, thumb.Rect)
+		}
+		for i := 0; i < len(thumb.Pix); i += 4 {
+			if c := (color.NRGBA{thumb.Pix[i], thumb.Pix[i+1], thumb.Pix[i+2], thumb.Pix[i+3]}); c != (color.NRGBA{255, 0, 0, 255}) {
+				t.Fatalf("size %d: pixel %d = %v, want red", size, i/4, c)
+			}
+		}
+	}
+}
@@ -0,0 +1,180 @@
+package mosaic
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+)
+
+// 元画像の型ごとの画素の読み方
+// *image.NRGBA のほか *image.RGBA、*image.Gray、*image.YCbCr は、画像全体を NRGBA に変換せずにバンドやタイルの範囲だけを直接読む
+// 画像の型による分岐は newPixelAccess にまとめ、NewImage や TileColor はこれを経由して読む
+type pixelAccess interface {
+	image.Image
+	Opaque() bool
+
+	// rect の画素を NRGBA に変換して dst の同じ位置に書き込む (draw.Draw と同じ値)
+	readNRGBA(dst *image.NRGBA, rect image.Rectangle)
+	// rect の画素の乗算済みの 16 ビット値 (color.Color の RGBA と同じ値) を s に加える
+	// RGBA は NRGBA に変換して乗算し直さないため、透明度の低い画素でも精度を失わない
+	addTo(s *colorSum, rect image.Rectangle)
+}
+
+// img の画素の読み方
+// 対応していない型は、draw.Draw と color.Color の RGBA で 1 画素ずつ読む
+func newPixelAccess(img image.Image) pixelAccess {
+	switch img := img.(type) {
+	case *image.NRGBA:
+		return nrgbaPixels{img}
+	case *image.RGBA:
+		return rgbaPixels{img}
+	case *image.Gray:
+		return grayPixels{img}
+	case *image.YCbCr:
+		return ycbcrPixels{img}
+	}
+	return genericPixels{img}
+}
+
+type nrgbaPixels struct{ *image.NRGBA }
+
+func (p nrgbaPixels) readNRGBA(dst *image.NRGBA, rect image.Rectangle) {
+	draw.Draw(dst, rect, p.NRGBA, rect.Min, draw.Src)
+}
+
+func (p nrgbaPixels) addTo(s *colorSum, rect image.Rectangle) {
+	s.addRect(p.NRGBA, rect)
+}
+
+// 乗算済みの 8 ビット値を持つ画像
+type rgbaPixels struct{ *image.RGBA }
+
+// color.NRGBAModel の変換と同じく、16 ビット値で乗算を戻してから上位 8 ビットにする
+func (p rgbaPixels) readNRGBA(dst *image.NRGBA, rect image.Rectangle) {
+	width := 4 * rect.Dx()
+	for y := rect.Min.Y; y < rect.Max.Y; y++ {
+		i, j := p.PixOffset(rect.Min.X, y), dst.PixOffset(rect.Min.X, y)
+		src, out := p.Pix[i:i+width:i+width], dst.Pix[j:j+width:j+width]
+		for x := 0; x < width; x += 4 {
+			s, d := src[x:x+4:x+4], out[x:x+4:x+4]
+			switch a := uint32(s[3]) * 0x101; a {
+			case 0xffff:
+				copy(d, s)
+			case 0:
+				d[0], d[1], d[2], d[3] = 0, 0, 0, 0
+			default:
+				d[0] = uint8(uint32(s[0]) * 0x101 * 0xffff / a >> 8)
+				d[1] = uint8(uint32(s[1]) * 0x101 * 0xffff / a >> 8)
+				d[2] = uint8(uint32(s[2]) * 0x101 * 0xffff / a >> 8)
+				d[3] = s[3]
+			}
+		}
+	}
+}
+
+func (p rgbaPixels) addTo(s *colorSum, rect image.Rectangle) {
+	width := 4 * rect.Dx()
+	var r, g, b, a uint64
+	for y := rect.Min.Y; y < rect.Max.Y; y++ {
+		i := p.PixOffset(rect.Min.X, y)
+		row := p.Pix[i : i+width : i+width]
+		for x := 0; x < width; x += 4 {
+			px := row[x : x+4 : x+4]
+			r += uint64(px[0])
+			g += uint64(px[1])
+			b += uint64(px[2])
+			a += uint64(px[3])
+		}
+	}
+	s.merge(colorSum{r: r * 0x101, g: g * 0x101, b: b * 0x101, a: a * 0x101, n: uint64(rect.Dx()) * uint64(rect.Dy())})
+}
+
+type grayPixels struct{ *image.Gray }
+
+func (p grayPixels) readNRGBA(dst *image.NRGBA, rect image.Rectangle) {
+	for y := rect.Min.Y; y < rect.Max.Y; y++ {
+		i, j := p.PixOffset(rect.Min.X, y), dst.PixOffset(rect.Min.X, y)
+		src, out := p.Pix[i:i+rect.Dx():i+rect.Dx()], dst.Pix[j:j+4*rect.Dx():j+4*rect.Dx()]
+		for x, v := range src {
+			d := out[4*x : 4*x+4 : 4*x+4]
+			d[0], d[1], d[2], d[3] = v, v, v, 0xff
+		}
+	}
+}
+
+func (p grayPixels) addTo(s *colorSum, rect image.Rectangle) {
+	var v uint64
+	for y := rect.Min.Y; y < rect.Max.Y; y++ {
+		i := p.PixOffset(rect.Min.X, y)
+		for _, g := range p.Pix[i : i+rect.Dx()] {
+			v += uint64(g)
+		}
+	}
+	n := uint64(rect.Dx()) * uint64(rect.Dy())
+	s.merge(colorSum{r: v * 0x101, g: v * 0x101, b: v * 0x101, a: n * 0xffff, n: n})
+}
+
+// 色差を間引いていることがある YCbCr の画像
+type ycbcrPixels struct{ *image.YCbCr }
+
+// (x, y) の画素の 16 ビット値 (color.YCbCr の RGBA と同じ値)
+func (p ycbcrPixels) rgb(x, y int) (r, g, b uint32) {
+	yi, ci := p.YOffset(x, y), p.COffset(x, y)
+	r, g, b, _ = color.YCbCr{Y: p.Y[yi], Cb: p.Cb[ci], Cr: p.Cr[ci]}.RGBA()
+	return r, g, b
+}
+
+func (p ycbcrPixels) readNRGBA(dst *image.NRGBA, rect image.Rectangle) {
+	for y := rect.Min.Y; y < rect.Max.Y; y++ {
+		j := dst.PixOffset(rect.Min.X, y)
+		out := dst.Pix[j : j+4*rect.Dx() : j+4*rect.Dx()]
+		for x := rect.Min.X; x < rect.Max.X; x++ {
+			r, g, b := p.rgb(x, y)
+			d := out[4*(x-rect.Min.X) : 4*(x-rect.Min.X)+4 : 4*(x-rect.Min.X)+4]
+			d[0], d[1], d[2], d[3] = uint8(r>>8), uint8(g>>8), uint8(b>>8), 0xff
+		}
+	}
+}
+
+func (p ycbcrPixels) addTo(s *colorSum, rect image.Rectangle) {
+	var sum colorSum
+	for y := rect.Min.Y; y < rect.Max.Y; y++ {
+		for x := rect.Min.X; x < rect.Max.X; x++ {
+			r, g, b := p.rgb(x, y)
+			sum.r += uint64(r)
+			sum.g += uint64(g)
+			sum.b += uint64(b)
+		}
+	}
+	sum.n = uint64(rect.Dx()) * uint64(rect.Dy())
+	sum.a = sum.n * 0xffff
+	s.merge(sum)
+}
+
+// その他の型の画像
+// Opaque を持たない型は、不透明ではないとみなす
+type genericPixels struct{ image.Image }
+
+func (p genericPixels) Opaque() bool {
+	if o, ok := p.Image.(interface{ Opaque() bool }); ok {
+		return o.Opaque()
+	}
+	return false
+}
+
+func (p genericPixels) readNRGBA(dst *image.NRGBA, rect image.Rectangle) {
+	draw.Draw(dst, rect, p.Image, rect.Min, draw.Src)
+}
+
+func (p genericPixels) addTo(s *colorSum, rect image.Rectangle) {
+	for y := rect.Min.Y; y < rect.Max.Y; y++ {
+		for x := rect.Min.X; x < rect.Max.X; x++ {
+			r, g, b, a := p.At(x, y).RGBA()
+			s.r += uint64(r)
+			s.g += uint64(g)
+			s.b += uint64(b)
+			s.a += uint64(a)
+			s.n++
+		}
+	}
+}
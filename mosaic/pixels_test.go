@@ -0,0 +1,153 @@
+package mosaic
+
+import (
+	"context"
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+	"testing"
+)
+
+// testImage を乗算済みの RGBA にし、透明度を maxAlpha までの値にした画像
+func testRGBA(w, h int, maxAlpha uint8) *image.RGBA {
+	src := testImage(w, h)
+	img := image.NewRGBA(src.Rect)
+	for i := 0; i < len(src.Pix); i += 4 {
+		a := 1 + uint32(src.Pix[i]^src.Pix[i+1])%uint32(maxAlpha)
+		for c := 0; c < 3; c++ {
+			img.Pix[i+c] = uint8(uint32(src.Pix[i+c]) * a / 255)
+		}
+		img.Pix[i+3] = uint8(a)
+	}
+	return img
+}
+
+// NRGBA 以外の元画像の種類
+func testSources() map[string]image.Image {
+	gray := image.NewGray(image.Rect(0, 0, 45, 29))
+	draw.Draw(gray, gray.Rect, testImage(45, 29), image.Point{}, draw.Src)
+	ycbcr := image.NewYCbCr(image.Rect(0, 0, 45, 29), image.YCbCrSubsampleRatio420)
+	for i := range ycbcr.Y {
+		ycbcr.Y[i] = uint8(i * 7)
+	}
+	for i := range ycbcr.Cb {
+		ycbcr.Cb[i], ycbcr.Cr[i] = uint8(i*3), uint8(255-i*5)
+	}
+	return map[string]image.Image{
+		"rgba":  testRGBA(45, 29, 255),
+		"gray":  gray,
+		"ycbcr": ycbcr,
+	}
+}
+
+func TestPixelAccessReadNRGBA(t *testing.T) {
+	for name, img := range testSources() {
+		// draw.Draw で変換した場合と同じ値
+		want := ConvertToNRGBA(img)
+		got := image.NewNRGBA(img.Bounds())
+		rect := image.Rect(3, 5, 40, 21)
+		newPixelAccess(img).readNRGBA(got, rect)
+		for y := rect.Min.Y; y < rect.Max.Y; y++ {
+			for x := rect.Min.X; x < rect.Max.X; x++ {
+				if got.NRGBAAt(x, y) != want.NRGBAAt(x, y) {
+					t.Fatalf("%s: pixel (%d,%d) = %v, want %v", name, x, y, got.NRGBAAt(x, y), want.NRGBAAt(x, y))
+				}
+			}
+		}
+	}
+}
+
+func TestNewImageMatchesConverted(t *testing.T) {
+	for name, img := range testSources() {
+		got, err := NewImage(img, 8, 8).ProcessContext(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := process(t, ConvertToNRGBA(img), 8)
+		for i := range got.Pix {
+			// 変換してから求めた平均との違いは 1 以内
+			if d := int(got.Pix[i]) - int(want.Pix[i]); d < -1 || d > 1 {
+				t.Fatalf("%s: byte %d = %d, want %d", name, i, got.Pix[i], want.Pix[i])
+			}
+		}
+	}
+}
+
+// 透明度の低い RGBA は乗算済みの値から直接求めるため、常に正確な平均を四捨五入した値になる
+// NRGBA に変換してから求めると、乗算を戻して掛け直す間に値が小さくなり、ちょうど中間の平均を切り捨てることがある
+// (平均色は NRGBA の元画像と同じく、乗算済みの値の平均を成分にする)
+func TestNewImageLowAlphaPrecision(t *testing.T) {
+	const tile = 4
+	img := testRGBA(64, 64, 6)
+	native, err := NewImage(img, tile, tile).ProcessContext(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	converted := process(t, ConvertToNRGBA(img), tile)
+
+	convertedOff := 0
+	for y := 0; y < 64; y += tile {
+		for x := 0; x < 64; x += tile {
+			var sum [3]float64
+			for py := y; py < y+tile; py++ {
+				for px := x; px < x+tile; px++ {
+					c := img.RGBAAt(px, py)
+					sum[0], sum[1], sum[2] = sum[0]+float64(c.R), sum[1]+float64(c.G), sum[2]+float64(c.B)
+				}
+			}
+			n, c := native.NRGBAAt(x, y), converted.NRGBAAt(x, y)
+			for i, pair := range [][2]uint8{{n.R, c.R}, {n.G, c.G}, {n.B, c.B}} {
+				want := uint8(math.Floor(sum[i]/(tile*tile) + 0.5))
+				if pair[0] != want {
+					t.Fatalf("tile (%d,%d): native %d, want %d", x, y, pair[0], want)
+				}
+				if pair[1] != want {
+					convertedOff++
+				}
+			}
+		}
+	}
+	// 変換してから求めると精度を失う場合がある (テストが精度の違いを見逃していない)
+	if convertedOff == 0 {
+		t.Error("converting to NRGBA first never lost precision")
+	}
+}
+
+func TestProcessIntoRGBA(t *testing.T) {
+	src := testImage(45, 29)
+	for i := 3; i < len(src.Pix); i += 8 {
+		src.Pix[i] = 128
+	}
+	mp := New(src, 8, 8)
+	want := image.NewRGBA(src.Rect)
+	draw.Draw(want, want.Rect, process(t, src, 8), image.Point{}, draw.Src)
+	got := image.NewRGBA(src.Rect)
+	if err := mp.ProcessInto(context.Background(), got); err != nil {
+		t.Fatal(err)
+	}
+	for i := range got.Pix {
+		if got.Pix[i] != want.Pix[i] {
+			t.Fatalf("byte %d = %d, want %d", i, got.Pix[i], want.Pix[i])
+		}
+	}
+	// RGBA の元画像に書き戻す
+	rgba := testRGBA(45, 29, 255)
+	want = image.NewRGBA(rgba.Rect)
+	out, err := NewImage(rgba, 8, 8).ProcessContext(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	draw.Draw(want, want.Rect, out, image.Point{}, draw.Src)
+	if err := NewImage(rgba, 8, 8).ProcessInto(context.Background(), rgba); err != nil {
+		t.Fatal(err)
+	}
+	for i := range rgba.Pix {
+		if rgba.Pix[i] != want.Pix[i] {
+			t.Fatalf("in place: byte %d = %d, want %d", i, rgba.Pix[i], want.Pix[i])
+		}
+	}
+	if c := color.RGBAModel.Convert(out.At(0, 0)); c != rgba.At(0, 0) {
+		t.Errorf("pixel (0,0) = %v, want %v", rgba.At(0, 0), c)
+	}
+}
@@ -0,0 +1,142 @@
+package mosaic
+
+import (
+	"context"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+// バンドやブロックを読み込むバッファを、処理をまたいで使い回すプール
+// 大きな画像を処理した後もバッファを持ち続けるため、長く動かすサーバーでは RunJanitor で使っていないバッファを捨てる
+// (ライブラリの既定ではプールを使わず、処理のたびにバッファを確保する)
+// 複数の Processor から同時に使ってよい
+type BufferPool struct {
+	now    func() time.Time // 最後に使った時刻を求める関数 (テストでは差し替える)
+	freeOS func()           // 捨てたメモリを OS に返す関数 (debug.FreeOSMemory)
+
+	mu       sync.Mutex
+	free     []pooledBuffer // 使っていないバッファ (返した順)
+	retained int64          // free のバイト数
+	inUse    int64          // 貸し出しているバッファのバイト数
+	high     int64          // retained + inUse の最大値
+	released int64          // 捨てたバッファの累計のバイト数
+}
+
+type pooledBuffer struct {
+	pix  []uint8
+	last time.Time // プールに返した時刻
+}
+
+// プールが持つバッファの統計
+type PoolStats struct {
+	Retained  int64 // 使っていないバッファとして持っているバイト数
+	InUse     int64 // 処理に貸し出しているバッファのバイト数
+	HighWater int64 // Retained + InUse の最大値
+	Released  int64 // 使われないまま捨てたバッファの累計のバイト数
+	Buffers   int   // 使っていないバッファの数
+}
+
+// 空のプールを生成
+func NewBufferPool() *BufferPool {
+	return &BufferPool{now: time.Now, freeOS: debug.FreeOSMemory}
+}
+
+// バンドとブロックのバッファを pool から借り、処理の終わりに返す
+// nil の場合はプールを使わない (既定)
+// WithBufferPool を指定した場合、Bands で受け取ったバンドは Close の後 (io.EOF を受け取った後) に使ってはならない
+func WithBufferPool(pool *BufferPool) Option {
+	return func(mp *Processor) {
+		mp.pool = pool
+	}
+}
+
+// 長さ n の 0 で埋めたバイト列を貸し出す
+// 容量が n 以上 2n 以下のバッファのうち最も小さいものを使い回し、なければ確保する
+func (p *BufferPool) get(n int) []uint8 {
+	p.mu.Lock()
+	best := -1
+	for i, b := range p.free {
+		if c := cap(b.pix); c >= n && c <= 2*n && (best < 0 || c < cap(p.free[best].pix)) {
+			best = i
+		}
+	}
+	var pix []uint8
+	if best >= 0 {
+		pix = p.free[best].pix[:n]
+		p.free = append(p.free[:best], p.free[best+1:]...)
+		p.retained -= int64(cap(pix))
+	}
+	size := int64(n)
+	if pix != nil {
+		size = int64(cap(pix))
+	}
+	p.inUse += size
+	p.high = max(p.high, p.retained+p.inUse)
+	p.mu.Unlock()
+
+	if pix == nil {
+		return make([]uint8, n)
+	}
+	clear(pix)
+	return pix
+}
+
+// get で借りたバイト列を返す
+func (p *BufferPool) put(pix []uint8) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	size := int64(cap(pix))
+	p.inUse -= size
+	p.retained += size
+	p.free = append(p.free, pooledBuffer{pix: pix[:cap(pix)], last: p.now()})
+}
+
+// idle の間使っていないバッファを捨て、捨てたバイト数を返却
+func (p *BufferPool) Release(idle time.Duration) int64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	cutoff := p.now().Add(-idle)
+	var dropped int64
+	kept := p.free[:0]
+	for _, b := range p.free {
+		if b.last.After(cutoff) {
+			kept = append(kept, b)
+			continue
+		}
+		dropped += int64(cap(b.pix))
+	}
+	clear(p.free[len(kept):])
+	p.free = kept
+	p.retained -= dropped
+	p.released += dropped
+	return dropped
+}
+
+// プールの現在の統計
+func (p *BufferPool) Stats() PoolStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return PoolStats{Retained: p.retained, InUse: p.inUse, HighWater: p.high, Released: p.released, Buffers: len(p.free)}
+}
+
+// interval ごとに idle の間使っていないバッファを捨てる (ctx が終わるまで戻らない)
+// freeOS が true の場合は、捨てたバッファがあれば debug.FreeOSMemory でメモリを OS に返す
+func (p *BufferPool) RunJanitor(ctx context.Context, interval, idle time.Duration, freeOS bool) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	p.janitor(ctx, ticker.C, idle, freeOS)
+}
+
+func (p *BufferPool) janitor(ctx context.Context, ticks <-chan time.Time, idle time.Duration, freeOS bool) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticks:
+			if p.Release(idle) > 0 && freeOS {
+				p.freeOS()
+			}
+		}
+	}
+}
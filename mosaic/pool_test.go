@@ -0,0 +1,231 @@
+package mosaic
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+// 進めた分だけ時刻が変わる時計
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	return c.now
+}
+
+func newFakePool() (*BufferPool, *fakeClock) {
+	clock := &fakeClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	pool := NewBufferPool()
+	pool.now = clock.Now
+	return pool, clock
+}
+
+func TestBufferPoolReuse(t *testing.T) {
+	pool, _ := newFakePool()
+	a := pool.get(1000)
+	for i := range a {
+		a[i] = 0xff
+	}
+	pool.put(a)
+	if s := pool.Stats(); s.Retained != 1000 || s.InUse != 0 || s.Buffers != 1 {
+		t.Fatalf("after put: %+v", s)
+	}
+	// 小さいバッファは同じバイト列を 0 で埋めて使い回す
+	b := pool.get(600)
+	if len(b) != 600 || &b[0] != &a[0] {
+		t.Fatalf("get(600) did not reuse the buffer")
+	}
+	for i, v := range b {
+		if v != 0 {
+			t.Fatalf("byte %d = %d, want 0", i, v)
+		}
+	}
+	if s := pool.Stats(); s.Retained != 0 || s.InUse != 1000 {
+		t.Errorf("after reuse: %+v", s)
+	}
+	// 容量が 2 倍を超えるバッファは使わない
+	pool.put(b)
+	if c := pool.get(400); &c[0] == &a[0] {
+		t.Error("get(400) reused a buffer of 1000 bytes")
+	}
+	if s := pool.Stats(); s.Retained != 1000 || s.InUse != 400 || s.HighWater != 1400 {
+		t.Errorf("after a new buffer: %+v", s)
+	}
+	// 最も小さい使えるバッファを使う
+	pool.put(pool.get(3000))
+	if d := pool.get(900); cap(d) != 1000 {
+		t.Errorf("get(900) used a buffer of %d bytes", cap(d))
+	}
+}
+
+func TestBufferPoolRelease(t *testing.T) {
+	pool, clock := newFakePool()
+	old, recent := pool.get(100), pool.get(200)
+	pool.put(old)
+	clock.Advance(30 * time.Second)
+	pool.put(recent)
+
+	clock.Advance(29 * time.Second)
+	if n := pool.Release(time.Minute); n != 0 {
+		t.Errorf("released %d bytes before a minute", n)
+	}
+	// 返してから 1 分たったバッファだけを捨てる
+	clock.Advance(time.Second)
+	if n := pool.Release(time.Minute); n != 100 {
+		t.Errorf("released %d bytes, want 100", n)
+	}
+	if s := pool.Stats(); s.Retained != 200 || s.Buffers != 1 || s.Released != 100 {
+		t.Errorf("after the first release: %+v", s)
+	}
+	// 使い回したバッファは、返し直した時刻から数える
+	clock.Advance(20 * time.Second)
+	pool.put(pool.get(200))
+	clock.Advance(50 * time.Second)
+	if n := pool.Release(time.Minute); n != 0 {
+		t.Errorf("released %d bytes of a recently used buffer", n)
+	}
+	clock.Advance(10 * time.Second)
+	if n := pool.Release(time.Minute); n != 200 {
+		t.Errorf("released %d bytes, want 200", n)
+	}
+	if s := pool.Stats(); s.Retained != 0 || s.Buffers != 0 || s.Released != 300 || s.HighWater != 300 {
+		t.Errorf("after the second release: %+v", s)
+	}
+}
+
+func TestBufferPoolJanitor(t *testing.T) {
+	pool, clock := newFakePool()
+	frees := 0
+	pool.freeOS = func() { frees++ }
+	ticks := make(chan time.Time)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		pool.janitor(ctx, ticks, time.Minute, true)
+	}()
+	// ticks は受け取るまで待つため、次の時刻を送った時点で前の掃除は終わっている
+	tick := func(d time.Duration) PoolStats {
+		ticks <- clock.Advance(d)
+		ticks <- clock.Now()
+		return pool.Stats()
+	}
+
+	pool.put(pool.get(1 << 20))
+	for i := 0; i < 5; i++ {
+		if s := tick(10 * time.Second); s.Buffers != 1 {
+			t.Fatalf("dropped after %ds: %+v", 10*(i+1), s)
+		}
+	}
+	if s := tick(10 * time.Second); s.Buffers != 0 || s.Released != 1<<20 {
+		t.Fatalf("not dropped after a minute: %+v", s)
+	}
+	// 捨てたバッファがない場合は OS に返さない
+	tick(10 * time.Second)
+	cancel()
+	<-done
+	if frees != 1 {
+		t.Errorf("FreeOSMemory called %d times, want 1", frees)
+	}
+
+	pool.put(pool.get(10))
+	clock.Advance(time.Hour)
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	go pool.janitor(ctx, ticks, time.Minute, false)
+	ticks <- clock.Now()
+	ticks <- clock.Now()
+	if s := pool.Stats(); s.Buffers != 0 || frees != 1 {
+		t.Errorf("without freeOS: %+v, %d frees", s, frees)
+	}
+}
+
+// 掃除と同時にバッファを借りて返しても、統計が合う (go test -race で競合がないことも確かめる)
+func TestBufferPoolConcurrent(t *testing.T) {
+	pool := NewBufferPool()
+	pool.freeOS = func() {}
+	ctx, cancel := context.WithCancel(context.Background())
+	janitorDone := make(chan struct{})
+	go func() {
+		defer close(janitorDone)
+		pool.RunJanitor(ctx, time.Millisecond, 0, true)
+	}()
+
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				b := pool.get(64 * (1 + (g+i)%4))
+				b[len(b)-1] = uint8(i)
+				if i%10 == 0 {
+					time.Sleep(100 * time.Microsecond)
+				}
+				pool.put(b)
+			}
+		}(g)
+	}
+	wg.Wait()
+	cancel()
+	<-janitorDone
+
+	s := pool.Stats()
+	var free int64
+	for _, b := range pool.free {
+		free += int64(cap(b.pix))
+	}
+	if s.InUse != 0 || s.Retained != free || s.Buffers != len(pool.free) || s.HighWater < s.Retained {
+		t.Errorf("stats %+v, %d bytes free", s, free)
+	}
+}
+
+func TestProcessWithBufferPool(t *testing.T) {
+	img := testImage(97, 61)
+	want := process(t, img, 8)
+	pool := NewBufferPool()
+	for _, opts := range [][]Option{
+		{WithWorkers(1)},
+		{WithWorkers(3)},
+		{WithPrefetch(2), WithWorkers(2)},
+		{WithBlockSize(32, 16)},
+	} {
+		opts = append(opts, WithBufferPool(pool))
+		for i := 0; i < 2; i++ {
+			assertSameImage(t, process(t, img, 8, opts...), want)
+			// 処理の終わりにすべてのバッファを返す
+			if s := pool.Stats(); s.InUse != 0 || s.Retained == 0 {
+				t.Fatalf("after processing: %+v", s)
+			}
+		}
+	}
+	// 2 回目からは返したバッファを使い回す
+	high := pool.Stats().HighWater
+	process(t, img, 8, WithWorkers(3), WithBufferPool(pool))
+	if s := pool.Stats(); s.HighWater != high {
+		t.Errorf("high water %d, want %d", s.HighWater, high)
+	}
+
+	// 途中で Close した場合もバッファを返す
+	it := New(img, 8, 8, WithPrefetch(1), WithBufferPool(pool)).Bands(context.Background())
+	if _, err := it.Next(); err != nil {
+		t.Fatal(err)
+	}
+	it.Close()
+	if s := pool.Stats(); s.InUse != 0 {
+		t.Errorf("after Close: %+v", s)
+	}
+}
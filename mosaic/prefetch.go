@@ -0,0 +1,112 @@
+package mosaic
+
+import (
+	"image"
+	"sync"
+)
+
+// ProcessBands や Bands でバンドの処理と fn の呼び出し (受け取ったバンドの利用) を重ねる
+// 呼び出し元が fn (エンコードや書き込み) を実行している間に、別のゴルーチンが次の depth 組のバンドを読み込んで処理しておく
+// 1 組は同時に処理するバンド (WithWorkers で決まる数) で、depth+1 組のバッファを使い回す
+// fn は呼び出し元のゴルーチンから上から順に呼び出され、結果はバンドを 1 つずつ処理した場合と同じになる
+// 0 以下の場合は重ねない (既定)
+// ProcessContext や ProcessInto などバンドで処理するメソッドすべてに効き、WithBlockSize のブロックの処理には効かない
+func WithPrefetch(depth int) Option {
+	return func(mp *Processor) {
+		mp.prefetch = depth
+	}
+}
+
+// 同時に処理するバンドの組
+type bandBatch struct {
+	buffers []*image.NRGBA
+	images  []*image.NRGBA // 処理結果を持つ画像 (バッファか、処理しなかったバンドでは元画像)
+	rects   []image.Rectangle
+	errs    []error
+	n       int // 処理したバンドの数
+}
+
+// バンドを処理するゴルーチンを起動し、処理済みの組を ready で受け渡す
+// 呼び出し側が受け取ったバンドを使っている間に、次の prefetch 組を処理しておく
+// 渡し終えた組のバッファは free に戻して使い回す
+func (it *BandIterator) startPrefetch() {
+	mp := it.mp
+	it.free = make(chan *bandBatch, mp.prefetch+1)
+	for i := 0; i < mp.prefetch+1; i++ {
+		b := mp.newBandBatch(it.bandWorkers)
+		it.batches = append(it.batches, b)
+		it.free <- b
+	}
+	it.ready = make(chan *bandBatch, mp.prefetch)
+
+	ctx, total := it.ctx, it.total
+	offset, bandWorkers, columnWorkers, rows := it.offset, it.bandWorkers, it.columnWorkers, it.rows
+	it.wg.Add(1)
+	go func() {
+		defer it.wg.Done()
+		defer close(it.ready)
+		for queued := 0; queued < total; queued += bandWorkers {
+			var b *bandBatch
+			select {
+			case b = <-it.free:
+			case <-ctx.Done():
+				it.producerErr = ctx.Err()
+				return
+			}
+			if err := ctx.Err(); err != nil {
+				it.producerErr = err
+				return
+			}
+
+			b.n = min(bandWorkers, total-queued)
+			mp.processBatch(b, offset, columnWorkers, rows)
+			offset += bandWorkers * mp.mosaicHeight
+
+			select {
+			case it.ready <- b:
+			case <-ctx.Done():
+				it.producerErr = ctx.Err()
+				return
+			}
+			for _, err := range b.errs[:b.n] {
+				if err != nil {
+					// 失敗したバンドまでを渡し、残りは処理しない
+					return
+				}
+			}
+		}
+	}()
+}
+
+// n 個のバンドを同時に処理する組のバッファを生成
+func (mp *Processor) newBandBatch(n int) *bandBatch {
+	b := &bandBatch{
+		buffers: make([]*image.NRGBA, n),
+		images:  make([]*image.NRGBA, n),
+		rects:   make([]image.Rectangle, n),
+		errs:    make([]error, n),
+	}
+	for i := range b.buffers {
+		b.buffers[i] = mp.newBandBuffer()
+	}
+	return b
+}
+
+// offset から b.n 個のバンドを読み込んで処理する
+// バンドが 1 つの場合は columnWorkers で列方向に分割し、複数の場合はバンドごとに並列に処理する
+func (mp *Processor) processBatch(b *bandBatch, offset, columnWorkers int, rows *sourceRows) {
+	rows.prune(offset - mp.margin)
+	if b.n == 1 {
+		b.images[0], b.rects[0], b.errs[0] = mp.processBand(b.buffers[0], offset, columnWorkers, rows)
+		return
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < b.n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			b.images[i], b.rects[i], b.errs[i] = mp.processBand(b.buffers[i], offset+i*mp.mosaicHeight, 1, rows)
+		}(i)
+	}
+	wg.Wait()
+}
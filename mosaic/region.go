@@ -0,0 +1,178 @@
+package mosaic
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"image/draw"
+	"time"
+)
+
+// ProcessRegions で処理する画像の範囲
+// 範囲ごとにタイルの大きさと、Options で描き方 (WithTileRenderer) や色の決め方 (WithTileColor) などを変えられる
+type Region struct {
+	Rect                  image.Rectangle
+	TileWidth, TileHeight int      // 0 以下の場合は ProcessRegions に渡したタイルの大きさ
+	Options               []Option // ProcessRegions に渡したオプションの後に適用するオプション
+}
+
+// regions の範囲だけを、範囲ごとの設定でモザイク処理し、img に書き戻す
+// 範囲の外の画素は書き換えない
+// タイルの格子は範囲によらず WithGridOrigin の原点を通り、範囲の端にかかるタイルは範囲で切り詰める
+// 範囲の外の画素はタイルの色の計算に含めないため、隣り合う範囲の色が混ざらない
+// 範囲が重なる場合は後の範囲を優先し、重なった画素は後の範囲だけで処理する
+// 進捗の BandsDone と BandsTotal は、すべての範囲のバンドを通した数になり、WithMetrics の計測は全体で 1 回とする
+// 画像からはみ出した範囲は WarningRegionClipped、画像と重ならない範囲は WarningRegionSkipped の警告を WithLogger のロガーと WithWarnings の関数に渡す
+// WithAdjustScope(AdjustAll) の場合は、範囲の外と、範囲の中で WithSelection で選ばなかった画素の色も変換する
+func ProcessRegions(ctx context.Context, img *image.NRGBA, tileWidth, tileHeight int, regions []Region, opts ...Option) error {
+	return processRegions(ctx, img, tileWidth, tileHeight, regions, []image.Rectangle{img.Rect}, opts...)
+}
+
+// ProcessRegions と同じく regions の範囲を処理する
+// AdjustAll で画素ごとに変換する画素は、area の範囲の画素に限る
+func processRegions(ctx context.Context, img *image.NRGBA, tileWidth, tileHeight int, regions []Region, area []image.Rectangle, opts ...Option) (err error) {
+	// 範囲についての警告は、オプションだけを適用したインスタンスで記録する
+	warner := &Processor{}
+	for _, opt := range opts {
+		opt(warner)
+	}
+	processors := make([]*Processor, 0, len(regions))
+	rects := make([]image.Rectangle, 0, len(regions))
+	total := 0
+	for i, r := range regions {
+		rect := r.Rect.Intersect(img.Rect)
+		if rect != r.Rect {
+			w := Warning{
+				Code:    WarningRegionClipped,
+				Message: "region extends outside the image; clipped to the image",
+				Fields:  map[string]any{"region": i + 1, "rect": r.Rect.String(), "clipped": rect.String()},
+			}
+			if rect.Empty() {
+				w.Code, w.Message = WarningRegionSkipped, "region does not overlap the image; skipped"
+				delete(w.Fields, "clipped")
+			}
+			if err := warner.warn(w); err != nil {
+				return err
+			}
+		}
+		if rect.Empty() {
+			continue
+		}
+		w, h := tileWidth, tileHeight
+		if r.TileWidth > 0 && r.TileHeight > 0 {
+			w, h = r.TileWidth, r.TileHeight
+		}
+		// 選ばなかった画素は、範囲ごとではなく最後にまとめて変換する (重なった範囲を 2 度変換しないため)
+		regionOpts := append(append(append([]Option{}, opts...), r.Options...), withRegionSelection(rect, regions[i+1:]), WithAdjustScope(AdjustRegion))
+		mp := New(img.SubImage(rect).(*image.NRGBA), w, h, regionOpts...)
+		if mp.err != nil {
+			return mp.err
+		}
+		processors = append(processors, mp)
+		rects = append(rects, rect)
+		total += mp.Grid().Rows
+	}
+
+	if len(processors) > 0 && processors[0].metrics != nil {
+		metrics, start := processors[0].metrics, time.Now()
+		metrics.ProcessStarted()
+		defer func() {
+			pixels := 0
+			for _, mp := range processors {
+				size := mp.src.Bounds().Size()
+				pixels += size.X * size.Y
+			}
+			metrics.ProcessFinished(time.Since(start), pixels, err)
+		}()
+	}
+
+	done := 0
+	for _, mp := range processors {
+		mp.metrics = nil
+		if progress := mp.progress; progress != nil {
+			offset := done
+			mp.progress = func(p Progress) {
+				progress(Progress{BandsDone: offset + p.BandsDone, BandsTotal: total})
+			}
+		}
+		if _, err := mp.ProcessInPlace(ctx); err != nil {
+			return err
+		}
+		done += mp.Grid().Rows
+	}
+	if warner.adjustScope == AdjustAll && len(warner.adjusts) > 0 {
+		adjustUnselected(img, area, rects, warner.selection, warner.adjusts)
+	}
+	return nil
+}
+
+// area のうち、rects の範囲で selection (nil の場合はすべての画素) で選んだ画素以外の色を adjusts で変換する
+// 選んだ画素のビットマップは、大きな画像でも小さく済むように adjustRows 行ずつ求める
+func adjustUnselected(img *image.NRGBA, area, rects []image.Rectangle, selection Selection, adjusts []ColorAdjust) {
+	selected := Rects(rects...)
+	if selection != nil {
+		selected = Intersect(selection, selected)
+	}
+	for _, a := range area {
+		a = a.Intersect(img.Rect)
+		for y := a.Min.Y; y < a.Max.Y; y += adjustRows {
+			band := image.Rect(a.Min.X, y, a.Max.X, min(y+adjustRows, a.Max.Y))
+			b := NewBitmap(band)
+			selected.Fill(b)
+			adjustPixels(img, band, b, false, adjusts)
+		}
+	}
+}
+
+// adjustUnselected で 1 度に求めるビットマップの行数
+const adjustRows = 64
+
+// PatchRegions の処理済みの画像と元画像の範囲が異なることを表すエラー
+type BoundsMismatchError struct {
+	Base, Src image.Rectangle
+}
+
+func (e *BoundsMismatchError) Error() string {
+	return fmt.Sprintf("mosaic: base bounds %v do not match source bounds %v", e.Base, e.Src)
+}
+
+// 処理済みの画像 base のうち regions の範囲だけを、元画像 src の画素から処理し直す
+// 範囲に src の画素を写してから ProcessRegions で処理するため、範囲の中は src を ProcessRegions で処理した結果と同じになり、範囲の外の base の画素は書き換えない
+// (AdjustAll の場合も、範囲の外の画素は base のまま変換し直さない)
+// 範囲と重なるバンドだけを処理するため、処理の時間は画像全体ではなく範囲の大きさに比例する
+// src は書き換えない。base と src の範囲が異なる場合は *BoundsMismatchError を返却
+func PatchRegions(ctx context.Context, base, src *image.NRGBA, tileWidth, tileHeight int, regions []Region, opts ...Option) error {
+	if base.Rect != src.Rect {
+		return &BoundsMismatchError{Base: base.Rect, Src: src.Rect}
+	}
+	for _, r := range regions {
+		rect := r.Rect.Intersect(src.Rect)
+		draw.Draw(base, rect, src, rect.Min, draw.Src)
+	}
+	area := make([]image.Rectangle, len(regions))
+	for i, r := range regions {
+		area[i] = r.Rect
+	}
+	return processRegions(ctx, base, tileWidth, tileHeight, regions, area, opts...)
+}
+
+// rect のうち later の範囲と重なる画素を処理から除く選び方を、ほかの選び方と重ねるオプション
+// 重ならない場合はほかの選び方をそのまま使う
+func withRegionSelection(rect image.Rectangle, later []Region) Option {
+	return func(mp *Processor) {
+		var overlaps []image.Rectangle
+		for _, r := range later {
+			if o := r.Rect.Intersect(rect); !o.Empty() {
+				overlaps = append(overlaps, o)
+			}
+		}
+		if len(overlaps) == 0 {
+			return
+		}
+		s := mp.selection
+		if s == nil {
+			s = Rects(rect)
+		}
+		mp.selection = Subtract(s, Rects(overlaps...))
+	}
+}
@@ -0,0 +1,139 @@
+package mosaic
+
+import (
+	"context"
+	"errors"
+	"image"
+	"testing"
+)
+
+// img の複製を regions で処理した結果
+func processRegionsCopy(t *testing.T, img *image.NRGBA, tile int, regions []Region, opts ...Option) *image.NRGBA {
+	t.Helper()
+	out := image.NewNRGBA(img.Rect)
+	copy(out.Pix, img.Pix)
+	if err := ProcessRegions(context.Background(), out, tile, tile, regions, opts...); err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+func TestPatchRegions(t *testing.T) {
+	const tile = 8
+	src := testImage(120, 400)
+	first := []Region{{Rect: image.Rect(10, 20, 70, 90)}}
+	added := Region{Rect: image.Rect(40, 300, 100, 350)}
+	base := processRegionsCopy(t, src, tile, first)
+	want := processRegionsCopy(t, src, tile, []Region{added})
+
+	patched := image.NewNRGBA(base.Rect)
+	copy(patched.Pix, base.Pix)
+	var last Progress
+	err := PatchRegions(context.Background(), patched, src, tile, tile, []Region{added}, WithProgress(func(p Progress) { last = p }))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for y := src.Rect.Min.Y; y < src.Rect.Max.Y; y++ {
+		for x := src.Rect.Min.X; x < src.Rect.Max.X; x++ {
+			got := patched.NRGBAAt(x, y)
+			// 範囲の外は base のまま、範囲の中は最初から処理した結果と同じ
+			ref := base
+			if (image.Point{x, y}).In(added.Rect) {
+				ref = want
+			}
+			if got != ref.NRGBAAt(x, y) {
+				t.Fatalf("pixel (%d,%d) = %v, want %v", x, y, got, ref.NRGBAAt(x, y))
+			}
+		}
+	}
+	// 範囲と重なるバンドだけを処理する
+	if rows := (added.Rect.Max.Y-1)/tile - added.Rect.Min.Y/tile + 1; last.BandsTotal != rows {
+		t.Errorf("processed %d bands, want %d", last.BandsTotal, rows)
+	}
+}
+
+func TestPatchRegionsBoundsMismatch(t *testing.T) {
+	base, src := testImage(32, 32), testImage(32, 40)
+	before := append([]uint8(nil), base.Pix...)
+	err := PatchRegions(context.Background(), base, src, 8, 8, []Region{{Rect: image.Rect(0, 0, 8, 8)}})
+	var mismatch *BoundsMismatchError
+	if !errors.As(err, &mismatch) || mismatch.Base != base.Rect || mismatch.Src != src.Rect {
+		t.Fatalf("err = %v, want *BoundsMismatchError", err)
+	}
+	for i := range before {
+		if base.Pix[i] != before[i] {
+			t.Fatal("base was changed")
+		}
+	}
+}
+
+func TestRegionTile(t *testing.T) {
+	bounds := image.Rect(0, 0, 1000, 800)
+	region := func(x, y, w, h, tile int) RegionOptions {
+		return RegionOptions{Rect: [4]int{x, y, w, h}, Tile: tile}
+	}
+	tests := []struct {
+		name       string
+		minTiles   int
+		minTile    int
+		region     RegionOptions
+		tile, want int
+	}{
+		{"disabled", 0, 4, region(10, 10, 60, 45, 0), 100, 100},
+		// 60×45 の範囲は短い辺の 45 を 4 個に分ける
+		{"smaller than one tile", 4, 4, region(10, 10, 60, 45, 0), 100, 11},
+		{"exactly one tile", 4, 4, region(0, 0, 100, 100, 0), 100, 25},
+		{"exactly min tiles", 4, 4, region(0, 0, 400, 400, 0), 100, 100},
+		{"huge region", 4, 4, region(0, 0, 1000, 800, 0), 100, 100},
+		{"min tile bound", 4, 8, region(10, 10, 20, 20, 0), 100, 8},
+		{"min tile 0 means 1", 4, 0, region(10, 10, 3, 3, 0), 100, 1},
+		// 下限は元の大きさより大きくしない
+		{"min tile above the tile", 4, 16, region(10, 10, 20, 20, 0), 10, 10},
+		{"region tile", 4, 4, region(0, 0, 60, 60, 30), 100, 15},
+		{"region tile kept", 2, 4, region(0, 0, 60, 60, 12), 100, 12},
+		// 画像の端で切り詰めた大きさで決める
+		{"clipped", 4, 4, region(960, 0, 400, 400, 0), 100, 10},
+		{"outside", 4, 4, region(2000, 0, 400, 400, 0), 100, 4},
+	}
+	for _, tt := range tests {
+		o := Options{Tile: tt.tile, RegionMinTiles: tt.minTiles, MinTile: tt.minTile}
+		if got := o.RegionTile(tt.region, tt.tile, bounds); got != tt.want {
+			t.Errorf("%s: tile %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+// 小さくしたタイルでも、範囲はタイル RegionMinTiles×RegionMinTiles 個以上に分かれる
+func TestRegionTileSplitsSmallRegion(t *testing.T) {
+	img := testImage(200, 160)
+	r := RegionOptions{Rect: [4]int{30, 20, 60, 45}}
+	o := Options{Tile: 100, RegionMinTiles: 4, MinTile: 4}
+	tile := o.RegionTile(r, o.Tile, img.Rect)
+	out := processRegionsCopy(t, img, o.Tile, []Region{{Rect: r.Rectangle(), TileWidth: tile, TileHeight: tile}})
+	colors := map[[4]uint8]bool{}
+	for y := 20; y < 65; y++ {
+		for x := 30; x < 90; x++ {
+			c := out.NRGBAAt(x, y)
+			colors[[4]uint8{c.R, c.G, c.B, c.A}] = true
+		}
+	}
+	if len(colors) < 16 {
+		t.Errorf("region has %d tile colors, want at least 16", len(colors))
+	}
+}
+
+func TestRegionMinTilesValidateAndCanonical(t *testing.T) {
+	for _, o := range []Options{{Tile: 8, RegionMinTiles: -1}, {Tile: 8, MinTile: -1}} {
+		if err := o.Validate(); err == nil {
+			t.Errorf("%+v accepted", o)
+		}
+	}
+	// 範囲がない場合は設定を省く
+	if c := (Options{Tile: 8, RegionMinTiles: 4, MinTile: 4}).Canonical(); c.RegionMinTiles != 0 || c.MinTile != 0 {
+		t.Errorf("without regions: %d, %d", c.RegionMinTiles, c.MinTile)
+	}
+	regions := []RegionOptions{{Rect: [4]int{0, 0, 10, 10}}}
+	if c := (Options{Tile: 8, RegionMinTiles: 4, Regions: regions}).Canonical(); c.RegionMinTiles != 4 || c.MinTile != 1 {
+		t.Errorf("with regions: %d, %d", c.RegionMinTiles, c.MinTile)
+	}
+}
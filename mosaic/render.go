@@ -0,0 +1,70 @@
+package mosaic
+
+import (
+	"image"
+	"image/color"
+)
+
+// タイルを描画する処理
+// dst は tile の範囲に切り出した画像で、tile の外側は書き換えてはならない
+// TileColorFunc と同様に、複数のゴルーチンから同時に呼び出されることがある
+type TileRenderer interface {
+	Render(dst *image.NRGBA, tile image.Rectangle, c color.NRGBA)
+}
+
+// 関数を TileRenderer として扱う
+type TileRendererFunc func(dst *image.NRGBA, tile image.Rectangle, c color.NRGBA)
+
+func (f TileRendererFunc) Render(dst *image.NRGBA, tile image.Rectangle, c color.NRGBA) {
+	f(dst, tile, c)
+}
+
+// タイルを描画する処理を設定
+// 指定しない場合は FlatRenderer で塗りつぶす
+func WithTileRenderer(r TileRenderer) Option {
+	return func(mp *Processor) {
+		mp.renderer = r
+	}
+}
+
+// タイル全体を 1 色で塗りつぶす TileRenderer
+type FlatRenderer struct{}
+
+// 先頭の行を塗ってから、残りの行にコピーする
+func (FlatRenderer) Render(dst *image.NRGBA, tile image.Rectangle, c color.NRGBA) {
+	tile = tile.Intersect(dst.Bounds())
+	if tile.Empty() {
+		return
+	}
+	width := 4 * tile.Dx()
+	i := dst.PixOffset(tile.Min.X, tile.Min.Y)
+	row := dst.Pix[i : i+width : i+width]
+
+	// 1 画素を書き込み、書き込んだ範囲を倍々にコピーして行を埋める
+	row[0], row[1], row[2], row[3] = c.R, c.G, c.B, c.A
+	for n := 4; n < width; n *= 2 {
+		copy(row[n:], row[:n])
+	}
+	for y := tile.Min.Y + 1; y < tile.Max.Y; y++ {
+		i := dst.PixOffset(tile.Min.X, y)
+		copy(dst.Pix[i:i+width], row)
+	}
+}
+
+// タイルの範囲と色の組から画像を描画
+// 元画像の平均を取らずに、書き出したタイルの色などから同じモザイクを描き直す場合に使う
+// 画像の大きさは bounds で、どのタイルにも含まれない範囲は background で塗りつぶす
+// renderer が nil の場合は FlatRenderer で塗りつぶす
+func RenderTiles(bounds image.Rectangle, tiles []TileInfo, background color.NRGBA, renderer TileRenderer) *image.NRGBA {
+	img := image.NewNRGBA(bounds)
+	FlatRenderer{}.Render(img, bounds, background)
+	stage := &MosaicStage{Renderer: renderer}
+	for _, t := range tiles {
+		tile := t.Rect.Intersect(bounds)
+		if tile.Empty() {
+			continue
+		}
+		stage.render(img, tile, t.Color)
+	}
+	return img
+}
@@ -0,0 +1,123 @@
+package mosaic
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+// 描画前の画素の色 (どの描画処理も描かない色)
+var guardColor = color.NRGBA{1, 2, 3, 4}
+
+// r がタイルの範囲の中だけを、範囲全体にわたって描くことを確かめる
+// タイルの周りに余白を取った画像に描き、余白が書き換わっていないことと、タイルに描き残しがないことを見る
+// 画像の端で切れたタイルとして、画像からはみ出した tile も渡す
+func assertRendersWithin(t *testing.T, r TileRenderer) {
+	t.Helper()
+	canvas := image.Rect(0, 0, 64, 48)
+	c := color.NRGBA{200, 120, 40, 255}
+	for _, tile := range []image.Rectangle{
+		image.Rect(8, 8, 40, 40),   // 大きなタイル
+		image.Rect(10, 5, 17, 12),  // 奇数の大きさ
+		image.Rect(20, 20, 23, 22), // 小さなタイル
+		image.Rect(20, 20, 21, 21), // 1px
+		image.Rect(50, 30, 80, 60), // 右と下で切れるタイル
+		image.Rect(-8, -4, 6, 10),  // 左と上で切れるタイル
+	} {
+		dst := image.NewNRGBA(canvas)
+		FlatRenderer{}.Render(dst, canvas, guardColor)
+		r.Render(dst.SubImage(tile).(*image.NRGBA), tile, c)
+
+		inside := tile.Intersect(canvas)
+		for y := canvas.Min.Y; y < canvas.Max.Y; y++ {
+			for x := canvas.Min.X; x < canvas.Max.X; x++ {
+				got := dst.NRGBAAt(x, y)
+				if in := image.Pt(x, y).In(inside); in && got == guardColor {
+					t.Fatalf("tile %v: pixel (%d,%d) was not drawn", tile, x, y)
+				} else if !in && got != guardColor {
+					t.Fatalf("tile %v: pixel (%d,%d) outside the tile was written (%v)", tile, x, y, got)
+				}
+			}
+		}
+	}
+}
+
+func TestRenderersStayWithinTile(t *testing.T) {
+	gray := color.NRGBA{128, 128, 128, 255}
+	for name, r := range map[string]TileRenderer{
+		"flat":            FlatRenderer{},
+		"lego":            LegoRenderer{},
+		"lego baseplate":  LegoRenderer{Baseplate: gray},
+		"dot":             DotRenderer{Background: gray},
+		"dot transparent": DotRenderer{},
+		"rounded":         RoundedRenderer{Background: gray},
+		"grout":           GroutRenderer{Grout: gray},
+		"grout wide":      GroutRenderer{Grout: gray, Width: 5},
+		"label":           LabelRenderer{Base: GroutRenderer{Grout: gray}, MinSize: 8},
+	} {
+		t.Run(name, func(t *testing.T) {
+			assertRendersWithin(t, r)
+		})
+	}
+}
+
+func TestStyleRenderers(t *testing.T) {
+	bg := color.NRGBA{255, 255, 255, 255}
+	c := color.NRGBA{200, 40, 40, 255}
+	tile := image.Rect(0, 0, 32, 32)
+	render := func(r TileRenderer) *image.NRGBA {
+		dst := image.NewNRGBA(tile)
+		r.Render(dst, tile, c)
+		return dst
+	}
+	tests := []struct {
+		name   string
+		r      TileRenderer
+		points map[image.Point]color.NRGBA
+	}{
+		// 中央はタイルの色、角は背景
+		{"dot", DotRenderer{Background: bg}, map[image.Point]color.NRGBA{{16, 16}: c, {0, 0}: bg, {31, 31}: bg, {16, 3}: c}},
+		// 辺の中央はタイルの色、角と右下の隙間は背景
+		{"rounded", RoundedRenderer{Background: bg}, map[image.Point]color.NRGBA{{16, 0}: c, {0, 16}: c, {0, 0}: bg, {31, 16}: bg, {8, 8}: c}},
+		// 右と下の 4px (32/8) が目地
+		{"grout", GroutRenderer{Grout: bg}, map[image.Point]color.NRGBA{{0, 0}: c, {27, 27}: c, {28, 0}: bg, {0, 28}: bg, {31, 31}: bg}},
+	}
+	for _, tt := range tests {
+		img := render(tt.r)
+		for p, want := range tt.points {
+			if got := img.NRGBAAt(p.X, p.Y); got != want {
+				t.Errorf("%s: pixel %v = %v, want %v", tt.name, p, got, want)
+			}
+		}
+	}
+
+	// 小さなタイルは単色で塗りつぶす
+	small := image.Rect(0, 0, 3, 3)
+	for _, r := range []TileRenderer{DotRenderer{Background: bg}, RoundedRenderer{Background: bg}, GroutRenderer{Grout: bg, Width: 3}} {
+		dst := image.NewNRGBA(small)
+		r.Render(dst, small, c)
+		if got := dst.NRGBAAt(2, 2); got != c {
+			t.Errorf("%T on a 3px tile: pixel (2,2) = %v, want %v", r, got, c)
+		}
+	}
+}
+
+func TestTileRendererInPipeline(t *testing.T) {
+	img := testImage(50, 37)
+	// 描画処理には画像の端で切れたタイルも、タイルの範囲に切り出した画像で渡す
+	var calls int
+	check := TileRendererFunc(func(dst *image.NRGBA, tile image.Rectangle, c color.NRGBA) {
+		if dst.Bounds() != tile {
+			t.Errorf("dst bounds %v, tile %v", dst.Bounds(), tile)
+		}
+		calls++
+		FlatRenderer{}.Render(dst, tile, c)
+	})
+	out := process(t, img, 16, WithTileRenderer(check), WithWorkers(1))
+	if calls != 4*3 {
+		t.Errorf("renderer called %d times, want 12", calls)
+	}
+	// FlatRenderer は既定の塗りつぶしと同じ結果になる
+	assertSameImage(t, out, process(t, img, 16))
+	assertSameImage(t, process(t, img, 16, WithTileRenderer(FlatRenderer{})), out)
+}
@@ -0,0 +1,39 @@
+package mosaic
+
+// 平均色の成分を 8 ビットの値にする丸め方
+type Rounding int
+
+const (
+	// 最も近い値にし、ちょうど中間の場合は大きい方にする (既定)
+	// 乗算済みの 16 ビット値の合計 S と画素数 n から、成分を ⌊(2S + 257n) / (514n)⌋ とする
+	// 不透明な画素では、8 ビットの成分の合計 Σv について ⌊Σv/n + 1/2⌋ と同じ値になる
+	RoundHalfUp Rounding = iota
+	// 以前の計算 (⌊S/n⌋ の上位 8 ビット) で、平均を切り捨てる
+	// 以前の出力と同じバイト列が必要な場合に使う
+	RoundTruncate
+)
+
+// 平均色の成分の丸め方を設定
+// 平均色 (WithTileColor を指定しない場合と MeanColor) に効き、CIELAB や HSV の平均色には効かない
+func WithRounding(r Rounding) Option {
+	return func(mp *Processor) {
+		mp.rounding = r
+	}
+}
+
+// 乗算済みの 16 ビット値の合計 sum を n 画素で平均し、8 ビットの値にする (n は 0 より大きいこと)
+func (r Rounding) mean(sum, n uint64) uint8 {
+	if r == RoundTruncate {
+		return uint8(sum / n >> 8)
+	}
+	return uint8((2*sum + 0x101*n) / (2 * 0x101 * n))
+}
+
+// 重み付けした平均 (乗算済みの 16 ビット値) を 8 ビットの値にする
+// RoundTruncate は以前の計算 (16 ビット値に丸めてから上位 8 ビットを使う) にする
+func (r Rounding) weighted(v float64) uint8 {
+	if r == RoundTruncate {
+		return uint8(uint64(v+0.5) >> 8)
+	}
+	return uint8(v/0x101 + 0.5)
+}
@@ -0,0 +1,85 @@
+package mosaic
+
+import (
+	"image"
+	"image/color"
+	"math"
+	"testing"
+)
+
+// 不透明な画素の成分 values を 1 行に並べた画像
+func rowImage(values ...uint8) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, len(values), 1))
+	for x, v := range values {
+		img.SetNRGBA(x, 0, color.NRGBA{v, v, v, 255})
+	}
+	return img
+}
+
+func TestRoundingHalfBoundary(t *testing.T) {
+	tests := []struct {
+		values         []uint8
+		halfUp, legacy uint8
+	}{
+		{[]uint8{10, 11}, 11, 10},         // ちょうど 10.5
+		{[]uint8{0, 1}, 1, 0},             // 0.5
+		{[]uint8{254, 255}, 255, 255},     // 254.5 (以前の計算は 16 ビット値で切り捨てるため、255 に近いと切り上がる)
+		{[]uint8{10, 10, 11}, 10, 10},     // 10.33
+		{[]uint8{10, 11, 11}, 11, 10},     // 10.67
+		{[]uint8{10, 10, 10, 11}, 10, 10}, // 10.25
+		{[]uint8{10, 11, 11, 11}, 11, 10}, // 10.75
+		{[]uint8{100, 101, 100, 101}, 101, 100},
+		{[]uint8{255, 255}, 255, 255},
+		{[]uint8{0, 0, 0}, 0, 0},
+	}
+	for _, tt := range tests {
+		img := rowImage(tt.values...)
+		for _, c := range []struct {
+			r    Rounding
+			want uint8
+		}{{RoundHalfUp, tt.halfUp}, {RoundTruncate, tt.legacy}} {
+			got := averageColor(img, img.Rect, false, c.r)
+			if got.R != c.want || got.G != c.want || got.B != c.want || got.A != 255 {
+				t.Errorf("%v with rounding %d = %v, want %d", tt.values, c.r, got, c.want)
+			}
+			// 処理の結果も同じ色にする
+			if out := process(t, img, len(tt.values), WithRounding(c.r)); out.NRGBAAt(0, 0) != got {
+				t.Errorf("%v with rounding %d: processed %v, want %v", tt.values, c.r, out.NRGBAAt(0, 0), got)
+			}
+		}
+	}
+}
+
+func TestRoundingMatchesFloatReference(t *testing.T) {
+	img := testImage(97, 61)
+	for _, tile := range []int{2, 3, 7, 16} {
+		halfUp := process(t, img, tile)
+		legacy := process(t, img, tile, WithRounding(RoundTruncate))
+		for y := 0; y < img.Rect.Dy(); y += tile {
+			for x := 0; x < img.Rect.Dx(); x += tile {
+				var sum [3]float64
+				var total [3]uint64
+				rect := image.Rect(x, y, x+tile, y+tile).Intersect(img.Rect)
+				for py := rect.Min.Y; py < rect.Max.Y; py++ {
+					for px := rect.Min.X; px < rect.Max.X; px++ {
+						c := img.NRGBAAt(px, py)
+						sum[0], sum[1], sum[2] = sum[0]+float64(c.R), sum[1]+float64(c.G), sum[2]+float64(c.B)
+						total[0], total[1], total[2] = total[0]+uint64(c.R), total[1]+uint64(c.G), total[2]+uint64(c.B)
+					}
+				}
+				n := float64(rect.Dx() * rect.Dy())
+				h, l := halfUp.NRGBAAt(x, y), legacy.NRGBAAt(x, y)
+				for i, pair := range [][2]uint8{{h.R, l.R}, {h.G, l.G}, {h.B, l.B}} {
+					mean := sum[i] / n
+					// 四捨五入は平均との差が 0.5 以下、以前の計算は 16 ビット値の平均 ⌊257Σv/n⌋ の上位 8 ビット
+					if math.Abs(float64(pair[0])-mean) > 0.5 {
+						t.Fatalf("tile %d at (%d,%d): %d, mean %.4f", tile, x, y, pair[0], mean)
+					}
+					if want := uint8(0x101 * total[i] / uint64(n) >> 8); pair[1] != want {
+						t.Fatalf("tile %d at (%d,%d): legacy %d, mean %.4f", tile, x, y, pair[1], mean)
+					}
+				}
+			}
+		}
+	}
+}
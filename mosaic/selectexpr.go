@@ -0,0 +1,272 @@
+package mosaic
+
+import (
+	"fmt"
+	"image"
+	"strconv"
+	"strings"
+)
+
+// -select の処理する画素の選び方の式
+// 項は all (すべての画素)、regions (-region の範囲)、rect(x,y,w,h)、luma(>=0.9) または luma(>=0.9,grow)、mask(path) で、
+// 演算子は優先順位の高い順に !a (反転)、a & b (共通部分)、a + b (和) と a - b (差) (同じ優先順位は左から) で、括弧でまとめられる
+// 例: regions + luma(>=0.9) - rect(0,0,200,80)
+type SelectExpr struct {
+	Op   byte         // '+'、'-'、'&' または '!' (項の場合は 0)
+	Args []SelectExpr // 演算の対象 (! は 1 つ、ほかは 2 つ)
+	Term string       // 項の名前
+	Arg  string       // 項の括弧の中 (ParseSelectExpr で確かめた値)
+}
+
+// 式の項の名前
+var selectTerms = []string{"all", "regions", "rect", "luma", "mask"}
+
+// 選び方の式を解析する
+func ParseSelectExpr(s string) (SelectExpr, error) {
+	p := selectParser{s: s}
+	e, err := p.expr()
+	if err == nil && p.skipSpace() < len(s) {
+		err = fmt.Errorf("unexpected %q", s[p.pos:])
+	}
+	if err != nil {
+		return SelectExpr{}, fmt.Errorf("invalid selection %q: %w", s, err)
+	}
+	return e, nil
+}
+
+type selectParser struct {
+	s   string
+	pos int
+}
+
+func (p *selectParser) skipSpace() int {
+	for p.pos < len(p.s) && (p.s[p.pos] == ' ' || p.s[p.pos] == '\t') {
+		p.pos++
+	}
+	return p.pos
+}
+
+// 次の文字が c の場合は読み進める
+func (p *selectParser) accept(c byte) bool {
+	if p.skipSpace() < len(p.s) && p.s[p.pos] == c {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *selectParser) expr() (SelectExpr, error) {
+	e, err := p.intersection()
+	for err == nil {
+		var op byte
+		switch {
+		case p.accept('+'):
+			op = '+'
+		case p.accept('-'):
+			op = '-'
+		default:
+			return e, nil
+		}
+		var rhs SelectExpr
+		if rhs, err = p.intersection(); err == nil {
+			e = SelectExpr{Op: op, Args: []SelectExpr{e, rhs}}
+		}
+	}
+	return e, err
+}
+
+func (p *selectParser) intersection() (SelectExpr, error) {
+	e, err := p.unary()
+	for err == nil && p.accept('&') {
+		var rhs SelectExpr
+		if rhs, err = p.unary(); err == nil {
+			e = SelectExpr{Op: '&', Args: []SelectExpr{e, rhs}}
+		}
+	}
+	return e, err
+}
+
+func (p *selectParser) unary() (SelectExpr, error) {
+	if p.accept('!') {
+		e, err := p.unary()
+		return SelectExpr{Op: '!', Args: []SelectExpr{e}}, err
+	}
+	if p.accept('(') {
+		e, err := p.expr()
+		if err == nil && !p.accept(')') {
+			err = fmt.Errorf("missing ) at offset %d", p.pos)
+		}
+		return e, err
+	}
+	return p.term()
+}
+
+func (p *selectParser) term() (SelectExpr, error) {
+	start := p.skipSpace()
+	for p.pos < len(p.s) && 'a' <= p.s[p.pos] && p.s[p.pos] <= 'z' {
+		p.pos++
+	}
+	name := p.s[start:p.pos]
+	if name == "" {
+		if start == len(p.s) {
+			return SelectExpr{}, fmt.Errorf("missing term at the end")
+		}
+		return SelectExpr{}, fmt.Errorf("unexpected %q at offset %d", p.s[start], start)
+	}
+	e := SelectExpr{Term: name}
+	if p.accept('(') {
+		end := strings.IndexByte(p.s[p.pos:], ')')
+		if end < 0 {
+			return SelectExpr{}, fmt.Errorf("missing ) after %s(", name)
+		}
+		e.Arg = strings.TrimSpace(p.s[p.pos : p.pos+end])
+		p.pos += end + 1
+	}
+	return e, e.validateTerm()
+}
+
+// 項の名前と括弧の中を確かめ、括弧の中を決まった書式にする
+func (e *SelectExpr) validateTerm() error {
+	switch e.Term {
+	case "all", "regions":
+		if e.Arg != "" {
+			return fmt.Errorf("%s takes no arguments", e.Term)
+		}
+	case "rect":
+		parts := strings.Split(e.Arg, ",")
+		var v [4]int
+		for i := range parts {
+			n, err := strconv.Atoi(strings.TrimSpace(parts[i]))
+			if err != nil || len(parts) != len(v) {
+				return fmt.Errorf("invalid rect(%s) (want rect(x,y,w,h))", e.Arg)
+			}
+			v[i] = n
+		}
+		if v[2] <= 0 || v[3] <= 0 {
+			return fmt.Errorf("invalid rect(%s) (width and height must be positive)", e.Arg)
+		}
+		e.Arg = fmt.Sprintf("%d,%d,%d,%d", v[0], v[1], v[2], v[3])
+	case "luma":
+		cond, grow, hasGrow := strings.Cut(e.Arg, ",")
+		threshold, above, err := ParseLumaSelection(strings.TrimSpace(cond))
+		if err != nil {
+			return err
+		}
+		op := "<="
+		if above {
+			op = ">="
+		}
+		e.Arg = op + strconv.FormatFloat(threshold, 'g', -1, 64)
+		if hasGrow {
+			n, err := strconv.Atoi(strings.TrimSpace(grow))
+			if err != nil || n < 0 {
+				return fmt.Errorf("invalid luma(%s) (grow must be a non-negative integer)", cond+","+grow)
+			}
+			if n > 0 {
+				e.Arg += "," + strconv.Itoa(n)
+			}
+		}
+	case "mask":
+		if e.Arg == "" {
+			return fmt.Errorf("mask needs a path (want mask(path))")
+		}
+	default:
+		return fmt.Errorf("unknown term %q (want %s)", e.Term, strings.Join(selectTerms, ", "))
+	}
+	return nil
+}
+
+// rect の項の矩形
+func (e SelectExpr) Rect() image.Rectangle {
+	var x, y, w, h int
+	fmt.Sscanf(e.Arg, "%d,%d,%d,%d", &x, &y, &w, &h)
+	return image.Rect(x, y, x+w, y+h)
+}
+
+// luma の項の輝度のしきい値、条件の向き (LumaMask と同じ) と範囲を広げる画素数
+func (e SelectExpr) Luma() (threshold float64, above bool, grow int) {
+	cond, g, _ := strings.Cut(e.Arg, ",")
+	threshold, above, _ = ParseLumaSelection(cond)
+	grow, _ = strconv.Atoi(g)
+	return threshold, above, grow
+}
+
+// 式に含まれる名前が name の項
+func (e SelectExpr) Terms(name string) []SelectExpr {
+	if e.Op == 0 {
+		if e.Term == name {
+			return []SelectExpr{e}
+		}
+		return nil
+	}
+	var terms []SelectExpr
+	for _, a := range e.Args {
+		terms = append(terms, a.Terms(name)...)
+	}
+	return terms
+}
+
+// 演算子の優先順位 (項は最も高い)
+func (e SelectExpr) precedence() int {
+	switch e.Op {
+	case '+', '-':
+		return 1
+	case '&':
+		return 2
+	}
+	return 3
+}
+
+// 決まった書式の式 (同じ選び方の式は同じ文字列になる)
+func (e SelectExpr) String() string {
+	switch e.Op {
+	case 0:
+		if e.Arg == "" && (e.Term == "all" || e.Term == "regions") {
+			return e.Term
+		}
+		return e.Term + "(" + e.Arg + ")"
+	case '!':
+		return "!" + e.Args[0].operand(3)
+	}
+	// 左から結合するため、右の対象は同じ優先順位でも括弧で囲む
+	return e.Args[0].operand(e.precedence()) + " " + string(e.Op) + " " + e.Args[1].operand(e.precedence()+1)
+}
+
+// 優先順位が lowest より低い場合は括弧で囲んだ式
+func (e SelectExpr) operand(lowest int) string {
+	if e.precedence() < lowest {
+		return "(" + e.String() + ")"
+	}
+	return e.String()
+}
+
+// 式の Selection
+// all と rect 以外の項は source で Selection にする
+func (e SelectExpr) Selection(source func(term SelectExpr) (Selection, error)) (Selection, error) {
+	if e.Op == 0 {
+		switch e.Term {
+		case "all":
+			return Invert(Rects()), nil
+		case "rect":
+			return Rects(e.Rect()), nil
+		}
+		return source(e)
+	}
+	args := make([]Selection, len(e.Args))
+	for i, a := range e.Args {
+		s, err := a.Selection(source)
+		if err != nil {
+			return nil, err
+		}
+		args[i] = s
+	}
+	switch e.Op {
+	case '+':
+		return Union(args...), nil
+	case '-':
+		return Subtract(args[0], args[1:]...), nil
+	case '&':
+		return Intersect(args...), nil
+	}
+	return Invert(args[0]), nil
+}
@@ -0,0 +1,149 @@
+package mosaic
+
+import (
+	"errors"
+	"image"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseSelectExpr(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"regions + luma(>=0.9) - rect(0,0,200,80)", "regions + luma(>=0.9) - rect(0,0,200,80)"},
+		{" rect( 1, 2 ,3,4 ) ", "rect(1,2,3,4)"},
+		{"rect(-5,-5,10,10)", "rect(-5,-5,10,10)"},
+		{"all", "all"},
+		// 同じ優先順位は左から結合する
+		{"(all - regions) - rect(0,0,1,1)", "all - regions - rect(0,0,1,1)"},
+		{"all - (regions - rect(0,0,1,1))", "all - (regions - rect(0,0,1,1))"},
+		{"all - (regions + rect(0,0,1,1))", "all - (regions + rect(0,0,1,1))"},
+		// & は + と - より先に結合する
+		{"all + regions & rect(0,0,1,1)", "all + regions & rect(0,0,1,1)"},
+		{"(all + regions) & rect(0,0,1,1)", "(all + regions) & rect(0,0,1,1)"},
+		{"all&(regions&rect(0,0,1,1))", "all & (regions & rect(0,0,1,1))"},
+		// ! は最も先に結合する
+		{"!regions & all", "!regions & all"},
+		{"!(regions & all)", "!(regions & all)"},
+		{"!!regions", "!!regions"},
+		{"((regions))", "regions"},
+		{"luma(<=0.2, 0)", "luma(<=0.2)"},
+		{"luma(>= 0.90,3)", "luma(>=0.9,3)"},
+		{"mask(dir/a b.png)", "mask(dir/a b.png)"},
+		{"\tregions-mask(m.png)", "regions - mask(m.png)"},
+	}
+	for _, tt := range tests {
+		e, err := ParseSelectExpr(tt.in)
+		if err != nil {
+			t.Errorf("%q: %v", tt.in, err)
+			continue
+		}
+		if got := e.String(); got != tt.want {
+			t.Errorf("%q = %q, want %q", tt.in, got, tt.want)
+		}
+		// 決まった書式の式を解析し直すと同じ式になる
+		again, err := ParseSelectExpr(e.String())
+		if err != nil || !reflect.DeepEqual(again, e) {
+			t.Errorf("%q: round trip %+v, %v, want %+v", tt.in, again, err, e)
+		}
+	}
+}
+
+func TestParseSelectExprStructure(t *testing.T) {
+	e, err := ParseSelectExpr("all - regions - rect(0,0,1,1) + !mask(m.png) & regions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// ((all - regions) - rect) + (!mask & regions)
+	if e.Op != '+' || e.Args[0].Op != '-' || e.Args[0].Args[0].Op != '-' || e.Args[0].Args[1].Term != "rect" ||
+		e.Args[1].Op != '&' || e.Args[1].Args[0].Op != '!' || e.Args[1].Args[0].Args[0].Term != "mask" {
+		t.Errorf("parsed as %s: %+v", e, e)
+	}
+	if got := len(e.Terms("regions")); got != 2 {
+		t.Errorf("%d regions terms, want 2", got)
+	}
+	if got := e.Terms("mask"); len(got) != 1 || got[0].Arg != "m.png" {
+		t.Errorf("mask terms %+v", got)
+	}
+	if r := e.Args[0].Args[1].Rect(); r != image.Rect(0, 0, 1, 1) {
+		t.Errorf("rect %v", r)
+	}
+	l, _ := ParseSelectExpr("luma(<=0.25,4)")
+	if threshold, above, grow := l.Luma(); threshold != 0.25 || above || grow != 4 {
+		t.Errorf("luma %v %v %d", threshold, above, grow)
+	}
+}
+
+func TestParseSelectExprErrors(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"", "missing term"},
+		{"regions +", "missing term"},
+		{"+regions", `unexpected '+'`},
+		{"(regions", "missing )"},
+		{"regions)", `unexpected ")"`},
+		{"regions regions", `unexpected "regions"`},
+		{"rect(0,0,1,1", "missing ) after rect("},
+		{"rect(1,2,3)", "want rect(x,y,w,h)"},
+		{"rect(1,2,3,4,5)", "want rect(x,y,w,h)"},
+		{"rect(a,b,c,d)", "want rect(x,y,w,h)"},
+		{"rect(0,0,0,5)", "must be positive"},
+		{"regions(1)", "regions takes no arguments"},
+		{"faces", `unknown term "faces"`},
+		{"Regions", `unexpected 'R'`},
+		{"luma(0.9)", "want >=0.9"},
+		{"luma(>=1.5)", "between 0 and 1"},
+		{"luma(>=0.5,-1)", "grow must be"},
+		{"mask()", "mask needs a path"},
+		{"all - !", "missing term"},
+	}
+	for _, tt := range tests {
+		_, err := ParseSelectExpr(tt.in)
+		if err == nil {
+			t.Errorf("%q: accepted", tt.in)
+			continue
+		}
+		if !strings.Contains(err.Error(), tt.want) || !strings.Contains(err.Error(), "invalid selection") {
+			t.Errorf("%q: %v, want %q", tt.in, err, tt.want)
+		}
+	}
+}
+
+func TestSelectExprSelection(t *testing.T) {
+	e, err := ParseSelectExpr("regions + rect(30,0,10,10) - !mask(m.png) & all")
+	if err != nil {
+		t.Fatal(err)
+	}
+	regions := Rects(image.Rect(0, 0, 20, 20))
+	mask := Rects(image.Rect(5, 5, 35, 8))
+	var seen []string
+	sel, err := e.Selection(func(term SelectExpr) (Selection, error) {
+		seen = append(seen, term.String())
+		if term.Term == "regions" {
+			return regions, nil
+		}
+		return mask, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// all と rect は source を使わない
+	if !reflect.DeepEqual(seen, []string{"regions", "mask(m.png)"}) {
+		t.Errorf("source called for %v", seen)
+	}
+	bounds := image.Rect(0, 0, 50, 30)
+	got, want := NewBitmap(bounds), NewBitmap(bounds)
+	sel.Fill(got)
+	Subtract(Union(regions, Rects(image.Rect(30, 0, 40, 10))), Intersect(Invert(mask), Intersect())).Fill(want)
+	if !reflect.DeepEqual(got.words, want.words) {
+		t.Error("selection differs from the combinators")
+	}
+
+	errSource := errors.New("no such mask")
+	if _, err := e.Selection(func(SelectExpr) (Selection, error) { return nil, errSource }); err != errSource {
+		t.Errorf("source error: %v", err)
+	}
+}
@@ -0,0 +1,203 @@
+package mosaic
+
+import (
+	"image"
+	"math/bits"
+)
+
+// 処理する画素の選び方
+// 選ばなかった画素は WithExclude と同じく、タイルの色の計算に含めず元の値のまま残す
+// Fill はバンド (ブロックや列に分けた場合はその範囲) ごとに呼び出し、並列処理では複数のゴルーチンから同時に呼び出される
+type Selection interface {
+	// b.Rect の範囲で選ぶ画素のビットを立てる (呼び出し時の b はすべての画素を選んでいない)
+	Fill(b *Bitmap)
+}
+
+// 処理する画素を選ぶ条件を設定
+// 範囲やマスク、輝度などの選び方は Union、Intersect、Subtract、Invert で組み合わせられる
+func WithSelection(s Selection) Option {
+	return func(mp *Processor) {
+		mp.selection = s
+	}
+}
+
+// 範囲の画素ごとに 1 ビットを持つ、選んだ画素の集合
+// 行ごとに 64 画素を 1 語にまとめ、組み合わせは語ごとのビット演算で求める
+type Bitmap struct {
+	Rect   image.Rectangle
+	stride int // 1 行の語の数
+	words  []uint64
+}
+
+// r の範囲の、どの画素も選んでいないビットマップを生成
+func NewBitmap(r image.Rectangle) *Bitmap {
+	stride := (max(0, r.Dx()) + 63) / 64
+	return &Bitmap{Rect: r, stride: stride, words: make([]uint64, stride*max(0, r.Dy()))}
+}
+
+// (x, y) の画素を選んだかどうか (範囲外の画素は選んでいない)
+func (b *Bitmap) Contains(x, y int) bool {
+	if !(image.Point{x, y}.In(b.Rect)) {
+		return false
+	}
+	i := x - b.Rect.Min.X
+	return b.words[(y-b.Rect.Min.Y)*b.stride+i/64]&(1<<(i%64)) != 0
+}
+
+// (x, y) の画素を選ぶ (範囲外の場合は何もしない)
+func (b *Bitmap) Set(x, y int) {
+	if !(image.Point{x, y}.In(b.Rect)) {
+		return
+	}
+	i := x - b.Rect.Min.X
+	b.words[(y-b.Rect.Min.Y)*b.stride+i/64] |= 1 << (i % 64)
+}
+
+// r の範囲の画素をすべて選ぶ
+func (b *Bitmap) SetRect(r image.Rectangle) {
+	r = r.Intersect(b.Rect)
+	if r.Empty() {
+		return
+	}
+	from, to := r.Min.X-b.Rect.Min.X, r.Max.X-b.Rect.Min.X
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		row := b.row(y)
+		for i := from; i < to; {
+			n := min(to-i, 64-i%64)
+			row[i/64] |= (^uint64(0) >> (64 - n)) << (i % 64)
+			i += n
+		}
+	}
+}
+
+// 選んだ画素があるかどうか
+func (b *Bitmap) Any() bool {
+	for _, w := range b.words {
+		if w != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// 選んだ画素の数
+func (b *Bitmap) Count() int {
+	n := 0
+	for _, w := range b.words {
+		n += bits.OnesCount64(w)
+	}
+	return n
+}
+
+func (b *Bitmap) row(y int) []uint64 {
+	i := (y - b.Rect.Min.Y) * b.stride
+	return b.words[i : i+b.stride : i+b.stride]
+}
+
+// すべての画素の選択を反転する
+// 各行の末尾の語の範囲外のビットは 0 のまま保つ
+func (b *Bitmap) invert() {
+	last := ^uint64(0)
+	if n := b.Rect.Dx() % 64; n != 0 {
+		last >>= 64 - n
+	}
+	for i := range b.words {
+		b.words[i] = ^b.words[i]
+		if i%b.stride == b.stride-1 {
+			b.words[i] &= last
+		}
+	}
+}
+
+// 同じ範囲のビットマップと語ごとに op で組み合わせる
+func (b *Bitmap) combine(o *Bitmap, op func(a, b uint64) uint64) {
+	for i, w := range o.words {
+		b.words[i] = op(b.words[i], w)
+	}
+}
+
+// 矩形の範囲の画素を選ぶ Selection
+// 重なる矩形や画像の外にはみ出す矩形を含めてもよい
+func Rects(rects ...image.Rectangle) Selection {
+	return rectSelection(append([]image.Rectangle(nil), rects...))
+}
+
+type rectSelection []image.Rectangle
+
+func (s rectSelection) Fill(b *Bitmap) {
+	for _, r := range s {
+		b.SetRect(r)
+	}
+}
+
+// マスクの値が 0 でない画素を選ぶ Selection (WithMask と同じ選び方)
+// マスクの範囲外の画素は選ばない。マスクの座標は元画像と同じにすること
+func MaskSelection(mask *image.Alpha) Selection {
+	return maskSelection{mask}
+}
+
+type maskSelection struct{ mask *image.Alpha }
+
+func (s maskSelection) Fill(b *Bitmap) {
+	r := b.Rect.Intersect(s.mask.Rect)
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		i := s.mask.PixOffset(r.Min.X, y)
+		for x, a := range s.mask.Pix[i : i+r.Dx()] {
+			if a != 0 {
+				b.Set(r.Min.X+x, y)
+			}
+		}
+	}
+}
+
+// いずれかの Selection で選んだ画素を選ぶ Selection
+func Union(s ...Selection) Selection {
+	return combined{sels: append([]Selection(nil), s...), op: func(a, b uint64) uint64 { return a | b }}
+}
+
+// すべての Selection で選んだ画素を選ぶ Selection (引数がない場合はすべての画素)
+func Intersect(s ...Selection) Selection {
+	if len(s) == 0 {
+		return Invert(Rects())
+	}
+	return combined{sels: append([]Selection(nil), s...), op: func(a, b uint64) uint64 { return a & b }}
+}
+
+// s で選んだ画素のうち、minus のどれでも選んでいない画素を選ぶ Selection
+func Subtract(s Selection, minus ...Selection) Selection {
+	return combined{sels: append([]Selection{s}, minus...), op: func(a, b uint64) uint64 { return a &^ b }}
+}
+
+// s で選んでいない画素を選ぶ Selection
+func Invert(s Selection) Selection {
+	return inverted{s}
+}
+
+// 最初の Selection のビットマップに、残りの Selection のビットマップを順に op で組み合わせる
+type combined struct {
+	sels []Selection
+	op   func(a, b uint64) uint64
+}
+
+func (c combined) Fill(b *Bitmap) {
+	if len(c.sels) == 0 {
+		return
+	}
+	c.sels[0].Fill(b)
+	if len(c.sels) == 1 {
+		return
+	}
+	tmp := NewBitmap(b.Rect)
+	for _, s := range c.sels[1:] {
+		clear(tmp.words)
+		s.Fill(tmp)
+		b.combine(tmp, c.op)
+	}
+}
+
+type inverted struct{ s Selection }
+
+func (s inverted) Fill(b *Bitmap) {
+	s.s.Fill(b)
+	b.invert()
+}
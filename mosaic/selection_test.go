@@ -0,0 +1,139 @@
+package mosaic
+
+import (
+	"image"
+	"testing"
+)
+
+// b のすべての画素が in の通りに選ばれているか確かめる
+func assertBitmap(t *testing.T, name string, b *Bitmap, in func(x, y int) bool) {
+	t.Helper()
+	n := 0
+	for y := b.Rect.Min.Y; y < b.Rect.Max.Y; y++ {
+		for x := b.Rect.Min.X; x < b.Rect.Max.X; x++ {
+			if b.Contains(x, y) != in(x, y) {
+				t.Fatalf("%s: pixel (%d,%d) = %v, want %v", name, x, y, b.Contains(x, y), in(x, y))
+			}
+			if in(x, y) {
+				n++
+			}
+		}
+	}
+	if b.Count() != n || b.Any() != (n > 0) {
+		t.Errorf("%s: Count() = %d, Any() = %v, want %d", name, b.Count(), b.Any(), n)
+	}
+}
+
+func inRect(r image.Rectangle) func(x, y int) bool {
+	return func(x, y int) bool { return image.Pt(x, y).In(r) }
+}
+
+func TestBitmapSetRect(t *testing.T) {
+	// 語の境目をまたぐ範囲と、範囲の外にはみ出す矩形
+	b := NewBitmap(image.Rect(-3, 2, 197, 6))
+	b.SetRect(image.Rect(60, 3, 130, 5))
+	b.SetRect(image.Rect(190, -10, 300, 3))
+	assertBitmap(t, "set", b, func(x, y int) bool {
+		return inRect(image.Rect(60, 3, 130, 5))(x, y) || inRect(image.Rect(190, 2, 197, 3))(x, y)
+	})
+	b.Set(-3, 2)
+	b.Set(500, 500)
+	if !b.Contains(-3, 2) || b.Contains(500, 500) || b.Contains(-4, 2) {
+		t.Error("Set outside the bitmap")
+	}
+	// 反転しても各行の末尾の語の範囲外のビットは立てない
+	b = NewBitmap(image.Rect(0, 0, 70, 3))
+	b.SetRect(image.Rect(10, 1, 20, 2))
+	b.invert()
+	assertBitmap(t, "invert", b, func(x, y int) bool { return !inRect(image.Rect(10, 1, 20, 2))(x, y) })
+	if b.Count() != 70*3-10 {
+		t.Errorf("inverted Count() = %d", b.Count())
+	}
+}
+
+func TestSelectionCombinators(t *testing.T) {
+	a, b, c := image.Rect(0, 0, 40, 30), image.Rect(30, 20, 90, 50), image.Rect(10, 10, 70, 25)
+	mask := image.NewAlpha(image.Rect(5, 5, 100, 60))
+	for i := range mask.Pix {
+		if i%3 == 0 {
+			mask.Pix[i] = 1
+		}
+	}
+	inMask := func(x, y int) bool {
+		return image.Pt(x, y).In(mask.Rect) && mask.AlphaAt(x, y).A != 0
+	}
+	tests := []struct {
+		name string
+		s    Selection
+		in   func(x, y int) bool
+	}{
+		{"rects", Rects(a, b), func(x, y int) bool { return inRect(a)(x, y) || inRect(b)(x, y) }},
+		{"no rects", Rects(), func(x, y int) bool { return false }},
+		{"mask", MaskSelection(mask), inMask},
+		{"union", Union(Rects(a), Rects(b), Rects(c)), func(x, y int) bool { return inRect(a)(x, y) || inRect(b)(x, y) || inRect(c)(x, y) }},
+		{"intersect", Intersect(Rects(a), Rects(c)), func(x, y int) bool { return inRect(a)(x, y) && inRect(c)(x, y) }},
+		{"intersect nothing", Intersect(), func(x, y int) bool { return true }},
+		{"subtract", Subtract(Rects(a, b), Rects(c)), func(x, y int) bool { return (inRect(a)(x, y) || inRect(b)(x, y)) && !inRect(c)(x, y) }},
+		{"subtract several", Subtract(Rects(b), Rects(a), MaskSelection(mask)), func(x, y int) bool { return inRect(b)(x, y) && !inRect(a)(x, y) && !inMask(x, y) }},
+		{"invert", Invert(Rects(c)), func(x, y int) bool { return !inRect(c)(x, y) }},
+		{"nested", Union(Intersect(MaskSelection(mask), Rects(a)), Invert(Union(Rects(b), Rects(c)))), func(x, y int) bool {
+			return inMask(x, y) && inRect(a)(x, y) || !inRect(b)(x, y) && !inRect(c)(x, y)
+		}},
+	}
+	for _, tt := range tests {
+		// バンドの範囲ごとに Fill しても同じ
+		for _, r := range []image.Rectangle{image.Rect(0, 0, 100, 60), image.Rect(0, 16, 100, 24), image.Rect(-8, 40, 130, 70)} {
+			bm := NewBitmap(r)
+			tt.s.Fill(bm)
+			assertBitmap(t, tt.name, bm, tt.in)
+		}
+	}
+}
+
+// 選んだ範囲の境目のタイルは、選んだ画素だけを平均して塗り、選ばなかった画素は元のまま残す
+func TestSelectionAveragesIncludedPixels(t *testing.T) {
+	const tile = 8
+	img := testImage(61, 45)
+	mask := rectMask(img.Rect, image.Rect(40, 3, 58, 20))
+	sel := Subtract(Union(Rects(image.Rect(3, 5, 21, 30)), MaskSelection(mask)), Rects(image.Rect(10, 10, 14, 13), image.Rect(45, 0, 47, 45)))
+	selected := NewBitmap(img.Rect)
+	sel.Fill(selected)
+
+	for _, workers := range []int{1, 4} {
+		out := process(t, img, tile, WithSelection(sel), WithWorkers(workers))
+		for ty := 0; ty < img.Rect.Dy(); ty += tile {
+			for tx := 0; tx < img.Rect.Dx(); tx += tile {
+				r := image.Rect(tx, ty, tx+tile, ty+tile).Intersect(img.Rect)
+				var sum [3]int
+				n := 0
+				for y := r.Min.Y; y < r.Max.Y; y++ {
+					for x := r.Min.X; x < r.Max.X; x++ {
+						if selected.Contains(x, y) {
+							c := img.NRGBAAt(x, y)
+							sum[0], sum[1], sum[2] = sum[0]+int(c.R), sum[1]+int(c.G), sum[2]+int(c.B)
+							n++
+						}
+					}
+				}
+				for y := r.Min.Y; y < r.Max.Y; y++ {
+					for x := r.Min.X; x < r.Max.X; x++ {
+						want := img.NRGBAAt(x, y)
+						if selected.Contains(x, y) {
+							want.R, want.G, want.B = uint8((2*sum[0]+n)/(2*n)), uint8((2*sum[1]+n)/(2*n)), uint8((2*sum[2]+n)/(2*n))
+						}
+						if got := out.NRGBAAt(x, y); got != want {
+							t.Fatalf("workers %d: pixel (%d,%d) = %v, want %v", workers, x, y, got, want)
+						}
+					}
+				}
+			}
+		}
+	}
+}
+
+// Selection で範囲を選んだ場合は WithMask と同じ結果になる
+func TestSelectionMatchesMask(t *testing.T) {
+	img := testImage(64, 48)
+	r := image.Rect(5, 7, 40, 33)
+	assertSameImage(t, process(t, img, 8, WithSelection(Rects(r))), process(t, img, 8, WithMask(rectMask(img.Rect, r))))
+}
@@ -0,0 +1,26 @@
+package mosaic
+
+import "image"
+
+// Grid の行 (バンド) ごとに、WithSelection で選んだ画素を含むかどうかを求める
+// 選んだ画素を含まないバンドはすべてのタイルの画素を除外するため、読み込みも平均色の計算もせずに元画像のまま渡せる
+func (mp *Processor) selectedBands() []bool {
+	grid := mp.Grid()
+	bounds := mp.src.Bounds()
+	selected := make([]bool, grid.Rows)
+	for i := range selected {
+		y0 := grid.start().Y + i*mp.mosaicHeight
+		band := NewBitmap(image.Rect(bounds.Min.X, y0, bounds.Max.X, y0+mp.mosaicHeight).Intersect(bounds))
+		mp.selection.Fill(band)
+		selected[i] = band.Any()
+	}
+	return selected
+}
+
+// offset から始まるバンドを処理せずに済ませるかどうか
+func (mp *Processor) skipsBand(offset int) bool {
+	if mp.selected == nil {
+		return false
+	}
+	return !mp.selected[(offset-mp.Grid().start().Y)/mp.mosaicHeight]
+}
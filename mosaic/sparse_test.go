@@ -0,0 +1,119 @@
+package mosaic
+
+import (
+	"context"
+	"image"
+	"slices"
+	"sync"
+	"testing"
+)
+
+// rect の画素だけを選ぶマスク
+func rectMask(bounds, rect image.Rectangle) *image.Alpha {
+	mask := image.NewAlpha(bounds)
+	for y := rect.Min.Y; y < rect.Max.Y; y++ {
+		for x := rect.Min.X; x < rect.Max.X; x++ {
+			mask.Pix[mask.PixOffset(x, y)] = 0xff
+		}
+	}
+	return mask
+}
+
+// バンドを処理せずに済ませずに、すべてのバンドを処理した結果
+func processAllBands(t *testing.T, img *image.NRGBA, tile int, opts ...Option) *image.NRGBA {
+	t.Helper()
+	mp := New(img, tile, tile, opts...)
+	mp.selected = nil
+	out, err := mp.ProcessContext(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+func TestSparseBandsMatchFullProcessing(t *testing.T) {
+	const tile = 8
+	img := testImage(64, 200)
+	selected := image.Rect(20, 90, 30, 100)
+	mask := rectMask(img.Rect, selected)
+
+	for _, opts := range [][]Option{
+		{WithWorkers(1)},
+		{WithWorkers(4)},
+		{WithPrefetch(2)},
+		{WithGridOrigin(image.Pt(3, 5))},
+	} {
+		opts = append(opts, WithMask(mask))
+		mp := New(img, tile, tile, opts...)
+		if mp.selected == nil || slices.Index(mp.selected, true) < 0 || !slices.Contains(mp.selected, false) {
+			t.Fatalf("selected bands %v", mp.selected)
+		}
+		out, err := mp.ProcessContext(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertSameImage(t, out, processAllBands(t, img, tile, opts...))
+
+		// 選んだ画素を含まないバンドは元画像と同じバイト列
+		for y := img.Rect.Min.Y; y < img.Rect.Max.Y; y++ {
+			if y >= selected.Min.Y-tile && y < selected.Max.Y+tile {
+				continue
+			}
+			i := img.PixOffset(0, y)
+			if !slices.Equal(out.Pix[i:i+img.Stride], img.Pix[i:i+img.Stride]) {
+				t.Fatalf("row %d differs from the source", y)
+			}
+		}
+	}
+}
+
+func TestSparseBandsObserveEveryTile(t *testing.T) {
+	img := testImage(48, 96)
+	mask := rectMask(img.Rect, image.Rect(0, 40, 48, 48))
+	observe := func(skip bool) []TileInfo {
+		var mu sync.Mutex
+		var tiles []TileInfo
+		opts := []Option{WithMask(mask), WithTileObserver(func(info TileInfo) {
+			mu.Lock()
+			tiles = append(tiles, info)
+			mu.Unlock()
+		})}
+		if skip {
+			process(t, img, 8, opts...)
+		} else {
+			processAllBands(t, img, 8, opts...)
+		}
+		slices.SortFunc(tiles, func(a, b TileInfo) int { return (a.Y-b.Y)*1000 + a.X - b.X })
+		return tiles
+	}
+	// 処理しなかったバンドのタイルも、すべての画素を除外した場合と同じく Skipped で通知する
+	got, want := observe(true), observe(false)
+	if !slices.Equal(got, want) {
+		t.Errorf("observed tiles differ:\n%v\n%v", got, want)
+	}
+}
+
+// 大きな画像の小さな範囲だけを選んだ場合は、画像をコピーするのに近い速さになる
+func BenchmarkSparseSelection(b *testing.B) {
+	img := testImage(4096, 4096)
+	mask := rectMask(img.Rect, image.Rect(1000, 2000, 1300, 2200))
+	b.Run("copy", func(b *testing.B) {
+		b.SetBytes(int64(len(img.Pix)))
+		dst := image.NewNRGBA(img.Rect)
+		for i := 0; i < b.N; i++ {
+			copy(dst.Pix, img.Pix)
+		}
+	})
+	b.Run("sparse", func(b *testing.B) {
+		b.SetBytes(int64(len(img.Pix)))
+		for i := 0; i < b.N; i++ {
+			process(b, img, 16, WithMask(mask))
+		}
+	})
+	b.Run("full", func(b *testing.B) {
+		b.SetBytes(int64(len(img.Pix)))
+		for i := 0; i < b.N; i++ {
+			process(b, img, 16)
+		}
+	})
+}
@@ -0,0 +1,316 @@
+package mosaic
+
+import (
+	"image"
+	"image/color"
+)
+
+// バンドに対する処理の 1 段階
+// band の座標は画像全体の座標で、rect は band のうち処理すべき範囲 (画像の範囲に収めたもの)
+// rect の外側は書き換えてはならない
+// WithWorkers で並列に処理する場合、rect はバンドをタイルの列の境界で分割した一部になることがあり、
+// 同じバンドの別の範囲に対して同時に呼び出される
+type Stage interface {
+	Apply(band *image.NRGBA, rect image.Rectangle) error
+}
+
+// 上下のバンドの画素も参照する Stage (ぼかしなど)
+// Margin が 1 以上の場合、バンドは上下に Margin 行ずつ広げて元画像から読み込み (画像の端では画像の範囲まで)、
+// Apply の band はその行を含む。rect は元のバンドの範囲のままで、書き換えてよいのも rect の中だけなので、
+// 出力の画素が 2 度書き込まれることはない
+// 余白を持つ Stage がある場合、バンドはタイルの列に分割せず、WithBlockSize のブロックも使わない
+type MarginStage interface {
+	Stage
+	Margin() int
+}
+
+// Stage が必要とする上下の余白の行数 (MarginStage でない場合は 0)
+func stageMargin(s Stage) int {
+	if m, ok := s.(MarginStage); ok {
+		return max(0, m.Margin())
+	}
+	return 0
+}
+
+// 関数を Stage として扱う
+type StageFunc func(band *image.NRGBA, rect image.Rectangle) error
+
+func (f StageFunc) Apply(band *image.NRGBA, rect image.Rectangle) error {
+	return f(band, rect)
+}
+
+// 複数の Stage をバンドごとに順に実行する
+// Pipeline 自体も Stage なので、入れ子にできる
+type Pipeline struct {
+	stages []Stage
+}
+
+// Stage を順に実行する Pipeline を生成
+func NewPipeline(stages ...Stage) *Pipeline {
+	return &Pipeline{stages: stages}
+}
+
+// Stage を末尾に追加
+func (p *Pipeline) Append(stages ...Stage) {
+	p.stages = append(p.stages, stages...)
+}
+
+// 各 Stage の余白の合計
+func (p *Pipeline) Margin() int {
+	margin := 0
+	for _, s := range p.stages {
+		margin += stageMargin(s)
+	}
+	return margin
+}
+
+// 後の Stage が余白の行を参照できるよう、各 Stage は rect を後の Stage の余白の合計だけ上下に広げた範囲 (band の範囲まで) に適用する
+// MosaicStage の後に余白を持つ Stage を置く場合は、余白をタイルの高さの倍数にすると、余白の行のタイルも画像全体で処理した場合と同じになる
+func (p *Pipeline) Apply(band *image.NRGBA, rect image.Rectangle) error {
+	after := p.Margin()
+	for _, s := range p.stages {
+		after -= stageMargin(s)
+		r := rect
+		if after > 0 {
+			r.Min.Y, r.Max.Y = max(rect.Min.Y-after, band.Rect.Min.Y), min(rect.Max.Y+after, band.Rect.Max.Y)
+		}
+		if err := s.Apply(band, r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 処理に使う Pipeline を設定
+// 指定しない場合は、New の引数とオプションから MosaicStage を 1 つだけ持つ Pipeline を生成する
+// バンドの高さは New に渡したタイルの高さのままなので、MosaicStage の TileHeight はその約数にすること
+func WithPipeline(p *Pipeline) Option {
+	return func(mp *Processor) {
+		mp.pipeline = p
+	}
+}
+
+// タイルごとの平均色で塗りつぶす Stage
+// タイルは Origin を左上とする格子に並べ (Grid と同じ)、Apply の範囲はタイルを動かさず、処理する画素だけを選ぶ
+type MosaicStage struct {
+	TileWidth  int           // モザイクタイルの幅
+	TileHeight int           // モザイクタイルの高さ
+	TileColor  TileColorFunc // タイルの色を決める関数。nil の場合は平均色
+	Filter     TileFilter    // 平均色の画素の重み付け (TileColor が nil の場合だけ使う)
+	Rounding   Rounding      // 平均色の成分の丸め方 (TileColor が nil の場合と MeanColor に効く)
+	Exclude    ExcludeFunc   // 処理から除外する画素を決める関数。nil の場合はすべての画素を処理する
+	Selection  Selection     // 処理する画素の選び方 (画像全体の座標)。nil の場合はすべての画素を処理する
+	SkipEdges  float64       // EdgeEnergy がこれより大きいタイルを書き換えない。0 以下の場合はすべてのタイルを処理する
+	Pattern    TilePattern   // 処理するタイルを決める関数。nil の場合はすべてのタイルを処理する
+	Stripes    Stripes       // 処理する横縞。高さが 0 の場合はすべての行を処理する
+	Strength   *image.Gray   // タイルごとの処理の強さ (画像全体の座標、0〜255)。nil の場合はすべてのタイルを完全に処理する
+	Renderer   TileRenderer  // タイルを描画する処理。nil の場合は FlatRenderer
+	Adjusts    []ColorAdjust // 塗りつぶしの前にタイルの色を変換する処理
+	// Selection で選ばなかった画素の色も、画素ごとに Adjusts で変換する (AdjustAll)
+	AdjustOutside bool
+	Grain         Grain          // 塗りつぶし後に加えるノイズ
+	Opaque        bool           // 元画像がすべて不透明な場合は true にすると、平均色の計算で透明度を省く
+	Observe       func(TileInfo) // タイルを処理するたびに呼び出される関数。nil の場合は呼び出さない
+	Origin        image.Point    // 列と行の番号が 0, 0 のタイルの左上 (New では Grid の左上のタイル)
+
+	weights *tileWeights // Filter の重み (nil の場合はタイルごとに求める)
+	source  pixelAccess  // 一様な平均色を直接求める元画像 (NewImage の NRGBA 以外の画像、nil の場合はバンドから求める)
+}
+
+// タイルの平均色はタイルの中の画素だけから求めるため、余白は持たない
+func (s *MosaicStage) Margin() int {
+	return 0
+}
+
+func (s *MosaicStage) Apply(band *image.NRGBA, rect image.Rectangle) error {
+	if s.unchanged() {
+		return nil
+	}
+	filter := s.filter(rect)
+	if !s.Stripes.active() {
+		s.applyTiles(band, rect, filter)
+	} else {
+		// 処理する縞ごとに、縞の中だけでタイルを計算する
+		for _, r := range s.Stripes.split(rect) {
+			s.applyTiles(band, r, filter)
+		}
+	}
+	if s.adjustsOutside() {
+		adjustPixels(band, rect, filter.selected, false, s.Adjusts)
+	}
+	return nil
+}
+
+// rect の範囲をモザイクタイル単位で処理
+// rect の端がタイルの境界でない場合も、タイルは Origin を基準に並べ、rect の外側は書き換えない
+func (s *MosaicStage) applyTiles(band *image.NRGBA, rect image.Rectangle, filter pixelFilter) {
+	var (
+		excluded []excludedPixel
+		orig     []uint8
+	)
+	for y := rect.Min.Y - floorMod(rect.Min.Y-s.Origin.Y, s.TileHeight); y < rect.Max.Y; y += s.TileHeight {
+		row := floorDiv(y-s.Origin.Y, s.TileHeight)
+		for x := rect.Min.X - floorMod(rect.Min.X-s.Origin.X, s.TileWidth); x < rect.Max.X; x += s.TileWidth {
+			column := floorDiv(x-s.Origin.X, s.TileWidth)
+			tile := image.Rect(x, y, x+s.TileWidth, y+s.TileHeight).Intersect(rect)
+			if s.Pattern != nil && !s.Pattern(column, row) {
+				s.observe(TileInfo{X: column, Y: row, Rect: tile, Skipped: true})
+				continue
+			}
+			// 強さが 0 のタイルは書き換えず、途中の強さのタイルは混ぜるために元の画素を控える
+			var strength, full uint64
+			if s.Strength != nil {
+				if strength, full = tileStrength(s.Strength, tile); strength == 0 {
+					s.observe(TileInfo{X: column, Y: row, Rect: tile, Skipped: true})
+					continue
+				}
+				if strength < full {
+					orig = copyTile(orig, band, tile)
+				}
+			}
+
+			// 除外する画素の元の値を控えておき、描画の後に戻す
+			if filter.active() {
+				excluded = appendExcluded(excluded[:0], band, tile, filter)
+				if len(excluded) == tile.Dx()*tile.Dy() {
+					s.observe(TileInfo{X: column, Y: row, Rect: tile, Skipped: true})
+					continue
+				}
+			}
+
+			// モザイクタイルの色を計算
+			avgColor, skip := s.tileColor(band, tile, filter)
+			if skip {
+				s.observe(TileInfo{X: column, Y: row, Rect: tile, Skipped: true})
+				continue
+			}
+
+			// タイルの色を変換
+			for _, a := range s.Adjusts {
+				avgColor = a.Adjust(avgColor)
+			}
+
+			s.observe(TileInfo{
+				X:      column,
+				Y:      row,
+				Rect:   tile,
+				Color:  avgColor,
+				Pixels: tile.Dx()*tile.Dy() - len(excluded),
+			})
+
+			// モザイクタイルを描画
+			s.render(band, tile, avgColor)
+
+			// ノイズを加える
+			s.Grain.apply(band, tile, column, row)
+
+			if strength < full {
+				blendTile(band, tile, orig, strength, full)
+			}
+			restoreExcluded(band, excluded)
+		}
+	}
+}
+
+// rect のタイルをすべて処理しなかったものとして Observe に通知する (画素は書き換えない)
+// すべての画素を除外したバンドを applyTiles で処理した場合と同じタイルを同じ順に通知する
+func (s *MosaicStage) skipTiles(rect image.Rectangle) {
+	if s.Observe == nil {
+		return
+	}
+	rects := []image.Rectangle{rect}
+	if s.Stripes.active() {
+		rects = s.Stripes.split(rect)
+	}
+	for _, r := range rects {
+		for y := r.Min.Y - floorMod(r.Min.Y-s.Origin.Y, s.TileHeight); y < r.Max.Y; y += s.TileHeight {
+			row := floorDiv(y-s.Origin.Y, s.TileHeight)
+			for x := r.Min.X - floorMod(r.Min.X-s.Origin.X, s.TileWidth); x < r.Max.X; x += s.TileWidth {
+				tile := image.Rect(x, y, x+s.TileWidth, y+s.TileHeight).Intersect(r)
+				s.observe(TileInfo{X: floorDiv(x-s.Origin.X, s.TileWidth), Y: row, Rect: tile, Skipped: true})
+			}
+		}
+	}
+}
+
+// 1×1 のタイルを元の画素の色のまま塗る (画素を書き換えない) 設定かどうか
+// 色の変換やノイズ、独自の描画がなく、タイルの通知も不要な場合は、平均色の計算を省いてバンドをそのまま残す
+// 平均色は乗算済みの値で求めるため、半透明の画素は 1 画素のタイルでも元の色にならず、不透明な元画像だけに限る
+func (s *MosaicStage) unchanged() bool {
+	return s.TileWidth == 1 && s.TileHeight == 1 && s.Opaque && s.TileColor == nil && len(s.Adjusts) == 0 &&
+		s.Grain.Amount == 0 && s.Renderer == nil && s.Observe == nil
+}
+
+// Selection で選ばなかった画素を画素ごとに変換するかどうか
+func (s *MosaicStage) adjustsOutside() bool {
+	return s.AdjustOutside && s.Selection != nil && len(s.Adjusts) > 0
+}
+
+func (s *MosaicStage) observe(t TileInfo) {
+	if s.Observe != nil {
+		s.Observe(t)
+	}
+}
+
+// タイルの色を計算
+// SkipEdges によりタイルを書き換えない場合は skip を true にする
+// 既定の平均色は TileColor と同じ tileMean で PixelRegion を経由せずに直接計算し、一様な平均ではエッジの量も同じ走査で求める
+func (s *MosaicStage) tileColor(band *image.NRGBA, tile image.Rectangle, filter pixelFilter) (c color.NRGBA, skip bool) {
+	if s.TileColor == nil && s.Filter == BoxFilter && !filter.active() && s.SkipEdges > 0 {
+		c, edges := averageColorEdges(band, tile, s.Rounding)
+		return c, edges > s.SkipEdges
+	}
+	if s.SkipEdges > 0 && edgeEnergy(band, tile) > s.SkipEdges {
+		return color.NRGBA{}, true
+	}
+	if s.TileColor == nil {
+		full := image.Pt(tile.Min.X-floorMod(tile.Min.X-s.Origin.X, s.TileWidth), tile.Min.Y-floorMod(tile.Min.Y-s.Origin.Y, s.TileHeight))
+		return s.mean(filter).color(band, tile, full), false
+	}
+	return s.TileColor(PixelRegion{img: band, Rect: tile, filter: filter, rounding: s.Rounding}), false
+}
+
+// 既定の平均色の求め方
+func (s *MosaicStage) mean(filter pixelFilter) tileMean {
+	m := tileMean{weights: s.weights, filter: filter, rounding: s.Rounding, opaque: s.Opaque, source: s.source}
+	if m.weights == nil {
+		m.weights = newTileWeights(s.Filter, s.TileWidth, s.TileHeight)
+	}
+	return m
+}
+
+// rect の範囲を処理する場合の除外する画素の条件 (Selection はこの範囲のビットマップにする)
+func (s *MosaicStage) filter(rect image.Rectangle) pixelFilter {
+	f := pixelFilter{exclude: s.Exclude}
+	if s.Selection != nil {
+		f.selected = NewBitmap(rect)
+		s.Selection.Fill(f.selected)
+	}
+	return f
+}
+
+// タイルを描画
+// 独自の TileRenderer にはタイルの範囲に切り出した画像を渡し、範囲外に書き込めないようにする
+// 既定の単色の描画は、色を color.Color に変換すると (ヒープに確保されるため) タイルごとに確保が起きるため、FlatRenderer を直接呼ぶ
+func (s *MosaicStage) render(band *image.NRGBA, tile image.Rectangle, c color.NRGBA) {
+	if s.Renderer == nil {
+		FlatRenderer{}.Render(band, tile, c)
+		return
+	}
+	s.Renderer.Render(band.SubImage(tile).(*image.NRGBA), tile, c)
+}
+
+// すべての画素に ColorAdjust を適用する Stage
+// タイルの色ではなく画素ごとに変換するため、MosaicStage の前に置くと平均を取る前の色を調整できる
+type AdjustStage struct {
+	Adjust ColorAdjust
+}
+
+func (s AdjustStage) Apply(band *image.NRGBA, rect image.Rectangle) error {
+	for y := rect.Min.Y; y < rect.Max.Y; y++ {
+		for x := rect.Min.X; x < rect.Max.X; x++ {
+			band.SetNRGBA(x, y, s.Adjust.Adjust(band.NRGBAAt(x, y)))
+		}
+	}
+	return nil
+}
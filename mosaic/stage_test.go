@@ -0,0 +1,84 @@
+package mosaic
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"image"
+	"testing"
+)
+
+func TestPipelineOrderMatters(t *testing.T) {
+	img := testImage(96, 64)
+	contrast := Contrast(60)
+	mosaic := func() *MosaicStage { return &MosaicStage{TileWidth: 16, TileHeight: 16} }
+
+	adjustFirst := process(t, img, 16, WithPipeline(NewPipeline(AdjustStage{Adjust: contrast}, mosaic())))
+	mosaicFirst := process(t, img, 16, WithPipeline(NewPipeline(mosaic(), AdjustStage{Adjust: contrast})))
+	if bytes.Equal(adjustFirst.Pix, mosaicFirst.Pix) {
+		t.Fatal("changing the order of the stages did not change the result")
+	}
+	// 平均の後に画素ごとに調整するのは、タイルの色を調整するのと同じ
+	assertSameImage(t, mosaicFirst, process(t, img, 16, WithColorAdjust(contrast)))
+	// 調整の後に平均するのは、調整した画像を処理するのと同じ
+	adjusted := process(t, img, 16, WithPipeline(NewPipeline(AdjustStage{Adjust: contrast})))
+	assertSameImage(t, adjustFirst, process(t, adjusted, 16))
+}
+
+func TestDefaultPipelineIsMosaicStage(t *testing.T) {
+	img := testImageAt(image.Rect(5, 3, 101, 70))
+	want := process(t, img, 12)
+	got := process(t, img, 12, WithPipeline(NewPipeline(&MosaicStage{TileWidth: 12, TileHeight: 12})))
+	assertSameImage(t, got, want)
+}
+
+func TestUserStage(t *testing.T) {
+	img := testImage(50, 37)
+	var rects []image.Rectangle
+	invert := StageFunc(func(band *image.NRGBA, rect image.Rectangle) error {
+		rects = append(rects, rect)
+		for y := rect.Min.Y; y < rect.Max.Y; y++ {
+			for x := rect.Min.X; x < rect.Max.X; x++ {
+				i := band.PixOffset(x, y)
+				band.Pix[i], band.Pix[i+1], band.Pix[i+2] = 255-band.Pix[i], 255-band.Pix[i+1], 255-band.Pix[i+2]
+			}
+		}
+		return nil
+	})
+	out := process(t, img, 8, WithPipeline(NewPipeline(invert)), WithWorkers(1))
+	for i := range img.Pix {
+		want := 255 - img.Pix[i]
+		if i%4 == 3 {
+			want = img.Pix[i]
+		}
+		if out.Pix[i] != want {
+			t.Fatalf("byte %d = %d, want %d", i, out.Pix[i], want)
+		}
+	}
+	// バンドは上から順に、画像の範囲に収めて渡す
+	covered := 0
+	for i, r := range rects {
+		if !r.In(img.Rect) || i > 0 && r.Min.Y != rects[i-1].Max.Y {
+			t.Fatalf("band %d: rect %v (previous %v)", i, r, rects[max(i-1, 0)])
+		}
+		covered += r.Dy()
+	}
+	if covered != img.Rect.Dy() {
+		t.Errorf("bands cover %d rows, want %d", covered, img.Rect.Dy())
+	}
+}
+
+func TestStageError(t *testing.T) {
+	errStage := errors.New("stage failed")
+	calls := 0
+	failing := StageFunc(func(band *image.NRGBA, rect image.Rectangle) error {
+		if calls++; calls == 2 {
+			return errStage
+		}
+		return nil
+	})
+	_, err := New(testImage(40, 40), 8, 8, WithPipeline(NewPipeline(failing)), WithWorkers(1)).ProcessContext(context.Background())
+	if !errors.Is(err, errStage) {
+		t.Fatalf("err = %v, want %v", err, errStage)
+	}
+}
@@ -0,0 +1,186 @@
+package mosaic
+
+import (
+	_ "embed"
+	"fmt"
+	"image"
+	"image/color"
+	"slices"
+	"strings"
+)
+
+// 刺繍糸
+type Thread struct {
+	Code  string // 色番号 (例: 310)
+	Name  string
+	Color color.NRGBA
+}
+
+//go:embed dmcthreads.txt
+var dmcThreadData string
+
+// DMC の刺繍糸の色の表
+var DMCThreads = parseThreads(dmcThreadData)
+
+// 色番号、#RRGGBB、名前を並べた糸の表のファイルを解析
+// 埋め込んだファイルの誤りはプログラムの誤りのため、panic する
+func parseThreads(data string) []Thread {
+	var threads []Thread
+	for _, line := range strings.Split(data, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "# ") {
+			continue
+		}
+		fields := strings.Fields(line)
+		var r, g, b uint8
+		if len(fields) < 3 {
+			panic(fmt.Sprintf("mosaic: invalid thread line %q", line))
+		}
+		if _, err := fmt.Sscanf(fields[1], "#%02x%02x%02x", &r, &g, &b); err != nil {
+			panic(fmt.Sprintf("mosaic: invalid thread line %q", line))
+		}
+		threads = append(threads, Thread{
+			Code:  fields[0],
+			Name:  strings.Join(fields[2:], " "),
+			Color: color.NRGBA{R: r, G: g, B: b, A: 255},
+		})
+	}
+	return threads
+}
+
+// 図案の記号に使う文字
+// 見分けにくい I と O は使わない
+const stitchSymbols = "ABCDEFGHJKLMNPQRSTUVWXYZ0123456789"
+
+// i 番目の糸の記号
+// 1 文字の記号を使い切った後は、2 文字の組み合わせを使う
+func stitchSymbol(i int) string {
+	n := len(stitchSymbols)
+	if i < n {
+		return stitchSymbols[i : i+1]
+	}
+	i -= n
+	return stitchSymbols[i/n%n:i/n%n+1] + stitchSymbols[i%n:i%n+1]
+}
+
+// クロスステッチの図案
+// タイルを 1 マスとし、タイルの色を糸の表の最も近い色 (PaletteMatcher と同じ基準) に置き換える
+// 書き換えなかったタイルと完全に透明なタイルは、刺さないマスとする
+type StitchChart struct {
+	Columns, Rows int
+	threads       []Thread
+	matcher       *PaletteMatcher
+	cells         []int // 行ごとに左から並べたマスの糸 (threads の添字、-1 は刺さないマス)
+}
+
+func NewStitchChart(columns, rows int, threads []Thread) *StitchChart {
+	colors := make([]color.NRGBA, len(threads))
+	for i, t := range threads {
+		colors[i] = t.Color
+	}
+	cells := make([]int, columns*rows)
+	for i := range cells {
+		cells[i] = -1
+	}
+	return &StitchChart{Columns: columns, Rows: rows, threads: threads, matcher: NewPaletteMatcher(colors), cells: cells}
+}
+
+// WithTileObserver に渡す関数
+// 異なるタイルに対しては、複数のゴルーチンから同時に呼び出せる
+func (c *StitchChart) Observe(t TileInfo) {
+	if t.X < 0 || t.X >= c.Columns || t.Y < 0 || t.Y >= c.Rows {
+		return
+	}
+	i := -1
+	if !t.Skipped && t.Color.A != 0 {
+		i = c.matcher.Nearest(t.Color)
+	}
+	c.cells[t.Y*c.Columns+t.X] = i
+}
+
+// 図案の凡例の 1 行
+type StitchLegendEntry struct {
+	Symbol string
+	Thread Thread
+	Count  int // 刺すマスの数
+}
+
+// 図案で使う糸の凡例
+// 刺すマスの多い順 (同じ数の場合は糸の表の順) に並べ、その順に記号を割り当てる
+// 記号は図案の内容だけから決まるため、同じ図案からは常に同じ凡例になる
+func (c *StitchChart) Legend() []StitchLegendEntry {
+	counts := make([]int, len(c.threads))
+	for _, i := range c.cells {
+		if i >= 0 {
+			counts[i]++
+		}
+	}
+	var legend []StitchLegendEntry
+	for i, n := range counts {
+		if n > 0 {
+			legend = append(legend, StitchLegendEntry{Thread: c.threads[i], Count: n})
+		}
+	}
+	// 糸の表の順に並んでいるため、安定ソートで同じ数の糸の順序を保つ
+	slices.SortStableFunc(legend, func(a, b StitchLegendEntry) int { return b.Count - a.Count })
+	for i := range legend {
+		legend[i].Symbol = stitchSymbol(i)
+	}
+	return legend
+}
+
+// 図案の線の色
+var (
+	stitchGridColor  = color.NRGBA{0xa0, 0xa0, 0xa0, 0xff}
+	stitchMajorColor = color.NRGBA{0x30, 0x30, 0x30, 0xff}
+	stitchEmptyColor = color.NRGBA{0xff, 0xff, 0xff, 0xff}
+)
+
+// 10 マスごとに太い線を引く
+const stitchMajorEvery = 10
+
+// 1 マスを cell×cell の画素で描いた図案の画像
+// マスは糸の色で塗って記号を描き、マスの境界に細い線を、10 マスごとと外周に 2px の太い線を引く
+func (c *StitchChart) Image(cell int) *image.NRGBA {
+	legend := c.Legend()
+	symbols := map[string]string{}
+	for _, e := range legend {
+		symbols[e.Thread.Code] = e.Symbol
+	}
+	img := image.NewNRGBA(image.Rect(0, 0, c.Columns*cell+2, c.Rows*cell+2))
+	fillRect(img, img.Rect, stitchEmptyColor)
+	for y := 0; y < c.Rows; y++ {
+		for x := 0; x < c.Columns; x++ {
+			i := c.cells[y*c.Columns+x]
+			if i < 0 {
+				continue
+			}
+			t := c.threads[i]
+			rect := image.Rect(x*cell+1, y*cell+1, (x+1)*cell, (y+1)*cell)
+			fillRect(img, rect, t.Color)
+			symbol := symbols[t.Code]
+			scale := max(1, min(cell/2/glyphHeight, (cell-4)/textWidth(symbol)))
+			if textWidth(symbol)*scale <= rect.Dx() && glyphHeight*scale <= rect.Dy() {
+				drawText(img, rect, symbol, scale, labelInk(t.Color))
+			}
+		}
+	}
+	// 細い線をすべて引いた後に、太い線を重ねる
+	c.drawLines(img, cell, 1, 1, stitchGridColor)
+	c.drawLines(img, cell, stitchMajorEvery, 2, stitchMajorColor)
+	return img
+}
+
+// every マスごとと外周に、幅 width の線を縦横に引く
+func (c *StitchChart) drawLines(img *image.NRGBA, cell, every, width int, line color.NRGBA) {
+	for x := 0; x <= c.Columns; x++ {
+		if x%every == 0 || x == c.Columns {
+			fillRect(img, image.Rect(x*cell, 0, x*cell+width, img.Rect.Max.Y), line)
+		}
+	}
+	for y := 0; y <= c.Rows; y++ {
+		if y%every == 0 || y == c.Rows {
+			fillRect(img, image.Rect(0, y*cell, img.Rect.Max.X, y*cell+width), line)
+		}
+	}
+}
@@ -0,0 +1,50 @@
+package mosaic
+
+import "image"
+
+// タイルごとの処理の強さを決めるグレースケールのマップを設定
+// マップの値は 0 で元画像のまま、255 で完全にモザイク処理することを表し、
+// タイルの強さはタイルの範囲のマップの平均になる
+// 途中の値のタイルは、画素ごとに 元画像 × (1 − 強さ) + モザイク × 強さ で混ぜる
+// マップは画像全体と同じ座標で参照するため、画像と同じ範囲にすること
+func WithStrengthMap(m *image.Gray) Option {
+	return func(mp *Processor) {
+		mp.strength = m
+	}
+}
+
+// tile の範囲のマップの値の合計と、すべてが 255 の場合の合計
+func tileStrength(m *image.Gray, tile image.Rectangle) (sum, full uint64) {
+	tile = tile.Intersect(m.Rect)
+	for y := tile.Min.Y; y < tile.Max.Y; y++ {
+		i := m.PixOffset(tile.Min.X, y)
+		for _, v := range m.Pix[i : i+tile.Dx()] {
+			sum += uint64(v)
+		}
+	}
+	return sum, 255 * uint64(tile.Dx()*tile.Dy())
+}
+
+// tile の範囲の画素を控えたスライスを返す (buf を再利用する)
+func copyTile(buf []uint8, img *image.NRGBA, tile image.Rectangle) []uint8 {
+	buf = buf[:0]
+	for y := tile.Min.Y; y < tile.Max.Y; y++ {
+		i := img.PixOffset(tile.Min.X, y)
+		buf = append(buf, img.Pix[i:i+4*tile.Dx()]...)
+	}
+	return buf
+}
+
+// 描画後の tile の範囲の画素を、copyTile で控えた元の画素と sum/full の割合で混ぜる
+// 整数で計算するため、結果は実行環境によらない
+func blendTile(img *image.NRGBA, tile image.Rectangle, orig []uint8, sum, full uint64) {
+	width := 4 * tile.Dx()
+	for y := tile.Min.Y; y < tile.Max.Y; y++ {
+		i := img.PixOffset(tile.Min.X, y)
+		row := img.Pix[i : i+width]
+		src := orig[(y-tile.Min.Y)*width:]
+		for x := range row {
+			row[x] = uint8((uint64(src[x])*(full-sum) + uint64(row[x])*sum + full/2) / full)
+		}
+	}
+}
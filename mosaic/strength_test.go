@@ -0,0 +1,50 @@
+package mosaic
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"testing"
+)
+
+// r の範囲で値が v のマップ
+func uniformGray(r image.Rectangle, v uint8) *image.Gray {
+	m := image.NewGray(r)
+	draw.Draw(m, r, image.NewUniform(color.Gray{v}), image.Point{}, draw.Src)
+	return m
+}
+
+func TestStrengthMap(t *testing.T) {
+	src := testImage(50, 37)
+	full := process(t, src, 8)
+
+	// すべて 255 のマップは完全なモザイク、すべて 0 のマップは元画像のまま
+	assertSameImage(t, process(t, src, 8, WithStrengthMap(uniformGray(src.Rect, 255))), full)
+	assertSameImage(t, process(t, src, 8, WithStrengthMap(uniformGray(src.Rect, 0))), src)
+
+	// 途中の値は画素ごとに元画像とモザイクを混ぜる
+	half := process(t, src, 8, WithStrengthMap(uniformGray(src.Rect, 102)))
+	for i := range half.Pix {
+		want := (uint64(src.Pix[i])*153 + uint64(full.Pix[i])*102 + 127) / 255
+		if uint64(half.Pix[i]) != want {
+			t.Fatalf("byte %d = %d, want %d (original %d, mosaic %d)", i, half.Pix[i], want, src.Pix[i], full.Pix[i])
+		}
+	}
+
+	// タイルの強さはタイルの範囲の平均で決まる
+	// 左の 3 列のタイルは 255、それより右は 0 にする
+	m := uniformGray(src.Rect, 0)
+	draw.Draw(m, image.Rect(0, 0, 24, 37), image.NewUniform(color.Gray{255}), image.Point{}, draw.Src)
+	out := process(t, src, 8, WithStrengthMap(m))
+	for y := 0; y < 37; y++ {
+		for x := 0; x < 50; x++ {
+			want := src.NRGBAAt(x, y)
+			if x < 24 {
+				want = full.NRGBAAt(x, y)
+			}
+			if got := out.NRGBAAt(x, y); got != want {
+				t.Fatalf("pixel (%d, %d) = %v, want %v", x, y, got, want)
+			}
+		}
+	}
+}
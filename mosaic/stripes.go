@@ -0,0 +1,64 @@
+package mosaic
+
+import (
+	"fmt"
+	"image"
+	"strconv"
+	"strings"
+)
+
+// 横縞の範囲だけを処理する設定
+// 画像の原点から Process 行を処理し、続く Skip 行は元画像のまま残すことを繰り返す
+// 縞の境界はタイルの境界にそろえる必要はなく、縞にまたがるタイルは縞の中の部分を 1 つのタイルとして色を計算する
+type Stripes struct {
+	Process int // 処理する縞の高さ (px)
+	Skip    int // 元画像のまま残す縞の高さ (px)
+}
+
+// 横縞の範囲だけを処理する設定
+// process か skip が 0 以下の場合はすべての行を処理する
+// タイルの観察 (WithTileObserver) は縞で分けたタイルの部分ごとに行い、処理しない縞の中のタイルは通知しない
+func WithStripes(process, skip int) Option {
+	return func(mp *Processor) {
+		mp.stripes = Stripes{Process: process, Skip: skip}
+	}
+}
+
+// 40:20 形式 (処理する高さ:残す高さ) の横縞を解析
+func ParseStripes(s string) (Stripes, error) {
+	process, skip, ok := strings.Cut(s, ":")
+	p, err1 := strconv.Atoi(strings.TrimSpace(process))
+	k, err2 := strconv.Atoi(strings.TrimSpace(skip))
+	if !ok || err1 != nil || err2 != nil || p <= 0 || k <= 0 {
+		return Stripes{}, fmt.Errorf("invalid stripe %q (want processed:skipped heights such as 40:20)", s)
+	}
+	return Stripes{Process: p, Skip: k}, nil
+}
+
+// 40:20 形式の文字列
+func (s Stripes) String() string {
+	return strconv.Itoa(s.Process) + ":" + strconv.Itoa(s.Skip)
+}
+
+func (s Stripes) active() bool {
+	return s.Process > 0 && s.Skip > 0
+}
+
+// rect のうち処理する縞と重なる範囲を上から順に返す
+func (s Stripes) split(rect image.Rectangle) []image.Rectangle {
+	period := s.Process + s.Skip
+	var rects []image.Rectangle
+	// rect の上端を含む縞の周期の始まりから、縞を順に rect と重ねる
+	start := rect.Min.Y - floorMod(rect.Min.Y, period)
+	for y := start; y < rect.Max.Y; y += period {
+		if r := rect.Intersect(image.Rect(rect.Min.X, y, rect.Max.X, y+s.Process)); !r.Empty() {
+			rects = append(rects, r)
+		}
+	}
+	return rects
+}
+
+// 負の値でも 0 以上 m 未満になる剰余
+func floorMod(a, m int) int {
+	return (a%m + m) % m
+}
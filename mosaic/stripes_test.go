@@ -0,0 +1,72 @@
+package mosaic
+
+import (
+	"image"
+	"image/draw"
+	"testing"
+)
+
+// 処理する縞の行だけを、縞で切ったタイルごとにモザイク処理し、残す縞の行は元画像のまま残す
+func TestStripes(t *testing.T) {
+	// 16px のタイルは 3×7 並び、縞の境界 (40、60) はタイルの境界にそろっていない
+	src := testImage(48, 100)
+	out := process(t, src, 16, WithStripes(40, 20))
+
+	processed := []image.Rectangle{image.Rect(0, 0, 48, 40), image.Rect(0, 60, 48, 100)}
+	for y := 0; y < 100; y++ {
+		inStripe := y < 40 || y >= 60
+		for x := 0; x < 48; x++ {
+			if !inStripe && out.NRGBAAt(x, y) != src.NRGBAAt(x, y) {
+				t.Fatalf("pixel (%d, %d) in a skipped stripe was changed", x, y)
+			}
+		}
+	}
+	for _, stripe := range processed {
+		for ty := 0; ty < 7; ty++ {
+			for tx := 0; tx < 3; tx++ {
+				piece := image.Rect(tx*16, ty*16, tx*16+16, ty*16+16).Intersect(stripe)
+				if piece.Empty() {
+					continue
+				}
+				// 縞の中の部分だけを 1 つのタイルとして処理した色
+				crop := image.NewNRGBA(image.Rect(0, 0, piece.Dx(), piece.Dy()))
+				draw.Draw(crop, crop.Rect, src, piece.Min, draw.Src)
+				want := process(t, crop, 16).NRGBAAt(0, 0)
+				for y := piece.Min.Y; y < piece.Max.Y; y++ {
+					for x := piece.Min.X; x < piece.Max.X; x++ {
+						if got := out.NRGBAAt(x, y); got != want {
+							t.Fatalf("piece %v: pixel (%d, %d) = %v, want %v", piece, x, y, got, want)
+						}
+					}
+				}
+			}
+		}
+	}
+
+	// 処理しない縞の中のタイルは通知しない
+	var observed []image.Rectangle
+	process(t, src, 16, WithStripes(40, 20), WithWorkers(1), WithTileObserver(func(tile TileInfo) {
+		observed = append(observed, tile.Rect)
+	}))
+	for _, r := range observed {
+		if r.Max.Y > 40 && r.Min.Y < 60 {
+			t.Errorf("observed tile %v overlaps the skipped stripe", r)
+		}
+	}
+	// 0〜40 はタイルの 3 行 (高さ 16, 16, 8)、60〜100 は 4 行 (高さ 4, 16, 16, 4)
+	if len(observed) != 3*3+3*4 {
+		t.Errorf("%d tiles observed, want 21", len(observed))
+	}
+}
+
+func TestParseStripes(t *testing.T) {
+	s, err := ParseStripes(" 40 : 20 ")
+	if err != nil || s != (Stripes{Process: 40, Skip: 20}) || s.String() != "40:20" {
+		t.Errorf("ParseStripes = %+v, %v", s, err)
+	}
+	for _, bad := range []string{"", "40", "40:", ":20", "0:20", "40:0", "-1:5", "a:b"} {
+		if _, err := ParseStripes(bad); err == nil {
+			t.Errorf("ParseStripes(%q) accepted", bad)
+		}
+	}
+}
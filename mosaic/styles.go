@@ -0,0 +1,111 @@
+package mosaic
+
+import (
+	"image"
+	"image/color"
+)
+
+// タイルを背景の上の円として描く TileRenderer
+// 円の直径はタイルの小さい方の辺の 9 割で、縁はアンチエイリアスする
+type DotRenderer struct {
+	// 円の外側の色 (透明度が 0 の場合は透明にする)
+	Background color.NRGBA
+}
+
+// 円や角丸を描くタイルの最小の大きさ (px)
+// これより小さいタイルはタイルの色で塗りつぶすだけにする
+const styleMinSize = 4
+
+func (r DotRenderer) Render(dst *image.NRGBA, tile image.Rectangle, c color.NRGBA) {
+	tile = tile.Intersect(dst.Bounds())
+	if tile.Empty() {
+		return
+	}
+	size := min(tile.Dx(), tile.Dy())
+	if size < styleMinSize {
+		FlatRenderer{}.Render(dst, tile, c)
+		return
+	}
+	FlatRenderer{}.Render(dst, tile, r.Background)
+	cx := float64(tile.Min.X) + float64(tile.Dx())/2
+	cy := float64(tile.Min.Y) + float64(tile.Dy())/2
+	fillCircle(dst, tile, cx, cy, float64(size)*0.45, c)
+}
+
+// タイルを角の丸い四角形として描く TileRenderer
+// 右と下に隙間を空け、角の半径はタイルの小さい方の辺の 1/4 にする
+type RoundedRenderer struct {
+	// 隙間と角の外側の色 (透明度が 0 の場合は透明にする)
+	Background color.NRGBA
+}
+
+func (r RoundedRenderer) Render(dst *image.NRGBA, tile image.Rectangle, c color.NRGBA) {
+	tile = tile.Intersect(dst.Bounds())
+	if tile.Empty() {
+		return
+	}
+	if min(tile.Dx(), tile.Dy()) < styleMinSize {
+		FlatRenderer{}.Render(dst, tile, c)
+		return
+	}
+	FlatRenderer{}.Render(dst, tile, r.Background)
+	brick := insetGap(tile)
+	radius := min(brick.Dx(), brick.Dy()) / 4
+
+	// 角を除いた十字を塗り、四隅に円の 1/4 を描く
+	b := brick
+	FlatRenderer{}.Render(dst, image.Rect(b.Min.X+radius, b.Min.Y, b.Max.X-radius, b.Max.Y), c)
+	FlatRenderer{}.Render(dst, image.Rect(b.Min.X, b.Min.Y+radius, b.Max.X, b.Max.Y-radius), c)
+	if radius == 0 {
+		return
+	}
+	rf := float64(radius)
+	corners := []struct {
+		clip   image.Rectangle
+		cx, cy int
+	}{
+		{image.Rect(b.Min.X, b.Min.Y, b.Min.X+radius, b.Min.Y+radius), b.Min.X + radius, b.Min.Y + radius},
+		{image.Rect(b.Max.X-radius, b.Min.Y, b.Max.X, b.Min.Y+radius), b.Max.X - radius, b.Min.Y + radius},
+		{image.Rect(b.Min.X, b.Max.Y-radius, b.Min.X+radius, b.Max.Y), b.Min.X + radius, b.Max.Y - radius},
+		{image.Rect(b.Max.X-radius, b.Max.Y-radius, b.Max.X, b.Max.Y), b.Max.X - radius, b.Max.Y - radius},
+	}
+	for _, corner := range corners {
+		fillCircle(dst, corner.clip, float64(corner.cx), float64(corner.cy), rf, c)
+	}
+}
+
+// タイルの間に目地を入れたタイル張りのように描く TileRenderer
+// 目地は右と下にだけ入れ、隣のタイルとの間を 1 本にする
+type GroutRenderer struct {
+	// 目地の色 (透明度が 0 の場合は透明にする)
+	Grout color.NRGBA
+	// 目地の幅 (px、0 の場合はタイルの小さい方の辺の 1/8、最低 1px)
+	Width int
+}
+
+func (r GroutRenderer) Render(dst *image.NRGBA, tile image.Rectangle, c color.NRGBA) {
+	tile = tile.Intersect(dst.Bounds())
+	if tile.Empty() {
+		return
+	}
+	width := r.Width
+	if width <= 0 {
+		width = max(1, min(tile.Dx(), tile.Dy())/8)
+	}
+	if tile.Dx() <= width || tile.Dy() <= width {
+		FlatRenderer{}.Render(dst, tile, c)
+		return
+	}
+	FlatRenderer{}.Render(dst, tile, r.Grout)
+	FlatRenderer{}.Render(dst, image.Rect(tile.Min.X, tile.Min.Y, tile.Max.X-width, tile.Max.Y-width), c)
+}
+
+// 右と下にタイルの 1/16 (最低 1px) の隙間を空けた範囲
+// 隙間を空けられない小さなタイルはそのまま返す
+func insetGap(tile image.Rectangle) image.Rectangle {
+	gap := max(1, min(tile.Dx(), tile.Dy())/16)
+	if tile.Dx() <= gap || tile.Dy() <= gap {
+		return tile
+	}
+	return image.Rect(tile.Min.X, tile.Min.Y, tile.Max.X-gap, tile.Max.Y-gap)
+}
@@ -0,0 +1,70 @@
+package mosaic
+
+// RunSummary の形式の版
+// フィールドを削除した場合や意味を変えた場合に上げる (フィールドの追加では上げない)
+const SummaryVersion = 2
+
+// コマンドの 1 回の実行の要約 (apply と batch の -json の出力)
+// 1 枚の画像を処理した場合も Files の要素が 1 つの同じ形式にする
+type RunSummary struct {
+	Version int           `json:"version"` // SummaryVersion
+	Total   int           `json:"total"`
+	Failed  int           `json:"failed"`
+	Skipped int           `json:"skipped"`
+	Files   []FileSummary `json:"files"`
+}
+
+// 1 つの入力の処理の要約
+type FileSummary struct {
+	Input    string         `json:"input"`
+	Output   string         `json:"output"`
+	Status   string         `json:"status"` // ok、failed、skipped のいずれか
+	Error    string         `json:"error,omitempty"`
+	Format   string         `json:"format,omitempty"` // 入力の形式
+	Width    int            `json:"width,omitempty"`
+	Height   int            `json:"height,omitempty"`
+	Options  SummaryOptions `json:"options"`
+	Settings Options        `json:"settings"` // 処理結果に影響する設定 (Canonical にしたもの)
+	Timing   SummaryTiming  `json:"timing"`
+	BytesOut int64          `json:"bytes_out"`        // 出力の画像 (または SVG などの文書) のバイト数
+	Digest   string         `json:"digest,omitempty"` // -digest の処理結果の画素の Digest (求められなかった場合は空)
+	Warnings []Warning      `json:"warnings"`         // 処理中に記録した警告 (版 1 ではメッセージの文字列)
+	Memory   *SummaryMemory `json:"memory,omitempty"` // 主なメモリの確保の見積もり (デコードする前に失敗した場合は nil)
+}
+
+// 処理に使った設定 (-tile-mm の換算や -parallel 0 の解決などを済ませた値)
+type SummaryOptions struct {
+	Tile         int     `json:"tile"`
+	TileMM       float64 `json:"tile_mm,omitempty"`
+	DPI          float64 `json:"dpi,omitempty"` // タイルの大きさの換算に使った解像度
+	GridOrigin   [2]int  `json:"grid_origin"`
+	Workers      int     `json:"workers"`
+	ColorSpace   string  `json:"color_space"`   // rgb、lab または hsv
+	OutputFormat string  `json:"output_format"` // jpeg などの画像の形式、または svg などのタイルを要素で表す形式
+	Quality      int     `json:"quality,omitempty"`
+	RegionTiles  []int   `json:"region_tiles,omitempty"` // -region-min-tiles で範囲ごとに選んだタイルの大きさ (範囲の順)
+}
+
+// 主なメモリの確保の見積もりと、段階ごとに観測したヒープの変化 (バイト)
+// 見積もりは画像の大きさと設定から求めた値で、実際の確保とは一致しないことがある
+type SummaryMemory struct {
+	Decoded int64 `json:"decoded"` // デコーダーが返す画像
+	Source  int64 `json:"source"`  // NRGBA の元画像
+	Bands   int64 `json:"bands"`   // バンドかブロックのバッファ
+	Output  int64 `json:"output"`  // 元画像とは別に確保する出力や作業用の画像
+	Encoder int64 `json:"encoder"` // エンコーダーのバッファ (大きさが分からない場合は 0)
+	Planned int64 `json:"planned"` // 見積もりの合計
+
+	// 段階 (decode、process、encode) ごとの runtime.MemStats.HeapInuse の変化
+	// 回収されていない不要な確保も含み、バンドごとにエンコードする場合や TIFF のページでは process にエンコードやデコードを含む
+	HeapInuse map[string]int64 `json:"heap_inuse_delta"`
+}
+
+// 段階ごとの処理時間 (秒)
+// バンドごとにエンコードする場合は、エンコードに使った時間を除いた残りを処理の時間とする
+type SummaryTiming struct {
+	Decode  float64 `json:"decode"`
+	Process float64 `json:"process"`
+	Encode  float64 `json:"encode"`
+	Total   float64 `json:"total"`
+}
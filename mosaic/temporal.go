@@ -0,0 +1,124 @@
+package mosaic
+
+import (
+	"image/color"
+	"math"
+)
+
+// 動画など連続するフレームで、タイルの色のちらつきを抑える平滑化
+// タイルの位置ごとに前のフレームの色を保持し、新しい色を指数的に近づける
+// 色が Threshold より大きく変わった場合 (場面の切り替わり) は、平滑化せずに新しい色にする
+//
+// フレームごとに処理に使う格子 (Processor の Grid) を Frame に渡してから、TileColor を WithTileColor に渡して処理する
+// 1 つのフレームの処理中は異なるタイルに対して同時に呼び出されても安全だが、
+// 複数のフレームを同時に処理してはならない
+type TemporalSmoother struct {
+	Factor    float64       // 前のフレームの色の割合 (0〜1)。0 の場合は平滑化しない
+	Threshold float64       // 場面の切り替わりとみなす RGBA の距離 (0〜510)
+	Color     TileColorFunc // タイルの色を決める関数。nil の場合は Filter で重み付けした平均色
+	Filter    TileFilter    // Color が nil の場合の平均色の画素の重み付け (WithTileFilter と同じ)
+
+	grid    Grid          // 現在のフレームのタイルの格子
+	weights *tileWeights  // Filter の重み (BoxFilter の場合は nil)
+	state   [][4]float64  // タイルごとの平滑化した色
+	output  []color.NRGBA // タイルごとに前のフレームで返した色
+	valid   []bool        // state に前のフレームの色があるかどうか
+}
+
+// 平滑化を生成
+func NewTemporalSmoother(factor, threshold float64) *TemporalSmoother {
+	return &TemporalSmoother{Factor: factor, Threshold: threshold}
+}
+
+// 格子 grid のタイルに分けたフレームの処理を始める
+// 前のフレームと格子 (範囲、タイルの大きさ、原点) が異なる場合は、タイルの並びが変わるため保持している色を捨てる
+func (t *TemporalSmoother) Frame(grid Grid) {
+	if grid == t.grid && t.state != nil {
+		return
+	}
+	t.grid = grid
+	t.weights = nil
+	if grid.TileWidth > 0 && grid.TileHeight > 0 {
+		t.weights = newTileWeights(t.Filter, grid.TileWidth, grid.TileHeight)
+	}
+	n := grid.Columns * grid.Rows
+	t.state = make([][4]float64, n)
+	t.output = make([]color.NRGBA, n)
+	t.valid = make([]bool, n)
+}
+
+// 前のフレームの色を捨てる
+func (t *TemporalSmoother) Reset() {
+	t.state = nil
+	t.output = nil
+	t.valid = nil
+}
+
+// 平滑化したタイルの色を返す TileColorFunc
+func (t *TemporalSmoother) TileColor(pixels PixelRegion) color.NRGBA {
+	// タイルの左上の画素を含む格子のタイルから位置を決める
+	cell, ok := t.grid.CellAt(pixels.Rect.Min.X, pixels.Rect.Min.Y)
+	var c color.NRGBA
+	switch {
+	case t.Color != nil:
+		c = t.Color(pixels)
+	case ok && t.weights != nil:
+		c = t.weights.color(pixels.img, pixels.Rect, cell.Tile.Min, pixels.filter, pixels.rounding)
+	default:
+		c = MeanColor(pixels)
+	}
+	if !ok || t.state == nil {
+		return c
+	}
+	i := cell.Row*t.grid.Columns + cell.Column
+	current := t.unrounded(pixels, cell, c)
+	state := &t.state[i]
+	if !t.valid[i] || colorDistance(*state, current) > t.Threshold {
+		*state = current
+		t.output[i] = c
+		t.valid[i] = true
+		return c
+	}
+	// 平滑化した値が丸めの境界付近で揺れても色が変わらないよう、
+	// 前のフレームで返した値からの差が hysteresis を超えた成分だけを更新する
+	const hysteresis = 0.75
+	out := [4]*uint8{&t.output[i].R, &t.output[i].G, &t.output[i].B, &t.output[i].A}
+	for j := range state {
+		state[j] = t.Factor*state[j] + (1-t.Factor)*current[j]
+		if math.Abs(state[j]-float64(*out[j])) > hysteresis {
+			*out[j] = uint8(math.Round(state[j]))
+		}
+	}
+	return t.output[i]
+}
+
+// 平滑化に使うタイルの色
+// Color を指定しない場合は、丸めの境界をまたぐ小さな変化で色が揺れないよう、平均色と同じ平均を 8 ビットに丸めずに使う
+// それ以外の場合は c を使う
+func (t *TemporalSmoother) unrounded(pixels PixelRegion, cell Cell, c color.NRGBA) [4]float64 {
+	switch {
+	case t.Color != nil:
+	case t.weights != nil:
+		if m, ok := t.weights.mean(pixels.img, pixels.Rect, cell.Tile.Min, pixels.filter); ok {
+			return [4]float64{m[0] / 0x101, m[1] / 0x101, m[2] / 0x101, m[3] / 0x101}
+		}
+	case !pixels.filter.active():
+		var s colorSum
+		s.addRect(pixels.img, pixels.Rect)
+		if s.n > 0 {
+			n := float64(s.n) * 0x101
+			return [4]float64{float64(s.r) / n, float64(s.g) / n, float64(s.b) / n, float64(s.a) / n}
+		}
+	}
+	return [4]float64{float64(c.R), float64(c.G), float64(c.B), float64(c.A)}
+}
+
+// RGBA の値のユークリッド距離
+func colorDistance(a, b [4]float64) float64 {
+	var sum float64
+	for i := range a {
+		d := a[i] - b[i]
+		sum += d * d
+	}
+	return math.Sqrt(sum)
+}
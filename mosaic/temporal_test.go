@@ -0,0 +1,140 @@
+package mosaic
+
+import (
+	"context"
+	"image"
+	"image/color"
+	"testing"
+)
+
+// base の各画素に -1、0、+1 のどれかを加えたフレーム (seed ごとに異なる)
+func noisyFrame(base *image.NRGBA, seed uint32) *image.NRGBA {
+	img := image.NewNRGBA(base.Rect)
+	state := uint64(seed)
+	for i := range base.Pix {
+		if i%4 == 3 {
+			img.Pix[i] = base.Pix[i]
+			continue
+		}
+		// splitmix64 で画素ごとに偏りのない値を作る
+		state += 0x9e3779b97f4a7c15
+		z := (state ^ state>>30) * 0xbf58476d1ce4e5b9
+		z = (z ^ z>>27) * 0x94d049bb133111eb
+		v := int(base.Pix[i]) + int((z^z>>31)%3) - 1
+		img.Pix[i] = uint8(min(max(v, 0), 255))
+	}
+	return img
+}
+
+// smoother で平滑化して処理したフレーム
+func smoothFrame(t *testing.T, s *TemporalSmoother, img *image.NRGBA, tile int, opts ...Option) *image.NRGBA {
+	t.Helper()
+	mp := New(img, tile, tile, append(opts, WithTileColor(s.TileColor))...)
+	s.Frame(mp.Grid())
+	out, err := mp.ProcessContext(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+func TestTemporalSmootherSuppressesNoise(t *testing.T) {
+	const tile = 16
+	base := testImage(96, 64)
+	// ノイズで画素が変わらないよう、0 と 255 から離す
+	for i := range base.Pix {
+		if i%4 != 3 {
+			base.Pix[i] = 20 + base.Pix[i]%200
+		}
+	}
+	s := NewTemporalSmoother(0.7, 48)
+	first := smoothFrame(t, s, noisyFrame(base, 0), tile)
+
+	changedWithout := false
+	for frame := uint32(1); frame < 30; frame++ {
+		img := noisyFrame(base, frame)
+		out := smoothFrame(t, s, img, tile)
+		// 1 LSB のノイズではタイルの色が変わらない
+		assertSameImage(t, out, first)
+		if !changedWithout {
+			changedWithout = !sameImage(process(t, img, tile), first)
+		}
+	}
+	// 平滑化しない場合はノイズで色が変わるタイルがある (テストがノイズを見逃していない)
+	if !changedWithout {
+		t.Error("noise never changed an unsmoothed tile color")
+	}
+
+	// 場面の切り替わり (どのタイルも成分が 128 ずつ変わる) ではすぐに新しい色にする
+	cut := noisyFrame(base, 99)
+	for i := range cut.Pix {
+		if i%4 != 3 {
+			cut.Pix[i] += 128
+		}
+	}
+	assertSameImage(t, smoothFrame(t, s, cut, tile), process(t, cut, tile))
+}
+
+func TestTemporalSmootherResetsOnResize(t *testing.T) {
+	const tile = 8
+	s := NewTemporalSmoother(0.9, 510)
+	dark := image.NewNRGBA(image.Rect(0, 0, 32, 32))
+	FlatRenderer{}.Render(dark, dark.Rect, color.NRGBA{10, 10, 10, 255})
+	smoothFrame(t, s, dark, tile)
+
+	// 格子が変わると前のフレームの色を捨てるため、しきい値によらず新しい色になる
+	light := image.NewNRGBA(image.Rect(0, 0, 40, 24))
+	FlatRenderer{}.Render(light, light.Rect, color.NRGBA{200, 200, 200, 255})
+	assertSameImage(t, smoothFrame(t, s, light, tile), light)
+}
+
+// 格子の原点や画像の原点が (0, 0) でなくても、タイルごとに前のフレームの色を保持する
+// 最初のフレームは平滑化しない処理と同じ色になり、端で切り詰めたタイルも含めて 1 LSB のノイズでは色が変わらない
+func TestTemporalSmootherGrid(t *testing.T) {
+	const tile = 16
+	// 端で切り詰めたタイルも、ノイズが平均で埋もれる程度の画素を含む大きさにする
+	base := testImageAt(image.Rect(-24, 8, 88, 88))
+	for i := range base.Pix {
+		if i%4 != 3 {
+			base.Pix[i] = 20 + base.Pix[i]%200
+		}
+	}
+	for _, tt := range []struct {
+		name   string
+		filter TileFilter // WithTileFilter と同じ重み付けを平滑化にも設定する
+		opts   []Option
+	}{
+		{"offset bounds", BoxFilter, nil},
+		{"grid origin", BoxFilter, []Option{WithGridOrigin(image.Pt(-8, 0))}},
+		{"tent filter", TentFilter, []Option{WithTileFilter(TentFilter)}},
+		{"gauss filter and grid origin", GaussFilter, []Option{WithTileFilter(GaussFilter), WithGridOrigin(image.Pt(-8, 0))}},
+	} {
+		s := NewTemporalSmoother(0.7, 48)
+		s.Filter = tt.filter
+		first := noisyFrame(base, 0)
+		want := process(t, first, tile, tt.opts...)
+		if got := smoothFrame(t, s, first, tile, tt.opts...); !sameImage(got, want) {
+			t.Errorf("%s: first frame differs from the unsmoothed mosaic", tt.name)
+			continue
+		}
+		for frame := uint32(1); frame < 10; frame++ {
+			if got := smoothFrame(t, s, noisyFrame(base, frame), tile, tt.opts...); !sameImage(got, want) {
+				t.Errorf("%s: frame %d changed with 1 LSB noise", tt.name, frame)
+				break
+			}
+		}
+	}
+}
+
+// a と b の範囲と画素が同じかどうか
+func sameImage(a, b *image.NRGBA) bool {
+	if a.Rect != b.Rect {
+		return false
+	}
+	for i := range a.Pix {
+		if a.Pix[i] != b.Pix[i] {
+			return false
+		}
+	}
+	return true
+}
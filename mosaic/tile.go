@@ -0,0 +1,142 @@
+package mosaic
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+)
+
+// TileColor で平均する色空間
+type ColorSpace int
+
+const (
+	RGBSpace ColorSpace = iota // 乗算済みの RGB の平均 (MeanColor と同じ、既定)
+	LabSpace                   // CIELAB の平均 (LabMeanColor と同じ)
+	HSVSpace                   // HSV の平均 (HSVMeanColor と同じ)
+)
+
+var colorSpaceNames = []string{RGBSpace: "rgb", LabSpace: "lab", HSVSpace: "hsv"}
+
+// rgb、lab または hsv
+func (s ColorSpace) String() string {
+	if s < 0 || int(s) >= len(colorSpaceNames) {
+		return fmt.Sprintf("ColorSpace(%d)", int(s))
+	}
+	return colorSpaceNames[s]
+}
+
+// rgb、lab または hsv の名前の ColorSpace (空文字列は rgb)
+func ParseColorSpace(name string) (ColorSpace, error) {
+	if name == "" {
+		return RGBSpace, nil
+	}
+	for s, n := range colorSpaceNames {
+		if n == name {
+			return ColorSpace(s), nil
+		}
+	}
+	return RGBSpace, fmt.Errorf("unknown color space %q (want rgb, lab or hsv)", name)
+}
+
+// TileColor のタイルの色の求め方
+// ゼロ値は New の既定と同じ (RGB の一様な平均を四捨五入し、画像と重ならない範囲は不透明な黒)
+type ColorMode struct {
+	Space    ColorSpace // 平均する色空間
+	Filter   TileFilter // 平均色の画素の重み付け (RGBSpace の場合だけ使える)
+	Rounding Rounding   // 平均色の成分の丸め方 (RGBSpace の場合だけ効く)
+	Strict   bool       // rect が画像と重ならない場合に *EmptyTileError を返す
+}
+
+// ColorMode の Strict を指定した TileColor の範囲が、画像と重ならないことを表すエラー
+type EmptyTileError struct {
+	Rect, Bounds image.Rectangle
+}
+
+func (e *EmptyTileError) Error() string {
+	return fmt.Sprintf("mosaic: tile %v does not overlap image bounds %v", e.Rect, e.Bounds)
+}
+
+// img の rect の範囲の 1 つのタイルの色を、Processor と同じ計算で求める
+// rect が画像からはみ出す場合は画像の範囲で切り詰め、Filter の重みは切り詰める前の rect を基準にする (画像の端のタイルと同じ)
+// 画像と重ならない場合は不透明な黒を返し、mode.Strict の場合は *EmptyTileError を返却
+// *image.NRGBA は画素を直接読み、それ以外の画像の RGB の一様な平均は NewImage と同じく元画像から直接求める
+// その他の場合は、切り詰めた範囲だけを NRGBA に変換してから求める
+//
+//	c, err := mosaic.TileColor(img, image.Rect(0, 0, 32, 32), mosaic.ColorMode{})
+//	if err != nil {
+//		return err
+//	}
+//	mosaic.FillTile(dst, image.Rect(0, 0, 32, 32), c)
+func TileColor(img image.Image, rect image.Rectangle, mode ColorMode) (color.NRGBA, error) {
+	if mode.Space < 0 || int(mode.Space) >= len(colorSpaceNames) {
+		return color.NRGBA{}, fmt.Errorf("mosaic: unknown color space %v", mode.Space)
+	}
+	if mode.Filter < 0 || int(mode.Filter) >= len(tileFilterNames) {
+		return color.NRGBA{}, fmt.Errorf("mosaic: unknown tile filter %v", mode.Filter)
+	}
+	if mode.Filter != BoxFilter && mode.Space != RGBSpace {
+		return color.NRGBA{}, fmt.Errorf("mosaic: tile filter %v requires the rgb color space", mode.Filter)
+	}
+	tile := rect.Intersect(img.Bounds())
+	if tile.Empty() {
+		if mode.Strict {
+			return color.NRGBA{}, &EmptyTileError{Rect: rect, Bounds: img.Bounds()}
+		}
+		return color.NRGBA{0, 0, 0, 255}, nil
+	}
+	var source pixelAccess
+	src, ok := img.(*image.NRGBA)
+	if !ok {
+		source = newPixelAccess(img)
+		if mode.Space != RGBSpace || mode.Filter != BoxFilter {
+			src = image.NewNRGBA(tile)
+			source.readNRGBA(src, tile)
+		}
+	}
+
+	switch mode.Space {
+	case LabSpace:
+		return LabMeanColor(PixelRegion{img: src, Rect: tile}), nil
+	case HSVSpace:
+		return HSVMeanColor(PixelRegion{img: src, Rect: tile}), nil
+	}
+	m := tileMean{rounding: mode.Rounding, weights: newTileWeights(mode.Filter, rect.Dx(), rect.Dy()), source: source}
+	return m.color(src, tile, rect.Min), nil
+}
+
+// dst の rect の範囲を c で塗りつぶす (WithTileRenderer を指定しない Processor のタイルの描画と同じ)
+// rect が dst からはみ出す場合は dst の範囲だけを塗る
+// *image.NRGBA は画素を直接書き、それ以外の画像は draw.Draw で塗る
+func FillTile(dst draw.Image, rect image.Rectangle, c color.Color) {
+	if img, ok := dst.(*image.NRGBA); ok {
+		FlatRenderer{}.Render(img, rect, color.NRGBAModel.Convert(c).(color.NRGBA))
+		return
+	}
+	draw.Draw(dst, rect.Intersect(dst.Bounds()), image.NewUniform(c), image.Point{}, draw.Src)
+}
+
+// RGB の平均色の求め方 (TileColor と MosaicStage で共通)
+type tileMean struct {
+	weights  *tileWeights // nil の場合は一様な平均
+	filter   pixelFilter  // 平均に含めない画素
+	rounding Rounding
+	opaque   bool        // すべての画素が不透明であるとみなして透明度の計算を省く
+	source   pixelAccess // 一様な平均を img ではなく直接読む元画像 (nil の場合は img から読む)
+}
+
+// tile の平均色
+// full は tile を含む切り詰める前のタイルの左上で、weights の位置を決める
+func (m tileMean) color(img *image.NRGBA, tile image.Rectangle, full image.Point) color.NRGBA {
+	switch {
+	case m.weights != nil:
+		return m.weights.color(img, tile, full, m.filter, m.rounding)
+	case m.filter.active():
+		return averageColorExcluding(img, tile, m.filter, m.rounding)
+	case m.source != nil:
+		var s colorSum
+		m.source.addTo(&s, tile)
+		return s.color(m.rounding)
+	}
+	return averageColor(img, tile, m.opaque, m.rounding)
+}
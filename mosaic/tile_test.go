@@ -0,0 +1,160 @@
+package mosaic
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"testing"
+)
+
+// 画像の右と下で切れるタイルも、画像の中の範囲だけを塗る
+func TestFillTileClipped(t *testing.T) {
+	bounds := image.Rect(0, 0, 30, 20)
+	c := color.NRGBA{10, 200, 30, 255}
+	for _, rect := range []image.Rectangle{
+		image.Rect(24, 0, 36, 12),  // 右で切れる
+		image.Rect(0, 16, 12, 28),  // 下で切れる
+		image.Rect(24, 16, 36, 28), // 右下で切れる
+		image.Rect(29, 19, 41, 31), // 1px だけ残る
+		image.Rect(30, 20, 42, 32), // 画像の外
+	} {
+		dst := image.NewNRGBA(bounds)
+		FillTile(dst, rect, c)
+		inside := rect.Intersect(bounds)
+		for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+			for x := bounds.Min.X; x < bounds.Max.X; x++ {
+				want := color.NRGBA{}
+				if image.Pt(x, y).In(inside) {
+					want = c
+				}
+				if got := dst.NRGBAAt(x, y); got != want {
+					t.Fatalf("%v: pixel (%d,%d) = %v, want %v", rect, x, y, got, want)
+				}
+			}
+		}
+	}
+}
+
+// 右と下のタイルが切れる画像の処理結果が、素朴な計算と同じになる
+func TestProcessClippedTiles(t *testing.T) {
+	img := testImage(45, 29)
+	assertSameImage(t, process(t, img, 8, WithWorkers(1)), referenceMosaic(img, 8))
+}
+
+// 小、中、大のタイルの平均色の計算の速さ
+func BenchmarkAverageColor(b *testing.B) {
+	img := testImage(128, 128)
+	for _, size := range []int{8, 32, 128} {
+		rect := image.Rect(0, 0, size, size)
+		b.Run(fmt.Sprintf("%dx%d", size, size), func(b *testing.B) {
+			b.SetBytes(int64(4 * size * size))
+			for i := 0; i < b.N; i++ {
+				averageColor(img, rect, true, RoundHalfUp)
+			}
+		})
+		b.Run(fmt.Sprintf("%dx%d/alpha", size, size), func(b *testing.B) {
+			b.SetBytes(int64(4 * size * size))
+			for i := 0; i < b.N; i++ {
+				averageColor(img, rect, false, RoundHalfUp)
+			}
+		})
+	}
+}
+
+// タイルの塗りつぶしだけの速さ
+func BenchmarkFillTile(b *testing.B) {
+	dst := image.NewNRGBA(image.Rect(0, 0, 128, 128))
+	c := color.NRGBA{10, 200, 30, 255}
+	for _, size := range []int{8, 32, 128} {
+		rect := image.Rect(0, 0, size, size)
+		b.Run(fmt.Sprintf("%dx%d", size, size), func(b *testing.B) {
+			b.SetBytes(int64(4 * size * size))
+			for i := 0; i < b.N; i++ {
+				FillTile(dst, rect, c)
+			}
+		})
+	}
+}
+
+// 不透明とみなして透明度の計算を省いても、同じ平均色になる
+func TestAverageColorOpaqueShortcut(t *testing.T) {
+	img := testImage(37, 29)
+	for _, rect := range []image.Rectangle{img.Rect, image.Rect(3, 2, 10, 9), image.Rect(0, 0, 1, 1), image.Rect(30, 20, 37, 29)} {
+		for _, r := range []Rounding{RoundHalfUp, RoundTruncate} {
+			if a, b := averageColor(img, rect, true, r), averageColor(img, rect, false, r); a != b {
+				t.Errorf("%v rounding %d: opaque %v, alpha %v", rect, r, a, b)
+			}
+		}
+	}
+}
+
+func TestTileColor(t *testing.T) {
+	src := testImage(40, 30)
+	rgba := image.NewRGBA(src.Rect)
+	draw.Draw(rgba, rgba.Rect, src, image.Point{}, draw.Src)
+	tests := []struct {
+		name string
+		rect image.Rectangle
+		mode ColorMode
+		opts []Option // 同じ色になる Processor のオプション
+	}{
+		{"inside", image.Rect(8, 8, 16, 16), ColorMode{}, nil},
+		{"right edge", image.Rect(32, 0, 40, 8), ColorMode{}, nil},
+		{"clipped", image.Rect(32, 24, 40, 32), ColorMode{}, nil},
+		{"legacy", image.Rect(8, 8, 16, 16), ColorMode{Rounding: RoundTruncate}, []Option{WithRounding(RoundTruncate)}},
+		{"lab", image.Rect(16, 8, 24, 16), ColorMode{Space: LabSpace}, []Option{WithTileColor(LabMeanColor)}},
+		{"hsv", image.Rect(16, 8, 24, 16), ColorMode{Space: HSVSpace}, []Option{WithTileColor(HSVMeanColor)}},
+		{"tent clipped", image.Rect(32, 24, 40, 32), ColorMode{Filter: TentFilter}, []Option{WithTileFilter(TentFilter)}},
+	}
+	for _, tt := range tests {
+		// Processor のタイルと同じ色
+		want := process(t, src, 8, tt.opts...).NRGBAAt(tt.rect.Min.X, tt.rect.Min.Y)
+		for _, img := range []image.Image{src, rgba} {
+			got, err := TileColor(img, tt.rect, tt.mode)
+			if err != nil || got != want {
+				t.Errorf("%s (%T) = %v, %v, want %v", tt.name, img, got, err, want)
+			}
+		}
+	}
+}
+
+func TestTileColorOutside(t *testing.T) {
+	img := testImage(16, 16)
+	outside := image.Rect(16, 0, 24, 8)
+	if c, err := TileColor(img, outside, ColorMode{}); err != nil || c != (color.NRGBA{0, 0, 0, 255}) {
+		t.Errorf("outside = %v, %v, want opaque black", c, err)
+	}
+	_, err := TileColor(img, outside, ColorMode{Strict: true})
+	var empty *EmptyTileError
+	if !errors.As(err, &empty) || empty.Rect != outside || empty.Bounds != img.Rect {
+		t.Errorf("strict outside: %v", err)
+	}
+	// 一部でも重なれば Strict でもエラーにしない
+	if _, err := TileColor(img, image.Rect(15, 15, 23, 23), ColorMode{Strict: true}); err != nil {
+		t.Errorf("strict partial overlap: %v", err)
+	}
+	for _, mode := range []ColorMode{{Space: ColorSpace(9)}, {Filter: TileFilter(9)}, {Space: LabSpace, Filter: GaussFilter}} {
+		if _, err := TileColor(img, img.Rect, mode); err == nil {
+			t.Errorf("mode %+v accepted", mode)
+		}
+	}
+}
+
+// NRGBA 以外の画像も draw.Draw で同じように塗る (乗算済みの値の丸めを避けるため不透明な色)
+func TestFillTileRGBA(t *testing.T) {
+	c := color.NRGBA{200, 100, 50, 255}
+	rect := image.Rect(4, 4, 20, 20)
+	nrgba := image.NewNRGBA(image.Rect(0, 0, 16, 16))
+	rgba := image.NewRGBA(nrgba.Rect)
+	FillTile(nrgba, rect, c)
+	FillTile(rgba, rect, c)
+	for y := 0; y < 16; y++ {
+		for x := 0; x < 16; x++ {
+			if got, want := color.NRGBAModel.Convert(rgba.At(x, y)), color.NRGBAModel.Convert(nrgba.At(x, y)); got != want {
+				t.Fatalf("pixel (%d,%d) = %v, want %v", x, y, got, want)
+			}
+		}
+	}
+}
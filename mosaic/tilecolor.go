@@ -0,0 +1,215 @@
+package mosaic
+
+import (
+	"image"
+	"image/color"
+	"math"
+
+	"github.com/yashikota/go-streaming-image-mosaic/colorspace"
+)
+
+// タイルの画素からタイルの色を決める関数
+// 並列処理では複数のゴルーチンから同時に呼び出されることがあるため、共有する状態を持つ場合は呼び出し側で排他制御すること
+// PixelRegion は呼び出しの間だけ有効で、画素を書き換えてはならない
+type TileColorFunc func(pixels PixelRegion) color.NRGBA
+
+// タイルの色を決める関数を設定
+// 指定しない場合は平均色を使う
+func WithTileColor(fn TileColorFunc) Option {
+	return func(mp *Processor) {
+		mp.tileColor = fn
+	}
+}
+
+// タイル内の元画像の画素を参照するためのビュー
+type PixelRegion struct {
+	img      *image.NRGBA
+	filter   pixelFilter
+	rounding Rounding        // MeanColor の丸め方
+	Rect     image.Rectangle // タイルの範囲 (画像全体の座標)
+}
+
+// (x, y) の画素が WithExclude や WithMask、WithSelection で処理から除外されているかどうか
+// Row や Each は除外した画素も含むため、TileColorFunc は色の計算でこれを確認すること
+func (r PixelRegion) Excluded(x, y int) bool {
+	return r.filter.active() && r.filter.excluded(x, y, r.img.NRGBAAt(x, y))
+}
+
+// 画素数を返却
+func (r PixelRegion) Len() int {
+	return r.Rect.Dx() * r.Rect.Dy()
+}
+
+// (x, y) の画素を返却
+func (r PixelRegion) At(x, y int) color.NRGBA {
+	return r.img.NRGBAAt(x, y)
+}
+
+// y 行目のタイル内の画素を R, G, B, A の順に並べたスライスを返却
+// 元画像のメモリをそのまま参照する
+func (r PixelRegion) Row(y int) []uint8 {
+	i := r.img.PixOffset(r.Rect.Min.X, y)
+	return r.img.Pix[i : i+4*r.Rect.Dx() : i+4*r.Rect.Dx()]
+}
+
+// タイル内の画素を左上から順に fn に渡す
+func (r PixelRegion) Each(fn func(x, y int, c color.NRGBA)) {
+	for y := r.Rect.Min.Y; y < r.Rect.Max.Y; y++ {
+		row := r.Row(y)
+		for i := 0; i < len(row); i += 4 {
+			fn(r.Rect.Min.X+i/4, y, color.NRGBA{row[i], row[i+1], row[i+2], row[i+3]})
+		}
+	}
+}
+
+// タイルの平均色を返す TileColorFunc
+// 成分は WithRounding の丸め方 (既定は RoundHalfUp) で 8 ビットの値にする
+func MeanColor(pixels PixelRegion) color.NRGBA {
+	if pixels.filter.active() {
+		return averageColorExcluding(pixels.img, pixels.Rect, pixels.filter, pixels.rounding)
+	}
+	return averageColor(pixels.img, pixels.Rect, false, pixels.rounding)
+}
+
+// 指定範囲の画素の平均色を計算
+// opaque が true の場合は、すべての画素が不透明であるとみなして透明度の計算を省く
+// color.Color の RGBA と同じく乗算済みの 16 ビット値の平均を取り、rounding で 8 ビットの値に丸める
+func averageColor(img *image.NRGBA, rect image.Rectangle, opaque bool, rounding Rounding) color.NRGBA {
+	if rect.Empty() {
+		return color.NRGBA{0, 0, 0, 255}
+	}
+	if !opaque {
+		return averageColorAlpha(img, rect, rounding)
+	}
+
+	// 4 画素ずつ別々の変数に加算する
+	// 大きなタイル (約 1680 万画素以上) でもあふれないよう、CellAccumulator と同じく uint64 で合計する
+	var r0, g0, b0, r1, g1, b1, r2, g2, b2, r3, g3, b3 uint64
+	width := 4 * rect.Dx()
+	for y := rect.Min.Y; y < rect.Max.Y; y++ {
+		i := img.PixOffset(rect.Min.X, y)
+		row := img.Pix[i : i+width : i+width]
+		x := 0
+		for ; x+16 <= len(row); x += 16 {
+			r0 += uint64(row[x+0])
+			g0 += uint64(row[x+1])
+			b0 += uint64(row[x+2])
+			r1 += uint64(row[x+4])
+			g1 += uint64(row[x+5])
+			b1 += uint64(row[x+6])
+			r2 += uint64(row[x+8])
+			g2 += uint64(row[x+9])
+			b2 += uint64(row[x+10])
+			r3 += uint64(row[x+12])
+			g3 += uint64(row[x+13])
+			b3 += uint64(row[x+14])
+		}
+		for ; x < len(row); x += 4 {
+			r0 += uint64(row[x+0])
+			g0 += uint64(row[x+1])
+			b0 += uint64(row[x+2])
+		}
+	}
+
+	// 不透明な画素の 16 ビット値は 8 ビット値の 0x101 倍
+	count := uint64(rect.Dx()) * uint64(rect.Dy())
+	return colorSum{
+		r: (r0 + r1 + r2 + r3) * 0x101,
+		g: (g0 + g1 + g2 + g3) * 0x101,
+		b: (b0 + b1 + b2 + b3) * 0x101,
+		a: count * 0xffff,
+		n: count,
+	}.color(rounding)
+}
+
+// 透明度を含めて指定範囲の画素の平均色を計算
+func averageColorAlpha(img *image.NRGBA, rect image.Rectangle, rounding Rounding) color.NRGBA {
+	var s colorSum
+	s.addRect(img, rect)
+	return s.color(rounding)
+}
+
+// タイルの画素を CIELAB で平均した色を返す TileColorFunc
+// RGB の平均と異なり、彩度の高い補色どうし (青と黄など) が混ざっても灰色にくすみにくい
+// 半透明の画素は透明度で重み付けし、透明度は単純に平均する (除外した画素はどちらにも含めない)
+func LabMeanColor(pixels PixelRegion) color.NRGBA {
+	if pixels.Rect.Empty() {
+		return color.NRGBA{0, 0, 0, 255}
+	}
+	var l, a, b, weight float64
+	var alpha, count uint64
+	for y := pixels.Rect.Min.Y; y < pixels.Rect.Max.Y; y++ {
+		row := pixels.Row(y)
+		for x := 0; x < len(row); x += 4 {
+			if pixels.Excluded(pixels.Rect.Min.X+x/4, y) {
+				continue
+			}
+			count++
+			if row[x+3] == 0 {
+				continue
+			}
+			w := float64(row[x+3]) / 0xff
+			c := colorspace.SRGBToLab(row[x], row[x+1], row[x+2])
+			l += c.L * w
+			a += c.A * w
+			b += c.B * w
+			weight += w
+			alpha += uint64(row[x+3])
+		}
+	}
+	if weight == 0 {
+		return color.NRGBA{}
+	}
+	r, g, bl := colorspace.LabToSRGB(colorspace.Lab{L: l / weight, A: a / weight, B: b / weight})
+	return color.NRGBA{R: r, G: g, B: bl, A: uint8((alpha + count/2) / count)}
+}
+
+// 色相の平均に含める画素の彩度の下限
+// 無彩色に近い画素の色相はわずかな誤差で大きく変わるため、平均に含めない
+const hueMinSaturation = 0.05
+
+// タイルの画素を HSV で平均した色を返す TileColorFunc
+// 彩度と明度は単純に平均し、色相は角度の平均 (単位ベクトルの和の向き) を取る
+// 色相が打ち消し合って向きが定まらない場合は MeanColor の色を返す
+// 半透明の画素は透明度で重み付けし、透明度は単純に平均する (除外した画素はどちらにも含めない)
+func HSVMeanColor(pixels PixelRegion) color.NRGBA {
+	if pixels.Rect.Empty() {
+		return color.NRGBA{0, 0, 0, 255}
+	}
+	var s, v, weight, hx, hy, hueWeight float64
+	var alpha, count uint64
+	for y := pixels.Rect.Min.Y; y < pixels.Rect.Max.Y; y++ {
+		row := pixels.Row(y)
+		for x := 0; x < len(row); x += 4 {
+			if pixels.Excluded(pixels.Rect.Min.X+x/4, y) {
+				continue
+			}
+			count++
+			if row[x+3] == 0 {
+				continue
+			}
+			w := float64(row[x+3]) / 0xff
+			c := colorspace.RGBToHSV(row[x], row[x+1], row[x+2])
+			s += c.S * w
+			v += c.V * w
+			weight += w
+			alpha += uint64(row[x+3])
+			if c.S >= hueMinSaturation {
+				sin, cos := math.Sincos(c.H * math.Pi / 180)
+				hx += cos * w
+				hy += sin * w
+				hueWeight += w
+			}
+		}
+	}
+	if weight == 0 {
+		return color.NRGBA{}
+	}
+	// 無彩色だけのタイルも、色相の向きが定まらないため RGB の平均にする
+	if math.Hypot(hx, hy) <= 1e-6*hueWeight || hueWeight == 0 {
+		return MeanColor(pixels)
+	}
+	h := colorspace.NormalizeHue(math.Atan2(hy, hx) * 180 / math.Pi)
+	r, g, b := colorspace.HSVToRGB(colorspace.HSV{H: h, S: s / weight, V: v / weight})
+	return color.NRGBA{R: r, G: g, B: b, A: uint8((alpha + count/2) / count)}
+}
@@ -0,0 +1,123 @@
+package mosaic
+
+import (
+	"image"
+	"image/color"
+	"math"
+	"testing"
+
+	"github.com/yashikota/go-streaming-image-mosaic/colorspace"
+)
+
+// colors を横に並べた 1 行の画像の PixelRegion
+func pixelRow(colors ...color.NRGBA) PixelRegion {
+	img := image.NewNRGBA(image.Rect(0, 0, len(colors), 1))
+	for x, c := range colors {
+		img.SetNRGBA(x, 0, c)
+	}
+	return PixelRegion{img: img, Rect: img.Rect}
+}
+
+// 色相 h で彩度と明度が最大の色
+func hue(h float64) color.NRGBA {
+	r, g, b := colorspace.HSVToRGB(colorspace.HSV{H: h, S: 1, V: 1})
+	return color.NRGBA{r, g, b, 255}
+}
+
+func TestHSVMeanColorCircularHue(t *testing.T) {
+	tests := []struct {
+		name   string
+		pixels PixelRegion
+		hue    float64
+	}{
+		// 350 度と 10 度の平均は 180 度ではなく 0 度
+		{"across 0", pixelRow(hue(350), hue(10)), 0},
+		{"across 0 weighted", pixelRow(hue(350), hue(350), hue(20)), 0},
+		{"around 180", pixelRow(hue(170), hue(190)), 180},
+		{"sunset", pixelRow(hue(10), hue(30), hue(50)), 30},
+		// 無彩色に近い画素は色相の平均に含めない
+		{"gray ignored", pixelRow(hue(120), color.NRGBA{128, 128, 128, 255}, color.NRGBA{129, 128, 128, 255}), 120},
+	}
+	for _, tt := range tests {
+		got := HSVMeanColor(tt.pixels)
+		h := colorspace.RGBToHSV(got.R, got.G, got.B).H
+		if d := math.Abs(math.Remainder(h-tt.hue, 360)); d > 1 {
+			t.Errorf("%s: hue of %v is %g, want %g", tt.name, got, h, tt.hue)
+		}
+	}
+
+	// 彩度と明度は単純に平均する
+	got := HSVMeanColor(pixelRow(hue(350), color.NRGBA{0, 0, 0, 255}, hue(10), color.NRGBA{255, 255, 255, 255}))
+	if hsv := colorspace.RGBToHSV(got.R, got.G, got.B); math.Abs(hsv.S-0.5) > 0.01 || math.Abs(hsv.V-0.75) > 0.01 || (hsv.H > 1 && hsv.H < 359) {
+		t.Errorf("mean of red, black and white = %v (%+v), want hue 0, saturation 0.5, value 0.75", got, hsv)
+	}
+}
+
+func TestHSVMeanColorFallback(t *testing.T) {
+	tests := []struct {
+		name   string
+		pixels PixelRegion
+	}{
+		// 色相が打ち消し合う場合と無彩色だけの場合は RGB の平均
+		{"opposite hues", pixelRow(hue(0), hue(180))},
+		{"three-way", pixelRow(hue(0), hue(120), hue(240))},
+		{"gray", pixelRow(color.NRGBA{100, 100, 100, 255}, color.NRGBA{200, 200, 200, 255})},
+	}
+	for _, tt := range tests {
+		if got, want := HSVMeanColor(tt.pixels), MeanColor(tt.pixels); got != want {
+			t.Errorf("%s: %v, want the RGB mean %v", tt.name, got, want)
+		}
+	}
+
+	if got := HSVMeanColor(PixelRegion{img: image.NewNRGBA(image.Rect(0, 0, 4, 4))}); got != (color.NRGBA{0, 0, 0, 255}) {
+		t.Errorf("empty tile: %v", got)
+	}
+	if got := HSVMeanColor(pixelRow(color.NRGBA{255, 0, 0, 0}, color.NRGBA{0, 255, 0, 0})); got != (color.NRGBA{}) {
+		t.Errorf("transparent tile: %v", got)
+	}
+	// 半透明の画素は透明度で重み付けする
+	got := HSVMeanColor(pixelRow(color.NRGBA{255, 0, 0, 255}, color.NRGBA{0, 0, 255, 1}))
+	if h := colorspace.RGBToHSV(got.R, got.G, got.B).H; got.A != 128 || (h > 2 && h < 358) {
+		t.Errorf("translucent: %v (hue %g), want nearly red with alpha 128", got, h)
+	}
+}
+
+func TestHSVMeanColorProcess(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(0, 0, 8, 4))
+	for y := 0; y < 4; y++ {
+		for x := 0; x < 8; x++ {
+			img.SetNRGBA(x, y, hue(float64(350+(x%2)*20)))
+		}
+	}
+	out := process(t, img, 4, WithTileColor(HSVMeanColor))
+	for _, c := range []color.NRGBA{out.NRGBAAt(0, 0), out.NRGBAAt(7, 3)} {
+		if c != (color.NRGBA{255, 0, 0, 255}) {
+			t.Errorf("tile color %v, want red", c)
+		}
+	}
+}
+
+// 約 1680 万画素を超えるタイルでも 8 ビット値の合計があふれない
+func TestLargeTileAverage(t *testing.T) {
+	const size = 4200
+	img := image.NewNRGBA(image.Rect(0, 0, size, size))
+	for i := range img.Pix {
+		img.Pix[i] = 255
+	}
+	white := color.NRGBA{255, 255, 255, 255}
+	for _, space := range []ColorSpace{RGBSpace, LabSpace, HSVSpace} {
+		c, err := TileColor(img, img.Rect, ColorMode{Space: space})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c != white {
+			t.Errorf("%v: TileColor = %v, want %v", space, c, white)
+		}
+	}
+	out := process(t, img, size)
+	for _, p := range []image.Point{{0, 0}, {size / 2, size / 2}, {size - 1, size - 1}} {
+		if c := out.NRGBAAt(p.X, p.Y); c != white {
+			t.Errorf("Process: pixel %v = %v, want %v", p, c, white)
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package mosaic
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+)
+
+// タイルの平均色を求める際の画素の重み付け
+// 平均色 (WithTileColor を指定しない場合) にだけ効き、大きなタイルでも中心の小さく明るい部分を埋もれさせにくくする
+type TileFilter int
+
+const (
+	BoxFilter   TileFilter = iota // すべての画素を同じ重みにする (既定)
+	TentFilter                    // タイルの中心で最大、端に向かって線形に小さくする
+	GaussFilter                   // タイルの中心を平均、タイルの幅の 1/4 を標準偏差とするガウス関数
+)
+
+var tileFilterNames = []string{BoxFilter: "box", TentFilter: "tent", GaussFilter: "gauss"}
+
+// box、tent または gauss
+func (f TileFilter) String() string {
+	if f < 0 || int(f) >= len(tileFilterNames) {
+		return fmt.Sprintf("TileFilter(%d)", int(f))
+	}
+	return tileFilterNames[f]
+}
+
+// box、tent または gauss の名前の TileFilter (空文字列は box)
+func ParseTileFilter(name string) (TileFilter, error) {
+	if name == "" {
+		return BoxFilter, nil
+	}
+	for f, n := range tileFilterNames {
+		if n == name {
+			return TileFilter(f), nil
+		}
+	}
+	return BoxFilter, fmt.Errorf("unknown tile filter %q (want box, tent or gauss)", name)
+}
+
+// タイルの平均色の画素の重み付けを設定
+// 重みはタイルの中心を基準とし、画像や範囲の端で切り詰めたタイルは残った画素の重みの合計が 1 になるよう正規化する
+// WithTileColor で色の決め方を指定した場合は効かない
+func WithTileFilter(f TileFilter) Option {
+	return func(mp *Processor) {
+		mp.tileFilter = f
+	}
+}
+
+// タイルの列と行ごとの重み
+// 重みは縦横で分けられるため、画素の重みは列の重みと行の重みの積にする
+type tileWeights struct {
+	x, y []float64
+}
+
+// width × height のタイルの重み (BoxFilter の場合は重みを使わないため nil)
+func newTileWeights(f TileFilter, width, height int) *tileWeights {
+	if f == BoxFilter {
+		return nil
+	}
+	return &tileWeights{x: filterWeights(f, width), y: filterWeights(f, height)}
+}
+
+// 1 辺 n 画素のタイルの重み (合計は正規化しない)
+// 画素の中心のタイルの中心からの距離を、タイルの幅の半分を 1 として求め、距離から重みを決める
+func filterWeights(f TileFilter, n int) []float64 {
+	w := make([]float64, n)
+	half := float64(n) / 2
+	for i := range w {
+		d := (float64(i) + 0.5 - half) / half
+		switch f {
+		case TentFilter:
+			w[i] = 1 - math.Abs(d)
+		case GaussFilter:
+			// 標準偏差は half / 2
+			w[i] = math.Exp(-2 * d * d)
+		default:
+			w[i] = 1
+		}
+	}
+	return w
+}
+
+// tile の画素を重み付けした平均色
+// full は tile を含む切り詰める前のタイルの左上で、重みの位置を決める
+// 除外した画素は重みに含めず、残った画素の重みの合計で割る (画素がない場合は不透明な黒)
+// 平均色と同じく乗算済みの 16 ビット値を平均し、rounding で 8 ビットの値に丸める
+func (w *tileWeights) color(img *image.NRGBA, tile image.Rectangle, full image.Point, filter pixelFilter, rounding Rounding) color.NRGBA {
+	m, ok := w.mean(img, tile, full, filter)
+	if !ok {
+		return color.NRGBA{0, 0, 0, 255}
+	}
+	return color.NRGBA{R: rounding.weighted(m[0]), G: rounding.weighted(m[1]), B: rounding.weighted(m[2]), A: rounding.weighted(m[3])}
+}
+
+// tile の画素を重み付けした、乗算済みの 16 ビット値の平均 (丸めない)
+// 平均に含める画素がない場合は false
+func (w *tileWeights) mean(img *image.NRGBA, tile image.Rectangle, full image.Point, filter pixelFilter) ([4]float64, bool) {
+	var r, g, b, a, total float64
+	active := filter.active()
+	width := 4 * tile.Dx()
+	wx := w.x[tile.Min.X-full.X : tile.Max.X-full.X]
+	for y := tile.Min.Y; y < tile.Max.Y; y++ {
+		i := img.PixOffset(tile.Min.X, y)
+		row := img.Pix[i : i+width : i+width]
+		var rr, gg, bb, aa, rowTotal float64
+		for x := 0; x < len(row); x += 4 {
+			p := row[x : x+4 : x+4]
+			if active && filter.excluded(tile.Min.X+x/4, y, color.NRGBA{p[0], p[1], p[2], p[3]}) {
+				continue
+			}
+			var s colorSum
+			s.add(p[0], p[1], p[2], p[3])
+			weight := wx[x/4]
+			rr += weight * float64(s.r)
+			gg += weight * float64(s.g)
+			bb += weight * float64(s.b)
+			aa += weight * float64(s.a)
+			rowTotal += weight
+		}
+		wy := w.y[y-full.Y]
+		r, g, b, a, total = r+wy*rr, g+wy*gg, b+wy*bb, a+wy*aa, total+wy*rowTotal
+	}
+	if total == 0 {
+		return [4]float64{}, false
+	}
+	return [4]float64{r / total, g / total, b / total, a / total}, true
+}
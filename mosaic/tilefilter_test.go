@@ -0,0 +1,102 @@
+package mosaic
+
+import (
+	"image"
+	"image/color"
+	"math"
+	"testing"
+)
+
+// 切り詰める前のタイル full の中での位置 i (画素) の重みを、カーネルの定義から直接求める
+func referenceWeight(f TileFilter, i, n int) float64 {
+	d := float64(i) + 0.5 - float64(n)/2 // タイルの中心からの距離 (画素)
+	switch f {
+	case TentFilter:
+		return 1 - math.Abs(d)/(float64(n)/2)
+	case GaussFilter:
+		sigma := float64(n) / 4
+		return math.Exp(-d * d / (2 * sigma * sigma))
+	}
+	return 1
+}
+
+// 不透明な img の full のタイルのうち画像に含まれる画素を、画素ごとの重みで平均した色 (丸める前)
+func referenceFiltered(img *image.NRGBA, f TileFilter, full image.Rectangle) [3]float64 {
+	var sum [3]float64
+	var total float64
+	tile := full.Intersect(img.Rect)
+	for y := tile.Min.Y; y < tile.Max.Y; y++ {
+		for x := tile.Min.X; x < tile.Max.X; x++ {
+			w := referenceWeight(f, x-full.Min.X, full.Dx()) * referenceWeight(f, y-full.Min.Y, full.Dy())
+			c := img.NRGBAAt(x, y)
+			sum[0] += w * float64(c.R)
+			sum[1] += w * float64(c.G)
+			sum[2] += w * float64(c.B)
+			total += w
+		}
+	}
+	return [3]float64{sum[0] / total, sum[1] / total, sum[2] / total}
+}
+
+func TestTileFilterMatchesReference(t *testing.T) {
+	// 50×38 は 16px と 7px のタイルで右と下の端のタイルが切り詰められる
+	img := testImage(50, 38)
+	for _, f := range []TileFilter{TentFilter, GaussFilter} {
+		for _, tile := range []int{7, 16, 38} {
+			out := process(t, img, tile, WithTileFilter(f))
+			for y := 0; y < img.Rect.Dy(); y += tile {
+				for x := 0; x < img.Rect.Dx(); x += tile {
+					want := referenceFiltered(img, f, image.Rect(x, y, x+tile, y+tile))
+					got := out.NRGBAAt(x, y)
+					for i, v := range []uint8{got.R, got.G, got.B} {
+						// 丸めの違いだけを許す
+						if math.Abs(float64(v)-want[i]) > 0.5+1e-9 {
+							t.Fatalf("%s tile %d at (%d,%d): got %v, want %.3f", f, tile, x, y, got, want)
+						}
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestTileFilterNormalizesClippedTiles(t *testing.T) {
+	// 1 色の画像は、切り詰めたタイルでも重みの合計が 1 になるため同じ色になる
+	c := color.NRGBA{201, 73, 14, 255}
+	img := image.NewNRGBA(image.Rect(0, 0, 37, 21))
+	FlatRenderer{}.Render(img, img.Rect, c)
+	for _, f := range []TileFilter{BoxFilter, TentFilter, GaussFilter} {
+		assertSameImage(t, process(t, img, 16, WithTileFilter(f)), img)
+	}
+}
+
+func TestBoxFilterIsDefault(t *testing.T) {
+	img := testImage(45, 33)
+	assertSameImage(t, process(t, img, 8, WithTileFilter(BoxFilter)), process(t, img, 8))
+}
+
+func TestParseTileFilter(t *testing.T) {
+	for _, f := range []TileFilter{BoxFilter, TentFilter, GaussFilter} {
+		if got, err := ParseTileFilter(f.String()); err != nil || got != f {
+			t.Errorf("ParseTileFilter(%q) = %v, %v", f, got, err)
+		}
+	}
+	if f, err := ParseTileFilter(""); err != nil || f != BoxFilter {
+		t.Errorf("ParseTileFilter(\"\") = %v, %v", f, err)
+	}
+	if _, err := ParseTileFilter("lanczos"); err == nil {
+		t.Error("ParseTileFilter accepted an unknown filter")
+	}
+}
+
+func BenchmarkTileFilter(b *testing.B) {
+	img := testImage(1024, 1024)
+	for _, f := range []TileFilter{BoxFilter, TentFilter, GaussFilter} {
+		b.Run(f.String(), func(b *testing.B) {
+			b.SetBytes(int64(len(img.Pix)))
+			for i := 0; i < b.N; i++ {
+				process(b, img, 32, WithTileFilter(f))
+			}
+		})
+	}
+}
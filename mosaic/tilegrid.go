@@ -0,0 +1,108 @@
+package mosaic
+
+import "image"
+
+// 画像をタイルに分ける格子
+// タイルの境界は Origin を通る縦横の線で、既定の Origin は画像の座標の原点 (0, 0) とする
+// 処理する範囲 (WithMask、WithStripes、ブロックや並列処理の分割など) は格子を動かさず、
+// 格子のどのタイルのどの画素を処理するかだけを選ぶ
+// 画像の端にかかるタイルも格子の一部で、画像の範囲で切り詰めた部分を 1 つのタイルとする
+// 列と行の番号は、画像と重なる左上のタイルを 0, 0 とする (TileInfo の X, Y と同じ)
+type Grid struct {
+	Bounds                image.Rectangle // 画像の範囲
+	TileWidth, TileHeight int
+	Origin                image.Point // タイルの境界が通る点
+	Columns, Rows         int         // 画像と重なるタイルの列と行の数
+}
+
+// 格子のタイル
+type Cell struct {
+	Column, Row int
+	Rect        image.Rectangle // 画像の範囲で切り詰めたタイルの範囲
+	Tile        image.Rectangle // 切り詰めないタイルの範囲
+}
+
+// 画像の端で切り詰めたタイルかどうか
+func (c Cell) Partial() bool {
+	return c.Rect != c.Tile
+}
+
+// bounds を tileWidth×tileHeight のタイルに分ける、origin を通る格子
+// タイルの幅と高さは正であること
+func NewGrid(bounds image.Rectangle, tileWidth, tileHeight int, origin image.Point) Grid {
+	g := Grid{Bounds: bounds, TileWidth: tileWidth, TileHeight: tileHeight, Origin: origin}
+	if !bounds.Empty() {
+		g.Columns = floorDiv(bounds.Max.X-1-origin.X, tileWidth) - floorDiv(bounds.Min.X-origin.X, tileWidth) + 1
+		g.Rows = floorDiv(bounds.Max.Y-1-origin.Y, tileHeight) - floorDiv(bounds.Min.Y-origin.Y, tileHeight) + 1
+	}
+	return g
+}
+
+// 列と行の番号が 0, 0 のタイルの左上
+func (g Grid) start() image.Point {
+	return image.Pt(
+		g.Bounds.Min.X-floorMod(g.Bounds.Min.X-g.Origin.X, g.TileWidth),
+		g.Bounds.Min.Y-floorMod(g.Bounds.Min.Y-g.Origin.Y, g.TileHeight),
+	)
+}
+
+// 左から column 番目、上から row 番目のタイル
+// 画像と重ならない番号のタイルは Rect が空になる
+func (g Grid) Cell(column, row int) Cell {
+	p := g.start().Add(image.Pt(column*g.TileWidth, row*g.TileHeight))
+	tile := image.Rectangle{Min: p, Max: p.Add(image.Pt(g.TileWidth, g.TileHeight))}
+	return Cell{Column: column, Row: row, Rect: tile.Intersect(g.Bounds), Tile: tile}
+}
+
+// 画素 (x, y) を含むタイル (画像の範囲外の画素は false)
+func (g Grid) CellAt(x, y int) (Cell, bool) {
+	if g.Columns == 0 || !image.Pt(x, y).In(g.Bounds) {
+		return Cell{}, false
+	}
+	s := g.start()
+	return g.Cell((x-s.X)/g.TileWidth, (y-s.Y)/g.TileHeight), true
+}
+
+// すべてのタイル (行優先の順)
+func (g Grid) Cells() []Cell {
+	cells := make([]Cell, 0, g.Columns*g.Rows)
+	for y := 0; y < g.Rows; y++ {
+		for x := 0; x < g.Columns; x++ {
+			cells = append(cells, g.Cell(x, y))
+		}
+	}
+	return cells
+}
+
+// 格子の原点を設定
+// タイルの境界が origin を通るように格子を動かす
+// 指定しない場合は画像の座標の原点 (0, 0) を通る
+func WithGridOrigin(origin image.Point) Option {
+	return func(mp *Processor) {
+		mp.gridOrigin = origin
+	}
+}
+
+// 画像より大きいタイルを画像の大きさに切り詰めた場合に、画像を元の格子と同じタイルに分ける格子の原点
+// 画像の中を通る元の格子の境界は多くとも 1 つのため、その境界 (ない場合は画像の左上) を原点にする
+func clampedOrigin(bounds image.Rectangle, tileWidth, tileHeight int, origin image.Point) image.Point {
+	clamp := func(lo, hi, tile, origin int) int {
+		if tile <= hi-lo {
+			return origin
+		}
+		if b := lo - floorMod(lo-origin, tile) + tile; b < hi {
+			return b
+		}
+		return lo
+	}
+	return image.Pt(clamp(bounds.Min.X, bounds.Max.X, tileWidth, origin.X), clamp(bounds.Min.Y, bounds.Max.Y, tileHeight, origin.Y))
+}
+
+// 処理に使うタイルの格子 (画像より大きいタイルは画像の大きさに切り詰めた大きさ)
+// タイルの大きさが正しくない場合と元画像が空の場合は、タイルのない格子を返す
+func (mp *Processor) Grid() Grid {
+	if mp.err != nil {
+		return Grid{Bounds: mp.src.Bounds()}
+	}
+	return NewGrid(mp.src.Bounds(), mp.mosaicWidth, mp.mosaicHeight, mp.gridOrigin)
+}
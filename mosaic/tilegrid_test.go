@@ -0,0 +1,198 @@
+package mosaic
+
+import (
+	"context"
+	"image"
+	"image/draw"
+	"math/rand/v2"
+	"testing"
+)
+
+// img の r の範囲を、左上を (0, 0) にした画像に写す
+func cropAtOrigin(img *image.NRGBA, r image.Rectangle) *image.NRGBA {
+	dst := image.NewNRGBA(image.Rect(0, 0, r.Dx(), r.Dy()))
+	draw.Draw(dst, dst.Rect, img, r.Min, draw.Src)
+	return dst
+}
+
+func TestGridOriginStitchedCrops(t *testing.T) {
+	const tile = 16
+	full := testImage(200, 150)
+	want := process(t, full, tile)
+
+	tests := []struct {
+		name  string
+		split image.Point // 切り出す 4 つの範囲の境界
+	}{
+		// タイルの境界で切り出した場合は完全に一致する
+		{"aligned", image.Pt(96, 64)},
+		// タイルの途中で切った場合は、境界にかかるタイルだけが異なる
+		{"unaligned", image.Pt(100, 70)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := full.Rect
+			crops := []image.Rectangle{
+				image.Rect(b.Min.X, b.Min.Y, tt.split.X, tt.split.Y),
+				image.Rect(tt.split.X, b.Min.Y, b.Max.X, tt.split.Y),
+				image.Rect(b.Min.X, tt.split.Y, tt.split.X, b.Max.Y),
+				image.Rect(tt.split.X, tt.split.Y, b.Max.X, b.Max.Y),
+			}
+			stitched := image.NewNRGBA(b)
+			for _, r := range crops {
+				// 切り出した画像の座標での、元画像の原点の位置
+				out := process(t, cropAtOrigin(full, r), tile, WithGridOrigin(image.Point{}.Sub(r.Min)))
+				draw.Draw(stitched, r, out, image.Point{}, draw.Src)
+			}
+
+			seam := image.Rect(tt.split.X/tile*tile, tt.split.Y/tile*tile, (tt.split.X+tile-1)/tile*tile, (tt.split.Y+tile-1)/tile*tile)
+			diffs := 0
+			for y := b.Min.Y; y < b.Max.Y; y++ {
+				for x := b.Min.X; x < b.Max.X; x++ {
+					if stitched.NRGBAAt(x, y) == want.NRGBAAt(x, y) {
+						continue
+					}
+					if x < seam.Min.X || x >= seam.Max.X {
+						if y < seam.Min.Y || y >= seam.Max.Y {
+							t.Fatalf("pixel (%d,%d) outside the seam tiles: %v, want %v", x, y, stitched.NRGBAAt(x, y), want.NRGBAAt(x, y))
+						}
+					}
+					diffs++
+				}
+			}
+			if seam.Empty() && diffs != 0 {
+				t.Errorf("%d pixels differ for crops on tile boundaries", diffs)
+			}
+			if !seam.Empty() && diffs == 0 {
+				t.Error("seam tiles are identical although their source pixels are split")
+			}
+		})
+	}
+}
+
+func TestGridOriginSubImage(t *testing.T) {
+	// SubImage の座標は元画像の座標のままなので、原点を動かさなくても格子がそろう
+	full := testImage(120, 90)
+	want := process(t, full, 10, WithGridOrigin(image.Pt(3, 4)))
+	r := image.Rect(33, 24, 120, 90)
+	got := process(t, full.SubImage(r).(*image.NRGBA), 10, WithGridOrigin(image.Pt(3, 4)))
+	assertSameImage(t, got, want.SubImage(r).(*image.NRGBA))
+}
+
+func TestNewGrid(t *testing.T) {
+	tests := []struct {
+		bounds        image.Rectangle
+		tile          int
+		origin        image.Point
+		columns, rows int
+		first, last   Cell // 左上と右下のタイル
+	}{
+		// 1000 画素を 100 画素のタイルに分けると、ちょうど 10 列
+		{image.Rect(0, 0, 1000, 300), 100, image.Point{}, 10, 3,
+			Cell{0, 0, image.Rect(0, 0, 100, 100), image.Rect(0, 0, 100, 100)},
+			Cell{9, 2, image.Rect(900, 200, 1000, 300), image.Rect(900, 200, 1000, 300)}},
+		{image.Rect(0, 0, 1001, 250), 100, image.Point{}, 11, 3,
+			Cell{0, 0, image.Rect(0, 0, 100, 100), image.Rect(0, 0, 100, 100)},
+			Cell{10, 2, image.Rect(1000, 200, 1001, 250), image.Rect(1000, 200, 1100, 300)}},
+		// 原点を動かすと両端のタイルが切り詰められる
+		{image.Rect(0, 0, 1000, 300), 100, image.Pt(50, 30), 11, 4,
+			Cell{0, 0, image.Rect(0, 0, 50, 30), image.Rect(-50, -70, 50, 30)},
+			Cell{10, 3, image.Rect(950, 230, 1000, 300), image.Rect(950, 230, 1050, 330)}},
+		// 格子は画像の座標の原点を通り、画像の左上には合わせない
+		{image.Rect(50, -20, 250, 80), 100, image.Point{}, 3, 2,
+			Cell{0, 0, image.Rect(50, -20, 100, 0), image.Rect(0, -100, 100, 0)},
+			Cell{2, 1, image.Rect(200, 0, 250, 80), image.Rect(200, 0, 300, 100)}},
+		// 原点は画像の外にあってもよい
+		{image.Rect(0, 0, 30, 30), 16, image.Pt(-1000, 1003), 3, 3,
+			Cell{0, 0, image.Rect(0, 0, 8, 11), image.Rect(-8, -5, 8, 11)},
+			Cell{2, 2, image.Rect(24, 27, 30, 30), image.Rect(24, 27, 40, 43)}},
+	}
+	for _, tt := range tests {
+		g := NewGrid(tt.bounds, tt.tile, tt.tile, tt.origin)
+		if g.Columns != tt.columns || g.Rows != tt.rows {
+			t.Errorf("%v tile %d origin %v: %dx%d tiles, want %dx%d", tt.bounds, tt.tile, tt.origin, g.Columns, g.Rows, tt.columns, tt.rows)
+			continue
+		}
+		if first := g.Cell(0, 0); first != tt.first {
+			t.Errorf("%v origin %v: first cell %+v, want %+v", tt.bounds, tt.origin, first, tt.first)
+		}
+		if last := g.Cell(g.Columns-1, g.Rows-1); last != tt.last {
+			t.Errorf("%v origin %v: last cell %+v, want %+v", tt.bounds, tt.origin, last, tt.last)
+		}
+		if got := g.Cell(g.Columns, 0).Rect; !got.Empty() {
+			t.Errorf("%v: cell past the last column overlaps the image at %v", tt.bounds, got)
+		}
+	}
+	if g := NewGrid(image.Rect(5, 5, 5, 9), 4, 4, image.Point{}); g.Columns != 0 || g.Rows != 0 || len(g.Cells()) != 0 {
+		t.Errorf("empty bounds: %+v", g)
+	}
+}
+
+// すべてのタイルは画像を重なりなく覆い、CellAt はその画素を含むタイルを返す
+func TestGridCellsPartitionImage(t *testing.T) {
+	rng := rand.New(rand.NewPCG(3, 4))
+	for i := 0; i < 50; i++ {
+		corner := image.Pt(rng.IntN(41)-20, rng.IntN(41)-20)
+		bounds := image.Rectangle{Min: corner, Max: corner.Add(image.Pt(1+rng.IntN(60), 1+rng.IntN(60)))}
+		g := NewGrid(bounds, 1+rng.IntN(20), 1+rng.IntN(20), image.Pt(rng.IntN(101)-50, rng.IntN(101)-50))
+		covered := make(map[image.Point]int)
+		for _, c := range g.Cells() {
+			if c.Rect.Empty() || !c.Rect.In(c.Tile) || c.Rect != c.Tile.Intersect(bounds) || c.Partial() != (c.Rect != c.Tile) {
+				t.Fatalf("%+v: bad cell %+v", g, c)
+			}
+			for y := c.Rect.Min.Y; y < c.Rect.Max.Y; y++ {
+				for x := c.Rect.Min.X; x < c.Rect.Max.X; x++ {
+					covered[image.Pt(x, y)]++
+					if at, ok := g.CellAt(x, y); !ok || at != c {
+						t.Fatalf("%+v: CellAt(%d, %d) = %+v, want %+v", g, x, y, at, c)
+					}
+				}
+			}
+		}
+		if len(covered) != bounds.Dx()*bounds.Dy() {
+			t.Fatalf("%+v: cells cover %d of %d pixels", g, len(covered), bounds.Dx()*bounds.Dy())
+		}
+		for p, n := range covered {
+			if n != 1 {
+				t.Fatalf("%+v: pixel %v is in %d cells", g, p, n)
+			}
+		}
+		if _, ok := g.CellAt(bounds.Max.X, bounds.Min.Y); ok {
+			t.Errorf("%+v: CellAt outside the image succeeded", g)
+		}
+	}
+}
+
+// 格子のタイルをすべて選んだ場合、範囲やマスクでの選び方によらずタイルの色は変わらない
+func TestSelectionKeepsFullySelectedCells(t *testing.T) {
+	rng := rand.New(rand.NewPCG(5, 6))
+	img := testImage(97, 83)
+	for i := 0; i < 30; i++ {
+		tile := 3 + rng.IntN(20)
+		origin := image.Pt(rng.IntN(tile), rng.IntN(tile))
+		want := process(t, img, tile, WithGridOrigin(origin))
+		grid := New(img, tile, tile, WithGridOrigin(origin)).Grid()
+
+		r := image.Rect(rng.IntN(97), rng.IntN(83), rng.IntN(97), rng.IntN(83)).Canon()
+		if r.Empty() {
+			continue
+		}
+		selected := process(t, img, tile, WithGridOrigin(origin), WithSelection(Rects(r)))
+		masked := process(t, img, tile, WithGridOrigin(origin), WithMask(rectMask(img.Rect, r)))
+		regions := image.NewNRGBA(img.Rect)
+		copy(regions.Pix, img.Pix)
+		if err := ProcessRegions(context.Background(), regions, tile, tile, []Region{{Rect: r}}, WithGridOrigin(origin)); err != nil {
+			t.Fatal(err)
+		}
+		for _, c := range grid.Cells() {
+			if !c.Rect.In(r) {
+				continue
+			}
+			for name, got := range map[string]*image.NRGBA{"selection": selected, "mask": masked, "regions": regions} {
+				if g, w := got.NRGBAAt(c.Rect.Min.X, c.Rect.Min.Y), want.NRGBAAt(c.Rect.Min.X, c.Rect.Min.Y); g != w {
+					t.Fatalf("tile %d origin %v, %s %v: cell %v is %v, want %v", tile, origin, name, r, c.Rect, g, w)
+				}
+			}
+		}
+	}
+}
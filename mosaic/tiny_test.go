@@ -0,0 +1,247 @@
+package mosaic
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"sync"
+	"testing"
+)
+
+// 原点 origin を通る tile の格子で、img の範囲と重なる部分ごとに平均した結果
+// 格子は画像より大きいタイルでも切り詰める前と同じ (成分は RoundHalfUp で丸める)
+func referenceGridMosaic(img *image.NRGBA, tile int, origin image.Point) *image.NRGBA {
+	b := img.Rect
+	out := image.NewNRGBA(b)
+	startX := b.Min.X - floorMod(b.Min.X-origin.X, tile)
+	startY := b.Min.Y - floorMod(b.Min.Y-origin.Y, tile)
+	for ty := startY; ty < b.Max.Y; ty += tile {
+		for tx := startX; tx < b.Max.X; tx += tile {
+			rect := image.Rect(tx, ty, tx+tile, ty+tile).Intersect(b)
+			var sum [3]int
+			for y := rect.Min.Y; y < rect.Max.Y; y++ {
+				for x := rect.Min.X; x < rect.Max.X; x++ {
+					c := img.NRGBAAt(x, y)
+					sum[0] += int(c.R)
+					sum[1] += int(c.G)
+					sum[2] += int(c.B)
+				}
+			}
+			n := rect.Dx() * rect.Dy()
+			c := color.NRGBA{R: uint8((2*sum[0] + n) / (2 * n)), G: uint8((2*sum[1] + n) / (2 * n)), B: uint8((2*sum[2] + n) / (2 * n)), A: 255}
+			for y := rect.Min.Y; y < rect.Max.Y; y++ {
+				for x := rect.Min.X; x < rect.Max.X; x++ {
+					out.SetNRGBA(x, y, c)
+				}
+			}
+		}
+	}
+	return out
+}
+
+// 受け取ったバンドの大きさを記録するだけの Stage
+type bandRecorder struct {
+	mu     sync.Mutex
+	margin int
+	max    image.Point // 受け取ったバンドの最大の幅と高さ
+	bytes  int         // 受け取ったバンドのバッファの最大のバイト数
+}
+
+func (r *bandRecorder) Margin() int { return r.margin }
+
+func (r *bandRecorder) Apply(band *image.NRGBA, rect image.Rectangle) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.max = image.Pt(max(r.max.X, band.Rect.Dx()), max(r.max.Y, band.Rect.Dy()))
+	r.bytes = max(r.bytes, cap(band.Pix))
+	return nil
+}
+
+// 幅と高さ 0〜5 の画像をタイル 1〜5 で処理する
+// 空の画像は ErrEmptyImage になり、それ以外はどの処理の方法でも切り詰める前の格子の平均と同じになる
+func TestTinyImages(t *testing.T) {
+	configs := []struct {
+		name string
+		opts []Option
+	}{
+		{"default", nil},
+		{"workers", []Option{WithWorkers(3)}},
+		{"prefetch", []Option{WithPrefetch(2)}},
+		{"blocks", []Option{WithBlockSize(2, 2)}},
+		{"grid origin", []Option{WithGridOrigin(image.Pt(1, 2))}},
+	}
+	for _, min := range []image.Point{{0, 0}, {3, 7}, {-2, -1}} {
+		for w := 0; w <= 5; w++ {
+			for h := 0; h <= 5; h++ {
+				img := testImageAt(image.Rectangle{Min: min, Max: min.Add(image.Pt(w, h))})
+				for tile := 1; tile <= 5; tile++ {
+					for _, c := range configs {
+						name := fmt.Sprintf("%dx%d at %v, tile %d, %s", w, h, min, tile, c.name)
+						checkTinyImage(t, name, img, tile, c.opts)
+					}
+				}
+			}
+		}
+	}
+}
+
+func checkTinyImage(t *testing.T, name string, img *image.NRGBA, tile int, opts []Option) {
+	t.Helper()
+	// 指定した格子の原点 (指定しない場合は (0, 0))
+	probe := &Processor{}
+	for _, o := range opts {
+		o(probe)
+	}
+	origin := probe.gridOrigin
+
+	out, err := New(img, tile, tile, opts...).ProcessContext(context.Background())
+	if img.Rect.Empty() {
+		if !errors.Is(err, ErrEmptyImage) || out != nil {
+			t.Errorf("%s: %v, %v, want ErrEmptyImage", name, out, err)
+		}
+		return
+	}
+	if err != nil {
+		t.Fatalf("%s: %v", name, err)
+	}
+	want := referenceGridMosaic(img, tile, origin)
+	if out.Rect != want.Rect || !bytes.Equal(out.Pix, want.Pix) {
+		t.Errorf("%s: output differs from the reference", name)
+	}
+	// バッファは余白を含めても元画像より大きくしない
+	rec := &bandRecorder{margin: 2}
+	if _, err := New(img, tile, tile, append(opts, WithPipeline(NewPipeline(rec)))...).ProcessContext(context.Background()); err != nil {
+		t.Fatalf("%s: %v", name, err)
+	}
+	size := img.Rect.Size()
+	if rec.max.X > size.X || rec.max.Y > size.Y || rec.bytes > 4*size.X*size.Y {
+		t.Errorf("%s: band up to %v (%d bytes) for a %v image", name, rec.max, rec.bytes, size)
+	}
+}
+
+// 空の画像はどの処理のメソッドでも ErrEmptyImage になる
+func TestEmptyImageErrors(t *testing.T) {
+	for _, r := range []image.Rectangle{image.Rect(0, 0, 0, 0), image.Rect(0, 0, 0, 10), image.Rect(0, 0, 10, 0), image.Rect(5, 5, 5, 9)} {
+		img := image.NewNRGBA(r)
+		mp := New(img, 4, 4, WithTileVisitor(func(Tile) error { return nil }))
+		var buf bytes.Buffer
+		for _, tt := range []struct {
+			method string
+			err    error
+		}{
+			{"ProcessContext", func() error { _, err := mp.ProcessContext(context.Background()); return err }()},
+			{"ProcessInto", mp.ProcessInto(context.Background(), image.NewNRGBA(r))},
+			{"ProcessTo", mp.ProcessTo(context.Background(), &buf, "png", EncodeOptions{})},
+			{"ProcessToWriterAt", mp.ProcessToWriterAt(context.Background(), &memWriterAt{}, "ppm")},
+			{"ProcessTiles", mp.ProcessTiles(context.Background())},
+		} {
+			if !errors.Is(tt.err, ErrEmptyImage) {
+				t.Errorf("%v: %s = %v, want ErrEmptyImage", r, tt.method, tt.err)
+			}
+		}
+		if buf.Len() != 0 {
+			t.Errorf("%v: ProcessTo wrote %d bytes", r, buf.Len())
+		}
+		if _, err := mp.Bands(context.Background()).Next(); !errors.Is(err, ErrEmptyImage) {
+			t.Errorf("%v: Bands = %v, want ErrEmptyImage", r, err)
+		}
+		if g := mp.Grid(); len(g.Cells()) != 0 {
+			t.Errorf("%v: grid has %d cells", r, len(g.Cells()))
+		}
+	}
+}
+
+// 0 以下のタイルの大きさは、どの処理のメソッドでも *TileSizeError になる
+func TestTileSizeErrors(t *testing.T) {
+	img := testImage(8, 8)
+	for _, size := range []image.Point{{0, 4}, {4, 0}, {-1, -1}, {0, 0}} {
+		mp := New(img, size.X, size.Y, WithTileVisitor(func(Tile) error { return nil }))
+		errs := map[string]error{
+			"ProcessInto":  mp.ProcessInto(context.Background(), image.NewNRGBA(img.Rect)),
+			"ProcessBands": mp.ProcessBands(context.Background(), func(*image.NRGBA, image.Rectangle) error { return nil }),
+			"ProcessTiles": mp.ProcessTiles(context.Background()),
+		}
+		_, errs["ProcessContext"] = mp.ProcessContext(context.Background())
+		_, errs["ProcessInPlace"] = mp.ProcessInPlace(context.Background())
+		_, errs["Bands"] = mp.Bands(context.Background()).Next()
+		for method, err := range errs {
+			var tse *TileSizeError
+			if !errors.As(err, &tse) || tse.Width != size.X || tse.Height != size.Y {
+				t.Errorf("%v: %s = %v, want *TileSizeError", size, method, err)
+			}
+		}
+		if g := mp.Grid(); len(g.Cells()) != 0 {
+			t.Errorf("%v: grid has %d cells", size, len(g.Cells()))
+		}
+	}
+}
+
+// 画像全体を覆うタイルは、画像全体の平均色の 1 色になる
+func TestWholeImageTile(t *testing.T) {
+	img := testImage(300, 200)
+	want := MeanColor(PixelRegion{img: img, Rect: img.Rect})
+	for _, size := range []image.Point{{300, 200}, {500, 500}, {300, 1000}} {
+		mp := New(img, size.X, size.Y)
+		if g := mp.Grid(); g.Columns != 1 || g.Rows != 1 || g.TileWidth != 300 || g.TileHeight != 200 {
+			t.Errorf("tile %v: grid %+v", size, g)
+		}
+		out, err := mp.ProcessContext(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		for y := 0; y < 200; y++ {
+			for x := 0; x < 300; x++ {
+				if c := out.NRGBAAt(x, y); c != want {
+					t.Fatalf("tile %v: pixel (%d, %d) = %v, want %v", size, x, y, c, want)
+				}
+			}
+		}
+	}
+	// 幅だけが画像より大きい場合は、画像の幅のタイルが縦に並ぶ
+	out, err := New(img, 500, 64).ProcessContext(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, y := range []int{0, 63, 64, 199} {
+		top := y - y%64
+		want := MeanColor(PixelRegion{img: img, Rect: image.Rect(0, top, 300, min(top+64, 200))})
+		if a, b := out.NRGBAAt(0, y), out.NRGBAAt(299, y); a != want || b != want {
+			t.Errorf("row %d: %v and %v, want %v", y, a, b, want)
+		}
+	}
+}
+
+// 1×1 のタイルは、色を変えない限り元画像と同じ
+func TestOneByOneTile(t *testing.T) {
+	img := testImage(64, 48)
+	if out := process(t, img, 1); !bytes.Equal(out.Pix, img.Pix) {
+		t.Error("opaque 1x1 tiles changed the image")
+	}
+	// 平均色の計算を省かない場合 (タイルを通知する場合) と同じ結果
+	if out := process(t, img, 1, WithTileObserver(func(TileInfo) {})); !bytes.Equal(out.Pix, img.Pix) {
+		t.Error("1x1 tiles with an observer changed the image")
+	}
+	work := image.NewNRGBA(img.Rect)
+	copy(work.Pix, img.Pix)
+	if _, err := New(work, 1, 1).ProcessInPlace(context.Background()); err != nil || !bytes.Equal(work.Pix, img.Pix) {
+		t.Errorf("ProcessInPlace with 1x1 tiles changed the image (%v)", err)
+	}
+	// 色の変換は画素ごとに適用する
+	shifted := process(t, img, 1, WithHueShift(90))
+	if c, want := shifted.NRGBAAt(10, 20), ShiftHue(img.NRGBAAt(10, 20), 90); c != want {
+		t.Errorf("hue-shifted pixel %v, want %v", c, want)
+	}
+
+	// 半透明の画素は他のタイルと同じく乗算済みの値の平均になり、平均色を計算する場合と同じ
+	translucent := testImage(64, 48)
+	for i := 3; i < len(translucent.Pix); i += 4 {
+		translucent.Pix[i] = uint8(i)
+	}
+	want := process(t, translucent, 1, WithTileObserver(func(TileInfo) {}))
+	if out := process(t, translucent, 1); !bytes.Equal(out.Pix, want.Pix) {
+		t.Error("translucent 1x1 tiles differ from the averaged result")
+	}
+}
@@ -0,0 +1,200 @@
+package mosaic
+
+import (
+	"context"
+	"errors"
+	"image"
+	"image/color"
+	"time"
+)
+
+// ProcessTiles が WithTileVisitor の関数に渡すタイルの解析結果
+type Tile struct {
+	TileInfo
+	Variance [4]float64 // 色の計算に使った画素の R, G, B, A の分散 (WithTileVariance を指定した場合だけ求める)
+}
+
+// ProcessTiles でタイルごとに呼び出される関数を設定
+// 関数がエラーを返した場合は処理を中断し、ProcessTiles はそのエラーを返す
+func WithTileVisitor(fn func(Tile) error) Option {
+	return func(mp *Processor) {
+		mp.visitor = fn
+	}
+}
+
+// ProcessTiles でタイルの画素の成分ごとの分散も求める
+// 分散は除外した画素を含まない、重み付けのない母分散 (0〜255 の値の 2 乗の単位)
+func WithTileVariance() Option {
+	return func(mp *Processor) {
+		mp.variance = true
+	}
+}
+
+// 出力画像を作らずにタイルの色だけを求め、WithTileVisitor の関数に渡す
+// タイルは行優先の順 (上の行から、各行は左から) に 1 度ずつ渡し、WithStripes の場合は縞の部分ごとに渡す
+// 書き換えないタイル (WithExclude や WithPattern など) も Skipped を true にして渡す
+// タイルの色と画素数は同じ設定のモザイク処理で WithTileObserver に渡すものと同じで、WithTileObserver の関数も呼び出す
+// 塗りつぶしと出力画像の確保をせず、バンド 1 つのバッファだけで処理するため、WithWorkers、WithPrefetch、WithBlockSize は使わない
+// WithPipeline を指定した場合はタイルの色が決まらないため、エラーを返す
+func (mp *Processor) ProcessTiles(ctx context.Context) (err error) {
+	if mp.err != nil {
+		return mp.err
+	}
+	if mp.stage == nil {
+		return errors.New("mosaic: ProcessTiles cannot be used with WithPipeline")
+	}
+	if mp.metrics != nil {
+		start := time.Now()
+		mp.metrics.ProcessStarted()
+		defer func() {
+			size := mp.src.Bounds().Size()
+			mp.metrics.ProcessFinished(time.Since(start), size.X*size.Y, err)
+		}()
+	}
+	grid := mp.Grid()
+	bounds := mp.src.Bounds()
+	buffer := mp.newBandBuffer()
+	defer mp.releaseBuffers(buffer)
+	v := &tileVisitor{stage: mp.stage, fn: mp.visitor, variance: mp.variance}
+	offset := grid.start().Y
+	for i := 0; i < grid.Rows; i++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		var rect image.Rectangle
+		if mp.skipsBand(offset) {
+			rect = image.Rect(0, offset, bounds.Max.X, offset+mp.mosaicHeight).Intersect(bounds)
+			err = v.visit(nil, rect)
+		} else if v.direct() {
+			// 平均色を元画像から直接求めるため、バンドを読み込まない
+			rect = image.Rect(0, offset, bounds.Max.X, offset+mp.mosaicHeight).Intersect(bounds)
+			err = v.visit(buffer, rect)
+		} else {
+			rect = mp.readToBuffer(buffer, offset, nil)
+			err = v.visit(buffer, rect)
+		}
+		if err != nil {
+			return err
+		}
+		mp.bandDone(rect, i+1, grid.Rows)
+		offset += mp.mosaicHeight
+	}
+	return nil
+}
+
+// バンドのタイルの色を求めて渡す処理 (バンドを書き換えない)
+type tileVisitor struct {
+	stage    *MosaicStage
+	fn       func(Tile) error
+	variance bool
+	excluded []excludedPixel // 除外した画素を数えるバッファ (タイルごとに再利用する)
+}
+
+// タイルの色を NewImage の元画像から直接求め、バンドの画素を使わないかどうか (MosaicStage の tileColor で tileMean が source を読む場合)
+func (v *tileVisitor) direct() bool {
+	s := v.stage
+	return s.source != nil && s.Filter == BoxFilter && s.TileColor == nil && s.Exclude == nil && s.Selection == nil &&
+		s.SkipEdges <= 0 && !v.variance
+}
+
+// band の rect の範囲のタイルを渡す
+// band が nil の場合は、すべてのタイルを処理しなかったものとして渡す (MosaicStage の skipTiles と同じ順)
+func (v *tileVisitor) visit(band *image.NRGBA, rect image.Rectangle) error {
+	var filter pixelFilter
+	if band != nil {
+		filter = v.stage.filter(rect)
+	}
+	if !v.stage.Stripes.active() {
+		return v.visitRect(band, rect, filter)
+	}
+	for _, r := range v.stage.Stripes.split(rect) {
+		if err := v.visitRect(band, r, filter); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rect の範囲のタイルを applyTiles と同じ順に渡す
+func (v *tileVisitor) visitRect(band *image.NRGBA, rect image.Rectangle, filter pixelFilter) error {
+	s := v.stage
+	for y := rect.Min.Y - floorMod(rect.Min.Y-s.Origin.Y, s.TileHeight); y < rect.Max.Y; y += s.TileHeight {
+		row := floorDiv(y-s.Origin.Y, s.TileHeight)
+		for x := rect.Min.X - floorMod(rect.Min.X-s.Origin.X, s.TileWidth); x < rect.Max.X; x += s.TileWidth {
+			column := floorDiv(x-s.Origin.X, s.TileWidth)
+			t := Tile{TileInfo: TileInfo{X: column, Y: row, Rect: image.Rect(x, y, x+s.TileWidth, y+s.TileHeight).Intersect(rect), Skipped: true}}
+			if band != nil {
+				v.tile(band, &t, filter)
+			}
+			s.observe(t.TileInfo)
+			if v.fn != nil {
+				if err := v.fn(t); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// タイルの色を applyTiles と同じ条件で求めて t に設定する (書き換えないタイルは Skipped のまま)
+func (v *tileVisitor) tile(band *image.NRGBA, t *Tile, filter pixelFilter) {
+	s := v.stage
+	if s.Pattern != nil && !s.Pattern(t.X, t.Y) {
+		return
+	}
+	if s.Strength != nil {
+		if strength, _ := tileStrength(s.Strength, t.Rect); strength == 0 {
+			return
+		}
+	}
+	excluded := 0
+	if filter.active() {
+		v.excluded = appendExcluded(v.excluded[:0], band, t.Rect, filter)
+		if excluded = len(v.excluded); excluded == t.Rect.Dx()*t.Rect.Dy() {
+			return
+		}
+	}
+	c, skip := s.tileColor(band, t.Rect, filter)
+	if skip {
+		return
+	}
+	for _, a := range s.Adjusts {
+		c = a.Adjust(c)
+	}
+	t.Color, t.Pixels, t.Skipped = c, t.Rect.Dx()*t.Rect.Dy()-excluded, false
+	if v.variance {
+		t.Variance = tileVariance(band, t.Rect, filter)
+	}
+}
+
+// タイルの除外しない画素の成分ごとの分散
+func tileVariance(img *image.NRGBA, rect image.Rectangle, filter pixelFilter) [4]float64 {
+	var sum, sq [4]uint64
+	n := 0
+	width := 4 * rect.Dx()
+	for y := rect.Min.Y; y < rect.Max.Y; y++ {
+		i := img.PixOffset(rect.Min.X, y)
+		row := img.Pix[i : i+width : i+width]
+		for x := 0; x < len(row); x += 4 {
+			if filter.active() && filter.excluded(rect.Min.X+x/4, y, color.NRGBA{row[x], row[x+1], row[x+2], row[x+3]}) {
+				continue
+			}
+			for c := 0; c < 4; c++ {
+				p := uint64(row[x+c])
+				sum[c] += p
+				sq[c] += p * p
+			}
+			n++
+		}
+	}
+	var variance [4]float64
+	if n == 0 {
+		return variance
+	}
+	for c := range variance {
+		mean := float64(sum[c]) / float64(n)
+		variance[c] = max(0, float64(sq[c])/float64(n)-mean*mean)
+	}
+	return variance
+}
@@ -0,0 +1,202 @@
+package mosaic
+
+import (
+	"context"
+	"errors"
+	"image"
+	"math"
+	"slices"
+	"sync"
+	"testing"
+)
+
+// ProcessTiles で渡されたタイル
+func visitTiles(t *testing.T, img image.Image, tile int, opts ...Option) []Tile {
+	t.Helper()
+	var tiles []Tile
+	opts = append(opts, WithTileVisitor(func(tile Tile) error {
+		tiles = append(tiles, tile)
+		return nil
+	}))
+	if err := NewImage(img, tile, tile, opts...).ProcessTiles(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	return tiles
+}
+
+// モザイク処理で WithTileObserver に渡されたタイル (範囲の左上の行優先の順に並べる)
+func observeTiles(t *testing.T, img image.Image, tile int, opts ...Option) []TileInfo {
+	t.Helper()
+	var mu sync.Mutex
+	var tiles []TileInfo
+	opts = append(opts, WithTileObserver(func(info TileInfo) {
+		mu.Lock()
+		tiles = append(tiles, info)
+		mu.Unlock()
+	}), WithWorkers(4))
+	if _, err := NewImage(img, tile, tile, opts...).ProcessContext(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	slices.SortFunc(tiles, func(a, b TileInfo) int {
+		if a.Rect.Min.Y != b.Rect.Min.Y {
+			return a.Rect.Min.Y - b.Rect.Min.Y
+		}
+		return a.Rect.Min.X - b.Rect.Min.X
+	})
+	return tiles
+}
+
+func TestProcessTilesMatchesObserver(t *testing.T) {
+	img := testImageAt(image.Rect(3, 1, 90, 61))
+	half := testRGBA(77, 50, 200)
+	tests := []struct {
+		name string
+		img  image.Image
+		opts []Option
+	}{
+		{"nrgba", img, nil},
+		{"rgba", half, nil},
+		{"ycbcr", testSources()["ycbcr"], nil},
+		{"grid origin", img, []Option{WithGridOrigin(image.Pt(7, 5))}},
+		{"mask", img, []Option{WithMask(rectMask(img.Rect, image.Rect(10, 10, 50, 30)))}},
+		{"pattern", img, []Option{WithTilePattern(func(x, y int) bool { return (x+y)%2 == 0 })}},
+		{"lab color", img, []Option{WithTileColor(LabMeanColor)}},
+		{"gaussian", img, []Option{WithTileFilter(GaussFilter)}},
+		{"stripes", img, []Option{WithStripes(3, 2)}},
+	}
+	for _, tt := range tests {
+		got := visitTiles(t, tt.img, 8, tt.opts...)
+		want := observeTiles(t, tt.img, 8, tt.opts...)
+		if len(got) != len(want) {
+			t.Fatalf("%s: %d tiles, want %d", tt.name, len(got), len(want))
+		}
+		for i := range got {
+			// 行優先の順に渡す (縞の部分は上から順に、同じ行の部分は左から)
+			if i > 0 {
+				p, q := got[i-1].Rect.Min, got[i].Rect.Min
+				if q.Y < p.Y || q.Y == p.Y && q.X <= p.X {
+					t.Fatalf("%s: tile %d at %v after %v", tt.name, i, q, p)
+				}
+			}
+			if got[i].TileInfo != want[i] {
+				t.Fatalf("%s: tile %d = %+v, want %+v", tt.name, i, got[i].TileInfo, want[i])
+			}
+		}
+	}
+}
+
+func TestProcessTilesColorsMatchOutput(t *testing.T) {
+	img := testImage(61, 45)
+	out := process(t, img, 8)
+	tiles := visitTiles(t, img, 8)
+	if len(tiles) != 8*6 {
+		t.Fatalf("%d tiles", len(tiles))
+	}
+	for _, tile := range tiles {
+		if tile.Skipped || tile.Pixels != tile.Rect.Dx()*tile.Rect.Dy() || tile.Rect != image.Rect(8*tile.X, 8*tile.Y, 8*tile.X+8, 8*tile.Y+8).Intersect(img.Rect) {
+			t.Fatalf("tile %+v", tile)
+		}
+		if c := out.NRGBAAt(tile.Rect.Min.X, tile.Rect.Min.Y); c != tile.Color {
+			t.Errorf("tile (%d,%d) color %v, output %v", tile.X, tile.Y, tile.Color, c)
+		}
+	}
+}
+
+func TestProcessTilesVariance(t *testing.T) {
+	img := testImage(40, 24)
+	mask := rectMask(img.Rect, image.Rect(0, 0, 20, 24))
+	for _, opts := range [][]Option{nil, {WithMask(mask)}} {
+		for _, tile := range visitTiles(t, img, 8, append(opts, WithTileVariance())...) {
+			var sum, sq [4]float64
+			n := 0.0
+			for y := tile.Rect.Min.Y; y < tile.Rect.Max.Y; y++ {
+				for x := tile.Rect.Min.X; x < tile.Rect.Max.X; x++ {
+					if opts != nil && mask.AlphaAt(x, y).A == 0 {
+						continue
+					}
+					c := img.NRGBAAt(x, y)
+					for i, v := range []uint8{c.R, c.G, c.B, c.A} {
+						sum[i] += float64(v)
+						sq[i] += float64(v) * float64(v)
+					}
+					n++
+				}
+			}
+			for i := range sum {
+				want := 0.0
+				if n > 0 {
+					want = sq[i]/n - (sum[i]/n)*(sum[i]/n)
+				}
+				if math.Abs(tile.Variance[i]-want) > 1e-6 {
+					t.Fatalf("tile (%d,%d) channel %d: variance %g, want %g", tile.X, tile.Y, i, tile.Variance[i], want)
+				}
+			}
+		}
+	}
+	// 指定しない場合は求めない
+	for _, tile := range visitTiles(t, img, 8) {
+		if tile.Variance != ([4]float64{}) {
+			t.Fatalf("variance without WithTileVariance: %v", tile.Variance)
+		}
+	}
+}
+
+func TestProcessTilesErrors(t *testing.T) {
+	img := testImage(64, 64)
+	errStop := errors.New("stop")
+	n := 0
+	err := New(img, 8, 8, WithTileVisitor(func(Tile) error {
+		n++
+		if n == 5 {
+			return errStop
+		}
+		return nil
+	})).ProcessTiles(context.Background())
+	if !errors.Is(err, errStop) || n != 5 {
+		t.Errorf("visitor error: %v after %d tiles", err, n)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := New(img, 8, 8).ProcessTiles(ctx); !errors.Is(err, context.Canceled) {
+		t.Errorf("canceled: %v", err)
+	}
+	if err := New(img, 8, 8, WithPipeline(NewPipeline())).ProcessTiles(context.Background()); err == nil {
+		t.Error("ProcessTiles with WithPipeline succeeded")
+	}
+}
+
+// 出力画像を確保せず、バンドのバッファのほかはほとんど確保しない
+func TestProcessTilesAllocations(t *testing.T) {
+	img := testImage(256, 256)
+	mp := New(img, 16, 16, WithTileVisitor(func(Tile) error { return nil }))
+	allocs := testing.AllocsPerRun(5, func() {
+		if err := mp.ProcessTiles(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	})
+	if allocs > 10 {
+		t.Errorf("%g allocations per run", allocs)
+	}
+}
+
+func BenchmarkProcessTiles(b *testing.B) {
+	img := testImage(4096, 3072)
+	b.Run("tiles", func(b *testing.B) {
+		b.SetBytes(int64(len(img.Pix)))
+		b.ReportAllocs()
+		mp := New(img, 16, 16, WithTileVisitor(func(Tile) error { return nil }))
+		for i := 0; i < b.N; i++ {
+			if err := mp.ProcessTiles(context.Background()); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("process", func(b *testing.B) {
+		b.SetBytes(int64(len(img.Pix)))
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			process(b, img, 16, WithWorkers(1))
+		}
+	})
+}
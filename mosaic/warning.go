@@ -0,0 +1,78 @@
+package mosaic
+
+import (
+	"slices"
+	"sort"
+)
+
+// 処理を続けられたが、呼び出し側に知らせる事柄の種類
+type WarningCode string
+
+const (
+	WarningTileClamped   WarningCode = "tile_clamped"   // 画像より大きいタイルを画像の大きさに切り詰めた
+	WarningRegionClipped WarningCode = "region_clipped" // ProcessRegions の範囲が画像からはみ出したため、画像の範囲で切り詰めた
+	WarningRegionSkipped WarningCode = "region_skipped" // ProcessRegions の範囲が画像と重ならないため、処理しなかった
+)
+
+// 処理を続けられたが、呼び出し側に知らせる事柄
+// Fields は事柄ごとの値 (タイルの大きさや範囲など、ない場合は nil)
+type Warning struct {
+	Code    WarningCode    `json:"code"`
+	Message string         `json:"message"`
+	Fields  map[string]any `json:"fields,omitempty"`
+}
+
+// WithStrict で指定した種類の警告を、処理のエラーとして返すエラー
+type WarningError struct {
+	Warning Warning
+}
+
+func (e *WarningError) Error() string {
+	return "mosaic: " + e.Warning.Message + " (" + string(e.Warning.Code) + ")"
+}
+
+// 指定した種類の警告を処理を続けずにエラーにする
+// 処理のメソッド (ProcessRegions も含む) は、その警告を *WarningError にして返す
+func WithStrict(codes ...WarningCode) Option {
+	return func(mp *Processor) {
+		mp.strict = append(mp.strict, codes...)
+	}
+}
+
+// 警告ごとに呼び出される関数を設定
+// ProcessRegions の範囲についての警告と、範囲ごとの処理の警告も渡す
+func WithWarnings(fn func(Warning)) Option {
+	return func(mp *Processor) {
+		mp.onWarning = fn
+	}
+}
+
+// インスタンスの生成と処理で記録した警告 (WithStrict でエラーにした警告は含まない)
+func (mp *Processor) Warnings() []Warning {
+	return slices.Clone(mp.warnings)
+}
+
+// 警告を記録し、WithLogger のロガーに出力して WithWarnings の関数に渡す
+// WithStrict で指定した種類の場合は記録せずに *WarningError を返す
+func (mp *Processor) warn(w Warning) error {
+	if slices.Contains(mp.strict, w.Code) {
+		return &WarningError{Warning: w}
+	}
+	mp.warnings = append(mp.warnings, w)
+	if mp.logger != nil {
+		args := []any{"code", string(w.Code)}
+		keys := make([]string, 0, len(w.Fields))
+		for k := range w.Fields {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			args = append(args, k, w.Fields[k])
+		}
+		mp.logger.Warn(w.Message, args...)
+	}
+	if mp.onWarning != nil {
+		mp.onWarning(w)
+	}
+	return nil
+}
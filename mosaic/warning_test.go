@@ -0,0 +1,155 @@
+package mosaic
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"image"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+// WithWarnings に渡された警告の種類
+func collectWarnings(codes *[]WarningCode) Option {
+	return WithWarnings(func(w Warning) {
+		*codes = append(*codes, w.Code)
+	})
+}
+
+func TestWarningsLenient(t *testing.T) {
+	img := testImage(20, 12)
+	var log bytes.Buffer
+	var codes []WarningCode
+	mp := New(img, 32, 8, WithLogger(slog.New(slog.NewTextHandler(&log, nil))), collectWarnings(&codes))
+	out, err := mp.ProcessContext(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 切り詰めたタイルで処理を続ける
+	want, err := New(img, 20, 8).ProcessContext(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertSameImage(t, out, want)
+	warnings := mp.Warnings()
+	if len(warnings) != 1 || warnings[0].Code != WarningTileClamped || len(codes) != 1 || codes[0] != WarningTileClamped {
+		t.Fatalf("warnings %+v, observed %v", warnings, codes)
+	}
+	if f := warnings[0].Fields; f["tile_width"] != 32 || f["tile_height"] != 8 || f["width"] != 20 || f["height"] != 12 {
+		t.Errorf("fields %v", f)
+	}
+	if !strings.Contains(log.String(), "level=WARN") || !strings.Contains(log.String(), "code=tile_clamped") || !strings.Contains(log.String(), "height=12 tile_height=8") {
+		t.Errorf("log %q", log.String())
+	}
+	// Warnings は写しを返す
+	warnings[0].Code = "changed"
+	if mp.Warnings()[0].Code != WarningTileClamped {
+		t.Error("Warnings shares the recorded slice")
+	}
+	// タイルが画像に収まる場合は警告しない
+	if w := New(img, 4, 4).Warnings(); len(w) != 0 {
+		t.Errorf("warnings %+v", w)
+	}
+}
+
+func TestRegionWarningsLenient(t *testing.T) {
+	img := testImage(40, 30)
+	regions := []Region{
+		{Rect: image.Rect(30, 20, 60, 50)},                              // はみ出す
+		{Rect: image.Rect(100, 0, 120, 10)},                             // 重ならない
+		{Rect: image.Rect(0, 0, 100, 8), TileWidth: 200, TileHeight: 4}, // はみ出し、タイルも大きい
+	}
+	var got []Warning
+	out := processRegionsCopy(t, img, 8, regions, WithWarnings(func(w Warning) { got = append(got, w) }))
+	want := []WarningCode{WarningRegionClipped, WarningRegionSkipped, WarningRegionClipped, WarningTileClamped}
+	if len(got) != len(want) {
+		t.Fatalf("warnings %+v", got)
+	}
+	for i, w := range got {
+		if w.Code != want[i] {
+			t.Errorf("warning %d: %s, want %s", i, w.Code, want[i])
+		}
+	}
+	if f := got[0].Fields; f["region"] != 1 || f["rect"] != "(30,20)-(60,50)" || f["clipped"] != "(30,20)-(40,30)" {
+		t.Errorf("clipped fields %v", f)
+	}
+	if f := got[1].Fields; f["region"] != 2 || f["clipped"] != nil {
+		t.Errorf("skipped fields %v", f)
+	}
+	// はみ出した範囲も画像の中は処理する
+	if out.NRGBAAt(35, 25) == img.NRGBAAt(35, 25) && out.NRGBAAt(39, 29) == img.NRGBAAt(39, 29) {
+		t.Error("clipped region was not processed")
+	}
+}
+
+func TestWarningsStrict(t *testing.T) {
+	img := testImage(20, 12)
+	var codes []WarningCode
+	mp := New(img, 32, 8, WithStrict(WarningTileClamped), collectWarnings(&codes))
+	_, err := mp.ProcessContext(context.Background())
+	var werr *WarningError
+	if !errors.As(err, &werr) || werr.Warning.Code != WarningTileClamped {
+		t.Fatalf("error %v, want a tile_clamped WarningError", err)
+	}
+	if want := "mosaic: tile size is larger than the image; clamped to the image size (tile_clamped)"; err.Error() != want {
+		t.Errorf("error %q, want %q", err, want)
+	}
+	// エラーにした警告は記録せず、関数にも渡さない
+	if len(mp.Warnings()) != 0 || len(codes) != 0 {
+		t.Errorf("warnings %+v, observed %v", mp.Warnings(), codes)
+	}
+	for _, process := range []func() error{
+		func() error { return mp.ProcessInto(context.Background(), image.NewNRGBA(img.Rect)) },
+		func() error { return mp.ProcessTiles(context.Background()) },
+		func() error { _, err := mp.Bands(context.Background()).Next(); return err },
+	} {
+		if err := process(); !errors.As(err, &werr) {
+			t.Errorf("error %v, want a WarningError", err)
+		}
+	}
+
+	// ほかの種類を指定した場合は警告のまま
+	mp = New(img, 32, 8, WithStrict(WarningRegionSkipped, WarningRegionClipped))
+	if _, err := mp.ProcessContext(context.Background()); err != nil || len(mp.Warnings()) != 1 {
+		t.Errorf("%v, warnings %+v", err, mp.Warnings())
+	}
+}
+
+func TestRegionWarningsStrict(t *testing.T) {
+	img := testImage(40, 30)
+	regions := []Region{
+		{Rect: image.Rect(0, 0, 16, 16)},
+		{Rect: image.Rect(100, 0, 120, 10)},
+	}
+	for _, tt := range []struct {
+		strict WarningCode
+		fail   bool
+	}{
+		{WarningRegionSkipped, true},
+		{WarningRegionClipped, false},
+	} {
+		work := image.NewNRGBA(img.Rect)
+		copy(work.Pix, img.Pix)
+		err := ProcessRegions(context.Background(), work, 8, 8, regions, WithStrict(tt.strict))
+		var werr *WarningError
+		if tt.fail != errors.As(err, &werr) {
+			t.Fatalf("strict %s: %v", tt.strict, err)
+		}
+		if !tt.fail {
+			continue
+		}
+		if werr.Warning.Code != tt.strict || werr.Warning.Fields["region"] != 2 {
+			t.Errorf("strict %s: %+v", tt.strict, werr.Warning)
+		}
+		// 範囲を調べ終える前に失敗し、画像を書き換えない
+		if !bytes.Equal(work.Pix, img.Pix) {
+			t.Errorf("strict %s: image was modified", tt.strict)
+		}
+	}
+	// 範囲ごとの処理の警告もエラーにする
+	err := ProcessRegions(context.Background(), testImage(40, 30), 8, 8, []Region{{Rect: image.Rect(0, 0, 10, 10), TileWidth: 32, TileHeight: 32}}, WithStrict(WarningTileClamped))
+	if werr := (*WarningError)(nil); !errors.As(err, &werr) || werr.Warning.Code != WarningTileClamped {
+		t.Errorf("region tile clamped: %v", err)
+	}
+}
@@ -0,0 +1,208 @@
+package mosaic
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"io"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 各行の出力の位置が画像の大きさだけで決まる (圧縮しない) 形式
+// ヘッダーの後に、上の行から順に 1 画素あたり bytesPerPixel バイトの行を並べる
+type offsetFormat interface {
+	header(size image.Point) []byte
+	bytesPerPixel() int
+	// NRGBA の画素の列 src を dst に変換する (dst の長さは画素数 × bytesPerPixel)
+	encodePixels(dst, src []uint8)
+}
+
+// ProcessToWriterAt で書き出せる形式
+var offsetFormats = map[string]offsetFormat{
+	"ppm":  ppmFormat{},
+	"rgba": rgbaFormat{},
+}
+
+// name の形式を ProcessToWriterAt で書き出せるかどうか
+func IsOffsetFormat(name string) bool {
+	_, ok := offsetFormats[strings.ToLower(name)]
+	return ok
+}
+
+// ProcessToWriterAt で書き出せない形式を指定したことを表すエラー
+type OffsetFormatError struct {
+	Name    string   // 指定した形式の名前
+	Formats []string // ProcessToWriterAt で書き出せる形式
+}
+
+func (e *OffsetFormatError) Error() string {
+	return fmt.Sprintf("mosaic: format %q cannot be written at band offsets (supported formats: %s)", e.Name, strings.Join(e.Formats, ", "))
+}
+
+// モザイク処理を実行し、処理後の画像を format の形式で w に書き出す
+// 圧縮しない形式 (ppm と rgba) はバンドの出力の位置が前もって決まるため、ヘッダーを書いた後、
+// WithWorkers のゴルーチンがそれぞれ処理したバンドを直接その位置に書き込む
+// 出力画像全体を確保せず、1 つの io.Writer への書き込みを待つこともない
+// 書き込む順序は決まらないが、書き出す内容は ProcessTo と同じになる
+// w は io.WriterAt の約束どおり、重ならない範囲への WriteAt を同時に呼び出せること (*os.File など)
+// WithBlockSize によらず常にバンドで処理し、WithProgress の進捗は処理の終わったバンドの数を数える
+// 書き出せない形式の場合は処理せずに *OffsetFormatError を返却
+func (mp *Processor) ProcessToWriterAt(ctx context.Context, w io.WriterAt, format string) (err error) {
+	f, ok := offsetFormats[strings.ToLower(format)]
+	if !ok {
+		formats := make([]string, 0, len(offsetFormats))
+		for name := range offsetFormats {
+			formats = append(formats, name)
+		}
+		slices.Sort(formats)
+		return &OffsetFormatError{Name: format, Formats: formats}
+	}
+	if mp.err != nil {
+		return mp.err
+	}
+	if mp.metrics != nil {
+		start := time.Now()
+		mp.metrics.ProcessStarted()
+		defer func() {
+			size := mp.src.Bounds().Size()
+			mp.metrics.ProcessFinished(time.Since(start), size.X*size.Y, err)
+		}()
+	}
+
+	bounds := mp.src.Bounds()
+	header := f.header(bounds.Size())
+	if _, err := w.WriteAt(header, 0); err != nil {
+		return err
+	}
+	rowBytes := int64(bounds.Dx()) * int64(f.bytesPerPixel())
+
+	grid := mp.Grid()
+	total := grid.Rows
+	bandWorkers, columnWorkers := mp.split(total)
+
+	var (
+		mu       sync.Mutex
+		next     int   // 次に処理するバンドの番号
+		done     int   // 書き込んだバンドの数
+		firstErr error // 最初に失敗したゴルーチンのエラー
+	)
+	// 次に処理するバンドの番号を返却 (失敗した後や残りがない場合は false)
+	take := func() (int, bool) {
+		mu.Lock()
+		defer mu.Unlock()
+		if firstErr == nil {
+			firstErr = ctx.Err()
+		}
+		if firstErr != nil || next >= total {
+			return 0, false
+		}
+		next++
+		return next - 1, true
+	}
+	finish := func(rect image.Rectangle, err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			return
+		}
+		done++
+		if mp.logger != nil {
+			mp.logger.Debug("band written", "offset", rect.Max.Y, "bands_done", done, "bands_total", total)
+		}
+		if mp.progress != nil {
+			mp.progress(Progress{BandsDone: done, BandsTotal: total})
+		}
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < bandWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			buffer := mp.newBandBuffer()
+			defer mp.releaseBuffers(buffer)
+			var out []uint8
+			for {
+				band, ok := take()
+				if !ok {
+					return
+				}
+				img, rect, err := mp.processBand(buffer, grid.start().Y+band*mp.mosaicHeight, columnWorkers, nil)
+				if err == nil {
+					out = encodeBandAt(out, f, img, rect)
+					_, err = w.WriteAt(out, int64(len(header))+int64(rect.Min.Y-bounds.Min.Y)*rowBytes)
+				}
+				finish(rect, err)
+			}
+		}()
+	}
+	wg.Wait()
+	return firstErr
+}
+
+// バンドの rect の範囲を f の形式の行に変換し、buf を使い回して返却
+func encodeBandAt(buf []uint8, f offsetFormat, band *image.NRGBA, rect image.Rectangle) []uint8 {
+	row := rect.Dx() * f.bytesPerPixel()
+	buf = slices.Grow(buf[:0], row*rect.Dy())[:row*rect.Dy()]
+	for y := rect.Min.Y; y < rect.Max.Y; y++ {
+		i := band.PixOffset(rect.Min.X, y)
+		j := (y - rect.Min.Y) * row
+		f.encodePixels(buf[j:j+row], band.Pix[i:i+4*rect.Dx()])
+	}
+	return buf
+}
+
+// バイナリの PPM (P6)
+// 透明度は記録できないため、乗算済みにしない RGB の値をそのまま書き出す
+type ppmFormat struct{}
+
+func (ppmFormat) header(size image.Point) []byte {
+	return fmt.Appendf(nil, "P6\n%d %d\n255\n", size.X, size.Y)
+}
+
+func (ppmFormat) bytesPerPixel() int { return 3 }
+
+func (ppmFormat) encodePixels(dst, src []uint8) {
+	for i, j := 0, 0; i+4 <= len(src); i, j = i+4, j+3 {
+		dst[j], dst[j+1], dst[j+2] = src[i], src[i+1], src[i+2]
+	}
+}
+
+// ヘッダーのない、乗算済みにしない RGBA の画素を上の行から並べた形式
+// 大きさは記録しないため、読み手は別に知っている必要がある (動画のエンコーダーに渡すフレームなど)
+type rgbaFormat struct{}
+
+func (rgbaFormat) header(image.Point) []byte { return nil }
+
+func (rgbaFormat) bytesPerPixel() int { return 4 }
+
+func (rgbaFormat) encodePixels(dst, src []uint8) { copy(dst, src) }
+
+// f の形式で順に書き出す Encoder
+func offsetEncoder(f offsetFormat) EncoderFunc {
+	return func(w io.Writer, img image.Image, _ EncodeOptions) error {
+		bounds := img.Bounds()
+		if _, err := w.Write(f.header(bounds.Size())); err != nil {
+			return err
+		}
+		src, ok := img.(*image.NRGBA)
+		if !ok {
+			src = ConvertToNRGBA(img)
+		}
+		row := make([]uint8, bounds.Dx()*f.bytesPerPixel())
+		for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+			i := src.PixOffset(bounds.Min.X, y)
+			f.encodePixels(row, src.Pix[i:i+4*bounds.Dx()])
+			if _, err := w.Write(row); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
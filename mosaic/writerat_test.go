@@ -0,0 +1,102 @@
+package mosaic
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// 前もって確保したバッファの重ならない範囲に、ロックせずに書き込む io.WriterAt
+// 同じ範囲に同時に書き込めば、-race で検出される
+type fixedWriterAt []byte
+
+func (w fixedWriterAt) WriteAt(p []byte, off int64) (int, error) {
+	if off < 0 || off+int64(len(p)) > int64(len(w)) {
+		return 0, fmt.Errorf("write of %d bytes at %d is out of range", len(p), off)
+	}
+	return copy(w[off:], p), nil
+}
+
+// 複数のゴルーチンがバンドを書き込んでも、1 つのゴルーチンで ProcessTo した PPM や RGBA と同じバイト列になる
+// 端のタイルが切れる大きさで、原点が (0,0) でない画像を使う
+func TestProcessToWriterAt(t *testing.T) {
+	img := testImageAt(image.Rect(-13, 7, 500, 390))
+	for _, format := range []string{"ppm", "rgba"} {
+		for _, tt := range []struct {
+			tile int
+			opts []Option
+		}{
+			{7, nil},
+			{16, []Option{WithHueShift(45)}},
+			{9, []Option{WithGridOrigin(image.Pt(4, 2))}},
+			{1, nil},
+			// ブロックの指定によらずバンドで処理する
+			{12, []Option{WithBlockSize(24, 24)}},
+		} {
+			var want bytes.Buffer
+			serial := append([]Option{WithWorkers(1)}, tt.opts...)
+			if err := New(img, tt.tile, tt.tile, serial...).ProcessTo(context.Background(), &want, format, EncodeOptions{}); err != nil {
+				t.Fatal(err)
+			}
+			for _, workers := range []int{1, 2, 8, 33} {
+				opts := append([]Option{WithWorkers(workers)}, tt.opts...)
+				got := make(fixedWriterAt, want.Len())
+				if err := New(img, tt.tile, tt.tile, opts...).ProcessToWriterAt(context.Background(), got, strings.ToUpper(format)); err != nil {
+					t.Fatalf("%s, tile %d, %d workers: %v", format, tt.tile, workers, err)
+				}
+				if !bytes.Equal(got, want.Bytes()) {
+					t.Errorf("%s, tile %d, %d workers: output differs from the serial ProcessTo", format, tt.tile, workers)
+				}
+			}
+		}
+	}
+
+	// *os.File に書き込んでも同じ
+	var want bytes.Buffer
+	if err := New(img, 7, 7, WithWorkers(1)).ProcessTo(context.Background(), &want, "ppm", EncodeOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Create(filepath.Join(t.TempDir(), "out.ppm"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := New(img, 7, 7, WithWorkers(8)).ProcessToWriterAt(context.Background(), f, "ppm"); err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want.Bytes()) {
+		t.Error("file output differs from the serial ProcessTo")
+	}
+}
+
+// rgba はヘッダーのない、処理後の画像の Pix の行を上から並べたバイト列
+func TestEncodeRGBA(t *testing.T) {
+	img := testImageAt(image.Rect(-3, 2, 20, 17))
+	mp := New(img, 5, 5)
+	var got bytes.Buffer
+	if err := mp.ProcessTo(context.Background(), &got, "rgba", EncodeOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if want := mp.Process().Pix; !bytes.Equal(got.Bytes(), want) {
+		t.Errorf("rgba output (%d bytes) differs from the processed pixels (%d bytes)", got.Len(), len(want))
+	}
+}
+
+func TestProcessToWriterAtUnsupportedFormat(t *testing.T) {
+	err := New(testImage(8, 8), 4, 4).ProcessToWriterAt(context.Background(), fixedWriterAt(nil), "png")
+	var fe *OffsetFormatError
+	if !errors.As(err, &fe) || fe.Name != "png" || !slices.Equal(fe.Formats, []string{"ppm", "rgba"}) {
+		t.Errorf("error %v, want *OffsetFormatError listing ppm and rgba", err)
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"log/slog"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/yashikota/go-streaming-image-mosaic/mosaic"
+)
+
+// 主の出力とは別のタイルの大きさで書き出す出力 (-output)
+type outputSpec struct {
+	tile    int
+	path    string
+	quality int // JPEG の品質 (0 の場合は既定の品質)
+}
+
+// 繰り返し指定できる -output tile:path[:quality] の一覧
+type outputList []outputSpec
+
+func (l *outputList) String() string {
+	parts := make([]string, len(*l))
+	for i, o := range *l {
+		parts[i] = fmt.Sprintf("%d:%s", o.tile, o.path)
+		if o.quality > 0 {
+			parts[i] += ":" + strconv.Itoa(o.quality)
+		}
+	}
+	return strings.Join(parts, ",")
+}
+
+func (l *outputList) Set(s string) error {
+	tile, path, ok := strings.Cut(s, ":")
+	n, err := strconv.Atoi(tile)
+	if !ok || err != nil || n <= 0 || path == "" {
+		return fmt.Errorf("invalid output %q (want tile:path[:quality] such as 16:med.jpg:85)", s)
+	}
+	o := outputSpec{tile: n, path: path}
+	if i := strings.LastIndex(path, ":"); i >= 0 {
+		if q, err := strconv.Atoi(path[i+1:]); err == nil {
+			if q < 1 || q > 100 {
+				return fmt.Errorf("invalid output %q (quality must be between 1 and 100)", s)
+			}
+			o.path, o.quality = path[:i], q
+		}
+	}
+	*l = append(*l, o)
+	return nil
+}
+
+func (l *outputList) Get() any {
+	return l.String()
+}
+
+// 平均色の格子を使えるかどうか
+// 格子はタイル全体の画素の平均色 (RoundHalfUp で丸めたもの) だけを持つため、除外する画素やタイルの色の決め方を変える場合は使えない
+func (p pipeline) gridEligible() bool {
+	return p.color == nil && p.tileFilter == mosaic.BoxFilter && p.rounding == mosaic.RoundHalfUp && p.exclude == nil && p.selectLuma == nil && p.selectExpr == nil &&
+		p.skipEdges <= 0 && p.stripes.Process <= 0
+}
+
+// 主の出力と -output のタイルの大きさごとに、region の平均色の格子を作る
+// 小さい順に作り、すでに作った格子のタイルの大きさの倍数なら、その格子のマスをまとめて作る (画素を読み直さない)
+// 倍数でない大きさは画素から直接計算する
+func (p pipeline) colorGrids(logger *slog.Logger, region *image.NRGBA) map[int]*mosaic.ColorGrid {
+	if !p.gridEligible() {
+		return nil
+	}
+	sizes := []int{p.tile}
+	for _, o := range p.outputs {
+		sizes = append(sizes, o.tile)
+	}
+	slices.Sort(sizes)
+	sizes = slices.Compact(sizes)
+
+	grids := make(map[int]*mosaic.ColorGrid, len(sizes))
+	for i, tile := range sizes {
+		// 最も大きい約数の格子からまとめる
+		for j := i - 1; j >= 0 && grids[tile] == nil; j-- {
+			if g, err := grids[sizes[j]].Coarsen(tile); err == nil {
+				grids[tile] = g
+				logger.Debug("tile colors derived", "tile", tile, "from", sizes[j])
+			}
+		}
+		if grids[tile] == nil {
+			grids[tile] = mosaic.NewColorGridAt(region, tile, p.gridOrigin)
+			logger.Debug("tile colors computed", "tile", tile)
+		}
+	}
+	return grids
+}
+
+// -output の出力を順に処理して書き出す
+// 作業用の画像に src を写してからその場で処理するため、src は書き換えず、作業用の画像は出力の間で使い回す
+// 格子がある大きさは、grids の平均色をタイルの色にする
+func (p pipeline) writeOutputs(ctx context.Context, logger *slog.Logger, src, region *image.NRGBA, opts []mosaic.Option, grids map[int]*mosaic.ColorGrid) error {
+	work := image.NewNRGBA(src.Rect)
+	for _, out := range p.outputs {
+		copy(work.Pix, src.Pix)
+		target := work.SubImage(region.Rect).(*image.NRGBA)
+		// 進捗は主の出力にだけ表示する
+		outOpts := append(slices.Clip(opts), mosaic.WithProgress(nil))
+		if g := grids[out.tile]; g != nil {
+			outOpts = append(outOpts, mosaic.WithTileColor(g.TileColor))
+		}
+		if _, err := mosaic.New(target, out.tile, out.tile, outOpts...).ProcessInPlace(ctx); err != nil {
+			return p.fail(logger, stageProcess, fmt.Errorf("tile %d: %w", out.tile, err))
+		}
+		err := p.stats.timed(stageEncode, func() error {
+			return writeImage(out.path, work, mosaic.EncodeOptions{Quality: out.quality, DPI: p.encodeOpts.DPI})
+		})
+		if err != nil {
+			return p.fail(logger, stageEncode, &outputError{path: out.path, err: err})
+		}
+		logger.Debug("output written", "tile", out.tile, "path", out.path)
+	}
+	return nil
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log/slog"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/yashikota/go-streaming-image-mosaic/mosaic"
+)
+
+// 倍数の大きさの格子は小さい格子からまとめ、倍数でない大きさは画素から直接計算する
+// どちらも直接計算した格子と成分ごとに ±1 以内で一致する
+func TestColorGrids(t *testing.T) {
+	src := testImage(101, 67)
+	for i := range src.Pix {
+		src.Pix[i] ^= uint8(i * 7919 >> 3)
+	}
+	for _, origin := range []string{"0,0", "3,5"} {
+		f := newApplyFlags(io.Discard)
+		args := []string{"-tile", "8", "-grid-origin", origin, "-output", "16:a.png", "-output", "24:b.png", "-output", "12:c.png", "-output", "7:d.png"}
+		if err := f.parse(args); err != nil {
+			t.Fatal(err)
+		}
+		var logs bytes.Buffer
+		logger := slog.New(slog.NewTextHandler(&logs, &slog.HandlerOptions{Level: slog.LevelDebug}))
+		p := f.pipeline(logger)
+		p.outputs = f.outputs
+
+		grids := p.colorGrids(logger, src)
+		if len(grids) != 5 {
+			t.Fatalf("%d grids, want 5", len(grids))
+		}
+		for tile, g := range grids {
+			want := mosaic.NewColorGridAt(src, tile, p.gridOrigin)
+			if g.Columns != want.Columns || g.Rows != want.Rows {
+				t.Fatalf("origin %s, tile %d: %dx%d cells, want %dx%d", origin, tile, g.Columns, g.Rows, want.Columns, want.Rows)
+			}
+			for y := 0; y < g.Rows; y++ {
+				for x := 0; x < g.Columns; x++ {
+					a, b := g.At(x, y), want.At(x, y)
+					if absDiff(a.R, b.R) > 1 || absDiff(a.G, b.G) > 1 || absDiff(a.B, b.B) > 1 || absDiff(a.A, b.A) > 1 {
+						t.Errorf("origin %s, tile %d, cell (%d, %d): %v, want %v", origin, tile, x, y, a, b)
+					}
+				}
+			}
+		}
+		// 24 は最も大きい約数の 12 からまとめ、12 は 7 と 8 の倍数ではないため画素から計算する
+		for _, want := range []string{
+			`msg="tile colors computed" tile=7`,
+			`msg="tile colors computed" tile=8`,
+			`msg="tile colors computed" tile=12`,
+			`msg="tile colors derived" tile=16 from=8`,
+			`msg="tile colors derived" tile=24 from=12`,
+		} {
+			if !strings.Contains(logs.String(), want) {
+				t.Errorf("origin %s: log does not contain %q:\n%s", origin, want, logs.String())
+			}
+		}
+	}
+}
+
+// 除外する画素などで格子を使えない場合は、格子を作らない
+func TestColorGridsIneligible(t *testing.T) {
+	f := newApplyFlags(io.Discard)
+	if err := f.parse([]string{"-tile", "8", "-output", "16:a.png", "-exclude-color", "#ff00ff"}); err != nil {
+		t.Fatal(err)
+	}
+	p := f.pipeline(discardLogger)
+	p.outputs = f.outputs
+	if grids := p.colorGrids(discardLogger, testImage(32, 32)); grids != nil {
+		t.Errorf("grids = %v, want nil", grids)
+	}
+}
+
+// -output の出力は、それぞれのタイルの大きさで apply した結果と同じ
+func TestApplyOutputs(t *testing.T) {
+	dir := t.TempDir()
+	in := filepath.Join(dir, "in.png")
+	writeTestImage(t, in, testImage(101, 67))
+	for _, extra := range [][]string{nil, {"-exclude-color", "#000000"}, {"-grid-origin", "3,5"}} {
+		args := []string{"apply", "-in", in, "-out", filepath.Join(dir, "main.png"), "-tile", "8", "-quiet"}
+		for _, tile := range []int{16, 24, 12} {
+			args = append(args, "-output", fmt.Sprintf("%d:%s", tile, filepath.Join(dir, fmt.Sprintf("out%d.png", tile))))
+		}
+		if res := runCLI(t, append(args, extra...)...); res.code != exitOK {
+			t.Fatalf("%v: exit code = %d (stderr: %s)", extra, res.code, res.stderr)
+		}
+		for _, tile := range []int{8, 16, 24, 12} {
+			want := filepath.Join(dir, "want.png")
+			args := append([]string{"apply", "-in", in, "-out", want, "-tile", fmt.Sprint(tile), "-quiet"}, extra...)
+			if res := runCLI(t, args...); res.code != exitOK {
+				t.Fatalf("exit code = %d (stderr: %s)", res.code, res.stderr)
+			}
+			got := filepath.Join(dir, fmt.Sprintf("out%d.png", tile))
+			if tile == 8 {
+				got = filepath.Join(dir, "main.png")
+			}
+			assertSameImage(t, readTestImage(t, got), readTestImage(t, want))
+		}
+	}
+}
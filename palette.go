@@ -0,0 +1,98 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"image/color"
+	"io"
+	"log/slog"
+	"math"
+	"strings"
+	"sync"
+
+	"github.com/yashikota/go-streaming-image-mosaic/mosaic"
+)
+
+// palette のサブコマンドの使い方
+const paletteUsage = "usage: mosaic palette list | mosaic palette preview -name name -out path"
+
+// 組み込みのパレットの一覧と見本を表示する
+// list はパレットの名前、色の数と説明を、preview は見本の画像を書き出す
+func runPalette(args []string, stdout, stderr io.Writer) error {
+	if len(args) == 0 {
+		return &usageError{errors.New(paletteUsage)}
+	}
+	switch args[0] {
+	case "list":
+		if len(args) > 1 {
+			return &usageError{fmt.Errorf("unexpected arguments: %s", strings.Join(args[1:], " "))}
+		}
+		for _, p := range mosaic.Palettes() {
+			fmt.Fprintf(stdout, "%-12s %3d  %s\n", p.Name, len(p.Colors), p.Description)
+		}
+		return nil
+	case "preview":
+		return runPalettePreview(args[1:], stderr)
+	}
+	return &usageError{errors.New(paletteUsage)}
+}
+
+// パレットの見本の画像を書き出す
+func runPalettePreview(args []string, stderr io.Writer) error {
+	fs := flag.NewFlagSet(progName+" palette preview", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: %s palette preview -name name -out path\n\nflags:\n", progName)
+		fs.PrintDefaults()
+	}
+	name := fs.String("name", "", "パレットの名前 ("+strings.Join(mosaic.PaletteNames(), "、")+")")
+	out := fs.String("out", "", "見本の画像のパス (拡張子で形式を決め、登録されていない拡張子は JPEG)")
+	swatch := fs.Int("swatch", 64, "色ごとの四角の大きさ (px)")
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return err
+		}
+		return &usageError{err}
+	}
+	if fs.NArg() > 0 {
+		return &usageError{fmt.Errorf("unexpected arguments: %s", strings.Join(fs.Args(), " "))}
+	}
+	if *name == "" || *out == "" {
+		return &usageError{errors.New("both -name and -out are required")}
+	}
+	if *swatch <= 0 {
+		return &usageError{errors.New("-swatch must be positive")}
+	}
+	p, ok := mosaic.PaletteByName(*name)
+	if !ok {
+		return &usageError{fmt.Errorf("unknown palette %q (want %s)", *name, strings.Join(mosaic.PaletteNames(), ", "))}
+	}
+	if err := writeImage(*out, p.Preview(*swatch), mosaic.EncodeOptions{}); err != nil {
+		return &outputError{path: *out, err: err}
+	}
+	return nil
+}
+
+// パレットのどの色からも ΔE*ab がこれより遠いタイルの色は、パレットの色域の外として警告する
+const paletteGamutDistance = 20
+
+// タイルの色を m の最も近い色に置き換える ColorAdjust (透明度はそのまま残す)
+// どの色からも paletteGamutDistance より遠い色は、処理ごとに最初の 1 つだけを logger に警告する
+func paletteAdjust(logger *slog.Logger, m *mosaic.PaletteMatcher) mosaic.ColorAdjust {
+	var once sync.Once
+	return mosaic.ColorAdjustFunc(func(c color.NRGBA) color.NRGBA {
+		i := m.Nearest(c)
+		if i < 0 {
+			return c
+		}
+		p := m.Color(i)
+		if d := m.Distance(c, i); d > paletteGamutDistance {
+			once.Do(func() {
+				logger.Warn("tile color is outside the palette gamut; replaced with the nearest palette color", "code", warnPaletteGamut,
+					"color", mosaic.FormatHexColor(c), "nearest", mosaic.FormatHexColor(p), "delta_e", math.Round(d*10)/10)
+			})
+		}
+		return color.NRGBA{R: p.R, G: p.G, B: p.B, A: c.A}
+	})
+}
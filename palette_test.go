@@ -0,0 +1,88 @@
+package main
+
+import (
+	"image/color"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/yashikota/go-streaming-image-mosaic/mosaic"
+)
+
+func TestPaletteList(t *testing.T) {
+	res := runCLI(t, "palette", "list")
+	if res.code != exitOK {
+		t.Fatalf("exit code = %d (stderr: %s)", res.code, res.stderr)
+	}
+	lines := strings.Split(strings.TrimSpace(res.stdout), "\n")
+	if len(lines) != len(mosaic.PaletteNames()) {
+		t.Fatalf("list:\n%s", res.stdout)
+	}
+	for i, p := range mosaic.Palettes() {
+		if fields := strings.Fields(lines[i]); len(fields) < 3 || fields[0] != p.Name || fields[1] != strconv.Itoa(len(p.Colors)) {
+			t.Errorf("line %q for %s", lines[i], p.Name)
+		}
+	}
+}
+
+func TestPalettePreview(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "strip.png")
+	if res := runCLI(t, "palette", "preview", "-name", "viridis", "-out", out, "-swatch", "32"); res.code != exitOK {
+		t.Fatalf("exit code = %d (stderr: %s)", res.code, res.stderr)
+	}
+	p, _ := mosaic.PaletteByName("viridis")
+	want := p.Preview(32)
+	assertSameNRGBA(t, readTestImage(t, out), want)
+
+	for _, args := range [][]string{
+		nil,
+		{"show"},
+		{"list", "extra"},
+		{"preview", "-name", "viridis"},
+		{"preview", "-out", out},
+		{"preview", "-name", "magma", "-out", out},
+		{"preview", "-name", "viridis", "-out", out, "-swatch", "0"},
+	} {
+		if res := runCLI(t, append([]string{"palette"}, args...)...); res.code != exitUsage {
+			t.Errorf("%v: exit code = %d, want %d (stderr: %s)", args, res.code, exitUsage, res.stderr)
+		}
+	}
+}
+
+// -palette はタイルの色をパレットの色にし、-lego-palette は -palette lego と同じ
+func TestApplyPalette(t *testing.T) {
+	dir := t.TempDir()
+	in := filepath.Join(dir, "in.png")
+	writeTestImage(t, in, testImage(48, 32))
+	for _, name := range []string{"okabe-ito", "lego"} {
+		out := filepath.Join(dir, name+".png")
+		if res := runCLI(t, "apply", "-in", in, "-out", out, "-tile", "8", "-palette", name, "-quiet"); res.code != exitOK {
+			t.Fatalf("%s: exit code = %d (stderr: %s)", name, res.code, res.stderr)
+		}
+		p, _ := mosaic.PaletteByName(name)
+		allowed := map[color.NRGBA]bool{}
+		for _, c := range p.Colors {
+			allowed[c] = true
+		}
+		img := readTestImage(t, out)
+		for y := img.Rect.Min.Y; y < img.Rect.Max.Y; y++ {
+			for x := img.Rect.Min.X; x < img.Rect.Max.X; x++ {
+				if c := img.NRGBAAt(x, y); !allowed[c] {
+					t.Fatalf("%s: pixel (%d,%d) = %v is not in the palette", name, x, y, c)
+				}
+			}
+		}
+	}
+	lego := filepath.Join(dir, "lego-flag.png")
+	if res := runCLI(t, "apply", "-in", in, "-out", lego, "-tile", "8", "-lego-palette", "-quiet"); res.code != exitOK {
+		t.Fatalf("exit code = %d (stderr: %s)", res.code, res.stderr)
+	}
+	assertSameNRGBA(t, readTestImage(t, lego), readTestImage(t, filepath.Join(dir, "lego.png")))
+
+	for _, args := range [][]string{{"-palette", "magma"}, {"-palette", "viridis", "-lego-palette"}} {
+		if res := runCLI(t, append([]string{"apply", "-in", in, "-out", filepath.Join(dir, "bad.png"), "-tile", "8", "-quiet"}, args...)...); res.code != exitUsage {
+			t.Errorf("%v: exit code = %d, want %d (stderr: %s)", args, res.code, exitUsage, res.stderr)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/yashikota/go-streaming-image-mosaic/mosaic"
+)
+
+// patch のフラグ
+type patchFlags struct {
+	*commonFlags
+	base *string
+	in   *string
+	out  *string
+}
+
+func newPatchFlags(stderr io.Writer) *patchFlags {
+	c := newCommonFlags("patch", "[flags] -base processed -in original -region x,y,w,h -out path", stderr)
+	return &patchFlags{
+		commonFlags: c,
+		base:        c.fs.String("base", "", "処理済みの画像 (範囲の外はこの画像の画素をそのまま使う)"),
+		in:          c.fs.String("in", "", "-base の元になった処理前の画像 (範囲の中はこの画像から処理する)"),
+		out:         c.fs.String("out", "", "出力画像のパス (拡張子で形式を決め、登録されていない拡張子は JPEG)"),
+	}
+}
+
+// 処理済みの画像のうち -region と -regions の範囲だけを、元画像から処理し直す
+// 範囲と重なるバンドだけを処理するため、大きな画像に範囲を 1 つ足す場合も画像全体を処理し直さない
+func runPatch(args []string, stdout, stderr io.Writer) error {
+	f := newPatchFlags(stderr)
+	if err := f.parse(args); err != nil {
+		return err
+	}
+	if *f.base == "" || *f.in == "" || *f.out == "" {
+		return &usageError{errors.New("-base, -in and -out are required")}
+	}
+	if len(f.settings.Regions) == 0 {
+		return &usageError{errors.New("patch needs at least one -region or -regions")}
+	}
+
+	bar := newProgressBar(stderr, *f.quiet)
+	logger, err := f.logger(bar.logOutput(stderr))
+	if err != nil {
+		return err
+	}
+	p := f.pipeline(logger)
+
+	base, err := readCompareImage(*f.base)
+	if err != nil {
+		return err
+	}
+	file, err := os.Open(*f.in)
+	if err != nil {
+		return &inputError{path: *f.in, err: err}
+	}
+	defer file.Close()
+	p, br, err := p.withInputDensity(logger, bufio.NewReader(file))
+	if err != nil {
+		return fmt.Errorf("%s: %w", *f.in, &stageError{stage: stageDecode, err: err})
+	}
+	src, _, _, err := p.decodeSource(logger, br)
+	if err != nil {
+		return fmt.Errorf("%s: %w", *f.in, &stageError{stage: stageDecode, err: err})
+	}
+	if base.Rect.Size() != src.Rect.Size() {
+		return &inputError{path: *f.base, err: &mosaic.BoundsMismatchError{Base: base.Rect, Src: src.Rect}}
+	}
+	// 原点が異なる画像も、左上をそろえて重ねる
+	if base.Rect.Min != src.Rect.Min {
+		base = translated(base, src.Rect.Min)
+	}
+
+	opts, err := p.options(logger, bar.callback(logger, *f.in, 1, 1), src)
+	if err != nil {
+		return &stageError{stage: stageProcess, err: err}
+	}
+	if err := mosaic.PatchRegions(context.Background(), base, src, p.tile, p.tile, p.regions(logger, src.Rect), opts...); err != nil {
+		return &stageError{stage: stageProcess, err: err}
+	}
+	bar.finish()
+	if err := writeImage(*f.out, base, p.encodeOpts); err != nil {
+		return &outputError{path: *f.out, err: err}
+	}
+	logger.Info("patch finished", "regions", len(f.settings.Regions), "width", base.Rect.Dx(), "height", base.Rect.Dy(), "out", *f.out)
+	return nil
+}
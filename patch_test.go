@@ -0,0 +1,57 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestPatch(t *testing.T) {
+	dir := t.TempDir()
+	orig, base := filepath.Join(dir, "orig.png"), filepath.Join(dir, "base.png")
+	patched, full := filepath.Join(dir, "patched.png"), filepath.Join(dir, "full.png")
+	writeTestImage(t, orig, testImage(64, 48))
+
+	for _, args := range [][]string{
+		{"apply", "-in", orig, "-out", base, "-tile", "8", "-region", "0,0,24,24", "-quiet"},
+		{"patch", "-base", base, "-in", orig, "-out", patched, "-tile", "8", "-region", "32,16,24,24", "-quiet"},
+		{"apply", "-in", orig, "-out", full, "-tile", "8", "-region", "0,0,24,24", "-region", "32,16,24,24", "-quiet"},
+	} {
+		if res := runCLI(t, args...); res.code != exitOK {
+			t.Fatalf("%v: exit code = %d (stderr: %s)", args, res.code, res.stderr)
+		}
+	}
+	// 範囲を足して処理し直した結果は、両方の範囲で最初から処理した結果と同じ
+	got, want := readTestImage(t, patched), readTestImage(t, full)
+	if got.Rect != want.Rect {
+		t.Fatalf("bounds %v, want %v", got.Rect, want.Rect)
+	}
+	for i := range got.Pix {
+		if got.Pix[i] != want.Pix[i] {
+			t.Fatalf("patched output differs from a full run at byte %d", i)
+		}
+	}
+}
+
+func TestPatchErrors(t *testing.T) {
+	dir := t.TempDir()
+	orig, other := filepath.Join(dir, "orig.png"), filepath.Join(dir, "other.png")
+	writeTestImage(t, orig, testImage(32, 32))
+	writeTestImage(t, other, testImage(32, 40))
+	out := filepath.Join(dir, "out.png")
+
+	tests := []struct {
+		name string
+		args []string
+		code int
+	}{
+		{"no region", []string{"-base", orig, "-in", orig, "-out", out}, exitUsage},
+		{"no base", []string{"-in", orig, "-out", out, "-region", "0,0,8,8"}, exitUsage},
+		{"size mismatch", []string{"-base", other, "-in", orig, "-out", out, "-region", "0,0,8,8"}, exitInput},
+	}
+	for _, tt := range tests {
+		res := runCLI(t, append([]string{"patch", "-quiet"}, tt.args...)...)
+		if res.code != tt.code {
+			t.Errorf("%s: exit code = %d, want %d (stderr: %s)", tt.name, res.code, tt.code, res.stderr)
+		}
+	}
+}
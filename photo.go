@@ -0,0 +1,549 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"io/fs"
+	"log/slog"
+	"maps"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/yashikota/go-streaming-image-mosaic/mosaic"
+)
+
+// 素材のディレクトリに置く索引のファイル名 (-index を省略した場合)
+const defaultPhotoIndex = ".mosaic-index.json"
+
+// 索引の形式の版
+const photoIndexVersion = 1
+
+// 索引を途中で保存する間隔 (索引に追加した写真の数)
+const photoIndexSaveEvery = 32
+
+var errEmptyLibrary = errors.New("no photos in library")
+
+// photo のフラグ
+type photoFlags struct {
+	*commonFlags
+	in       *string
+	out      *string
+	library  *string
+	index    *string
+	noRepeat *int
+	quality  *int
+}
+
+func newPhotoFlags(stderr io.Writer) *photoFlags {
+	c := newCommonFlags("photo", "[flags]", stderr)
+	return &photoFlags{
+		commonFlags: c,
+		in:          c.fs.String("in", "", "入力画像のパス"),
+		out:         c.fs.String("out", "", "出力画像のパス (形式は拡張子から決める)"),
+		library:     c.fs.String("library", "", "タイルに使う写真を置いたディレクトリ"),
+		index:       c.fs.String("index", "", "写真の平均色の索引 (JSON) のパス (省略時は -library の "+defaultPhotoIndex+")"),
+		noRepeat:    c.fs.Int("no-repeat-radius", 0, "同じ写真を置かない範囲 (縦横のタイル数、0 で制限しない)"),
+		quality:     c.fs.Int("quality", 0, "JPEG などで書き出す場合の品質 (1〜100、0 で形式の既定)"),
+	}
+}
+
+// 索引に記録する写真の情報
+type photoIndexEntry struct {
+	Path   string `json:"path"`  // 素材のディレクトリからの相対パス (内容が同じ写真が複数ある場合はパスの順で最初のもの)
+	Color  string `json:"color"` // 中央の正方形の平均色 (#RRGGBB)
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+
+	// Path のファイルのバイト数と更新日時 (UTC の RFC 3339)
+	// どちらも変わっていないファイルは、内容を読まずに同じ写真とみなす
+	Size    int64  `json:"size,omitempty"`
+	ModTime string `json:"mod_time,omitempty"`
+}
+
+// 写真の平均色の索引
+// 写真はファイルの内容の SHA-256 で引くため、名前を変えたり移動したりした写真はデコードし直さない
+// 索引の作成が終わると素材のディレクトリにある写真だけを残し、JSON はキーの順に書くため、同じ写真からは同じバイト列になる
+type photoIndex struct {
+	Version int                        `json:"version"`
+	Photos  map[string]photoIndexEntry `json:"photos"`
+}
+
+// タイルに使う写真
+type libraryPhoto struct {
+	path  string // 読み込むパス
+	hash  string
+	color color.NRGBA
+}
+
+// 素材の写真でフォトモザイクを作る
+// 各タイルを平均色が最も近い写真に置き換え、写真の平均色は索引に保存して次からの実行で使う
+func runPhoto(args []string, stdout, stderr io.Writer) error {
+	if len(args) > 0 && args[0] == "index" {
+		return runPhotoIndex(args[1:], stderr)
+	}
+	f := newPhotoFlags(stderr)
+	if err := f.parse(args); err != nil {
+		return err
+	}
+	if *f.in == "" || *f.out == "" || *f.library == "" {
+		return &usageError{errors.New("-in, -out and -library are required")}
+	}
+	if *f.noRepeat < 0 {
+		return &usageError{errors.New("no-repeat-radius must not be negative")}
+	}
+	if *f.quality < 0 || *f.quality > 100 {
+		return &usageError{errors.New("quality must be between 0 and 100")}
+	}
+	indexPath := *f.index
+	if indexPath == "" {
+		indexPath = filepath.Join(*f.library, defaultPhotoIndex)
+	}
+	logger, err := f.logger(stderr)
+	if err != nil {
+		return err
+	}
+	p := f.pipeline(logger)
+	if p.encoder, err = imageEncoder("", *f.out); err != nil {
+		return err
+	}
+	p.encodeOpts = mosaic.EncodeOptions{Quality: *f.quality}
+
+	// 索引の作成を中断しても、それまでの結果は保存する
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	photos, err := indexLibrary(ctx, logger, *f.library, indexPath, p.workers)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.Open(*f.in)
+	if err != nil {
+		return &inputError{path: *f.in, err: err}
+	}
+	defer file.Close()
+	p, br, err := p.withInputDensity(logger, bufio.NewReader(file))
+	if err != nil {
+		return fmt.Errorf("%s: %w", *f.in, &stageError{stage: stageDecode, err: err})
+	}
+	src, region, _, err := p.decodeSource(logger, br)
+	if err != nil {
+		return fmt.Errorf("%s: %w", *f.in, &stageError{stage: stageDecode, err: err})
+	}
+
+	grid := mosaic.NewColorGridAt(region, p.tile, p.gridOrigin)
+	colors := make([]color.NRGBA, len(photos))
+	for i, photo := range photos {
+		colors[i] = photo.color
+	}
+	assign, repeats := mosaic.MatchPhotos(grid, colors, *f.noRepeat)
+	if repeats > 0 {
+		logger.Warn("library is too small to keep repeated photos apart", "tiles", repeats, "radius", *f.noRepeat)
+	}
+	thumbs, err := loadThumbnails(ctx, logger, photos, assign, p.tile, p.workers)
+	if err != nil {
+		return err
+	}
+	mosaic.DrawPhotos(src, grid, assign, func(i int) *image.NRGBA { return thumbs[i] })
+
+	if err := writePhotoMosaic(p, *f.out, src); err != nil {
+		return &outputError{path: *f.out, err: err}
+	}
+	logger.Info("photo mosaic finished", "tiles", len(assign), "photos", len(thumbs), "library", len(photos), "out", *f.out)
+	return nil
+}
+
+// 素材のディレクトリの索引だけを作る
+// CI などで 1 度だけ作った索引を共有し、photo の -index に渡して使う
+func runPhotoIndex(args []string, stderr io.Writer) error {
+	flags := flag.NewFlagSet(progName+" photo index", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "usage: %s photo index -library dir [-out path]\n\nflags:\n", progName)
+		flags.PrintDefaults()
+	}
+	library := flags.String("library", "", "タイルに使う写真を置いたディレクトリ")
+	out := flags.String("out", "", "索引 (JSON) のパス (省略時は -library の "+defaultPhotoIndex+")")
+	parallel := flags.Int("parallel", 0, "写真を並列に読み込むゴルーチンの数 (0 で GOMAXPROCS)")
+	verbose := flags.Bool("v", false, "詳細なログを出力")
+	quiet := flags.Bool("quiet", false, "エラー以外のログを出力しない")
+	if err := flags.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return err
+		}
+		return &usageError{err}
+	}
+	if flags.NArg() > 0 {
+		return &usageError{fmt.Errorf("unexpected arguments: %s", strings.Join(flags.Args(), " "))}
+	}
+	if *library == "" {
+		return &usageError{errors.New("-library is required")}
+	}
+	if *parallel < 0 {
+		return &usageError{errors.New("parallel must not be negative")}
+	}
+	workers := *parallel
+	if workers == 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	indexPath := *out
+	if indexPath == "" {
+		indexPath = filepath.Join(*library, defaultPhotoIndex)
+	}
+	logger, err := newLogger(stderr, *verbose, *quiet, "text")
+	if err != nil {
+		return &usageError{err}
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	_, err = indexLibrary(ctx, logger, *library, indexPath, workers)
+	return err
+}
+
+// 処理後の画像を書き出す (失敗した場合は書きかけの出力を残さない)
+func writePhotoMosaic(p pipeline, path string, img image.Image) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	err = p.encode(file, img)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(path)
+	}
+	return err
+}
+
+// 素材のディレクトリの写真の平均色を求め、パスの順に返却
+// 索引と大きさと更新日時が同じファイルは読まず、内容が索引にある写真はデコードせず、新しい写真は workers 個のゴルーチンで並列に読み込む
+// 索引は photoIndexSaveEvery 枚ごとと終了時に保存するため、中断しても次の実行はその続きから始まる
+// 終了時の索引は読み込んだ順によらずパスの順に作るため、ゴルーチンの数や実行するマシンによらず同じ内容になる
+// 読み込めないファイルは飛ばし、画像でないファイル以外は警告を出す
+func indexLibrary(ctx context.Context, logger *slog.Logger, dir, indexPath string, workers int) ([]libraryPhoto, error) {
+	paths, err := listLibrary(dir, indexPath)
+	if err != nil {
+		return nil, &inputError{path: dir, err: err}
+	}
+	index := readPhotoIndex(logger, indexPath)
+	previous := maps.Clone(index.Photos)
+	// パスから、大きさと更新日時を記録した索引の写真を引く
+	byPath := map[string]string{}
+	for hash, entry := range index.Photos {
+		if entry.ModTime != "" {
+			byPath[entry.Path] = hash
+		}
+	}
+
+	var (
+		mu      sync.Mutex
+		added   int // 索引に追加した写真の数
+		saveErr error
+	)
+	// 索引を保存する (mu を取得して呼び出す)
+	save := func() {
+		if err := writePhotoIndex(indexPath, index); err != nil && saveErr == nil {
+			saveErr = err
+		}
+	}
+
+	photos := make([]libraryPhoto, len(paths))
+	entries := make([]photoIndexEntry, len(paths))
+	ok := make([]bool, len(paths))
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < max(1, workers); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				path := filepath.Join(dir, paths[i])
+				hash, size, modTime, err := statPhoto(path, paths[i], previous, byPath)
+				if err != nil {
+					logger.Warn("skipping unreadable photo", "path", path, "error", err)
+					continue
+				}
+				mu.Lock()
+				entry, found := index.Photos[hash]
+				mu.Unlock()
+				if !found {
+					if entry, err = indexPhoto(path); err != nil {
+						level := slog.LevelWarn
+						if errors.Is(err, image.ErrFormat) {
+							// 画像でないファイル
+							level = slog.LevelDebug
+						}
+						logger.Log(ctx, level, "skipping photo that cannot be decoded", "path", path, "error", err)
+						continue
+					}
+					logger.Debug("photo indexed", "path", path, "color", entry.Color)
+				}
+				c, err := mosaic.ParseHexColor(entry.Color)
+				if err != nil {
+					logger.Warn("skipping photo with invalid index entry", "path", path, "error", err)
+					continue
+				}
+				entry.Path, entry.Size, entry.ModTime = paths[i], size, modTime
+				photos[i], entries[i], ok[i] = libraryPhoto{path: path, hash: hash, color: c}, entry, true
+
+				if found {
+					continue
+				}
+				mu.Lock()
+				index.Photos[hash] = entry
+				added++
+				if added%photoIndexSaveEvery == 0 {
+					save()
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+feed:
+	for i := range paths {
+		select {
+		case jobs <- i:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(jobs)
+	wg.Wait()
+
+	if ctx.Err() == nil {
+		// 素材のディレクトリにある写真だけを、パスの順で最初のファイルの情報で残す
+		index.Photos = map[string]photoIndexEntry{}
+		for i, entry := range entries {
+			if _, dup := index.Photos[photos[i].hash]; ok[i] && !dup {
+				index.Photos[photos[i].hash] = entry
+			}
+		}
+	}
+	if !maps.Equal(index.Photos, previous) {
+		save()
+	}
+	if saveErr != nil {
+		return nil, &outputError{path: indexPath, err: saveErr}
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	// 内容が同じ写真は 1 枚として扱う
+	var result []libraryPhoto
+	seen := map[string]bool{}
+	for i, photo := range photos {
+		if ok[i] && !seen[photo.hash] {
+			seen[photo.hash] = true
+			result = append(result, photo)
+		}
+	}
+	if len(result) == 0 {
+		return nil, &inputError{path: dir, err: errEmptyLibrary}
+	}
+	logger.Info("library indexed", "photos", len(result), "added", added, "index", indexPath)
+	return result, nil
+}
+
+// 素材のディレクトリのファイルを、ディレクトリからの相対パスの順に列挙
+// 名前が "." から始まるファイルとディレクトリ、索引のファイルは含めない
+func listLibrary(dir, indexPath string) ([]string, error) {
+	indexAbs, _ := filepath.Abs(indexPath)
+	var paths []string
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if path != dir && strings.HasPrefix(d.Name(), ".") {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		if abs, _ := filepath.Abs(path); abs == indexAbs {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		paths = append(paths, rel)
+		return nil
+	})
+	slices.Sort(paths)
+	return paths, err
+}
+
+// 索引を読み込む
+// ファイルがない場合や、形式の版が異なるなど読み込めない場合は空の索引から作り直す
+func readPhotoIndex(logger *slog.Logger, path string) *photoIndex {
+	index := &photoIndex{Version: photoIndexVersion, Photos: map[string]photoIndexEntry{}}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return index
+	}
+	var read photoIndex
+	if err == nil {
+		err = json.Unmarshal(data, &read)
+	}
+	if err == nil && read.Version != photoIndexVersion {
+		err = fmt.Errorf("unsupported index version %d", read.Version)
+	}
+	if err != nil {
+		logger.Warn("rebuilding photo index", "index", path, "error", err)
+		return index
+	}
+	if read.Photos != nil {
+		index.Photos = read.Photos
+	}
+	return index
+}
+
+// 索引を書き込む
+// 一時ファイルに書いてから置き換えるため、途中で止まっても壊れた索引は残らない
+func writePhotoIndex(path string, index *photoIndex) error {
+	data, err := json.MarshalIndent(index, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(append(data, '\n')); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0o644); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// 索引の写真を引くための、ファイルの内容の SHA-256 と大きさ、更新日時
+// rel の索引の情報と大きさと更新日時が同じ場合は、内容を読まずに索引の SHA-256 を使う
+func statPhoto(path, rel string, index map[string]photoIndexEntry, byPath map[string]string) (hash string, size int64, modTime string, err error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", 0, "", err
+	}
+	size, modTime = info.Size(), info.ModTime().UTC().Format(time.RFC3339Nano)
+	if h, ok := byPath[rel]; ok {
+		if entry := index[h]; entry.Size == size && entry.ModTime == modTime {
+			return h, size, modTime, nil
+		}
+	}
+	hash, err = hashFile(path)
+	return hash, size, modTime, err
+}
+
+// ファイルの内容の SHA-256 (16 進数)
+func hashFile(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// 写真をデコードし、索引に記録する情報を求める
+func indexPhoto(path string) (photoIndexEntry, error) {
+	img, err := decodePhoto(path)
+	if err != nil {
+		return photoIndexEntry{}, err
+	}
+	c := mosaic.PhotoColor(img)
+	size := img.Bounds().Size()
+	return photoIndexEntry{Color: fmt.Sprintf("#%02X%02X%02X", c.R, c.G, c.B), Width: size.X, Height: size.Y}, nil
+}
+
+func decodePhoto(path string) (image.Image, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	img, _, err := mosaic.Decode(bufio.NewReader(file))
+	return img, err
+}
+
+// タイルに選んだ写真を読み込み、tile×tile に縮小する
+// 写真は 1 枚につき 1 回だけ読み込み、workers 個のゴルーチンで並列に処理する
+func loadThumbnails(ctx context.Context, logger *slog.Logger, photos []libraryPhoto, assign []int, tile, workers int) (map[int]*image.NRGBA, error) {
+	var used []int
+	seen := make([]bool, len(photos))
+	for _, i := range assign {
+		if i >= 0 && !seen[i] {
+			seen[i] = true
+			used = append(used, i)
+		}
+	}
+	thumbs := make([]*image.NRGBA, len(used))
+	errs := make([]error, len(used))
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < max(1, workers); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range jobs {
+				img, err := decodePhoto(photos[used[j]].path)
+				if err != nil {
+					errs[j] = &inputError{path: photos[used[j]].path, err: err}
+					continue
+				}
+				thumbs[j] = mosaic.Thumbnail(img, tile)
+			}
+		}()
+	}
+	for j := range used {
+		if ctx.Err() != nil {
+			break
+		}
+		jobs <- j
+	}
+	close(jobs)
+	wg.Wait()
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	result := make(map[int]*image.NRGBA, len(used))
+	for j, i := range used {
+		if errs[j] != nil {
+			return nil, errs[j]
+		}
+		result[i] = thumbs[j]
+	}
+	logger.Debug("thumbnails loaded", "photos", len(used), "tile", tile)
+	return result, nil
+}
@@ -0,0 +1,440 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// 1 色で塗った画像
+func solidImage(w, h int, c color.NRGBA) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for i := 0; i < len(img.Pix); i += 4 {
+		img.Pix[i], img.Pix[i+1], img.Pix[i+2], img.Pix[i+3] = c.R, c.G, c.B, c.A
+	}
+	return img
+}
+
+// 素材のディレクトリのファイル (相対パスと内容)
+type libraryFile struct {
+	path string
+	data []byte
+}
+
+func photoFixture(t *testing.T) []libraryFile {
+	red := encodeTestImage(t, solidImage(24, 16, color.NRGBA{200, 20, 20, 255}), "png")
+	return []libraryFile{
+		{"a.png", red},
+		{"b/c.png", encodeTestImage(t, solidImage(16, 16, color.NRGBA{20, 20, 200, 255}), "png")},
+		{"b/d.jpg", encodeTestImage(t, solidImage(16, 24, color.NRGBA{20, 200, 20, 255}), "jpeg")},
+		{"dup.png", red},
+		{"e.gif", encodeTestImage(t, testImage(20, 20), "gif")},
+		{"notes.txt", []byte("not a photo")},
+		{".hidden.png", red},
+		{".cache/f.png", red},
+	}
+}
+
+// files を order の順に dir に書き出す (更新日時はそろえる)
+func writeLibrary(t *testing.T, dir string, files []libraryFile, order []int) {
+	t.Helper()
+	modTime := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	for _, i := range order {
+		path := filepath.Join(dir, files[i].path)
+		writeTestFile(t, path, files[i].data)
+		if err := os.Chtimes(path, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// photo index で索引を作り、そのバイト列を返す
+func buildPhotoIndex(t *testing.T, library, out string, args ...string) []byte {
+	t.Helper()
+	res := runCLI(t, append([]string{"photo", "index", "-library", library, "-out", out, "-quiet"}, args...)...)
+	if res.code != exitOK {
+		t.Fatalf("exit code = %d (stderr: %s)", res.code, res.stderr)
+	}
+	data, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func readTestPhotoIndex(t *testing.T, data []byte) photoIndex {
+	t.Helper()
+	var index photoIndex
+	if err := json.Unmarshal(data, &index); err != nil {
+		t.Fatalf("%v\n%s", err, data)
+	}
+	return index
+}
+
+// 索引の写真のパス (パスの順)
+func indexPaths(index photoIndex) []string {
+	var paths []string
+	for _, entry := range index.Photos {
+		paths = append(paths, entry.Path)
+	}
+	slices.Sort(paths)
+	return paths
+}
+
+// ファイルを作った順やゴルーチンの数によらず、同じ素材からは同じバイト列の索引になる
+func TestPhotoIndexDeterministic(t *testing.T) {
+	files := photoFixture(t)
+	dir := t.TempDir()
+	forward, backward := filepath.Join(dir, "forward"), filepath.Join(dir, "backward")
+	order := []int{0, 1, 2, 3, 4, 5, 6, 7}
+	writeLibrary(t, forward, files, order)
+	slices.Reverse(order)
+	writeLibrary(t, backward, files, order)
+
+	want := buildPhotoIndex(t, forward, filepath.Join(dir, "want.json"), "-parallel", "1")
+	for _, parallel := range []int{1, 7, 16} {
+		for _, library := range []string{forward, backward} {
+			out := filepath.Join(dir, "index-"+strconv.Itoa(parallel)+".json")
+			os.Remove(out)
+			if got := buildPhotoIndex(t, library, out, "-parallel", strconv.Itoa(parallel)); !bytes.Equal(got, want) {
+				t.Errorf("%s with %d workers:\n%s\nwant:\n%s", library, parallel, got, want)
+			}
+		}
+	}
+
+	// 内容が同じ写真はパスの順で最初のファイルで記録し、画像でないファイルと "." から始まるファイルは含めない
+	index := readTestPhotoIndex(t, want)
+	if index.Version != photoIndexVersion || !slices.Equal(indexPaths(index), []string{"a.png", "b/c.png", "b/d.jpg", "e.gif"}) {
+		t.Fatalf("index %+v", index)
+	}
+	for hash, entry := range index.Photos {
+		if len(hash) != 64 || entry.Size == 0 || entry.ModTime != "2024-01-02T03:04:05Z" {
+			t.Errorf("%s: %+v", hash, entry)
+		}
+	}
+	if a := index.Photos[mustHash(t, filepath.Join(forward, "a.png"))]; a.Color != "#C81414" || a.Width != 24 || a.Height != 16 {
+		t.Errorf("a.png: %+v", a)
+	}
+
+	// 変わっていない素材から作り直しても同じ
+	if got := buildPhotoIndex(t, forward, filepath.Join(dir, "want.json")); !bytes.Equal(got, want) {
+		t.Errorf("rebuilt index differs:\n%s", got)
+	}
+}
+
+func mustHash(t *testing.T, path string) string {
+	t.Helper()
+	hash, err := hashFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hash
+}
+
+// 索引を作り直す場合は、変わったファイルだけを読み込む
+func TestPhotoIndexIncremental(t *testing.T) {
+	dir := t.TempDir()
+	library, out := filepath.Join(dir, "thumbs"), filepath.Join(dir, "index.json")
+	writeLibrary(t, library, photoFixture(t), []int{0, 1, 2, 4, 5})
+	index := readTestPhotoIndex(t, buildPhotoIndex(t, library, out))
+
+	// 索引の色と SHA-256 を書き換え、作り直した索引に残るかどうかで読み込んだかどうかを確かめる
+	c := mustHash(t, filepath.Join(library, "b/c.png"))
+	entry := index.Photos[c]
+	entry.Color = "#010203"
+	index.Photos[c] = entry
+	a := mustHash(t, filepath.Join(library, "a.png"))
+	index.Photos["stale-a"] = index.Photos[a]
+	delete(index.Photos, a)
+	if err := writePhotoIndex(out, &index); err != nil {
+		t.Fatal(err)
+	}
+
+	// 名前を変えた写真は内容の SHA-256 で引き、デコードし直さない
+	if err := os.Rename(filepath.Join(library, "b/c.png"), filepath.Join(library, "z.png")); err != nil {
+		t.Fatal(err)
+	}
+	// 内容を変えたファイルは読み直し、消したファイルは索引から除く
+	writeTestImage(t, filepath.Join(library, "b/d.jpg"), solidImage(8, 8, color.NRGBA{250, 250, 0, 255}))
+	if err := os.Remove(filepath.Join(library, "e.gif")); err != nil {
+		t.Fatal(err)
+	}
+	got := readTestPhotoIndex(t, buildPhotoIndex(t, library, out))
+	if !slices.Equal(indexPaths(got), []string{"a.png", "b/d.jpg", "z.png"}) {
+		t.Fatalf("paths %v", indexPaths(got))
+	}
+	// 大きさと更新日時が同じファイルは内容を読まない
+	if entry, ok := got.Photos["stale-a"]; !ok || entry.Path != "a.png" {
+		t.Errorf("unchanged a.png was hashed again: %+v", got.Photos)
+	}
+	if entry := got.Photos[c]; entry.Path != "z.png" || entry.Color != "#010203" {
+		t.Errorf("renamed photo: %+v", entry)
+	}
+	d := got.Photos[mustHash(t, filepath.Join(library, "b/d.jpg"))]
+	if d.Width != 8 || d.Color == "#14C814" {
+		t.Errorf("changed photo: %+v", d)
+	}
+	if len(got.Photos) != 3 {
+		t.Errorf("%d photos, want 3", len(got.Photos))
+	}
+}
+
+// indexLibrary のログから、デコードして索引に加えた写真のパスと、追加した数を読む
+func indexedPhotos(t *testing.T, library, indexPath string, workers int) (decoded []string, added int) {
+	t.Helper()
+	var logs bytes.Buffer
+	logger := slog.New(slog.NewJSONHandler(&logs, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	if _, err := indexLibrary(context.Background(), logger, library, indexPath, workers); err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range strings.Split(strings.TrimSpace(logs.String()), "\n") {
+		var record struct {
+			Msg   string `json:"msg"`
+			Path  string `json:"path"`
+			Added int    `json:"added"`
+		}
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatalf("%q: %v", line, err)
+		}
+		switch record.Msg {
+		case "photo indexed":
+			rel, err := filepath.Rel(library, record.Path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			decoded = append(decoded, filepath.ToSlash(rel))
+		case "library indexed":
+			added = record.Added
+		}
+	}
+	slices.Sort(decoded)
+	return decoded, added
+}
+
+// 作り直す場合にデコードするのは、索引にない内容のファイルだけ
+func TestIndexLibraryDecodesOnlyChangedPhotos(t *testing.T) {
+	dir := t.TempDir()
+	library, out := filepath.Join(dir, "thumbs"), filepath.Join(dir, "index.json")
+	writeLibrary(t, library, photoFixture(t), []int{0, 1, 2, 3, 4})
+	steps := []struct {
+		name   string
+		change func()
+		want   []string
+	}{
+		// dup.png は先に読んだ a.png と同じ内容なので、デコードしない
+		{"first build", func() {}, []string{"a.png", "b/c.png", "b/d.jpg", "e.gif"}},
+		{"unchanged", func() {}, nil},
+		{"renamed and changed", func() {
+			if err := os.Rename(filepath.Join(library, "b/c.png"), filepath.Join(library, "z.png")); err != nil {
+				t.Fatal(err)
+			}
+			writeTestImage(t, filepath.Join(library, "b/d.jpg"), solidImage(8, 8, color.NRGBA{250, 250, 0, 255}))
+		}, []string{"b/d.jpg"}},
+	}
+	for _, step := range steps {
+		step.change()
+		// 同じ内容の写真を同時に読まないよう、1 つのゴルーチンで読む
+		decoded, added := indexedPhotos(t, library, out, 1)
+		if !slices.Equal(decoded, step.want) || added != len(step.want) {
+			t.Errorf("%s: decoded %v, added %d, want %v", step.name, decoded, added, step.want)
+		}
+	}
+
+	// 同じ素材を別の索引に、ゴルーチンの数を変えて作っても同じバイト列になる
+	want, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, workers := range []int{1, 8} {
+		other := filepath.Join(dir, "index-"+strconv.Itoa(workers)+".json")
+		indexedPhotos(t, library, other, workers)
+		if got, err := os.ReadFile(other); err != nil || !bytes.Equal(got, want) {
+			t.Errorf("%d workers: index differs (%v)", workers, err)
+		}
+	}
+}
+
+func TestPhotoIndexUsage(t *testing.T) {
+	library := t.TempDir()
+	writeLibrary(t, library, photoFixture(t), []int{5})
+	tests := []struct {
+		name string
+		args []string
+		code int
+	}{
+		{"no library", nil, exitUsage},
+		{"extra arguments", []string{"-library", library, "extra"}, exitUsage},
+		{"negative parallel", []string{"-library", library, "-parallel", "-1"}, exitUsage},
+		{"no photos", []string{"-library", library, "-quiet"}, exitInput},
+		{"missing library", []string{"-library", filepath.Join(library, "missing"), "-quiet"}, exitInput},
+	}
+	for _, tt := range tests {
+		if res := runCLI(t, append([]string{"photo", "index"}, tt.args...)...); res.code != tt.code {
+			t.Errorf("%s: exit code = %d, want %d (stderr: %s)", tt.name, res.code, tt.code, res.stderr)
+		}
+	}
+}
+
+// CI で作った索引を -index に渡して使い、素材が変わっていなければ索引は書き換えない
+func TestPhotoWithPublishedIndex(t *testing.T) {
+	dir := t.TempDir()
+	library, out := filepath.Join(dir, "thumbs"), filepath.Join(dir, "index.json")
+	writeLibrary(t, library, photoFixture(t), []int{0, 1, 2, 4})
+	want := buildPhotoIndex(t, library, out)
+	info, err := os.Stat(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	in := filepath.Join(dir, "in.png")
+	writeTestImage(t, in, testImage(32, 24))
+	res := runCLI(t, "photo", "-in", in, "-out", filepath.Join(dir, "out.png"), "-library", library, "-index", out, "-tile", "8", "-quiet")
+	if res.code != exitOK {
+		t.Fatalf("exit code = %d (stderr: %s)", res.code, res.stderr)
+	}
+	if got := readTestImage(t, filepath.Join(dir, "out.png")); got.Rect != image.Rect(0, 0, 32, 24) {
+		t.Errorf("output %v", got.Rect)
+	}
+	after, err := os.Stat(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(out); !bytes.Equal(data, want) || !after.ModTime().Equal(info.ModTime()) {
+		t.Error("photo rewrote an unchanged index")
+	}
+	// 索引は素材のディレクトリに作らない
+	if _, err := os.Stat(filepath.Join(library, defaultPhotoIndex)); err == nil {
+		t.Error("default index was created")
+	}
+}
+
+// 単色の写真を置いた素材のディレクトリ
+// 赤、青、白をそれぞれ 5 段階の明るさで用意し、画像でないファイルも置く
+func photoColorLibrary(t *testing.T) (dir string, colors map[color.NRGBA]string) {
+	t.Helper()
+	dir = t.TempDir()
+	colors = map[color.NRGBA]string{}
+	for _, base := range []color.NRGBA{{255, 0, 0, 255}, {0, 0, 255, 255}, {255, 255, 255, 255}} {
+		for i := 0; i < 5; i++ {
+			d := uint8(i * 16)
+			dark := func(v uint8) uint8 { return v - v/255*d }
+			c := color.NRGBA{dark(base.R), dark(base.G), dark(base.B), 255}
+			img := image.NewNRGBA(image.Rect(0, 0, 20, 12))
+			draw.Draw(img, img.Rect, image.NewUniform(c), image.Point{}, draw.Src)
+			name := fmt.Sprintf("%02x%02x%02x.png", c.R, c.G, c.B)
+			writeTestImage(t, filepath.Join(dir, "sub", name), img)
+			colors[c] = name
+		}
+	}
+	writeTestFile(t, filepath.Join(dir, "notes.txt"), []byte("not a photo"))
+	return dir, colors
+}
+
+// 左半分が赤、右上が青、右下が白で、8 px のタイルが 6×4 並ぶ画像
+func photoInput(t *testing.T, path string) {
+	t.Helper()
+	img := image.NewNRGBA(image.Rect(0, 0, 48, 32))
+	draw.Draw(img, image.Rect(0, 0, 24, 32), image.NewUniform(color.NRGBA{255, 0, 0, 255}), image.Point{}, draw.Src)
+	draw.Draw(img, image.Rect(24, 0, 48, 16), image.NewUniform(color.NRGBA{0, 0, 255, 255}), image.Point{}, draw.Src)
+	draw.Draw(img, image.Rect(24, 16, 48, 32), image.NewUniform(color.NRGBA{255, 255, 255, 255}), image.Point{}, draw.Src)
+	writeTestImage(t, path, img)
+}
+
+// 出力のタイルごとに置いた写真のファイル名 (行優先)
+// どの写真とも色が合わないタイルがあればテストを止める
+func photoTiles(t *testing.T, path string, colors map[color.NRGBA]string) []string {
+	t.Helper()
+	img := readTestImage(t, path)
+	var names []string
+	for y := 0; y < img.Rect.Dy(); y += 8 {
+		for x := 0; x < img.Rect.Dx(); x += 8 {
+			c := img.NRGBAAt(x, y)
+			for ty := y; ty < y+8; ty++ {
+				for tx := x; tx < x+8; tx++ {
+					if img.NRGBAAt(tx, ty) != c {
+						t.Fatalf("tile (%d, %d) is not a single photo", x/8, y/8)
+					}
+				}
+			}
+			name, ok := colors[c]
+			if !ok {
+				t.Fatalf("tile (%d, %d) has color %v of no photo", x/8, y/8, c)
+			}
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+func TestPhoto(t *testing.T) {
+	library, colors := photoColorLibrary(t)
+	dir := t.TempDir()
+	in := filepath.Join(dir, "in.png")
+	photoInput(t, in)
+	out := filepath.Join(dir, "out.png")
+
+	res := runCLI(t, "photo", "-library", library, "-in", in, "-out", out, "-tile", "8", "-quiet")
+	if res.code != exitOK {
+		t.Fatalf("exit code = %d (stderr: %s)", res.code, res.stderr)
+	}
+	// 制限しない場合は、色が同じ写真だけを使う
+	counts := map[string]int{}
+	for _, name := range photoTiles(t, out, colors) {
+		counts[name]++
+	}
+	want := map[string]int{"ff0000.png": 12, "0000ff.png": 6, "ffffff.png": 6}
+	if fmt.Sprint(counts) != fmt.Sprint(want) {
+		t.Errorf("photo counts %v, want %v", counts, want)
+	}
+
+	// 写真ごとに 1 件の索引を素材のディレクトリに作る
+	data, err := os.ReadFile(filepath.Join(library, defaultPhotoIndex))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var index photoIndex
+	if err := json.Unmarshal(data, &index); err != nil {
+		t.Fatal(err)
+	}
+	if len(index.Photos) != len(colors) {
+		t.Errorf("index has %d photos, want %d", len(index.Photos), len(colors))
+	}
+
+	for _, radius := range []int{1, 2} {
+		res := runCLI(t, "photo", "-library", library, "-in", in, "-out", out, "-tile", "8", "-quiet", "-no-repeat-radius", fmt.Sprint(radius))
+		if res.code != exitOK {
+			t.Fatalf("radius %d: exit code = %d (stderr: %s)", radius, res.code, res.stderr)
+		}
+		names := photoTiles(t, out, colors)
+		if len(names) != 6*4 {
+			t.Fatalf("radius %d: %d tiles, want 24", radius, len(names))
+		}
+		// 縦横 radius タイル以内 (斜めを含む) に同じ写真はない
+		for i, name := range names {
+			x, y := i%6, i/6
+			for j := i + 1; j < len(names); j++ {
+				nx, ny := j%6, j/6
+				if max(nx-x, x-nx, ny-y) <= radius && names[j] == name {
+					t.Errorf("radius %d: %s at (%d, %d) and (%d, %d)", radius, name, x, y, nx, ny)
+				}
+			}
+		}
+		// 索引の写真を使い、作り直さない
+		after, err := os.ReadFile(filepath.Join(library, defaultPhotoIndex))
+		if err != nil || string(after) != string(data) {
+			t.Errorf("radius %d: index changed (%v)", radius, err)
+		}
+	}
+}
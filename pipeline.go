@@ -0,0 +1,922 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/yashikota/go-streaming-image-mosaic/internal/imagemeta"
+	"github.com/yashikota/go-streaming-image-mosaic/internal/jpegstream"
+	"github.com/yashikota/go-streaming-image-mosaic/internal/tiff"
+	"github.com/yashikota/go-streaming-image-mosaic/mosaic"
+)
+
+// 処理の段階
+const (
+	stageDecode  = "decode"
+	stageProcess = "process"
+	stageEncode  = "encode"
+)
+
+// バンドごとに書き出す場合に、書き出している間に先に処理しておくバンドの数
+// 書き出し中、処理済み、処理中の 3 つのバンドのバッファを使う
+const bandPrefetch = 2
+
+// どの段階で失敗したかを保持するエラー
+type stageError struct {
+	stage string
+	err   error
+}
+
+func (e *stageError) Error() string {
+	return e.stage + ": " + e.err.Error()
+}
+
+func (e *stageError) Unwrap() error {
+	return e.err
+}
+
+// デコードからエンコードまでの一連の処理の設定
+type pipeline struct {
+	tile        int                    // モザイクタイルの大きさ
+	gridOrigin  image.Point            // タイルの境界が通る点
+	tileMM      float64                // タイルの大きさ (mm、0 より大きい場合は解像度で換算して tile を置き換える)
+	dpi         float64                // 入力の解像度 (0 の場合は入力に記録された解像度)
+	workers     int                    // 1 枚の画像の処理に使うゴルーチンの数
+	timeout     time.Duration          // 1 枚の画像の処理の制限時間 (0 の場合は無制限)
+	limits      imageLimits            // デコードする画像の大きさの上限
+	maxHeap     byteSize               // 見積もった主なメモリの確保の上限 (0 は無制限)
+	downscale   int                    // デコードした画像を 1/downscale に縮小してから処理する (1 以下は縮小しない、TIFF には効かない)
+	grain       mosaic.Grain           // 塗りつぶし後に加えるノイズ
+	adjusts     []mosaic.ColorAdjust   // 塗りつぶしの前にタイルの色を変換する処理 (適用順)
+	palette     *mosaic.PaletteMatcher // adjusts の後にタイルの色を置き換えるパレット (nil の場合は置き換えない)
+	adjustScope mosaic.AdjustScope     // adjusts と palette を適用する範囲
+	color       mosaic.TileColorFunc   // タイルの色を決める関数 (nil の場合は RGB の平均色)
+	colorSpace  string                 // タイルの色を平均する色空間の名前 (要約に出力する)
+	tileFilter  mosaic.TileFilter      // タイルの平均色の画素の重み付け
+	rounding    mosaic.Rounding        // タイルの平均色の成分の丸め方
+	settings    mosaic.Options         // 処理結果に影響する設定 (Canonical にしたもの、キャッシュのキーと要約に使う)
+	exclude     mosaic.ExcludeFunc     // 処理から除外する画素を決める関数 (nil の場合はすべての画素を処理する)
+	selectLuma  *lumaSelection         // 輝度で処理する画素を選ぶ条件 (nil の場合はすべての画素を処理する)
+	selectExpr  *mosaic.SelectExpr     // -select の処理する画素の選び方 (nil の場合はすべての画素を処理する)
+	selectMask  map[string]*image.Gray // -select の mask(path) の画像 (パスごと)
+	skipEdges   float64                // エッジの量がこれより大きいタイルを処理しない (0 の場合は無効)
+	metrics     *metrics               // nil の場合は計測しない
+	pool        *mosaic.BufferPool     // バンドのバッファを借りるプール (nil の場合は処理のたびに確保する)
+	logger      *slog.Logger           // nil の場合はログを出力しない
+
+	debugOverlay     string // デバッグ用オーバーレイの出力先 (空の場合は出力しない)
+	debugOverlayFill bool   // オーバーレイのタイルを計算結果の色で塗るかどうか
+
+	exportTiles  string // タイルの色の書き出し先 (空の場合は書き出さない)
+	exportFormat string // タイルの色の書き出しの形式 (空の場合は書き出し先の拡張子で決める)
+
+	format       string // 出力の形式 (空の場合は JPEG、svg または html の場合はタイルを要素で表した SVG か HTML)
+	htmlOriginal bool   // HTML の出力に元画像を埋め込むかどうか
+	encoder      string // 画像の出力の形式 (空の場合は JPEG、JPEG はタイルの大きさが合えばバンドごとにエンコードする)
+	encodeOpts   mosaic.EncodeOptions
+	stitchLegend string // -format stitch の凡例の書き出し先
+	stitchCell   int    // -format stitch の図案の 1 マスの大きさ
+	maxCols      int    // -format emoji-text のタイルの列の数の上限 (0 で無制限)
+
+	block blockSize // 処理の単位のブロックの大きさ (ゼロ値の場合はバンドで処理する)
+
+	preview *terminalPreview // タイルの色を集めて端末に描くプレビュー (nil の場合は描かない)
+	stdout  io.Writer        // 出力のパスが - の場合の書き出し先 (nil の場合は - という名前のファイルに書き出す)
+
+	animate *animation // タイルの大きさを順に変えたアニメーション GIF を出力する場合の設定
+	outputs outputList // 主の出力とは別のタイルの大きさで書き出す出力
+
+	tolerant     bool        // 途中で切れた JPEG を切れた位置まで処理するかどうか
+	tolerantFill color.NRGBA // 復元できなかった行を塗りつぶす色
+
+	pages pageRanges // 複数ページの TIFF で処理するページ (空の場合はすべて)
+
+	convertSRGB bool // 埋め込まれた ICC プロファイルに従って sRGB に変換してから処理するかどうか
+
+	renderer mosaic.TileRenderer // タイルの描画処理 (nil の場合は単色で塗りつぶす)
+	pattern  mosaic.TilePattern  // 処理するタイルを決める関数 (nil の場合はすべてのタイル)
+	stripes  mosaic.Stripes      // 処理する横縞 (高さが 0 の場合はすべての行)
+
+	strengthMap  *image.Gray // タイルごとの処理の強さ (nil の場合はすべてのタイルを完全に処理する)
+	strengthPath string      // strengthMap を読み込んだパス
+
+	summaries *summaryLog // 入力ごとの処理を記録する場合の記録先 (nil の場合は記録しない)
+	stats     *runStats   // 処理中の入力の記録 (run が設定する)
+	digest    bool        // 処理結果の画素の Digest を記録する (summaries が必要)
+
+	// 処理中に記録した警告を受け取る関数 (nil の場合は要約にだけ記録する)
+	onWarning func(mosaic.Warning)
+}
+
+// 画像を読み込み、モザイク処理して出力の形式 (既定は JPEG) にエンコードした結果を w に書き込む
+// name はログに出力する入力の名前
+func (p pipeline) run(ctx context.Context, name string, r io.Reader, w io.Writer, progress mosaic.ProgressFunc) error {
+	logger := p.logger
+	if logger == nil {
+		logger = discardLogger
+	}
+	if p.summaries != nil {
+		p.stats = p.summaries.begin(name)
+	}
+	logger = p.warningLogger(logger)
+	logger = logger.With("input", name)
+	start := time.Now()
+	logger.Info("processing started", "tile", p.tile)
+
+	if p.timeout > 0 {
+		// デコードとエンコードは context を受け取らないため、入出力のたびに期限を確認する
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.timeout)
+		defer cancel()
+		r = &contextReader{ctx: ctx, r: r}
+	}
+	// 通常のファイルには、圧縮しない形式のバンドを位置を指定して書き込める
+	seekable := seekableOutput(w)
+	// 読み手が止まった名前付きパイプなどへの書き込みでも、ctx の終了で中断する
+	ow := newContextWriter(ctx, w)
+	defer ow.stop()
+	w = ow
+	cr := &countingReader{r: r}
+	cw := &countingWriter{w: w}
+	defer func() {
+		p.stats.finish(cw.n)
+		p.stats.logMemory(logger)
+	}()
+	if p.metrics != nil {
+		defer func() {
+			p.metrics.addBytes(cr.n, cw.n)
+		}()
+	}
+
+	// TIFF は複数のページを持つことがあるため、ページごとに処理して TIFF で書き出す
+	br := bufio.NewReader(cr)
+	if magic, _ := br.Peek(4); tiff.IsTIFF(magic) {
+		return p.runTIFF(ctx, logger, start, br, cw, progress)
+	}
+
+	p, br, err := p.withInputDensity(logger, br)
+	if err != nil {
+		return p.fail(logger, stageDecode, err)
+	}
+	br = p.checkProgressive(logger, br)
+	src, region, format, err := p.decodeSource(logger, br)
+	if err != nil {
+		return p.fail(logger, stageDecode, err)
+	}
+	if p.downscale > 1 {
+		src, region = downscaleSource(src, region, p.downscale)
+		logger.Debug("image downscaled", "factor", p.downscale, "width", src.Rect.Dx(), "height", src.Rect.Dy())
+	}
+	size := src.Rect.Size()
+	p.stats.since(stageDecode)
+	p.stats.sampleHeap(stageDecode)
+	p.stats.resolved(p, format, size.X, size.Y)
+	if p.encodeOpts.DPI > 0 && !p.recordsResolution() {
+		logger.Warn("resolution is not recorded in this output format", "code", warnMetadataDropped,
+			"metadata", "resolution", "dpi", p.encodeOpts.DPI, "format", p.outputFormat())
+	}
+	if p.digest {
+		p.stats.startDigest(src.Rect)
+	}
+	opts, err := p.options(logger, progress, src)
+	if err != nil {
+		return p.fail(logger, stageProcess, err)
+	}
+	if len(p.outputs) > 0 {
+		// 画像は 1 回だけデコードし、タイルの大きさごとの平均色は格子から求める
+		grids := p.colorGrids(logger, region)
+		if err := p.writeOutputs(ctx, logger, src, region, opts, grids); err != nil {
+			return err
+		}
+		if g := grids[p.tile]; g != nil {
+			opts = append(opts, mosaic.WithTileColor(g.TileColor))
+		}
+	}
+	grid := mosaic.NewGrid(region.Rect, p.tile, p.tile, p.gridOrigin)
+	columns, rows := grid.Columns, grid.Rows
+	if p.format == formatEmojiText && p.maxCols > 0 && columns > p.maxCols {
+		return &usageError{fmt.Errorf("emoji text would be %d columns wide (max-cols is %d; use a larger -tile or -max-cols)", columns, p.maxCols)}
+	}
+	header := exportHeader{size: size, name: name, tile: p.tile}
+	var observers []func(mosaic.TileInfo)
+	var export *tileExport
+	if p.exportTiles != "" {
+		if export, err = p.openTileExport(grid, header); err != nil {
+			return p.fail(logger, stageEncode, err)
+		}
+		defer export.file.Close()
+		observers = append(observers, export.observe)
+	}
+	var vector *tileExporter
+	if p.format == exportSVG || p.format == exportHTML {
+		if p.debugOverlay != "" {
+			logger.Warn("debug overlay is not supported for this output format", "code", warnUnsupported, "format", p.format)
+		}
+		if p.format == exportHTML && p.htmlOriginal {
+			if header.original, err = dataURI(src); err != nil {
+				return p.fail(logger, stageEncode, err)
+			}
+		}
+		if vector, err = newTileExporter(cw, p.format, grid, header); err != nil {
+			return p.fail(logger, stageEncode, err)
+		}
+		observers = append(observers, vector.observe)
+	}
+	var chart *mosaic.StitchChart
+	if p.format == formatStitch {
+		if p.debugOverlay != "" {
+			logger.Warn("debug overlay is not supported for this output format", "code", warnUnsupported, "format", p.format)
+		}
+		chart = mosaic.NewStitchChart(columns, rows, mosaic.DMCThreads)
+		observers = append(observers, chart.Observe)
+	}
+	var emoji *mosaic.EmojiGrid
+	if p.format == formatEmojiText || p.format == formatEmojiPNG {
+		if p.debugOverlay != "" {
+			logger.Warn("debug overlay is not supported for this output format", "code", warnUnsupported, "format", p.format)
+		}
+		emoji = mosaic.NewEmojiGrid(columns, rows)
+		observers = append(observers, emoji.Observe)
+	}
+	if p.preview != nil {
+		observers = append(observers, p.preview.collect(columns, rows))
+	}
+	if len(observers) > 0 {
+		opts = append(opts, mosaic.WithTileObserver(func(t mosaic.TileInfo) {
+			for _, observe := range observers {
+				observe(t)
+			}
+		}))
+	}
+	// バンドの高さが MCU の高さの倍数なら、処理済みのバンドを順にエンコードする
+	streaming := p.streaming()
+	if streaming {
+		// 次のバンドを処理している間に、処理済みのバンドをエンコードする
+		opts = append(opts, mosaic.WithPrefetch(bandPrefetch))
+	}
+	processor := mosaic.New(region, p.tile, p.tile, opts...)
+
+	switch {
+	case p.animate != nil:
+		logger.Debug("encoding", "mode", "animation", "frames", len(p.animate.frames()))
+		if err := p.writeAnimation(ctx, logger, cw, src, region, opts); err != nil {
+			return err
+		}
+	case vector != nil:
+		// タイルの色だけを使うため、処理済みのバンドは (-digest の Digest に加えて) 捨てる
+		logger.Debug("encoding", "mode", p.format)
+		if err := processor.ProcessBands(ctx, p.hashBand); err != nil {
+			return p.fail(logger, stageProcess, err)
+		}
+		p.hashRest(src, region)
+		p.stats.sampleHeap(stageProcess)
+		if err := p.stats.timed(stageEncode, vector.close); err != nil {
+			return p.fail(logger, stageEncode, err)
+		}
+	case chart != nil:
+		// 図案はタイルの色だけから描くため、処理済みのバンドは (-digest の Digest に加えて) 捨てる
+		logger.Debug("encoding", "mode", p.format)
+		if err := processor.ProcessBands(ctx, p.hashBand); err != nil {
+			return p.fail(logger, stageProcess, err)
+		}
+		p.hashRest(src, region)
+		p.stats.sampleHeap(stageProcess)
+		if err := p.stats.timed(stageEncode, func() error { return png.Encode(cw, chart.Image(p.stitchCell)) }); err != nil {
+			return p.fail(logger, stageEncode, err)
+		}
+		legend := chart.Legend()
+		if err := p.stats.timed(stageEncode, func() error { return writeStitchLegend(p.stitchLegend, legend) }); err != nil {
+			return p.fail(logger, stageEncode, &outputError{path: p.stitchLegend, err: err})
+		}
+		logger.Debug("stitch legend written", "path", p.stitchLegend, "threads", len(legend))
+	case emoji != nil:
+		// 絵文字はタイルの色だけから選ぶため、処理済みのバンドは (-digest の Digest に加えて) 捨てる
+		logger.Debug("encoding", "mode", p.format)
+		if err := processor.ProcessBands(ctx, p.hashBand); err != nil {
+			return p.fail(logger, stageProcess, err)
+		}
+		p.hashRest(src, region)
+		p.stats.sampleHeap(stageProcess)
+		err := p.stats.timed(stageEncode, func() error {
+			if p.format == formatEmojiText {
+				return emoji.WriteText(cw)
+			}
+			return png.Encode(cw, emoji.Image())
+		})
+		if err != nil {
+			return p.fail(logger, stageEncode, err)
+		}
+	case p.debugOverlay != "" && !p.settings.ProcessesRegions():
+		// オーバーレイには元画像が必要なので、出力画像を別に確保する (-region の場合は範囲の処理で書き出す)
+		output, err := processor.ProcessContext(ctx)
+		if err != nil {
+			return p.fail(logger, stageProcess, err)
+		}
+		if region != src {
+			// 塗りつぶした行を含む、元画像と同じ大きさの出力画像にする
+			full := image.NewNRGBA(src.Rect)
+			draw.Draw(full, src.Rect, src, src.Rect.Min, draw.Src)
+			draw.Draw(full, output.Rect, output, output.Rect.Min, draw.Src)
+			output = full
+		}
+		p.stats.sampleHeap(stageProcess)
+		p.stats.hashImage(output)
+		overlay := mosaic.DebugOverlayGrid(src, output, mosaic.NewGrid(src.Rect, p.tile, p.tile, p.gridOrigin), p.debugOverlayFill)
+		if err := p.stats.timed(stageEncode, func() error { return p.writeDebugOverlay(src, overlay) }); err != nil {
+			return p.fail(logger, stageEncode, err)
+		}
+		logger.Debug("debug overlay written", "path", p.debugOverlay)
+		if err := p.stats.timed(stageEncode, func() error { return p.encode(cw, output) }); err != nil {
+			return p.fail(logger, stageEncode, err)
+		}
+	case p.block != (blockSize{}) && p.encoderName() == "tiff" && region == src && grid.Cell(0, 0).Tile.Min == src.Rect.Min:
+		// ブロックを順にタイルの TIFF として書き出す
+		logger.Debug("encoding", "mode", "blocks", "block", processor.BlockSize())
+		if err := p.encodeTiledTIFF(ctx, logger, processor, cw, src); err != nil {
+			return err
+		}
+	case p.settings.ProcessesRegions():
+		// 範囲ごとに処理して元画像に書き戻し、まとめてエンコードする
+		logger.Debug("encoding", "mode", "regions", "regions", len(p.settings.Regions), "encoder", p.encoderName())
+		var original *image.NRGBA
+		if p.debugOverlay != "" {
+			// オーバーレイには元画像が必要なので、書き戻す前に複製する
+			original = image.NewNRGBA(src.Rect)
+			copy(original.Pix, src.Pix)
+		}
+		regions := p.regions(logger, region.Rect)
+		if err := mosaic.ProcessRegions(ctx, region, p.tile, p.tile, regions, opts...); err != nil {
+			return p.fail(logger, stageProcess, err)
+		}
+		p.stats.sampleHeap(stageProcess)
+		p.stats.hashImage(src)
+		if original != nil {
+			overlay := mosaic.DebugOverlayRegions(original, src, p.tile, p.tile, regions, p.gridOrigin, p.debugOverlayFill)
+			if err := p.stats.timed(stageEncode, func() error { return p.writeDebugOverlay(original, overlay) }); err != nil {
+				return p.fail(logger, stageEncode, err)
+			}
+			logger.Debug("debug overlay written", "path", p.debugOverlay)
+		}
+		if err := p.stats.timed(stageEncode, func() error { return p.encode(cw, src) }); err != nil {
+			return p.fail(logger, stageEncode, err)
+		}
+	case seekable != nil && p.format == "" && mosaic.IsOffsetFormat(p.encoderName()) && region == src && !p.digest:
+		// バンドの出力の位置が前もって決まるため、ゴルーチンごとに処理したバンドを直接その位置に書き込む
+		logger.Debug("encoding", "mode", "offsets", "encoder", p.encoderName())
+		wa := &countingWriterAt{w: seekable}
+		err := processor.ProcessToWriterAt(ctx, wa, p.encoderName())
+		cw.n += wa.n.Load()
+		if wa.err != nil {
+			return p.fail(logger, stageEncode, wa.err)
+		}
+		if err != nil {
+			return p.fail(logger, stageProcess, err)
+		}
+		p.stats.sampleHeap(stageProcess)
+	case streaming:
+		logger.Debug("encoding", "mode", "streaming")
+		if err := p.encodeBands(ctx, logger, processor, cw, src, region); err != nil {
+			return err
+		}
+	default:
+		// 結果を元画像に書き戻してメモリを節約し、まとめてエンコードする
+		if p.block != (blockSize{}) {
+			logger.Debug("encoding", "mode", "buffered", "encoder", p.encoderName(), "block", processor.BlockSize())
+		} else if p.encoderName() == "jpeg" && p.tile%jpegstream.MCUHeight != 0 {
+			logger.Debug("encoding", "mode", "buffered",
+				"reason", fmt.Sprintf("tile %d is not a multiple of %d", p.tile, jpegstream.MCUHeight))
+		} else if p.encoderName() == "jpeg" {
+			logger.Debug("encoding", "mode", "buffered",
+				"reason", fmt.Sprintf("grid origin y %d is not a multiple of %d", p.gridOrigin.Y, jpegstream.MCUHeight))
+		} else {
+			logger.Debug("encoding", "mode", "buffered", "encoder", p.encoderName())
+		}
+		if _, err := processor.ProcessInPlace(ctx); err != nil {
+			return p.fail(logger, stageProcess, err)
+		}
+		p.stats.sampleHeap(stageProcess)
+		p.stats.hashImage(src)
+		if err := p.stats.timed(stageEncode, func() error { return p.encode(cw, src) }); err != nil {
+			return p.fail(logger, stageEncode, err)
+		}
+	}
+
+	if export != nil {
+		if err := export.close(); err != nil {
+			return p.fail(logger, stageEncode, err)
+		}
+		logger.Debug("tile colors exported", "path", p.exportTiles, "tiles", export.written)
+	}
+
+	if p.metrics != nil {
+		p.metrics.imageProcessed(format)
+	}
+	logger.Info("processing finished",
+		"format", format, "width", size.X, "height", size.Y,
+		"duration", time.Since(start), "bytes_out", cw.n)
+	return nil
+}
+
+// タイルの色の書き出し先のファイルと書き出し
+type tileExport struct {
+	*tileExporter
+	file *os.File
+}
+
+func (p pipeline) openTileExport(grid mosaic.Grid, header exportHeader) (*tileExport, error) {
+	file, err := os.Create(p.exportTiles)
+	if err != nil {
+		return nil, err
+	}
+	exporter, err := newTileExporter(file, exportFormat(p.exportFormat, p.exportTiles), grid, header)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &tileExport{tileExporter: exporter, file: file}, nil
+}
+
+func (e *tileExport) close() error {
+	if err := e.tileExporter.close(); err != nil {
+		return err
+	}
+	return e.file.Close()
+}
+
+// src を処理する Processor のオプション
+// 強さのマップや -select のマスクの大きさが src と異なる場合はエラーを返す
+func (p pipeline) options(logger *slog.Logger, progress mosaic.ProgressFunc, src *image.NRGBA) ([]mosaic.Option, error) {
+	opts := []mosaic.Option{
+		mosaic.WithProgress(progress),
+		mosaic.WithLogger(logger),
+		mosaic.WithGrain(p.grain),
+		mosaic.WithColorAdjust(p.colorAdjusts(logger)...),
+		mosaic.WithAdjustScope(p.adjustScope),
+		mosaic.WithWorkers(p.workers),
+		mosaic.WithSkipEdges(p.skipEdges),
+		mosaic.WithGridOrigin(p.gridOrigin),
+	}
+	if p.metrics != nil {
+		opts = append(opts, mosaic.WithMetrics(p.metrics))
+	}
+	if p.pool != nil {
+		opts = append(opts, mosaic.WithBufferPool(p.pool))
+	}
+	if b := p.blockSize(); b != (image.Point{}) {
+		opts = append(opts, mosaic.WithBlockSize(b.X, b.Y))
+	}
+	if p.color != nil {
+		opts = append(opts, mosaic.WithTileColor(p.color))
+	}
+	if p.tileFilter != mosaic.BoxFilter {
+		opts = append(opts, mosaic.WithTileFilter(p.tileFilter))
+	}
+	if p.rounding != mosaic.RoundHalfUp {
+		opts = append(opts, mosaic.WithRounding(p.rounding))
+	}
+	if p.pattern != nil {
+		opts = append(opts, mosaic.WithTilePattern(p.pattern))
+	}
+	if p.stripes.Process > 0 {
+		opts = append(opts, mosaic.WithStripes(p.stripes.Process, p.stripes.Skip))
+	}
+	if p.exclude != nil {
+		opts = append(opts, mosaic.WithExclude(p.exclude))
+	}
+	if p.renderer != nil {
+		opts = append(opts, mosaic.WithTileRenderer(p.renderer))
+	}
+	if selection, err := p.selection(src); err != nil {
+		return nil, err
+	} else if selection != nil {
+		opts = append(opts, mosaic.WithSelection(selection))
+	}
+	if p.strengthMap != nil {
+		m, err := strengthMapFor(p.strengthMap, p.strengthPath, src)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, mosaic.WithStrengthMap(m))
+	}
+	return opts, nil
+}
+
+// タイルの色を変換する処理 (パレットへの置き換えは、ほかの調整を済ませた色に対して最後に行う)
+// パレットの色域の外の色の警告は logger に出力するため、処理ごとに作る
+func (p pipeline) colorAdjusts(logger *slog.Logger) []mosaic.ColorAdjust {
+	if p.palette == nil {
+		return p.adjusts
+	}
+	return append(slices.Clip(p.adjusts), paletteAdjust(logger, p.palette))
+}
+
+// r の画像をデコードし、元画像とモザイク処理する範囲を返却
+// tolerant で復元できなかった行は塗りつぶし、region から除く
+func (p pipeline) decodeSource(logger *slog.Logger, r *bufio.Reader) (src, region *image.NRGBA, format string, err error) {
+	return p.decodeSourceInto(logger, r, nil)
+}
+
+// decodeSource と同じく r の画像をデコードし、画像の範囲が buf と同じ場合は buf に書き込んで元画像にする
+// 同じ大きさの画像を続けて処理する場合に、元画像のメモリを使い回すために使う (buf が nil の場合は確保する)
+func (p pipeline) decodeSourceInto(logger *slog.Logger, r *bufio.Reader, buf *image.NRGBA) (src, region *image.NRGBA, format string, err error) {
+	var (
+		in      io.Reader = r
+		profile []byte
+	)
+	if p.convertSRGB {
+		in, profile = readICCProfile(r)
+	}
+	img, format, valid, err := p.decode(logger, in)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	size := img.Bounds().Size()
+	logger.Debug("image decoded", "format", format, "width", size.X, "height", size.Y)
+	if img.Bounds().Empty() {
+		// 幅か高さが 0 の画像は、処理やエンコードで分かりにくいエラーになる前にデコードのエラーとする
+		return nil, nil, "", mosaic.ErrEmptyImage
+	}
+
+	if buf != nil && buf.Rect == img.Bounds() {
+		draw.Draw(buf, buf.Rect, img, buf.Rect.Min, draw.Src)
+		src = buf
+	} else {
+		src = mosaic.ConvertToNRGBA(img)
+	}
+	if profile != nil {
+		p.convertToSRGB(logger, src, profile)
+	}
+	region = src
+	if valid < size.Y {
+		// 復元できなかった行を塗りつぶし、残りの範囲だけをモザイク処理する
+		missing := image.Rect(src.Rect.Min.X, src.Rect.Min.Y+valid, src.Rect.Max.X, src.Rect.Max.Y)
+		draw.Draw(src, missing, image.NewUniform(p.tolerantFill), image.Point{}, draw.Src)
+		region = src.SubImage(image.Rect(src.Rect.Min.X, src.Rect.Min.Y, src.Rect.Max.X, missing.Min.Y)).(*image.NRGBA)
+	}
+	return src, region, format, nil
+}
+
+// 処理済みのバンドを順に JPEG にエンコードして w に書き込む
+// 出力画像全体を保持しないため、出力に使うメモリはバンド 1 つ分で済む
+// processor は src のうち region の範囲を処理し、region より下の行は src のままエンコードする
+func (p pipeline) encodeBands(ctx context.Context, logger *slog.Logger, processor *mosaic.Processor, w io.Writer, src, region *image.NRGBA) error {
+	size := src.Rect.Size()
+	var o *jpeg.Options
+	if p.encodeOpts.Quality > 0 {
+		o = &jpeg.Options{Quality: p.encodeOpts.Quality}
+	}
+	if p.encodeOpts.DPI > 0 {
+		w = imagemeta.JPEGWriter(w, p.encodeOpts.DPI)
+	}
+	enc, err := jpegstream.NewEncoder(w, size.X, size.Y, o)
+	if err != nil {
+		return p.fail(logger, stageEncode, err)
+	}
+	var encErr error
+	err = processor.ProcessBands(ctx, func(band *image.NRGBA, rect image.Rectangle) error {
+		p.stats.hashRows(band, rect)
+		encErr = p.stats.timed(stageEncode, func() error { return enc.WriteBand(band, rect) })
+		return encErr
+	})
+	if encErr != nil {
+		return p.fail(logger, stageEncode, encErr)
+	}
+	if err != nil {
+		return p.fail(logger, stageProcess, err)
+	}
+	if region.Rect.Max.Y < src.Rect.Max.Y {
+		rest := image.Rect(src.Rect.Min.X, region.Rect.Max.Y, src.Rect.Max.X, src.Rect.Max.Y)
+		p.stats.hashRows(src, rest)
+		if err := p.stats.timed(stageEncode, func() error { return enc.WriteBand(src, rest) }); err != nil {
+			return p.fail(logger, stageEncode, err)
+		}
+	}
+	if err := p.stats.timed(stageEncode, enc.Close); err != nil {
+		return p.fail(logger, stageEncode, err)
+	}
+	return nil
+}
+
+// bounds の画像を処理する -region と -regions の範囲
+// 範囲ごとの設定は、指定したものだけを全体の設定の後に適用する
+// -region-min-tiles の場合は範囲ごとに選んだタイルの大きさをログと実行の要約に記録する
+func (p pipeline) regions(logger *slog.Logger, bounds image.Rectangle) []mosaic.Region {
+	regions := make([]mosaic.Region, len(p.settings.Regions))
+	var tiles []int
+	for i, r := range p.settings.Regions {
+		tile := p.settings.RegionTile(r, p.tile, bounds)
+		regions[i] = mosaic.Region{Rect: r.Rectangle(), TileWidth: tile, TileHeight: tile}
+		if p.settings.RegionMinTiles > 0 {
+			tiles = append(tiles, tile)
+			logger.Debug("region tile size", "region", i+1, "rect", r.Rectangle(), "tile", tile)
+		}
+		if r.ColorSpace != "" {
+			regions[i].Options = append(regions[i].Options, mosaic.WithTileColor(meanColor(r.ColorSpace)))
+		}
+		if r.Style != "" {
+			o := p.settings
+			o.Style = r.Style
+			regions[i].Options = append(regions[i].Options, mosaic.WithTileRenderer(renderer(o)))
+		}
+	}
+	p.stats.regionTiles(tiles)
+	return regions
+}
+
+// 処理済みのバンドを -digest の Digest に加える mosaic.BandFunc
+func (p pipeline) hashBand(band *image.NRGBA, rect image.Rectangle) error {
+	p.stats.hashRows(band, rect)
+	return nil
+}
+
+// region より下の、処理しなかった src の行を -digest の Digest に加える
+func (p pipeline) hashRest(src, region *image.NRGBA) {
+	if region.Rect.Max.Y < src.Rect.Max.Y {
+		p.stats.hashRows(src, image.Rect(src.Rect.Min.X, region.Rect.Max.Y, src.Rect.Max.X, src.Rect.Max.Y))
+	}
+}
+
+// 画像の出力の形式の名前
+func (p pipeline) encoderName() string {
+	if p.encoder == "" {
+		return "jpeg"
+	}
+	return p.encoder
+}
+
+// -format の format と出力のパス path から書き出す形式の名前を決める
+// 拡張子のないパスと標準出力は空 (JPEG) にし、書き出せない形式と拡張子は使い方のエラーにする
+func outputEncoder(format, path string) (string, error) {
+	name, _, err := mosaic.ResolveEncoder(format, path)
+	if err != nil {
+		if format == "" && (path == stdoutPath || path == dataURIOut || filepath.Ext(path) == "") {
+			return "", nil
+		}
+		var unknown *mosaic.UnknownEncoderError
+		if errors.As(err, &unknown) {
+			err = fmt.Errorf("unknown output format %q (want %s)", unknown.Name, strings.Join(unknown.Encoders, ", "))
+		}
+		return "", &usageError{err}
+	}
+	return name, nil
+}
+
+// 画像として書き出す形式の名前 (タイルから書き出す形式は使い方のエラーにする)
+func imageEncoder(format, path string) (string, error) {
+	name, err := outputEncoder(format, path)
+	if err == nil && mosaic.IsTileFormat(name) {
+		return "", &usageError{fmt.Errorf("%s output is only supported by apply", name)}
+	}
+	return name, err
+}
+
+// 画像を出力の形式で w に書き出す
+func (p pipeline) encode(w io.Writer, img image.Image) error {
+	enc, err := mosaic.LookupEncoder(p.encoderName())
+	if err != nil {
+		return err
+	}
+	return enc.Encode(w, img, p.encodeOpts)
+}
+
+// 画像をデコードし、形式と先頭から何行目までが有効かを返却
+// 大きさの上限を超える画像はデコードしない
+// tolerant の場合、途中で切れた JPEG は切れた位置までを復元する
+func (p pipeline) decode(logger *slog.Logger, r io.Reader) (image.Image, string, int, error) {
+	r, err := p.limits.check(r)
+	if err != nil {
+		return nil, "", 0, err
+	}
+	if p.maxHeap > 0 || p.stats != nil {
+		// 主なメモリの確保を見積もり、-max-heap を超える画像はデコードしない
+		var header imageHeader
+		r, header, err = peekHeader(r)
+		switch {
+		case err == nil:
+			m := p.planMemory(header.config, header.decodedBytes())
+			if err := p.checkHeap(header.config, m); err != nil {
+				return nil, "", 0, err
+			}
+			p.stats.planned(m)
+		case p.maxHeap > 0:
+			return nil, "", 0, err
+		}
+	}
+	if !p.tolerant {
+		img, format, err := mosaic.Decode(r)
+		if err != nil {
+			return nil, "", 0, err
+		}
+		return img, format, img.Bounds().Dy(), nil
+	}
+
+	// 切れた場合にデコードし直すため、入力全体を読み込んでおく
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, "", 0, err
+	}
+	img, format, err := mosaic.Decode(bytes.NewReader(data))
+	if err == nil {
+		return img, format, img.Bounds().Dy(), nil
+	}
+	if !bytes.HasPrefix(data, []byte{0xff, 0xd8}) {
+		return nil, "", 0, err
+	}
+	partial, valid, recoverErr := decodeTruncatedJPEG(data)
+	if recoverErr != nil {
+		logger.Debug("truncated JPEG could not be recovered", "error", recoverErr)
+		return nil, "", 0, err
+	}
+	height := partial.Bounds().Dy()
+	logger.Warn("truncated JPEG recovered", "code", warnTruncated,
+		"recovered_percent", fmt.Sprintf("%.1f", float64(valid)*100/float64(height)),
+		"rows", valid, "height", height)
+	return partial, "jpeg", valid, nil
+}
+
+// SOF を探すために読み込む JPEG の先頭部分の最大サイズ (最大 64KiB の APP1 の EXIF の後にある SOF まで読む)
+const jpegHeaderLimit = 1 << 17
+
+// JPEG で書き出す場合に、入力がプログレッシブ JPEG かどうかを先頭部分から調べ、ベースラインで書き出すことを警告する
+// 読んだ先頭部分を含めて画像全体を読み込める *bufio.Reader を返却
+func (p pipeline) checkProgressive(logger *slog.Logger, br *bufio.Reader) *bufio.Reader {
+	if p.outputFormat() != "jpeg" {
+		return br
+	}
+	br = bufio.NewReaderSize(br, jpegHeaderLimit)
+	if header, _ := br.Peek(jpegHeaderLimit); progressiveJPEG(header) {
+		logger.Warn("progressive JPEG input is written as a baseline JPEG", "code", warnProgressive)
+	}
+	return br
+}
+
+// 出力の形式に -tile-mm や -dpi の解像度を記録できるかどうか
+func (p pipeline) recordsResolution() bool {
+	switch p.outputFormat() {
+	case "jpeg", "png", "tiff":
+		return true
+	}
+	return false
+}
+
+// 書き出す形式の名前 (タイルを要素で表す形式か、画像の形式。アニメーションは gif)
+func (p pipeline) outputFormat() string {
+	switch {
+	case p.animate != nil:
+		return "gif"
+	case p.format != "":
+		return p.format
+	}
+	return p.encoderName()
+}
+
+// 画像の先頭部分から ICC プロファイルを取り出す
+// 読んだ先頭部分を含めて画像全体を読み込める io.Reader を返却
+func readICCProfile(r io.Reader) (io.Reader, []byte) {
+	br := bufio.NewReaderSize(r, infoHeaderLimit)
+	header, _ := br.Peek(infoHeaderLimit)
+	return br, embeddedICCProfile(header)
+}
+
+// ICC プロファイルに従って src の色をその場で sRGB に変換する
+// 変換できないプロファイルは警告を出力し、色を変換せずに処理を続ける
+func (p pipeline) convertToSRGB(logger *slog.Logger, src *image.NRGBA, profile []byte) {
+	transform, err := parseICCProfile(profile)
+	if err != nil {
+		logger.Warn("colors are not converted to sRGB", "code", warnColorProfile, "error", err)
+		return
+	}
+	transform.apply(src)
+	logger.Debug("converted to sRGB", "profile_bytes", len(profile))
+}
+
+// デバッグ用オーバーレイを PNG で出力
+// -select などで処理する画素を選んだ場合は、元画像 src で選んだ画素の輪郭を描く
+func (p pipeline) writeDebugOverlay(src, overlay *image.NRGBA) error {
+	selection, err := p.selection(src)
+	if err != nil {
+		return err
+	}
+	if selection != nil {
+		mosaic.StrokeSelection(overlay, selection, mosaic.OutlineColor)
+	}
+	file, err := os.Create(p.debugOverlay)
+	if err != nil {
+		return &outputError{path: p.debugOverlay, err: err}
+	}
+	if err := png.Encode(file, overlay); err != nil {
+		file.Close()
+		return &outputError{path: p.debugOverlay, err: err}
+	}
+	if err := file.Close(); err != nil {
+		return &outputError{path: p.debugOverlay, err: err}
+	}
+	return nil
+}
+
+// 失敗した段階を記録してエラーを返却
+func (p pipeline) fail(logger *slog.Logger, stage string, err error) error {
+	var stalled *outputStalledError
+	if p.timeout > 0 && errors.Is(err, context.DeadlineExceeded) && !errors.As(err, &stalled) {
+		err = &timeoutError{timeout: p.timeout}
+	}
+	logger.Debug("processing failed", "stage", stage, "error", err)
+	if p.metrics != nil {
+		p.metrics.failure(stage)
+	}
+	return &stageError{stage: stage, err: err}
+}
+
+// 制限時間を超えたことを表すエラー
+type timeoutError struct {
+	timeout time.Duration
+}
+
+func (e *timeoutError) Error() string { return fmt.Sprintf("timed out after %s", e.timeout) }
+func (e *timeoutError) Unwrap() error { return context.DeadlineExceeded }
+
+// ctx が終了した後の読み込みでエラーを返す io.Reader
+// 読み込みの途中では中断しないため、止まるのは次の Read の呼び出しまで遅れる
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c *contextReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(p)
+}
+
+// 読み込んだバイト数を数える io.Reader
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// 書き込んだバイト数と最初の書き込みのエラーを記録する io.WriterAt
+// 重ならない範囲への WriteAt を同時に呼び出せる
+type countingWriterAt struct {
+	w    io.WriterAt
+	n    atomic.Int64
+	once sync.Once
+	err  error
+}
+
+func (c *countingWriterAt) WriteAt(p []byte, off int64) (int, error) {
+	n, err := c.w.WriteAt(p, off)
+	c.n.Add(int64(n))
+	if err != nil {
+		c.once.Do(func() { c.err = err })
+	}
+	return n, err
+}
+
+// w が WriteAt で任意の位置に書き込める通常のファイルなら、その io.WriterAt を返却 (パイプや端末などは nil)
+func seekableOutput(w io.Writer) io.WriterAt {
+	f, ok := w.(*os.File)
+	if !ok {
+		return nil
+	}
+	info, err := f.Stat()
+	if err != nil || !info.Mode().IsRegular() {
+		return nil
+	}
+	return f
+}
+
+// 書き込んだバイト数を数える io.Writer
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"image/color"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/yashikota/go-streaming-image-mosaic/mosaic"
+)
+
+// 出力のパスに指定すると標準出力に書き出す
+const stdoutPath = "-"
+
+// 端末の幅を決められない場合の文字数
+const defaultPreviewColumns = 80
+
+// 上半分を前景色、下半分を背景色で塗る文字
+const upperHalfBlock = "▀"
+
+// 端末へのタイルの格子のプレビュー
+// 1 文字に縦 2 つのタイルを描き、端末の幅に収まらない場合はタイルをまとめて縮小する
+// 処理中に collect でタイルの色を集め、処理が終わった後に flush で描く
+type terminalPreview struct {
+	w         io.Writer
+	columns   int  // 端末の幅 (文字数)
+	truecolor bool // 24 ビットの色を使うかどうか (false の場合は 256 色)
+	grid      *previewGrid
+}
+
+// w に描くプレビュー
+// 幅は環境変数 COLUMNS、端末の大きさ、80 文字の順に決め、色は COLORTERM が truecolor か 24bit の場合だけ 24 ビットにする
+func newTerminalPreview(w io.Writer, getenv func(string) string) *terminalPreview {
+	columns := 0
+	if n, err := strconv.Atoi(getenv("COLUMNS")); err == nil && n > 0 {
+		columns = n
+	} else if f, ok := w.(*os.File); ok {
+		columns, _ = terminalColumns(f)
+	}
+	if columns <= 0 {
+		columns = defaultPreviewColumns
+	}
+	colorterm := strings.ToLower(getenv("COLORTERM"))
+	return &terminalPreview{w: w, columns: columns, truecolor: colorterm == "truecolor" || colorterm == "24bit"}
+}
+
+// プレビューに描くタイルの色の格子
+// 書き換えなかったタイルと完全に透明なタイルは描かない
+type previewGrid struct {
+	columns, rows int
+	mu            sync.Mutex
+	cells         []color.NRGBA
+	filled        []bool
+}
+
+func newPreviewGrid(columns, rows int) *previewGrid {
+	return &previewGrid{columns: columns, rows: rows, cells: make([]color.NRGBA, columns*rows), filled: make([]bool, columns*rows)}
+}
+
+// WithTileObserver に渡す関数
+func (g *previewGrid) observe(t mosaic.TileInfo) {
+	if t.X < 0 || t.X >= g.columns || t.Y < 0 || t.Y >= g.rows || t.Skipped || t.Color.A == 0 {
+		return
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.cells[t.Y*g.columns+t.X] = t.Color
+	g.filled[t.Y*g.columns+t.X] = true
+}
+
+// k×k のタイルをまとめた格子 (色は描くタイルの単純な平均)
+func (g *previewGrid) downsample(k int) *previewGrid {
+	if k <= 1 {
+		return g
+	}
+	out := newPreviewGrid((g.columns+k-1)/k, (g.rows+k-1)/k)
+	for y := 0; y < out.rows; y++ {
+		for x := 0; x < out.columns; x++ {
+			var r, gr, b, n int
+			for ty := y * k; ty < min((y+1)*k, g.rows); ty++ {
+				for tx := x * k; tx < min((x+1)*k, g.columns); tx++ {
+					if i := ty*g.columns + tx; g.filled[i] {
+						c := g.cells[i]
+						r, gr, b, n = r+int(c.R), gr+int(c.G), b+int(c.B), n+1
+					}
+				}
+			}
+			if n > 0 {
+				out.cells[y*out.columns+x] = color.NRGBA{uint8(r / n), uint8(gr / n), uint8(b / n), 0xff}
+				out.filled[y*out.columns+x] = true
+			}
+		}
+	}
+	return out
+}
+
+// columns×rows のタイルの色を集める関数 (WithTileObserver に渡す)
+func (t *terminalPreview) collect(columns, rows int) func(mosaic.TileInfo) {
+	t.grid = newPreviewGrid(columns, rows)
+	return t.grid.observe
+}
+
+// 集めたタイルの色の格子を、端末の幅に収まるよう縮小して描く
+func (t *terminalPreview) flush() error {
+	g := t.grid
+	if g == nil {
+		return nil
+	}
+	g = g.downsample((g.columns + t.columns - 1) / t.columns)
+	bw := bufio.NewWriter(t.w)
+	for y := 0; y < g.rows; y += 2 {
+		for x := 0; x < g.columns; x++ {
+			top, topOK := g.cells[y*g.columns+x], g.filled[y*g.columns+x]
+			var bottom color.NRGBA
+			bottomOK := false
+			if y+1 < g.rows {
+				bottom, bottomOK = g.cells[(y+1)*g.columns+x], g.filled[(y+1)*g.columns+x]
+			}
+			switch {
+			case topOK && bottomOK:
+				bw.WriteString(t.sgr(38, top) + t.sgr(48, bottom) + upperHalfBlock)
+			case topOK:
+				bw.WriteString(t.sgr(38, top) + "\x1b[49m" + upperHalfBlock)
+			case bottomOK:
+				// 上半分を端末の背景のまま残すため、下半分のブロックを前景色で描く
+				bw.WriteString(t.sgr(38, bottom) + "\x1b[49m▄")
+			default:
+				bw.WriteString("\x1b[0m ")
+			}
+		}
+		bw.WriteString("\x1b[0m\n")
+	}
+	return bw.Flush()
+}
+
+// 前景 (38) か背景 (48) の色を c にするエスケープシーケンス
+func (t *terminalPreview) sgr(layer int, c color.NRGBA) string {
+	if t.truecolor {
+		return fmt.Sprintf("\x1b[%d;2;%d;%d;%dm", layer, c.R, c.G, c.B)
+	}
+	return fmt.Sprintf("\x1b[%d;5;%dm", layer, ansi256(c))
+}
+
+// 256 色のうち c に最も近い色の番号
+// 6×6×6 の色の立方体 (16〜231) と 24 段階の灰色 (232〜255) から、RGB の距離で選ぶ
+func ansi256(c color.NRGBA) int {
+	levels := [6]int{0, 95, 135, 175, 215, 255}
+	nearestLevel := func(v uint8) int {
+		best := 0
+		for i, l := range levels {
+			if abs(int(v)-l) < abs(int(v)-levels[best]) {
+				best = i
+			}
+		}
+		return best
+	}
+	dist := func(r, g, b int) int {
+		dr, dg, db := int(c.R)-r, int(c.G)-g, int(c.B)-b
+		return dr*dr + dg*dg + db*db
+	}
+	r, g, b := nearestLevel(c.R), nearestLevel(c.G), nearestLevel(c.B)
+	cube := 16 + 36*r + 6*g + b
+	cubeDist := dist(levels[r], levels[g], levels[b])
+
+	// 灰色は 8、18、…、238
+	avg := (int(c.R) + int(c.G) + int(c.B)) / 3
+	gray := min(23, max(0, (avg-8+5)/10))
+	v := 8 + 10*gray
+	if dist(v, v, v) < cubeDist {
+		return 232 + gray
+	}
+	return cube
+}
+
+// Close で何もしない io.WriteCloser (標準出力を閉じないために使う)
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+func abs(v int) int {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
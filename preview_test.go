@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/yashikota/go-streaming-image-mosaic/mosaic"
+)
+
+// 3×3 のタイルの格子 (ゼロ値は書き換えなかったタイル)
+var previewFixture = [][]color.NRGBA{
+	{{255, 0, 0, 255}, {0, 255, 0, 255}, {}},
+	{{0, 0, 255, 255}, {255, 255, 255, 255}, {0, 0, 0, 255}},
+	{{128, 128, 128, 255}, {}, {255, 255, 0, 255}},
+}
+
+// env の環境変数で previewFixture を描いた文字列
+func renderPreviewFixture(t *testing.T, env map[string]string) string {
+	t.Helper()
+	var buf bytes.Buffer
+	p := newTerminalPreview(&buf, func(key string) string { return env[key] })
+	observe := p.collect(3, 3)
+	for y, row := range previewFixture {
+		for x, c := range row {
+			observe(mosaic.TileInfo{X: x, Y: y, Color: c, Skipped: c == color.NRGBA{}})
+		}
+	}
+	if err := p.flush(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.String()
+}
+
+func TestTerminalPreviewSnapshot(t *testing.T) {
+	tests := []struct {
+		name string
+		env  map[string]string
+		want string
+	}{
+		{"truecolor", map[string]string{"COLORTERM": "truecolor"},
+			"\x1b[38;2;255;0;0m\x1b[48;2;0;0;255m▀\x1b[38;2;0;255;0m\x1b[48;2;255;255;255m▀\x1b[38;2;0;0;0m\x1b[49m▄\x1b[0m\n" +
+				"\x1b[38;2;128;128;128m\x1b[49m▀\x1b[0m \x1b[38;2;255;255;0m\x1b[49m▀\x1b[0m\n"},
+		{"24bit", map[string]string{"COLORTERM": "24bit"},
+			"\x1b[38;2;255;0;0m\x1b[48;2;0;0;255m▀\x1b[38;2;0;255;0m\x1b[48;2;255;255;255m▀\x1b[38;2;0;0;0m\x1b[49m▄\x1b[0m\n" +
+				"\x1b[38;2;128;128;128m\x1b[49m▀\x1b[0m \x1b[38;2;255;255;0m\x1b[49m▀\x1b[0m\n"},
+		{"256 colors", nil,
+			"\x1b[38;5;196m\x1b[48;5;21m▀\x1b[38;5;46m\x1b[48;5;231m▀\x1b[38;5;16m\x1b[49m▄\x1b[0m\n" +
+				"\x1b[38;5;244m\x1b[49m▀\x1b[0m \x1b[38;5;226m\x1b[49m▀\x1b[0m\n"},
+		// 2 文字の幅に収めるため、2×2 のタイルをまとめて平均する
+		{"downsampled", map[string]string{"COLORTERM": "truecolor", "COLUMNS": "2"},
+			"\x1b[38;2;127;127;127m\x1b[48;2;128;128;128m▀\x1b[38;2;0;0;0m\x1b[48;2;255;255;0m▀\x1b[0m\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := renderPreviewFixture(t, tt.env); got != tt.want {
+				t.Errorf("preview = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTerminalPreviewColumns(t *testing.T) {
+	for _, tt := range []struct {
+		columns string
+		want    int
+	}{
+		{"120", 120},
+		{"", defaultPreviewColumns}, // bytes.Buffer は端末ではない
+		{"0", defaultPreviewColumns},
+		{"wide", defaultPreviewColumns},
+	} {
+		p := newTerminalPreview(&bytes.Buffer{}, func(key string) string {
+			if key == "COLUMNS" {
+				return tt.columns
+			}
+			return ""
+		})
+		if p.columns != tt.want {
+			t.Errorf("COLUMNS=%q: %d columns, want %d", tt.columns, p.columns, tt.want)
+		}
+	}
+}
+
+func TestANSI256(t *testing.T) {
+	for _, tt := range []struct {
+		c    color.NRGBA
+		want int
+	}{
+		{color.NRGBA{0, 0, 0, 255}, 16},
+		{color.NRGBA{255, 255, 255, 255}, 231},
+		{color.NRGBA{255, 0, 0, 255}, 196},
+		{color.NRGBA{0, 255, 0, 255}, 46},
+		{color.NRGBA{0, 0, 255, 255}, 21},
+		{color.NRGBA{95, 135, 175, 255}, 16 + 36*1 + 6*2 + 3},
+		// 立方体より灰色の段階のほうが近い
+		{color.NRGBA{128, 128, 128, 255}, 244},
+		{color.NRGBA{8, 8, 8, 255}, 232},
+		{color.NRGBA{238, 238, 238, 255}, 255},
+	} {
+		if got := ansi256(tt.c); got != tt.want {
+			t.Errorf("ansi256(%v) = %d, want %d", tt.c, got, tt.want)
+		}
+	}
+}
+
+// -out - の場合はプレビューを標準エラー出力に書き、標準出力の画像を壊さない
+func TestApplyPreview(t *testing.T) {
+	t.Setenv("COLORTERM", "truecolor")
+	t.Setenv("COLUMNS", "80")
+	dir := t.TempDir()
+	in := filepath.Join(dir, "in.png")
+	writeTestImage(t, in, testImage(32, 16))
+
+	res := runCLI(t, "apply", "-in", in, "-out", "-", "-format", "png", "-tile", "8", "-quiet", "-preview")
+	if res.code != exitOK {
+		t.Fatalf("exit code = %d (stderr: %s)", res.code, res.stderr)
+	}
+	img, err := png.Decode(strings.NewReader(res.stdout))
+	if err != nil {
+		t.Fatalf("stdout is not a PNG: %v", err)
+	}
+	if img.Bounds() != image.Rect(0, 0, 32, 16) {
+		t.Errorf("bounds %v", img.Bounds())
+	}
+	// 4×2 のタイルは 1 行に 4 文字
+	if lines := strings.Split(strings.TrimSuffix(res.stderr, "\n"), "\n"); len(lines) != 1 || strings.Count(lines[0], upperHalfBlock) != 4 {
+		t.Errorf("preview on stderr = %q", res.stderr)
+	}
+
+	out := filepath.Join(dir, "out.png")
+	res = runCLI(t, "apply", "-in", in, "-out", out, "-tile", "8", "-quiet", "-preview")
+	if res.code != exitOK || strings.Count(res.stdout, upperHalfBlock) != 4 || res.stderr != "" {
+		t.Errorf("exit code = %d, stdout %q, stderr %q", res.code, res.stdout, res.stderr)
+	}
+}
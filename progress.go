@@ -0,0 +1,239 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/yashikota/go-streaming-image-mosaic/mosaic"
+)
+
+const (
+	progressWidth       = 30                     // バーの幅 (文字数)
+	progressTTYInterval = 100 * time.Millisecond // 端末での再描画の最短間隔
+	progressLogInterval = 5 * time.Second        // 端末以外でのログ出力の間隔
+	progressRateWindow  = 5 * time.Second        // 残り時間の計算に使う直近の期間
+)
+
+// 処理の進捗を表示する
+// 出力先が端末の場合は 1 行のバーを上書きし、それ以外の場合は一定間隔でログに出力する
+type progressBar struct {
+	mu       sync.Mutex
+	w        io.Writer
+	tty      bool
+	start    time.Time
+	lastDraw time.Time
+	drawn    bool
+	samples  []progressSample // 直近の進捗 (残り時間の計算用)
+	now      func() time.Time // 現在時刻を求める関数 (テストでは差し替える)
+}
+
+// ある時刻での全体の進捗 (0〜1)
+type progressSample struct {
+	at   time.Time
+	done float64
+}
+
+// 進捗の表示を生成
+// quiet の場合は何も表示しないため nil を返却 (nil の progressBar のメソッドは何もしない)
+func newProgressBar(stderr io.Writer, quiet bool) *progressBar {
+	if quiet {
+		return nil
+	}
+	return newProgressBarAt(stderr, isTerminal(stderr), time.Now)
+}
+
+// 出力先が端末かどうかを tty とし、現在時刻を now で求める進捗の表示を生成
+func newProgressBarAt(stderr io.Writer, tty bool, now func() time.Time) *progressBar {
+	b := &progressBar{
+		w:     stderr,
+		tty:   tty,
+		start: now(),
+		now:   now,
+	}
+	if !b.tty {
+		// 短い処理ではログを出さないよう、最初の出力も間隔を空ける
+		b.lastDraw = b.start
+	}
+	return b
+}
+
+// ログの出力先を返却
+// 端末にバーを表示する場合は、ログを書く前にバーを消す
+func (b *progressBar) logOutput(stderr io.Writer) io.Writer {
+	if b == nil || !b.tty {
+		return stderr
+	}
+	return b
+}
+
+func (b *progressBar) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.drawn {
+		fmt.Fprint(b.w, "\r\x1b[K")
+		b.drawn = false
+	}
+	return b.w.Write(p)
+}
+
+// 出力先が端末かどうか
+func isTerminal(w io.Writer) bool {
+	f, ok := w.(*os.File)
+	if !ok {
+		return false
+	}
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// files 個中 file 番目 (1 始まり) のファイルの進捗を受け取るコールバックを返却
+// 端末以外では logger に出力する
+func (b *progressBar) callback(logger *slog.Logger, name string, file, files int) mosaic.ProgressFunc {
+	if b == nil {
+		return nil
+	}
+	return func(p mosaic.Progress) {
+		done := (float64(file-1) + p.Percent()/100) / float64(files)
+		b.update(logger, name, file, files, p, done)
+	}
+}
+
+// 進捗を記録し、前回の表示から十分に時間が経っていれば表示する
+func (b *progressBar) update(logger *slog.Logger, name string, file, files int, p mosaic.Progress, done float64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := b.now()
+	b.samples = append(b.samples, progressSample{at: now, done: done})
+	for len(b.samples) > 2 && now.Sub(b.samples[0].at) > progressRateWindow {
+		b.samples = b.samples[1:]
+	}
+
+	interval := progressLogInterval
+	if b.tty {
+		interval = progressTTYInterval
+	}
+	finished := file == files && p.BandsDone == p.BandsTotal
+	if now.Sub(b.lastDraw) < interval && !(finished && b.tty) {
+		return
+	}
+	b.lastDraw = now
+
+	elapsed := now.Sub(b.start)
+	eta, etaKnown := b.eta(now, done)
+	if !b.tty {
+		attrs := []any{"input", name, "percent", fmt.Sprintf("%.1f", done*100),
+			"bands_done", p.BandsDone, "bands_total", p.BandsTotal,
+			"elapsed", elapsed.Round(time.Second)}
+		if files > 1 {
+			attrs = append(attrs, "file", file, "files", files)
+		}
+		if etaKnown {
+			attrs = append(attrs, "eta", eta.Round(time.Second))
+		}
+		logger.Info("progress", attrs...)
+		return
+	}
+
+	line := progressLine(done)
+	if files > 1 {
+		line += fmt.Sprintf("  file %d/%d", file, files)
+	}
+	line += fmt.Sprintf("  bands %d/%d  elapsed %s", p.BandsDone, p.BandsTotal, formatClock(elapsed))
+	if etaKnown {
+		line += "  ETA " + formatClock(eta)
+	}
+	// 行頭に戻って上書きし、行末の残りを消す
+	fmt.Fprintf(b.w, "\r%s\x1b[K", line)
+	b.drawn = true
+}
+
+// total 枚中 done 枚のフレームを処理した進捗を記録し、前回の表示から十分に時間が経っていれば表示する
+// 処理の速さは 1 秒あたりのフレーム数で表す
+func (b *progressBar) frames(logger *slog.Logger, done, total int) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := b.now()
+	fraction := float64(done) / float64(total)
+	b.samples = append(b.samples, progressSample{at: now, done: fraction})
+	for len(b.samples) > 2 && now.Sub(b.samples[0].at) > progressRateWindow {
+		b.samples = b.samples[1:]
+	}
+
+	interval := progressLogInterval
+	if b.tty {
+		interval = progressTTYInterval
+	}
+	if now.Sub(b.lastDraw) < interval && !(done == total && b.tty) {
+		return
+	}
+	b.lastDraw = now
+
+	elapsed := now.Sub(b.start)
+	fps := float64(done) / elapsed.Seconds()
+	eta, etaKnown := b.eta(now, fraction)
+	if !b.tty {
+		attrs := []any{"frames_done", done, "frames_total", total, "fps", fmt.Sprintf("%.1f", fps),
+			"elapsed", elapsed.Round(time.Second)}
+		if etaKnown {
+			attrs = append(attrs, "eta", eta.Round(time.Second))
+		}
+		logger.Info("progress", attrs...)
+		return
+	}
+
+	line := progressLine(fraction) + fmt.Sprintf("  frames %d/%d  %.1f fps  elapsed %s", done, total, fps, formatClock(elapsed))
+	if etaKnown {
+		line += "  ETA " + formatClock(eta)
+	}
+	fmt.Fprintf(b.w, "\r%s\x1b[K", line)
+	b.drawn = true
+}
+
+// 進んだ割合 done (0〜1) のバーと百分率
+func progressLine(done float64) string {
+	filled := int(done * progressWidth)
+	bar := strings.Repeat("=", filled) + strings.Repeat(" ", progressWidth-filled)
+	return fmt.Sprintf("[%s] %5.1f%%", bar, done*100)
+}
+
+// 直近の処理速度から残り時間を推定
+func (b *progressBar) eta(now time.Time, done float64) (time.Duration, bool) {
+	first := b.samples[0]
+	span := now.Sub(first.at)
+	progressed := done - first.done
+	if span <= 0 || progressed <= 0 {
+		return 0, false
+	}
+	return time.Duration(float64(span) * (1 - done) / progressed), true
+}
+
+// 端末に表示したバーの後で改行する
+func (b *progressBar) finish() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.drawn {
+		return
+	}
+	fmt.Fprintln(b.w)
+	b.drawn = false
+}
+
+// 経過時間を h:mm:ss または m:ss で表す
+func formatClock(d time.Duration) string {
+	s := int(d.Round(time.Second) / time.Second)
+	if s >= 3600 {
+		return fmt.Sprintf("%d:%02d:%02d", s/3600, s/60%60, s%60)
+	}
+	return fmt.Sprintf("%d:%02d", s/60, s%60)
+}
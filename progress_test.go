@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/yashikota/go-streaming-image-mosaic/mosaic"
+)
+
+// 呼び出し側が進める時計
+type fakeClock struct{ t time.Time }
+
+func newFakeClock() *fakeClock { return &fakeClock{t: time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)} }
+
+func (c *fakeClock) now() time.Time          { return c.t }
+func (c *fakeClock) advance(d time.Duration) { c.t = c.t.Add(d) }
+
+// 端末に描いたバー (行頭に戻って上書きした各行)
+func drawnLines(out string) []string {
+	var lines []string
+	for _, s := range strings.Split(out, "\r")[1:] {
+		lines = append(lines, strings.TrimSuffix(strings.TrimSuffix(s, "\n"), "\x1b[K"))
+	}
+	return lines
+}
+
+// 端末では 100ms (1 秒に 10 回) より短い間隔の更新は描かず、最後のバンドは間隔によらず描く
+func TestProgressBarThrottle(t *testing.T) {
+	var out bytes.Buffer
+	clock := newFakeClock()
+	b := newProgressBarAt(&out, true, clock.now)
+	progress := b.callback(discardLogger, "in.png", 1, 1)
+	// 2 秒かけて 10ms ごとに 200 バンドを処理する
+	for i := 1; i <= 200; i++ {
+		clock.advance(10 * time.Millisecond)
+		progress(mosaic.Progress{BandsDone: i, BandsTotal: 200})
+	}
+	b.finish()
+
+	lines := drawnLines(out.String())
+	// 最初の更新、その後 100ms ごとの 19 回と最後のバンド
+	if len(lines) != 21 {
+		t.Fatalf("drawn %d times in 2s, want 21: %q", len(lines), lines)
+	}
+	if want := "[" + strings.Repeat("=", 15) + strings.Repeat(" ", 15) + "]  50.5%  bands 101/200  elapsed 0:01  ETA 0:01"; lines[10] != want {
+		t.Errorf("line 10 = %q, want %q", lines[10], want)
+	}
+	if want := "[" + strings.Repeat("=", 30) + "] 100.0%  bands 200/200  elapsed 0:02  ETA 0:00"; lines[20] != want {
+		t.Errorf("last line = %q, want %q", lines[20], want)
+	}
+	if !strings.HasSuffix(out.String(), "\n") {
+		t.Error("finish did not end the bar with a newline")
+	}
+}
+
+// 端末以外では、バーの代わりに 5 秒ごとに progress のログを出力する
+// 最初のログも開始から 5 秒後で、短い処理ではログを出さない
+func TestProgressBarLogFallback(t *testing.T) {
+	var out bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&out, &slog.HandlerOptions{
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if a.Key == slog.TimeKey {
+				return slog.Attr{}
+			}
+			return a
+		},
+	}))
+	clock := newFakeClock()
+	b := newProgressBarAt(&out, false, clock.now)
+	if w := b.logOutput(&out); w != io.Writer(&out) {
+		t.Error("log output is wrapped without a terminal")
+	}
+	progress := b.callback(logger, "in.png", 1, 1)
+	// 12 秒かけて 100ms ごとに 120 バンドを処理する
+	for i := 1; i <= 120; i++ {
+		clock.advance(100 * time.Millisecond)
+		progress(mosaic.Progress{BandsDone: i, BandsTotal: 120})
+	}
+	b.finish()
+
+	want := `level=INFO msg=progress input=in.png percent=41.7 bands_done=50 bands_total=120 elapsed=5s eta=7s
+level=INFO msg=progress input=in.png percent=83.3 bands_done=100 bands_total=120 elapsed=10s eta=2s
+`
+	if out.String() != want {
+		t.Errorf("output:\n%s\nwant:\n%s", out.String(), want)
+	}
+	if strings.ContainsAny(out.String(), "\r\x1b") {
+		t.Error("control characters written without a terminal")
+	}
+}
+
+// 複数のファイルでは、全体の進捗のバーにファイルの番号と、処理中のファイルのバンドの数を並べる
+func TestProgressBarBatch(t *testing.T) {
+	var out bytes.Buffer
+	clock := newFakeClock()
+	b := newProgressBarAt(&out, true, clock.now)
+	files := []batchFile{{in: "a.png"}, {in: "b.png"}, {in: "c.png"}, {in: "d.png"}}
+	report, err := processFiles(discardLogger, b, files, false, func(_ batchFile, progress mosaic.ProgressFunc) error {
+		for i := 1; i <= 4; i++ {
+			clock.advance(time.Second)
+			progress(mosaic.Progress{BandsDone: i, BandsTotal: 4})
+		}
+		return nil
+	})
+	if err != nil || report.Failed != 0 {
+		t.Fatalf("processFiles: %v, %d failed", err, report.Failed)
+	}
+	b.finish()
+
+	lines := drawnLines(out.String())
+	if len(lines) != 16 {
+		t.Fatalf("drawn %d times, want 16: %q", len(lines), lines)
+	}
+	for i, line := range lines {
+		file, band := i/4+1, i%4+1
+		done := float64(i+1) / 16
+		filled := int(done * progressWidth)
+		want := fmt.Sprintf("[%s%s] %5.1f%%  file %d/4  bands %d/4  elapsed 0:%02d",
+			strings.Repeat("=", filled), strings.Repeat(" ", progressWidth-filled), done*100, file, band, i+1)
+		if !strings.HasPrefix(line, want) {
+			t.Errorf("line %d = %q, want prefix %q", i, line, want)
+		}
+	}
+}
+
+// -quiet では進捗を表示せず、nil のバーのメソッドは何もしない
+func TestProgressBarQuiet(t *testing.T) {
+	var out bytes.Buffer
+	b := newProgressBar(&out, true)
+	if b != nil {
+		t.Fatal("progress bar created with quiet")
+	}
+	if progress := b.callback(discardLogger, "in.png", 1, 1); progress != nil {
+		t.Error("callback is not nil")
+	}
+	if w := b.logOutput(&out); w != io.Writer(&out) {
+		t.Error("log output is wrapped")
+	}
+	b.frames(discardLogger, 1, 2)
+	b.finish()
+	if out.Len() != 0 {
+		t.Errorf("wrote %q", out.String())
+	}
+}
+
+// 端末にバーを描いた後のログは、バーを消してから書く
+func TestProgressBarClearsBeforeLog(t *testing.T) {
+	var out bytes.Buffer
+	clock := newFakeClock()
+	b := newProgressBarAt(&out, true, clock.now)
+	b.callback(discardLogger, "in.png", 1, 1)(mosaic.Progress{BandsDone: 1, BandsTotal: 2})
+	fmt.Fprintln(b.logOutput(&out), "level=WARN msg=warning")
+	b.finish()
+
+	want := "\r[" + strings.Repeat("=", 15) + strings.Repeat(" ", 15) + "]  50.0%  bands 1/2  elapsed 0:00\x1b[K" +
+		"\r\x1b[Klevel=WARN msg=warning\n"
+	if out.String() != want {
+		t.Errorf("output = %q, want %q", out.String(), want)
+	}
+}
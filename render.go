@@ -0,0 +1,425 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"math"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/yashikota/go-streaming-image-mosaic/mosaic"
+)
+
+// render のフラグ
+type renderFlags struct {
+	*commonFlags
+	tiles     *string
+	out       *string
+	allowGaps *bool
+	gapColor  *string
+}
+
+func newRenderFlags(stderr io.Writer) *renderFlags {
+	c := newCommonFlags("render", "[flags] -tiles file -out path", stderr)
+	return &renderFlags{
+		commonFlags: c,
+		tiles:       c.fs.String("tiles", "", "タイルの色のファイル (-export-tiles と同じ形式の JSON、NDJSON または CSV)"),
+		out:         c.fs.String("out", "", "出力画像のパス (拡張子で形式を決め、登録されていない拡張子は JPEG)"),
+		allowGaps:   c.fs.Bool("allow-gaps", false, "格子に欠けているタイルを -gap-color で塗りつぶす"),
+		gapColor:    c.fs.String("gap-color", "#000000", "-allow-gaps で欠けているタイルを塗りつぶす色"),
+	}
+}
+
+// タイルの色のファイルから画像を描画する
+// -tile を指定した場合は格子の位置に tile×tile のタイルを並べ、省略した場合はファイルのタイルの範囲をそのまま使う
+func runRender(args []string, stdout, stderr io.Writer) error {
+	f := newRenderFlags(stderr)
+	if err := f.parse(args); err != nil {
+		return err
+	}
+	if *f.tiles == "" || *f.out == "" {
+		return &usageError{errors.New("both -tiles and -out are required")}
+	}
+	gap, err := mosaic.ParseHexColor(*f.gapColor)
+	if err != nil {
+		return &usageError{err}
+	}
+	useGrid := false
+	f.fs.Visit(func(fl *flag.Flag) {
+		useGrid = useGrid || fl.Name == "tile"
+	})
+	if useGrid && *f.tile <= 0 {
+		return &usageError{errInvalidTile}
+	}
+
+	logger, err := f.logger(stderr)
+	if err != nil {
+		return err
+	}
+	tiles, err := readTileFile(*f.tiles)
+	if err != nil {
+		return &inputError{path: *f.tiles, err: err}
+	}
+	size := 0
+	if useGrid {
+		size = *f.tile
+	}
+	bounds, infos, err := layoutTiles(tiles, size, *f.allowGaps)
+	if err != nil {
+		return &inputError{path: *f.tiles, err: err}
+	}
+	// 描画する画像を確保する前に、画像の大きさの上限を確かめる
+	if err := f.limits().checkConfig(image.Config{Width: bounds.Dx(), Height: bounds.Dy()}); err != nil {
+		return &inputError{path: *f.tiles, err: err}
+	}
+
+	img := mosaic.RenderTiles(bounds, infos, gap, renderer(f.settings))
+	if err := writeImage(*f.out, img, mosaic.EncodeOptions{}); err != nil {
+		return &outputError{path: *f.out, err: err}
+	}
+	logger.Info("render finished", "tiles", len(infos), "width", bounds.Dx(), "height", bounds.Dy(), "out", *f.out)
+	return nil
+}
+
+// 読み込んだタイル
+type importedTile struct {
+	gridX, gridY int
+	rect         image.Rectangle // hasRect が false の場合はゼロ値
+	hasRect      bool
+	color        color.NRGBA
+}
+
+// 読み込むタイルの情報
+// exportedTile と同じ名前で、grid_x と grid_y、色 (hex または r, g, b と省略できる a) は必須
+// x, y, width, height は -tile を省略して描画する場合に必要
+type tileRecord struct {
+	GridX  *int   `json:"grid_x"`
+	GridY  *int   `json:"grid_y"`
+	X      *int   `json:"x"`
+	Y      *int   `json:"y"`
+	Width  *int   `json:"width"`
+	Height *int   `json:"height"`
+	Hex    string `json:"hex"`
+	R      *int   `json:"r"`
+	G      *int   `json:"g"`
+	B      *int   `json:"b"`
+	A      *int   `json:"a"`
+}
+
+// タイルの色のファイルを読み込む
+// 拡張子が .csv の場合は CSV、それ以外は JSON の配列または NDJSON として読む
+func readTileFile(path string) ([]importedTile, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	var records []tileRecord
+	if exportFormat("", path) == exportCSV {
+		records, err = readTileCSV(file)
+	} else {
+		records, err = readTileJSON(file)
+	}
+	if err != nil {
+		return nil, err
+	}
+	tiles := make([]importedTile, len(records))
+	for i, r := range records {
+		if tiles[i], err = r.tile(); err != nil {
+			return nil, fmt.Errorf("tile %d: %w", i+1, err)
+		}
+	}
+	return tiles, nil
+}
+
+// JSON の配列、または JSON のオブジェクトを並べたもの (NDJSON) を読み込む
+func readTileJSON(r io.Reader) ([]tileRecord, error) {
+	br := bufio.NewReader(r)
+	first, err := peekNonSpace(br)
+	if err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(br)
+	var records []tileRecord
+	if first != '[' {
+		for {
+			var rec tileRecord
+			if err := dec.Decode(&rec); err == io.EOF {
+				return records, nil
+			} else if err != nil {
+				return nil, err
+			}
+			records = append(records, rec)
+		}
+	}
+	if err := dec.Decode(&records); err != nil {
+		return nil, err
+	}
+	return records, nil
+}
+
+// 空白を読み飛ばし、次のバイトを読まずに返却
+func peekNonSpace(br *bufio.Reader) (byte, error) {
+	for {
+		b, err := br.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		if !strings.ContainsRune(" \t\r\n", rune(b)) {
+			return b, br.UnreadByte()
+		}
+	}
+}
+
+// 見出しの行に従って CSV を読み込む
+func readTileCSV(r io.Reader) ([]tileRecord, error) {
+	cr := csv.NewReader(r)
+	header, err := cr.Read()
+	if err != nil {
+		return nil, err
+	}
+	columns := map[string]int{}
+	for i, name := range header {
+		columns[strings.TrimSpace(name)] = i
+	}
+	var records []tileRecord
+	for {
+		row, err := cr.Read()
+		if err == io.EOF {
+			return records, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		var rec tileRecord
+		field := func(name string) (string, bool) {
+			i, ok := columns[name]
+			if !ok || strings.TrimSpace(row[i]) == "" {
+				return "", false
+			}
+			return strings.TrimSpace(row[i]), true
+		}
+		for name, dst := range map[string]**int{
+			"grid_x": &rec.GridX, "grid_y": &rec.GridY,
+			"x": &rec.X, "y": &rec.Y, "width": &rec.Width, "height": &rec.Height,
+			"r": &rec.R, "g": &rec.G, "b": &rec.B, "a": &rec.A,
+		} {
+			s, ok := field(name)
+			if !ok {
+				continue
+			}
+			v, err := strconv.Atoi(s)
+			if err != nil {
+				line, _ := cr.FieldPos(columns[name])
+				return nil, fmt.Errorf("line %d: invalid %s %q", line, name, s)
+			}
+			*dst = &v
+		}
+		rec.Hex, _ = field("hex")
+		records = append(records, rec)
+	}
+}
+
+// 読み込んだ値を検証してタイルにする
+func (r tileRecord) tile() (importedTile, error) {
+	var t importedTile
+	if r.GridX == nil || r.GridY == nil {
+		return t, errors.New("grid_x and grid_y are required")
+	}
+	if *r.GridX < 0 || *r.GridY < 0 {
+		return t, fmt.Errorf("negative grid position (%d, %d)", *r.GridX, *r.GridY)
+	}
+	t.gridX, t.gridY = *r.GridX, *r.GridY
+
+	switch {
+	case r.Hex != "":
+		c, err := mosaic.ParseHexColor(r.Hex)
+		if err != nil {
+			return t, err
+		}
+		t.color = c
+	case r.R != nil && r.G != nil && r.B != nil:
+		t.color = color.NRGBA{A: 255}
+		for _, ch := range []struct {
+			v   int
+			dst *uint8
+		}{{*r.R, &t.color.R}, {*r.G, &t.color.G}, {*r.B, &t.color.B}} {
+			if ch.v < 0 || ch.v > 255 {
+				return t, fmt.Errorf("color component %d is out of range", ch.v)
+			}
+			*ch.dst = uint8(ch.v)
+		}
+	default:
+		return t, errors.New("hex or r, g and b are required")
+	}
+	if r.A != nil {
+		if *r.A < 0 || *r.A > 255 {
+			return t, fmt.Errorf("alpha %d is out of range", *r.A)
+		}
+		t.color.A = uint8(*r.A)
+	}
+
+	if r.X != nil && r.Y != nil && r.Width != nil && r.Height != nil {
+		if *r.Width <= 0 || *r.Height <= 0 {
+			return t, fmt.Errorf("tile size %dx%d must be positive", *r.Width, *r.Height)
+		}
+		t.rect = image.Rect(*r.X, *r.Y, *r.X+*r.Width, *r.Y+*r.Height)
+		t.hasRect = true
+	}
+	return t, nil
+}
+
+// 欠けているタイルを示す際に並べる数の上限
+const maxMissingListed = 10
+
+// タイルを並べる範囲を決める
+// size が正の場合は格子の位置から size×size のタイルを並べ、0 の場合はタイルの範囲を使う
+// size が正でも、ファイルの範囲が書き出したタイルより小さい列と行 (画像の端のタイル) は、その割合で幅と高さを縮める
+// 格子の列と行の数は grid_x と grid_y の最大値から決め、allowGaps が false の場合は欠けているタイルをエラーにする
+// grid_x と grid_y は信頼できない値なので、格子の大きさに比例するメモリは確保しない
+func layoutTiles(tiles []importedTile, size int, allowGaps bool) (image.Rectangle, []mosaic.TileInfo, error) {
+	if len(tiles) == 0 {
+		return image.Rectangle{}, nil, errors.New("no tiles")
+	}
+	columns, rows := 0, 0
+	seen := make(map[image.Point]bool, len(tiles))
+	for _, t := range tiles {
+		if size > 0 && (t.gridX >= math.MaxInt32/size || t.gridY >= math.MaxInt32/size) {
+			return image.Rectangle{}, nil, fmt.Errorf("grid position (%d, %d) is too large for tile size %d", t.gridX, t.gridY, size)
+		}
+		p := image.Pt(t.gridX, t.gridY)
+		if seen[p] {
+			return image.Rectangle{}, nil, fmt.Errorf("duplicate tile (%d, %d)", t.gridX, t.gridY)
+		}
+		seen[p] = true
+		columns = max(columns, t.gridX+1)
+		rows = max(rows, t.gridY+1)
+	}
+
+	var bounds image.Rectangle
+	infos := make([]mosaic.TileInfo, len(tiles))
+	if size > 0 {
+		xs, ys := newGridAxes(tiles, size)
+		for i, t := range tiles {
+			rect := image.Rect(xs.start(t.gridX), ys.start(t.gridY), xs.start(t.gridX+1), ys.start(t.gridY+1))
+			infos[i] = mosaic.TileInfo{X: t.gridX, Y: t.gridY, Rect: rect, Color: t.color}
+		}
+		bounds = image.Rect(0, 0, xs.start(columns), ys.start(rows))
+	} else {
+		for i, t := range tiles {
+			if !t.hasRect {
+				return image.Rectangle{}, nil, fmt.Errorf("tile (%d, %d) has no x, y, width and height (specify -tile)", t.gridX, t.gridY)
+			}
+			bounds = bounds.Union(t.rect)
+			infos[i] = mosaic.TileInfo{X: t.gridX, Y: t.gridY, Rect: t.rect, Color: t.color}
+		}
+	}
+
+	if total := int64(columns) * int64(rows); !allowGaps && total > int64(len(seen)) {
+		// 欠けているタイルは、先頭から len(seen)+maxMissingListed 個までのセルに必ず含まれる
+		var missing []string
+		for cell := int64(0); cell < total && len(missing) < maxMissingListed; cell++ {
+			if p := image.Pt(int(cell%int64(columns)), int(cell/int64(columns))); !seen[p] {
+				missing = append(missing, fmt.Sprintf("(%d, %d)", p.X, p.Y))
+			}
+		}
+		count := total - int64(len(seen))
+		list := strings.Join(missing, ", ")
+		if count > int64(len(missing)) {
+			list += fmt.Sprintf(" and %d more", count-int64(len(missing)))
+		}
+		return image.Rectangle{}, nil, fmt.Errorf("%d of %d tiles are missing: %s (use -allow-gaps to fill them)", count, total, list)
+	}
+	return bounds, infos, nil
+}
+
+// -tile を指定して並べる格子の 1 つの軸 (列または行)
+// 大きさが size と異なる列 (行) だけを保持し、格子の大きさによらないメモリで位置を求める
+type gridAxis struct {
+	size   int
+	cells  []int // 大きさが size と異なる列の番号 (昇順)
+	deltas []int // cells[i] までの列 (cells[i] を含む) の size との差の合計
+}
+
+// ファイルのタイルの範囲から、列と行の幅と高さを決める
+// 書き出したタイルの大きさ (範囲の幅と高さの最大値) より小さい列と行は、size をその割合で縮める
+func newGridAxes(tiles []importedTile, size int) (xs, ys gridAxis) {
+	var full image.Point
+	for _, t := range tiles {
+		if t.hasRect {
+			full.X = max(full.X, t.rect.Dx())
+			full.Y = max(full.Y, t.rect.Dy())
+		}
+	}
+	widths, heights := map[int]int{}, map[int]int{}
+	for _, t := range tiles {
+		if !t.hasRect {
+			continue
+		}
+		if w := t.rect.Dx(); w < full.X {
+			widths[t.gridX] = max(1, (w*size+full.X/2)/full.X)
+		}
+		if h := t.rect.Dy(); h < full.Y {
+			heights[t.gridY] = max(1, (h*size+full.Y/2)/full.Y)
+		}
+	}
+	return newGridAxis(size, widths), newGridAxis(size, heights)
+}
+
+func newGridAxis(size int, sizes map[int]int) gridAxis {
+	a := gridAxis{size: size}
+	for cell := range sizes {
+		a.cells = append(a.cells, cell)
+	}
+	slices.Sort(a.cells)
+	delta := 0
+	for _, cell := range a.cells {
+		delta += sizes[cell] - size
+		a.deltas = append(a.deltas, delta)
+	}
+	return a
+}
+
+// cell 番目の列の開始位置 (cell が列の数の場合は格子の終わり)
+func (a gridAxis) start(cell int) int {
+	pos := cell * a.size
+	if i := sort.SearchInts(a.cells, cell); i > 0 {
+		pos += a.deltas[i-1]
+	}
+	return pos
+}
+
+// 出力のパスの拡張子に応じたエンコーダー (登録されていない拡張子とタイルから書き出す形式は JPEG)
+func pathEncoder(path string) (mosaic.Encoder, error) {
+	if name, enc, err := mosaic.ResolveEncoder("", path); err == nil && !mosaic.IsTileFormat(name) {
+		return enc, nil
+	}
+	return mosaic.LookupEncoder("jpeg")
+}
+
+// 拡張子に応じた形式で画像を書き出す (登録されていない拡張子は JPEG)
+func writeImage(path string, img image.Image, opts mosaic.EncodeOptions) error {
+	enc, err := pathEncoder(path)
+	if err != nil {
+		return err
+	}
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	err = enc.Encode(file, img, opts)
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
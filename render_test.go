@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// apply で書き出したタイルの色から render で描き直すと、apply の出力と同じ画像になる
+// 画像の大きさがタイルの倍数でない場合も、端のタイルの範囲から元の大きさに戻す
+func TestRenderRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	in := filepath.Join(dir, "in.png")
+	writeTestImage(t, in, testImage(97, 61))
+
+	for _, tt := range []struct {
+		name   string
+		tiles  string
+		render []string // -tiles と -out に続けるフラグ
+		apply  []string // -in と -out に続けるフラグ
+	}{
+		{"json tile", "tiles.json", []string{"-tile", "10"}, nil},
+		{"json rects", "tiles.json", nil, nil},
+		{"ndjson", "tiles.ndjson", []string{"-tile", "10"}, nil},
+		{"csv", "tiles.csv", []string{"-tile", "10"}, nil},
+		{"grout", "tiles.json", []string{"-tile", "10", "-style", "grout"}, []string{"-style", "grout"}},
+		{"grid origin", "tiles.json", []string{"-tile", "10"}, []string{"-grid-origin", "3,4"}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			tiles := filepath.Join(dir, tt.tiles)
+			want := filepath.Join(dir, "want.png")
+			args := append([]string{"apply", "-in", in, "-out", want, "-tile", "10", "-quiet", "-export-tiles", tiles}, tt.apply...)
+			if res := runCLI(t, args...); res.code != exitOK {
+				t.Fatalf("apply: exit code = %d (stderr: %s)", res.code, res.stderr)
+			}
+			got := filepath.Join(dir, "got.png")
+			args = append([]string{"render", "-tiles", tiles, "-out", got, "-quiet"}, tt.render...)
+			if res := runCLI(t, args...); res.code != exitOK {
+				t.Fatalf("render: exit code = %d (stderr: %s)", res.code, res.stderr)
+			}
+			assertSameImage(t, readTestImage(t, got), readTestImage(t, want))
+		})
+	}
+}
+
+func TestRenderScalesEdgeTiles(t *testing.T) {
+	dir := t.TempDir()
+	tiles := filepath.Join(dir, "tiles.json")
+	// 10 px のタイルで書き出した 15×10 の画像 (右端の列は幅 5)
+	writeTestFile(t, tiles, []byte(`[
+{"grid_x":0,"grid_y":0,"x":0,"y":0,"width":10,"height":10,"hex":"#ff0000"},
+{"grid_x":1,"grid_y":0,"x":10,"y":0,"width":5,"height":10,"hex":"#00ff00"}]`))
+	out := filepath.Join(dir, "out.png")
+	if res := runCLI(t, "render", "-tiles", tiles, "-tile", "20", "-out", out, "-quiet"); res.code != exitOK {
+		t.Fatalf("exit code = %d (stderr: %s)", res.code, res.stderr)
+	}
+	img := readTestImage(t, out)
+	if img.Rect.Dx() != 30 || img.Rect.Dy() != 20 {
+		t.Fatalf("rendered %v, want 30x20", img.Rect)
+	}
+	if c := img.NRGBAAt(19, 0); c.R != 255 {
+		t.Errorf("pixel (19, 0) = %v, want red", c)
+	}
+	if c := img.NRGBAAt(20, 19); c.G != 255 {
+		t.Errorf("pixel (20, 19) = %v, want green", c)
+	}
+}
+
+func TestRenderGrid(t *testing.T) {
+	dir := t.TempDir()
+	tile := func(x, y int) string {
+		return fmt.Sprintf(`{"grid_x":%d,"grid_y":%d,"hex":"#808080"}`, x, y)
+	}
+	tests := []struct {
+		name   string
+		tiles  []string
+		args   []string
+		code   int
+		stderr string
+	}{
+		{"missing", []string{tile(0, 0), tile(1, 1)}, nil, exitInput, "2 of 4 tiles are missing: (1, 0), (0, 1)"},
+		{"gaps", []string{tile(0, 0), tile(1, 1)}, []string{"-allow-gaps"}, exitOK, ""},
+		{"duplicate", []string{tile(0, 0), tile(0, 0)}, nil, exitInput, "duplicate tile (0, 0)"},
+		// 格子の大きさに比例するメモリを確保せずに、欠けているタイルを数える
+		{"huge grid", []string{tile(0, 0), tile(1<<20, 1<<20)}, nil, exitInput, "tiles are missing: (1, 0), (2, 0)"},
+		{"too far", []string{tile(0, 0), tile(1<<40, 0)}, []string{"-allow-gaps"}, exitInput, "too large for tile size"},
+		{"over limit", []string{tile(0, 0), tile(10000, 0)}, []string{"-allow-gaps", "-max-pixels", "1MP"}, exitInput, "exceeds max-pixels"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tiles := filepath.Join(dir, "tiles.ndjson")
+			writeTestFile(t, tiles, []byte(strings.Join(tt.tiles, "\n")))
+			out := filepath.Join(dir, "out.png")
+			os.Remove(out)
+			args := append([]string{"render", "-tiles", tiles, "-tile", "10", "-out", out, "-quiet"}, tt.args...)
+			res := runCLI(t, args...)
+			if res.code != tt.code {
+				t.Fatalf("exit code = %d, want %d (stderr: %s)", res.code, tt.code, res.stderr)
+			}
+			if !strings.Contains(res.stderr, tt.stderr) {
+				t.Errorf("stderr %q does not contain %q", res.stderr, tt.stderr)
+			}
+			if _, err := os.Stat(out); (err == nil) != (tt.code == exitOK) {
+				t.Errorf("output exists = %v, want %v", err == nil, tt.code == exitOK)
+			}
+		})
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/draw"
+	"os"
+
+	"github.com/yashikota/go-streaming-image-mosaic/mosaic"
+)
+
+// 輝度で処理する画素を選ぶ条件
+type lumaSelection struct {
+	threshold float64 // 0〜1 の輝度のしきい値
+	above     bool    // true の場合はしきい値以上、false の場合は以下の画素を選ぶ
+	grow      int     // 選んだ範囲を広げる画素数
+}
+
+// src のうち条件を満たす画素を選ぶマスク
+func (s *lumaSelection) mask(src *image.NRGBA) *image.Alpha {
+	mask := mosaic.LumaMask(src, s.threshold, s.above)
+	if s.grow > 0 {
+		mask = mosaic.DilateMask(mask, s.grow)
+	}
+	return mask
+}
+
+// -select の式の mask(path) の画像を読み込む (パスごとに 1 回)
+func loadSelectMasks(expr string) (map[string]*image.Gray, error) {
+	e, err := mosaic.ParseSelectExpr(expr)
+	if err != nil {
+		return nil, &usageError{err}
+	}
+	masks := make(map[string]*image.Gray)
+	for _, t := range e.Terms("mask") {
+		if masks[t.Arg] != nil {
+			continue
+		}
+		m, err := loadStrengthMap(t.Arg)
+		if err != nil {
+			return nil, &inputError{path: t.Arg, err: err}
+		}
+		masks[t.Arg] = m
+	}
+	return masks, nil
+}
+
+// src の処理する画素の選び方 (-select と -select-luma の両方を指定した場合は両方で選んだ画素、どちらもない場合は nil)
+func (p pipeline) selection(src *image.NRGBA) (mosaic.Selection, error) {
+	var sels []mosaic.Selection
+	if p.selectExpr != nil {
+		s, err := p.selectExpr.Selection(func(t mosaic.SelectExpr) (mosaic.Selection, error) {
+			switch t.Term {
+			case "regions":
+				rects := make([]image.Rectangle, len(p.settings.Regions))
+				for i, r := range p.settings.Regions {
+					rects[i] = r.Rectangle()
+				}
+				return mosaic.Rects(rects...), nil
+			case "luma":
+				threshold, above, grow := t.Luma()
+				l := lumaSelection{threshold: threshold, above: above, grow: grow}
+				return mosaic.MaskSelection(l.mask(src)), nil
+			case "mask":
+				return selectMaskFor(p.selectMask[t.Arg], t.Arg, src)
+			}
+			return nil, fmt.Errorf("unsupported selection term %q", t.Term)
+		})
+		if err != nil {
+			return nil, err
+		}
+		sels = append(sels, s)
+	}
+	if p.selectLuma != nil {
+		sels = append(sels, mosaic.MaskSelection(p.selectLuma.mask(src)))
+	}
+	switch len(sels) {
+	case 0:
+		return nil, nil
+	case 1:
+		return sels[0], nil
+	}
+	return mosaic.Intersect(sels...), nil
+}
+
+// mask(path) の画像のうち、明るさが半分 (128) 以上の画素を選ぶ src と同じ範囲の Selection
+// 大きさが src と異なる場合はエラーにする
+func selectMaskFor(m *image.Gray, path string, src *image.NRGBA) (mosaic.Selection, error) {
+	if m.Rect.Size() != src.Rect.Size() {
+		return nil, &inputError{path: path, err: fmt.Errorf("select mask is %dx%d but the image is %dx%d",
+			m.Rect.Dx(), m.Rect.Dy(), src.Rect.Dx(), src.Rect.Dy())}
+	}
+	mask := image.NewAlpha(src.Rect)
+	size := src.Rect.Size()
+	for y := 0; y < size.Y; y++ {
+		row := m.Pix[y*m.Stride : y*m.Stride+size.X]
+		out := mask.Pix[y*mask.Stride : y*mask.Stride+size.X]
+		for x, v := range row {
+			if v >= 0x80 {
+				out[x] = 0xff
+			}
+		}
+	}
+	return mosaic.MaskSelection(mask), nil
+}
+
+// -strength-map の画像を読み込み、グレースケールにする
+// カラーの画像は輝度を使い、透明度は無視する
+func loadStrengthMap(path string) (*image.Gray, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	img, _, err := mosaic.Decode(file)
+	if err != nil {
+		return nil, err
+	}
+	if gray, ok := img.(*image.Gray); ok {
+		return gray, nil
+	}
+	gray := image.NewGray(img.Bounds())
+	draw.Draw(gray, gray.Rect, img, img.Bounds().Min, draw.Src)
+	return gray, nil
+}
+
+// src と同じ範囲に合わせた強さのマップ
+// 大きさが src と異なる場合はエラーにする
+func strengthMapFor(m *image.Gray, path string, src *image.NRGBA) (*image.Gray, error) {
+	if m.Rect.Size() != src.Rect.Size() {
+		return nil, &inputError{path: path, err: fmt.Errorf("strength map is %dx%d but the image is %dx%d",
+			m.Rect.Dx(), m.Rect.Dy(), src.Rect.Dx(), src.Rect.Dy())}
+	}
+	shifted := *m
+	shifted.Rect = src.Rect
+	return &shifted, nil
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"path/filepath"
+	"testing"
+
+	"github.com/yashikota/go-streaming-image-mosaic/mosaic"
+)
+
+// 暗い背景に明るい矩形がある画像
+func brightRectImage(w, h int, bright image.Rectangle) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			c := color.NRGBA{uint8(x % 60), uint8(y % 60), 30, 255}
+			if image.Pt(x, y).In(bright) {
+				c = color.NRGBA{uint8(240 + x%16), 250, uint8(240 + y%16), 255}
+			}
+			img.SetNRGBA(x, y, c)
+		}
+	}
+	return img
+}
+
+func TestApplySelectLuma(t *testing.T) {
+	dir := t.TempDir()
+	in := filepath.Join(dir, "in.png")
+	bright := image.Rect(16, 16, 48, 40)
+	src := brightRectImage(64, 64, bright)
+	writeTestImage(t, in, src)
+
+	for _, grow := range []int{0, 3} {
+		out := filepath.Join(dir, "out.png")
+		res := runCLI(t, "apply", "-in", in, "-out", out, "-tile", "8", "-quiet",
+			"-select-luma", ">=0.9", "-select-grow", fmt.Sprint(grow))
+		if res.code != exitOK {
+			t.Fatalf("grow %d: exit code = %d (stderr: %s)", grow, res.code, res.stderr)
+		}
+		got := readTestImage(t, out)
+		mask := mosaic.DilateMask(mosaic.LumaMask(src, 0.9, true), grow)
+		assertSameNRGBA(t, got, mosaic.New(src, 8, 8, mosaic.WithMask(mask)).Process())
+
+		// 選んだ範囲から離れた画素は元のまま
+		grown := bright.Inset(-grow)
+		for y := 0; y < 64; y++ {
+			for x := 0; x < 64; x++ {
+				if !image.Pt(x, y).In(grown) && got.NRGBAAt(x, y) != src.NRGBAAt(x, y) {
+					t.Fatalf("grow %d: unselected pixel (%d, %d) changed", grow, x, y)
+				}
+			}
+		}
+		if grow == 0 && got.NRGBAAt(16, 16) == src.NRGBAAt(16, 16) {
+			t.Errorf("bright pixel (16, 16) was not mosaiced")
+		}
+	}
+
+	for _, bad := range []string{"0.9", ">=2", "~0.5"} {
+		if res := runCLI(t, "apply", "-in", in, "-out", filepath.Join(dir, "bad.png"), "-select-luma", bad); res.code != exitUsage {
+			t.Errorf("-select-luma %q: exit code = %d, want %d", bad, res.code, exitUsage)
+		}
+	}
+}
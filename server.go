@@ -0,0 +1,598 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/yashikota/go-streaming-image-mosaic/internal/tiff"
+	"github.com/yashikota/go-streaming-image-mosaic/mosaic"
+)
+
+var (
+	errInvalidTile = errors.New("tile must be positive")
+	errNotReady    = errors.New("server is not ready")
+)
+
+// HTTP サーバーモードの状態を保持する構造体
+type server struct {
+	pipeline pipeline    // デフォルトの処理設定
+	jobs     *jobManager // 非同期ジョブの管理
+	metrics  *metrics    // nil の場合は /metrics を公開しない
+	cache    ResultCache // /process の処理結果のキャッシュ (nil の場合はキャッシュしない)
+	limits   *requestLimits
+	ready    atomic.Bool // 起動が終わり、終了の準備を始めていない間だけ true
+
+	deadline time.Duration // /process の処理時間の目標 (0 の場合は近道をしない)
+	work     workModel     // 起動時に測った処理の速さ (deadline が 0 の場合は使わない)
+}
+
+// serve のフラグ
+type serveFlags struct {
+	*commonFlags
+	addr          *string
+	workers       *int
+	jobTTL        *time.Duration
+	enableMetrics *bool
+	cacheSize     *int
+	maxBody       *int64
+	rate          requestRate
+	burst         *int
+	maxInFlight   *int
+	drainTimeout  *time.Duration
+	drainDelay    *time.Duration
+	deadline      *time.Duration
+	idleRelease   *time.Duration
+	idleInterval  *time.Duration
+	idleFreeOS    *bool
+}
+
+// サーバーモードでデコードする画像の画素数の既定の上限
+const serveMaxPixels = 100_000_000
+
+func newServeFlags(stderr io.Writer) *serveFlags {
+	c := newCommonFlags("serve", "[flags]", stderr)
+	// 小さなリクエストで巨大な画像を確保させないよう、サーバーモードでは既定で上限を設ける
+	c.maxPixels = serveMaxPixels
+	c.fs.Lookup("max-pixels").DefValue = c.maxPixels.String()
+	f := &serveFlags{
+		commonFlags:   c,
+		addr:          c.fs.String("addr", ":8080", "待ち受けるアドレス"),
+		workers:       c.fs.Int("workers", 2, "同時に処理するジョブ数"),
+		jobTTL:        c.fs.Duration("job-ttl", time.Hour, "完了したジョブの結果を保持する期間"),
+		enableMetrics: c.fs.Bool("metrics", false, "/metrics を公開する"),
+		cacheSize:     c.fs.Int("cache-size", 64<<20, "/process の処理結果をメモリにキャッシュする合計の大きさ (バイト、0 で無効)"),
+		maxBody:       c.fs.Int64("max-body", 64<<20, "リクエストボディの最大バイト数 (0 で無制限)"),
+		burst:         c.fs.Int("burst", 10, "-rate を超えて続けて受け付けるリクエスト数"),
+		maxInFlight:   c.fs.Int("max-in-flight", 16, "同時に受け付ける画像のリクエスト数 (超えた場合は 503、0 で無制限)"),
+		drainTimeout:  c.fs.Duration("drain-timeout", 30*time.Second, "SIGTERM を受け取ってから処理中のリクエストの完了を待つ時間 (過ぎると処理を中断する)"),
+		drainDelay:    c.fs.Duration("drain-delay", 0, "SIGTERM を受け取ってから新しいリクエストを拒否し始めるまでの時間 (この間 /readyz は 503 を返す)"),
+		idleRelease:   c.fs.Duration("idle-release", time.Minute, "この時間使っていないバンドのバッファをプールから捨てる (0 で捨てない)"),
+		idleInterval:  c.fs.Duration("idle-release-interval", 10*time.Second, "-idle-release の使っていないバッファを確かめる間隔"),
+		idleFreeOS:    c.fs.Bool("idle-free-os", true, "バッファを捨てた後に、使っていないヒープのメモリを OS に返す (debug.FreeOSMemory)"),
+		deadline:      c.fs.Duration("deadline", 0, "/process の処理時間の目標 (0 で無効)。起動時に測った処理の速さから間に合わないと見積もった画像は、タイルを大きくするか縮小してから処理する"),
+	}
+	c.fs.Var(&f.rate, "rate", "クライアントの IP アドレスごとに受け付けるリクエストの割合 (`rate`、例: 5/s、300/m、0 で無制限)")
+	return f
+}
+
+// HTTP サーバーを起動
+func runServe(args []string, stdout, stderr io.Writer) error {
+	f := newServeFlags(stderr)
+	if err := f.parse(args); err != nil {
+		return err
+	}
+	if *f.workers <= 0 {
+		return &usageError{errors.New("workers must be positive")}
+	}
+	if *f.cacheSize < 0 {
+		return &usageError{errors.New("cache-size must not be negative")}
+	}
+	if *f.maxBody < 0 || *f.maxInFlight < 0 {
+		return &usageError{errors.New("max-body and max-in-flight must not be negative")}
+	}
+	if f.rate > 0 && *f.burst <= 0 {
+		return &usageError{errors.New("burst must be positive")}
+	}
+	if *f.drainTimeout < 0 || *f.drainDelay < 0 || *f.deadline < 0 {
+		return &usageError{errors.New("drain-timeout, drain-delay and deadline must not be negative")}
+	}
+	if *f.idleRelease < 0 || *f.idleRelease > 0 && *f.idleInterval <= 0 {
+		return &usageError{errors.New("idle-release must not be negative and idle-release-interval must be positive")}
+	}
+
+	logger, err := f.logger(stderr)
+	if err != nil {
+		return err
+	}
+	s, err := f.newServer(logger)
+	if err != nil {
+		return err
+	}
+
+	ln, err := net.Listen("tcp", *f.addr)
+	if err != nil {
+		return err
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if *f.idleRelease > 0 {
+		go s.pipeline.pool.RunJanitor(ctx, *f.idleInterval, *f.idleRelease, *f.idleFreeOS)
+	}
+	logger.Info("server listening", "addr", ln.Addr().String(), "workers", *f.workers)
+	return s.serve(ctx, logger, ln, *f.drainDelay, *f.drainTimeout)
+}
+
+// フラグの設定でサーバーを生成 (待ち受けは始めない)
+func (f *serveFlags) newServer(logger *slog.Logger) (*server, error) {
+	p := f.pipeline(logger)
+	if *f.enableMetrics {
+		p.metrics = newMetrics()
+	}
+	// 長く動かすため、バンドのバッファはプールから借りて使い回す
+	p.pool = mosaic.NewBufferPool()
+	if p.metrics != nil {
+		p.metrics.pool = p.pool
+	}
+
+	s := &server{pipeline: p, metrics: p.metrics}
+	s.limits = newRequestLimits(*f.maxBody, float64(f.rate), *f.burst, *f.maxInFlight)
+	if *f.cacheSize > 0 {
+		s.cache = newMemoryResultCache(*f.cacheSize)
+	}
+	s.jobs = newJobManager(newMemoryJobStore(), *f.workers, 64, *f.jobTTL)
+	if *f.deadline > 0 {
+		work, err := calibrateWork(context.Background(), p)
+		if err != nil {
+			return nil, err
+		}
+		s.work, s.deadline = work, *f.deadline
+		logger.Info("work calibrated", "deadline", s.deadline,
+			"decode_mpx_per_second", s.work.decode/1e6, "scale_mpx_per_second", s.work.scale/1e6, "process_mpx_per_second", s.work.process/1e6, "per_tile", time.Duration(s.work.perTile*float64(time.Second)))
+	}
+	return s, nil
+}
+
+// ctx が終わるまでリクエストを処理し、その後は新しいリクエストを受け付けずに処理中のリクエストの完了を待つ
+// ctx が終わってから delay の間は、/readyz だけを 503 にしてリクエストを受け付け続ける (ロードバランサーが外すまでの猶予)
+// drain を過ぎても終わらないリクエストは context をキャンセルして中断する
+// 非同期ジョブは ctx が終わった時点で受け付けをやめ (503)、受け付け済みのジョブは drain の間だけ完了を待つ
+func (s *server) serve(ctx context.Context, logger *slog.Logger, ln net.Listener, delay, drain time.Duration) error {
+	// リクエストの context の親で、待つ時間を過ぎた場合にキャンセルする
+	base, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	srv := &http.Server{
+		Handler:     s.routes(),
+		BaseContext: func(net.Listener) context.Context { return base },
+	}
+	errc := make(chan error, 1)
+	go func() {
+		errc <- srv.Serve(ln)
+	}()
+	s.ready.Store(true)
+
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+	}
+	s.ready.Store(false)
+	s.jobs.stopIntake()
+	logger.Info("shutting down", "drain_delay", delay, "drain_timeout", drain)
+	time.Sleep(delay)
+	drainCtx, drainCancel := context.WithTimeout(context.Background(), drain)
+	defer drainCancel()
+	if err := srv.Shutdown(drainCtx); err != nil {
+		logger.Warn("drain timed out; canceling in-flight requests", "error", err)
+		cancel()
+		srv.Close()
+	}
+	if err := s.jobs.Close(drainCtx); err != nil {
+		logger.Warn("drain timed out; canceling unfinished jobs", "error", err)
+	}
+	logger.Info("server stopped")
+	return nil
+}
+
+// ルーティングを設定
+func (s *server) routes() http.Handler {
+	mux := http.NewServeMux()
+	process, submit := s.handleProcess, s.handleSubmitJob
+	if s.limits != nil {
+		process, submit = s.limits.wrap(process), s.limits.wrap(submit)
+	}
+	mux.HandleFunc("POST /process", process)
+	mux.HandleFunc("POST /jobs", submit)
+	mux.HandleFunc("GET /jobs/{id}", s.handleJobStatus)
+	mux.HandleFunc("GET /jobs/{id}/result", s.handleJobResult)
+	mux.HandleFunc("GET /jobs/{id}/events", s.handleJobEvents)
+	mux.HandleFunc("DELETE /jobs/{id}", s.handleCancelJob)
+	mux.HandleFunc("GET /healthz", s.handleHealth)
+	mux.HandleFunc("GET /readyz", s.handleReady)
+	if s.metrics != nil {
+		mux.Handle("GET /metrics", s.metrics)
+	}
+	// どのバージョンが応答したかをクライアントが確かめられるよう、すべての応答に付ける
+	version := currentVersion().String()
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Mosaic-Version", version)
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// プロセスが動いていれば常に成功する
+func (s *server) handleHealth(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// リクエストを受け付けられる場合に成功する
+// 起動中と終了の準備中は 503 を返し、ロードバランサーがリクエストを送らないようにする
+func (s *server) handleReady(w http.ResponseWriter, r *http.Request) {
+	if !s.ready.Load() {
+		writeError(w, http.StatusServiceUnavailable, errNotReady)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ready"})
+}
+
+// リクエストボディの画像をモザイク処理し、そのまま返却
+// Accept が multipart/mixed の場合は、処理したバンドから順に返す
+// キャッシュが有効な場合は、入力と処理設定から決まるキーを ETag とし、同じキーの処理結果があればそれを返却する
+func (s *server) handleProcess(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	// 応答の形式は Accept で変わるため、キャッシュが Accept ごとに分けて保存するようにする
+	w.Header().Set("Vary", "Accept")
+	p, err := s.pipelineFromQuery(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if wantsMultipart(r) {
+		s.handleProcessBands(w, r, p)
+		return
+	}
+	if rejectUnacceptable(w, r) {
+		return
+	}
+	if s.cache == nil {
+		var body io.Reader = r.Body
+		if s.deadline > 0 {
+			// ヘッダーを読めない画像は、そのまま処理して失敗させる
+			var header imageHeader
+			if body, header, err = peekHeader(body); err == nil {
+				p = s.fitDeadline(w, r, p, start, header)
+			}
+		}
+		var buf bytes.Buffer
+		warnings := &warningList{}
+		p.onWarning = warnings.add
+		if err := p.run(r.Context(), "request", body, &buf, nil); err != nil {
+			writeError(w, processStatus(err), err)
+			return
+		}
+		setWarningHeader(w.Header(), warnings.all())
+		w.Header().Set("Content-Type", outputContentType(buf.Bytes(), p.encoderName()))
+		w.Write(buf.Bytes())
+		return
+	}
+
+	// キーを求めるため、ボディを読み切っておく
+	input, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, bodyStatus(err), err)
+		return
+	}
+	if s.deadline > 0 {
+		if _, header, err := peekHeader(bytes.NewReader(input)); err == nil {
+			p = s.fitDeadline(w, r, p, start, header)
+		}
+	}
+	// 前に同じ入力を処理していれば、入力のキーから処理結果のキーを引ける
+	inputKey := cacheKey(input, s.requestOptions(p))
+	key := inputKey
+	if ref, ok := s.cache.Get(inputKey); ok && ref.Ref != "" {
+		key = ref.Ref
+	}
+	result, ok := s.cache.Get(key)
+	cached := ok && result.Ref == ""
+	if etag := `"` + key + `"`; etagMatches(r, etag, cached) {
+		// 同じキーの処理結果は常に同じなので、キャッシュになくても一致する
+		// GET と HEAD 以外では、If-None-Match が一致したリクエストは 412 で失敗させる (RFC 9110 13.1.2)
+		s.cacheResult(cachePreconditionFailed)
+		w.Header().Set("ETag", etag)
+		writeError(w, http.StatusPreconditionFailed, errors.New("If-None-Match matches the result of this request"))
+		return
+	}
+	if cached {
+		s.cacheResult(cacheHit)
+		w.Header().Set("X-Cache", "HIT")
+	} else {
+		s.cacheResult(cacheMiss)
+		result, key, err = s.processResult(r.Context(), p, input)
+		if err != nil {
+			writeError(w, processStatus(err), err)
+			return
+		}
+		if key != "" {
+			s.cache.Put(inputKey, CachedResult{Ref: key})
+		} else {
+			key = inputKey
+		}
+		if cached, ok := s.cache.Get(key); ok && cached.Ref == "" {
+			// 形式の違う入力から同じ処理結果を求めていた場合は、その結果を使う
+			result = cached
+		} else {
+			s.cache.Put(key, result)
+		}
+		w.Header().Set("X-Cache", "MISS")
+	}
+	etag := `"` + key + `"`
+	setWarningHeader(w.Header(), result.Warnings)
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Content-Type", outputContentType(result.Data, p.encoderName()))
+	w.Write(result.Data)
+}
+
+// リクエストの処理中に記録した警告
+// エンコードやプレビューなど、処理の途中で別のゴルーチンから記録することがあるため、排他制御する
+type warningList struct {
+	mu   sync.Mutex
+	list []mosaic.Warning
+}
+
+func (l *warningList) add(w mosaic.Warning) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.list = append(l.list, w)
+}
+
+func (l *warningList) all() []mosaic.Warning {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return slices.Clone(l.list)
+}
+
+// 警告ごとに "種類: メッセージ" の X-Mosaic-Warning ヘッダーを付ける
+func setWarningHeader(h http.Header, warnings []mosaic.Warning) {
+	for _, w := range warnings {
+		h.Add("X-Mosaic-Warning", string(w.Code)+": "+w.Message)
+	}
+}
+
+// キャッシュのキーに含める処理設定
+// クエリパラメーターで変えた設定を反映した Canonical な設定に、処理するページと出力の形式 (-deadline で縮小する場合は倍率も) を加える
+func (s *server) requestOptions(p pipeline) string {
+	settings, _ := json.Marshal(p.settings)
+	options := string(settings) + "\npages=" + p.pages.String() + "\nformat=" + p.encoderName()
+	if p.downscale > 1 {
+		options += "\ndownscale=" + strconv.Itoa(p.downscale)
+	}
+	return options
+}
+
+// input を処理し、キャッシュする処理結果と処理結果のキーを返却
+// キャッシュから返す場合も同じ警告を付けるよう、警告も保持する
+// 処理結果の画素の Digest を求められなかった場合 (複数ページの TIFF など) のキーは空
+func (s *server) processResult(ctx context.Context, p pipeline, input []byte) (CachedResult, string, error) {
+	var buf bytes.Buffer
+	warnings := &warningList{}
+	p.onWarning = warnings.add
+	p.digest = true
+	p.summaries = newSummaryLog(p)
+	if err := p.run(ctx, "request", bytes.NewReader(input), &buf, nil); err != nil {
+		return CachedResult{}, "", err
+	}
+	result := CachedResult{Data: buf.Bytes(), Warnings: warnings.all()}
+	summary := p.summaries.file("request", "", nil)
+	if summary.Digest == "" {
+		return result, "", nil
+	}
+	return result, resultKey(summary.Digest, outputOptions(p, summary.Options.DPI)), nil
+}
+
+// 処理結果のキーに含める出力の設定
+// 出力の形式とエンコードの設定で、解像度は入力から決めた値 dpi を使う
+func outputOptions(p pipeline, dpi float64) string {
+	opts := p.encodeOpts
+	opts.DPI = dpi
+	return fmt.Sprintf("format=%s\nquality=%d\ncompression=%d\nlossless=%t\ndpi=%g", p.encoderName(), opts.Quality, opts.Compression, opts.Lossless, opts.DPI)
+}
+
+// キャッシュの参照の結果を記録
+func (s *server) cacheResult(result string) {
+	if s.metrics != nil {
+		s.metrics.cacheResult(result)
+	}
+}
+
+// 処理結果の Content-Type
+// TIFF の入力は TIFF で、それ以外は encoder の形式で出力する
+func outputContentType(data []byte, encoder string) string {
+	if tiff.IsTIFF(data) {
+		return "image/tiff"
+	}
+	if mt := mosaic.EncoderMediaType(encoder); mt != "" {
+		return mt
+	}
+	return "application/octet-stream"
+}
+
+// 処理のエラーに対応する HTTP ステータス
+func processStatus(err error) int {
+	var tooLarge *ErrImageTooLarge
+	var bodyTooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) || errors.As(err, &bodyTooLarge) {
+		return http.StatusRequestEntityTooLarge
+	}
+	return http.StatusUnprocessableEntity
+}
+
+// リクエストボディの読み込みのエラーに対応する HTTP ステータス
+func bodyStatus(err error) int {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return http.StatusRequestEntityTooLarge
+	}
+	return http.StatusBadRequest
+}
+
+// Accept の 1 つの範囲 (image/png、image/*、*/* など)
+type acceptRange struct {
+	mediaType string
+	q         float64
+}
+
+// Accept の範囲を並びの順に返却 (書式の誤った範囲は無視する)
+func parseAccept(accept string) []acceptRange {
+	var ranges []acceptRange
+	for _, v := range strings.Split(accept, ",") {
+		mt, params, err := mime.ParseMediaType(strings.TrimSpace(v))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(v, 64); err != nil || q < 0 || q > 1 {
+				continue
+			}
+		}
+		ranges = append(ranges, acceptRange{mediaType: mt, q: q})
+	}
+	return ranges
+}
+
+// mediaType に一致する最も詳しい範囲 (image/png、image/*、*/* の順) の q と、その範囲の位置
+// 同じ詳しさの範囲が複数ある場合は先の範囲を使い、一致する範囲がなければ q を 0 にする
+func acceptQuality(ranges []acceptRange, mediaType string) (q float64, pos int) {
+	typ, _, _ := strings.Cut(mediaType, "/")
+	best := -1
+	pos = -1
+	for i, r := range ranges {
+		specificity := -1
+		switch {
+		case r.mediaType == mediaType:
+			specificity = 2
+		case r.mediaType == typ+"/*":
+			specificity = 1
+		case r.mediaType == "*/*":
+			specificity = 0
+		}
+		if specificity > best {
+			best, q, pos = specificity, r.q, i
+		}
+	}
+	return q, pos
+}
+
+// Accept のうち、最も q の大きい書き出せる形式
+// 同じ q の場合は一致した範囲が先に並んだ形式を、同じ範囲に一致した場合は登録の順 (既定の JPEG が先) で選ぶ
+// q が 0 の形式は選ばず、書き出せる形式がなければ false を返却
+func acceptedEncoder(accept string) (string, bool) {
+	ranges := parseAccept(accept)
+	best, bestQ, bestPos := "", 0.0, 0
+	for _, name := range mosaic.Encoders() {
+		mt := mosaic.EncoderMediaType(name)
+		if mt == "" || mosaic.IsTileFormat(name) {
+			continue
+		}
+		q, pos := acceptQuality(ranges, mt)
+		if q > bestQ || (q == bestQ && q > 0 && pos < bestPos) {
+			best, bestQ, bestPos = name, q, pos
+		}
+	}
+	return best, best != ""
+}
+
+// 書き出せる形式の MIME タイプ (登録の順)
+func supportedMediaTypes() []string {
+	var types []string
+	for _, name := range mosaic.Encoders() {
+		if mt := mosaic.EncoderMediaType(name); mt != "" && !mosaic.IsTileFormat(name) && !slices.Contains(types, mt) {
+			types = append(types, mt)
+		}
+	}
+	return types
+}
+
+// Accept に書き出せる形式がない場合の 406 のレスポンス
+type notAcceptable struct {
+	Error     string   `json:"error"`
+	Supported []string `json:"supported"` // 書き出せる形式の MIME タイプ
+}
+
+// format の指定がなく、Accept があるのに書き出せる形式を含まない場合は 406 を返し、true を返却
+func rejectUnacceptable(w http.ResponseWriter, r *http.Request) bool {
+	accept := r.Header.Get("Accept")
+	if r.URL.Query().Get("format") != "" || strings.TrimSpace(accept) == "" {
+		return false
+	}
+	if _, ok := acceptedEncoder(accept); ok {
+		return false
+	}
+	writeJSON(w, http.StatusNotAcceptable, notAcceptable{
+		Error:     "none of the types in Accept can be produced (use the format query parameter or one of the supported types)",
+		Supported: supportedMediaTypes(),
+	})
+	return true
+}
+
+// クエリパラメータからリクエストごとの処理設定を組み立てる
+// 出力の形式は format、なければ Accept で決め (どちらもなければ JPEG)
+func (s *server) pipelineFromQuery(r *http.Request) (pipeline, error) {
+	p := s.pipeline
+	if v := r.URL.Query().Get("format"); v != "" {
+		if _, err := mosaic.LookupEncoder(v); err != nil {
+			return pipeline{}, err
+		}
+		if mosaic.IsTileFormat(v) {
+			// タイルから書き出す形式は apply だけで使える
+			return pipeline{}, fmt.Errorf("format %s is not supported by the server", v)
+		}
+		p.encoder = strings.ToLower(v)
+	} else if name, ok := acceptedEncoder(r.Header.Get("Accept")); ok {
+		p.encoder = name
+	}
+	if v := r.URL.Query().Get("tile"); v != "" {
+		tile, err := strconv.Atoi(v)
+		if err != nil {
+			return pipeline{}, err
+		}
+		// px で指定した大きさは -tile-mm より優先する
+		o := p.settings
+		o.Tile, o.TileMM = tile, 0
+		if err := o.Validate(); err != nil {
+			return pipeline{}, err
+		}
+		p.settings = o.Canonical()
+		p.tile, p.tileMM = tile, 0
+	}
+	return p, nil
+}
+
+// JSON 形式でレスポンスを書き込む
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// JSON 形式でエラーレスポンスを書き込む
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
@@ -0,0 +1,343 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"image"
+	"image/png"
+	"io"
+	"net"
+	"net/http"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestAcceptedEncoder(t *testing.T) {
+	tests := []struct {
+		accept string
+		want   string // 空は書き出せる形式がない
+	}{
+		{"", ""},
+		{"image/png", "png"},
+		{"image/webp,image/avif,image/*", "jpeg"},
+		{"*/*", "jpeg"},
+		// q の大きい形式を選ぶ
+		{"image/png;q=0.5, image/gif;q=0.8", "gif"},
+		{"image/gif;q=0.2, image/*;q=0.9", "jpeg"},
+		// 同じ q の場合は先に並べた形式
+		{"image/tiff, image/png", "tiff"},
+		{"image/png;q=0.5, image/gif;q=0.5", "png"},
+		// 詳しい範囲の q を使う
+		{"image/*;q=0.9, image/jpeg;q=0.1", "png"},
+		{"image/jpeg;q=0, image/*", "png"},
+		{"image/*, image/png;q=0, image/jpeg;q=0", "gif"},
+		{"*/*;q=0.1, image/x-portable-pixmap", "ppm"},
+		// q が 0 の形式と、書式の誤った範囲は選ばない
+		{"image/png;q=0", ""},
+		{"image/png;q=2, image/gif;q=x", ""},
+		{"image/webp, image/avif", ""},
+		// タイルから書き出す形式は選ばない
+		{"image/svg+xml, text/html, text/plain", ""},
+		{"text/*", ""},
+	}
+	for _, tt := range tests {
+		got, ok := acceptedEncoder(tt.accept)
+		if got != tt.want || ok != (tt.want != "") {
+			t.Errorf("acceptedEncoder(%q) = %q, %v, want %q", tt.accept, got, ok, tt.want)
+		}
+	}
+}
+
+func TestServerNegotiation(t *testing.T) {
+	input := encodeTestImage(t, testImage(32, 24), "png")
+	post := func(ts, query, accept string) (*http.Response, []byte) {
+		t.Helper()
+		req, err := http.NewRequest(http.MethodPost, ts+"/process?tile=8"+query, bytes.NewReader(input))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if vary := resp.Header.Get("Vary"); vary != "Accept" {
+			t.Errorf("%s %q: Vary %q", query, accept, vary)
+		}
+		return resp, body
+	}
+
+	// キャッシュの有無によらず同じ応答で、キャッシュはリクエストの形式ごとに分ける
+	for _, args := range [][]string{nil, {"-cache-size", "0"}} {
+		ts, _ := newTestServer(t, args...)
+		tests := []struct {
+			query, accept string
+			status        int
+			contentType   string
+		}{
+			{"", "", http.StatusOK, "image/jpeg"},
+			{"", "image/webp,image/avif,image/*", http.StatusOK, "image/jpeg"},
+			{"", "image/png", http.StatusOK, "image/png"},
+			{"", "image/gif;q=0.4, image/png;q=0.6", http.StatusOK, "image/png"},
+			{"", "image/gif;q=0.6, image/png;q=0.4", http.StatusOK, "image/gif"},
+			// format は Accept より優先する
+			{"&format=gif", "image/png", http.StatusOK, "image/gif"},
+			{"&format=tiff", "image/webp", http.StatusOK, "image/tiff"},
+			{"&format=svg", "", http.StatusBadRequest, "application/json"},
+			{"&format=webp", "", http.StatusBadRequest, "application/json"},
+			{"", "image/webp", http.StatusNotAcceptable, "application/json"},
+			{"", "image/svg+xml", http.StatusNotAcceptable, "application/json"},
+		}
+		for _, tt := range tests {
+			resp, body := post(ts.URL, tt.query, tt.accept)
+			if resp.StatusCode != tt.status || resp.Header.Get("Content-Type") != tt.contentType {
+				t.Errorf("%v %s %q: status %d, Content-Type %q, want %d, %q", args, tt.query, tt.accept, resp.StatusCode, resp.Header.Get("Content-Type"), tt.status, tt.contentType)
+			}
+			if resp.StatusCode != http.StatusNotAcceptable {
+				continue
+			}
+			var na notAcceptable
+			if err := json.Unmarshal(body, &na); err != nil {
+				t.Fatalf("%q: %v\n%s", tt.accept, err, body)
+			}
+			if na.Error == "" || !slices.Equal(na.Supported, []string{"image/jpeg", "image/png", "image/gif", "image/tiff", "image/x-portable-pixmap"}) {
+				t.Errorf("%q: 406 body %+v", tt.accept, na)
+			}
+		}
+	}
+}
+
+func TestServeDrain(t *testing.T) {
+	f := newServeFlags(io.Discard)
+	if err := f.parse([]string{"-max-in-flight", "1", "-cache-size", "0"}); err != nil {
+		t.Fatal(err)
+	}
+	s, err := f.newServer(discardLogger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	url := "http://" + ln.Addr().String()
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+	errc := make(chan error, 1)
+	go func() { errc <- s.serve(ctx, discardLogger, ln, 2*time.Second, 10*time.Second) }()
+
+	input := encodeTestImage(t, testImage(64, 48), "png")
+	eventually := func(what string, ok func() bool) {
+		t.Helper()
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+			if ok() {
+				return
+			}
+		}
+		t.Fatalf("timed out waiting for %s", what)
+	}
+	status := func(method, path string, body []byte) int {
+		code, _ := doRequest(t, method, url+path, bytes.NewReader(body))
+		return code
+	}
+	eventually("ready", func() bool { return status(http.MethodGet, "/readyz", nil) == http.StatusOK })
+
+	// ボディを送り終えていない処理中のリクエスト
+	pr, pw := io.Pipe()
+	type result struct {
+		code int
+		body []byte
+		err  error
+	}
+	slow := make(chan result, 1)
+	go func() {
+		resp, err := http.Post(url+"/process?tile=8&format=png", "image/png", pr)
+		if err != nil {
+			slow <- result{err: err}
+			return
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		slow <- result{resp.StatusCode, body, err}
+	}()
+	if _, err := pw.Write(input[:len(input)/2]); err != nil {
+		t.Fatal(err)
+	}
+	// -max-in-flight 1 の枠が埋まれば、処理中のリクエストはハンドラーに入っている
+	eventually("slow request in flight", func() bool { return status(http.MethodPost, "/process?tile=8", input) == http.StatusServiceUnavailable })
+
+	// シグナルを受けた後は /readyz が 503
+	stop()
+	eventually("not ready", func() bool { return status(http.MethodGet, "/readyz", nil) == http.StatusServiceUnavailable })
+	// 処理中のリクエストは最後まで処理する
+	if _, err := pw.Write(input[len(input)/2:]); err != nil {
+		t.Fatal(err)
+	}
+	pw.Close()
+	r := <-slow
+	if r.err != nil || r.code != http.StatusOK {
+		t.Fatalf("in-flight request: status %d, %v: %s", r.code, r.err, r.body)
+	}
+	if _, _, err := image.Decode(bytes.NewReader(r.body)); err != nil {
+		t.Errorf("in-flight response: %v", err)
+	}
+	// 処理中のリクエストが -max-in-flight の枠を返した後も、新しいジョブは受け付けない
+	code, body := doRequest(t, http.MethodPost, url+"/jobs?tile=8", bytes.NewReader(input))
+	if code != http.StatusServiceUnavailable || !bytes.Contains(body, []byte(errJobsClosed.Error())) {
+		t.Errorf("POST /jobs while draining: status %d: %s", code, body)
+	}
+
+	select {
+	case err := <-errc:
+		if err != nil {
+			t.Fatalf("serve: %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("serve did not return")
+	}
+	if _, err := http.Get(url + "/healthz"); err == nil {
+		t.Error("server still accepts connections after drain")
+	}
+}
+
+func TestServerCacheKeyedOnDigest(t *testing.T) {
+	ts, _ := newTestServer(t)
+	img := testImage(64, 48)
+	// 同じ画素を別のバイト列にした入力
+	var fast, best bytes.Buffer
+	for _, in := range []struct {
+		buf   *bytes.Buffer
+		level png.CompressionLevel
+	}{{&fast, png.BestSpeed}, {&best, png.BestCompression}} {
+		if err := (&png.Encoder{CompressionLevel: in.level}).Encode(in.buf, img); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if bytes.Equal(fast.Bytes(), best.Bytes()) {
+		t.Fatal("fixtures are identical")
+	}
+	post := func(query string, input []byte, etag string) (*http.Response, []byte) {
+		t.Helper()
+		req, err := http.NewRequest(http.MethodPost, ts.URL+"/process?"+query, bytes.NewReader(input))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if etag != "" {
+			req.Header.Set("If-None-Match", etag)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp, body
+	}
+
+	first, body := post("tile=8&format=png", fast.Bytes(), "")
+	etag := first.Header.Get("ETag")
+	if first.StatusCode != http.StatusOK || first.Header.Get("X-Cache") != "MISS" || etag == "" {
+		t.Fatalf("first: status %d, X-Cache %q, ETag %q", first.StatusCode, first.Header.Get("X-Cache"), etag)
+	}
+	// 形式の違う入力でも、処理結果の画素が同じならキャッシュのキーと ETag は同じ
+	other, otherBody := post("tile=8&format=png", best.Bytes(), "")
+	if other.Header.Get("ETag") != etag || !bytes.Equal(otherBody, body) {
+		t.Errorf("same pixels: ETag %q, want %q", other.Header.Get("ETag"), etag)
+	}
+	for _, input := range [][]byte{fast.Bytes(), best.Bytes()} {
+		resp, again := post("tile=8&format=png", input, "")
+		if resp.Header.Get("X-Cache") != "HIT" || resp.Header.Get("ETag") != etag || !bytes.Equal(again, body) {
+			t.Errorf("repeat: X-Cache %q, ETag %q", resp.Header.Get("X-Cache"), resp.Header.Get("ETag"))
+		}
+		if resp, _ := post("tile=8&format=png", input, etag); resp.StatusCode != http.StatusPreconditionFailed || resp.Header.Get("ETag") != etag {
+			t.Errorf("If-None-Match: status %d, ETag %q, want 412 and %q", resp.StatusCode, resp.Header.Get("ETag"), etag)
+		}
+	}
+	// 処理設定や出力の設定を変えるとキーも変わる
+	for _, query := range []string{"tile=16&format=png", "tile=8&format=gif"} {
+		resp, _ := post(query, fast.Bytes(), "")
+		if resp.Header.Get("ETag") == etag || resp.Header.Get("X-Cache") != "MISS" {
+			t.Errorf("%s: ETag %q, X-Cache %q", query, resp.Header.Get("ETag"), resp.Header.Get("X-Cache"))
+		}
+	}
+	// TIFF の入力も繰り返しのリクエストはキャッシュから返す
+	tiffInput := encodeTestImage(t, img, "tiff")
+	post("tile=8", tiffInput, "")
+	if resp, _ := post("tile=8", tiffInput, ""); resp.Header.Get("X-Cache") != "HIT" || resp.Header.Get("Content-Type") != "image/tiff" {
+		t.Errorf("tiff: X-Cache %q, Content-Type %q", resp.Header.Get("X-Cache"), resp.Header.Get("Content-Type"))
+	}
+}
+
+// If-None-Match: * は、キャッシュに処理結果がある場合だけ一致し、POST のため 412 を返す
+// 処理結果がなければ処理して 200 を返し、次のリクエストからはキャッシュから返す
+func TestServerIfNoneMatchStar(t *testing.T) {
+	ts, _ := newTestServer(t)
+	input := encodeTestImage(t, testImage(64, 48), "png")
+	post := func(query, ifNoneMatch string) (*http.Response, []byte) {
+		t.Helper()
+		req, err := http.NewRequest(http.MethodPost, ts.URL+"/process?"+query, bytes.NewReader(input))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ifNoneMatch != "" {
+			req.Header.Set("If-None-Match", ifNoneMatch)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp, body
+	}
+
+	tests := []struct {
+		query       string
+		ifNoneMatch string
+		status      int
+		cache       string // 412 の場合は X-Cache を付けない
+	}{
+		{"tile=8&format=png", "*", http.StatusOK, "MISS"},
+		{"tile=8&format=png", "*", http.StatusPreconditionFailed, ""},
+		{"tile=8&format=png", `"other", *`, http.StatusPreconditionFailed, ""},
+		{"tile=8&format=png", `"other"`, http.StatusOK, "HIT"},
+		{"tile=8&format=png", "", http.StatusOK, "HIT"},
+		// 処理設定が違う処理結果はまだない
+		{"tile=16&format=png", `W/"other", *`, http.StatusOK, "MISS"},
+		{"tile=16&format=png", "*", http.StatusPreconditionFailed, ""},
+		{"tile=8&format=gif", "", http.StatusOK, "MISS"},
+	}
+	var want []byte
+	for i, tt := range tests {
+		resp, body := post(tt.query, tt.ifNoneMatch)
+		if resp.StatusCode != tt.status || resp.Header.Get("X-Cache") != tt.cache || resp.Header.Get("ETag") == "" {
+			t.Errorf("%d: %s with If-None-Match %q: status %d, X-Cache %q, ETag %q, want %d and %q", i, tt.query, tt.ifNoneMatch, resp.StatusCode, resp.Header.Get("X-Cache"), resp.Header.Get("ETag"), tt.status, tt.cache)
+			continue
+		}
+		if tt.status == http.StatusPreconditionFailed && !bytes.Contains(body, []byte(`"error"`)) {
+			t.Errorf("%d: 412 body %s", i, body)
+		}
+		if tt.query == "tile=8&format=png" && tt.status == http.StatusOK {
+			if want == nil {
+				want = body
+			} else if !bytes.Equal(body, want) {
+				t.Errorf("%d: body differs from the first response", i)
+			}
+		}
+	}
+}
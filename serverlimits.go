@@ -0,0 +1,148 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	errRateLimited = errors.New("too many requests")
+	errServerBusy  = errors.New("server is busy")
+)
+
+// 1 秒あたりのリクエスト数を表すフラグの値 (例: 5/s、300/m、0 で無制限)
+type requestRate float64
+
+func (r *requestRate) String() string {
+	if *r == 0 {
+		return "0"
+	}
+	return strconv.FormatFloat(float64(*r), 'g', -1, 64) + "/s"
+}
+
+func (r *requestRate) Set(s string) error {
+	n, unit, _ := strings.Cut(s, "/")
+	v, err := strconv.ParseFloat(n, 64)
+	if err != nil || v < 0 || math.IsInf(v, 0) {
+		return fmt.Errorf("invalid rate %q (want a rate such as 5/s or 300/m)", s)
+	}
+	switch unit {
+	case "", "s":
+	case "m":
+		v /= 60
+	case "h":
+		v /= 3600
+	default:
+		return fmt.Errorf("invalid rate %q (unit must be s, m or h)", s)
+	}
+	*r = requestRate(v)
+	return nil
+}
+
+func (r *requestRate) Get() any {
+	return float64(*r)
+}
+
+// サーバーのリクエストの制限
+type requestLimits struct {
+	maxBody  int64         // リクエストボディの最大バイト数 (0 で無制限)
+	rate     float64       // クライアントの IP アドレスごとの 1 秒あたりのリクエスト数 (0 で無制限)
+	burst    int           // rate を超えて続けて受け付けるリクエスト数
+	inFlight chan struct{} // 同時に処理するリクエストの枠 (nil で無制限)
+
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+func newRequestLimits(maxBody int64, rate float64, burst, maxInFlight int) *requestLimits {
+	l := &requestLimits{maxBody: maxBody, rate: rate, burst: burst, buckets: map[string]*tokenBucket{}}
+	if maxInFlight > 0 {
+		l.inFlight = make(chan struct{}, maxInFlight)
+	}
+	return l
+}
+
+// クライアントごとのトークンバケット
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// 画像を受け取るハンドラーに制限を加える
+// 制限を超えたリクエストは待たせずに拒否し、ボディを読む前に 429、503、413 を返す
+func (l *requestLimits) wrap(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if l.rate > 0 {
+			if ok, wait := l.allow(clientIP(r), time.Now()); !ok {
+				w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+				writeError(w, http.StatusTooManyRequests, errRateLimited)
+				return
+			}
+		}
+		if l.inFlight != nil {
+			select {
+			case l.inFlight <- struct{}{}:
+				defer func() { <-l.inFlight }()
+			default:
+				writeError(w, http.StatusServiceUnavailable, errServerBusy)
+				return
+			}
+		}
+		if l.maxBody > 0 {
+			if r.ContentLength > l.maxBody {
+				writeError(w, http.StatusRequestEntityTooLarge, &http.MaxBytesError{Limit: l.maxBody})
+				return
+			}
+			// Content-Length のないリクエストは、上限を超えて読んだ時点で失敗させる
+			r.Body = http.MaxBytesReader(w, r.Body, l.maxBody)
+		}
+		next(w, r)
+	}
+}
+
+// クライアントのリクエストを受け付けるかどうか
+// 受け付けない場合は、次のリクエストを受け付けるまでの時間を返却
+func (l *requestLimits) allow(client string, now time.Time) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	burst := float64(max(l.burst, 1))
+	if now.Sub(l.lastSweep) > time.Minute {
+		// 満杯まで戻ったバケットは新しく作るものと同じなので、捨てて増え続けないようにする
+		for ip, b := range l.buckets {
+			if b.tokens+now.Sub(b.last).Seconds()*l.rate >= burst {
+				delete(l.buckets, ip)
+			}
+		}
+		l.lastSweep = now
+	}
+	b, ok := l.buckets[client]
+	if !ok {
+		b = &tokenBucket{tokens: burst, last: now}
+		l.buckets[client] = b
+	}
+	b.tokens = math.Min(burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+	}
+	b.tokens--
+	return true, 0
+}
+
+// リクエストを送ったクライアントの IP アドレス
+// プロキシのヘッダーは偽装できるため参照しない
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
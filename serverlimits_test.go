@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// 画像のリクエストを送り、ステータスとレスポンスを返却
+func postImage(t *testing.T, url string, body io.Reader) (*http.Response, []byte) {
+	t.Helper()
+	resp, err := http.Post(url, "image/png", body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, data
+}
+
+// JSON のエラーのレスポンスかどうか
+func assertJSONError(t *testing.T, resp *http.Response, body []byte, status int) {
+	t.Helper()
+	var e struct {
+		Error string `json:"error"`
+	}
+	if resp.StatusCode != status {
+		t.Fatalf("status %d, want %d: %s", resp.StatusCode, status, body)
+	}
+	if err := json.Unmarshal(body, &e); err != nil || e.Error == "" {
+		t.Errorf("error body %q: %v", body, err)
+	}
+}
+
+func TestRequestLimitsBodySize(t *testing.T) {
+	ts, _ := newTestServer(t, "-max-body", "1000", "-cache-size", "0")
+	small := encodeTestImage(t, testImage(8, 8), "png")
+	large := encodeTestImage(t, testImage(256, 256), "png")
+	if len(small) > 1000 || len(large) <= 1000 {
+		t.Fatalf("fixture sizes %d, %d", len(small), len(large))
+	}
+
+	for _, path := range []string{"/process?tile=4", "/jobs?tile=4"} {
+		resp, body := postImage(t, ts.URL+path, bytes.NewReader(small))
+		if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusAccepted {
+			t.Errorf("%s small: status %d: %s", path, resp.StatusCode, body)
+		}
+		// Content-Length で分かる場合はボディを読まずに拒否する
+		resp, body = postImage(t, ts.URL+path, bytes.NewReader(large))
+		assertJSONError(t, resp, body, http.StatusRequestEntityTooLarge)
+		// Content-Length のないボディは上限を超えて読んだ時点で拒否する
+		resp, body = postImage(t, ts.URL+path, io.MultiReader(bytes.NewReader(large)))
+		assertJSONError(t, resp, body, http.StatusRequestEntityTooLarge)
+	}
+}
+
+func TestRequestLimitsRate(t *testing.T) {
+	ts, _ := newTestServer(t, "-rate", "1/m", "-burst", "2", "-cache-size", "0")
+	input := encodeTestImage(t, testImage(8, 8), "png")
+	for i := 0; i < 2; i++ {
+		if resp, body := postImage(t, ts.URL+"/process?tile=4", bytes.NewReader(input)); resp.StatusCode != http.StatusOK {
+			t.Fatalf("request %d: status %d: %s", i, resp.StatusCode, body)
+		}
+	}
+	resp, body := postImage(t, ts.URL+"/process?tile=4", bytes.NewReader(input))
+	assertJSONError(t, resp, body, http.StatusTooManyRequests)
+	if got := resp.Header.Get("Retry-After"); got != "60" {
+		t.Errorf("Retry-After %q, want 60", got)
+	}
+	// 制限は画像を受け取るハンドラーだけ
+	if code, _ := doRequest(t, http.MethodGet, ts.URL+"/healthz", nil); code != http.StatusOK {
+		t.Errorf("/healthz: status %d", code)
+	}
+}
+
+func TestRequestLimitsAllow(t *testing.T) {
+	l := newRequestLimits(0, 2, 3, 0)
+	now := time.Unix(1000, 0)
+	for i := 0; i < 3; i++ {
+		if ok, _ := l.allow("a", now); !ok {
+			t.Fatalf("burst request %d rejected", i)
+		}
+	}
+	ok, wait := l.allow("a", now)
+	if ok || wait != 500*time.Millisecond {
+		t.Fatalf("after burst: %v, wait %v, want false, 500ms", ok, wait)
+	}
+	// 別のクライアントは別のバケット
+	if ok, _ := l.allow("b", now); !ok {
+		t.Error("other client rejected")
+	}
+	// 2/s なので 0.5 秒で 1 つ戻る
+	if ok, _ := l.allow("a", now.Add(500*time.Millisecond)); !ok {
+		t.Error("refilled token rejected")
+	}
+	if ok, _ := l.allow("a", now.Add(500*time.Millisecond)); ok {
+		t.Error("second request after refill accepted")
+	}
+	// 満杯に戻ったバケットは掃除で捨てる
+	l.allow("c", now.Add(2*time.Minute))
+	l.mu.Lock()
+	n := len(l.buckets)
+	l.mu.Unlock()
+	if n != 1 {
+		t.Errorf("%d buckets after sweep, want 1", n)
+	}
+}
+
+func TestRequestRateFlag(t *testing.T) {
+	tests := []struct {
+		in   string
+		want float64
+		ok   bool
+	}{
+		{"5", 5, true},
+		{"5/s", 5, true},
+		{"300/m", 5, true},
+		{"3600/h", 1, true},
+		{"0", 0, true},
+		{"-1/s", 0, false},
+		{"5/d", 0, false},
+		{"fast", 0, false},
+	}
+	for _, tt := range tests {
+		var r requestRate
+		err := r.Set(tt.in)
+		if (err == nil) != tt.ok || (tt.ok && float64(r) != tt.want) {
+			t.Errorf("Set(%q) = %v, %v; want %v, ok %v", tt.in, float64(r), err, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestRequestLimitsInFlight(t *testing.T) {
+	const n = 3
+	ts, s := newTestServer(t, "-max-in-flight", "3", "-cache-size", "0")
+	input := encodeTestImage(t, testImage(32, 32), "png")
+
+	// ボディを送り終えていない n 件のリクエストで枠を埋める
+	writers := make([]*io.PipeWriter, n)
+	done := make(chan int, n)
+	for i := range writers {
+		pr, pw := io.Pipe()
+		writers[i] = pw
+		go func() {
+			resp, err := http.Post(ts.URL+"/process?tile=4", "image/png", pr)
+			if err != nil {
+				done <- 0
+				return
+			}
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+			done <- resp.StatusCode
+		}()
+		if _, err := pw.Write(input[:10]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for deadline := time.Now().Add(5 * time.Second); len(s.limits.inFlight) < n; time.Sleep(5 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d requests in flight, want %d", len(s.limits.inFlight), n)
+		}
+	}
+
+	// n+1 件目は待たずに 503
+	for _, path := range []string{"/process?tile=4", "/jobs?tile=4"} {
+		resp, body := postImage(t, ts.URL+path, bytes.NewReader(input))
+		assertJSONError(t, resp, body, http.StatusServiceUnavailable)
+	}
+
+	for _, pw := range writers {
+		pw.Write(input[10:])
+		pw.Close()
+	}
+	for range writers {
+		if code := <-done; code != http.StatusOK {
+			t.Errorf("in-flight request: status %d", code)
+		}
+	}
+	// 枠が空けば受け付ける
+	if resp, body := postImage(t, ts.URL+"/process?tile=4", bytes.NewReader(input)); resp.StatusCode != http.StatusOK {
+		t.Errorf("after release: status %d: %s", resp.StatusCode, body)
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// 書き込み先が受け取らないまま ctx が終了したことを表すエラー
+type outputStalledError struct {
+	written int64 // それまでに書き込めたバイト数
+	err     error // ctx.Err()
+}
+
+func (e *outputStalledError) Error() string {
+	return fmt.Sprintf("output stalled: %v after writing %d bytes", e.err, e.written)
+}
+
+func (e *outputStalledError) Unwrap() error { return e.err }
+
+// ctx の終了で書き込みを中断する io.Writer
+// 名前付きパイプやソケットのような書き込みの期限を設定できる *os.File には ctx の期限を設定し、ctx の終了で期限を過去にして止まった書き込みも中断する
+// 通常のファイルは止まらないため、書き込みの間で ctx を確かめるだけにする
+// それ以外の書き込み先は別のゴルーチンで書き込み、ctx が終了したら書き込みの終わりを待たずにエラーを返す
+// (中断した書き込みのゴルーチンは、書き込み先が受け取るか閉じられるまで残る)
+// 中断した後の Write は書き込み先に触れずに同じエラーを返す
+type contextWriter struct {
+	ctx     context.Context
+	w       io.Writer
+	file    *os.File // 書き込みの期限を設定した書き込み先 (nil の場合は設定していない)
+	direct  bool     // ctx を確かめてから直接書き込む (通常のファイルか、ctx が終了しない場合)
+	cancel  func() bool
+	written int64
+	err     error // 中断した理由 (以降の Write で返す)
+}
+
+func newContextWriter(ctx context.Context, w io.Writer) *contextWriter {
+	c := &contextWriter{ctx: ctx, w: w}
+	if ctx.Done() == nil {
+		c.direct = true
+		return c
+	}
+	if f, ok := w.(*os.File); ok {
+		if info, err := f.Stat(); err == nil && info.Mode().IsRegular() {
+			c.direct = true
+			return c
+		}
+		deadline, _ := ctx.Deadline()
+		if f.SetWriteDeadline(deadline) == nil {
+			c.file = f
+			c.cancel = context.AfterFunc(ctx, func() {
+				f.SetWriteDeadline(time.Unix(1, 0))
+			})
+		}
+	}
+	return c
+}
+
+func (c *contextWriter) Write(p []byte) (int, error) {
+	if c.err != nil {
+		return 0, c.err
+	}
+	if err := c.ctx.Err(); err != nil {
+		// 書き込む前に終了した場合は書き込み先が止まったわけではないため、ctx のエラーをそのまま返す
+		return 0, err
+	}
+	var (
+		n   int
+		err error
+	)
+	switch {
+	case c.direct:
+		n, err = c.w.Write(p)
+	case c.file != nil:
+		n, err = c.file.Write(p)
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			c.written += int64(n)
+			return n, c.stalled(context.DeadlineExceeded)
+		}
+	default:
+		// 書き込み先が p を読み終える前に返る場合があるため、写しを渡す
+		buf := append([]byte(nil), p...)
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			n, err = c.w.Write(buf)
+		}()
+		select {
+		case <-done:
+		case <-c.ctx.Done():
+			return 0, c.stalled(c.ctx.Err())
+		}
+	}
+	c.written += int64(n)
+	return n, err
+}
+
+// 中断した理由を記録し、返すエラーを作る
+// 期限を設定した書き込み先では ctx より先に期限を過ぎることがあるため、ctx が終了していない場合は err を使う
+func (c *contextWriter) stalled(err error) error {
+	if ctxErr := c.ctx.Err(); ctxErr != nil {
+		err = ctxErr
+	}
+	c.err = &outputStalledError{written: c.written, err: err}
+	return c.err
+}
+
+// ctx の終了の監視をやめ、設定した書き込みの期限を外す
+func (c *contextWriter) stop() {
+	if c.cancel != nil {
+		c.cancel()
+		c.file.SetWriteDeadline(time.Time{})
+	}
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+// limit バイトを受け取った後は、unblock が閉じられるまで書き込みを止める io.Writer
+type blockingWriter struct {
+	mu      sync.Mutex
+	limit   int
+	buf     bytes.Buffer
+	writes  int
+	unblock chan struct{}
+}
+
+func (w *blockingWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	w.writes++
+	if room := w.limit - w.buf.Len(); room < len(p) {
+		w.buf.Write(p[:room])
+		w.mu.Unlock()
+		<-w.unblock
+		return room, io.ErrShortWrite
+	}
+	defer w.mu.Unlock()
+	return w.buf.Write(p)
+}
+
+func TestContextWriterStalls(t *testing.T) {
+	bw := &blockingWriter{limit: 1024, unblock: make(chan struct{})}
+	defer close(bw.unblock)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	w := newContextWriter(ctx, bw)
+	defer w.stop()
+
+	start := time.Now()
+	var err error
+	chunk := bytes.Repeat([]byte{'x'}, 256)
+	for i := 0; i < 16 && err == nil; i++ {
+		_, err = w.Write(chunk)
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Errorf("returned after %v", d)
+	}
+	var stalled *outputStalledError
+	if !errors.As(err, &stalled) || !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("error %v, want a stalled output", err)
+	}
+	if want := "output stalled: context deadline exceeded after writing 1024 bytes"; err.Error() != want {
+		t.Errorf("error %q, want %q", err, want)
+	}
+	// 中断した後は書き込み先に触れずに同じエラーを返す
+	bw.mu.Lock()
+	writes := bw.writes
+	bw.mu.Unlock()
+	if _, again := w.Write(chunk); again != err {
+		t.Errorf("second write: %v", again)
+	}
+	bw.mu.Lock()
+	defer bw.mu.Unlock()
+	if bw.writes != writes {
+		t.Errorf("wrote %d times after stalling, want %d", bw.writes, writes)
+	}
+}
+
+// 書き込みの期限を設定できるパイプは、ctx の終了で期限を過去にして止まった書き込みを中断する
+func TestContextWriterPipe(t *testing.T) {
+	r, pw, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	defer pw.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	w := newContextWriter(ctx, pw)
+	if w.file == nil {
+		t.Fatal("the pipe has no write deadline")
+	}
+	time.AfterFunc(50*time.Millisecond, cancel)
+	start := time.Now()
+	// パイプの容量 (64KB) を超えて書き込むと、読み手がいないため止まる
+	n, err := w.Write(make([]byte, 1<<20))
+	if d := time.Since(start); d > 2*time.Second {
+		t.Errorf("returned after %v", d)
+	}
+	var stalled *outputStalledError
+	if !errors.As(err, &stalled) || !errors.Is(err, context.Canceled) || stalled.written != int64(n) || n == 0 {
+		t.Fatalf("wrote %d bytes: %v", n, err)
+	}
+	// 監視をやめると期限を外す
+	w.stop()
+	go io.Copy(io.Discard, r)
+	if _, err := pw.Write([]byte("after stop")); err != nil {
+		t.Errorf("write after stop: %v", err)
+	}
+}
+
+func TestContextWriterDirect(t *testing.T) {
+	f, err := os.Create(filepath.Join(t.TempDir(), "out"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	// 通常のファイルには期限を設定せず、書き込みの間で ctx を確かめる
+	w := newContextWriter(ctx, f)
+	if !w.direct || w.file != nil {
+		t.Fatalf("regular file: direct %v, file %v", w.direct, w.file)
+	}
+	if _, err := w.Write([]byte("abc")); err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	// 書き込む前に終了した場合は、止まったのではなく ctx のエラーを返す
+	var stalled *outputStalledError
+	if _, err := w.Write([]byte("def")); !errors.Is(err, context.Canceled) || errors.As(err, &stalled) {
+		t.Errorf("after cancel: %v", err)
+	}
+	if w := newContextWriter(context.Background(), &bytes.Buffer{}); !w.direct {
+		t.Error("a context without Done is not written directly")
+	}
+}
+
+// 1 回の Read で最大 64 バイトを、delay ずつ待ってから返す io.Reader
+// 下の Read を呼び出し始めた時刻を記録する
+type slowReader struct {
+	r     io.Reader
+	delay time.Duration
+
+	mu    sync.Mutex
+	reads []time.Time
+}
+
+func (s *slowReader) Read(p []byte) (int, error) {
+	s.mu.Lock()
+	s.reads = append(s.reads, time.Now())
+	s.mu.Unlock()
+	time.Sleep(s.delay)
+	return s.r.Read(p[:min(len(p), 64)])
+}
+
+// after より後に呼び出し始めた Read の数と、Read の数
+func (s *slowReader) readsAfter(after time.Time) (late, total int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, t := range s.reads {
+		if t.After(after) {
+			late++
+		}
+	}
+	return late, len(s.reads)
+}
+
+// slow の名前のファイルを slowReader で読む fs.FS
+type slowFS struct {
+	fstest.MapFS
+	slow   string
+	reader *slowReader
+}
+
+type slowFile struct {
+	fs.File
+	r io.Reader
+}
+
+func (f slowFile) Read(p []byte) (int, error) { return f.r.Read(p) }
+
+func (s *slowFS) Open(name string) (fs.File, error) {
+	f, err := s.MapFS.Open(name)
+	if err != nil || name != s.slow {
+		return f, err
+	}
+	s.reader = &slowReader{r: f, delay: 10 * time.Millisecond}
+	return slowFile{File: f, r: s.reader}, nil
+}
+
+// -timeout はデコード中の遅い入力も打ち切る
+// 打ち切った後は、読み込み中だった Read の次の Read で止まり、バッチは次のファイルに進む
+func TestTimeoutSlowInput(t *testing.T) {
+	const timeout = 200 * time.Millisecond
+	// ノイズで圧縮の効かない、読み切るのに数秒かかる PNG
+	input := encodeTestImage(t, noisyTestFrame(testImage(128, 128), 1), "png")
+	f := newBatchFlags(io.Discard)
+	if err := f.parse([]string{"-tile", "8", "-quiet", "-timeout", timeout.String()}); err != nil {
+		t.Fatal(err)
+	}
+	p := f.pipeline(discardLogger)
+
+	slow := &slowReader{r: bytes.NewReader(input), delay: 10 * time.Millisecond}
+	start := time.Now()
+	err := p.run(context.Background(), "slow.png", slow, io.Discard, nil)
+	elapsed := time.Since(start)
+	var timeoutErr *timeoutError
+	var stageErr *stageError
+	if !errors.As(err, &timeoutErr) || !errors.Is(err, context.DeadlineExceeded) || !errors.As(err, &stageErr) || stageErr.stage != stageDecode {
+		t.Fatalf("error %v, want a timeout while decoding", err)
+	}
+	if elapsed > timeout+time.Second {
+		t.Errorf("returned after %v", elapsed)
+	}
+	// 期限の後に始まった Read はなく、戻った後も読み続けない
+	// (期限の直前に ctx を確認した Read は、delay の半分より前に始まる)
+	late, total := slow.readsAfter(start.Add(timeout + slow.delay/2))
+	if late != 0 {
+		t.Errorf("%d of %d reads started after the deadline", late, total)
+	}
+	if total >= len(input)/64 {
+		t.Errorf("read the whole input in %d reads", total)
+	}
+	time.Sleep(5 * slow.delay)
+	if _, after := slow.readsAfter(start); after != total {
+		t.Errorf("%d reads after returning", after-total)
+	}
+
+	fsys := &slowFS{MapFS: fstest.MapFS{
+		"a-slow.png": {Data: input},
+		"b.png":      {Data: input},
+	}, slow: "a-slow.png"}
+	out := t.TempDir()
+	report, firstErr, err := batch{fsys: fsys, inName: "in", outDir: out}.run(context.Background(), p, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !errors.As(firstErr, &timeoutErr) || report.Total != 2 || report.Failed != 1 {
+		t.Fatalf("total %d, failed %d, first error %v", report.Total, report.Failed, firstErr)
+	}
+	for _, file := range report.Files {
+		wantOK := filepath.Base(file.Input) == "b.png"
+		if (file.Status == "ok") != wantOK || !wantOK && !strings.Contains(file.Error, "timed out after "+timeout.String()) {
+			t.Errorf("%s: status %q, error %q", file.Input, file.Status, file.Error)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(out, "b.jpg")); err != nil {
+		t.Errorf("the file after the timeout was not processed: %v", err)
+	}
+}
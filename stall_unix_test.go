@@ -0,0 +1,40 @@
+//go:build linux || darwin
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// 読み手が受け取らない名前付きパイプへの出力は -timeout で失敗し、パイプを削除しない
+func TestApplyStalledFIFO(t *testing.T) {
+	dir := t.TempDir()
+	in, fifo := filepath.Join(dir, "in.png"), filepath.Join(dir, "out.ppm")
+	writeTestImage(t, in, testImage(600, 400))
+	if err := syscall.Mkfifo(fifo, 0o600); err != nil {
+		t.Skip("mkfifo:", err)
+	}
+	// 開くだけで読まない読み手 (これがないと書き込み側の open で止まる)
+	reader, err := os.OpenFile(fifo, os.O_RDONLY|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+
+	start := time.Now()
+	res := runCLI(t, "apply", "-in", in, "-out", fifo, "-tile", "8", "-timeout", "300ms", "-quiet")
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("returned after %v", d)
+	}
+	if res.code != exitOutput || !strings.Contains(res.stderr, "output stalled: context deadline exceeded after writing") {
+		t.Errorf("exit code = %d, want %d (stderr: %s)", res.code, exitOutput, res.stderr)
+	}
+	if info, err := os.Stat(fifo); err != nil || info.Mode()&os.ModeNamedPipe == 0 {
+		t.Errorf("the FIFO was removed: %v", err)
+	}
+}
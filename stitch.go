@@ -0,0 +1,43 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/yashikota/go-streaming-image-mosaic/mosaic"
+)
+
+// -format stitch の出力
+const formatStitch = "stitch"
+
+// -stitch-legend を省略した場合の凡例の書き出し先 (図案の拡張子を除いて _legend.csv を付ける)
+func defaultStitchLegend(out string) string {
+	return strings.TrimSuffix(out, filepath.Ext(out)) + "_legend.csv"
+}
+
+// 凡例の CSV の見出し
+var stitchLegendHeader = []string{"symbol", "code", "name", "hex", "stitches"}
+
+// 図案の凡例を CSV で path に書き出す
+func writeStitchLegend(path string, legend []mosaic.StitchLegendEntry) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	w := csv.NewWriter(file)
+	w.Write(stitchLegendHeader)
+	for _, e := range legend {
+		c := e.Thread.Color
+		w.Write([]string{e.Symbol, e.Thread.Code, e.Thread.Name, fmt.Sprintf("#%02X%02X%02X", c.R, c.G, c.B), strconv.Itoa(e.Count)})
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/csv"
+	"image"
+	"image/color"
+	"image/draw"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// 4 色の糸と同じ色のタイルだけの画像から、4 行の凡例と図案を書き出す
+// 凡例は刺すマスの多い順に並び、その順に記号を割り当てる
+func TestApplyStitchLegend(t *testing.T) {
+	threads := []struct {
+		symbol    string
+		code, hex string
+		c         color.NRGBA
+		tiles     int
+	}{
+		{"A", "310", "#000000", color.NRGBA{0, 0, 0, 255}, 24},
+		{"B", "B5200", "#FFFFFF", color.NRGBA{255, 255, 255, 255}, 18},
+		{"C", "666", "#E31D42", color.NRGBA{0xe3, 0x1d, 0x42, 255}, 12},
+		{"D", "907", "#C7E666", color.NRGBA{0xc7, 0xe6, 0x66, 255}, 6},
+	}
+	// 8px のタイルが 10×6 並ぶ画像を、行優先の順に threads の色で塗る
+	img := image.NewNRGBA(image.Rect(0, 0, 80, 48))
+	want := make([]color.NRGBA, 0, 60)
+	for _, th := range threads {
+		for i := 0; i < th.tiles; i++ {
+			want = append(want, th.c)
+		}
+	}
+	for n, c := range want {
+		x, y := n%10*8, n/10*8
+		draw.Draw(img, image.Rect(x, y, x+8, y+8), image.NewUniform(c), image.Point{}, draw.Src)
+	}
+	dir := t.TempDir()
+	in := filepath.Join(dir, "in.png")
+	writeTestImage(t, in, img)
+	out := filepath.Join(dir, "pattern.png")
+	if res := runCLI(t, "apply", "-in", in, "-out", out, "-format", "stitch", "-tile", "8", "-quiet"); res.code != exitOK {
+		t.Fatalf("exit code = %d (stderr: %s)", res.code, res.stderr)
+	}
+
+	file, err := os.Open(filepath.Join(dir, "pattern_legend.csv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	rows, err := csv.NewReader(file).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(rows[0], ",") != strings.Join(stitchLegendHeader, ",") {
+		t.Errorf("header %v", rows[0])
+	}
+	if len(rows) != 1+len(threads) {
+		t.Fatalf("%d legend entries, want %d", len(rows)-1, len(threads))
+	}
+	for i, th := range threads {
+		row := rows[i+1]
+		if row[0] != th.symbol || row[1] != th.code || row[3] != th.hex || row[4] != strconv.Itoa(th.tiles) {
+			t.Errorf("legend %d = %v, want symbol %s, code %s, %s, %d stitches", i, row, th.symbol, th.code, th.hex, th.tiles)
+		}
+	}
+
+	// 1 マスは 16px で、外周の線の分だけ 2px 大きい
+	chart := readTestImage(t, out)
+	if chart.Rect.Dx() != 10*16+2 || chart.Rect.Dy() != 6*16+2 {
+		t.Fatalf("chart %v, want 162x98", chart.Rect)
+	}
+	for n, c := range want {
+		// 線と記号を避けた、マスの左上の画素
+		x, y := n%10*16+2, n/10*16+2
+		if got := chart.NRGBAAt(x, y); got != c {
+			t.Errorf("cell (%d, %d) = %v, want %v", n%10, n/10, got, c)
+		}
+	}
+}
@@ -0,0 +1,344 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"image"
+	"io"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/yashikota/go-streaming-image-mosaic/mosaic"
+)
+
+// -json で出力する要約のための、入力ごとの処理の記録
+// 画像を 1 枚ずつ順に処理する場合にだけ使う (複数のゴルーチンから同時に記録してはならない)
+type summaryLog struct {
+	files    map[string]*runStats  // 入力の名前ごとの記録
+	options  mosaic.SummaryOptions // 処理を始める前に失敗した入力の要約に使う設定
+	settings mosaic.Options
+}
+
+// p で処理する入力の記録
+func newSummaryLog(p pipeline) *summaryLog {
+	return &summaryLog{files: map[string]*runStats{}, options: summaryOptions(p), settings: p.settings}
+}
+
+// 1 つの入力の処理の記録
+type runStats struct {
+	start     time.Time
+	summary   mosaic.FileSummary
+	durations map[string]time.Duration // 段階ごとの時間 (処理の時間は残りから求める)
+	pixels    *mosaic.PixelHash        // -digest で処理結果の画素の Digest を求める場合 (nil の場合は求めない)
+	heap      int64                    // 前の段階の終わりの runtime.MemStats.HeapInuse
+}
+
+// 入力 name の処理の記録を始める
+func (l *summaryLog) begin(name string) *runStats {
+	s := &runStats{
+		start:     time.Now(),
+		summary:   mosaic.FileSummary{Input: name, Options: l.options, Settings: l.settings, Warnings: []mosaic.Warning{}},
+		durations: map[string]time.Duration{},
+		heap:      heapInuse(),
+	}
+	l.files[name] = s
+	return s
+}
+
+// 入力 in を out に書き出した処理の要約
+// 処理を始める前に失敗した入力は、入出力とエラーだけの要約にする
+func (l *summaryLog) file(in, out string, err error) mosaic.FileSummary {
+	summary := mosaic.FileSummary{Input: in, Options: l.options, Settings: l.settings, Warnings: []mosaic.Warning{}}
+	if s := l.files[in]; s != nil {
+		summary = s.summary
+	}
+	summary.Output = out
+	summary.Status = "ok"
+	if err != nil {
+		summary.Status = "failed"
+		summary.Error = err.Error()
+	}
+	return summary
+}
+
+// バッチ処理の結果の要約
+// 処理しなかったファイルは結果の状態 (skipped など) だけの要約にする
+func (l *summaryLog) batch(report batchReport) mosaic.RunSummary {
+	summary := mosaic.RunSummary{Total: report.Total, Failed: report.Failed, Skipped: report.Skipped, Files: make([]mosaic.FileSummary, 0, len(report.Files))}
+	for _, result := range report.Files {
+		file := l.file(result.Input, result.Output, nil)
+		file.Status, file.Error = result.Status, result.Error
+		if l.files[result.Input] == nil {
+			file.Timing.Total = result.Duration
+		}
+		summary.Files = append(summary.Files, file)
+	}
+	return summary
+}
+
+// 警告を記録するロガー
+// 要約と p.onWarning のどちらにも記録しない場合は logger のまま
+func (p pipeline) warningLogger(logger *slog.Logger) *slog.Logger {
+	if p.stats == nil && p.onWarning == nil {
+		return logger
+	}
+	return slog.New(&warningRecorder{Handler: logger.Handler(), record: func(w mosaic.Warning) {
+		if p.stats != nil {
+			p.stats.summary.Warnings = append(p.stats.summary.Warnings, w)
+		}
+		if p.onWarning != nil {
+			p.onWarning(w)
+		}
+	}})
+}
+
+// 処理に使った設定と入力の画像を記録する
+func (s *runStats) resolved(p pipeline, format string, width, height int) {
+	if s == nil {
+		return
+	}
+	s.summary.Format, s.summary.Width, s.summary.Height = format, width, height
+	s.summary.Options, s.summary.Settings = summaryOptions(p), p.settings
+}
+
+// -region-min-tiles で範囲ごとに選んだタイルの大きさを記録する
+func (s *runStats) regionTiles(tiles []int) {
+	if s != nil {
+		s.summary.Options.RegionTiles = tiles
+	}
+}
+
+// bounds の処理結果の画素の Digest を求め始める
+func (s *runStats) startDigest(bounds image.Rectangle) {
+	if s != nil {
+		s.pixels = mosaic.NewPixelHash(bounds)
+	}
+}
+
+// 処理済みの行を Digest に加える (上の行から順に渡すこと)
+func (s *runStats) hashRows(img *image.NRGBA, rect image.Rectangle) {
+	if s != nil && s.pixels != nil {
+		// 順に渡せなかった場合は Digest を求めない (Sum が false になる)
+		s.pixels.Write(img, rect)
+	}
+}
+
+// 処理済みの画像全体を Digest に加える
+func (s *runStats) hashImage(img *image.NRGBA) {
+	s.hashRows(img, img.Rect)
+}
+
+// p の処理の設定の要約
+func summaryOptions(p pipeline) mosaic.SummaryOptions {
+	output := p.format
+	if output == "" {
+		output = p.encoderName()
+	}
+	return mosaic.SummaryOptions{
+		Tile:         p.tile,
+		TileMM:       p.tileMM,
+		DPI:          p.encodeOpts.DPI,
+		GridOrigin:   [2]int{p.gridOrigin.X, p.gridOrigin.Y},
+		Workers:      p.workers,
+		ColorSpace:   p.colorSpace,
+		OutputFormat: output,
+		Quality:      p.encodeOpts.Quality,
+	}
+}
+
+// 処理を始めてからの時間を段階 stage の時間とする
+func (s *runStats) since(stage string) {
+	if s != nil {
+		s.durations[stage] = time.Since(s.start)
+	}
+}
+
+// fn の実行時間を段階 stage の時間に加える
+func (s *runStats) timed(stage string, fn func() error) error {
+	if s == nil {
+		return fn()
+	}
+	start := time.Now()
+	err := fn()
+	s.durations[stage] += time.Since(start)
+	return err
+}
+
+// デコードする前に見積もった主なメモリの確保を記録する
+func (s *runStats) planned(m mosaic.SummaryMemory) {
+	if s != nil {
+		m.HeapInuse = map[string]int64{}
+		s.summary.Memory = &m
+	}
+}
+
+// 前の段階の終わりからの HeapInuse の変化を段階 stage に加える
+func (s *runStats) sampleHeap(stage string) {
+	if s == nil || s.summary.Memory == nil {
+		return
+	}
+	heap := heapInuse()
+	s.summary.Memory.HeapInuse[stage] += heap - s.heap
+	s.heap = heap
+}
+
+// 処理の終わりに全体の時間と出力のバイト数を記録する
+// 処理の後に HeapInuse を記録していない場合 (バンドごとにエンコードする場合など) は、残りの変化を処理の段階に加える
+func (s *runStats) finish(bytesOut int64) {
+	if s == nil {
+		return
+	}
+	if m := s.summary.Memory; m != nil {
+		if _, ok := m.HeapInuse[stageProcess]; ok {
+			s.sampleHeap(stageEncode)
+		} else {
+			s.sampleHeap(stageProcess)
+		}
+	}
+	total := time.Since(s.start)
+	decode, encode := s.durations[stageDecode], s.durations[stageEncode]
+	s.summary.Timing = mosaic.SummaryTiming{
+		Decode:  decode.Seconds(),
+		Process: max(0, total-decode-encode).Seconds(),
+		Encode:  encode.Seconds(),
+		Total:   total.Seconds(),
+	}
+	s.summary.BytesOut = bytesOut
+	if s.pixels != nil {
+		if d, ok := s.pixels.Sum(); ok {
+			s.summary.Digest = d.String()
+		}
+	}
+}
+
+// 主なメモリの確保の見積もりと段階ごとの HeapInuse の変化をデバッグログに出力する
+func (s *runStats) logMemory(logger *slog.Logger) {
+	if s == nil || s.summary.Memory == nil {
+		return
+	}
+	m := s.summary.Memory
+	args := []any{
+		"planned", byteSize(m.Planned), "decoded", byteSize(m.Decoded), "source", byteSize(m.Source),
+		"bands", byteSize(m.Bands), "output", byteSize(m.Output), "encoder", byteSize(m.Encoder),
+	}
+	for _, stage := range []string{stageDecode, stageProcess, stageEncode} {
+		if delta, ok := m.HeapInuse[stage]; ok {
+			args = append(args, "heap_"+stage, byteSize(delta))
+		}
+	}
+	logger.Debug("memory", args...)
+}
+
+// CLI が記録する警告の種類 (処理の警告は mosaic.Warning* の種類)
+const (
+	warnGeneric      mosaic.WarningCode = "warning"               // 種類を付けずに出力した警告
+	warnUnsupported  mosaic.WarningCode = "unsupported_option"    // 入力や出力の形式で使えない指定を無視した
+	warnTruncated    mosaic.WarningCode = "truncated_input"       // 途中で切れた JPEG を、復元できた行だけ処理した
+	warnColorProfile mosaic.WarningCode = "color_profile_ignored" // ICC プロファイルを解釈できず、色を sRGB に変換しなかった
+	// 出力の形式に記録できないメタデータ (-tile-mm や -dpi の解像度) を書き出さなかった
+	warnMetadataDropped mosaic.WarningCode = "metadata_dropped"
+	warnProgressive     mosaic.WarningCode = "progressive_to_baseline" // プログレッシブ JPEG の入力をベースラインの JPEG で書き出した
+	warnPaletteGamut    mosaic.WarningCode = "palette_gamut"           // パレットのどの色からも遠いタイルの色を、最も近い色に置き換えた
+)
+
+// 警告以上のログを mosaic.Warning にして記録し、元の Handler にも渡す slog.Handler
+// 元の Handler の出力のレベル (-quiet など) によらず記録する
+type warningRecorder struct {
+	slog.Handler
+	record func(mosaic.Warning)
+}
+
+func (h *warningRecorder) Enabled(ctx context.Context, level slog.Level) bool {
+	return level >= slog.LevelWarn || h.Handler.Enabled(ctx, level)
+}
+
+func (h *warningRecorder) Handle(ctx context.Context, r slog.Record) error {
+	if r.Level >= slog.LevelWarn {
+		h.record(logWarning(r))
+	}
+	if !h.Handler.Enabled(ctx, r.Level) {
+		return nil
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h *warningRecorder) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &warningRecorder{Handler: h.Handler.WithAttrs(attrs), record: h.record}
+}
+
+func (h *warningRecorder) WithGroup(name string) slog.Handler {
+	return &warningRecorder{Handler: h.Handler.WithGroup(name), record: h.record}
+}
+
+// ログのレコードの警告
+// code の属性を警告の種類にし (ない場合は warnGeneric)、ほかの属性を Fields にする
+func logWarning(r slog.Record) mosaic.Warning {
+	w := mosaic.Warning{Code: warnGeneric, Message: r.Message}
+	r.Attrs(func(a slog.Attr) bool {
+		if a.Key == "code" {
+			w.Code = mosaic.WarningCode(a.Value.String())
+			return true
+		}
+		if w.Fields == nil {
+			w.Fields = map[string]any{}
+		}
+		// JSON にできない値 (error など) は文字列にする
+		switch v := a.Value.Resolve().Any().(type) {
+		case error:
+			w.Fields[a.Key] = v.Error()
+		case fmt.Stringer:
+			w.Fields[a.Key] = v.String()
+		default:
+			w.Fields[a.Key] = v
+		}
+		return true
+	})
+	return w
+}
+
+// 要約を JSON で path (空の場合は stdout) に書き出す
+func writeSummaryTo(path string, stdout io.Writer, summary mosaic.RunSummary) error {
+	if path == "" {
+		return writeSummary(stdout, summary)
+	}
+	file, err := os.Create(path)
+	if err != nil {
+		return &outputError{path: path, err: err}
+	}
+	if err := writeSummary(file, summary); err != nil {
+		file.Close()
+		return &outputError{path: path, err: err}
+	}
+	if err := file.Close(); err != nil {
+		return &outputError{path: path, err: err}
+	}
+	return nil
+}
+
+// 要約を JSON で w に書き出す
+func writeSummary(w io.Writer, summary mosaic.RunSummary) error {
+	summary.Version = mosaic.SummaryVersion
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(summary)
+}
+
+// 処理に成功したファイルの Digest を sha256sum に似た "Digest  出力のパス" の行で書き出す
+// Digest を求められなかったファイル (アニメーションやブロックごとの TIFF など) は警告を記録する
+func writeDigests(w io.Writer, logger *slog.Logger, files []mosaic.FileSummary) error {
+	for _, file := range files {
+		if file.Status != "ok" {
+			continue
+		}
+		if file.Digest == "" {
+			logger.Warn("digest is not available for this output", "input", file.Input)
+			continue
+		}
+		if _, err := fmt.Fprintf(w, "%s  %s\n", file.Digest, file.Output); err != nil {
+			return &outputError{path: stdoutPath, err: err}
+		}
+	}
+	return nil
+}
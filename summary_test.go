@@ -0,0 +1,182 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/yashikota/go-streaming-image-mosaic/mosaic"
+)
+
+// 要約の JSON を RunSummary と、フィールドの有無を調べるための map の両方に読み込む
+func decodeSummary(t *testing.T, data []byte) (mosaic.RunSummary, map[string]any) {
+	t.Helper()
+	var summary mosaic.RunSummary
+	if err := json.Unmarshal(data, &summary); err != nil {
+		t.Fatalf("summary %q: %v", data, err)
+	}
+	var raw map[string]any
+	if err := json.Unmarshal(data, &raw); err != nil {
+		t.Fatal(err)
+	}
+	return summary, raw
+}
+
+// 要約の各ファイルに欠かせないフィールドがあるかを確かめる
+func assertSummaryFields(t *testing.T, raw map[string]any) {
+	t.Helper()
+	for _, key := range []string{"version", "total", "failed", "skipped", "files"} {
+		if _, ok := raw[key]; !ok {
+			t.Errorf("summary has no %q", key)
+		}
+	}
+	files, _ := raw["files"].([]any)
+	for i, v := range files {
+		file, _ := v.(map[string]any)
+		for _, key := range []string{"input", "output", "status", "options", "settings", "timing", "bytes_out", "warnings"} {
+			if _, ok := file[key]; !ok {
+				t.Errorf("file %d has no %q", i, key)
+			}
+		}
+		if file["status"] != "ok" {
+			continue
+		}
+		timing, _ := file["timing"].(map[string]any)
+		for _, key := range []string{"decode", "process", "encode", "total"} {
+			if _, ok := timing[key]; !ok {
+				t.Errorf("file %d timing has no %q", i, key)
+			}
+		}
+		options, _ := file["options"].(map[string]any)
+		for _, key := range []string{"tile", "workers", "color_space", "output_format"} {
+			if _, ok := options[key]; !ok {
+				t.Errorf("file %d options has no %q", i, key)
+			}
+		}
+	}
+}
+
+func TestApplyJSONSummary(t *testing.T) {
+	dir := t.TempDir()
+	in, out := filepath.Join(dir, "in.png"), filepath.Join(dir, "out.png")
+	writeTestImage(t, in, testImage(60, 40))
+
+	// -tile-mm を -dpi で換算したタイルの大きさを記録する (5mm は 300dpi で 59px)
+	res := runCLI(t, "apply", "-json", "-tile-mm", "5", "-dpi", "300", "-parallel", "2", "-in", in, "-out", out, "-quiet")
+	if res.code != exitOK {
+		t.Fatalf("exit code = %d (stderr: %s)", res.code, res.stderr)
+	}
+	summary, raw := decodeSummary(t, []byte(res.stdout))
+	assertSummaryFields(t, raw)
+	if summary.Version != mosaic.SummaryVersion || summary.Total != 1 || summary.Failed != 0 || len(summary.Files) != 1 {
+		t.Fatalf("summary %+v", summary)
+	}
+	file := summary.Files[0]
+	info, err := os.Stat(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if file.Input != in || file.Output != out || file.Status != "ok" || file.Format != "png" || file.Width != 60 || file.Height != 40 || file.BytesOut != info.Size() {
+		t.Errorf("file %+v", file)
+	}
+	if o := file.Options; o.Tile != 59 || o.TileMM != 5 || o.Workers != 2 || o.ColorSpace != "rgb" || o.OutputFormat != "png" {
+		t.Errorf("options %+v", o)
+	}
+	if file.Timing.Total <= 0 || file.Timing.Total < file.Timing.Decode {
+		t.Errorf("timing %+v", file.Timing)
+	}
+}
+
+func TestApplyJSONSummaryWarnings(t *testing.T) {
+	dir := t.TempDir()
+	in, report := filepath.Join(dir, "in.png"), filepath.Join(dir, "summary.json")
+	writeTestImage(t, in, testImage(20, 20))
+
+	// 標準出力に画像を書き出す場合は -report に書き出す
+	res := runCLI(t, "apply", "-json", "-report", report, "-tile", "64", "-in", in, "-out", "-", "-quiet")
+	if res.code != exitOK {
+		t.Fatalf("exit code = %d (stderr: %s)", res.code, res.stderr)
+	}
+	data, err := os.ReadFile(report)
+	if err != nil {
+		t.Fatal(err)
+	}
+	summary, raw := decodeSummary(t, data)
+	assertSummaryFields(t, raw)
+	file := summary.Files[0]
+	if file.Output != stdoutPath || file.BytesOut != int64(len(res.stdout)) {
+		t.Errorf("output %q, %d bytes, wrote %d", file.Output, file.BytesOut, len(res.stdout))
+	}
+	// 画像より大きいタイルは切り詰めて警告する
+	if len(file.Warnings) == 0 || file.Warnings[0].Code != "tile_clamped" {
+		t.Errorf("warnings %+v", file.Warnings)
+	}
+}
+
+func TestBatchJSONSummary(t *testing.T) {
+	in, out := batchFixture(t), filepath.Join(t.TempDir(), "out")
+	report := filepath.Join(t.TempDir(), "summary.json")
+	res := runCLI(t, "batch", "-json", "-report", report, "-in", in, "-out", out, "-tile", "8", "-quiet")
+	if res.code != exitPartial {
+		t.Fatalf("exit code = %d, want %d (stderr: %s)", res.code, exitPartial, res.stderr)
+	}
+	data, err := os.ReadFile(report)
+	if err != nil {
+		t.Fatal(err)
+	}
+	summary, raw := decodeSummary(t, data)
+	assertSummaryFields(t, raw)
+	if summary.Version != mosaic.SummaryVersion || summary.Total != 4 || summary.Failed != 2 || len(summary.Files) != 4 {
+		t.Fatalf("summary: version %d, total %d, failed %d, %d files", summary.Version, summary.Total, summary.Failed, len(summary.Files))
+	}
+	for _, file := range summary.Files {
+		switch file.Status {
+		case "ok":
+			if file.Width == 0 || file.BytesOut == 0 || file.Options.Tile != 8 {
+				t.Errorf("%s: %+v", file.Input, file)
+			}
+		case "failed":
+			if file.Error == "" {
+				t.Errorf("%s failed without an error", file.Input)
+			}
+		default:
+			t.Errorf("%s: status %q", file.Input, file.Status)
+		}
+	}
+}
+
+// -region-min-tiles で範囲ごとに選んだタイルの大きさを、要約と -v のログに記録する
+func TestApplyRegionMinTiles(t *testing.T) {
+	dir := t.TempDir()
+	in, out := filepath.Join(dir, "in.png"), filepath.Join(dir, "out.png")
+	writeTestImage(t, in, testImage(400, 300))
+	regions := []string{"-region", "10,10,60,45", "-region", "100,100,100,100", "-region", "0,0,400,300"}
+	res := runCLI(t, append([]string{"apply", "-json", "-v", "-tile", "100", "-region-min-tiles", "4", "-in", in, "-out", out}, regions...)...)
+	if res.code != exitOK {
+		t.Fatalf("exit code = %d (stderr: %s)", res.code, res.stderr)
+	}
+	summary, _ := decodeSummary(t, []byte(res.stdout))
+	if got := summary.Files[0].Options.RegionTiles; len(got) != 3 || got[0] != 11 || got[1] != 25 || got[2] != 75 {
+		t.Errorf("region tiles %v, want [11 25 75]", got)
+	}
+	if s := summary.Files[0].Settings; s.RegionMinTiles != 4 || s.MinTile != 4 {
+		t.Errorf("settings %+v", s)
+	}
+	if !strings.Contains(res.stderr, "region tile size") || !strings.Contains(res.stderr, "tile=11") {
+		t.Errorf("stderr does not log the region tile sizes:\n%s", res.stderr)
+	}
+
+	// 指定しない場合は記録しない
+	res = runCLI(t, append([]string{"apply", "-json", "-tile", "100", "-in", in, "-out", out, "-quiet"}, regions...)...)
+	if res.code != exitOK {
+		t.Fatalf("exit code = %d (stderr: %s)", res.code, res.stderr)
+	}
+	if summary, _ := decodeSummary(t, []byte(res.stdout)); summary.Files[0].Options.RegionTiles != nil {
+		t.Errorf("region tiles %v without -region-min-tiles", summary.Files[0].Options.RegionTiles)
+	}
+	if res := runCLI(t, "apply", "-tile", "8", "-region-min-tiles", "-1", "-in", in, "-out", out, "-quiet"); res.code != exitUsage {
+		t.Errorf("negative -region-min-tiles: exit code = %d, want %d", res.code, exitUsage)
+	}
+}
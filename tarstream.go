@@ -0,0 +1,127 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+
+	"github.com/yashikota/go-streaming-image-mosaic/mosaic"
+)
+
+// tar のフラグ
+type tarFlags struct {
+	*commonFlags
+}
+
+func newTarFlags(stderr io.Writer) *tarFlags {
+	return &tarFlags{commonFlags: newCommonFlags("tar", "[flags] < in.tar > out.tar", stderr)}
+}
+
+// 標準入力の tar の画像をモザイク処理し、tar として標準出力に書き出す
+// 例: tar cf - photos/ | mosaic tar | tar xf - -C out/
+func runTar(args []string, stdout, stderr io.Writer) error {
+	f := newTarFlags(stderr)
+	if err := f.parse(args); err != nil {
+		return err
+	}
+	if f.fs.NArg() > 0 {
+		return &usageError{errors.New("tar reads the archive from stdin and takes no arguments")}
+	}
+
+	logger, err := f.logger(stderr)
+	if err != nil {
+		return err
+	}
+	p := f.pipeline(logger)
+	total, failed, err := processTar(context.Background(), p, logger, os.Stdin, stdout)
+	if err != nil {
+		return err
+	}
+	logger.Info("tar finished", "total", total, "failed", failed)
+	if failed > 0 {
+		return &partialError{failed: failed, total: total}
+	}
+	return nil
+}
+
+// r の tar のエントリを順に w の tar に書き写し、画像のエントリはモザイク処理する
+// 処理した画像の数と失敗した画像の数を返却し、tar の読み書きに失敗した場合は err を返却
+// 画像は名前の拡張子の形式 (元の画像と同じ形式) で書き出し、ヘッダーは大きさのみを書き換える
+// 名前やモード、所有者、更新日時、PAX の拡張ヘッダーは元のまま引き継ぎ、ハードリンクとシンボリックリンクもそのまま書き写す
+// 失敗した画像のエントリは出力に含めない (元の画像をそのまま残さないため)
+// メモリに保持するのは処理中の 1 枚のエンコード結果だけで、画像以外のエントリは読み込みながら書き写す
+func processTar(ctx context.Context, p pipeline, logger *slog.Logger, r io.Reader, w io.Writer) (total, failed int, err error) {
+	tr := tar.NewReader(r)
+	tw := tar.NewWriter(w)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return total, failed, &inputError{path: "stdin", err: err}
+		}
+
+		switch {
+		case header.Typeflag == tar.TypeXGlobalHeader:
+			// グローバルヘッダーには PAX のレコード以外を設定できない
+			header = &tar.Header{Typeflag: header.Typeflag, Name: header.Name, PAXRecords: header.PAXRecords, Format: header.Format}
+		case header.Typeflag == tar.TypeReg && isImageFile(header.Name):
+			total++
+			var buf bytes.Buffer
+			// 名前を変えずに済むよう、拡張子の形式で書き出す
+			if p.encoder, _, err = mosaic.ResolveEncoder("", header.Name); err == nil {
+				err = p.run(ctx, header.Name, tr, &buf, nil)
+			}
+			if err != nil {
+				failed++
+				logger.Error("file failed", "input", header.Name, "error", err)
+				continue
+			}
+			header.Size = int64(buf.Len())
+			if err := tw.WriteHeader(header); err != nil {
+				return total, failed, &outputError{path: "stdout", err: fmt.Errorf("%s: %w", header.Name, err)}
+			}
+			if _, err := tw.Write(buf.Bytes()); err != nil {
+				return total, failed, &outputError{path: "stdout", err: err}
+			}
+			continue
+		}
+
+		if err := tw.WriteHeader(header); err != nil {
+			return total, failed, &outputError{path: "stdout", err: fmt.Errorf("%s: %w", header.Name, err)}
+		}
+		if err := copyTarEntry(tw, tr); err != nil {
+			return total, failed, err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return total, failed, &outputError{path: "stdout", err: err}
+	}
+	return total, failed, nil
+}
+
+// エントリの内容を書き写す
+// 読み込みと書き込みのどちらで失敗したかに応じたエラーを返却
+func copyTarEntry(tw *tar.Writer, tr *tar.Reader) error {
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := tr.Read(buf)
+		if n > 0 {
+			if _, werr := tw.Write(buf[:n]); werr != nil {
+				return &outputError{path: "stdout", err: werr}
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return &inputError{path: "stdin", err: err}
+		}
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"image"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/yashikota/go-streaming-image-mosaic/mosaic"
+)
+
+// tar のエントリのヘッダーと内容
+type tarEntry struct {
+	header tar.Header
+	data   []byte
+}
+
+// entries を順に書き込んだ tar
+func buildTestTar(t *testing.T, entries []tarEntry) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, e := range entries {
+		h := e.header
+		h.Size = int64(len(e.data))
+		if err := tw.WriteHeader(&h); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write(e.data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// tar のすべてのエントリを読み込む
+func readTestTar(t *testing.T, data []byte) []tarEntry {
+	t.Helper()
+	var entries []tarEntry
+	tr := tar.NewReader(bytes.NewReader(data))
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			return entries
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, tarEntry{header: *h, data: body})
+	}
+}
+
+// tar のフラグ args から作ったパイプライン
+func tarPipeline(t *testing.T, args ...string) pipeline {
+	t.Helper()
+	f := newTarFlags(io.Discard)
+	if err := f.parse(args); err != nil {
+		t.Fatal(err)
+	}
+	return f.pipeline(discardLogger)
+}
+
+func TestProcessTarRoundTrip(t *testing.T) {
+	mtime := time.Date(2024, 5, 6, 7, 8, 9, 0, time.UTC)
+	file := func(name string, data []byte) tarEntry {
+		return tarEntry{tar.Header{Typeflag: tar.TypeReg, Name: name, Mode: 0o640, Uid: 1000, Gid: 100, ModTime: mtime, Format: tar.FormatPAX}, data}
+	}
+	link := func(typ byte, name, target string) tarEntry {
+		return tarEntry{header: tar.Header{Typeflag: typ, Name: name, Linkname: target, Mode: 0o777, ModTime: mtime, Format: tar.FormatPAX}}
+	}
+	png := file("photos/a.png", encodeTestImage(t, testImage(40, 24), "png"))
+	png.header.PAXRecords = map[string]string{"SCHILY.xattr.user.origin": "camera"}
+	entries := []tarEntry{
+		{header: tar.Header{Typeflag: tar.TypeDir, Name: "photos/", Mode: 0o755, ModTime: mtime, Format: tar.FormatPAX}},
+		png,
+		file("photos/b.jpg", encodeTestImage(t, testImage(32, 32), "jpeg")),
+		file("photos/notes.txt", []byte("not an image\n")),
+		link(tar.TypeSymlink, "photos/latest.png", "a.png"),
+		link(tar.TypeLink, "photos/copy.jpg", "photos/b.jpg"),
+	}
+
+	var out bytes.Buffer
+	p := tarPipeline(t, "-tile", "8")
+	total, failed, err := processTar(context.Background(), p, discardLogger, bytes.NewReader(buildTestTar(t, entries)), &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total != 2 || failed != 0 {
+		t.Fatalf("total %d, failed %d", total, failed)
+	}
+
+	got := readTestTar(t, out.Bytes())
+	if len(got) != len(entries) {
+		t.Fatalf("%d entries, want %d", len(got), len(entries))
+	}
+	for i, g := range got {
+		want := entries[i]
+		h, w := g.header, want.header
+		// 名前、リンク先、モード、所有者、更新日時は元のまま
+		if h.Name != w.Name || h.Linkname != w.Linkname || h.Typeflag != w.Typeflag || h.Mode != w.Mode || h.Uid != w.Uid || h.Gid != w.Gid || !h.ModTime.Equal(w.ModTime) {
+			t.Errorf("entry %d header changed: %+v, want %+v", i, h, w)
+		}
+		if h.Size != int64(len(g.data)) {
+			t.Errorf("%s: header size %d, %d bytes", h.Name, h.Size, len(g.data))
+		}
+		if h.Typeflag != tar.TypeReg || !isImageFile(h.Name) {
+			if !bytes.Equal(g.data, want.data) {
+				t.Errorf("%s changed", h.Name)
+			}
+			continue
+		}
+		img, format, err := image.Decode(bytes.NewReader(g.data))
+		if err != nil {
+			t.Fatalf("%s: %v", h.Name, err)
+		}
+		if bytes.Equal(g.data, want.data) {
+			t.Errorf("%s was not processed", h.Name)
+		}
+		// 元の画像と同じ形式で書き出す
+		if _, wantFormat, _ := image.DecodeConfig(bytes.NewReader(want.data)); format != wantFormat {
+			t.Errorf("%s: written as %s, want %s", h.Name, format, wantFormat)
+		}
+		if format == "png" && !isMosaic(mosaic.ConvertToNRGBA(img), 8) {
+			t.Errorf("%s is not a mosaic of 8px tiles", h.Name)
+		}
+	}
+	if v := got[1].header.PAXRecords["SCHILY.xattr.user.origin"]; v != "camera" {
+		t.Errorf("PAX record lost: %q", v)
+	}
+}
+
+func TestProcessTarDropsFailedImages(t *testing.T) {
+	entries := []tarEntry{
+		{tar.Header{Typeflag: tar.TypeReg, Name: "broken.png", Mode: 0o644}, []byte("not a png")},
+		{tar.Header{Typeflag: tar.TypeReg, Name: "ok.png", Mode: 0o644}, encodeTestImage(t, testImage(16, 16), "png")},
+	}
+	var out bytes.Buffer
+	p := tarPipeline(t, "-tile", "8")
+	total, failed, err := processTar(context.Background(), p, discardLogger, bytes.NewReader(buildTestTar(t, entries)), &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total != 2 || failed != 1 {
+		t.Fatalf("total %d, failed %d", total, failed)
+	}
+	// 失敗した画像を元のまま残さない
+	if got := readTestTar(t, out.Bytes()); len(got) != 1 || got[0].header.Name != "ok.png" {
+		t.Errorf("entries %v", got)
+	}
+}
@@ -0,0 +1,11 @@
+//go:build !linux && !darwin
+
+package main
+
+import "os"
+
+// 端末の幅 (文字数)
+// このプラットフォームでは取得できないため、常に false を返却
+func terminalColumns(f *os.File) (int, bool) {
+	return 0, false
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/yashikota/go-streaming-image-mosaic/internal/tiff"
+	"github.com/yashikota/go-streaming-image-mosaic/mosaic"
+)
+
+// 処理するページの範囲を表すフラグの値 (例: 1,3-5)
+// ページ番号は 1 から数え、空の場合はすべてのページを処理する
+type pageRanges []pageRange
+
+type pageRange struct {
+	first, last int
+}
+
+func (r *pageRanges) String() string {
+	parts := make([]string, len(*r))
+	for i, pr := range *r {
+		parts[i] = strconv.Itoa(pr.first)
+		if pr.last != pr.first {
+			parts[i] += "-" + strconv.Itoa(pr.last)
+		}
+	}
+	return strings.Join(parts, ",")
+}
+
+func (r *pageRanges) Set(s string) error {
+	var ranges pageRanges
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		first, last, isRange := strings.Cut(part, "-")
+		pr, err := parsePageRange(first, last, isRange)
+		if err != nil {
+			return fmt.Errorf("invalid page range %q (want e.g. 1,3-5)", part)
+		}
+		ranges = append(ranges, pr)
+	}
+	*r = ranges
+	return nil
+}
+
+func parsePageRange(first, last string, isRange bool) (pageRange, error) {
+	a, err := strconv.Atoi(strings.TrimSpace(first))
+	if err != nil {
+		return pageRange{}, err
+	}
+	b := a
+	if isRange {
+		if b, err = strconv.Atoi(strings.TrimSpace(last)); err != nil {
+			return pageRange{}, err
+		}
+	}
+	if a < 1 || b < a {
+		return pageRange{}, fmt.Errorf("bad range %d-%d", a, b)
+	}
+	return pageRange{first: a, last: b}, nil
+}
+
+func (r *pageRanges) Get() any {
+	return r.String()
+}
+
+// page ページ目 (1 から数える) を処理するかどうか
+func (r pageRanges) contains(page int) bool {
+	if len(r) == 0 {
+		return true
+	}
+	for _, pr := range r {
+		if page >= pr.first && page <= pr.last {
+			return true
+		}
+	}
+	return false
+}
+
+// TIFF のすべてのページを読み込み、選んだページをモザイク処理して TIFF として w に書き込む
+// ページごとに大きさが異なるため、Processor はページごとに生成する
+// 選んでいないページは処理せずにそのまま書き込み、どのページも解像度のタグを引き継ぐ (-dpi を指定した場合はその解像度にする)
+// IFD はファイルの末尾にあることも多いため、入力はすべて読み込む
+func (p pipeline) runTIFF(ctx context.Context, logger *slog.Logger, start time.Time, r io.Reader, w *countingWriter, progress mosaic.ProgressFunc) error {
+	if p.debugOverlay != "" {
+		logger.Warn("debug overlay is not supported for TIFF", "code", warnUnsupported)
+	}
+	if p.exportTiles != "" {
+		logger.Warn("tile export is not supported for TIFF", "code", warnUnsupported)
+	}
+	if p.animate != nil {
+		logger.Warn("animation is not supported for TIFF; writing TIFF", "code", warnUnsupported)
+	}
+	if len(p.outputs) > 0 {
+		logger.Warn("additional outputs are not supported for TIFF", "code", warnUnsupported)
+	}
+	if p.preview != nil {
+		logger.Warn("preview is not supported for TIFF", "code", warnUnsupported)
+	}
+	if p.format != "" {
+		logger.Warn("output format is not supported for TIFF; writing TIFF", "code", warnUnsupported, "format", p.format)
+	} else if p.encoderName() != "jpeg" && p.encoderName() != "tiff" {
+		logger.Warn("output format is not supported for TIFF; writing TIFF", "code", warnUnsupported, "format", p.encoderName())
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return p.fail(logger, stageDecode, err)
+	}
+	file, err := tiff.Parse(data)
+	if err != nil {
+		return p.fail(logger, stageDecode, err)
+	}
+	p.stats.since(stageDecode)
+	if first, err := file.Config(0); err == nil && p.stats != nil {
+		p.stats.resolved(p, "tiff", first.Width, first.Height)
+		// 出力の形式によらず TIFF で書き出す
+		p.stats.summary.Options.OutputFormat = "tiff"
+	}
+	// 途中のページで失敗して出力が書きかけにならないよう、先にすべてのページの大きさを確認する
+	// ページは 1 つずつ処理するため、メモリの確保は最も大きいページの見積もりにする
+	var largest mosaic.SummaryMemory
+	for i := 0; i < file.NumPages(); i++ {
+		config, err := file.Config(i)
+		if err != nil {
+			return p.fail(logger, stageDecode, fmt.Errorf("page %d: %w", i+1, err))
+		}
+		if err := p.limits.checkConfig(config); err != nil {
+			return p.fail(logger, stageDecode, fmt.Errorf("page %d: %w", i+1, err))
+		}
+		m := p.planMemory(config, decodedBytes(config, "tiff", nil))
+		if err := p.checkHeap(config, m); err != nil {
+			return p.fail(logger, stageDecode, fmt.Errorf("page %d: %w", i+1, err))
+		}
+		if m.Planned > largest.Planned {
+			largest = m
+		}
+	}
+	p.stats.planned(largest)
+	p.stats.sampleHeap(stageDecode)
+
+	enc := tiff.NewEncoder(w, file.NumPages())
+	processed := 0
+	for i := 0; i < file.NumPages(); i++ {
+		var page *tiff.Page
+		err := p.stats.timed(stageDecode, func() (err error) {
+			page, err = file.Page(i)
+			return err
+		})
+		if err != nil {
+			return p.fail(logger, stageDecode, fmt.Errorf("page %d: %w", i+1, err))
+		}
+		out, res := page.Image, page.Resolution
+		if p.dpi > 0 {
+			res = tiff.ResolutionDPI(p.dpi)
+		}
+		if p.pages.contains(i + 1) {
+			processed++
+			size := page.Image.Bounds().Size()
+			logger.Debug("processing page", "page", i+1, "width", size.X, "height", size.Y)
+			// 解像度はページごとに異なることがあるため、タイルの大きさもページごとに換算する
+			dpi, ok := page.Resolution.DPI()
+			pp, err := p.withDensity(logger, dpi, ok)
+			if err != nil {
+				return p.fail(logger, stageDecode, fmt.Errorf("page %d: %w", i+1, err))
+			}
+			src := mosaic.ConvertToNRGBA(page.Image)
+			opts, err := pp.options(logger, progress, src)
+			if err != nil {
+				return p.fail(logger, stageProcess, fmt.Errorf("page %d: %w", i+1, err))
+			}
+			if pp.settings.ProcessesRegions() {
+				out, err = src, mosaic.ProcessRegions(ctx, src, pp.tile, pp.tile, pp.regions(logger, src.Rect), opts...)
+			} else {
+				out, err = mosaic.New(src, pp.tile, pp.tile, opts...).ProcessInPlace(ctx)
+			}
+			if err != nil {
+				return p.fail(logger, stageProcess, fmt.Errorf("page %d: %w", i+1, err))
+			}
+		}
+		if err := p.stats.timed(stageEncode, func() error { return enc.Encode(out, res) }); err != nil {
+			return p.fail(logger, stageEncode, err)
+		}
+	}
+	if err := p.stats.timed(stageEncode, enc.Close); err != nil {
+		return p.fail(logger, stageEncode, err)
+	}
+
+	if p.metrics != nil {
+		p.metrics.imageProcessed("tiff")
+	}
+	first, _ := file.Config(0)
+	logger.Info("processing finished",
+		"format", "tiff", "width", first.Width, "height", first.Height,
+		"pages", file.NumPages(), "processed_pages", processed,
+		"duration", time.Since(start), "bytes_out", w.n)
+	return nil
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/yashikota/go-streaming-image-mosaic/internal/tiff"
+	"github.com/yashikota/go-streaming-image-mosaic/mosaic"
+)
+
+// 大きさと解像度がページごとに異なる 3 ページの TIFF
+func writeMultiPageTIFF(t *testing.T, path string) []*tiff.Page {
+	t.Helper()
+	pages := []*tiff.Page{
+		{Image: testImage(48, 32), Resolution: tiff.ResolutionDPI(300)},
+		{Image: testImage(20, 60), Resolution: tiff.ResolutionDPI(150)},
+		{Image: testImage(33, 17), Resolution: tiff.Resolution{}},
+	}
+	var buf bytes.Buffer
+	enc := tiff.NewEncoder(&buf, len(pages))
+	for _, p := range pages {
+		if err := enc.Encode(p.Image, p.Resolution); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := enc.Close(); err != nil {
+		t.Fatal(err)
+	}
+	writeTestFile(t, path, buf.Bytes())
+	return pages
+}
+
+func TestApplyMultiPageTIFF(t *testing.T) {
+	dir := t.TempDir()
+	in := filepath.Join(dir, "in.tif")
+	pages := writeMultiPageTIFF(t, in)
+
+	tests := []struct {
+		name      string
+		args      []string
+		processed []bool
+		dpi       float64 // 0 の場合は入力の解像度を引き継ぐ
+	}{
+		{"all pages", nil, []bool{true, true, true}, 0},
+		{"selected pages", []string{"-pages", "1,3"}, []bool{true, false, true}, 0},
+		{"range", []string{"-pages", "2-3"}, []bool{false, true, true}, 0},
+		{"dpi", []string{"-pages", "2", "-dpi", "96"}, []bool{false, true, false}, 96},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out := filepath.Join(dir, "out.tif")
+			args := append([]string{"apply", "-in", in, "-out", out, "-tile", "8", "-quiet"}, tt.args...)
+			if res := runCLI(t, args...); res.code != exitOK {
+				t.Fatalf("exit code = %d (stderr: %s)", res.code, res.stderr)
+			}
+			data, err := os.ReadFile(out)
+			if err != nil {
+				t.Fatal(err)
+			}
+			file, err := tiff.Parse(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if file.NumPages() != len(pages) {
+				t.Fatalf("%d pages, want %d", file.NumPages(), len(pages))
+			}
+			for i, in := range pages {
+				page, err := file.Page(i)
+				if err != nil {
+					t.Fatal(err)
+				}
+				want := mosaic.ConvertToNRGBA(in.Image)
+				if tt.processed[i] {
+					want = mosaic.New(want, 8, 8).Process()
+				}
+				// 選んでいないページは入力のまま
+				assertSameNRGBA(t, mosaic.ConvertToNRGBA(page.Image), want)
+				res := in.Resolution
+				if tt.dpi > 0 {
+					res = tiff.ResolutionDPI(tt.dpi)
+				}
+				if page.Resolution != res {
+					t.Errorf("page %d: resolution %+v, want %+v", i+1, page.Resolution, res)
+				}
+			}
+		})
+	}
+}
+
+func TestPageRanges(t *testing.T) {
+	tests := []struct {
+		in       string
+		str      string
+		contains []int
+		excludes []int
+	}{
+		{"", "", []int{1, 2, 100}, nil},
+		{"1", "1", []int{1}, []int{2}},
+		{"1,3-5", "1,3-5", []int{1, 3, 4, 5}, []int{2, 6}},
+		{" 2 - 3 , ,7", "2-3,7", []int{2, 3, 7}, []int{1, 4, 8}},
+		{"4-4", "4", []int{4}, []int{3, 5}},
+	}
+	for _, tt := range tests {
+		var r pageRanges
+		if err := r.Set(tt.in); err != nil {
+			t.Fatalf("Set(%q): %v", tt.in, err)
+		}
+		if r.String() != tt.str {
+			t.Errorf("Set(%q).String() = %q, want %q", tt.in, r.String(), tt.str)
+		}
+		for _, page := range tt.contains {
+			if !r.contains(page) {
+				t.Errorf("%q does not contain %d", tt.in, page)
+			}
+		}
+		for _, page := range tt.excludes {
+			if r.contains(page) {
+				t.Errorf("%q contains %d", tt.in, page)
+			}
+		}
+	}
+	for _, in := range []string{"0", "3-1", "a", "1-", "-2", "1-b"} {
+		var r pageRanges
+		if err := r.Set(in); err == nil {
+			t.Errorf("Set(%q) succeeded", in)
+		}
+	}
+}
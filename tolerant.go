@@ -0,0 +1,345 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/jpeg"
+	"io"
+)
+
+// 8x8 ブロック 1 つの符号化後の最大バイト数
+// 64 個の係数それぞれがハフマン符号 (最大 16 ビット) と付加ビット (16 ビット未満) からなる
+const maxBlockBytes = 64 * (16 + 16) / 8
+
+// 切れた位置の直前のうち、復元できた行の判定で信用しないバイト数
+const tolerantMargin = 64
+
+// 途中で切れた JPEG を、切れた位置以降をゼロのデータで補ってデコードする
+// 返却する画像は元の大きさで、先頭から valid 行が切れる前のデータだけから得られた行
+//
+// 切れた位置の影響を受けない行は、tolerantMargin だけ手前で切った場合のデコード結果と比べて求める
+// ゼロのビット列は常にハフマン符号の最初の符号として読めるため、補ったデータは必ずデコードできる
+func decodeTruncatedJPEG(data []byte) (img image.Image, valid int, err error) {
+	layout, err := parseJPEGLayout(data)
+	if err != nil {
+		return nil, 0, err
+	}
+	scan := layout.lastScan(len(data))
+	if scan == nil {
+		return nil, 0, errors.New("no image data before the end of the file")
+	}
+	if scan.end >= 0 {
+		// 最後のスキャンは揃っており、それ以降だけが欠けている
+		img, err := jpeg.Decode(io.MultiReader(bytes.NewReader(data[:scan.end]), bytes.NewReader(eoi)))
+		if err != nil {
+			return nil, 0, err
+		}
+		return img, img.Bounds().Dy(), nil
+	}
+
+	if img, err := jpeg.Decode(io.MultiReader(bytes.NewReader(data), bytes.NewReader(eoi))); err == nil {
+		// エントロピー符号化データは揃っており、End Of Image だけが欠けている
+		return img, img.Bounds().Dy(), nil
+	}
+	img, err = jpeg.Decode(layout.padded(data, len(data)))
+	if err != nil {
+		return nil, 0, err
+	}
+	ref, err := jpeg.Decode(layout.padded(data, max(0, len(data)-tolerantMargin)))
+	if err != nil {
+		// 手前で切るとヘッダーまで欠ける場合は、ほとんど復元できていない
+		return img, 0, nil
+	}
+	valid = firstDifferentRow(img, ref)
+	if valid < img.Bounds().Dy() {
+		// 切れた位置を含む MCU の行は途中までしか正しくないため、MCU の行単位で切り捨てる
+		// ストリーミングでエンコードできるよう、16 行単位にも揃える
+		step := max(8*layout.maxV, 16)
+		valid -= valid % step
+	}
+	return img, valid, nil
+}
+
+// End Of Image
+var eoi = []byte{0xff, 0xd9}
+
+// JPEG のフレームとスキャンの構成
+type jpegLayout struct {
+	width, height int
+	maxH, maxV    int // サンプリング係数の最大値
+	comps         []jpegComponent
+	scans         []jpegScan
+}
+
+// フレームの成分
+type jpegComponent struct {
+	id   byte
+	h, v int // サンプリング係数
+}
+
+// スキャンの位置と構成
+type jpegScan struct {
+	start   int   // エントロピー符号化データの開始位置
+	end     int   // エントロピー符号化データの終了位置 (データが途中で切れている場合は -1)
+	comps   []int // スキャンに含まれる成分の添字
+	restart int   // リスタート間隔 (MCU の数、0 の場合はリスタートマーカーなし)
+	rsts    []int // リスタートマーカーの位置
+}
+
+// JPEG のマーカーを走査し、フレームとスキャンの構成を取得
+// データが途中で切れている場合は、そこまでに得られた構成を返却する
+func parseJPEGLayout(data []byte) (*jpegLayout, error) {
+	if len(data) < 2 || data[0] != 0xff || data[1] != 0xd8 {
+		return nil, errors.New("not a JPEG")
+	}
+	l := &jpegLayout{}
+	restart := 0
+	for i := 2; i+4 <= len(data); {
+		if data[i] != 0xff {
+			return nil, errors.New("invalid marker")
+		}
+		marker := data[i+1]
+		if marker == 0xff {
+			i++
+			continue
+		}
+		if marker == 0xd8 || marker == 0x01 || (marker >= 0xd0 && marker <= 0xd7) {
+			i += 2
+			continue
+		}
+		if marker == 0xd9 {
+			return nil, errors.New("the file is not truncated")
+		}
+		length := int(binary.BigEndian.Uint16(data[i+2:]))
+		end := i + 2 + length
+		if length < 2 || end > len(data) {
+			break
+		}
+		segment := data[i+4 : end]
+
+		switch {
+		case isSOF(marker):
+			if err := l.parseSOF(segment); err != nil {
+				return nil, err
+			}
+		case marker == 0xdd:
+			if len(segment) < 2 {
+				return nil, errors.New("invalid DRI segment")
+			}
+			restart = int(binary.BigEndian.Uint16(segment))
+		case marker == 0xda:
+			scan, err := l.parseSOS(segment)
+			if err != nil {
+				return nil, err
+			}
+			scan.start, scan.restart = end, restart
+			end = scan.scanEntropyData(data)
+			l.scans = append(l.scans, scan)
+			if end < len(data) && data[end+1] == 0xd9 {
+				return nil, errors.New("the file is not truncated")
+			}
+			if scan.end < 0 {
+				return l, nil
+			}
+		}
+		i = end
+	}
+	if len(l.scans) == 0 {
+		return nil, errors.New("no image data before the end of the file")
+	}
+	return l, nil
+}
+
+// SOF セグメントから画像の大きさと成分を取得
+func (l *jpegLayout) parseSOF(seg []byte) error {
+	if len(seg) < 6 {
+		return errors.New("invalid SOF segment")
+	}
+	l.height = int(binary.BigEndian.Uint16(seg[1:]))
+	l.width = int(binary.BigEndian.Uint16(seg[3:]))
+	n := int(seg[5])
+	if n == 0 || len(seg) < 6+3*n || l.width == 0 || l.height == 0 {
+		return errors.New("invalid SOF segment")
+	}
+	l.comps = make([]jpegComponent, n)
+	for i := range l.comps {
+		c := seg[6+3*i:]
+		h, v := int(c[1]>>4), int(c[1]&0x0f)
+		if n == 1 {
+			// 成分が 1 つの場合、サンプリング係数は意味を持たない
+			h, v = 1, 1
+		}
+		if h == 0 || v == 0 {
+			return errors.New("invalid sampling factor")
+		}
+		l.comps[i] = jpegComponent{id: c[0], h: h, v: v}
+		l.maxH, l.maxV = max(l.maxH, h), max(l.maxV, v)
+	}
+	return nil
+}
+
+// SOS セグメントからスキャンに含まれる成分を取得
+func (l *jpegLayout) parseSOS(seg []byte) (jpegScan, error) {
+	if len(l.comps) == 0 || len(seg) < 1 || len(seg) < 1+2*int(seg[0]) {
+		return jpegScan{}, errors.New("invalid SOS segment")
+	}
+	var scan jpegScan
+	for i := 0; i < int(seg[0]); i++ {
+		id := seg[1+2*i]
+		found := false
+		for j, c := range l.comps {
+			if c.id == id {
+				scan.comps = append(scan.comps, j)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return jpegScan{}, errors.New("unknown component in SOS segment")
+		}
+	}
+	return scan, nil
+}
+
+// エントロピー符号化データを走査してリスタートマーカーと終了位置を記録し、次のマーカーの位置を返却
+func (s *jpegScan) scanEntropyData(data []byte) int {
+	s.end = -1
+	i := s.start
+	for i+1 < len(data) {
+		if data[i] != 0xff {
+			i++
+			continue
+		}
+		next := data[i+1]
+		switch {
+		case next == 0x00:
+			i += 2
+		case next == 0xff:
+			i++
+		case next >= 0xd0 && next <= 0xd7:
+			s.rsts = append(s.rsts, i)
+			i += 2
+		default:
+			s.end = i
+			return i
+		}
+	}
+	return len(data)
+}
+
+// 先頭から n バイトの範囲で始まっている最後のスキャン
+func (l *jpegLayout) lastScan(n int) *jpegScan {
+	var scan *jpegScan
+	for i := range l.scans {
+		if l.scans[i].start <= n {
+			scan = &l.scans[i]
+		}
+	}
+	return scan
+}
+
+// スキャンの MCU の数と、MCU あたりのブロック数
+func (l *jpegLayout) mcus(s *jpegScan) (mcus, blocks int) {
+	if len(s.comps) == 1 {
+		// 成分が 1 つのスキャンでは、MCU はその成分のブロック 1 つ
+		c := l.comps[s.comps[0]]
+		w := (l.width*c.h + l.maxH - 1) / l.maxH
+		h := (l.height*c.v + l.maxV - 1) / l.maxV
+		return ((w + 7) / 8) * ((h + 7) / 8), 1
+	}
+	for _, i := range s.comps {
+		blocks += l.comps[i].h * l.comps[i].v
+	}
+	mx := (l.width + 8*l.maxH - 1) / (8 * l.maxH)
+	my := (l.height + 8*l.maxV - 1) / (8 * l.maxV)
+	return mx * my, blocks
+}
+
+// data の先頭 n バイトの後に、スキャンの残りを埋めるゼロのデータと End Of Image を続ける
+// リスタートマーカーがある場合は、残りの区間ごとにマーカーも補う
+func (l *jpegLayout) padded(data []byte, n int) io.Reader {
+	readers := []io.Reader{bytes.NewReader(data[:n])}
+	if scan := l.lastScan(n); scan != nil {
+		mcus, blocks := l.mcus(scan)
+		intervals, perInterval := 1, mcus
+		if scan.restart > 0 {
+			perInterval = scan.restart
+			intervals = (mcus + perInterval - 1) / perInterval
+		}
+		done := 0
+		for _, off := range scan.rsts {
+			if off+2 <= n {
+				done++
+			}
+		}
+		for i := done; i < intervals; i++ {
+			readers = append(readers, &zeroReader{n: int64(perInterval) * int64(blocks) * maxBlockBytes})
+			if i < intervals-1 {
+				readers = append(readers, bytes.NewReader([]byte{0xff, 0xd0 + byte(i%8)}))
+			}
+		}
+	}
+	readers = append(readers, bytes.NewReader(eoi))
+	return io.MultiReader(readers...)
+}
+
+// n バイトのゼロを返す io.Reader
+type zeroReader struct {
+	n int64
+}
+
+func (z *zeroReader) Read(p []byte) (int, error) {
+	if z.n <= 0 {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > z.n {
+		p = p[:z.n]
+	}
+	clear(p)
+	z.n -= int64(len(p))
+	return len(p), nil
+}
+
+// 2 つの同じ大きさの画像で、最初に異なる行の番号 (上端からの行数) を返却
+// すべて同じ場合は画像の高さを返却
+func firstDifferentRow(a, b image.Image) int {
+	r := a.Bounds()
+	switch a := a.(type) {
+	case *image.YCbCr:
+		if b, ok := b.(*image.YCbCr); ok && a.SubsampleRatio == b.SubsampleRatio && a.Rect == b.Rect {
+			for y := r.Min.Y; y < r.Max.Y; y++ {
+				yi := a.YOffset(r.Min.X, y)
+				ci := a.COffset(r.Min.X, y)
+				cn := a.COffset(r.Max.X-1, y) - ci + 1
+				if !bytes.Equal(a.Y[yi:yi+r.Dx()], b.Y[yi:yi+r.Dx()]) ||
+					!bytes.Equal(a.Cb[ci:ci+cn], b.Cb[ci:ci+cn]) ||
+					!bytes.Equal(a.Cr[ci:ci+cn], b.Cr[ci:ci+cn]) {
+					return y - r.Min.Y
+				}
+			}
+			return r.Dy()
+		}
+	case *image.Gray:
+		if b, ok := b.(*image.Gray); ok && a.Rect == b.Rect {
+			for y := r.Min.Y; y < r.Max.Y; y++ {
+				i := a.PixOffset(r.Min.X, y)
+				if !bytes.Equal(a.Pix[i:i+r.Dx()], b.Pix[i:i+r.Dx()]) {
+					return y - r.Min.Y
+				}
+			}
+			return r.Dy()
+		}
+	}
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			r1, g1, b1, a1 := a.At(x, y).RGBA()
+			r2, g2, b2, a2 := b.At(x, y).RGBA()
+			if r1 != r2 || g1 != g2 || b1 != b2 || a1 != a2 {
+				return y - r.Min.Y
+			}
+		}
+	}
+	return r.Dy()
+}
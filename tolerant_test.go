@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/yashikota/go-streaming-image-mosaic/mosaic"
+)
+
+// 640x480 のベースライン JPEG
+func truncatedJPEGFixture(t *testing.T) (data []byte, full image.Image) {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, testImage(640, 480), &jpeg.Options{Quality: 90}); err != nil {
+		t.Fatal(err)
+	}
+	full, err := jpeg.Decode(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes(), full
+}
+
+func TestDecodeTruncatedJPEG(t *testing.T) {
+	data, full := truncatedJPEGFixture(t)
+	for _, percent := range []int{10, 30, 60, 90, 99} {
+		img, valid, err := decodeTruncatedJPEG(data[:len(data)*percent/100])
+		if err != nil {
+			t.Fatalf("%d%%: %v", percent, err)
+		}
+		if img.Bounds() != full.Bounds() {
+			t.Fatalf("%d%%: bounds %v, want %v", percent, img.Bounds(), full.Bounds())
+		}
+		// 復元した行は MCU の行単位で、データの割合を超えず、大きく下回らない
+		if valid%16 != 0 || valid > 480*percent/100 || valid < 480*percent/100-48 {
+			t.Errorf("%d%%: recovered %d rows", percent, valid)
+		}
+		if row := firstDifferentRow(img, full); row < valid {
+			t.Errorf("%d%%: row %d differs from the complete image, but %d rows were recovered", percent, row, valid)
+		}
+	}
+
+	// End Of Image だけが欠けている場合はすべての行を復元する
+	img, valid, err := decodeTruncatedJPEG(data[:len(data)-2])
+	if err != nil || valid != 480 || firstDifferentRow(img, full) != 480 {
+		t.Errorf("missing EOI: recovered %d rows, %v", valid, err)
+	}
+
+	for _, bad := range [][]byte{data[:20], []byte("\xff\xd8\xff\xd9")} {
+		if _, _, err := decodeTruncatedJPEG(bad); err == nil {
+			t.Errorf("decodeTruncatedJPEG(%d bytes) succeeded", len(bad))
+		}
+	}
+}
+
+func TestApplyTolerant(t *testing.T) {
+	data, _ := truncatedJPEGFixture(t)
+	truncated := data[:len(data)*60/100]
+	partial, valid, err := decodeTruncatedJPEG(truncated)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	in := filepath.Join(dir, "in.jpg")
+	writeTestFile(t, in, truncated)
+
+	// 既定では切れた JPEG はデコードのエラー
+	if res := runCLI(t, "apply", "-in", in, "-out", filepath.Join(dir, "strict.png"), "-tile", "16"); res.code != exitDecode {
+		t.Errorf("strict: exit code = %d, want %d (stderr: %s)", res.code, exitDecode, res.stderr)
+	}
+
+	tests := []struct {
+		args []string
+		fill color.NRGBA
+	}{
+		{nil, color.NRGBA{0x80, 0x80, 0x80, 0xff}},
+		{[]string{"-tolerant-fill", "#ff0000"}, color.NRGBA{0xff, 0, 0, 0xff}},
+	}
+	for _, tt := range tests {
+		out := filepath.Join(dir, "out.png")
+		args := append([]string{"apply", "-in", in, "-out", out, "-tile", "16", "-tolerant"}, tt.args...)
+		res := runCLI(t, args...)
+		if res.code != exitOK {
+			t.Fatalf("exit code = %d (stderr: %s)", res.code, res.stderr)
+		}
+		for _, want := range []string{"truncated JPEG recovered", "code=" + string(warnTruncated), "recovered_percent=56.7", "rows=272"} {
+			if !strings.Contains(res.stderr, want) {
+				t.Errorf("warning does not contain %s:\n%s", want, res.stderr)
+			}
+		}
+
+		got := readTestImage(t, out)
+		if got.Rect != image.Rect(0, 0, 640, 480) {
+			t.Fatalf("output is %v, want the full 640x480", got.Rect)
+		}
+		// 復元できなかった行は塗りつぶし、復元した行だけをモザイク処理する
+		for y := valid; y < 480; y++ {
+			for x := 0; x < 640; x++ {
+				if c := got.NRGBAAt(x, y); c != tt.fill {
+					t.Fatalf("pixel (%d, %d) = %v, want %v", x, y, c, tt.fill)
+				}
+			}
+		}
+		top := mosaic.ConvertToNRGBA(partial).SubImage(image.Rect(0, 0, 640, valid)).(*image.NRGBA)
+		want := mosaic.New(top, 16, 16).Process()
+		assertSameNRGBA(t, mosaic.ConvertToNRGBA(got.SubImage(want.Rect)), want)
+	}
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/yashikota/go-streaming-image-mosaic/mosaic"
+)
+
+// 更新を確認するモジュールのパス
+const modulePath = "github.com/yashikota/go-streaming-image-mosaic"
+
+// 最新のバージョンを問い合わせるモジュールプロキシの URL (テストで差し替える)
+var latestVersionURL = "https://proxy.golang.org/" + modulePath + "/@latest"
+
+// 更新の確認を待つ最大の時間
+const checkUpdateTimeout = 10 * time.Second
+
+// ビルド情報から読み取ったバージョン
+// -version の表示、バッチ処理のレポート、サーバーの X-Mosaic-Version ヘッダーはすべてこの値から作る
+type buildVersion struct {
+	Version  string `json:"version"`            // モジュールのバージョン (go build でビルドした場合は (devel))
+	Revision string `json:"revision,omitempty"` // VCS のリビジョン
+	Time     string `json:"time,omitempty"`     // リビジョンをコミットした日時 (vcs.time)
+	Modified bool   `json:"modified,omitempty"` // コミットしていない変更を含むかどうか
+}
+
+// 実行中のバイナリのバージョン
+func currentVersion() buildVersion {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return buildVersion{Version: "(unknown)"}
+	}
+	v := buildVersion{Version: info.Main.Version}
+	for _, s := range info.Settings {
+		switch s.Key {
+		case "vcs.revision":
+			v.Revision = s.Value
+		case "vcs.time":
+			v.Time = s.Value
+		case "vcs.modified":
+			v.Modified = s.Value == "true"
+		}
+	}
+	return v
+}
+
+// v1.2.3 rev abcdef committed 2024-01-02T03:04:05Z (modified) の形式の文字列
+// 日時は vcs.time (リビジョンをコミットした日時) で、ビルドした日時ではない
+func (v buildVersion) String() string {
+	parts := []string{v.Version}
+	if v.Revision != "" {
+		parts = append(parts, "rev "+v.Revision)
+	}
+	if v.Time != "" {
+		parts = append(parts, "committed "+v.Time)
+	}
+	if v.Modified {
+		parts = append(parts, "(modified)")
+	}
+	return strings.Join(parts, " ")
+}
+
+// プログラム名を付けたバージョン文字列
+func versionString() string {
+	return progName + " " + currentVersion().String()
+}
+
+// バージョンと読み書きできる形式を表示する
+// -check-update を指定した場合は、新しいバージョンがあれば stderr に 1 行で知らせる (確認に失敗しても終了コードは変えない)
+func runVersion(args []string, stdout, stderr io.Writer) error {
+	fs := flag.NewFlagSet(progName+" -version", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	checkUpdate := fs.Bool("check-update", false, "モジュールプロキシに新しいバージョンがあるかを問い合わせる")
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return err
+		}
+		return &usageError{err}
+	}
+	if fs.NArg() > 0 {
+		return &usageError{fmt.Errorf("unexpected arguments: %s", strings.Join(fs.Args(), " "))}
+	}
+	fmt.Fprintln(stdout, versionString())
+	fmt.Fprintln(stdout, "formats: "+strings.Join(mosaic.Formats(), ", "))
+	fmt.Fprintln(stdout, "output formats: "+strings.Join(mosaic.Encoders(), ", "))
+	if !*checkUpdate {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), checkUpdateTimeout)
+	defer cancel()
+	latest, err := fetchLatestVersion(ctx, http.DefaultClient, latestVersionURL)
+	if err != nil {
+		fmt.Fprintf(stderr, "%s: update check failed: %v\n", progName, err)
+		return nil
+	}
+	if notice := updateNotice(currentVersion().Version, latest); notice != "" {
+		fmt.Fprintln(stderr, notice)
+	}
+	return nil
+}
+
+// モジュールプロキシの @latest から最新のバージョンを取得する
+func fetchLatestVersion(ctx context.Context, client *http.Client, url string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%s: %s", url, resp.Status)
+	}
+	var latest struct {
+		Version string
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<16)).Decode(&latest); err != nil {
+		return "", fmt.Errorf("%s: %w", url, err)
+	}
+	if _, ok := parseSemver(latest.Version); !ok {
+		return "", fmt.Errorf("%s: invalid version %q", url, latest.Version)
+	}
+	return latest.Version, nil
+}
+
+// latest が current より新しい場合に表示する 1 行の通知 (知らせない場合は空)
+// current がリリースのバージョンでない場合 ((devel) など) と、リリースの current に対して latest がプレリリースの場合は知らせない
+func updateNotice(current, latest string) string {
+	cur, ok := parseSemver(current)
+	if !ok {
+		return ""
+	}
+	next, ok := parseSemver(latest)
+	if !ok || (next.pre != "" && cur.pre == "") || next.compare(cur) <= 0 {
+		return ""
+	}
+	return fmt.Sprintf("%s: %s is available (running %s); go install %s@%s", progName, latest, current, modulePath, latest)
+}
+
+// vMAJOR.MINOR.PATCH[-PRERELEASE][+BUILD] のバージョン
+type semver struct {
+	core [3]int
+	pre  string // プレリリースの部分 (- の後、+ の前)
+}
+
+// v で始まるセマンティックバージョンを解析する (ビルドメタデータは比較に使わないため捨てる)
+func parseSemver(s string) (semver, bool) {
+	rest, ok := strings.CutPrefix(s, "v")
+	if !ok {
+		return semver{}, false
+	}
+	rest, _, _ = strings.Cut(rest, "+")
+	var v semver
+	rest, v.pre, _ = strings.Cut(rest, "-")
+	parts := strings.Split(rest, ".")
+	if len(parts) != 3 {
+		return semver{}, false
+	}
+	for i, p := range parts {
+		n, err := strconv.Atoi(p)
+		if err != nil || n < 0 || (len(p) > 1 && p[0] == '0') {
+			return semver{}, false
+		}
+		v.core[i] = n
+	}
+	return v, true
+}
+
+// セマンティックバージョンの優先順位で比べ、v が w より古い場合は負、同じ場合は 0、新しい場合は正を返却
+// プレリリースは同じ番号のリリースより古く、識別子ごとに数字は数値で、それ以外は文字列で比べる
+func (v semver) compare(w semver) int {
+	for i := range v.core {
+		if v.core[i] != w.core[i] {
+			return v.core[i] - w.core[i]
+		}
+	}
+	switch {
+	case v.pre == w.pre:
+		return 0
+	case v.pre == "":
+		return 1
+	case w.pre == "":
+		return -1
+	}
+	a, b := strings.Split(v.pre, "."), strings.Split(w.pre, ".")
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if c := comparePrerelease(a[i], b[i]); c != 0 {
+			return c
+		}
+	}
+	return len(a) - len(b)
+}
+
+// プレリリースの識別子を比べる (数字だけの識別子はそれ以外より古い)
+func comparePrerelease(a, b string) int {
+	x, errA := strconv.Atoi(a)
+	y, errB := strconv.Atoi(b)
+	switch {
+	case errA == nil && errB == nil:
+		return x - y
+	case errA == nil:
+		return -1
+	case errB == nil:
+		return 1
+	}
+	return strings.Compare(a, b)
+}
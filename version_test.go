@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestUpdateNotice(t *testing.T) {
+	tests := []struct {
+		current, latest string
+		notify          bool
+	}{
+		{"v1.2.3", "v1.2.4", true},
+		{"v1.2.3", "v1.10.0", true},
+		{"v1.2.3", "v2.0.0", true},
+		{"v1.2.3", "v1.2.3", false},
+		{"v1.2.3", "v1.2.3+meta", false},
+		{"v1.2.4", "v1.2.3", false},
+		// リリースを使っている場合はプレリリースを知らせない
+		{"v1.2.3", "v1.3.0-rc.1", false},
+		{"v1.3.0-rc.1", "v1.3.0-rc.2", true},
+		{"v1.3.0-rc.2", "v1.3.0-rc.10", true},
+		{"v1.3.0-rc.1", "v1.3.0", true},
+		{"v1.3.0-alpha", "v1.3.0-alpha.1", true},
+		{"v1.3.0-alpha.beta", "v1.3.0-alpha.1", false},
+		{"v1.3.0-beta", "v1.3.0-alpha", false},
+		{"v1.3.0-rc.1", "v1.2.9", false},
+		{"(devel)", "v9.9.9", false},
+		{"v1.2.3", "latest", false},
+		{"v1.2", "v1.2.4", false},
+		{"v1.02.3", "v1.2.4", false},
+	}
+	for _, tt := range tests {
+		notice := updateNotice(tt.current, tt.latest)
+		if (notice != "") != tt.notify {
+			t.Errorf("updateNotice(%q, %q) = %q, want notify %v", tt.current, tt.latest, notice, tt.notify)
+		}
+		if tt.notify && (strings.Contains(notice, "\n") || !strings.Contains(notice, tt.latest+" is available (running "+tt.current+")") || !strings.HasSuffix(notice, modulePath+"@"+tt.latest)) {
+			t.Errorf("notice %q", notice)
+		}
+	}
+}
+
+// @latest の応答を返すモジュールプロキシ
+func stubProxy(t *testing.T, status int, body string) string {
+	t.Helper()
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/"+modulePath+"/@latest" {
+			http.NotFound(w, r)
+			return
+		}
+		w.WriteHeader(status)
+		fmt.Fprint(w, body)
+	}))
+	t.Cleanup(ts.Close)
+	return ts.URL + "/" + modulePath + "/@latest"
+}
+
+func TestFetchLatestVersion(t *testing.T) {
+	url := stubProxy(t, http.StatusOK, `{"Version":"v1.4.0","Time":"2024-05-01T00:00:00Z"}`)
+	if v, err := fetchLatestVersion(context.Background(), http.DefaultClient, url); err != nil || v != "v1.4.0" {
+		t.Errorf("latest %q, %v", v, err)
+	}
+	for _, tt := range []struct {
+		status int
+		body   string
+		want   string
+	}{
+		{http.StatusNotFound, "not found", "404"},
+		{http.StatusOK, "{", "unexpected EOF"},
+		{http.StatusOK, `{"Version":"master"}`, "invalid version"},
+	} {
+		_, err := fetchLatestVersion(context.Background(), http.DefaultClient, stubProxy(t, tt.status, tt.body))
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%d %q: %v, want %q", tt.status, tt.body, err, tt.want)
+		}
+	}
+}
+
+func TestVersionCommand(t *testing.T) {
+	res := runCLI(t, "-version")
+	if res.code != exitOK || !strings.HasPrefix(res.stdout, versionString()+"\n") || !strings.Contains(res.stdout, "output formats: ") {
+		t.Fatalf("exit code = %d, stdout %q", res.code, res.stdout)
+	}
+	// 指定しない場合は問い合わせない
+	calls := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { calls++ }))
+	defer ts.Close()
+	old := latestVersionURL
+	defer func() { latestVersionURL = old }()
+	latestVersionURL = ts.URL
+	if res := runCLI(t, "-version"); res.code != exitOK || calls != 0 || res.stderr != "" {
+		t.Errorf("without -check-update: %d calls, stderr %q", calls, res.stderr)
+	}
+
+	// 確認に失敗しても終了コードは変えない
+	latestVersionURL = stubProxy(t, http.StatusBadGateway, "")
+	if res := runCLI(t, "-version", "-check-update"); res.code != exitOK || !strings.Contains(res.stderr, "update check failed") {
+		t.Errorf("failed check: exit code = %d, stderr %q", res.code, res.stderr)
+	}
+	// テストのバイナリは (devel) のため、新しいリリースがあっても知らせない
+	latestVersionURL = stubProxy(t, http.StatusOK, `{"Version":"v99.0.0"}`)
+	if res := runCLI(t, "-version", "-check-update"); res.code != exitOK || res.stderr != "" {
+		t.Errorf("devel build: exit code = %d, stderr %q", res.code, res.stderr)
+	}
+	if res := runCLI(t, "-version", "extra"); res.code != exitUsage {
+		t.Errorf("extra argument: exit code = %d, want %d", res.code, exitUsage)
+	}
+}
+
+func TestBuildVersionString(t *testing.T) {
+	v := buildVersion{Version: "v1.2.3", Revision: "abcdef", Time: "2024-01-02T03:04:05Z", Modified: true}
+	if got, want := v.String(), "v1.2.3 rev abcdef committed 2024-01-02T03:04:05Z (modified)"; got != want {
+		t.Errorf("String() = %q, want %q", got, want)
+	}
+	if got := (buildVersion{Version: "(devel)"}).String(); got != "(devel)" {
+		t.Errorf("String() = %q", got)
+	}
+}
+
+// CLI、サーバーとレポートのバージョンは同じ値から作る
+func TestVersionSurfaces(t *testing.T) {
+	want := currentVersion()
+	ts, _ := newTestServer(t)
+	for _, path := range []string{"/healthz", "/no-such-path"} {
+		resp, err := http.Get(ts.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if got := resp.Header.Get("X-Mosaic-Version"); got != want.String() {
+			t.Errorf("%s: X-Mosaic-Version %q, want %q", path, got, want.String())
+		}
+	}
+
+	in, out := batchFixture(t), t.TempDir()
+	reportPath := filepath.Join(t.TempDir(), "report.json")
+	runCLI(t, "batch", "-in", in, "-out", out, "-tile", "8", "-quiet", "-report", reportPath)
+	if got := readBatchReport(t, reportPath).Version; got != want {
+		t.Errorf("report version %+v, want %+v", got, want)
+	}
+}
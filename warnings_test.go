@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"log/slog"
+	"net/http"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/yashikota/go-streaming-image-mosaic/mosaic"
+)
+
+// 要約の警告の種類
+func warningCodes(summary mosaic.RunSummary) []mosaic.WarningCode {
+	var codes []mosaic.WarningCode
+	for _, w := range summary.Files[0].Warnings {
+		codes = append(codes, w.Code)
+	}
+	return codes
+}
+
+func TestApplyWarnings(t *testing.T) {
+	dir := t.TempDir()
+	in := filepath.Join(dir, "in.png")
+	writeTestImage(t, in, testImage(60, 40))
+	tests := []struct {
+		name string
+		args []string
+		want []mosaic.WarningCode
+	}{
+		{"none", []string{"-tile", "8", "-out", filepath.Join(dir, "none.png")}, nil},
+		{"tile clamped", []string{"-tile", "100", "-out", filepath.Join(dir, "clamped.png")}, []mosaic.WarningCode{mosaic.WarningTileClamped}},
+		{"regions", []string{"-tile", "8", "-region", "50,30,20,20", "-region", "100,100,10,10", "-out", filepath.Join(dir, "regions.png")},
+			[]mosaic.WarningCode{mosaic.WarningRegionClipped, mosaic.WarningRegionSkipped}},
+		// gif には解像度を記録できない (png には記録する)
+		{"metadata dropped", []string{"-tile", "8", "-dpi", "300", "-out", filepath.Join(dir, "dpi.gif")}, []mosaic.WarningCode{warnMetadataDropped}},
+		{"metadata kept", []string{"-tile", "8", "-dpi", "300", "-out", filepath.Join(dir, "dpi.png")}, nil},
+		// 色の付いた画像は灰色のパレットの色域の外になる (警告は 1 つだけ)
+		{"palette gamut", []string{"-tile", "8", "-palette", "grayscale", "-out", filepath.Join(dir, "gray.png")}, []mosaic.WarningCode{warnPaletteGamut}},
+	}
+	for _, tt := range tests {
+		res := runCLI(t, append([]string{"apply", "-json", "-in", in}, tt.args...)...)
+		if res.code != exitOK {
+			t.Fatalf("%s: exit code = %d (stderr: %s)", tt.name, res.code, res.stderr)
+		}
+		summary, _ := decodeSummary(t, []byte(res.stdout))
+		if got := warningCodes(summary); !slices.Equal(got, tt.want) {
+			t.Errorf("%s: warnings %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	// 灰色の画像は灰色のパレットの色域に収まる
+	gray := testImage(32, 32)
+	for i := 0; i < len(gray.Pix); i += 4 {
+		gray.Pix[i+1], gray.Pix[i+2] = gray.Pix[i], gray.Pix[i]
+	}
+	writeTestImage(t, filepath.Join(dir, "gray-in.png"), gray)
+	res := runCLI(t, "apply", "-json", "-in", filepath.Join(dir, "gray-in.png"), "-tile", "8", "-palette", "grayscale", "-out", filepath.Join(dir, "gray-out.png"))
+	if summary, _ := decodeSummary(t, []byte(res.stdout)); len(summary.Files[0].Warnings) != 0 {
+		t.Errorf("gray input: warnings %+v", summary.Files[0].Warnings)
+	}
+	res = runCLI(t, "apply", "-json", "-in", in, "-tile", "8", "-palette", "grayscale", "-out", filepath.Join(dir, "gray.png"))
+	summary, _ := decodeSummary(t, []byte(res.stdout))
+	if f := summary.Files[0].Warnings[0].Fields; f["color"] == nil || f["nearest"] == nil || f["delta_e"].(float64) <= paletteGamutDistance {
+		t.Errorf("palette gamut fields %v", f)
+	}
+}
+
+// 先頭の SOF0 を SOF2 に書き換えた JPEG (デコードはできないが、ヘッダーはプログレッシブ JPEG と同じ)
+func progressiveHeader(t *testing.T) (baseline, progressive []byte) {
+	t.Helper()
+	baseline = encodeTestImage(t, testImage(16, 16), "jpeg")
+	i := bytes.Index(baseline, []byte{0xff, 0xc0})
+	if i < 0 {
+		t.Fatal("no SOF0")
+	}
+	progressive = slices.Clone(baseline)
+	progressive[i+1] = 0xc2
+	return baseline, progressive
+}
+
+func TestCheckProgressive(t *testing.T) {
+	baseline, progressive := progressiveHeader(t)
+	if progressiveJPEG(baseline) || !progressiveJPEG(progressive) || progressiveJPEG([]byte("\x89PNG\r\n\x1a\n")) {
+		t.Fatal("progressiveJPEG misdetects the SOF")
+	}
+	// 大きな APP1 の後の SOF も見つける
+	app1 := append([]byte{0xff, 0xd8, 0xff, 0xe1, 0xff, 0xff}, make([]byte, 0xfffd)...)
+	large := append(app1, progressive[2:]...)
+	if !progressiveJPEG(large) {
+		t.Error("SOF after a 64KiB APP1 was not found")
+	}
+
+	for _, tt := range []struct {
+		name    string
+		encoder string
+		input   []byte
+		warn    bool
+	}{
+		{"progressive to jpeg", "", large, true},
+		{"baseline to jpeg", "jpeg", baseline, false},
+		{"progressive to png", "png", progressive, false},
+	} {
+		var records []mosaic.Warning
+		p := pipeline{encoder: tt.encoder, onWarning: func(w mosaic.Warning) { records = append(records, w) }}
+		logger := p.warningLogger(slog.New(slog.NewTextHandler(io.Discard, nil)))
+		br := p.checkProgressive(logger, bufio.NewReader(bytes.NewReader(tt.input)))
+		if got := len(records) == 1 && records[0].Code == warnProgressive; got != tt.warn || len(records) > 1 {
+			t.Errorf("%s: warnings %+v", tt.name, records)
+		}
+		// 調べた先頭部分も読み込める
+		if data, err := io.ReadAll(br); err != nil || !bytes.Equal(data, tt.input) {
+			t.Errorf("%s: read %d bytes, %v", tt.name, len(data), err)
+		}
+	}
+}
+
+// 一括で返す応答は警告を X-Mosaic-Warning に付け、キャッシュから返す場合も同じ警告を付ける
+func TestServerWarningHeaders(t *testing.T) {
+	input := encodeTestImage(t, testImage(30, 20), "png")
+	want := []string{"tile_clamped: tile size is larger than the image; clamped to the image size"}
+	post := func(ts string, query string) *http.Response {
+		t.Helper()
+		resp, err := http.Post(ts+"/process?"+query, "image/png", bytes.NewReader(input))
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("status %d", resp.StatusCode)
+		}
+		return resp
+	}
+
+	ts, _ := newTestServer(t)
+	for _, cache := range []string{"MISS", "HIT"} {
+		resp := post(ts.URL, "tile=64&format=png")
+		if got := resp.Header.Values("X-Mosaic-Warning"); resp.Header.Get("X-Cache") != cache || !slices.Equal(got, want) {
+			t.Errorf("%s: X-Cache %q, warnings %q", cache, resp.Header.Get("X-Cache"), got)
+		}
+	}
+	// 警告のない結果のキャッシュには警告を付けない
+	for i := 0; i < 2; i++ {
+		if resp := post(ts.URL, "tile=8&format=png"); len(resp.Header.Values("X-Mosaic-Warning")) != 0 {
+			t.Errorf("X-Cache %s: warnings %q", resp.Header.Get("X-Cache"), resp.Header.Values("X-Mosaic-Warning"))
+		}
+	}
+
+	uncached, _ := newTestServer(t, "-cache-size", "0")
+	if got := post(uncached.URL, "tile=64&format=png").Header.Values("X-Mosaic-Warning"); !slices.Equal(got, want) {
+		t.Errorf("without a cache: warnings %q", got)
+	}
+}
+
+func TestMemoryResultCacheKeepsWarnings(t *testing.T) {
+	c := newMemoryResultCache(10)
+	warnings := []mosaic.Warning{{Code: mosaic.WarningTileClamped, Message: "clamped"}}
+	c.Put("a", CachedResult{Data: []byte("12345"), Warnings: warnings})
+	c.Put("b", CachedResult{Data: []byte("123456")})
+	// 大きさは画像のバイト数で数え、上限を超えたら古い結果から捨てる
+	if _, ok := c.Get("a"); ok {
+		t.Error("a was not evicted")
+	}
+	c.Put("a", CachedResult{Data: []byte("1234"), Warnings: warnings})
+	got, ok := c.Get("a")
+	if !ok || string(got.Data) != "1234" || len(got.Warnings) != 1 || got.Warnings[0].Message != "clamped" {
+		t.Errorf("a = %+v, %v", got, ok)
+	}
+	if got, ok := c.Get("b"); !ok || got.Warnings != nil {
+		t.Errorf("b = %+v, %v", got, ok)
+	}
+}
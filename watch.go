@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+// watch のフラグ
+type watchFlags struct {
+	*commonFlags
+	in       *string
+	out      *string
+	interval *time.Duration
+}
+
+func newWatchFlags(stderr io.Writer) *watchFlags {
+	c := newCommonFlags("watch", "[flags] -in dir -out dir", stderr)
+	return &watchFlags{
+		commonFlags: c,
+		in:          c.fs.String("in", "", "監視するディレクトリ"),
+		out:         c.fs.String("out", "", "出力先のディレクトリ"),
+		interval:    c.fs.Duration("interval", 2*time.Second, "ディレクトリを確認する間隔"),
+	}
+}
+
+// ディレクトリを定期的に確認し、出力がないか古い画像をモザイク処理する
+// SIGINT または SIGTERM を受け取ると終了する
+func runWatch(args []string, stdout, stderr io.Writer) error {
+	f := newWatchFlags(stderr)
+	if err := f.parse(args); err != nil {
+		return err
+	}
+	if *f.in == "" || *f.out == "" {
+		return &usageError{errors.New("both -in and -out are required")}
+	}
+	if *f.interval <= 0 {
+		return &usageError{errors.New("interval must be positive")}
+	}
+
+	logger, err := f.logger(stderr)
+	if err != nil {
+		return err
+	}
+	p := f.pipeline(logger)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	logger.Info("watching", "dir", *f.in, "interval", *f.interval)
+	ticker := time.NewTicker(*f.interval)
+	defer ticker.Stop()
+	failed := map[string]time.Time{}
+	for {
+		if err := scanOnce(ctx, p, *f.in, *f.out, *f.interval, failed); err != nil {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// ディレクトリを 1 回確認し、処理が必要な画像を処理する
+// 書き込み中のファイルを避けるため、settle より最近に更新されたファイルは次回に回す
+// failed には失敗したファイルの更新日時を記録し、更新されるまで再試行しない
+func scanOnce(ctx context.Context, p pipeline, inDir, outDir string, settle time.Duration, failed map[string]time.Time) error {
+	now := time.Now()
+	return filepath.WalkDir(inDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return &inputError{path: path, err: err}
+		}
+		if ctx.Err() != nil {
+			return filepath.SkipAll
+		}
+		if d.IsDir() || !isImageFile(path) {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return &inputError{path: path, err: err}
+		}
+		if now.Sub(info.ModTime()) < settle {
+			return nil
+		}
+		if t, ok := failed[path]; ok && t.Equal(info.ModTime()) {
+			return nil
+		}
+
+		out, err := outputPath(inDir, outDir, path)
+		if err != nil {
+			return err
+		}
+		if outInfo, err := os.Stat(out); err == nil && !outInfo.ModTime().Before(info.ModTime()) {
+			return nil
+		}
+		if err := os.MkdirAll(filepath.Dir(out), 0o755); err != nil {
+			return &outputError{path: filepath.Dir(out), err: err}
+		}
+
+		if err := processFile(ctx, p, path, out, nil); err != nil {
+			failed[path] = info.ModTime()
+			p.logger.Error("file failed", "input", path, "error", err)
+			return nil
+		}
+		delete(failed, path)
+		return nil
+	})
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/yashikota/go-streaming-image-mosaic/mosaic"
+)
+
+// zip ファイルかどうか
+func isZipFile(name string) bool {
+	return strings.EqualFold(filepath.Ext(name), ".zip")
+}
+
+// zip 内の画像をまとめてモザイク処理し、別の zip に書き出すバッチ処理
+// エントリの順序、名前、更新日時、圧縮方式を保ち、画像以外のエントリとディレクトリは圧縮済みのデータをそのまま書き写す
+// 画像のエントリは名前の拡張子の形式 (元の画像と同じ形式) で書き出す
+// 一度に展開する画像は 1 枚だけなので、アーカイブ全体をディスクやメモリに展開しない
+type zipBatch struct {
+	in       string // 入力の zip のパス
+	out      string // 出力の zip のパス
+	failFast bool   // 最初の失敗で残りのエントリを処理しないかどうか
+}
+
+// すべての画像のエントリを処理し、結果と最初に失敗したエントリのエラーを返却
+// 失敗した画像のエントリは出力に含めない (元の画像をそのまま残さないため)
+// アーカイブの読み書きに失敗した場合や -fail-fast で中止した場合は、出力の zip を残さない
+func (z zipBatch) run(ctx context.Context, p pipeline, bar *progressBar) (report batchReport, firstErr, err error) {
+	r, err := zip.OpenReader(z.in)
+	if err != nil {
+		return batchReport{}, nil, &inputError{path: z.in, err: err}
+	}
+	defer r.Close()
+
+	outFile, err := os.Create(z.out)
+	if err != nil {
+		return batchReport{}, nil, &outputError{path: z.out, err: err}
+	}
+	w := zip.NewWriter(outFile)
+	if err := w.SetComment(r.Comment); err != nil {
+		z.discard(outFile)
+		return batchReport{}, nil, &outputError{path: z.out, err: err}
+	}
+
+	var files []batchFile
+	for i, f := range r.File {
+		if f.FileInfo().IsDir() || !isImageFile(f.Name) {
+			continue
+		}
+		files = append(files, batchFile{
+			name:  f.Name,
+			in:    filepath.Join(z.in, filepath.FromSlash(f.Name)),
+			out:   filepath.Join(z.out, filepath.FromSlash(f.Name)),
+			entry: i,
+		})
+	}
+
+	// 画像のエントリを処理する前に、それより前にある画像以外のエントリを書き写す
+	next := 0
+	copyUntil := func(end int) error {
+		for ; next < end; next++ {
+			f := r.File[next]
+			if !f.FileInfo().IsDir() && isImageFile(f.Name) {
+				continue
+			}
+			if err := copyZipEntry(w, f); err != nil {
+				return fmt.Errorf("%s: %w", filepath.Join(z.in, filepath.FromSlash(f.Name)), err)
+			}
+		}
+		return nil
+	}
+	var archiveErr error
+	report, firstErr = processFiles(p.logger, bar, files, z.failFast, func(file batchFile, progress mosaic.ProgressFunc) error {
+		if archiveErr != nil {
+			return archiveErr
+		}
+		if archiveErr = copyUntil(file.entry); archiveErr != nil {
+			return archiveErr
+		}
+		next = file.entry + 1
+		return z.processEntry(ctx, p, w, r.File[file.entry], file, progress)
+	})
+	if archiveErr == nil {
+		archiveErr = copyUntil(len(r.File))
+	}
+	if archiveErr != nil {
+		z.discard(outFile)
+		return batchReport{}, nil, archiveErr
+	}
+	if z.failFast && firstErr != nil {
+		z.discard(outFile)
+		return report, firstErr, nil
+	}
+
+	if err := w.Close(); err != nil {
+		z.discard(outFile)
+		return batchReport{}, nil, &outputError{path: z.out, err: err}
+	}
+	if err := outFile.Close(); err != nil {
+		os.Remove(z.out)
+		return batchReport{}, nil, &outputError{path: z.out, err: err}
+	}
+	return report, firstErr, nil
+}
+
+// 書きかけの出力の zip を削除
+func (z zipBatch) discard(outFile *os.File) {
+	outFile.Close()
+	os.Remove(z.out)
+}
+
+// 画像のエントリをモザイク処理して書き込む
+// 処理に失敗した場合にエントリを書きかけにしないよう、エンコード結果をまとめて書き込む
+func (z zipBatch) processEntry(ctx context.Context, p pipeline, w *zip.Writer, f *zip.File, file batchFile, progress mosaic.ProgressFunc) error {
+	rc, err := f.Open()
+	if err != nil {
+		return &inputError{path: file.in, err: err}
+	}
+	defer rc.Close()
+
+	// 名前を変えずに済むよう、拡張子の形式で書き出す
+	if p.encoder, _, err = mosaic.ResolveEncoder("", f.Name); err != nil {
+		return &stageError{stage: stageEncode, err: err}
+	}
+	var buf bytes.Buffer
+	if err := p.run(ctx, file.in, rc, &buf, progress); err != nil {
+		return fmt.Errorf("%s: %w", file.in, err)
+	}
+
+	header := f.FileHeader
+	// 大きさと CRC は書き込み時に計算し直す
+	// 拡張フィールドは更新日時などを書き込み時に付け直すため引き継がない
+	header.CRC32 = 0
+	header.CompressedSize, header.UncompressedSize = 0, 0
+	header.CompressedSize64, header.UncompressedSize64 = 0, 0
+	header.Extra = nil
+	ew, err := w.CreateHeader(&header)
+	if err != nil {
+		return &outputError{path: z.out, err: err}
+	}
+	if _, err := ew.Write(buf.Bytes()); err != nil {
+		return &outputError{path: z.out, err: err}
+	}
+	return nil
+}
+
+// エントリを圧縮済みのデータのまま書き写す
+func copyZipEntry(w *zip.Writer, f *zip.File) error {
+	raw, err := f.OpenRaw()
+	if err != nil {
+		return err
+	}
+	header := f.FileHeader
+	dst, err := w.CreateRaw(&header)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(dst, raw)
+	return err
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"image"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/yashikota/go-streaming-image-mosaic/mosaic"
+)
+
+// zip に書き込むエントリ
+type zipEntry struct {
+	name   string
+	method uint16
+	data   []byte
+}
+
+// entries を順に書き込んだ zip ファイルを作る
+func writeTestZip(t *testing.T, path string, modified time.Time, entries []zipEntry) {
+	t.Helper()
+	var buf bytes.Buffer
+	w := zip.NewWriter(&buf)
+	for _, e := range entries {
+		fw, err := w.CreateHeader(&zip.FileHeader{Name: e.name, Method: e.method, Modified: modified})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := fw.Write(e.data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	writeTestFile(t, path, buf.Bytes())
+}
+
+// img の tile の大きさのタイルがそれぞれ 1 色で塗られているかどうか
+func isMosaic(img *image.NRGBA, tile int) bool {
+	b := img.Rect
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			if img.NRGBAAt(x, y) != img.NRGBAAt(x-(x-b.Min.X)%tile, y-(y-b.Min.Y)%tile) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func TestZipBatch(t *testing.T) {
+	dir := t.TempDir()
+	in, out := filepath.Join(dir, "photos.zip"), filepath.Join(dir, "out.zip")
+	modified := time.Date(2024, 5, 6, 7, 8, 10, 0, time.UTC)
+	text := []byte("caption: not an image\n")
+	entries := []zipEntry{
+		{"readme.txt", zip.Deflate, text},
+		{"a.png", zip.Store, encodeTestImage(t, testImage(40, 24), "png")},
+		{"nested/", zip.Store, nil},
+		{"nested/deeper/b.jpg", zip.Deflate, encodeTestImage(t, testImage(32, 32), "jpeg")},
+	}
+	writeTestZip(t, in, modified, entries)
+
+	res := runCLI(t, "batch", "-in", in, "-out", out, "-tile", "8", "-quiet")
+	if res.code != exitOK {
+		t.Fatalf("exit code = %d (stderr: %s)", res.code, res.stderr)
+	}
+	r, err := zip.OpenReader(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if len(r.File) != len(entries) {
+		t.Fatalf("%d entries, want %d", len(r.File), len(entries))
+	}
+	for i, f := range r.File {
+		want := entries[i]
+		// 名前、順序、圧縮方式、更新日時を保つ
+		if f.Name != want.name || f.Method != want.method || !f.Modified.Equal(modified) {
+			t.Errorf("entry %d: %s method %d modified %v, want %s method %d", i, f.Name, f.Method, f.Modified, want.name, want.method)
+		}
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := io.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		switch filepath.Ext(f.Name) {
+		case ".txt":
+			if !bytes.Equal(data, text) {
+				t.Errorf("%s changed: %q", f.Name, data)
+			}
+		case ".png", ".jpg":
+			img, format, err := image.Decode(bytes.NewReader(data))
+			if err != nil {
+				t.Fatalf("%s: %v", f.Name, err)
+			}
+			// 元の画像と同じ形式で書き出す
+			if wantFormat := map[string]string{".png": "png", ".jpg": "jpeg"}[filepath.Ext(f.Name)]; format != wantFormat {
+				t.Errorf("%s: written as %s, want %s", f.Name, format, wantFormat)
+			}
+			if bytes.Equal(data, want.data) {
+				t.Errorf("%s was not processed", f.Name)
+			}
+			if format == "png" {
+				if !isMosaic(mosaic.ConvertToNRGBA(img), 8) {
+					t.Errorf("%s is not a mosaic of 8px tiles", f.Name)
+				}
+			}
+		}
+	}
+}
+
+func TestZipBatchRequiresZipOutput(t *testing.T) {
+	in := filepath.Join(t.TempDir(), "photos.zip")
+	writeTestZip(t, in, time.Now(), nil)
+	res := runCLI(t, "batch", "-in", in, "-out", t.TempDir(), "-quiet")
+	if res.code != exitUsage {
+		t.Fatalf("exit code = %d, want %d", res.code, exitUsage)
+	}
+	if _, err := os.Stat(in); err != nil {
+		t.Fatal(err)
+	}
+}